@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogFields are the fields access log lines can be made of, in the
+// order of the default format:
+//
+//   - method, host, path, query, protocol: of the request
+//   - status: the status answered with
+//   - backend, backend_id: the server that answered
+//   - duration_ms, queue_wait_ms, ttfb_ms: timings in milliseconds
+//   - bytes_in, bytes_out: bytes of the request and response bodies
+//   - hijacked: whether the connection was upgraded
+//   - attempts, retries: upstream attempts, and attempts beyond the first
+//   - upstream: every attempt, with its status and timings
+//   - error_class: the class of the failure, if any
+//   - backend_override, faults, cache, idempotency, sticky: how the request
+//     was handled by those features
+//   - api_key, tenant, country: who the client is
+//   - time: when the request started, in RFC 3339
+//   - client_ip, user_agent, request_id: of the client and request
+//   - route: the name of the matching route
+//   - instance: the instance ID of the load balancer
+var accessLogFields = []string{
+	"method", "host", "path", "query", "protocol", "status", "backend", "backend_id",
+	"duration_ms", "queue_wait_ms", "ttfb_ms", "bytes_in", "bytes_out", "hijacked",
+	"attempts", "retries", "upstream", "error_class", "backend_override", "faults",
+	"cache", "idempotency", "api_key", "tenant", "country", "sticky",
+	"time", "client_ip", "user_agent", "request_id", "route", "instance",
+}
+
+// defaultAccessLogFields are the fields of the default format, which also
+// has the time, level, message and instance of every slog line.
+var defaultAccessLogFields = []string{
+	"method", "path", "protocol", "status", "backend", "backend_id", "duration_ms",
+	"queue_wait_ms", "ttfb_ms", "bytes_in", "bytes_out", "hijacked", "attempts",
+	"upstream", "error_class", "backend_override", "faults", "cache", "idempotency",
+	"api_key", "tenant", "country", "sticky",
+}
+
+// AccessLogFormat chooses what request lines of the access log hold.
+// Fields lists the fields of JSON lines, by default those of the slog
+// format. Template instead writes text lines, in which {field} is replaced
+// by the field's value, or "-" if it is empty, e.g.
+// "{client_ip} {method} {path} {status} {duration_ms}ms". Sampling thins
+// out fast successful requests. Connection lines of passthrough listeners
+// keep the default format.
+type AccessLogFormat struct {
+	Fields   []string
+	Template string
+	Sampling *AccessLogSampling
+}
+
+// AccessLogSampling logs every request failing or taking at least
+// SlowThreshold, if set, but only SuccessPercent percent of the others,
+// those answered with 2xx. Dropped lines are counted in
+// lb_access_log_lines_total so that totals can be derived.
+type AccessLogSampling struct {
+	SlowThreshold  time.Duration
+	SuccessPercent float64
+}
+
+// WithAccessLogFormat customizes the request lines of the access log set
+// with WithAccessLog. Unknown fields are rejected by NewLoadBalancer.
+func WithAccessLogFormat(f AccessLogFormat) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessFormat = &accessLogFormat{config: f, rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+	}
+}
+
+// accessLogFormat renders and samples the request lines of the access log.
+type accessLogFormat struct {
+	config   AccessLogFormat
+	template []accessLogSegment
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	out  io.Writer
+
+	logged  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// accessLogSegment is a literal or, if field is set, a field of a template.
+type accessLogSegment struct {
+	literal string
+	field   string
+}
+
+// init checks the fields of the format and parses its template.
+func (f *accessLogFormat) init() error {
+	if f.config.Template != "" && len(f.config.Fields) > 0 {
+		return fmt.Errorf("access log: fields and template are mutually exclusive")
+	}
+	for _, field := range f.config.Fields {
+		if !slices.Contains(accessLogFields, field) {
+			return fmt.Errorf("access log: unknown field %q", field)
+		}
+	}
+	rest := f.config.Template
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			f.template = append(f.template, accessLogSegment{literal: rest})
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("access log: unterminated field in template %q", f.config.Template)
+		}
+		field := rest[start+1 : start+end]
+		if !slices.Contains(accessLogFields, field) {
+			return fmt.Errorf("access log: unknown field %q in template", field)
+		}
+		f.template = append(f.template, accessLogSegment{literal: rest[:start]}, accessLogSegment{field: field})
+		rest = rest[start+end+1:]
+	}
+	if s := f.config.Sampling; s != nil && (s.SuccessPercent < 0 || s.SuccessPercent > 100 || s.SlowThreshold < 0) {
+		return fmt.Errorf("access log: success_percent must be between 0 and 100 and slow_threshold not negative")
+	}
+
+	return nil
+}
+
+// sample reports whether the line of a request answered with status after
+// duration is logged, counting the decision.
+func (f *accessLogFormat) sample(status int, duration time.Duration) bool {
+	s := f.config.Sampling
+	keep := s == nil || status < 200 || status >= 300 || s.SlowThreshold > 0 && duration >= s.SlowThreshold
+	if !keep {
+		f.mu.Lock()
+		keep = f.rand.Float64()*100 < s.SuccessPercent
+		f.mu.Unlock()
+	}
+	if keep {
+		f.logged.Add(1)
+	} else {
+		f.dropped.Add(1)
+	}
+
+	return keep
+}
+
+// custom reports whether lines are rendered by the format rather than by
+// the slog handler.
+func (f *accessLogFormat) custom() bool {
+	return f.config.Template != "" || len(f.config.Fields) > 0
+}
+
+// write renders a line of attrs, the values of every field, to the access
+// log.
+func (f *accessLogFormat) write(attrs map[string]slog.Value) error {
+	var b bytes.Buffer
+	if f.config.Template != "" {
+		for _, s := range f.template {
+			if s.field == "" {
+				b.WriteString(s.literal)
+				continue
+			}
+			v := attrs[s.field].Resolve()
+			switch {
+			case v.Kind() == slog.KindString && v.String() == "":
+				b.WriteByte('-')
+			case v.Kind() == slog.KindAny:
+				data, err := json.Marshal(v.Any())
+				if err != nil {
+					return err
+				}
+				b.Write(data)
+			default:
+				b.WriteString(v.String())
+			}
+		}
+	} else {
+		b.WriteByte('{')
+		for i, field := range f.config.Fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(field)
+			value, err := json.Marshal(attrs[field].Any())
+			if err != nil {
+				return err
+			}
+			b.Write(key)
+			b.WriteByte(':')
+			b.Write(value)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.out.Write(b.Bytes())
+
+	return err
+}
+
+func (f *accessLogFormat) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP lb_access_log_lines_total Request lines of the access log, by whether sampling kept them.")
+	fmt.Fprintln(w, "# TYPE lb_access_log_lines_total counter")
+	fmt.Fprintf(w, "lb_access_log_lines_total{result=\"logged\"} %d\n", f.logged.Load())
+	fmt.Fprintf(w, "lb_access_log_lines_total{result=\"dropped\"} %d\n", f.dropped.Load())
+}
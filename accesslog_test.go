@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFormattedLoadBalancer(t *testing.T, handler http.HandlerFunc, f AccessLogFormat) (*LoadBalancer, *syncBuffer) {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log), WithAccessLogFormat(f),
+		WithRoutes(Route{Name: "api", PathPrefix: "/api/"}))
+	lb.accessFormat.rand = rand.New(rand.NewPCG(1, 2))
+
+	return lb, log
+}
+
+func TestAccessLogFormat_Fields(t *testing.T) {
+	fields := []string{"time", "client_ip", "method", "path", "status", "route", "retries", "request_id"}
+	lb, log := newFormattedLoadBalancer(t, func(rw http.ResponseWriter, req *http.Request) {}, AccessLogFormat{Fields: fields})
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	lb.serveProxy(httptest.NewRecorder(), req)
+
+	entries := accessLogEntries(t, log)
+	if len(entries) != 1 {
+		t.Fatalf("Expected one line, got %d", len(entries))
+	}
+	var keys []string
+	for key := range entries[0] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	want := slices.Sorted(slices.Values(fields))
+	if !slices.Equal(keys, want) {
+		t.Errorf("Expected exactly fields %v, got %v", want, keys)
+	}
+	if e := entries[0]; e["client_ip"] != "192.0.2.1" || e["route"] != "api" || e["status"] != float64(200) ||
+		e["retries"] != float64(0) || e["request_id"] != "req-1" {
+		t.Errorf("Unexpected values %v", e)
+	}
+}
+
+func TestAccessLogFormat_Template(t *testing.T) {
+	lb, log := newFormattedLoadBalancer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}, AccessLogFormat{Template: "{client_ip} {method} {path}?{query} {status} {tenant} attempts={attempts}"})
+
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/users?page=2", nil))
+
+	if got, want := log.String(), "192.0.2.1 POST /api/users?page=2 201 - attempts=1\n"; got != want {
+		t.Errorf("Expected line %q, got %q", want, got)
+	}
+}
+
+func TestAccessLogFormat_Sampling(t *testing.T) {
+	lb, log := newFormattedLoadBalancer(t, func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		case "/api/fail":
+			rw.WriteHeader(http.StatusInternalServerError)
+		case "/api/slow":
+			time.Sleep(20 * time.Millisecond)
+		}
+	}, AccessLogFormat{
+		Fields:   []string{"path", "status"},
+		Sampling: &AccessLogSampling{SlowThreshold: 10 * time.Millisecond, SuccessPercent: 10},
+	})
+
+	const requests = 500
+	for range requests {
+		for _, path := range []string{"/api/ok", "/api/missing", "/api/fail"} {
+			lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/slow", nil))
+
+	counts := make(map[string]int)
+	for _, e := range accessLogEntries(t, log) {
+		counts[e["path"].(string)]++
+	}
+	if counts["/api/missing"] != requests || counts["/api/fail"] != requests || counts["/api/slow"] != 1 {
+		t.Errorf("Expected every error and slow request logged, got %v", counts)
+	}
+	if ok := counts["/api/ok"]; ok < requests*5/100 || ok > requests*15/100 {
+		t.Errorf("Expected about 10%% of %d successes logged, got %d", requests, ok)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	logged := 2*requests + 1 + counts["/api/ok"]
+	for _, want := range []string{
+		`lb_access_log_lines_total{result="logged"} ` + strconv.Itoa(logged),
+		`lb_access_log_lines_total{result="dropped"} ` + strconv.Itoa(3*requests+1-logged),
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestAccessLogFormat_UnknownField(t *testing.T) {
+	for _, f := range []AccessLogFormatConfig{
+		{Fields: []string{"method", "colour"}},
+		{Template: "{method} {colour}"},
+		{Template: "{method"},
+		{Fields: []string{"method"}, Template: "{method}"},
+	} {
+		cfg := &Config{AccessLogFormat: &f}
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected format %+v to be rejected", f)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// countingResponseWriter records the status code and the number of body
+// bytes actually written to the client, independent of any Content-Length
+// the backend announced. Connections hijacked through it (e.g. WebSocket
+// upgrades) keep counting bytes written to and read from the raw connection.
+// With stream set, responses that turn out to be streams are held to its
+// policy, and writes are serialized with the stream's own. With page set,
+// the load balancer's own error responses are rendered from the error
+// pages.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	written  atomic.Int64
+	read     atomic.Int64
+	hijacked bool
+	stream   *streamWatch
+	page     *pageRequest
+
+	// streams, if set, watches the response once it turns out to be an
+	// event stream from server, for requests not watched from the start.
+	streams *LoadBalancer
+	server  Server
+
+	// grpc is set for gRPC requests, whose failures are reported in
+	// grpc-status.
+	grpc bool
+}
+
+func newCountingResponseWriter(rw http.ResponseWriter) *countingResponseWriter {
+	return &countingResponseWriter{ResponseWriter: rw}
+}
+
+// countingWriterOf returns the countingResponseWriter rw is or wraps, or
+// nil.
+func countingWriterOf(rw http.ResponseWriter) *countingResponseWriter {
+	for rw != nil {
+		if cw, ok := rw.(*countingResponseWriter); ok {
+			return cw
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		rw = u.Unwrap()
+	}
+
+	return nil
+}
+
+// attach records server as the server the response comes from.
+func (w *countingResponseWriter) attach(server Server) {
+	w.server = server
+	w.stream.attach(server)
+}
+
+// watchEventStream watches the event stream about to be written unless the
+// request is watched already; closing body cuts it off.
+func (w *countingResponseWriter) watchEventStream(body *classifyingBody) {
+	if w.stream != nil || w.streams == nil {
+		return
+	}
+	w.stream = w.streams.watchEventStream(w, w.server, body.cut)
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.stream != nil {
+		w.stream.writeMu.Lock()
+		defer w.stream.writeMu.Unlock()
+		if w.stream.cutOff {
+			return
+		}
+	}
+	if w.status == 0 {
+		w.status = status
+		if w.stream != nil {
+			w.stream.responding(status, w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.stream != nil {
+		w.stream.writeMu.Lock()
+		defer w.stream.writeMu.Unlock()
+		if w.stream.cutOff {
+			return 0, errStreamClosed
+		}
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+		if w.stream != nil {
+			w.stream.responding(w.status, w.Header())
+		}
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written.Add(int64(n))
+	if w.stream != nil && n > 0 {
+		w.stream.touch()
+	}
+
+	return n, err
+}
+
+// Status returns the status code sent to the client, or 200 when the handler
+// never wrote one explicitly.
+func (w *countingResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+func (w *countingResponseWriter) Flush() {
+	if w.stream != nil {
+		w.stream.writeMu.Lock()
+		defer w.stream.writeMu.Unlock()
+		if w.stream.cutOff {
+			return
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	var counted net.Conn = &countingConn{Conn: conn, read: &w.read, written: &w.written}
+	if w.stream != nil {
+		counted = w.stream.upgraded(counted)
+	}
+
+	// Keep client bytes the server already buffered in front of the conn.
+	var r io.Reader = counted
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		w.read.Add(int64(n))
+		r = io.MultiReader(bytes.NewReader(buffered), counted)
+	}
+
+	return counted, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(counted)), nil
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+
+	return n, err
+}
+
+// countingConn counts bytes flowing through a hijacked connection.
+type countingConn struct {
+	net.Conn
+	read    *atomic.Int64
+	written *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+
+	return n, err
+}
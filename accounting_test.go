@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// accessLogEntries decodes every JSON line written to the access log.
+func accessLogEntries(t *testing.T, log *syncBuffer) []map[string]any {
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid access log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// newProxiedBackend starts a backend with handler and a load balancer in
+// front of it that writes its access log to the returned buffer.
+func newProxiedBackend(t *testing.T, handler http.HandlerFunc) (*LoadBalancer, *httptest.Server, *syncBuffer) {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log))
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	t.Cleanup(front.Close)
+
+	return lb, front, log
+}
+
+func TestAccounting_RequestAndResponseBytes(t *testing.T) {
+	lb, front, log := newProxiedBackend(t, func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		rw.Write(bytes.Repeat([]byte("r"), 2500))
+	})
+
+	resp, err := http.Post(front.URL, "text/plain", bytes.NewReader(bytes.Repeat([]byte("q"), 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	entries := accessLogEntries(t, log)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 access log entry, got %d", len(entries))
+	}
+	if entries[0]["bytes_in"] != 1000.0 || entries[0]["bytes_out"] != 2500.0 {
+		t.Errorf("Expected 1000 bytes in and 2500 out, got %v and %v", entries[0]["bytes_in"], entries[0]["bytes_out"])
+	}
+
+	stats := lb.Stats()[0]
+	if stats.BytesIn != 1000 || stats.BytesOut != 2500 {
+		t.Errorf("Expected cumulative 1000/2500 bytes, got %d/%d", stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestAccounting_ChunkedResponse(t *testing.T) {
+	lb, front, log := newProxiedBackend(t, func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 3; i++ {
+			rw.Write(bytes.Repeat([]byte("c"), 1000))
+			rw.(http.Flusher).Flush()
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.TransferEncoding) == 0 {
+			t.Errorf("Expected a chunked response")
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	for _, entry := range accessLogEntries(t, log) {
+		if entry["bytes_out"] != 3000.0 || entry["bytes_in"] != 0.0 {
+			t.Errorf("Expected 0 bytes in and 3000 out, got %v and %v", entry["bytes_in"], entry["bytes_out"])
+		}
+	}
+	if stats := lb.Stats()[0]; stats.BytesOut != 6000 {
+		t.Errorf("Expected cumulative 6000 bytes out, got %d", stats.BytesOut)
+	}
+}
+
+func TestAccounting_HijackedConnection(t *testing.T) {
+	lb, front, log := newProxiedBackend(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Connection", "Upgrade")
+		rw.Header().Set("Upgrade", "echo")
+		rw.WriteHeader(http.StatusSwitchingProtocols)
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, brw)
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %v, %v", resp, err)
+	}
+	io.WriteString(conn, "hello")
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "hello" {
+		t.Fatalf("Expected echo of hello, got %q, %v", echo, err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lb.Stats()[0].BytesIn == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	entries := accessLogEntries(t, log)
+	if len(entries) != 1 || entries[0]["hijacked"] != true {
+		t.Fatalf("Expected one hijacked access log entry, got %v", entries)
+	}
+	if entries[0]["bytes_in"] != 5.0 {
+		t.Errorf("Expected 5 bytes read from the hijacked connection, got %v", entries[0]["bytes_in"])
+	}
+	if out := entries[0]["bytes_out"].(float64); out <= 5 {
+		t.Errorf("Expected the 101 response and echo to be counted, got %v", out)
+	}
+}
+
+func TestAccounting_Protocol(t *testing.T) {
+	lb, front, log := newProxiedBackend(t, okHandler)
+	tlsFront := httptest.NewUnstartedServer(http.HandlerFunc(lb.serveProxy))
+	tlsFront.EnableHTTP2 = true
+	tlsFront.StartTLS()
+	defer tlsFront.Close()
+
+	for _, get := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return http.Get(front.URL) },
+		func() (*http.Response, error) { return tlsFront.Client().Get(tlsFront.URL) },
+	} {
+		resp, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	entries := accessLogEntries(t, log)
+	if len(entries) != 2 || entries[0]["protocol"] != "HTTP/1.1" || entries[1]["protocol"] != "HTTP/2.0" {
+		t.Errorf("Expected the client protocol of each request to be logged, got %v", entries)
+	}
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_requests_total{protocol="HTTP/1.1"} 1`, `lb_requests_total{protocol="HTTP/2.0"} 1`} {
+		if !strings.Contains(metrics.Body.String(), want+"\n") {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
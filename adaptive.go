@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	defaultAdaptiveInterval    = 30 * time.Second
+	defaultAdaptiveFloor       = 0.25
+	defaultAdaptiveCap         = 2
+	defaultAdaptiveMaxStep     = 0.1
+	defaultAdaptiveMinRequests = 20
+)
+
+// adaptiveWeightScale converts effective weights to the integer weights of
+// candidates, so a factor of 0.5 on weight 1 still orders below 1.
+const adaptiveWeightScale = 100
+
+// AdaptiveWeights adjusts the weights of servers to their recent
+// performance. Every Interval, 30s by default, each server's p95 latency and
+// error rate over the interval are compared with the pool medians: a server
+// twice as fast as the median targets twice its configured weight, one with
+// twice the median error rate half of it. The resulting factor on the
+// configured weight is bounded by Floor, 0.25 by default, and Cap, 2 by
+// default, and moves by at most MaxStep, 0.1 by default, per interval so
+// weights settle instead of oscillating. Servers that completed fewer than
+// MinRequests requests in the interval, 20 by default, keep their factor.
+// Weights never reach zero; taking servers out is left to health checks.
+// They affect the strategies that weigh servers, such as
+// weighted-least-connections.
+type AdaptiveWeights struct {
+	Interval    time.Duration
+	Floor       float64
+	Cap         float64
+	MaxStep     float64
+	MinRequests uint64
+}
+
+// WithAdaptiveWeights enables adaptive weights. They are adjusted while
+// RunWeightAdjustment runs.
+func WithAdaptiveWeights(a AdaptiveWeights) Option {
+	return func(lb *LoadBalancer) {
+		if a.Interval <= 0 {
+			a.Interval = defaultAdaptiveInterval
+		}
+		if a.Floor <= 0 {
+			a.Floor = defaultAdaptiveFloor
+		}
+		if a.Cap <= 0 {
+			a.Cap = defaultAdaptiveCap
+		}
+		if a.MaxStep <= 0 {
+			a.MaxStep = defaultAdaptiveMaxStep
+		}
+		if a.MinRequests == 0 {
+			a.MinRequests = defaultAdaptiveMinRequests
+		}
+		lb.adaptive = &weightController{
+			config:  a,
+			factors: make(map[string]float64),
+			last:    make(map[string]adaptiveSample),
+		}
+	}
+}
+
+// weightController holds the weight factors of servers and the counters
+// they were last adjusted from. It is guarded by lb.mu.
+type weightController struct {
+	config  AdaptiveWeights
+	factors map[string]float64
+	last    map[string]adaptiveSample
+}
+
+// adaptiveSample is a reading of a server's cumulative counters.
+type adaptiveSample struct {
+	counts    []uint64
+	completed uint64
+	errors    uint64
+}
+
+// factor returns the weight factor of the server with the given name.
+func (c *weightController) factor(addr string) float64 {
+	if f, ok := c.factors[addr]; ok {
+		return f
+	}
+
+	return 1
+}
+
+// RunWeightAdjustment adjusts the weights of servers at the configured
+// interval until ctx is done. It returns at once without adaptive weights.
+func (lb *LoadBalancer) RunWeightAdjustment(ctx context.Context) {
+	if lb.adaptive == nil {
+		return
+	}
+	ticker := time.NewTicker(lb.adaptive.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			markActive(ctx)
+			lb.adjustWeights()
+		}
+	}
+}
+
+// adjustWeights moves the weight factor of every server toward its target
+// for the requests completed since the previous adjustment.
+func (lb *LoadBalancer) adjustWeights() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.adaptive
+	type reading struct {
+		addr        string
+		p95, errors float64
+	}
+	var readings []reading
+	for _, s := range lb.servers {
+		addr := serverName(s)
+		counters := lb.countersFor(addr)
+		state := counters.latency.state()
+		now := adaptiveSample{counts: state.Counts, completed: state.Count, errors: counters.errors}
+		prev, ok := c.last[addr]
+		c.last[addr] = now
+		if !ok || now.completed < prev.completed || now.errors < prev.errors {
+			// No baseline yet, or the counters were restored from state
+			continue
+		}
+		completed := now.completed - prev.completed
+		if completed < c.config.MinRequests {
+			continue
+		}
+		counts := make([]uint64, len(now.counts))
+		for i := range counts {
+			counts[i] = now.counts[i] - prev.counts[i]
+		}
+		readings = append(readings, reading{
+			addr:   addr,
+			p95:    quantile(state.Buckets, counts, completed, 0.95),
+			errors: float64(now.errors-prev.errors) / float64(completed),
+		})
+	}
+	if len(readings) < 2 {
+		return
+	}
+
+	latencies := make([]float64, len(readings))
+	errorRates := make([]float64, len(readings))
+	for i, r := range readings {
+		latencies[i], errorRates[i] = r.p95, r.errors
+	}
+	medianLatency, medianErrors := median(latencies), median(errorRates)
+	for _, r := range readings {
+		target := 1.0
+		if r.p95 > 0 {
+			target = medianLatency / r.p95
+		}
+		// Error rates are compared by their success rates so a clean pool
+		// does not divide by zero.
+		if medianErrors < 1 {
+			target *= (1 - r.errors) / (1 - medianErrors)
+		}
+		target = math.Max(c.config.Floor, math.Min(c.config.Cap, target))
+
+		f := c.factor(r.addr)
+		step := math.Max(-c.config.MaxStep, math.Min(c.config.MaxStep, target-f))
+		c.factors[r.addr] = f + step
+	}
+}
+
+// median returns the median of values, which must not be empty. It sorts
+// values.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// ResetWeights returns every server to its configured weight. It does
+// nothing without adaptive weights.
+func (lb *LoadBalancer) ResetWeights() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.adaptive != nil {
+		clear(lb.adaptive.factors)
+	}
+}
+
+// effectiveWeightLocked returns the weight server is selected with: its
+// configured weight, scaled by its factor with adaptive weights. lb.mu must
+// be held.
+func (lb *LoadBalancer) effectiveWeightLocked(server Server) int {
+	weight := serverWeight(server)
+	if lb.adaptive == nil {
+		return weight
+	}
+	scaled := float64(weight) * lb.adaptive.factor(serverName(server)) * adaptiveWeightScale
+
+	return int(math.Round(scaled))
+}
+
+// handleResetWeights returns every server to its configured weight.
+func (lb *LoadBalancer) handleResetWeights(rw http.ResponseWriter, req *http.Request) {
+	lb.ResetWeights()
+	rw.WriteHeader(http.StatusNoContent)
+}
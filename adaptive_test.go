@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// observeRequests adds n completed requests taking latency, errors of them
+// failed, to the counters of the server with the given address.
+func observeRequests(lb *LoadBalancer, addr string, n int, latency time.Duration, errors int) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(addr)
+	for i := 0; i < n; i++ {
+		c.latency.Observe(latency)
+	}
+	c.errors += uint64(errors)
+}
+
+func TestAdaptiveWeights_Adjustment(t *testing.T) {
+	fast := &MockServer{addr: "http://fast.com", isAlive: true}
+	median := &MockServer{addr: "http://median.com", isAlive: true}
+	slow := &MockServer{addr: "http://slow.com", isAlive: true}
+	flaky := &MockServer{addr: "http://flaky.com", isAlive: true}
+	quiet := &MockServer{addr: "http://quiet.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{fast, median, slow, flaky, quiet}, WithAdaptiveWeights(AdaptiveWeights{}))
+
+	// p95 latencies of 10ms, 25ms, 50ms and 25ms with a third failing
+	interval := func() {
+		observeRequests(lb, fast.addr, 100, 10*time.Millisecond, 0)
+		observeRequests(lb, median.addr, 100, 25*time.Millisecond, 0)
+		observeRequests(lb, slow.addr, 100, 50*time.Millisecond, 0)
+		observeRequests(lb, flaky.addr, 90, 25*time.Millisecond, 30)
+		observeRequests(lb, quiet.addr, 5, time.Second, 0)
+		lb.adjustWeights()
+	}
+	factors := func() map[string]float64 {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		got := make(map[string]float64)
+		for _, s := range lb.servers {
+			got[s.Address()] = lb.adaptive.factor(s.Address())
+		}
+		return got
+	}
+
+	// The first tick only takes a baseline
+	interval()
+	prev := factors()
+	for addr, f := range prev {
+		if f != 1 {
+			t.Errorf("Expected %s to keep its weight after the baseline, got %f", addr, f)
+		}
+	}
+
+	for tick := 0; tick < 20; tick++ {
+		interval()
+		got := factors()
+		for addr, f := range got {
+			if f < 0.25 || f > 2 || math.Abs(f-prev[addr]) > 0.1+1e-9 {
+				t.Fatalf("Tick %d: %s moved from %f to %f", tick, addr, prev[addr], f)
+			}
+		}
+		prev = got
+	}
+
+	// Faster servers reach the cap, slower ones settle near their target;
+	// p95 latencies are interpolated within histogram buckets
+	want := map[string]float64{
+		fast.addr:   2,
+		median.addr: 1,
+		slow.addr:   0.5,
+		flaky.addr:  2.0 / 3,
+		quiet.addr:  1,
+	}
+	for addr, f := range want {
+		if math.Abs(prev[addr]-f) > 0.01 {
+			t.Errorf("Expected %s to converge to %f, got %f", addr, f, prev[addr])
+		}
+	}
+
+	// Converged weights hold still
+	interval()
+	for addr, f := range factors() {
+		if f != prev[addr] {
+			t.Errorf("Expected %s to stay at %f, got %f", addr, prev[addr], f)
+		}
+	}
+}
+
+func TestAdaptiveWeights_SelectionAndReset(t *testing.T) {
+	fast := &MockServer{addr: "http://fast.com", isAlive: true}
+	slow := &MockServer{addr: "http://slow.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{fast, slow},
+		WithStrategy(&weightedLeastConnections{}),
+		WithAdaptiveWeights(AdaptiveWeights{MaxStep: 1, Floor: 0.75}))
+
+	for i := 0; i < 2; i++ {
+		observeRequests(lb, fast.addr, 50, 5*time.Millisecond, 0)
+		observeRequests(lb, slow.addr, 50, 500*time.Millisecond, 0)
+		lb.adjustWeights()
+	}
+	stats := lb.Stats()
+	if w := stats[0].EffectiveWeight; w == nil || *w != 2 {
+		t.Errorf("Expected the fast server at twice its weight, got %v", w)
+	}
+	if w := stats[1].EffectiveWeight; w == nil || *w != 0.75 {
+		t.Errorf("Expected the slow server at the floor, got %v", w)
+	}
+
+	// Weighted 2 to 0.75, the fast server takes requests beyond twice the
+	// slow server's in flight
+	lb.mu.Lock()
+	lb.countersFor(fast.addr).inFlight = 2
+	lb.countersFor(slow.addr).inFlight = 1
+	lb.mu.Unlock()
+	if s, err := lb.getNextAvailableServer(); err != nil || s != fast {
+		t.Errorf("Expected the fast server below its share, got %v %v", s, err)
+	}
+
+	rw := postAdmin(lb, "/admin/weights/reset", "")
+	if rw.Code != 204 {
+		t.Fatalf("Expected the reset to succeed, got %d", rw.Code)
+	}
+	if w := lb.Stats()[0].EffectiveWeight; w == nil || *w != 1 {
+		t.Errorf("Expected the configured weight after reset, got %v", w)
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if body := metrics.Body.String(); !strings.Contains(body, `lb_server_effective_weight{server="http://fast.com"} 1`) {
+		t.Errorf("Expected the effective weight in the metrics, got:\n%s", body)
+	}
+}
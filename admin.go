@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AdminHandler returns the handler serving the administrative API:
+//
+//	GET  /admin/status          snapshot of every server, the log level,
+//	                            the fairness scores and the background
+//	                            workers
+//	GET  /admin/dump            human-readable state dump
+//	GET  /admin/config          effective configuration, secrets redacted
+//	GET  /admin/stats.csv       snapshot of every server as CSV
+//	POST /admin/servers         add a server
+//	PUT  /admin/servers/labels  replace a server's labels
+//	PUT  /admin/servers/address move a server to another address, keeping
+//	                            its name
+//	POST /admin/drain           take a server out of selection, at once or
+//	                            fading out, optionally waiting for its
+//	                            requests to complete
+//	POST /admin/undrain         return a drained server to selection
+//	POST /admin/backends/health pin a server up or down, or return it to
+//	                            its probes
+//	POST /admin/weights/reset   return servers to their configured weights
+//	GET  /admin/mirror          comparison report of mirrored requests
+//	POST /admin/mirror/reset    clear the comparison report
+//	GET  /admin/fairness        per-window selection counts and imbalance
+//	GET  /admin/events          pool events as server-sent events
+//	GET  /admin/errors          the last upstream errors in full, newest
+//	                            first
+//	GET  /lb/pools/{name}/health whether the pool has its minimum of
+//	                            healthy servers and fresh probe data
+//	GET  /admin/ramp            state and decisions of the traffic ramp
+//	POST /admin/ramp/{action}   pause, resume or abort the ramp
+//	PUT  /admin/loglevel        change the log level or toggle the access log
+//	POST /admin/config/pin      pin the configuration to a version pulled
+//	                            from the control plane
+//	DELETE /admin/config/pin    resume applying pulled configurations
+//	POST /admin/gossip          apply a server health message from a peer
+//	GET  /metrics               metrics in Prometheus text format
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/status", lb.handleStatus)
+	mux.HandleFunc("GET /admin/dump", lb.handleDump)
+	mux.HandleFunc("GET /admin/config", lb.handleConfig)
+	mux.HandleFunc("GET /admin/stats.csv", lb.handleStatsCSV)
+	mux.HandleFunc("POST /admin/servers", lb.handleAddServer)
+	mux.HandleFunc("PUT /admin/servers/labels", lb.handleSetLabels)
+	mux.HandleFunc("PUT /admin/servers/address", lb.handleSetAddress)
+	mux.HandleFunc("POST /admin/drain", lb.handleDrain)
+	mux.HandleFunc("POST /admin/undrain", lb.handleUndrain)
+	mux.HandleFunc("POST /admin/backends/health", lb.handleHealthOverride)
+	mux.HandleFunc("POST /admin/weights/reset", lb.handleResetWeights)
+	mux.HandleFunc("GET /admin/mirror", lb.handleMirror)
+	mux.HandleFunc("POST /admin/mirror/reset", lb.handleMirrorReset)
+	mux.HandleFunc("GET /admin/fairness", lb.handleFairness)
+	mux.HandleFunc("GET /admin/events", lb.handleEvents)
+	mux.HandleFunc("GET /admin/errors", lb.handleErrors)
+	mux.HandleFunc("GET /lb/pools/{name}/health", lb.handlePoolHealth)
+	mux.HandleFunc("GET /admin/ramp", lb.handleRamp)
+	mux.HandleFunc("POST /admin/ramp/{action}", lb.handleRampControl)
+	mux.HandleFunc("PUT /admin/loglevel", lb.handleSetLogLevel)
+	mux.HandleFunc("POST /admin/config/pin", lb.handlePinConfig)
+	mux.HandleFunc("DELETE /admin/config/pin", lb.handleUnpinConfig)
+	mux.HandleFunc("POST "+gossipPath, lb.handleGossip)
+	mux.HandleFunc("GET /metrics", lb.handleMetrics)
+
+	return mux
+}
+
+func (lb *LoadBalancer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	status := map[string]any{"servers": lb.Stats(), "logging": lb.logStatus(), "workers": lb.Workers()}
+	if lb.fairness != nil {
+		status["fairness"] = lb.fairness.status(lb.now())
+	}
+	if lb.control != nil {
+		status["control_plane"] = lb.control.status(lb.now())
+	}
+	writeJSON(rw, http.StatusOK, status)
+}
+
+func (lb *LoadBalancer) handleAddServer(rw http.ResponseWriter, req *http.Request) {
+	var sc ServerConfig
+	if err := json.NewDecoder(req.Body).Decode(&sc); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+
+	server, err := newServerFromConfig(sc.withDefaults(lb.serverDefaults), lb.serverOptions()...)
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err := lb.AddServer(server); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// handleSetLabels replaces the labels of the server given by name or,
+// without one, by address.
+func (lb *LoadBalancer) handleSetLabels(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name    string            `json:"name"`
+		Address string            `json:"address"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	ref := body.Name
+	if ref == "" {
+		ref = body.Address
+	}
+
+	if err := lb.SetServerLabels(ref, body.Labels); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetAddress moves the server with the given name to a new address:
+//
+//	{"name": "api-1", "address": "http://10.0.0.7:8080"}
+func (lb *LoadBalancer) handleSetAddress(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	if body.Name == "" || body.Address == "" {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("name and address are required"))
+		return
+	}
+
+	if err := lb.SetServerAddress(body.Name, body.Address); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetLogLevel changes the runtime logging settings. The body sets the
+// level, optionally only for a duration such as "5m", and/or turns the
+// access log on or off:
+//
+//	{"level": "debug", "duration": "5m", "access_log": false}
+func (lb *LoadBalancer) handleSetLogLevel(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Level     *slog.Level `json:"level"`
+		Duration  Duration    `json:"duration"`
+		AccessLog *bool       `json:"access_log"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	if body.Level == nil && body.AccessLog == nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("nothing to change: set level or access_log"))
+		return
+	}
+	if body.Duration < 0 || (body.Duration > 0 && body.Level == nil) {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("duration must be positive and requires a level"))
+		return
+	}
+
+	if body.Level != nil {
+		lb.SetLogLevel(*body.Level, time.Duration(body.Duration))
+	}
+	if body.AccessLog != nil {
+		lb.SetAccessLog(*body.AccessLog)
+	}
+	writeJSON(rw, http.StatusOK, lb.logStatus())
+}
+
+// handlePinConfig pins the configuration to a version kept from the
+// control plane:
+//
+//	{"version": "2024-06-01.3"}
+func (lb *LoadBalancer) handlePinConfig(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	if body.Version == "" {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("version is required"))
+		return
+	}
+
+	if err := lb.PinConfigVersion(body.Version); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, lb.control.status(lb.now()))
+}
+
+func (lb *LoadBalancer) handleUnpinConfig(rw http.ResponseWriter, req *http.Request) {
+	if err := lb.UnpinConfigVersion(); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON encodes v as the JSON response body with the given status.
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// writeJSONError reports err as a JSON object with the given status.
+func writeJSONError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
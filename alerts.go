@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAlertWindow      = time.Minute
+	defaultAlertMinRequests = 10
+)
+
+// AlertRule is a threshold on the servers matching Selector, or every
+// server without one, checked once per window. Exactly one condition is
+// set:
+//
+//   - LatencyP95: a server's p95 latency over the window is above it;
+//   - ErrorRate: the fraction of a server's requests that failed in the
+//     window is above it;
+//   - MinHealthy: fewer of the servers are alive.
+//
+// Latency and error rates are only judged for servers that completed
+// MinRequests requests in the window, 10 by default, so that a quiet server
+// neither fires nor resolves on a handful of requests.
+//
+// The rule fires once its condition held for For consecutive windows, 1 by
+// default, and resolves at the first window it no longer holds. After
+// firing, the rule does not fire again for the same server or pool within
+// Cooldown, even if it resolved meanwhile.
+type AlertRule struct {
+	Name     string
+	Selector Selector
+
+	LatencyP95 time.Duration
+	ErrorRate  float64
+	MinHealthy int
+
+	For         int
+	Cooldown    time.Duration
+	MinRequests uint64
+}
+
+// condition names the condition of the rule.
+func (r *AlertRule) condition() string {
+	switch {
+	case r.LatencyP95 > 0:
+		return "latency_p95"
+	case r.ErrorRate > 0:
+		return "error_rate"
+	default:
+		return "min_healthy"
+	}
+}
+
+// Alerts evaluates alert rules over consecutive windows of Window, one
+// minute by default, while RunAlerts runs. Alerts firing and resolving are
+// published as EventAlertFired and EventAlertResolved, carrying the Alert.
+type Alerts struct {
+	Window time.Duration
+	Rules  []AlertRule
+}
+
+// WithAlerts enables alert rules.
+func WithAlerts(a Alerts) Option {
+	return func(lb *LoadBalancer) {
+		lb.alerts.set(a)
+	}
+}
+
+// Alert describes a rule firing or resolving: the server, or for
+// MinHealthy rules the pool named by the rule's selector, the value observed
+// in the last window and the threshold it was held against. Latencies are
+// in seconds.
+type Alert struct {
+	Rule      string   `json:"rule"`
+	Condition string   `json:"condition"`
+	Backend   string   `json:"backend,omitempty"`
+	Pool      string   `json:"pool,omitempty"`
+	Observed  float64  `json:"observed"`
+	Threshold float64  `json:"threshold"`
+	Window    Duration `json:"window"`
+	Windows   int      `json:"windows"`
+}
+
+// alertReading is a server's activity over one window.
+type alertReading struct {
+	server    string
+	labels    map[string]string
+	alive     bool
+	completed uint64
+	errors    uint64
+	p95       float64
+}
+
+// alertWindow is the activity of the pool over the window ending at end.
+type alertWindow struct {
+	end     time.Time
+	servers []alertReading
+}
+
+// alertObservation is the value a rule observed for one server or pool.
+type alertObservation struct {
+	backend  string
+	value    float64
+	breached bool
+}
+
+// observe returns the values of rule in w. Servers with too few requests to
+// judge are left out.
+func (r *AlertRule) observe(w alertWindow) []alertObservation {
+	if r.MinHealthy > 0 {
+		healthy := 0
+		for _, s := range w.servers {
+			if s.alive && r.Selector.Matches(s.labels) {
+				healthy++
+			}
+		}
+		return []alertObservation{{value: float64(healthy), breached: healthy < r.MinHealthy}}
+	}
+
+	var observed []alertObservation
+	for _, s := range w.servers {
+		if !r.Selector.Matches(s.labels) || s.completed < r.MinRequests {
+			continue
+		}
+		o := alertObservation{backend: s.server}
+		if r.LatencyP95 > 0 {
+			o.value = s.p95
+			o.breached = s.p95 > r.LatencyP95.Seconds()
+		} else {
+			o.value = float64(s.errors) / float64(s.completed)
+			o.breached = o.value > r.ErrorRate
+		}
+		observed = append(observed, o)
+	}
+
+	return observed
+}
+
+// threshold returns the threshold of the rule, in the unit of its values.
+func (r *AlertRule) threshold() float64 {
+	switch {
+	case r.LatencyP95 > 0:
+		return r.LatencyP95.Seconds()
+	case r.ErrorRate > 0:
+		return r.ErrorRate
+	default:
+		return float64(r.MinHealthy)
+	}
+}
+
+// alertKey identifies the alert of a rule for one server, or its pool.
+type alertKey struct {
+	rule, backend string
+}
+
+// alertState tracks the alert of a rule for one server or pool.
+type alertState struct {
+	breached int
+	firing   bool
+	fired    time.Time
+	alert    Alert
+}
+
+// alertEvaluator holds the alert rules and the state of their alerts.
+type alertEvaluator struct {
+	mu     sync.Mutex
+	config Alerts
+	states map[alertKey]*alertState
+
+	// last holds the cumulative counters of every server at the end of the
+	// previous window.
+	last map[string]adaptiveSample
+}
+
+func newAlertEvaluator() *alertEvaluator {
+	return &alertEvaluator{
+		config: Alerts{Window: defaultAlertWindow},
+		states: make(map[alertKey]*alertState),
+		last:   make(map[string]adaptiveSample),
+	}
+}
+
+// set replaces the rules, filling in their defaults. Alerts of rules that
+// keep their name keep their state; those of removed rules resolve with the
+// next window.
+func (e *alertEvaluator) set(a Alerts) {
+	if a.Window <= 0 {
+		a.Window = defaultAlertWindow
+	}
+	a.Rules = slices.Clone(a.Rules)
+	for i := range a.Rules {
+		if a.Rules[i].For <= 0 {
+			a.Rules[i].For = 1
+		}
+		if a.Rules[i].MinRequests == 0 {
+			a.Rules[i].MinRequests = defaultAlertMinRequests
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.config = a
+}
+
+// window returns the length of the windows.
+func (e *alertEvaluator) window() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.config.Window
+}
+
+// evaluate applies the rules to w and returns the events of the alerts that
+// fired or resolved, in the order of the rules and servers.
+func (e *alertEvaluator) evaluate(w alertWindow) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var events []Event
+	seen := make(map[alertKey]bool)
+	for i := range e.config.Rules {
+		rule := &e.config.Rules[i]
+		for _, o := range rule.observe(w) {
+			key := alertKey{rule.Name, o.backend}
+			seen[key] = true
+			s := e.states[key]
+			if s == nil {
+				s = &alertState{}
+				e.states[key] = s
+			}
+			s.alert = Alert{
+				Rule:      rule.Name,
+				Condition: rule.condition(),
+				Backend:   o.backend,
+				Observed:  o.value,
+				Threshold: rule.threshold(),
+				Window:    Duration(e.config.Window),
+			}
+			if o.backend == "" {
+				s.alert.Pool = rule.Selector.String()
+			}
+			if !o.breached {
+				s.breached = 0
+				if s.firing {
+					s.firing = false
+					events = append(events, alertEvent(EventAlertResolved, s.alert, w.end))
+				}
+				continue
+			}
+			s.breached++
+			s.alert.Windows = s.breached
+			if s.firing || s.breached < rule.For {
+				continue
+			}
+			if !s.fired.IsZero() && w.end.Sub(s.fired) < rule.Cooldown {
+				continue
+			}
+			s.firing, s.fired = true, w.end
+			events = append(events, alertEvent(EventAlertFired, s.alert, w.end))
+		}
+	}
+	events = append(events, e.forgetLocked(w, seen)...)
+
+	return events
+}
+
+// forgetLocked drops the alerts of rules that were removed and of servers
+// that left the pool, resolving those that fired. Servers that were only
+// too quiet to judge in w keep their alerts. e.mu must be held.
+func (e *alertEvaluator) forgetLocked(w alertWindow, seen map[alertKey]bool) []Event {
+	rules := make(map[string]bool, len(e.config.Rules))
+	for _, r := range e.config.Rules {
+		rules[r.Name] = true
+	}
+	servers := make(map[string]bool, len(w.servers))
+	for _, s := range w.servers {
+		servers[s.server] = true
+	}
+
+	var gone []alertKey
+	for key := range e.states {
+		if !seen[key] && (!rules[key.rule] || key.backend != "" && !servers[key.backend]) {
+			gone = append(gone, key)
+		}
+	}
+	slices.SortFunc(gone, func(a, b alertKey) int {
+		return strings.Compare(a.rule+"\x00"+a.backend, b.rule+"\x00"+b.backend)
+	})
+	var events []Event
+	for _, key := range gone {
+		if s := e.states[key]; s.firing {
+			events = append(events, alertEvent(EventAlertResolved, s.alert, w.end))
+		}
+		delete(e.states, key)
+	}
+
+	return events
+}
+
+// alertEvent returns the event of alert firing or resolving at t.
+func alertEvent(kind EventType, alert Alert, t time.Time) Event {
+	return Event{Type: kind, Time: t, Backend: alert.Backend, Reason: alert.Rule, Alert: &alert}
+}
+
+// alertWindow reads the activity of every server since the previous window.
+// The first window of a server starts with its counters at zero.
+func (lb *LoadBalancer) alertWindow() alertWindow {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	now := lb.now()
+	w := alertWindow{end: now}
+	e := lb.alerts
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	current := make(map[string]adaptiveSample, len(lb.servers))
+	for _, s := range lb.servers {
+		name := serverName(s)
+		c := lb.countersFor(name)
+		state := c.latency.state()
+		sample := adaptiveSample{counts: state.Counts, completed: state.Count, errors: c.errors}
+		current[name] = sample
+		r := alertReading{server: name, labels: serverLabels(s), alive: lb.aliveLocked(s, now)}
+		prev, ok := e.last[name]
+		if !ok || sample.completed < prev.completed || sample.errors < prev.errors {
+			prev = adaptiveSample{counts: make([]uint64, len(sample.counts))}
+		}
+		r.completed, r.errors = sample.completed-prev.completed, sample.errors-prev.errors
+		counts := make([]uint64, len(sample.counts))
+		for i := range counts {
+			counts[i] = sample.counts[i] - prev.counts[i]
+		}
+		r.p95 = quantile(state.Buckets, counts, r.completed, 0.95)
+		w.servers = append(w.servers, r)
+	}
+	e.last = current
+
+	return w
+}
+
+// SetAlerts replaces the alert rules, as configuration reloads do.
+func (lb *LoadBalancer) SetAlerts(a Alerts) {
+	lb.alerts.set(a)
+}
+
+// RunAlerts evaluates the alert rules at the end of every window until ctx
+// is done, publishing and logging the alerts that fire or resolve.
+func (lb *LoadBalancer) RunAlerts(ctx context.Context) {
+	lb.alertWindow()
+	for {
+		timer := time.NewTimer(lb.alerts.window())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		markActive(ctx)
+		for _, event := range lb.alerts.evaluate(lb.alertWindow()) {
+			a := event.Alert
+			fmt.Printf("alert %s %s: %s of %s is %g, threshold %g\n", a.Rule, strings.TrimPrefix(string(event.Type), "alert_"), a.Condition, alertSubject(a), a.Observed, a.Threshold)
+			lb.events.publish(event)
+		}
+	}
+}
+
+// alertSubject names the server or pool of a for logs.
+func alertSubject(a *Alert) string {
+	switch {
+	case a.Backend != "":
+		return a.Backend
+	case a.Pool != "":
+		return "pool " + a.Pool
+	default:
+		return "the pool"
+	}
+}
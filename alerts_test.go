@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// alertSequence feeds windows to e and returns the events of each.
+type alertSequence struct {
+	t   *testing.T
+	e   *alertEvaluator
+	now time.Time
+}
+
+// next evaluates a window of readings a minute after the previous one and
+// returns the types and backends of its events.
+func (s *alertSequence) next(readings ...alertReading) []string {
+	s.now = s.now.Add(time.Minute)
+	var got []string
+	for _, e := range s.e.evaluate(alertWindow{end: s.now, servers: readings}) {
+		if e.Alert == nil || e.Backend != e.Alert.Backend || !e.Time.Equal(s.now) {
+			s.t.Fatalf("Expected the event to carry its alert, got %+v", e)
+		}
+		got = append(got, string(e.Type)+" "+e.Alert.Rule+" "+e.Backend)
+	}
+	return got
+}
+
+func newAlertSequence(t *testing.T, rules ...AlertRule) *alertSequence {
+	e := newAlertEvaluator()
+	e.set(Alerts{Rules: rules})
+	return &alertSequence{t: t, e: e, now: time.Unix(1700000000, 0)}
+}
+
+func expectAlerts(t *testing.T, window int, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Window %d: expected %v, got %v", window, want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Window %d: expected %v, got %v", window, want, got)
+		}
+	}
+}
+
+func TestAlerts_FireCooldownResolve(t *testing.T) {
+	s := newAlertSequence(t, AlertRule{Name: "slow", LatencyP95: 500 * time.Millisecond, For: 2, Cooldown: 6 * time.Minute})
+	slow := alertReading{server: "a", alive: true, completed: 100, p95: 1}
+	fast := alertReading{server: "a", alive: true, completed: 100, p95: 0.1}
+
+	for i, step := range []struct {
+		reading alertReading
+		want    []string
+	}{
+		{slow, nil},                            // 1 window breached, For is 2
+		{slow, []string{"alert_fired slow a"}}, // fires
+		{slow, nil},                            // still firing
+		{fast, []string{"alert_resolved slow a"}},
+		{slow, nil},
+		{slow, nil}, // 2 windows again, but within the cooldown of the first firing
+		{slow, nil},
+		{slow, []string{"alert_fired slow a"}}, // the cooldown has passed
+	} {
+		expectAlerts(t, i+1, s.next(step.reading), step.want...)
+	}
+}
+
+func TestAlerts_Payload(t *testing.T) {
+	e := newAlertEvaluator()
+	e.set(Alerts{Window: 30 * time.Second, Rules: []AlertRule{
+		{Name: "errors", ErrorRate: 0.1},
+		{Name: "capacity", MinHealthy: 2, Selector: Selector{{Key: "tier", Operator: OpEquals, Values: []string{"web"}}}},
+	}})
+	web := map[string]string{"tier": "web"}
+	events := e.evaluate(alertWindow{end: time.Now(), servers: []alertReading{
+		{server: "a", labels: web, alive: true, completed: 20, errors: 5},
+		{server: "b", labels: web, alive: false, completed: 20},
+		{server: "c", alive: true, completed: 5, errors: 5}, // too few requests
+	}})
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 alerts, got %+v", events)
+	}
+	want := Alert{Rule: "errors", Condition: "error_rate", Backend: "a", Observed: 0.25, Threshold: 0.1, Window: Duration(30 * time.Second), Windows: 1}
+	if *events[0].Alert != want {
+		t.Errorf("Expected %+v, got %+v", want, *events[0].Alert)
+	}
+	want = Alert{Rule: "capacity", Condition: "min_healthy", Pool: "tier=web", Observed: 1, Threshold: 2, Window: Duration(30 * time.Second), Windows: 1}
+	if *events[1].Alert != want {
+		t.Errorf("Expected %+v, got %+v", want, *events[1].Alert)
+	}
+}
+
+func TestAlerts_QuietAndRemoved(t *testing.T) {
+	s := newAlertSequence(t, AlertRule{Name: "errors", ErrorRate: 0.5, MinRequests: 10})
+	failing := func(name string) alertReading {
+		return alertReading{server: name, alive: true, completed: 10, errors: 10}
+	}
+
+	expectAlerts(t, 1, s.next(failing("a"), failing("b")), "alert_fired errors a", "alert_fired errors b")
+	// a is too quiet to judge and keeps its alert; b left the pool
+	expectAlerts(t, 2, s.next(alertReading{server: "a", alive: true, completed: 1}), "alert_resolved errors b")
+
+	// Reloaded rules without the rule resolve its alerts
+	s.e.set(Alerts{Rules: []AlertRule{{Name: "down", MinHealthy: 1}}})
+	expectAlerts(t, 3, s.next(failing("a")), "alert_resolved errors a")
+}
+
+func TestAlerts_ServerWindows(t *testing.T) {
+	failing := newBackendServer(t, statusHandler(http.StatusInternalServerError))
+	healthy := newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{failing, healthy}, WithAlerts(Alerts{Rules: []AlertRule{
+		{Name: "errors", ErrorRate: 0.5, MinRequests: 5},
+	}}))
+	lb.alertWindow()
+	for i := 0; i < 20; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	events := lb.alerts.evaluate(lb.alertWindow())
+	if len(events) != 1 || events[0].Backend != failing.Address() || events[0].Alert.Observed != 1 {
+		t.Fatalf("Expected the failing server to fire, got %+v", events)
+	}
+
+	// The next window starts from the counters of the previous one
+	for i := 0; i < 20; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	w := lb.alertWindow()
+	for _, r := range w.servers {
+		if r.completed != 10 {
+			t.Errorf("Expected 10 requests to %s in the window, got %d", r.server, r.completed)
+		}
+	}
+}
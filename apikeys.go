@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultAPIKeyHeader carries API keys unless APIKeys names another header.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// APIKeys requires requests to present a known API key in Header,
+// X-API-Key by default, or in the query parameter QueryParam if set.
+// Requests without a known key are answered with 401. Keys are only stored
+// hashed and looked up by their hash, so checking a key takes the same time
+// whichever key it is. The key is removed from the request before it is
+// forwarded, and its ID takes its place in the access log and metrics.
+// File optionally names a JSON file of further keys, {"keys": [...]} in the
+// configuration format, that ReloadSecrets reads again so keys can be added
+// and revoked while running.
+type APIKeys struct {
+	Header     string
+	QueryParam string
+	Keys       []APIKey
+	File       string
+}
+
+// APIKey is a key accepted by APIKeys. SHA256 is the hex SHA-256 of the
+// key, as returned by HashAPIKey. Requests with the key are limited to
+// RateLimit if set, answering 429 beyond it, and only reach servers
+// matching Selector in addition to the selector of their route.
+type APIKey struct {
+	ID        string
+	SHA256    string
+	RateLimit *RateLimit
+	Selector  Selector
+}
+
+// RateLimit allows PerSecond requests on average with bursts of up to
+// Burst requests, at least one. With Key, a key as understood by
+// newKeyExtractor, the limit applies to each value of the key on its own,
+// such as to each client of a tenant with "client-ip". Requests without
+// the key share one limit.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+	Key       string
+}
+
+// HashAPIKey returns the hash of key stored in APIKey.SHA256.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithAPIKeys requires API keys. NewLoadBalancer fails if a key is invalid
+// or the key file cannot be read.
+func WithAPIKeys(a APIKeys) Option {
+	return func(lb *LoadBalancer) {
+		if a.Header == "" {
+			a.Header = defaultAPIKeyHeader
+		}
+		presented := HeaderKey(a.Header)
+		if a.QueryParam != "" {
+			presented = FirstKey(presented, QueryKey(a.QueryParam))
+		}
+		lb.apiKeys = &apiKeyStore{
+			config:    a,
+			presented: presented,
+			limits:    make(map[string]*rateLimiter),
+			results:   make(map[string]*apiKeyResults),
+			now:       func() time.Time { return lb.now() },
+		}
+	}
+}
+
+// apiKeyStore holds the accepted keys by hash, with the rate limiter and
+// request counts of each key ID.
+type apiKeyStore struct {
+	config APIKeys
+	now    func() time.Time
+
+	// presented reads the key presented with a request.
+	presented KeyExtractor
+
+	mu       sync.Mutex
+	byHash   map[[sha256.Size]byte]*APIKey
+	limits   map[string]*rateLimiter
+	results  map[string]*apiKeyResults
+	rejected uint64
+}
+
+// apiKeyResults counts the requests presenting a key.
+type apiKeyResults struct {
+	allowed, limited uint64
+}
+
+// apiKeyFile is the format of APIKeys.File.
+type apiKeyFile struct {
+	Keys []APIKeyConfig `json:"keys"`
+}
+
+// reload rebuilds the keys from the configured ones and the key file. Rate
+// limiters of keys that remain with the same limit keep their state.
+func (s *apiKeyStore) reload() error {
+	keys := slices.Clone(s.config.Keys)
+	if s.config.File != "" {
+		data, err := os.ReadFile(s.config.File)
+		if err != nil {
+			return fmt.Errorf("api keys: %w", err)
+		}
+		var f apiKeyFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("api keys: decode %s: %w", s.config.File, err)
+		}
+		for i, kc := range f.Keys {
+			key, err := kc.build()
+			if err != nil {
+				return fmt.Errorf("api keys: %s: keys[%d]: %w", s.config.File, i, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	byHash := make(map[[sha256.Size]byte]*APIKey, len(keys))
+	limits := make(map[string]*rateLimiter)
+	ids := make(map[string]bool, len(keys))
+	for i := range keys {
+		key := &keys[i]
+		var hash [sha256.Size]byte
+		if n, err := hex.Decode(hash[:], []byte(key.SHA256)); err != nil || n != sha256.Size {
+			return fmt.Errorf("api key %q: sha256 must be a hex SHA-256", key.ID)
+		}
+		if key.ID == "" || ids[key.ID] {
+			return fmt.Errorf("api key %q: ids must be set and unique", key.ID)
+		}
+		if l := key.RateLimit; l != nil {
+			if l.PerSecond <= 0 || l.Burst < 0 {
+				return fmt.Errorf("api key %q: rate limit must be positive", key.ID)
+			}
+			limiter, err := newRateLimiter(*l)
+			if err != nil {
+				return fmt.Errorf("api key %q: rate limit: %w", key.ID, err)
+			}
+			limits[key.ID] = limiter
+		}
+		ids[key.ID] = true
+		byHash[hash] = key
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byHash = byHash
+	for id, limiter := range limits {
+		if old := s.limits[id]; old != nil && old.limit == limiter.limit {
+			limits[id] = old
+		}
+	}
+	s.limits = limits
+
+	return nil
+}
+
+// authenticate checks the key presented with req and removes it from the
+// request. It returns the key, or ErrUnauthorized or ErrRateLimited with
+// the time until a request is allowed again. With shared set, rate limits
+// are taken from the shared store rather than local buckets.
+func (s *apiKeyStore) authenticate(req *http.Request, shared *sharedRateLimiter) (*APIKey, time.Duration, error) {
+	presented, _ := s.presented(req)
+	req.Header.Del(s.config.Header)
+	if p := s.config.QueryParam; p != "" {
+		if query := req.URL.Query(); query.Has(p) {
+			query.Del(p)
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.byHash[sha256.Sum256([]byte(presented))]
+	if presented == "" || key == nil {
+		s.rejected++
+		return nil, 0, ErrUnauthorized
+	}
+	results := s.results[key.ID]
+	if results == nil {
+		results = &apiKeyResults{}
+		s.results[key.ID] = results
+	}
+	if limiter := s.limits[key.ID]; limiter != nil {
+		var wait time.Duration
+		bucket := limiter.bucket(req)
+		if shared != nil {
+			// The store is not to be waited on with the keys locked.
+			s.mu.Unlock()
+			wait = shared.take(req.Context(), "api_key:"+key.ID+bucket, limiter.limit, s.now())
+			s.mu.Lock()
+		} else {
+			wait = limiter.take(bucket, s.now())
+		}
+		if wait > 0 {
+			results.limited++
+			return key, wait, fmt.Errorf("api key %q: %w", key.ID, ErrRateLimited)
+		}
+	}
+	results.allowed++
+
+	return key, 0, nil
+}
+
+// tokenBucket is the rate limiter of a key.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst(), last: now}
+}
+
+func (l RateLimit) burst() float64 {
+	return math.Max(1, float64(l.Burst))
+}
+
+// take takes a token at now. If none is left it returns the time until
+// one is.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed.Seconds()*b.limit.PerSecond)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.limit.PerSecond * float64(time.Second))
+}
+
+// maxRateLimitBuckets is how many buckets a keyed rate limiter keeps before
+// dropping those that refilled.
+const maxRateLimitBuckets = 10000
+
+// rateLimiter holds the token buckets of a RateLimit, one per value of its
+// key.
+type rateLimiter struct {
+	limit   RateLimit
+	key     KeyExtractor
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) (*rateLimiter, error) {
+	l := &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+	if limit.Key != "" {
+		var err error
+		if l.key, err = newKeyExtractor(limit.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// bucket returns the suffix naming the bucket of req: the value of the key
+// after a colon, or nothing without one.
+func (l *rateLimiter) bucket(req *http.Request) string {
+	if l.key == nil {
+		return ""
+	}
+	key, ok := l.key(req)
+	if !ok {
+		return ""
+	}
+
+	return ":" + key
+}
+
+// take takes a token from bucket at now. If none is left it returns the
+// time until one is. The caller must serialize calls.
+func (l *rateLimiter) take(bucket string, now time.Time) time.Duration {
+	b := l.buckets[bucket]
+	if b == nil {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			for name, b := range l.buckets {
+				if b.full(now) {
+					delete(l.buckets, name)
+				}
+			}
+		}
+		b = newTokenBucket(l.limit, now)
+		l.buckets[bucket] = b
+	}
+
+	return b.take(now)
+}
+
+// full reports whether the bucket has refilled by now, so that dropping it
+// loses nothing.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.PerSecond >= b.limit.burst()
+}
+
+// checkAPIKey authenticates req if API keys are required, recording its
+// key in the request's info. Failures are answered on rw.
+func (lb *LoadBalancer) checkAPIKey(rw http.ResponseWriter, req *http.Request) error {
+	if lb.apiKeys == nil {
+		return nil
+	}
+	key, wait, err := lb.apiKeys.authenticate(req, lb.sharedLimits)
+	if info := requestInfo(req); key != nil && info != nil {
+		info.apiKey = key
+	}
+	if err != nil {
+		if wait > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		writeError(rw, err)
+	}
+
+	return err
+}
+
+// requestAPIKey returns the key req was authenticated with, or nil.
+func requestAPIKey(req *http.Request) *APIKey {
+	if info := requestInfo(req); info != nil {
+		return info.apiKey
+	}
+
+	return nil
+}
+
+// apiKeyID returns the ID of the key req was authenticated with, if any.
+func apiKeyID(req *http.Request) string {
+	if key := requestAPIKey(req); key != nil {
+		return key.ID
+	}
+
+	return ""
+}
+
+// apiKeySelector returns the selector of the key req was authenticated
+// with, if any.
+func apiKeySelector(req *http.Request) Selector {
+	if req == nil {
+		return nil
+	}
+	if key := requestAPIKey(req); key != nil {
+		return key.Selector
+	}
+
+	return nil
+}
+
+// ReloadAPIKeys reads the API key file again. The previous keys stay in
+// effect if it fails.
+func (lb *LoadBalancer) ReloadAPIKeys() error {
+	if lb.apiKeys == nil || lb.apiKeys.config.File == "" {
+		return nil
+	}
+
+	return lb.apiKeys.reload()
+}
+
+// writeMetrics renders the API key request counts by key ID.
+func (s *apiKeyStore) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.results))
+	for id := range s.results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintln(w, "# HELP lb_api_key_requests_total Requests presenting an API key by key ID and result.")
+	fmt.Fprintln(w, "# TYPE lb_api_key_requests_total counter")
+	for _, id := range ids {
+		r := s.results[id]
+		fmt.Fprintf(w, "lb_api_key_requests_total{key=%q,result=\"allowed\"} %d\n", id, r.allowed)
+		fmt.Fprintf(w, "lb_api_key_requests_total{key=%q,result=\"limited\"} %d\n", id, r.limited)
+	}
+	fmt.Fprintln(w, "# HELP lb_api_key_rejected_total Requests without a known API key.")
+	fmt.Fprintln(w, "# TYPE lb_api_key_rejected_total counter")
+	fmt.Fprintf(w, "lb_api_key_rejected_total %d\n", s.rejected)
+}
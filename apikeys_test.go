@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyedGet sends a request to path with the API key in the X-API-Key
+// header unless it is empty.
+func keyedGet(lb *LoadBalancer, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	return rw
+}
+
+func TestAPIKeys_Authentication(t *testing.T) {
+	var forwarded *http.Request
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req
+	})
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log), WithAPIKeys(APIKeys{
+		QueryParam: "api_key",
+		Keys:       []APIKey{{ID: "partner", SHA256: HashAPIKey("s3cret")}},
+	}))
+
+	if rw := keyedGet(lb, "/", "s3cret"); rw.Code != http.StatusOK || forwarded.Header.Get("X-API-Key") != "" {
+		t.Errorf("Expected the key to be accepted and removed, got %d %v", rw.Code, forwarded.Header)
+	}
+	if rw := keyedGet(lb, "/search?q=a&api_key=s3cret", ""); rw.Code != http.StatusOK || forwarded.URL.RawQuery != "q=a" {
+		t.Errorf("Expected the query key to be accepted and removed, got %d %q", rw.Code, forwarded.URL.RawQuery)
+	}
+	forwarded = nil
+	for _, key := range []string{"", "wrong"} {
+		if rw := keyedGet(lb, "/", key); rw.Code != http.StatusUnauthorized {
+			t.Errorf("Expected key %q to be rejected, got %d", key, rw.Code)
+		}
+	}
+	if forwarded != nil {
+		t.Errorf("Expected rejected requests not to reach the server")
+	}
+
+	entries := accessLogEntries(t, log)
+	if entries[0]["api_key"] != "partner" || entries[2]["api_key"] != "" {
+		t.Errorf("Expected the key ID in the access log, got %v and %v", entries[0]["api_key"], entries[2]["api_key"])
+	}
+	if strings.Contains(log.String(), "s3cret") {
+		t.Errorf("Expected the key never to be logged")
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`lb_api_key_requests_total{key="partner",result="allowed"} 2`,
+		`lb_api_key_rejected_total 2`,
+	} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
+
+func TestAPIKeys_RateLimitsAndRouting(t *testing.T) {
+	served := map[string]int{}
+	handler := func(name string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) { served[name]++ }
+	}
+	cheap := newBackendServer(t, handler("cheap"), WithLabels(map[string]string{"pool": "cheap"}))
+	premium := newBackendServer(t, handler("premium"), WithLabels(map[string]string{"pool": "premium"}))
+	lb := newTestLoadBalancer(t, []Server{cheap, premium}, WithAPIKeys(APIKeys{Keys: []APIKey{
+		{ID: "free", SHA256: HashAPIKey("free-key"), RateLimit: &RateLimit{PerSecond: 0.5, Burst: 2},
+			Selector: Selector{{Key: "pool", Operator: OpEquals, Values: []string{"cheap"}}}},
+		{ID: "paid", SHA256: HashAPIKey("paid-key"), RateLimit: &RateLimit{PerSecond: 10, Burst: 4}},
+	}}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if rw := keyedGet(lb, "/", "free-key"); rw.Code != http.StatusOK {
+			t.Fatalf("Expected the burst to be allowed, got %d", rw.Code)
+		}
+	}
+	rw := keyedGet(lb, "/", "free-key")
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected the free key to be limited, got %d with Retry-After %q", rw.Code, rw.Header().Get("Retry-After"))
+	}
+
+	// The paid key has its own limit and reaches every server
+	for i := 0; i < 4; i++ {
+		if rw := keyedGet(lb, "/", "paid-key"); rw.Code != http.StatusOK {
+			t.Errorf("Expected the paid key to be unaffected, got %d", rw.Code)
+		}
+	}
+	if served["cheap"] != 4 || served["premium"] != 2 {
+		t.Errorf("Expected the free key on the cheap pool only, got %v", served)
+	}
+
+	now = now.Add(2 * time.Second)
+	if rw := keyedGet(lb, "/", "free-key"); rw.Code != http.StatusOK {
+		t.Errorf("Expected the free key to recover, got %d", rw.Code)
+	}
+}
+
+func TestAPIKeys_RateLimitByKey(t *testing.T) {
+	server := newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{server}, WithAPIKeys(APIKeys{Keys: []APIKey{
+		{ID: "shared", SHA256: HashAPIKey("shared-key"), RateLimit: &RateLimit{PerSecond: 1, Burst: 1, Key: "path:^/users/(?P<key>[^/]+)"}},
+	}}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	if rw := keyedGet(lb, "/users/a", "shared-key"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the first request of the user to be allowed, got %d", rw.Code)
+	}
+	if rw := keyedGet(lb, "/users/a/orders", "shared-key"); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the user to be limited, got %d", rw.Code)
+	}
+	if rw := keyedGet(lb, "/users/b", "shared-key"); rw.Code != http.StatusOK {
+		t.Errorf("Expected another user of the key to be unaffected, got %d", rw.Code)
+	}
+
+	if _, err := NewLoadBalancer("8000", []Server{server}, WithAPIKeys(APIKeys{Keys: []APIKey{
+		{ID: "bad", SHA256: HashAPIKey("bad-key"), RateLimit: &RateLimit{PerSecond: 1, Key: "cookie"}},
+	}})); err == nil {
+		t.Error("Expected an invalid rate limit key to be rejected")
+	}
+}
+
+func TestAPIKeys_FileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys := func(ids ...string) {
+		var keys []string
+		for _, id := range ids {
+			keys = append(keys, `{"id": "`+id+`", "sha256": "`+HashAPIKey(id+"-key")+`"}`)
+		}
+		if err := os.WriteFile(path, []byte(`{"keys": [`+strings.Join(keys, ",")+`]}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("a")
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server}, WithAPIKeys(APIKeys{File: path}))
+
+	if keyedGet(lb, "/", "a-key").Code != http.StatusOK || keyedGet(lb, "/", "b-key").Code != http.StatusUnauthorized {
+		t.Fatalf("Expected only the key from the file to be accepted")
+	}
+
+	writeKeys("b")
+	if err := lb.ReloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if code := keyedGet(lb, "/", "a-key").Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be rejected, got %d", code)
+	}
+	if code := keyedGet(lb, "/", "b-key").Code; code != http.StatusOK {
+		t.Errorf("Expected the added key to be accepted, got %d", code)
+	}
+
+	// A broken file keeps the previous keys
+	os.WriteFile(path, []byte(`{"keys": [{"id": "c", "sha256": "nothex"}]}`), 0o600)
+	if err := lb.ReloadSecrets(); err == nil {
+		t.Errorf("Expected the broken file to fail the reload")
+	}
+	if code := keyedGet(lb, "/", "b-key").Code; code != http.StatusOK {
+		t.Errorf("Expected the previous keys to stay in effect, got %d", code)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// authOriginalMethodHeader and authOriginalURIHeader tell the auth
+	// service which request it is asked about.
+	authOriginalMethodHeader = "X-Original-Method"
+	authOriginalURIHeader    = "X-Original-URI"
+
+	defaultAuthTimeout      = 2 * time.Second
+	defaultAuthMaxIdleConns = 32
+	defaultAuthCacheEntries = 10000
+
+	// authResponseLimit bounds the response bodies of the auth service read
+	// so that their connections can be reused.
+	authResponseLimit = 64 << 10
+)
+
+// AuthRequest consults an auth service before the requests of a route are
+// proxied, as nginx's auth_request does. Each request is described to the
+// service by a GET to URL carrying RequestHeaders of the request,
+// Authorization and Cookie by default, and its method and URI in the
+// X-Original-Method and X-Original-URI headers; its body is not sent.
+//
+// A 2xx answer lets the request through with ResponseHeaders of the answer,
+// such as X-User, copied onto it. Those headers are always removed from the
+// request first, so clients cannot set them themselves. A 401 or 403 answer
+// is returned to the client with DenyHeaders of the answer,
+// WWW-Authenticate by default. Any other answer, or none within Timeout, 2s
+// by default, fails the request with 503 unless FailOpen lets it through.
+//
+// Subrequests use their own connections, keeping up to MaxIdleConns idle,
+// 32 by default. With CacheTTL set, answers are remembered for that long by
+// the values of RequestHeaders, so the service must decide on those alone.
+// Failures are never cached.
+type AuthRequest struct {
+	URL             string
+	Timeout         time.Duration
+	RequestHeaders  []string
+	ResponseHeaders []string
+	DenyHeaders     []string
+	FailOpen        bool
+	MaxIdleConns    int
+	CacheTTL        time.Duration
+}
+
+func (a AuthRequest) withDefaults() AuthRequest {
+	if a.Timeout <= 0 {
+		a.Timeout = defaultAuthTimeout
+	}
+	if a.RequestHeaders == nil {
+		a.RequestHeaders = []string{"Authorization", "Cookie"}
+	}
+	if a.DenyHeaders == nil {
+		a.DenyHeaders = []string{"WWW-Authenticate"}
+	}
+	if a.MaxIdleConns <= 0 {
+		a.MaxIdleConns = defaultAuthMaxIdleConns
+	}
+
+	return a
+}
+
+// Auth request results reported in metrics.
+const (
+	authAllowed = "allowed"
+	authDenied  = "denied"
+	authFailed  = "failed"
+)
+
+// authDecision is the answer of the auth service to a request.
+type authDecision struct {
+	status int
+	header http.Header
+}
+
+// authCacheEntry is a decision remembered until expires.
+type authCacheEntry struct {
+	decision authDecision
+	expires  time.Time
+}
+
+// authScope consults the auth service of a route.
+type authScope struct {
+	config AuthRequest
+	source *AuthRequest
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]authCacheEntry
+}
+
+func newAuthScope(source *AuthRequest) *authScope {
+	config := source.withDefaults()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConns
+
+	return &authScope{
+		config: config,
+		source: source,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache: make(map[[sha256.Size]byte]authCacheEntry),
+	}
+}
+
+// cacheKey returns the key of the decisions for req.
+func (s *authScope) cacheKey(req *http.Request) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range s.config.RequestHeaders {
+		for _, value := range req.Header.Values(name) {
+			fmt.Fprintf(h, "%s: %s\n", http.CanonicalHeaderKey(name), value)
+		}
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	return key
+}
+
+func (s *authScope) cached(key [sha256.Size]byte, now time.Time) (authDecision, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.cache[key]
+	if !ok || !now.Before(entry.expires) {
+		return authDecision{}, false
+	}
+
+	return entry.decision, true
+}
+
+// remember caches d for key. Once the cache is full, expired entries are
+// dropped, and d is not cached if that makes no room.
+func (s *authScope) remember(key [sha256.Size]byte, d authDecision, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.cache) >= defaultAuthCacheEntries {
+		for k, entry := range s.cache {
+			if !now.Before(entry.expires) {
+				delete(s.cache, k)
+			}
+		}
+		if len(s.cache) >= defaultAuthCacheEntries {
+			return
+		}
+	}
+	s.cache[key] = authCacheEntry{decision: d, expires: now.Add(s.config.CacheTTL)}
+}
+
+// ask sends the subrequest describing req to the auth service.
+func (s *authScope) ask(ctx context.Context, req *http.Request) (authDecision, error) {
+	sub, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.URL, nil)
+	if err != nil {
+		return authDecision{}, err
+	}
+	for _, name := range s.config.RequestHeaders {
+		for _, value := range req.Header.Values(name) {
+			sub.Header.Add(name, value)
+		}
+	}
+	sub.Header.Set(authOriginalMethodHeader, req.Method)
+	sub.Header.Set(authOriginalURIHeader, req.URL.RequestURI())
+
+	resp, err := s.client.Do(sub)
+	if err != nil {
+		return authDecision{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, authResponseLimit))
+
+	var names []string
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		names = s.config.ResponseHeaders
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		names = s.config.DenyHeaders
+	default:
+		return authDecision{}, fmt.Errorf("auth service answered %d", resp.StatusCode)
+	}
+	d := authDecision{status: resp.StatusCode, header: make(http.Header)}
+	for _, name := range names {
+		for _, value := range resp.Header.Values(name) {
+			d.header.Add(name, value)
+		}
+	}
+
+	return d, nil
+}
+
+// authRequestStore holds the auth scopes of the routes with an AuthRequest
+// and their results, by route name. Scopes are set up on first use, and
+// again when the route is replaced, such as by the control plane.
+type authRequestStore struct {
+	mu      sync.Mutex
+	scopes  map[string]*authScope
+	results map[string]map[string]uint64
+	hits    map[string]uint64
+}
+
+func newAuthRequestStore() *authRequestStore {
+	return &authRequestStore{
+		scopes:  make(map[string]*authScope),
+		results: make(map[string]map[string]uint64),
+		hits:    make(map[string]uint64),
+	}
+}
+
+// scope returns the scope of route.
+func (s *authRequestStore) scope(route *Route) *authScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := s.scopes[route.Name]
+	if scope == nil || scope.source != route.AuthRequest {
+		if scope != nil {
+			scope.client.CloseIdleConnections()
+		}
+		scope = newAuthScope(route.AuthRequest)
+		s.scopes[route.Name] = scope
+		if s.results[route.Name] == nil {
+			s.results[route.Name] = make(map[string]uint64)
+		}
+	}
+
+	return scope
+}
+
+// closeIdleConnections closes the idle connections to the auth services.
+func (s *authRequestStore) closeIdleConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, scope := range s.scopes {
+		scope.client.CloseIdleConnections()
+	}
+}
+
+func (s *authRequestStore) count(route, result string, hit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[route][result]++
+	if hit {
+		s.hits[route]++
+	}
+}
+
+// writeMetrics renders the auth request counters of each route.
+func (s *authRequestStore) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.results) == 0 {
+		return
+	}
+	routes := make([]string, 0, len(s.results))
+	for route := range s.results {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP lb_auth_requests_total Requests checked with the auth service of their route, by result.")
+	fmt.Fprintln(w, "# TYPE lb_auth_requests_total counter")
+	for _, route := range routes {
+		for _, result := range []string{authAllowed, authDenied, authFailed} {
+			fmt.Fprintf(w, "lb_auth_requests_total{route=%q,result=%q} %d\n", route, result, s.results[route][result])
+		}
+	}
+	fmt.Fprintln(w, "# HELP lb_auth_cache_hits_total Requests decided by a cached answer of the auth service.")
+	fmt.Fprintln(w, "# TYPE lb_auth_cache_hits_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "lb_auth_cache_hits_total{route=%q} %d\n", route, s.hits[route])
+	}
+}
+
+// authorize checks req with the auth service of its route, if any, and
+// returns it with the headers the service sent copied on. Denials and
+// failures are answered on rw.
+func (lb *LoadBalancer) authorize(rw http.ResponseWriter, req *http.Request) (*http.Request, error) {
+	route := lb.matchRoute(req)
+	if route == nil || route.AuthRequest == nil || journalDelivery(req) {
+		return req, nil
+	}
+	scope := lb.auth.scope(route)
+	for _, name := range scope.config.ResponseHeaders {
+		req.Header.Del(name)
+	}
+
+	now := lb.now()
+	var key [sha256.Size]byte
+	d, hit := authDecision{}, false
+	if scope.config.CacheTTL > 0 {
+		key = scope.cacheKey(req)
+		d, hit = scope.cached(key, now)
+	}
+	if !hit {
+		var err error
+		if d, err = scope.ask(req.Context(), req); err != nil {
+			if req.Context().Err() != nil {
+				err = fmt.Errorf("%w: %v", ErrClientClosed, err)
+				writeError(rw, err)
+				return req, err
+			}
+			lb.auth.count(route.Name, authFailed, false)
+			if scope.config.FailOpen {
+				fmt.Printf("warning: route %q: auth request failed, letting the request through: %v\n", route.Name, err)
+				return req, nil
+			}
+			err = fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+			writeError(rw, err)
+			return req, err
+		}
+		if scope.config.CacheTTL > 0 {
+			scope.remember(key, d, now)
+		}
+	}
+
+	if d.status == http.StatusUnauthorized || d.status == http.StatusForbidden {
+		lb.auth.count(route.Name, authDenied, hit)
+		for name, values := range d.header {
+			rw.Header()[name] = slices.Clone(values)
+		}
+		writeStatus(rw, d.status)
+		return req, fmt.Errorf("route %q: auth service answered %d", route.Name, d.status)
+	}
+	lb.auth.count(route.Name, authAllowed, hit)
+	for name, values := range d.header {
+		req.Header[name] = slices.Clone(values)
+	}
+
+	return req, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authService answers subrequests for the tokens it knows, recording what
+// it was asked.
+type authService struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	requests int
+	last     http.Header
+}
+
+func (a *authService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	a.mu.Lock()
+	a.requests++
+	a.last = req.Header.Clone()
+	delay := a.delay
+	a.mu.Unlock()
+	time.Sleep(delay)
+
+	switch req.Header.Get("Authorization") {
+	case "Bearer alice":
+		rw.Header().Set("X-User", "alice")
+		rw.Header().Set("X-Internal", "secret")
+	case "Bearer mallory":
+		rw.WriteHeader(http.StatusForbidden)
+	default:
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		rw.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+func (a *authService) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests
+}
+
+func newAuthLoadBalancer(t *testing.T, auth AuthRequest) (*LoadBalancer, *authService, *transformBackend) {
+	service := &authService{}
+	srv := httptest.NewServer(service)
+	t.Cleanup(srv.Close)
+	auth.URL = srv.URL + "/check"
+
+	b := &transformBackend{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.requests++
+		b.header = req.Header
+	}))
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{Name: "api", PathPrefix: "/api/", AuthRequest: &auth}))
+
+	return lb, service, b
+}
+
+func authGet(lb *LoadBalancer, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("X-User", "spoofed")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	return rw
+}
+
+func TestAuthRequest_Allow(t *testing.T) {
+	lb, service, backend := newAuthLoadBalancer(t, AuthRequest{ResponseHeaders: []string{"X-User"}})
+
+	if rw := authGet(lb, "/api/orders?page=2", "alice"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	if got := service.last; got.Get("X-Original-Method") != "GET" || got.Get("X-Original-URI") != "/api/orders?page=2" ||
+		got.Get("Authorization") != "Bearer alice" || got.Get("X-User") != "" {
+		t.Errorf("Expected the subrequest to describe the request with selected headers, got %v", got)
+	}
+	if backend.header.Get("X-User") != "alice" || backend.header.Get("X-Internal") != "" {
+		t.Errorf("Expected only the configured headers copied, got X-User %q and X-Internal %q",
+			backend.header.Get("X-User"), backend.header.Get("X-Internal"))
+	}
+
+	// Routes without an auth request are not checked.
+	authGet(lb, "/public", "")
+	if service.count() != 1 || backend.requests != 2 {
+		t.Errorf("Expected one subrequest for two proxied requests, got %d and %d", service.count(), backend.requests)
+	}
+}
+
+func TestAuthRequest_Deny(t *testing.T) {
+	lb, _, backend := newAuthLoadBalancer(t, AuthRequest{})
+
+	rw := authGet(lb, "/api/orders", "")
+	if rw.Code != http.StatusUnauthorized || rw.Header().Get("WWW-Authenticate") != `Bearer realm="api"` {
+		t.Errorf("Expected 401 with the challenge of the auth service, got %d and %v", rw.Code, rw.Header())
+	}
+	if rw := authGet(lb, "/api/orders", "mallory"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rw.Code)
+	}
+	if backend.requests != 0 {
+		t.Errorf("Expected denied requests not to be proxied, got %d", backend.requests)
+	}
+}
+
+func TestAuthRequest_FailurePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		failOpen bool
+		want     int
+	}{
+		{"closed", false, http.StatusServiceUnavailable},
+		{"open", true, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, service, backend := newAuthLoadBalancer(t, AuthRequest{
+				Timeout: 20 * time.Millisecond, FailOpen: tc.failOpen, ResponseHeaders: []string{"X-User"},
+			})
+			service.delay = 200 * time.Millisecond
+
+			if rw := authGet(lb, "/api/orders", "alice"); rw.Code != tc.want {
+				t.Fatalf("Expected %d on timeout, got %d", tc.want, rw.Code)
+			}
+			if tc.failOpen && backend.header.Get("X-User") != "" {
+				t.Errorf("Expected the spoofed X-User removed, got %q", backend.header.Get("X-User"))
+			}
+			rw := httptest.NewRecorder()
+			lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+			if !strings.Contains(rw.Body.String(), `lb_auth_requests_total{route="api",result="failed"} 1`) {
+				t.Error("Expected the failure to be counted")
+			}
+		})
+	}
+}
+
+func TestAuthRequest_Cache(t *testing.T) {
+	lb, service, _ := newAuthLoadBalancer(t, AuthRequest{CacheTTL: time.Minute, ResponseHeaders: []string{"X-User"}})
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	for _, token := range []string{"alice", "alice", "", "", "alice"} {
+		authGet(lb, "/api/orders", token)
+	}
+	if service.count() != 2 {
+		t.Errorf("Expected one subrequest per token, got %d", service.count())
+	}
+	now = now.Add(2 * time.Minute)
+	authGet(lb, "/api/orders", "alice")
+	if service.count() != 3 {
+		t.Errorf("Expected the expired answer to be asked again, got %d subrequests", service.count())
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`lb_auth_requests_total{route="api",result="allowed"} 4`,
+		`lb_auth_requests_total{route="api",result="denied"} 2`,
+		`lb_auth_cache_hits_total{route="api"} 3`,
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestAuthRequestConfig(t *testing.T) {
+	cfg := &Config{
+		Servers: []ServerConfig{{Address: "http://localhost:9001"}},
+		Routes: []RouteConfig{{Name: "api", PathPrefix: "/api/", AuthRequest: &AuthRequestConfig{
+			URL: "http://auth.internal/check", FailurePolicy: "open", CacheTTL: Duration(5 * time.Second),
+		}}},
+	}
+	if _, err := cfg.Build(); err != nil {
+		t.Fatalf("Expected the auth request to build, got %v", err)
+	}
+
+	for _, bad := range []AuthRequestConfig{
+		{},
+		{URL: "/check"},
+		{URL: "http://auth.internal/check", FailurePolicy: "sometimes"},
+		{URL: "http://auth.internal/check", Timeout: Duration(-time.Second)},
+	} {
+		cfg.Routes[0].AuthRequest = &bad
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected auth request %+v to be rejected", bad)
+		}
+	}
+}
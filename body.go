@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// BodyOverflow selects what happens to a request whose body does not fit
+// the memory buffer of its BodyBufferPolicy.
+type BodyOverflow string
+
+const (
+	// OverflowProceed forwards the request as is but without replay, so it
+	// is not retried.
+	OverflowProceed BodyOverflow = "proceed"
+
+	// OverflowReject rejects the request with 413 Request Entity Too Large.
+	OverflowReject BodyOverflow = "reject"
+
+	// OverflowSpill continues buffering into a temporary file up to
+	// MaxFile bytes. Bodies beyond that are rejected with 413.
+	OverflowSpill BodyOverflow = "spill"
+)
+
+// BodyBufferPolicy bounds how much of a request body is buffered so the
+// request can be replayed to another server.
+type BodyBufferPolicy struct {
+	MaxMemory int64
+	Overflow  BodyOverflow
+	MaxFile   int64
+	TempDir   string
+}
+
+// defaultBodyBuffer applies to routes without a body buffering policy.
+var defaultBodyBuffer = BodyBufferPolicy{MaxMemory: 64 << 10, Overflow: OverflowProceed}
+
+// WithBodyBuffer sets the body buffering policy of requests whose route has
+// none.
+func WithBodyBuffer(policy BodyBufferPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.bodyBuffer = policy
+	}
+}
+
+// bodyBufferFor returns the body buffering policy applying to req.
+func (lb *LoadBalancer) bodyBufferFor(req *http.Request) BodyBufferPolicy {
+	if route := lb.matchRoute(req); route != nil && route.BodyBuffer != nil {
+		return *route.BodyBuffer
+	}
+
+	return lb.bodyBuffer
+}
+
+// replayableBody is a request body held in memory or in a temporary file so
+// it can be sent more than once. Close removes the temporary file.
+type replayableBody struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// bufferBody reads body according to policy. It returns a nil
+// replayableBody and the body to forward unchanged when the body overflows
+// with OverflowProceed, and ErrBodyTooLarge when it must be rejected.
+func bufferBody(body io.ReadCloser, policy BodyBufferPolicy) (*replayableBody, io.ReadCloser, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, policy.MaxMemory+1)
+	if err == io.EOF {
+		return &replayableBody{data: buf.Bytes(), size: n}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: read body: %v", ErrClientClosed, err)
+	}
+
+	switch policy.Overflow {
+	case OverflowReject:
+		return nil, nil, ErrBodyTooLarge
+	case OverflowSpill:
+		rb, err := spillBody(io.MultiReader(&buf, body), policy)
+		return rb, nil, err
+	default:
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, body), body}, nil
+	}
+}
+
+// spillBody copies r into a temporary file of at most policy.MaxFile bytes.
+func spillBody(r io.Reader, policy BodyBufferPolicy) (*replayableBody, error) {
+	f, err := os.CreateTemp(policy.TempDir, "lb-body-*")
+	if err != nil {
+		return nil, err
+	}
+	rb := &replayableBody{file: f}
+
+	rb.size, err = io.CopyN(f, r, policy.MaxFile+1)
+	switch {
+	case err == io.EOF:
+		return rb, nil
+	case err == nil:
+		rb.Close()
+		return nil, ErrBodyTooLarge
+	case isFileError(err):
+		rb.Close()
+		return nil, fmt.Errorf("spill body: %w", err)
+	default:
+		rb.Close()
+		return nil, fmt.Errorf("%w: read body: %v", ErrClientClosed, err)
+	}
+}
+
+// isFileError reports whether err came from the file system rather than the
+// client.
+func isFileError(err error) bool {
+	var pathErr *os.PathError
+	return errors.As(err, &pathErr)
+}
+
+// reader returns a fresh reader over the whole body.
+func (b *replayableBody) reader() io.ReadCloser {
+	if b.file != nil {
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+
+	return io.NopCloser(bytes.NewReader(b.data))
+}
+
+// Close releases the body, removing its temporary file.
+func (b *replayableBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+
+	return os.Remove(b.file.Name())
+}
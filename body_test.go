@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// echoRecorder is a backend handler recording the request bodies it
+// receives and the files present in dir while serving.
+type echoRecorder struct {
+	dir string
+
+	mu     sync.Mutex
+	bodies []string
+	files  []int
+}
+
+func (e *echoRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	entries, _ := os.ReadDir(e.dir)
+	e.mu.Lock()
+	e.bodies = append(e.bodies, string(body))
+	e.files = append(e.files, len(entries))
+	e.mu.Unlock()
+}
+
+// newBodyLoadBalancer returns a load balancer whose first server refuses
+// connections, so every request is retried on the second one if possible.
+func newBodyLoadBalancer(t *testing.T, policy BodyBufferPolicy) (*LoadBalancer, *echoRecorder) {
+	echo := &echoRecorder{dir: policy.TempDir}
+	lb := newTestLoadBalancer(t, []Server{newRefusingServer(t), newBackendServer(t, echo.ServeHTTP)},
+		WithRetryPolicy(RetryPolicy{Attempts: 2}), WithBodyBuffer(policy))
+	return lb, echo
+}
+
+func TestBodyBuffer_UnderMemoryCap(t *testing.T) {
+	dir := t.TempDir()
+	lb, echo := newBodyLoadBalancer(t, BodyBufferPolicy{MaxMemory: 16, Overflow: OverflowReject, TempDir: dir})
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("POST", "/", strings.NewReader("small body")))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be retried, got %d", rw.Code)
+	}
+	if len(echo.bodies) != 1 || echo.bodies[0] != "small body" || echo.files[0] != 0 {
+		t.Errorf("Expected the full body from memory, got %v with %v files", echo.bodies, echo.files)
+	}
+}
+
+func TestBodyBuffer_SpillsToTempFile(t *testing.T) {
+	dir := t.TempDir()
+	lb, echo := newBodyLoadBalancer(t, BodyBufferPolicy{MaxMemory: 4, Overflow: OverflowSpill, MaxFile: 64, TempDir: dir})
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("POST", "/", strings.NewReader("a body between the caps")))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be retried, got %d", rw.Code)
+	}
+	if len(echo.bodies) != 1 || echo.bodies[0] != "a body between the caps" {
+		t.Errorf("Expected the full body to be replayed, got %v", echo.bodies)
+	}
+	if echo.files[0] != 1 {
+		t.Errorf("Expected the body to be spilled to a temp file, got %d files", echo.files[0])
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the temp file to be removed, got %d files", len(entries))
+	}
+}
+
+func TestBodyBuffer_OverHardCap(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		overflow BodyOverflow
+		status   int
+		received bool
+	}{
+		// Forwarded without replay, so the refused attempt is not retried
+		{OverflowProceed, http.StatusBadGateway, false},
+		{OverflowReject, http.StatusRequestEntityTooLarge, false},
+		{OverflowSpill, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		lb, echo := newBodyLoadBalancer(t, BodyBufferPolicy{MaxMemory: 8, Overflow: tt.overflow, MaxFile: 32, TempDir: dir})
+
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if rw.Code != tt.status {
+			t.Errorf("%s: Expected status %d, got %d", tt.overflow, tt.status, rw.Code)
+		}
+		if len(echo.bodies) != 0 {
+			t.Errorf("%s: Expected no request to reach the healthy backend, got %v", tt.overflow, echo.bodies)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: Expected no temp files left, got %d", tt.overflow, len(entries))
+		}
+	}
+
+	// Proceeding still forwards the whole body when nothing fails
+	echo := &echoRecorder{dir: t.TempDir()}
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, echo.ServeHTTP)},
+		WithRetryPolicy(RetryPolicy{Attempts: 2}), WithBodyBuffer(BodyBufferPolicy{MaxMemory: 8, Overflow: OverflowProceed}))
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if rw.Code != http.StatusOK || len(echo.bodies) != 1 || echo.bodies[0] != body {
+		t.Errorf("Expected the unbuffered body to be forwarded intact, got %d %v", rw.Code, echo.bodies)
+	}
+}
+
+func TestBodyBuffer_RoutePolicy(t *testing.T) {
+	lb, _ := newBodyLoadBalancer(t, BodyBufferPolicy{MaxMemory: 1024, Overflow: OverflowProceed})
+	WithRoutes(Route{Name: "upload", PathPrefix: "/upload", BodyBuffer: &BodyBufferPolicy{MaxMemory: 4, Overflow: OverflowReject}})(lb)
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("POST", "/upload", strings.NewReader("too large")))
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the route policy to reject the body, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCacheEntries bounds the responses a ResponseCache keeps.
+	defaultCacheEntries = 1024
+
+	// defaultCacheBody bounds the body of a cached response.
+	defaultCacheBody = 1 << 20
+
+	// defaultCacheBytes bounds the memory of the cached responses.
+	defaultCacheBytes = 64 << 20
+
+	// defaultCacheShards is the number of independently locked parts of
+	// the cache.
+	defaultCacheShards = 16
+
+	// defaultCacheFailureBackoff and defaultCacheMaxFailureBackoff bound
+	// how long requests for a failing key are held back.
+	defaultCacheFailureBackoff    = time.Second
+	defaultCacheMaxFailureBackoff = 30 * time.Second
+)
+
+// ResponseCache caches GET responses of servers in memory. A 200 response is
+// stored unless the request carries Authorization or Range, or the response
+// sets cookies, is marked no-store, no-cache or private, or varies on *.
+// Responses are fresh for their s-maxage or max-age, and DefaultTTL
+// otherwise; responses without a lifetime are only stored when they carry
+// an ETag or Last-Modified to revalidate them with. Clients whose
+// If-None-Match or If-Modified-Since match a fresh entry get a 304 without
+// a server being contacted. Stale entries are revalidated with a conditional
+// request, and a 304 from the server refreshes the entry instead of
+// transferring the body again. Stale entries are also served as the
+// stale-while-revalidate and stale-if-error directives of RFC 5861 allow,
+// or the StalePolicy of the route. At most MaxEntries responses, 1024 by
+// default, of up to MaxBody bytes, 1 MiB by default, are kept, taking up to
+// MaxBytes, 64 MiB by default, counting their keys and headers. The cache
+// is split by key into Shards parts, 16 by default, each with its share of
+// the limits and its own lock; a shard evicts its least recently used
+// entries to make room before storing a response, so the cache never
+// exceeds MaxBytes. With HeapLimit set, the byte budget is halved, down to
+// a sixteenth of MaxBytes, whenever the heap is found above HeapLimit, and
+// doubled back while it is below.
+//
+// Failures are never cached: 5xx responses are passed on, or replaced by a
+// stale response. 404 and 410 responses are cached only for routes with a
+// NegativeTTL, for that long. Once a request for a key fails with a 5xx
+// response or no server, further requests for it are held back from
+// servers for FailureBackoff, 1s by default, doubling with every failure
+// in a row up to MaxFailureBackoff, 30s by default. They are answered
+// with the stale response where stale-if-error allows it, and with 503
+// otherwise. After the backoff one request at a time retries, and the
+// first to succeed releases the key.
+type ResponseCache struct {
+	DefaultTTL        time.Duration
+	MaxEntries        int
+	MaxBody           int64
+	MaxBytes          int64
+	Shards            int
+	HeapLimit         uint64
+	FailureBackoff    time.Duration
+	MaxFailureBackoff time.Duration
+}
+
+// StalePolicy sets how long after expiring cached responses may be served.
+// Within WhileRevalidate of expiry a stale response is served at once while
+// it is refreshed in the background. Within IfError of expiry it is served
+// in place of a 500, 502, 503 or 504 response or when no server is
+// available.
+type StalePolicy struct {
+	WhileRevalidate time.Duration
+	IfError         time.Duration
+}
+
+// WithResponseCache enables the response cache.
+func WithResponseCache(c ResponseCache) Option {
+	return func(lb *LoadBalancer) {
+		if c.MaxEntries <= 0 {
+			c.MaxEntries = defaultCacheEntries
+		}
+		if c.MaxBody <= 0 {
+			c.MaxBody = defaultCacheBody
+		}
+		if c.MaxBytes <= 0 {
+			c.MaxBytes = defaultCacheBytes
+		}
+		if c.Shards <= 0 {
+			c.Shards = defaultCacheShards
+		}
+		if c.FailureBackoff <= 0 {
+			c.FailureBackoff = defaultCacheFailureBackoff
+		}
+		if c.MaxFailureBackoff <= 0 {
+			c.MaxFailureBackoff = max(defaultCacheMaxFailureBackoff, c.FailureBackoff)
+		}
+		lb.cache = newResponseStore(c)
+	}
+}
+
+// Cache results reported in the access log and metrics.
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheStale       = "stale"
+	cacheStaleError  = "stale-if-error"
+	cacheNegativeHit = "negative-hit"
+	cacheSuppressed  = "suppressed"
+)
+
+// Warnings added to stale responses.
+const (
+	warningStale            = `110 - "Response is Stale"`
+	warningRevalidateFailed = `111 - "Revalidation Failed"`
+)
+
+// cacheEntry is a stored response. status is 200, or 404 or 410 for a
+// negative entry.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+
+	// stale holds the stale windows the response announced.
+	stale StalePolicy
+
+	// accounted is the size the entry is accounted for in the store.
+	accounted int64
+}
+
+func (e *cacheEntry) etag() string {
+	return e.header.Get("ETag")
+}
+
+// negative reports whether e caches a 404 or 410 response.
+func (e *cacheEntry) negative() bool {
+	return e.status != http.StatusOK
+}
+
+// negativeStatus reports whether a response with status may be cached
+// under a NegativeTTL.
+func negativeStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
+// cacheKey identifies the cached response for req.
+func cacheKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// cacheable reports whether the response to req may come from or go to the
+// cache.
+func cacheable(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Range") == "" && req.Header.Get("Upgrade") == ""
+}
+
+// newEntry returns the entry storing a response to req with the given
+// status, header and body, or nil if the response must not be stored. 404
+// and 410 responses are stored for negativeTTL, if set.
+func (s *responseStore) newEntry(req *http.Request, status int, header http.Header, body []byte, now time.Time, negativeTTL time.Duration) *cacheEntry {
+	negative := negativeStatus(status) && negativeTTL > 0
+	if status != http.StatusOK && !negative || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	directives := cacheDirectives(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return nil
+		}
+	}
+	e := &cacheEntry{key: cacheKey(req), status: status, header: header.Clone(), body: body, stored: now}
+	for _, name := range header.Values("Vary") {
+		for _, name := range strings.Split(name, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if e.vary == nil {
+				e.vary = make(map[string]string)
+			}
+			e.vary[name] = req.Header.Get(name)
+		}
+	}
+	if negative {
+		e.expires = now.Add(negativeTTL)
+		return e
+	}
+	ttl := s.ttl(directives)
+	if ttl <= 0 && e.etag() == "" && header.Get("Last-Modified") == "" {
+		return nil
+	}
+	e.expires = now.Add(ttl)
+	e.stale = staleWindows(directives)
+
+	return e
+}
+
+// ttl returns the lifetime the directives give a response.
+func (s *responseStore) ttl(directives map[string]string) time.Duration {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return s.config.DefaultTTL
+}
+
+// staleWindows returns the stale-while-revalidate and stale-if-error
+// windows the directives give a response.
+func staleWindows(directives map[string]string) StalePolicy {
+	window := func(name string) time.Duration {
+		seconds, err := strconv.Atoi(directives[name])
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	return StalePolicy{WhileRevalidate: window("stale-while-revalidate"), IfError: window("stale-if-error")}
+}
+
+// cacheDirectives parses the Cache-Control header fields of header.
+func cacheDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return directives
+}
+
+// refresh updates e with the headers of a 304 response revalidating it.
+func (s *responseStore) refresh(e *cacheEntry, header http.Header, now time.Time) *cacheEntry {
+	refreshed := *e
+	refreshed.header = e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+		if values := header.Values(name); len(values) > 0 {
+			refreshed.header[name] = values
+		}
+	}
+	refreshed.stored = now
+	directives := cacheDirectives(refreshed.header)
+	refreshed.expires = now.Add(s.ttl(directives))
+	refreshed.stale = staleWindows(directives)
+	s.store(&refreshed)
+
+	return &refreshed
+}
+
+// notModified reports whether the conditional headers of req match e. As
+// for servers, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(req *http.Request, e *cacheEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.etag())
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(e.header.Get("Last-Modified"))
+
+	return err == nil && !modified.After(ims)
+}
+
+// etagMatches reports whether the If-None-Match list matches etag, using
+// the weak comparison If-None-Match calls for: W/"a" and "a" match.
+func etagMatches(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveEntry answers req from e, with a 304 if the conditional headers of
+// req match it and with warning, if set, as a Warning header. Headers
+// already set on rw take precedence over the stored ones.
+func serveEntry(rw http.ResponseWriter, req *http.Request, e *cacheEntry, now time.Time, warning string) {
+	header := rw.Header()
+	for name, values := range e.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	if warning != "" {
+		header.Add("Warning", warning)
+	}
+	if e.negative() {
+		header.Set("Content-Length", strconv.Itoa(len(e.body)))
+		rw.WriteHeader(e.status)
+		rw.Write(e.body)
+		return
+	}
+	if notModified(req, e) {
+		for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			header.Del(name)
+		}
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(e.body)
+}
+
+// cacheExchange sits between the attempts of a cacheable request and the
+// client, capturing the response for the cache. When a stored entry is
+// being revalidated, a 304 from the server is held back so the entry can be
+// served instead, and so are failures the entry may be served in place of.
+type cacheExchange struct {
+	http.ResponseWriter
+	store *responseStore
+	req   *http.Request
+	now   time.Time
+
+	// negativeTTL is how long 404 and 410 responses are cached, and retry
+	// whether the request claimed the retry of a failing key.
+	negativeTTL time.Duration
+	retry       bool
+
+	// entry is the expired entry for the request, if any, revalidating
+	// whether the request asks the server if it is still valid, and ifError
+	// how long after expiry it may replace a failure.
+	entry        *cacheEntry
+	revalidating bool
+	ifError      time.Duration
+
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+	notModified bool
+	failed      bool
+}
+
+// revalidate returns the request asking the server whether the entry is
+// still valid.
+func (x *cacheExchange) revalidate(req *http.Request) *http.Request {
+	x.revalidating = true
+	req = req.Clone(req.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if etag := x.entry.etag(); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := x.entry.header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+
+	return req
+}
+
+// canServeStale reports whether the entry may be served in place of a
+// failure.
+func (x *cacheExchange) canServeStale() bool {
+	return x.entry != nil && x.now.Before(x.entry.expires.Add(x.ifError))
+}
+
+// heldBack reports whether the response of the server was kept from the
+// client.
+func (x *cacheExchange) heldBack() bool {
+	return x.notModified || x.failed
+}
+
+func (x *cacheExchange) WriteHeader(status int) {
+	if x.status != 0 || status < http.StatusOK {
+		x.ResponseWriter.WriteHeader(status)
+		return
+	}
+	x.status = status
+	x.header = x.ResponseWriter.Header().Clone()
+	switch {
+	case x.revalidating && status == http.StatusNotModified:
+		x.notModified = true
+	case staleReplaces(status) && x.canServeStale():
+		x.failed = true
+		clear(x.ResponseWriter.Header())
+	default:
+		x.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// staleReplaces reports whether a stale entry may replace a response with
+// status.
+func staleReplaces(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (x *cacheExchange) Write(p []byte) (int, error) {
+	if x.status == 0 {
+		x.WriteHeader(http.StatusOK)
+	}
+	if x.heldBack() {
+		return len(p), nil
+	}
+	if !x.tooLarge {
+		if int64(x.body.Len()+len(p)) > x.store.maxBody() {
+			x.tooLarge = true
+			x.body = bytes.Buffer{}
+		} else {
+			x.body.Write(p)
+		}
+	}
+
+	return x.ResponseWriter.Write(p)
+}
+
+func (x *cacheExchange) Flush() {
+	if !x.heldBack() {
+		http.NewResponseController(x.ResponseWriter).Flush()
+	}
+}
+
+func (x *cacheExchange) Unwrap() http.ResponseWriter {
+	return x.ResponseWriter
+}
+
+// finish stores the response of a completed exchange or, for a revalidated
+// entry, refreshes the entry and serves it. It returns the cache result.
+func (x *cacheExchange) finish() string {
+	switch {
+	case x.notModified:
+		e := x.store.refresh(x.entry, x.header, x.now)
+		serveEntry(x.ResponseWriter, x.req, e, x.now, "")
+		x.store.count(cacheRevalidated)
+		return cacheRevalidated
+	case x.failed:
+		return x.serveStale()
+	}
+	if !x.tooLarge && x.status != 0 {
+		if e := x.store.newEntry(x.req, x.status, x.header, bytes.Clone(x.body.Bytes()), x.now, x.negativeTTL); e != nil {
+			x.store.store(e)
+		}
+	}
+	x.store.count(cacheMiss)
+
+	return cacheMiss
+}
+
+// serveStale serves the entry in place of a failure and returns the cache
+// result.
+func (x *cacheExchange) serveStale() string {
+	serveEntry(x.ResponseWriter, x.req, x.entry, x.now, warningRevalidateFailed)
+	x.store.count(cacheStaleError)
+
+	return cacheStaleError
+}
+
+// stalePolicyFor returns the stale windows of e for req: those of the
+// route of req if it has a StalePolicy, else those e announced.
+func (lb *LoadBalancer) stalePolicyFor(req *http.Request, e *cacheEntry) StalePolicy {
+	if route := lb.matchRoute(req); route != nil && route.Stale != nil {
+		return *route.Stale
+	}
+
+	return e.stale
+}
+
+// cacheRefreshKey marks background refreshes of a stale entry.
+type cacheRefreshKey struct{}
+
+// serveCached answers req from the cache if it holds a fresh entry for it,
+// or a stale one it may serve while refreshing it, and holds it back from
+// servers while its key is failing. It returns the cache result if it
+// answered req. Otherwise it returns the exchange capturing the response
+// for the cache, and the request to send to servers, which revalidates an
+// expired entry. The exchange is nil for requests the cache does not
+// handle.
+func (lb *LoadBalancer) serveCached(rw http.ResponseWriter, req *http.Request) (string, *cacheExchange, *http.Request) {
+	if lb.cache == nil || !cacheable(req) {
+		return "", nil, req
+	}
+
+	now := lb.now()
+	directives := cacheDirectives(req.Header)
+	_, noCache := directives["no-cache"]
+	var e *cacheEntry
+	if !noCache {
+		e = lb.cache.lookup(req)
+	}
+	refresh := req.Context().Value(cacheRefreshKey{}) != nil
+	var stale StalePolicy
+	if e != nil && e.negative() {
+		if now.Before(e.expires) && !refresh {
+			serveEntry(rw, req, e, now, "")
+			lb.cache.count(cacheNegativeHit)
+			return cacheNegativeHit, nil, req
+		}
+		// Expired negative entries are neither served stale nor
+		// revalidated.
+		e = nil
+	}
+	if e != nil && !refresh {
+		stale = lb.stalePolicyFor(req, e)
+		switch {
+		case now.Before(e.expires):
+			serveEntry(rw, req, e, now, "")
+			lb.cache.count(cacheHit)
+			return cacheHit, nil, req
+		case now.Before(e.expires.Add(stale.WhileRevalidate)):
+			serveEntry(rw, req, e, now, warningStale)
+			lb.cache.count(cacheStale)
+			lb.refreshCached(req)
+			return cacheStale, nil, req
+		}
+	}
+
+	if _, ok := directives["no-store"]; ok {
+		return "", nil, req
+	}
+	retry, retryAt, ok := lb.cache.admit(cacheKey(req), now)
+	if !ok {
+		lb.cache.count(cacheSuppressed)
+		if e != nil && now.Before(e.expires.Add(stale.IfError)) {
+			serveEntry(rw, req, e, now, warningRevalidateFailed)
+		} else {
+			rw.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAt.Sub(now).Seconds())), 1)))
+			writeError(rw, ErrCacheBackoff)
+		}
+		return cacheSuppressed, nil, req
+	}
+	x := &cacheExchange{ResponseWriter: rw, store: lb.cache, req: req, now: now, retry: retry}
+	if route := lb.matchRoute(req); route != nil {
+		x.negativeTTL = route.NegativeTTL
+	}
+	if e != nil {
+		x.entry, x.ifError = e, stale.IfError
+		if e.etag() != "" || e.header.Get("Last-Modified") != "" {
+			req = x.revalidate(req)
+		}
+	}
+
+	return "", x, req
+}
+
+// refreshCached refreshes the entry for req in the background through the
+// normal proxy path, unless a refresh of it is already running.
+func (lb *LoadBalancer) refreshCached(req *http.Request) {
+	key := cacheKey(req)
+	lb.cache.mu.Lock()
+	if lb.cache.refreshing[key] {
+		lb.cache.mu.Unlock()
+		return
+	}
+	lb.cache.refreshing[key] = true
+	lb.cache.mu.Unlock()
+
+	refresh := req.Clone(context.WithValue(context.Background(), cacheRefreshKey{}, true))
+	refresh.Body = http.NoBody
+	refresh.Header.Del("If-None-Match")
+	refresh.Header.Del("If-Modified-Since")
+	go func() {
+		defer func() {
+			lb.cache.mu.Lock()
+			delete(lb.cache.refreshing, key)
+			lb.cache.mu.Unlock()
+		}()
+		lb.serveProxy(&discardResponseWriter{header: http.Header{}}, refresh)
+	}()
+}
+
+// discardResponseWriter discards the response of a background refresh.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// cacheFailure marks a key whose requests recently failed. Until retryAt
+// its requests are held back from servers; after it, one at a time is
+// let through, retrying.
+type cacheFailure struct {
+	failures int
+	retryAt  time.Time
+	retrying bool
+}
+
+// admit reports whether a request for key may go to servers at now, and
+// whether it is the retry of a failing key. If not, it returns when the
+// next retry is due.
+func (s *responseStore) admit(key string, now time.Time) (retry bool, retryAt time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.failures[key]
+	switch {
+	case f == nil:
+		return false, time.Time{}, true
+	case f.retrying || now.Before(f.retryAt):
+		return false, f.retryAt, false
+	}
+	f.retrying = true
+
+	return true, time.Time{}, true
+}
+
+// settle records the outcome of the exchange at now: a 5xx response, or
+// none without the client going away, fails its key; any other response
+// releases it.
+func (x *cacheExchange) settle(now time.Time) {
+	failed := x.status >= http.StatusInternalServerError || x.status == 0
+	if x.status == 0 && x.req.Context().Err() != nil {
+		// The client went away; that says nothing about the servers.
+		if x.retry {
+			x.store.release(cacheKey(x.req))
+		}
+		return
+	}
+	x.store.settle(cacheKey(x.req), failed, x.retry, now)
+}
+
+// release ends the retry of key a request claimed, leaving the key failing.
+func (s *responseStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f := s.failures[key]; f != nil {
+		f.retrying = false
+	}
+}
+
+// settle fails or releases key at now. retry ends the retry the request
+// claimed.
+func (s *responseStore) settle(key string, failed, retry bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.failures[key]
+	if f != nil && retry {
+		f.retrying = false
+	}
+	if !failed {
+		delete(s.failures, key)
+		return
+	}
+	if f == nil {
+		if len(s.failures) >= s.config.MaxEntries && !s.pruneFailuresLocked(now) {
+			return
+		}
+		f = &cacheFailure{}
+		s.failures[key] = f
+	}
+	f.failures++
+	backoff := s.config.FailureBackoff << min(f.failures-1, 16)
+	f.retryAt = now.Add(min(backoff, s.config.MaxFailureBackoff))
+}
+
+// pruneFailuresLocked forgets the failing keys not requested since their
+// backoff ran out, reporting whether any was. s.mu must be held.
+func (s *responseStore) pruneFailuresLocked(now time.Time) bool {
+	pruned := false
+	for key, f := range s.failures {
+		if !f.retrying && now.After(f.retryAt.Add(s.config.MaxFailureBackoff)) {
+			delete(s.failures, key)
+			pruned = true
+		}
+	}
+
+	return pruned
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCachingBackend returns a server answering with an ETag and
+// Last-Modified that honors conditional requests, and its call counter.
+func newCachingBackend(t *testing.T, header http.Header) (Server, *atomic.Int64, *atomic.Value) {
+	var calls atomic.Int64
+	var conditional atomic.Value
+	conditional.Store("")
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		conditional.Store(req.Header.Get("If-None-Match"))
+		for name, values := range header {
+			rw.Header()[name] = values
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Last-Modified", "Mon, 05 Oct 2026 10:00:00 GMT")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(rw, "cached body")
+	})
+	return server, &calls, &conditional
+}
+
+func cachedGet(lb *LoadBalancer, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/doc", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	return rw
+}
+
+func TestCache_ConditionalRequests(t *testing.T) {
+	server, calls, _ := newCachingBackend(t, http.Header{"Cache-Control": {"max-age=60"}})
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}), WithAccessLog(log))
+
+	if rw := cachedGet(lb); rw.Code != http.StatusOK || rw.Body.String() != "cached body" {
+		t.Fatalf("Expected the response, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	for _, tt := range []struct {
+		header []string
+		status int
+	}{
+		{[]string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+		{[]string{"If-None-Match", `W/"v0", W/"v1"`}, http.StatusNotModified},
+		{[]string{"If-None-Match", `*`}, http.StatusNotModified},
+		{[]string{"If-None-Match", `"v2"`}, http.StatusOK},
+		{[]string{"If-Modified-Since", "Mon, 05 Oct 2026 10:00:00 GMT"}, http.StatusNotModified},
+		{[]string{"If-Modified-Since", "Sun, 04 Oct 2026 10:00:00 GMT"}, http.StatusOK},
+		{nil, http.StatusOK},
+	} {
+		rw := cachedGet(lb, tt.header...)
+		if rw.Code != tt.status {
+			t.Errorf("%v: expected %d, got %d", tt.header, tt.status, rw.Code)
+		}
+		if tt.status == http.StatusNotModified && (rw.Body.Len() != 0 || rw.Header().Get("ETag") != `"v1"`) {
+			t.Errorf("%v: expected an empty 304 with the ETag, got %q %v", tt.header, rw.Body.String(), rw.Header())
+		}
+		if tt.status == http.StatusOK && rw.Body.String() != "cached body" {
+			t.Errorf("%v: expected the cached body, got %q", tt.header, rw.Body.String())
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected only the first request to reach the backend, got %d calls", n)
+	}
+	entries := accessLogEntries(t, log)
+	if entries[0]["cache"] != cacheMiss || entries[1]["cache"] != cacheHit {
+		t.Errorf("Expected a miss then hits in the access log, got %v and %v", entries[0]["cache"], entries[1]["cache"])
+	}
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	server, calls, conditional := newCachingBackend(t, http.Header{"Cache-Control": {"max-age=60"}})
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	cachedGet(lb)
+	now = now.Add(61 * time.Second)
+
+	// The stale entry is revalidated and the backend's 304 serves its body
+	rw := cachedGet(lb, "If-None-Match", `"other"`)
+	if rw.Code != http.StatusOK || rw.Body.String() != "cached body" {
+		t.Errorf("Expected the cached body after revalidation, got %d %q", rw.Code, rw.Body.String())
+	}
+	if calls.Load() != 2 || conditional.Load() != `"v1"` {
+		t.Errorf("Expected a conditional request for the stored ETag, got %d calls with %q", calls.Load(), conditional.Load())
+	}
+
+	// Revalidation refreshed the entry
+	now = now.Add(30 * time.Second)
+	if rw := cachedGet(lb, "If-None-Match", `"v1"`); rw.Code != http.StatusNotModified || calls.Load() != 2 {
+		t.Errorf("Expected a 304 from the refreshed entry, got %d after %d calls", rw.Code, calls.Load())
+	}
+}
+
+func TestCache_NotStored(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		client []string
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, nil},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, nil},
+		{"cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, nil},
+		{"vary", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, nil},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, []string{"Authorization", "Bearer x"}},
+	} {
+		server, calls, _ := newCachingBackend(t, tt.header)
+		lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}))
+		cachedGet(lb, tt.client...)
+		cachedGet(lb, tt.client...)
+		if calls.Load() != 2 {
+			t.Errorf("%s: expected the response not to be cached, got %d calls", tt.name, calls.Load())
+		}
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int64
+	gate := make(chan struct{})
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		n := calls.Add(1)
+		if n == 2 {
+			<-gate
+		}
+		rw.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		fmt.Fprintf(rw, "body %d", n)
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	cachedGet(lb)
+	now = now.Add(70 * time.Second)
+
+	// Stale responses are served at once while a single refresh runs
+	for i := 0; i < 3; i++ {
+		rw := cachedGet(lb)
+		if rw.Body.String() != "body 1" || rw.Header().Get("Warning") != warningStale || rw.Header().Get("Age") != "70" {
+			t.Errorf("Expected the stale body with a warning, got %q %v", rw.Body.String(), rw.Header())
+		}
+	}
+	waitFor(t, "background refresh", func() bool { return calls.Load() == 2 })
+	close(gate)
+	waitFor(t, "refreshed entry", func() bool { return cachedGet(lb).Body.String() == "body 2" })
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected a single background refresh, got %d calls", n)
+	}
+
+	// Beyond the window the request waits for the server
+	now = now.Add(91 * time.Second)
+	if rw := cachedGet(lb); rw.Body.String() != "body 3" || rw.Header().Get("Warning") != "" {
+		t.Errorf("Expected a fresh response beyond the stale window, got %q %v", rw.Body.String(), rw.Header())
+	}
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	var failing atomic.Bool
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		if failing.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60, stale-if-error=120")
+		io.WriteString(rw, "cached "+req.URL.Path)
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}), WithRoutes(
+		Route{Name: "strict", PathPrefix: "/strict", Stale: &StalePolicy{}},
+		Route{Name: "default", PathPrefix: "/"},
+	))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	get("/doc")
+	get("/strict")
+	failing.Store(true)
+	now = now.Add(100 * time.Second)
+
+	if rw := get("/doc"); rw.Code != http.StatusOK || rw.Body.String() != "cached /doc" || rw.Header().Get("Warning") != warningRevalidateFailed {
+		t.Errorf("Expected the stale entry in place of the 503, got %d %q %v", rw.Code, rw.Body.String(), rw.Header())
+	}
+	if rw := get("/strict"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the route policy to disable stale-if-error, got %d", rw.Code)
+	}
+
+	server.(*simpleServer).SetAlive(false)
+	if rw := get("/doc"); rw.Code != http.StatusOK || rw.Body.String() != "cached /doc" {
+		t.Errorf("Expected the stale entry without available servers, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	now = now.Add(81 * time.Second)
+	if rw := get("/doc"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the failure beyond the stale-if-error window, got %d", rw.Code)
+	}
+}
+
+func TestCache_FailingKeyBackoff(t *testing.T) {
+	var calls atomic.Int64
+	var failing atomic.Bool
+	gate := make(chan struct{}, 1)
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if req.URL.Path == "/slow" {
+			<-gate
+		}
+		if failing.Load() {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		io.WriteString(rw, "cached body")
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	cachedGet(lb)
+	failing.Store(true)
+	now = now.Add(61 * time.Second)
+
+	// Each failure backs the key off for twice as long, during which
+	// clients get the stale response without the backend being asked.
+	attempts := int64(1)
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		for i := 0; i < 5; i++ {
+			rw := cachedGet(lb)
+			if rw.Code != http.StatusOK || rw.Body.String() != "cached body" || rw.Header().Get("Warning") != warningRevalidateFailed {
+				t.Fatalf("Expected the stale response, got %d %q", rw.Code, rw.Body.String())
+			}
+		}
+		attempts++
+		if n := calls.Load(); n != attempts {
+			t.Fatalf("Expected one attempt per backoff, got %d calls after %d backoffs", n, attempts-1)
+		}
+		now = now.Add(backoff - time.Millisecond)
+		cachedGet(lb)
+		if n := calls.Load(); n != attempts {
+			t.Fatalf("Expected no attempt before the %s backoff ran out, got %d calls", backoff, n)
+		}
+		now = now.Add(time.Millisecond)
+	}
+
+	// Without a stale response, clients are answered 503 with Retry-After.
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	get("/new")
+	if rw := get("/new"); rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After while the key backs off, got %d %v", rw.Code, rw.Header())
+	}
+
+	// Retries are single-flighted.
+	gate <- struct{}{}
+	get("/slow?fail")
+	before := calls.Load()
+	now = now.Add(time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get("/slow?fail")
+	}()
+	waitFor(t, "the retry", func() bool { return calls.Load() == before+1 })
+	if rw := get("/slow?fail"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected requests during the retry to be held back, got %d", rw.Code)
+	}
+	gate <- struct{}{}
+	<-done
+
+	// The first success releases the key.
+	failing.Store(false)
+	now = now.Add(time.Minute)
+	cachedGet(lb)
+	if rw := cachedGet(lb); rw.Header().Get("Warning") != "" || rw.Code != http.StatusOK {
+		t.Errorf("Expected a fresh response once the backend recovered, got %d %v", rw.Code, rw.Header())
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_cache_requests_total{result="suppressed"} 17`, "lb_cache_failing_keys 2"} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s, got\n%s", want, rw.Body.String())
+		}
+	}
+}
+
+func TestCache_NegativeTTL(t *testing.T) {
+	var calls atomic.Int64
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		switch req.URL.Path {
+		case "/gone":
+			rw.WriteHeader(http.StatusGone)
+		default:
+			http.NotFound(rw, req)
+		}
+	})
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}), WithAccessLog(log), WithRoutes(
+		Route{Name: "negative", PathPrefix: "/n/", NegativeTTL: 10 * time.Second},
+		Route{Name: "gone", PathPrefix: "/gone", NegativeTTL: 10 * time.Second},
+		Route{Name: "default", PathPrefix: "/"},
+	))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	get := func(path string) int {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		calls  int64
+	}{
+		{"/n/missing", http.StatusNotFound, 1},
+		{"/n/missing", http.StatusNotFound, 1},
+		{"/gone", http.StatusGone, 2},
+		{"/gone", http.StatusGone, 2},
+		{"/missing", http.StatusNotFound, 3},
+		{"/missing", http.StatusNotFound, 4},
+	} {
+		if code := get(tt.path); code != tt.status || calls.Load() != tt.calls {
+			t.Errorf("%s: expected %d after %d calls, got %d after %d", tt.path, tt.status, tt.calls, code, calls.Load())
+		}
+	}
+	entries := accessLogEntries(t, log)
+	if entries[1]["cache"] != cacheNegativeHit {
+		t.Errorf("Expected a negative hit in the access log, got %v", entries[1]["cache"])
+	}
+
+	now = now.Add(9 * time.Second)
+	get("/n/missing")
+	if calls.Load() != 4 {
+		t.Errorf("Expected the 404 cached for its TTL, got %d calls", calls.Load())
+	}
+	now = now.Add(time.Second)
+	get("/n/missing")
+	if calls.Load() != 5 {
+		t.Errorf("Expected the 404 to expire after its TTL, got %d calls", calls.Load())
+	}
+}
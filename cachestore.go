@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"net/http"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cacheEntryOverhead approximates the memory an entry takes beyond its
+	// key, headers and body.
+	cacheEntryOverhead = 256
+
+	// cacheMemoryInterval is how often the heap is compared to HeapLimit.
+	cacheMemoryInterval = 5 * time.Second
+
+	// heapObjectsMetric is the runtime metric of the memory of live and
+	// unswept heap objects.
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// responseStore holds the cached responses in shards chosen by key hash.
+type responseStore struct {
+	config ResponseCache
+	seed   maphash.Seed
+	shards []*cacheShard
+
+	// budget is the byte budget of the whole cache, and used the bytes
+	// taken, which never exceed it.
+	budget atomic.Int64
+	used   atomic.Int64
+	shrunk atomic.Uint64
+
+	mu      sync.Mutex
+	results map[string]uint64
+
+	// refreshing holds the keys refreshed in the background, and failures
+	// the keys whose requests recently failed.
+	refreshing map[string]bool
+	failures   map[string]*cacheFailure
+}
+
+// cacheShard holds part of the cached responses, most recently used first,
+// within its share of the byte and entry budgets.
+type cacheShard struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	budget     int64
+	maxEntries int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newResponseStore(c ResponseCache) *responseStore {
+	s := &responseStore{
+		config:  c,
+		seed:    maphash.MakeSeed(),
+		shards:  make([]*cacheShard, c.Shards),
+		results: make(map[string]uint64),
+
+		refreshing: make(map[string]bool),
+		failures:   make(map[string]*cacheFailure),
+	}
+	for i := range s.shards {
+		s.shards[i] = &cacheShard{
+			entries:    make(map[string]*list.Element),
+			lru:        list.New(),
+			maxEntries: max((c.MaxEntries+c.Shards-1)/c.Shards, 1),
+		}
+	}
+	s.setBudget(c.MaxBytes)
+
+	return s
+}
+
+// size returns the bytes accounted for e.
+func (e *cacheEntry) size() int64 {
+	n := cacheEntryOverhead + len(e.key) + len(e.body)
+	for name, values := range e.header {
+		for _, v := range values {
+			n += len(name) + len(v)
+		}
+	}
+	for name, v := range e.vary {
+		n += len(name) + len(v)
+	}
+
+	return int64(n)
+}
+
+// maxBody returns the largest body worth capturing: bodies above MaxBody
+// or a shard's share of the byte budget are never stored.
+func (s *responseStore) maxBody() int64 {
+	return min(s.config.MaxBody, s.budget.Load()/int64(len(s.shards)))
+}
+
+func (s *responseStore) shardFor(key string) *cacheShard {
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+// lookup returns the entry stored for req, or nil.
+func (s *responseStore) lookup(req *http.Request) *cacheEntry {
+	key := cacheKey(req)
+	shard := s.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	el := shard.entries[key]
+	if el == nil {
+		shard.misses++
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	for name, value := range e.vary {
+		if req.Header.Get(name) != value {
+			shard.misses++
+			return nil
+		}
+	}
+	shard.lru.MoveToFront(el)
+	shard.hits++
+
+	return e
+}
+
+// store adds e, replacing any entry with the same key. Least recently used
+// entries are evicted before e is added, so that the shard stays within its
+// budgets; an entry larger than the shard's byte budget is not stored.
+func (s *responseStore) store(e *cacheEntry) {
+	size := e.size()
+	shard := s.shardFor(e.key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if el := shard.entries[e.key]; el != nil {
+		s.removeLocked(shard, el)
+	}
+	if size > shard.budget {
+		return
+	}
+	for shard.lru.Len() > 0 && (shard.bytes+size > shard.budget || shard.lru.Len() >= shard.maxEntries) {
+		s.removeLocked(shard, shard.lru.Back())
+		shard.evictions++
+	}
+	e.accounted = size
+	shard.entries[e.key] = shard.lru.PushFront(e)
+	shard.bytes += size
+	s.used.Add(size)
+}
+
+// removeLocked removes el from shard. shard.mu must be held.
+func (s *responseStore) removeLocked(shard *cacheShard, el *list.Element) {
+	e := shard.lru.Remove(el).(*cacheEntry)
+	delete(shard.entries, e.key)
+	shard.bytes -= e.accounted
+	s.used.Add(-e.accounted)
+}
+
+// setBudget sets the byte budget of the cache, evicting least recently used
+// entries of shards above their new share.
+func (s *responseStore) setBudget(budget int64) {
+	s.budget.Store(budget)
+	share := budget / int64(len(s.shards))
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.budget = share
+		for shard.bytes > shard.budget {
+			s.removeLocked(shard, shard.lru.Back())
+			shard.evictions++
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// adjustBudget halves the byte budget, down to a sixteenth of MaxBytes,
+// when heap is above HeapLimit, and doubles it back up to MaxBytes
+// otherwise.
+func (s *responseStore) adjustBudget(heap uint64) {
+	budget := s.budget.Load()
+	next := min(budget*2, s.config.MaxBytes)
+	if heap > s.config.HeapLimit {
+		next = max(budget/2, s.config.MaxBytes/16)
+	}
+	if next == budget {
+		return
+	}
+	if next < budget {
+		s.shrunk.Add(1)
+		fmt.Printf("warning: heap at %d bytes is above %d, shrinking the response cache to %d bytes\n", heap, s.config.HeapLimit, next)
+	}
+	s.setBudget(next)
+}
+
+// RunCacheMemoryWatch adjusts the byte budget of the response cache to the
+// heap size until ctx is done. It returns at once unless the cache has a
+// HeapLimit.
+func (lb *LoadBalancer) RunCacheMemoryWatch(ctx context.Context) {
+	if lb.cache == nil || lb.cache.config.HeapLimit == 0 {
+		return
+	}
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	ticker := time.NewTicker(cacheMemoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		markActive(ctx)
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			lb.cache.adjustBudget(sample[0].Value.Uint64())
+		}
+	}
+}
+
+func (s *responseStore) count(result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[result]++
+}
+
+// writeMetrics renders the cache counters, in total and by shard.
+func (s *responseStore) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	results := make([]string, 0, len(s.results))
+	for result := range s.results {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	fmt.Fprintln(w, "# HELP lb_cache_requests_total Cacheable requests, by cache result.")
+	fmt.Fprintln(w, "# TYPE lb_cache_requests_total counter")
+	for _, result := range results {
+		fmt.Fprintf(w, "lb_cache_requests_total{result=%q} %d\n", result, s.results[result])
+	}
+	fmt.Fprintln(w, "# HELP lb_cache_failing_keys Keys whose requests are held back from servers after failing.")
+	fmt.Fprintln(w, "# TYPE lb_cache_failing_keys gauge")
+	fmt.Fprintf(w, "lb_cache_failing_keys %d\n", len(s.failures))
+	s.mu.Unlock()
+
+	type shardStats struct {
+		entries                 int
+		bytes                   int64
+		hits, misses, evictions uint64
+	}
+	stats := make([]shardStats, len(s.shards))
+	entries := 0
+	for i, shard := range s.shards {
+		shard.mu.Lock()
+		stats[i] = shardStats{shard.lru.Len(), shard.bytes, shard.hits, shard.misses, shard.evictions}
+		shard.mu.Unlock()
+		entries += stats[i].entries
+	}
+	fmt.Fprintln(w, "# HELP lb_cache_entries Responses currently cached.")
+	fmt.Fprintln(w, "# TYPE lb_cache_entries gauge")
+	fmt.Fprintf(w, "lb_cache_entries %d\n", entries)
+	fmt.Fprintln(w, "# HELP lb_cache_bytes Memory accounted to cached responses.")
+	fmt.Fprintln(w, "# TYPE lb_cache_bytes gauge")
+	fmt.Fprintf(w, "lb_cache_bytes %d\n", s.used.Load())
+	fmt.Fprintln(w, "# HELP lb_cache_budget_bytes Current byte budget of the cache, lowered under memory pressure.")
+	fmt.Fprintln(w, "# TYPE lb_cache_budget_bytes gauge")
+	fmt.Fprintf(w, "lb_cache_budget_bytes %d\n", s.budget.Load())
+	fmt.Fprintln(w, "# HELP lb_cache_budget_shrinks_total Times the byte budget was lowered under memory pressure.")
+	fmt.Fprintln(w, "# TYPE lb_cache_budget_shrinks_total counter")
+	fmt.Fprintf(w, "lb_cache_budget_shrinks_total %d\n", s.shrunk.Load())
+
+	fmt.Fprintln(w, "# HELP lb_cache_shard_entries Responses cached, by shard.")
+	fmt.Fprintln(w, "# TYPE lb_cache_shard_entries gauge")
+	for i, st := range stats {
+		fmt.Fprintf(w, "lb_cache_shard_entries{shard=\"%d\"} %d\n", i, st.entries)
+	}
+	fmt.Fprintln(w, "# HELP lb_cache_shard_bytes Memory accounted to cached responses, by shard.")
+	fmt.Fprintln(w, "# TYPE lb_cache_shard_bytes gauge")
+	for i, st := range stats {
+		fmt.Fprintf(w, "lb_cache_shard_bytes{shard=\"%d\"} %d\n", i, st.bytes)
+	}
+	fmt.Fprintln(w, "# HELP lb_cache_shard_lookups_total Cache lookups, by shard and result.")
+	fmt.Fprintln(w, "# TYPE lb_cache_shard_lookups_total counter")
+	for i, st := range stats {
+		fmt.Fprintf(w, "lb_cache_shard_lookups_total{shard=\"%d\",result=\"hit\"} %d\n", i, st.hits)
+		fmt.Fprintf(w, "lb_cache_shard_lookups_total{shard=\"%d\",result=\"miss\"} %d\n", i, st.misses)
+	}
+	fmt.Fprintln(w, "# HELP lb_cache_shard_evictions_total Entries evicted to make room, by shard.")
+	fmt.Fprintln(w, "# TYPE lb_cache_shard_evictions_total counter")
+	for i, st := range stats {
+		fmt.Fprintf(w, "lb_cache_shard_evictions_total{shard=\"%d\"} %d\n", i, st.evictions)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a store filled with defaults as WithResponseCache
+// does.
+func newTestStore(c ResponseCache) *responseStore {
+	lb := &LoadBalancer{}
+	WithResponseCache(c)(lb)
+	return lb.cache
+}
+
+func testEntry(key string, body int) *cacheEntry {
+	return &cacheEntry{
+		key:    key,
+		header: http.Header{"Content-Type": {"text/plain"}},
+		body:   bytes.Repeat([]byte("x"), body),
+	}
+}
+
+func TestResponseStore_ByteBudgetUnderLargeEntries(t *testing.T) {
+	const budget = 64 << 10
+	s := newTestStore(ResponseCache{MaxBytes: budget, Shards: 4, MaxEntries: 1 << 20})
+
+	var exceeded atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if used := s.used.Load(); used > budget {
+				exceeded.Store(used)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(g), 1))
+			for i := range 2000 {
+				// Entries range from tiny to larger than a shard may hold.
+				size := r.IntN(budget / 3)
+				s.store(testEntry(fmt.Sprintf("/%d/%d", g, i%64), size))
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if used := exceeded.Load(); used != 0 {
+		t.Errorf("Expected the cache to stay within %d bytes, reached %d", budget, used)
+	}
+	var total int64
+	for _, shard := range s.shards {
+		if shard.bytes > shard.budget {
+			t.Errorf("Expected shard to stay within %d bytes, holds %d", shard.budget, shard.bytes)
+		}
+		total += shard.bytes
+	}
+	if total != s.used.Load() {
+		t.Errorf("Expected shards to account for %d bytes, got %d", s.used.Load(), total)
+	}
+}
+
+func TestResponseStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	size := testEntry("example.com/a", 1000).size()
+	s := newTestStore(ResponseCache{MaxBytes: 3 * size, Shards: 1})
+
+	for _, key := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		s.store(testEntry(key, 1000))
+	}
+	s.lookup(httptest.NewRequest("GET", "http://example.com/a", nil))
+	s.store(testEntry("example.com/d", 1000))
+	if s.shards[0].entries["example.com/b"] != nil || s.shards[0].entries["example.com/a"] == nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+
+	s.store(testEntry("example.com/e", int(4*size)))
+	if s.shards[0].entries["example.com/e"] != nil || s.used.Load() != 3*size {
+		t.Errorf("Expected an entry above the budget to be refused without evictions, used %d", s.used.Load())
+	}
+}
+
+func TestResponseStore_ShrinksUnderMemoryPressure(t *testing.T) {
+	const budget = 1 << 20
+	s := newTestStore(ResponseCache{MaxBytes: budget, Shards: 4, HeapLimit: 100 << 20, MaxEntries: 1 << 20})
+	for i := range 200 {
+		s.store(testEntry("/"+strconv.Itoa(i), 4000))
+	}
+
+	s.adjustBudget(200 << 20)
+	s.adjustBudget(200 << 20)
+	if got := s.budget.Load(); got != budget/4 || s.used.Load() > budget/4 {
+		t.Errorf("Expected the budget shrunk to %d with entries evicted, got %d using %d", budget/4, got, s.used.Load())
+	}
+	for range 10 {
+		s.adjustBudget(200 << 20)
+	}
+	if got := s.budget.Load(); got != budget/16 {
+		t.Errorf("Expected the budget to bottom out at %d, got %d", budget/16, got)
+	}
+	for range 10 {
+		s.adjustBudget(50 << 20)
+	}
+	if got := s.budget.Load(); got != budget {
+		t.Errorf("Expected the budget restored to %d, got %d", budget, got)
+	}
+}
+
+func TestResponseCache_ShardMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("cached"))
+	}))
+	defer backend.Close()
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{Shards: 2}))
+	for range 3 {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := rw.Body.String()
+	shard := "0"
+	if lb.cache.shards[1].lru.Len() == 1 {
+		shard = "1"
+	}
+	for _, want := range []string{
+		`lb_cache_shard_lookups_total{shard="` + shard + `",result="hit"} 2`,
+		`lb_cache_shard_lookups_total{shard="` + shard + `",result="miss"} 1`,
+		`lb_cache_shard_entries{shard="` + shard + `"} 1`,
+		"lb_cache_budget_bytes 67108864",
+	} {
+		if !bytes.Contains([]byte(metrics), []byte(want)) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+// mutexCache is a map behind a single mutex, the baseline for the sharded
+// store.
+type mutexCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func (c *mutexCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[cacheKey(req)]
+}
+
+func BenchmarkResponseStore_ConcurrentHits(b *testing.B) {
+	const keys = 1024
+	reqs := make([]*http.Request, keys)
+	for i := range reqs {
+		reqs[i] = httptest.NewRequest("GET", "http://example.com/"+strconv.Itoa(i), nil)
+	}
+	run := func(b *testing.B, lookup func(*http.Request) *cacheEntry) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(time.Now().UnixNano())
+			for pb.Next() {
+				i++
+				if lookup(reqs[i%keys]) == nil {
+					b.Error("Expected a hit")
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("mutex-map", func(b *testing.B) {
+		c := &mutexCache{entries: make(map[string]*cacheEntry)}
+		for _, req := range reqs {
+			c.entries[cacheKey(req)] = testEntry(cacheKey(req), 100)
+		}
+		run(b, c.lookup)
+	})
+	for _, shards := range []int{1, 16, 64} {
+		b.Run("shards-"+strconv.Itoa(shards), func(b *testing.B) {
+			s := newTestStore(ResponseCache{Shards: shards, MaxEntries: 2 * keys})
+			for _, req := range reqs {
+				s.store(testEntry(cacheKey(req), 100))
+			}
+			run(b, s.lookup)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultCapabilityTimeout = 5 * time.Second
+
+// Protocols a server is configured for, as reported in Capabilities.
+const (
+	protocolHTTP1 = "http/1.1"
+	protocolH2C   = "h2c"
+	protocolALPN  = "h2,http/1.1"
+)
+
+// CapabilityProbe checks each server as it is registered: it measures the
+// time to connect, negotiates ALPN with servers reached over TLS, tries
+// cleartext HTTP/2 with those configured for h2c, and requests the health
+// check path, or / without one, over the configured protocol. Findings are reported in
+// the server's stats, and mismatches with the configuration, such as h2c
+// configured for a server that only speaks HTTP/1.1, are logged as
+// warnings. Probes run in the background, within Timeout, 5s by default,
+// and never hold up the registration or selection of a server.
+type CapabilityProbe struct {
+	Timeout time.Duration
+}
+
+// WithCapabilityProbe probes the capabilities of servers as they are
+// registered.
+func WithCapabilityProbe(p CapabilityProbe) Option {
+	return func(lb *LoadBalancer) {
+		if p.Timeout <= 0 {
+			p.Timeout = defaultCapabilityTimeout
+		}
+		lb.capabilityProbe = &p
+		lb.capabilities = make(map[string]*Capabilities)
+	}
+}
+
+// Capabilities are what a capability probe found about a server.
+// Configured is the protocol the server is configured for: "http/1.1",
+// "h2c", or "h2,http/1.1" for servers reached over TLS, which negotiate it
+// with ALPN. Protocol is the protocol the probe request was answered in.
+// H2C reports whether a server configured for h2c accepts cleartext
+// HTTP/2.
+type Capabilities struct {
+	Checked      time.Time `json:"checked"`
+	Configured   string    `json:"configured"`
+	ConnectRTT   float64   `json:"connect_rtt_ms"`
+	ALPN         string    `json:"alpn,omitempty"`
+	H2C          *bool     `json:"h2c,omitempty"`
+	Protocol     string    `json:"protocol,omitempty"`
+	ProbePath    string    `json:"probe_path"`
+	ProbeStatus  int       `json:"probe_status,omitempty"`
+	Warnings     []string  `json:"warnings,omitempty"`
+	ProbeFailure string    `json:"probe_failure,omitempty"`
+}
+
+func (c *Capabilities) warn(format string, args ...any) {
+	c.Warnings = append(c.Warnings, fmt.Sprintf(format, args...))
+}
+
+// capabilityProber is implemented by servers whose capabilities can be
+// probed.
+type capabilityProber interface {
+	ProbeCapabilities(ctx context.Context) *Capabilities
+}
+
+// probeCapabilitiesLocked probes server in the background if capability
+// probes are on and the server supports them. lb.mu must be held.
+func (lb *LoadBalancer) probeCapabilitiesLocked(server Server) {
+	prober, ok := server.(capabilityProber)
+	if !ok || lb.capabilityProbe == nil {
+		return
+	}
+	timeout := lb.capabilityProbe.Timeout
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		c := prober.ProbeCapabilities(ctx)
+		for _, w := range c.Warnings {
+			fmt.Printf("warning: server %s: %s\n", serverName(server), w)
+		}
+
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.findServerLocked(serverName(server)) == server {
+			lb.capabilities[serverName(server)] = c
+		}
+	}()
+}
+
+// configuredProtocol returns the protocol s is configured for.
+func (s *simpleServer) configuredProtocol() string {
+	switch {
+	case s.target().Scheme == "https":
+		return protocolALPN
+	case s.transport.Protocols != nil && s.transport.Protocols.UnencryptedHTTP2():
+		return protocolH2C
+	default:
+		return protocolHTTP1
+	}
+}
+
+// ProbeCapabilities probes what the server supports within the deadline
+// of ctx.
+func (s *simpleServer) ProbeCapabilities(ctx context.Context) *Capabilities {
+	c := &Capabilities{Checked: time.Now(), Configured: s.configuredProtocol(), ProbePath: "/"}
+	target := s.target()
+	if s.health != nil && !s.health.GRPC {
+		c.ProbePath = s.health.Path
+	}
+
+	host := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		c.ProbeFailure = fmt.Sprintf("connect: %v", err)
+		c.warn("cannot connect: %v", err)
+		return c
+	}
+	c.ConnectRTT = float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case target.Scheme == "https":
+		s.probeALPN(ctx, target, conn, c)
+	case c.Configured == protocolH2C:
+		conn.Close()
+		s.probeH2C(ctx, target, c)
+	default:
+		conn.Close()
+	}
+
+	transport, closeConns := probeTransport(s.transport.Clone())
+	defer closeConns()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.JoinPath(c.ProbePath).String(), nil)
+	if err != nil {
+		c.ProbeFailure = err.Error()
+		return c
+	}
+	if s.health != nil && s.health.Host != "" {
+		req.Host = s.health.Host
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		c.ProbeFailure = err.Error()
+		c.warn("request over %s failed: %v", c.Configured, err)
+		return c
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	c.Protocol, c.ProbeStatus = resp.Proto, resp.StatusCode
+	if resp.StatusCode == http.StatusNotFound && s.health != nil && !s.health.GRPC {
+		c.warn("health check path %s answered 404", c.ProbePath)
+	}
+
+	return c
+}
+
+// probeALPN completes a TLS handshake on conn offering HTTP/2 and
+// HTTP/1.1, and records the protocol negotiated.
+func (s *simpleServer) probeALPN(ctx context.Context, target *url.URL, conn net.Conn, c *Capabilities) {
+	config := s.transport.TLSClientConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = target.Hostname()
+	}
+	config.NextProtos = []string{"h2", "http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.warn("TLS handshake failed: %v", err)
+		return
+	}
+	c.ALPN = tlsConn.ConnectionState().NegotiatedProtocol
+	if c.ALPN == "" {
+		c.ALPN = "http/1.1"
+	}
+	if s.transport.Protocols != nil && s.transport.Protocols.UnencryptedHTTP2() {
+		c.warn("h2c is configured for a server reached over TLS, which negotiated %s", c.ALPN)
+	}
+}
+
+// probeH2C tries cleartext HTTP/2 with prior knowledge and warns if the
+// server does not accept it. Servers not configured for h2c are not tried:
+// an HTTP/1 server hands the prior-knowledge preface, a "PRI *" request, to
+// its handler.
+func (s *simpleServer) probeH2C(ctx context.Context, target *url.URL, c *Capabilities) {
+	transport, closeConns := probeTransport(&http.Transport{Protocols: new(http.Protocols)})
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer closeConns()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.JoinPath(c.ProbePath).String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := transport.RoundTrip(req)
+	h2c := err == nil
+	if h2c {
+		resp.Body.Close()
+	} else if ctx.Err() != nil {
+		return
+	}
+	c.H2C = &h2c
+
+	if !h2c {
+		c.warn("h2c is configured but the server does not accept cleartext HTTP/2")
+	}
+}
+
+// probeTransport returns transport with its connections tracked and a
+// function closing all of them. A server without h2c takes the HTTP/2
+// preface for an HTTP/1.1 request and may never answer it, which leaves
+// the connection open after the request is canceled.
+func probeTransport(transport *http.Transport) (*http.Transport, func()) {
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	}
+
+	return transport, func() {
+		transport.CloseIdleConnections()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func healthHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			http.NotFound(rw, req)
+		}
+	})
+}
+
+func newH2CBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewUnstartedServer(healthHandler())
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	http1 := httptest.NewServer(healthHandler())
+	defer http1.Close()
+	h2c := newH2CBackend(t)
+	tlsBackend := httptest.NewUnstartedServer(healthHandler())
+	tlsBackend.EnableHTTP2 = true
+	tlsBackend.StartTLS()
+	defer tlsBackend.Close()
+	insecure := WithUpstreamTLS(UpstreamTLS{InsecureSkipVerify: true})
+	health := WithHealthCheck(HealthCheck{Path: "/health"})
+
+	for _, tc := range []struct {
+		name       string
+		addr       string
+		opts       []ServerOption
+		configured string
+		alpn       string
+		h2c        *bool
+		protocol   string
+		warning    string
+	}{
+		{name: "http1", addr: http1.URL, opts: []ServerOption{health}, configured: protocolHTTP1, protocol: "HTTP/1.1"},
+		{name: "h2c", addr: h2c.URL, opts: []ServerOption{health, WithH2C()}, configured: protocolH2C, h2c: ptr(true), protocol: "HTTP/2.0"},
+		{
+			name: "h2c not accepted", addr: http1.URL, opts: []ServerOption{health, WithH2C()}, configured: protocolH2C, h2c: new(bool),
+			warning: "does not accept cleartext HTTP/2",
+		},
+		{name: "h2c not configured", addr: h2c.URL, opts: []ServerOption{health}, configured: protocolHTTP1, protocol: "HTTP/1.1"},
+		{name: "tls", addr: tlsBackend.URL, opts: []ServerOption{health, insecure}, configured: protocolALPN, alpn: "h2", protocol: "HTTP/2.0"},
+		{
+			name: "missing health path", addr: http1.URL, opts: []ServerOption{WithHealthCheck(HealthCheck{Path: "/healthz"})}, configured: protocolHTTP1,
+			protocol: "HTTP/1.1", warning: "/healthz answered 404",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := newSimpleServer(tc.addr, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			c := server.ProbeCapabilities(context.Background())
+
+			if c.Configured != tc.configured || c.ALPN != tc.alpn || c.Protocol != tc.protocol {
+				t.Errorf("Expected %s, ALPN %q and protocol %q, got %+v", tc.configured, tc.alpn, tc.protocol, c)
+			}
+			if (c.H2C == nil) != (tc.h2c == nil) || c.H2C != nil && *c.H2C != *tc.h2c {
+				t.Errorf("Expected h2c %v, got %v", tc.h2c, c.H2C)
+			}
+			if c.ConnectRTT <= 0 {
+				t.Errorf("Expected a connect RTT, got %v", c.ConnectRTT)
+			}
+			warnings := strings.Join(c.Warnings, "; ")
+			if tc.warning == "" && warnings != "" || !strings.Contains(warnings, tc.warning) {
+				t.Errorf("Expected warning %q, got %q", tc.warning, warnings)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestCapabilityProbe_OnRegistration(t *testing.T) {
+	h2c := newH2CBackend(t)
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}},
+		WithCapabilityProbe(CapabilityProbe{Timeout: time.Second}))
+	server, err := newSimpleServer(h2c.URL, WithH2C())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.AddServer(server); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		rw := httptest.NewRecorder()
+		lb.handleStatus(rw, httptest.NewRequest("GET", "/status", nil))
+		return rw.Body.String()
+	}
+	waitFor(t, "the capability probe", func() bool { return strings.Contains(status(), `"capabilities"`) })
+	var got struct {
+		Servers []ServerStats `json:"servers"`
+	}
+	if err := json.Unmarshal([]byte(status()), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range got.Servers {
+		if s.Address == h2c.URL && (s.Capabilities == nil || s.Capabilities.Protocol != "HTTP/2.0") {
+			t.Errorf("Expected the h2c server to answer in HTTP/2, got %+v", s.Capabilities)
+		}
+	}
+}
+
+func TestCapabilityProbe_Timeout(t *testing.T) {
+	// A server that never answers holds the probe until its timeout. It is
+	// released before closing, which waits for its requests.
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer func() {
+		close(release)
+		stalled.Close()
+	}()
+	server, err := newSimpleServer(stalled.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	c := server.ProbeCapabilities(ctx)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the probe to end at its timeout, took %v", time.Since(start))
+	}
+	if c.ProbeFailure == "" {
+		t.Error("Expected the probe to report its failure")
+	}
+}
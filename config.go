@@ -0,0 +1,3158 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written in configuration files as a
+// string such as "30s" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// Redacted is a configuration string holding a secret. It is decoded like
+// any string but always encoded as "<redacted>", so the secret never
+// appears in configuration dumps.
+type Redacted string
+
+func (r Redacted) MarshalJSON() ([]byte, error) {
+	if r == "" {
+		return json.Marshal("")
+	}
+
+	return json.Marshal(redactedValue)
+}
+
+// Config is the configuration of the load balancer, as read from a JSON
+// file or built in code and passed to Build.
+type Config struct {
+	Port      string         `json:"port"`
+	AdminPort string         `json:"admin_port"`
+	Servers   []ServerConfig `json:"servers"`
+	Routes    []RouteConfig  `json:"routes"`
+
+	// ServerDefaults holds settings inherited by every server, including
+	// servers added at runtime, that the server does not set itself.
+	ServerDefaults *ServerConfig `json:"server_defaults,omitempty"`
+
+	// AllowEmptyPool permits starting without servers, for pools filled
+	// through the admin API.
+	AllowEmptyPool bool `json:"allow_empty_pool,omitempty"`
+
+	// StrictRoutes rejects configurations with routes that can never match
+	// or whose outcome depends on their order, instead of warning about
+	// them.
+	StrictRoutes bool `json:"strict_routes,omitempty"`
+
+	// Strategy names the selection strategy: "round-robin" (the default),
+	// "weighted-least-connections" or "least-reported-load", which needs
+	// health checks with a load_path.
+	Strategy string `json:"strategy,omitempty"`
+
+	// Strategies is an ordered fallback chain used instead of Strategy, e.g.
+	// ["cookie-hash:SESSIONID", "client-ip-hash", "round-robin"]. Hash
+	// strategies pass to the next one when their key is missing.
+	Strategies []string `json:"strategies,omitempty"`
+
+	// Warmup sends synthetic requests to servers added at runtime before
+	// they receive real traffic.
+	Warmup *WarmupConfig `json:"warmup,omitempty"`
+
+	// Retry retries failed upstream attempts on another server.
+	Retry *RetryConfig `json:"retry,omitempty"`
+
+	// Redirects passes, rewrites or follows redirects from servers.
+	Redirects *RedirectConfig `json:"redirects,omitempty"`
+
+	// BodyBuffer bounds the buffering of request bodies for replay. It
+	// defaults to 64 KiB in memory, forwarding larger bodies without retries.
+	BodyBuffer *BodyBufferConfig `json:"body_buffer,omitempty"`
+
+	// HeaderLimits bounds the size and number of request headers. The
+	// largest max_total also sets the listeners' header limit.
+	HeaderLimits *HeaderLimitsConfig `json:"header_limits,omitempty"`
+
+	// UnsafeFaultInjection allows routes to inject faults. It must never be
+	// set in production.
+	UnsafeFaultInjection bool `json:"unsafe_fault_injection,omitempty"`
+
+	// BackendOverride allows forcing debugging requests to a server with the
+	// X-LB-Backend header.
+	BackendOverride *BackendOverrideConfig `json:"backend_override,omitempty"`
+
+	// Debug explains the server selection of requests in the X-LB-Debug
+	// response header.
+	Debug *DebugConfig `json:"debug,omitempty"`
+
+	// InstanceID distinguishes this load balancer from others serving the
+	// same traffic in the served-by header, the access log and metrics. It
+	// defaults to the hostname.
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// ServedBy adds a response header naming the instance and optionally the
+	// server that handled each request.
+	ServedBy *ServedByConfig `json:"served_by,omitempty"`
+
+	// DockerDiscovery adds servers for the running Docker containers
+	// labeled for it. The pool may then start out empty.
+	DockerDiscovery *DockerDiscoveryConfig `json:"docker_discovery,omitempty"`
+
+	// SRVDiscovery maintains servers from DNS SRV records. The pool may
+	// then start out empty.
+	SRVDiscovery *SRVDiscoveryConfig `json:"srv_discovery,omitempty"`
+
+	// ControlPlane pulls the servers and routes from a signed document
+	// served by a control plane. The pool may then start out empty.
+	ControlPlane *ControlPlaneConfig `json:"control_plane,omitempty"`
+
+	// Gossip shares server health with other instances of the load
+	// balancer.
+	Gossip *GossipConfig `json:"gossip,omitempty"`
+
+	// FDGuard guards against running out of file descriptors.
+	FDGuard *FDGuardConfig `json:"fd_guard,omitempty"`
+
+	// CapabilityProbe probes the protocols servers support as they are
+	// registered.
+	CapabilityProbe *CapabilityProbeConfig `json:"capability_probe,omitempty"`
+
+	// Startup bounds how long startup waits for discovery and health checks
+	// before binding the listeners.
+	Startup *StartupConfig `json:"startup,omitempty"`
+
+	// HashLoadFactor bounds the in-flight requests of any server under the
+	// consistent-hash strategy to this multiple of the average. It defaults
+	// to 1.25 and must be at least 1.
+	HashLoadFactor float64 `json:"hash_load_factor,omitempty"`
+
+	// LogLevel is the level of operational logging to standard error
+	// ("debug", "info", "warn" or "error"). It defaults to info and can be
+	// changed at runtime with PUT /admin/loglevel.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// Queue holds requests for up to MaxWait while every eligible server is
+	// at its concurrency limit.
+	Queue *QueueConfigFile `json:"queue,omitempty"`
+
+	// ReusePort serves Port on several sockets bound with SO_REUSEPORT, each
+	// with its own accept loop, so the kernel spreads new connections across
+	// them. Listeners is their number and defaults to GOMAXPROCS. Linux only.
+	ReusePort bool `json:"reuse_port,omitempty"`
+	Listeners int  `json:"listeners,omitempty"`
+
+	// Passthrough proxies TLS connections on its own port to servers chosen
+	// by SNI, without terminating TLS.
+	Passthrough *PassthroughConfig `json:"passthrough,omitempty"`
+
+	// TLS serves the proxied traffic over HTTPS on its own port, and over
+	// HTTP/3 on the same UDP port when http3 is set.
+	TLS *ListenerTLSConfig `json:"tls,omitempty"`
+
+	// Connections bounds the client connections of the proxy listeners.
+	Connections *ConnectionsConfig `json:"connections,omitempty"`
+
+	// PathNormalization cleans request paths before routing.
+	PathNormalization *PathNormalizationConfig `json:"path_normalization,omitempty"`
+
+	// APIKeys requires clients to present an API key.
+	APIKeys *APIKeysConfig `json:"api_keys,omitempty"`
+
+	// DNS resolves server hostnames through a shared cache.
+	DNS *DNSConfigFile `json:"dns,omitempty"`
+
+	// StickySessions pins clients to a server with an affinity cookie.
+	StickySessions *StickySessionsConfig `json:"sticky_sessions,omitempty"`
+
+	// Streams bounds the lifetime of upgraded connections and event
+	// streams.
+	Streams *StreamPolicyConfig `json:"streams,omitempty"`
+
+	// StreamShutdown sets how streams end on shutdown.
+	StreamShutdown *StreamShutdownConfig `json:"stream_shutdown,omitempty"`
+
+	// Tenants isolates the teams sharing the load balancer.
+	Tenants *TenantsConfig `json:"tenants,omitempty"`
+
+	// SharedRateLimits keeps the rate limits of API keys and tenants in
+	// Redis, shared with other instances.
+	SharedRateLimits *SharedRateLimitsConfig `json:"shared_rate_limits,omitempty"`
+
+	// GeoIP resolves the country of clients from a MaxMind DB, for routing
+	// by country and region.
+	GeoIP *GeoIPConfig `json:"geoip,omitempty"`
+
+	// AdaptiveWeights adjusts the weights of servers to their recent
+	// latency and error rate.
+	AdaptiveWeights *AdaptiveWeightsConfig `json:"adaptive_weights,omitempty"`
+
+	// Deadline bounds the time requests may take and tells servers the
+	// budget left.
+	Deadline *DeadlineConfig `json:"deadline,omitempty"`
+
+	// Alerts publishes events when servers or the pool degrade.
+	Alerts *AlertsConfig `json:"alerts,omitempty"`
+
+	// Ramp shifts traffic from a baseline pool to a target pool in steps.
+	Ramp *RampConfig `json:"ramp,omitempty"`
+
+	// Feedback heeds the load and drain requests servers send in a
+	// response header. It trusts the servers, so it is off by default.
+	Feedback *FeedbackConfig `json:"feedback,omitempty"`
+
+	// Mirror sends a sample of requests to a candidate server as well and
+	// compares the responses.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+
+	// Cache caches GET responses of servers in memory.
+	Cache *CacheConfig `json:"cache,omitempty"`
+
+	// ErrorPages renders the load balancer's own error responses from
+	// templates, keyed by status code such as "503".
+	ErrorPages map[string]*ResponseTemplateConfig `json:"error_pages,omitempty"`
+
+	// TemplateVars are the variables error pages and static responses are
+	// rendered with, as .Vars.
+	TemplateVars map[string]string `json:"template_vars,omitempty"`
+
+	// UnixSocket optionally serves proxied traffic on a unix socket in
+	// addition to Port.
+	UnixSocket string `json:"unix_socket,omitempty"`
+
+	// AccessLog is the file access log lines are appended to, or "-" for
+	// standard output. The access log is disabled when empty.
+	AccessLog string `json:"access_log,omitempty"`
+
+	// AccessLogRotate rotates an access log file by size or age.
+	AccessLogRotate *RotateConfigFile `json:"access_log_rotate,omitempty"`
+
+	// AccessLogFormat chooses the fields of access log lines and samples
+	// them.
+	AccessLogFormat *AccessLogFormatConfig `json:"access_log_format,omitempty"`
+
+	// Snapshot periodically appends per-server statistics to a JSONL file.
+	Snapshot *SnapshotConfig `json:"snapshot,omitempty"`
+
+	// Recording samples traffic to a JSONL file for the replay subcommand.
+	Recording *RecordingConfig `json:"recording,omitempty"`
+
+	// State persists the liveness, failure counts and latencies of servers
+	// across restarts.
+	State *StateConfig `json:"state,omitempty"`
+
+	// HealthHistory is the number of health transitions kept per server and
+	// shown in the status, 16 by default.
+	HealthHistory int `json:"health_history,omitempty"`
+
+	// RecentErrors is the number of upstream errors kept for
+	// /admin/errors, 100 by default.
+	RecentErrors int `json:"recent_errors,omitempty"`
+
+	// FlapDetection holds down servers whose health flaps.
+	FlapDetection *FlapDetectionConfig `json:"flap_detection,omitempty"`
+
+	// FairnessAudit scores how evenly servers are selected over time.
+	FairnessAudit *FairnessAuditConfig `json:"fairness_audit,omitempty"`
+
+	// MinHealthyServers is the number of healthy servers the pool needs for
+	// /readyz to succeed. It defaults to 1.
+	MinHealthyServers *int `json:"min_healthy_servers,omitempty"`
+
+	// LogProbes includes /healthz and /readyz requests in the access log.
+	LogProbes bool `json:"log_probes,omitempty"`
+
+	// MaxProbeAge is how old the newest probe may be for
+	// /lb/pools/{name}/health to succeed. It defaults to three health
+	// intervals of the most often probed server.
+	MaxProbeAge Duration `json:"max_probe_age,omitempty"`
+
+	// PreStopDelay is how long /readyz fails before the listeners close on
+	// shutdown, so upstream load balancers stop sending traffic first.
+	PreStopDelay Duration `json:"pre_stop_delay,omitempty"`
+
+	// ShutdownTimeout bounds how long in-flight requests are drained on
+	// shutdown or after handing listeners to an upgraded process.
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
+
+	// path, hash and loadedAt identify the file the configuration was
+	// loaded from: its path, its SHA-256 and when it was read.
+	path     string
+	hash     string
+	loadedAt time.Time
+}
+
+// fieldSet holds the keys of a JSON object, recording which fields of a
+// configuration struct were set explicitly.
+type fieldSet map[string]bool
+
+// decodeFieldSet returns the keys of the JSON object data.
+func decodeFieldSet(data []byte) (fieldSet, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	set := make(fieldSet, len(fields))
+	for k := range fields {
+		set[k] = true
+	}
+
+	return set, nil
+}
+
+// has reports whether the field with the given key was set. Structs built in
+// code rather than decoded have no field set, and nonZero decides instead.
+func (s fieldSet) has(key string, nonZero bool) bool {
+	if s == nil {
+		return nonZero
+	}
+
+	return s[key]
+}
+
+// ServerConfig describes a single backend server.
+type ServerConfig struct {
+	// Name identifies the server in metrics, sticky sessions, saved state,
+	// logs and the admin API, so that its address may change without
+	// losing them. It defaults to the address.
+	Name    string            `json:"name,omitempty"`
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	// Weight is the relative capacity of the server. It defaults to 1 when
+	// omitted; an explicit 0 keeps the server as a last resort.
+	Weight *int `json:"weight,omitempty"`
+
+	// Priority is the failover priority group of the server. Servers of
+	// higher priorities only take requests when no server of a lower one
+	// is available.
+	Priority int `json:"priority,omitempty"`
+
+	// MaxConcurrent caps the requests in flight to the server; 0 is
+	// unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// ResponseHeaderTimeout bounds the wait for response headers once the
+	// request has been sent.
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty"`
+
+	// FirstByteTimeout fails attempts that received no byte of the
+	// response, headers or body, that long after they started, unless
+	// their route sets its own.
+	FirstByteTimeout Duration `json:"first_byte_timeout,omitempty"`
+
+	// ConnMaxAge closes idle connections to the server once they are that
+	// old, so that connections dropped by middleboxes are not reused.
+	ConnMaxAge Duration `json:"conn_max_age,omitempty"`
+
+	// Maintenance schedules recurring windows in which the server is taken
+	// out of selection.
+	Maintenance []MaintenanceWindowConfig `json:"maintenance,omitempty"`
+
+	// TLSSessionCacheSize is the number of TLS sessions kept for resumption
+	// with an HTTPS server. It defaults to 64; a negative size disables
+	// resumption.
+	TLSSessionCacheSize int `json:"tls_session_cache_size,omitempty"`
+
+	// H2C forwards requests over cleartext HTTP/2, as gRPC servers without
+	// TLS expect.
+	H2C bool `json:"h2c,omitempty"`
+
+	// Required fails startup when the server's hostname does not resolve.
+	// Other servers start as pending and join the pool once it resolves.
+	Required bool `json:"required,omitempty"`
+
+	// TLS verifies the certificate of a server with an https address.
+	TLS *UpstreamTLSConfig `json:"tls,omitempty"`
+
+	// ExternalScheme adjusts the server's responses to the scheme of its
+	// clients.
+	ExternalScheme *ExternalSchemeConfig `json:"external_scheme,omitempty"`
+
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	// Prewarm keeps idle connections open to the server.
+	Prewarm *PrewarmConfig `json:"prewarm,omitempty"`
+
+	// AcceptEncoding sets the content codings negotiated with the server.
+	AcceptEncoding *UpstreamEncodingConfig `json:"accept_encoding,omitempty"`
+
+	// Auth signs the requests sent to the server.
+	Auth *AuthConfig `json:"auth,omitempty"`
+
+	// set records the fields present in the file, so that an explicit zero
+	// overrides a default while an omitted field inherits it.
+	set fieldSet
+}
+
+func (sc *ServerConfig) UnmarshalJSON(data []byte) error {
+	type plain ServerConfig
+	if err := json.Unmarshal(data, (*plain)(sc)); err != nil {
+		return err
+	}
+	var err error
+	sc.set, err = decodeFieldSet(data)
+
+	return err
+}
+
+// withDefaults returns sc with the fields it does not set taken from d.
+// Labels are merged, with the server's own labels taking precedence, and
+// health checks are merged field by field.
+func (sc ServerConfig) withDefaults(d *ServerConfig) ServerConfig {
+	if d == nil {
+		return sc
+	}
+
+	r := sc
+	if !sc.set.has("weight", sc.Weight != nil) {
+		r.Weight = d.Weight
+	}
+	if !sc.set.has("priority", sc.Priority != 0) {
+		r.Priority = d.Priority
+	}
+	if !sc.set.has("max_concurrent", sc.MaxConcurrent != 0) {
+		r.MaxConcurrent = d.MaxConcurrent
+	}
+	if !sc.set.has("response_header_timeout", sc.ResponseHeaderTimeout != 0) {
+		r.ResponseHeaderTimeout = d.ResponseHeaderTimeout
+	}
+	if !sc.set.has("first_byte_timeout", sc.FirstByteTimeout != 0) {
+		r.FirstByteTimeout = d.FirstByteTimeout
+	}
+	if !sc.set.has("conn_max_age", sc.ConnMaxAge != 0) {
+		r.ConnMaxAge = d.ConnMaxAge
+	}
+	if !sc.set.has("tls_session_cache_size", sc.TLSSessionCacheSize != 0) {
+		r.TLSSessionCacheSize = d.TLSSessionCacheSize
+	}
+	if !sc.set.has("h2c", sc.H2C) {
+		r.H2C = d.H2C
+	}
+	if !sc.set.has("required", sc.Required) {
+		r.Required = d.Required
+	}
+	if !sc.set.has("tls", sc.TLS != nil) {
+		r.TLS = d.TLS
+	}
+	if !sc.set.has("external_scheme", sc.ExternalScheme != nil) {
+		r.ExternalScheme = d.ExternalScheme
+	}
+	if !sc.set.has("maintenance", sc.Maintenance != nil) {
+		r.Maintenance = d.Maintenance
+	}
+	if !sc.set.has("auth", sc.Auth != nil) {
+		r.Auth = d.Auth
+	}
+	if !sc.set.has("prewarm", sc.Prewarm != nil) {
+		r.Prewarm = d.Prewarm
+	}
+	if !sc.set.has("accept_encoding", sc.AcceptEncoding != nil) {
+		r.AcceptEncoding = d.AcceptEncoding
+	}
+	if len(d.Labels) > 0 {
+		r.Labels = maps.Clone(d.Labels)
+		maps.Copy(r.Labels, sc.Labels)
+	}
+	switch {
+	case !sc.set.has("health_check", sc.HealthCheck != nil):
+		r.HealthCheck = d.HealthCheck
+	case sc.HealthCheck != nil && d.HealthCheck != nil:
+		hc := sc.HealthCheck.withDefaults(d.HealthCheck)
+		r.HealthCheck = &hc
+	}
+
+	return r
+}
+
+// QueueConfigFile is the file representation of QueueConfig.
+type QueueConfigFile struct {
+	Depth   int        `json:"depth"`
+	MaxWait Duration   `json:"max_wait"`
+	Shed    ShedPolicy `json:"shed,omitempty"`
+}
+
+// RotateConfigFile is the file representation of RotateConfig. Daily
+// rotation is a max_age of "24h".
+type RotateConfigFile struct {
+	MaxSize int64    `json:"max_size,omitempty"`
+	MaxAge  Duration `json:"max_age,omitempty"`
+}
+
+func (c *RotateConfigFile) build() RotateConfig {
+	if c == nil {
+		return RotateConfig{}
+	}
+
+	return RotateConfig{MaxSize: c.MaxSize, MaxAge: time.Duration(c.MaxAge)}
+}
+
+// AccessLogFormatConfig is the file representation of AccessLogFormat.
+type AccessLogFormatConfig struct {
+	Fields   []string                 `json:"fields,omitempty"`
+	Template string                   `json:"template,omitempty"`
+	Sampling *AccessLogSamplingConfig `json:"sampling,omitempty"`
+}
+
+// AccessLogSamplingConfig is the file representation of AccessLogSampling.
+type AccessLogSamplingConfig struct {
+	SlowThreshold  Duration `json:"slow_threshold,omitempty"`
+	SuccessPercent float64  `json:"success_percent"`
+}
+
+func (c *AccessLogFormatConfig) build() AccessLogFormat {
+	f := AccessLogFormat{Fields: c.Fields, Template: c.Template}
+	if s := c.Sampling; s != nil {
+		f.Sampling = &AccessLogSampling{SlowThreshold: time.Duration(s.SlowThreshold), SuccessPercent: s.SuccessPercent}
+	}
+
+	return f
+}
+
+// SnapshotConfig describes the periodic statistics snapshot file.
+type SnapshotConfig struct {
+	Path     string            `json:"path"`
+	Interval Duration          `json:"interval"`
+	Rotate   *RotateConfigFile `json:"rotate,omitempty"`
+}
+
+// RecordingConfig is the file representation of Recording, written to Path.
+// max_body defaults to 64 KiB and a negative value records no bodies.
+type RecordingConfig struct {
+	Path          string            `json:"path"`
+	Rotate        *RotateConfigFile `json:"rotate,omitempty"`
+	SamplePercent float64           `json:"sample_percent"`
+	Routes        []string          `json:"routes,omitempty"`
+	RedactHeaders []string          `json:"redact_headers,omitempty"`
+	MaxBody       int               `json:"max_body,omitempty"`
+	QueueSize     int               `json:"queue_size,omitempty"`
+}
+
+// StateConfig describes the state file. The state is saved every Interval,
+// 30s by default, and on shutdown; at startup it is restored unless it was
+// saved more than MaxAge ago, 10m by default.
+type StateConfig struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval,omitempty"`
+	MaxAge   Duration `json:"max_age,omitempty"`
+}
+
+// PassthroughConfig is the file representation of Passthrough, served on
+// Port.
+type PassthroughConfig struct {
+	Port             string          `json:"port"`
+	Rules            []SNIRuleConfig `json:"rules"`
+	Default          string          `json:"default,omitempty"`
+	CloseUnmatched   bool            `json:"close_unmatched,omitempty"`
+	HandshakeTimeout Duration        `json:"handshake_timeout,omitempty"`
+	Balance          string          `json:"balance,omitempty"`
+	DialRetries      int             `json:"dial_retries,omitempty"`
+	FailAfter        int             `json:"fail_after,omitempty"`
+	EjectFor         Duration        `json:"eject_for,omitempty"`
+}
+
+// ListenerTLSConfig is the file representation of ListenerTLS, with the
+// certificate and key read from PEM files, again on SIGHUP.
+type ListenerTLSConfig struct {
+	Port          string   `json:"port"`
+	CertFile      string   `json:"cert_file"`
+	KeyFile       string   `json:"key_file"`
+	HTTP3         bool     `json:"http3,omitempty"`
+	AltSvcMaxAge  Duration `json:"alt_svc_max_age,omitempty"`
+	OCSPStapling  bool     `json:"ocsp_stapling,omitempty"`
+	ExpiryWarning Duration `json:"expiry_warning,omitempty"`
+}
+
+func (c *ListenerTLSConfig) build() (ListenerTLS, error) {
+	if c.Port == "" || c.CertFile == "" || c.KeyFile == "" {
+		return ListenerTLS{}, fmt.Errorf("tls: port, cert_file and key_file are required")
+	}
+	if c.AltSvcMaxAge < 0 || c.ExpiryWarning < 0 {
+		return ListenerTLS{}, fmt.Errorf("tls: alt_svc_max_age and expiry_warning must not be negative")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return ListenerTLS{}, fmt.Errorf("tls: %w", err)
+	}
+
+	return ListenerTLS{
+		Port:          c.Port,
+		Certificate:   cert,
+		HTTP3:         c.HTTP3,
+		AltSvcMaxAge:  time.Duration(c.AltSvcMaxAge),
+		CertFile:      c.CertFile,
+		KeyFile:       c.KeyFile,
+		OCSPStapling:  c.OCSPStapling,
+		ExpiryWarning: time.Duration(c.ExpiryWarning),
+	}, nil
+}
+
+// SNIRuleConfig is the file representation of SNIRule.
+type SNIRuleConfig struct {
+	Host     string `json:"host"`
+	Selector string `json:"selector"`
+}
+
+func (c *PassthroughConfig) build() (Passthrough, error) {
+	if c.Port == "" {
+		return Passthrough{}, fmt.Errorf("passthrough: port is required")
+	}
+	switch c.Balance {
+	case "", passthroughLeastConnections:
+	default:
+		return Passthrough{}, fmt.Errorf("passthrough: unknown balance %q", c.Balance)
+	}
+	if c.DialRetries < 0 || c.FailAfter < 0 || c.EjectFor < 0 {
+		return Passthrough{}, fmt.Errorf("passthrough: dial_retries, fail_after and eject_for must not be negative")
+	}
+	p := Passthrough{
+		CloseUnmatched:   c.CloseUnmatched,
+		HandshakeTimeout: time.Duration(c.HandshakeTimeout),
+		Balance:          c.Balance,
+		DialRetries:      c.DialRetries,
+		FailAfter:        c.FailAfter,
+		EjectFor:         time.Duration(c.EjectFor),
+	}
+	for _, rc := range c.Rules {
+		if rc.Host == "" || strings.Contains(strings.TrimPrefix(rc.Host, "*."), "*") {
+			return Passthrough{}, fmt.Errorf("passthrough: invalid host %q", rc.Host)
+		}
+		selector, err := ParseSelector(rc.Selector)
+		if err != nil {
+			return Passthrough{}, fmt.Errorf("passthrough: host %q: %w", rc.Host, err)
+		}
+		p.Rules = append(p.Rules, SNIRule{Host: rc.Host, Selector: selector})
+	}
+	var err error
+	if p.Default, err = ParseSelector(c.Default); err != nil {
+		return Passthrough{}, fmt.Errorf("passthrough: default: %w", err)
+	}
+
+	return p, nil
+}
+
+// FlapDetectionConfig is the file representation of FlapDetection.
+type FlapDetectionConfig struct {
+	Transitions int      `json:"transitions"`
+	Window      Duration `json:"window"`
+	Quiet       Duration `json:"quiet"`
+}
+
+// FairnessAuditConfig is the file representation of FairnessAudit.
+type FairnessAuditConfig struct {
+	Window      Duration `json:"window,omitempty"`
+	History     int      `json:"history,omitempty"`
+	WarnRatio   float64  `json:"warn_ratio,omitempty"`
+	WarnWindows int      `json:"warn_windows,omitempty"`
+}
+
+func (c *FairnessAuditConfig) build() (FairnessAudit, error) {
+	if c.Window < 0 || c.History < 0 || c.WarnWindows < 0 {
+		return FairnessAudit{}, fmt.Errorf("fairness_audit: window, history and warn_windows must not be negative")
+	}
+	if c.WarnRatio != 0 && c.WarnRatio < 1 {
+		return FairnessAudit{}, fmt.Errorf("fairness_audit: warn_ratio must be at least 1")
+	}
+
+	return FairnessAudit{
+		Window:      time.Duration(c.Window),
+		History:     c.History,
+		WarnRatio:   c.WarnRatio,
+		WarnWindows: c.WarnWindows,
+	}, nil
+}
+
+// BackendOverrideConfig is the file representation of BackendOverride.
+// Enabling it requires a secret or at least one allowed CIDR.
+type BackendOverrideConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Secret       Redacted `json:"secret,omitempty"`
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+}
+
+func (c *BackendOverrideConfig) build() (BackendOverride, error) {
+	o := BackendOverride{Enabled: c.Enabled, Secret: string(c.Secret)}
+	for _, cidr := range c.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return BackendOverride{}, fmt.Errorf("backend_override: %w", err)
+		}
+		o.AllowedPrefixes = append(o.AllowedPrefixes, prefix)
+	}
+	if o.Enabled && o.Secret == "" && len(o.AllowedPrefixes) == 0 {
+		return BackendOverride{}, fmt.Errorf("backend_override: enabling it requires a secret or allowed_cidrs")
+	}
+
+	return o, nil
+}
+
+// DebugConfig is the file representation of DebugExplain. It requires a
+// secret unless always is set.
+type DebugConfig struct {
+	Always bool     `json:"always,omitempty"`
+	Secret Redacted `json:"secret,omitempty"`
+}
+
+func (c *DebugConfig) build() (DebugExplain, error) {
+	if !c.Always && c.Secret == "" {
+		return DebugExplain{}, fmt.Errorf("debug: a secret is required unless always is set")
+	}
+
+	return DebugExplain{Always: c.Always, Secret: string(c.Secret)}, nil
+}
+
+// DockerDiscoveryConfig configures discovering servers from Docker
+// containers. Empty fields take the defaults of the docker package.
+type DockerDiscoveryConfig struct {
+	Socket      string `json:"socket,omitempty"`
+	LabelPrefix string `json:"label_prefix,omitempty"`
+	Host        string `json:"host,omitempty"`
+}
+
+// SRVDiscoveryConfig is the file representation of SRVDiscovery.
+type SRVDiscoveryConfig struct {
+	Name       string   `json:"name"`
+	Scheme     string   `json:"scheme,omitempty"`
+	Interval   Duration `json:"interval,omitempty"`
+	PerAddress bool     `json:"per_address,omitempty"`
+	Grace      Duration `json:"grace,omitempty"`
+}
+
+func (c *SRVDiscoveryConfig) build() (SRVDiscovery, error) {
+	if c.Name == "" {
+		return SRVDiscovery{}, fmt.Errorf("srv_discovery: name is required")
+	}
+	if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+		return SRVDiscovery{}, fmt.Errorf("srv_discovery: scheme must be http or https")
+	}
+	if c.Interval < 0 || c.Grace < 0 {
+		return SRVDiscovery{}, fmt.Errorf("srv_discovery: interval and grace must not be negative")
+	}
+
+	return SRVDiscovery{
+		Name:       c.Name,
+		Scheme:     c.Scheme,
+		Interval:   time.Duration(c.Interval),
+		PerAddress: c.PerAddress,
+		Grace:      time.Duration(c.Grace),
+	}, nil
+}
+
+// ControlPlaneConfig is the file representation of ControlPlane. Key
+// names the HMAC key or the Ed25519 public key as "env:<name>" or
+// "file:<path>".
+type ControlPlaneConfig struct {
+	URL       string   `json:"url"`
+	Interval  Duration `json:"interval,omitempty"`
+	Algorithm string   `json:"algorithm"`
+	Key       Redacted `json:"key"`
+	History   int      `json:"history,omitempty"`
+}
+
+func (c *ControlPlaneConfig) build() (ControlPlane, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ControlPlane{}, fmt.Errorf("control_plane: url must be an http or https URL")
+	}
+	if c.Interval < 0 || c.History < 0 {
+		return ControlPlane{}, fmt.Errorf("control_plane: interval and history must not be negative")
+	}
+	key, err := LoadSecret(string(c.Key))
+	if err != nil {
+		return ControlPlane{}, fmt.Errorf("control_plane: %w", err)
+	}
+	switch algorithm := ControlPlaneAlgorithm(c.Algorithm); algorithm {
+	case ControlPlaneHMAC:
+	case ControlPlaneEd25519:
+		if pub, err := base64.StdEncoding.DecodeString(key.Value()); err != nil || len(pub) != ed25519.PublicKeySize {
+			return ControlPlane{}, fmt.Errorf("control_plane: ed25519 key must be a base64 %d byte public key", ed25519.PublicKeySize)
+		}
+	default:
+		return ControlPlane{}, fmt.Errorf("control_plane: unknown algorithm %q, want hmac-sha256 or ed25519", algorithm)
+	}
+
+	return ControlPlane{
+		URL:       c.URL,
+		Interval:  time.Duration(c.Interval),
+		Algorithm: ControlPlaneAlgorithm(c.Algorithm),
+		Key:       key,
+		History:   c.History,
+	}, nil
+}
+
+// GossipConfig is the file representation of Gossip. Peers are the base
+// URLs of the admin APIs of the other instances, and Key names the key they
+// share as "env:<name>" or "file:<path>".
+type GossipConfig struct {
+	Peers    []string `json:"peers"`
+	Key      Redacted `json:"key"`
+	TrustFor Duration `json:"trust_for,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+func (c *GossipConfig) build() (Gossip, error) {
+	if len(c.Peers) == 0 {
+		return Gossip{}, fmt.Errorf("gossip: peers are required")
+	}
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Gossip{}, fmt.Errorf("gossip: peer %q must be an http or https URL", peer)
+		}
+	}
+	if c.TrustFor < 0 || c.Timeout < 0 {
+		return Gossip{}, fmt.Errorf("gossip: trust_for and timeout must not be negative")
+	}
+	key, err := LoadSecret(string(c.Key))
+	if err != nil {
+		return Gossip{}, fmt.Errorf("gossip: %w", err)
+	}
+
+	return Gossip{
+		Peers:    c.Peers,
+		Key:      key,
+		TrustFor: time.Duration(c.TrustFor),
+		Timeout:  time.Duration(c.Timeout),
+	}, nil
+}
+
+// FDGuardConfig is the file representation of FDGuard.
+type FDGuardConfig struct {
+	Enforce   bool     `json:"enforce,omitempty"`
+	HighWater float64  `json:"high_water,omitempty"`
+	LowWater  float64  `json:"low_water,omitempty"`
+	Interval  Duration `json:"interval,omitempty"`
+}
+
+func (c *FDGuardConfig) build() (FDGuard, error) {
+	high, low := c.HighWater, c.LowWater
+	if high == 0 {
+		high = defaultFDHighWater
+	}
+	if low == 0 {
+		low = defaultFDLowWater
+	}
+	if low <= 0 || high > 1 || low >= high {
+		return FDGuard{}, fmt.Errorf("fd_guard: want 0 < low_water < high_water <= 1, got %g and %g", low, high)
+	}
+	if c.Interval < 0 {
+		return FDGuard{}, fmt.Errorf("fd_guard: interval must not be negative")
+	}
+
+	return FDGuard{Enforce: c.Enforce, HighWater: high, LowWater: low, Interval: time.Duration(c.Interval)}, nil
+}
+
+// CapabilityProbeConfig is the file representation of CapabilityProbe.
+type CapabilityProbeConfig struct {
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (c *CapabilityProbeConfig) build() (CapabilityProbe, error) {
+	if c.Timeout < 0 {
+		return CapabilityProbe{}, fmt.Errorf("capability_probe: timeout must not be negative")
+	}
+
+	return CapabilityProbe{Timeout: time.Duration(c.Timeout)}, nil
+}
+
+// StartupConfig is the file representation of Startup.
+type StartupConfig struct {
+	DiscoveryTimeout Duration `json:"discovery_timeout,omitempty"`
+	HealthTimeout    Duration `json:"health_timeout,omitempty"`
+}
+
+func (c *StartupConfig) build() (Startup, error) {
+	if c.DiscoveryTimeout < 0 || c.HealthTimeout < 0 {
+		return Startup{}, fmt.Errorf("startup: discovery_timeout and health_timeout must not be negative")
+	}
+
+	return Startup{DiscoveryTimeout: time.Duration(c.DiscoveryTimeout), HealthTimeout: time.Duration(c.HealthTimeout)}, nil
+}
+
+// ServedByConfig is the file representation of ServedBy. Backend is "" to
+// leave the server out, "opaque" or "address".
+type ServedByConfig struct {
+	Header  string          `json:"header,omitempty"`
+	Backend BackendIdentity `json:"backend,omitempty"`
+}
+
+func (c *ServedByConfig) build() (ServedBy, error) {
+	switch c.Backend {
+	case BackendIdentityNone, BackendIdentityOpaque, BackendIdentityAddress:
+	default:
+		return ServedBy{}, fmt.Errorf("served_by: unknown backend identity %q", c.Backend)
+	}
+
+	return ServedBy{Header: c.Header, Backend: c.Backend}, nil
+}
+
+// WarmupConfig is the file representation of Warmup.
+type WarmupConfig struct {
+	Requests  []WarmupRequestConfig `json:"requests"`
+	Timeout   Duration              `json:"timeout,omitempty"`
+	FailOpen  bool                  `json:"fail_open,omitempty"`
+	SlowStart Duration              `json:"slow_start,omitempty"`
+}
+
+// WarmupRequestConfig is the file representation of WarmupRequest.
+type WarmupRequestConfig struct {
+	Method      string            `json:"method,omitempty"`
+	Path        string            `json:"path"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Count       int               `json:"count"`
+	Concurrency int               `json:"concurrency,omitempty"`
+}
+
+func (c *WarmupConfig) build() (Warmup, error) {
+	w := Warmup{Timeout: time.Duration(c.Timeout), FailOpen: c.FailOpen, SlowStart: time.Duration(c.SlowStart)}
+	if w.SlowStart < 0 {
+		return Warmup{}, fmt.Errorf("warmup: slow_start must not be negative")
+	}
+	for _, rc := range c.Requests {
+		if rc.Count <= 0 || rc.Concurrency < 0 {
+			return Warmup{}, fmt.Errorf("warmup %s: count must be positive", rc.Path)
+		}
+		header := http.Header{}
+		for k, v := range rc.Headers {
+			header.Set(k, v)
+		}
+		w.Requests = append(w.Requests, WarmupRequest{
+			Method:      rc.Method,
+			Path:        rc.Path,
+			Header:      header,
+			Count:       rc.Count,
+			Concurrency: rc.Concurrency,
+		})
+	}
+
+	return w, nil
+}
+
+// MaintenanceWindowConfig is the file representation of MaintenanceWindow.
+// Start is a time of day such as "03:00", Days are abbreviated weekdays such
+// as "sun" and Timezone is an IANA name such as "Europe/Berlin".
+type MaintenanceWindowConfig struct {
+	Start    string   `json:"start"`
+	Duration Duration `json:"duration"`
+	Days     []string `json:"days,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+	Lead     Duration `json:"lead,omitempty"`
+
+	// SlowStart ramps the server back up to its full weight after the
+	// window.
+	SlowStart Duration `json:"slow_start,omitempty"`
+}
+
+func (c *MaintenanceWindowConfig) build() (MaintenanceWindow, error) {
+	start, err := time.Parse("15:04", c.Start)
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance: start %q is not a time of day like 03:00", c.Start)
+	}
+	w := MaintenanceWindow{
+		Start:     time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		Duration:  time.Duration(c.Duration),
+		Lead:      time.Duration(c.Lead),
+		SlowStart: time.Duration(c.SlowStart),
+	}
+	if w.Duration <= 0 || w.Duration > 24*time.Hour || w.Lead < 0 || w.Lead > 24*time.Hour ||
+		w.SlowStart < 0 || w.SlowStart > 24*time.Hour {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance: duration must be positive and duration, lead and slow_start at most 24h")
+	}
+	for _, day := range c.Days {
+		i := slices.Index(weekdayNames, strings.ToLower(day))
+		if i < 0 {
+			return MaintenanceWindow{}, fmt.Errorf("maintenance: unknown day %q", day)
+		}
+		w.Days = append(w.Days, time.Weekday(i))
+	}
+	if c.Timezone != "" {
+		w.Location, err = time.LoadLocation(c.Timezone)
+		if err != nil {
+			return MaintenanceWindow{}, fmt.Errorf("maintenance: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+// weekdayNames are the names of time.Weekday values in configuration files.
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// HealthCheckConfig describes active health checking of a server. Host,
+// ServerName, CAFile and InsecureSkipVerify apply to probes only, so they can
+// mimic real traffic independently of the proxy transport.
+type HealthCheckConfig struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	Host               string   `json:"host,omitempty"`
+	ServerName         string   `json:"server_name,omitempty"`
+	CAFile             string   `json:"ca_file,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+	Port               string   `json:"port,omitempty"`
+	GRPC               bool     `json:"grpc,omitempty"`
+	GRPCService        string   `json:"grpc_service,omitempty"`
+	LoadPath           string   `json:"load_path,omitempty"`
+	LoadStaleIntervals int      `json:"load_stale_intervals,omitempty"`
+
+	set fieldSet
+}
+
+func (c *HealthCheckConfig) UnmarshalJSON(data []byte) error {
+	type plain HealthCheckConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var err error
+	c.set, err = decodeFieldSet(data)
+
+	return err
+}
+
+// withDefaults returns c with the fields it does not set taken from d.
+func (c HealthCheckConfig) withDefaults(d *HealthCheckConfig) HealthCheckConfig {
+	r := c
+	if !c.set.has("path", c.Path != "") {
+		r.Path = d.Path
+	}
+	if !c.set.has("interval", c.Interval != 0) {
+		r.Interval = d.Interval
+	}
+	if !c.set.has("timeout", c.Timeout != 0) {
+		r.Timeout = d.Timeout
+	}
+	if !c.set.has("host", c.Host != "") {
+		r.Host = d.Host
+	}
+	if !c.set.has("server_name", c.ServerName != "") {
+		r.ServerName = d.ServerName
+	}
+	if !c.set.has("ca_file", c.CAFile != "") {
+		r.CAFile = d.CAFile
+	}
+	if !c.set.has("insecure_skip_verify", c.InsecureSkipVerify) {
+		r.InsecureSkipVerify = d.InsecureSkipVerify
+	}
+	if !c.set.has("port", c.Port != "") {
+		r.Port = d.Port
+	}
+	if !c.set.has("grpc", c.GRPC) {
+		r.GRPC = d.GRPC
+	}
+	if !c.set.has("grpc_service", c.GRPCService != "") {
+		r.GRPCService = d.GRPCService
+	}
+	if !c.set.has("load_path", c.LoadPath != "") {
+		r.LoadPath = d.LoadPath
+	}
+	if !c.set.has("load_stale_intervals", c.LoadStaleIntervals != 0) {
+		r.LoadStaleIntervals = d.LoadStaleIntervals
+	}
+
+	return r
+}
+
+// UpstreamTLSConfig is the file representation of UpstreamTLS.
+type UpstreamTLSConfig struct {
+	ServerName         string `json:"server_name,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// build converts the configuration into an UpstreamTLS, loading the CA
+// bundle.
+func (c *UpstreamTLSConfig) build() (UpstreamTLS, error) {
+	t := UpstreamTLS{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return UpstreamTLS{}, err
+		}
+		t.RootCAs = pool
+	}
+
+	return t, nil
+}
+
+// ExternalSchemeConfig is the file representation of ExternalScheme.
+// SameSite is "lax", "strict" or "none".
+type ExternalSchemeConfig struct {
+	Locations     bool   `json:"locations,omitempty"`
+	SecureCookies bool   `json:"secure_cookies,omitempty"`
+	SameSite      string `json:"same_site,omitempty"`
+}
+
+func (c *ExternalSchemeConfig) build() (ExternalScheme, error) {
+	e := ExternalScheme{Locations: c.Locations, SecureCookies: c.SecureCookies}
+	switch strings.ToLower(c.SameSite) {
+	case "":
+	case "lax":
+		e.SameSite = http.SameSiteLaxMode
+	case "strict":
+		e.SameSite = http.SameSiteStrictMode
+	case "none":
+		e.SameSite = http.SameSiteNoneMode
+	default:
+		return ExternalScheme{}, fmt.Errorf("external_scheme: same_site must be lax, strict or none")
+	}
+
+	return e, nil
+}
+
+// PrewarmConfig is the file representation of Prewarm.
+type PrewarmConfig struct {
+	MinIdle int    `json:"min_idle"`
+	Path    string `json:"path,omitempty"`
+}
+
+func (c *PrewarmConfig) build() (Prewarm, error) {
+	if c.MinIdle <= 0 {
+		return Prewarm{}, fmt.Errorf("prewarm: min_idle must be positive")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return Prewarm{}, fmt.Errorf("prewarm: path %q must start with /", c.Path)
+	}
+
+	return Prewarm{MinIdle: c.MinIdle, Path: c.Path}, nil
+}
+
+// UpstreamEncodingConfig is the file representation of UpstreamEncoding:
+// mode "pass", "identity" or "force" with the encodings to force.
+type UpstreamEncodingConfig struct {
+	Mode      EncodingMode `json:"mode"`
+	Encodings []string     `json:"encodings,omitempty"`
+}
+
+func (c *UpstreamEncodingConfig) build() (UpstreamEncoding, error) {
+	e := UpstreamEncoding{Mode: c.Mode, Encodings: c.Encodings}
+	if err := e.validate(); err != nil {
+		return UpstreamEncoding{}, fmt.Errorf("accept_encoding: %w", err)
+	}
+
+	return e, nil
+}
+
+// build converts the configuration into a HealthCheck, loading the CA bundle.
+func (c *HealthCheckConfig) build() (HealthCheck, error) {
+	hc := HealthCheck{
+		Path:               c.Path,
+		Interval:           time.Duration(c.Interval),
+		Timeout:            time.Duration(c.Timeout),
+		Host:               c.Host,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		Port:               c.Port,
+		GRPC:               c.GRPC,
+		GRPCService:        c.GRPCService,
+		LoadPath:           c.LoadPath,
+		LoadStaleIntervals: c.LoadStaleIntervals,
+	}
+	if c.LoadStaleIntervals < 0 {
+		return HealthCheck{}, fmt.Errorf("load_stale_intervals must not be negative")
+	}
+	if c.LoadPath != "" && c.GRPC {
+		return HealthCheck{}, fmt.Errorf("load_path does not apply to gRPC health checks")
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return HealthCheck{}, err
+		}
+		hc.RootCAs = pool
+	}
+
+	return hc, nil
+}
+
+// RouteConfig describes a route constraining selection to a labelled subset
+// of servers. Selector uses the syntax accepted by ParseSelector.
+type RouteConfig struct {
+	Name            string            `json:"name"`
+	PathPrefix      string            `json:"path_prefix"`
+	Selector        string            `json:"selector"`
+	HeaderSelectors map[string]string `json:"header_selectors,omitempty"`
+	Fallback        SelectorFallback  `json:"fallback,omitempty"`
+
+	// PathPattern matches whole paths, e.g. "/users/{id}/avatar", instead
+	// of path_prefix.
+	PathPattern string `json:"path_pattern,omitempty"`
+
+	// CaseInsensitive matches the path prefix or pattern regardless of
+	// case.
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+
+	// TrailingSlash is "strict", the default, "ignore", "strip" or
+	// "redirect".
+	TrailingSlash TrailingSlash `json:"trailing_slash,omitempty"`
+
+	// SetHeaders sets request headers, with {path.<name>} placeholders.
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+
+	// Retry overrides the top-level retry policy for the route.
+	Retry *RetryConfig `json:"retry,omitempty"`
+
+	// BodyBuffer overrides the top-level body buffering policy for the route.
+	BodyBuffer *BodyBufferConfig `json:"body_buffer,omitempty"`
+
+	// Strategies overrides the top-level strategy chain for the route.
+	Strategies []string `json:"strategies,omitempty"`
+
+	// HeaderLimits overrides the top-level header limits for the route.
+	HeaderLimits *HeaderLimitsConfig `json:"header_limits,omitempty"`
+
+	// Faults injects failures into the route's requests for resilience
+	// testing. It requires unsafe_fault_injection.
+	Faults *FaultInjectionConfig `json:"faults,omitempty"`
+
+	// Sensitive keeps the route's request bodies out of recordings.
+	Sensitive bool `json:"sensitive,omitempty"`
+
+	// RawPath forwards the route's request paths without normalization.
+	RawPath bool `json:"raw_path,omitempty"`
+
+	// StickySessions overrides the top-level sticky sessions for the route.
+	StickySessions *StickySessionsConfig `json:"sticky_sessions,omitempty"`
+
+	// Streams overrides the top-level stream policy for the route.
+	Streams *StreamPolicyConfig `json:"streams,omitempty"`
+
+	// Redirects overrides the top-level redirect policy for the route.
+	Redirects *RedirectConfig `json:"redirects,omitempty"`
+
+	// Auth signs the route's requests to servers.
+	Auth *AuthConfig `json:"auth,omitempty"`
+
+	// Stale overrides the stale windows of the route's cached responses.
+	Stale *StaleConfig `json:"stale,omitempty"`
+
+	// NegativeTTL caches the route's 404 and 410 responses for that long.
+	NegativeTTL Duration `json:"negative_ttl,omitempty"`
+
+	// Compare overrides how mirrored responses of the route are compared.
+	Compare *ComparisonConfig `json:"compare,omitempty"`
+
+	// Idempotency deduplicates the route's requests carrying an
+	// Idempotency-Key header.
+	Idempotency *IdempotencyConfig `json:"idempotency,omitempty"`
+
+	// Static answers the route's requests without contacting a server.
+	Static *StaticResponseConfig `json:"static,omitempty"`
+
+	// Countries restricts the route to clients in the listed countries. It
+	// requires geoip.
+	Countries []string `json:"countries,omitempty"`
+
+	// Validate rejects the route's responses that fail validation.
+	Validate *ResponseValidationConfig `json:"validate,omitempty"`
+
+	// Journal accepts the route's requests into a journal in a directory
+	// and delivers them in the background.
+	Journal *JournalConfig `json:"journal,omitempty"`
+
+	// Transform rewrites the route's request bodies before they are sent
+	// to servers.
+	Transform *TransformConfig `json:"transform,omitempty"`
+
+	// AuthRequest consults an auth service before the route's requests are
+	// proxied.
+	AuthRequest *AuthRequestConfig `json:"auth_request,omitempty"`
+
+	// GRPCService restricts the route to the methods of a gRPC service,
+	// e.g. "helloworld.Greeter".
+	GRPCService string `json:"grpc_service,omitempty"`
+
+	// ReadWrite sends the route's writes to the servers matching its
+	// writes selector and its reads to those matching its selector.
+	ReadWrite *ReadWriteSplitConfig `json:"read_write,omitempty"`
+
+	// Methods restricts the methods of the route's requests.
+	Methods *MethodPolicyConfig `json:"methods,omitempty"`
+
+	// FirstByteTimeout fails attempts that received no byte of the
+	// response that long after they started, overriding the servers'.
+	FirstByteTimeout Duration `json:"first_byte_timeout,omitempty"`
+}
+
+// MethodPolicyConfig is the file representation of MethodPolicy. Methods
+// are case-insensitive.
+type MethodPolicyConfig struct {
+	Allow             []string `json:"allow"`
+	SynthesizeOptions bool     `json:"synthesize_options,omitempty"`
+}
+
+func (c *MethodPolicyConfig) build() (*MethodPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if len(c.Allow) == 0 {
+		return nil, fmt.Errorf("methods: allow must list at least one method")
+	}
+	p := &MethodPolicy{SynthesizeOptions: c.SynthesizeOptions}
+	for _, m := range c.Allow {
+		if !validMethod(m) {
+			return nil, fmt.Errorf("methods: invalid method %q", m)
+		}
+		p.Allow = append(p.Allow, strings.ToUpper(m))
+	}
+
+	return p, nil
+}
+
+// ReadWriteSplitConfig is the file representation of ReadWriteSplit.
+type ReadWriteSplitConfig struct {
+	Writes   string   `json:"writes"`
+	PinReads Duration `json:"pin_reads,omitempty"`
+	Cookie   string   `json:"cookie,omitempty"`
+}
+
+func (c *ReadWriteSplitConfig) build() (*ReadWriteSplit, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Writes == "" {
+		return nil, fmt.Errorf("read_write: writes is required")
+	}
+	writes, err := ParseSelector(c.Writes)
+	if err != nil {
+		return nil, fmt.Errorf("read_write: writes: %w", err)
+	}
+	if c.PinReads < 0 {
+		return nil, fmt.Errorf("read_write: pin_reads must not be negative")
+	}
+
+	return &ReadWriteSplit{Writes: writes, PinReads: time.Duration(c.PinReads), Cookie: c.Cookie}, nil
+}
+
+// AuthConfig describes a Signer. Type "token" sets a StaticToken, by
+// default as a bearer token in the Authorization header, and "hmac" an
+// HMACSigner signature. Secret names the token or key as "env:<name>" or
+// "file:<path>". Any other type names a signer registered with
+// RegisterSigner, which takes no further settings.
+type AuthConfig struct {
+	Type   string   `json:"type"`
+	Header string   `json:"header,omitempty"`
+	Scheme string   `json:"scheme,omitempty"`
+	Secret Redacted `json:"secret,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+func (c *AuthConfig) build() (Signer, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.Type {
+	case "token", "hmac":
+	default:
+		if signer, ok := registeredSigner(c.Type); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("auth: unknown type %q", c.Type)
+	}
+	secret, err := LoadSecret(string(c.Secret))
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+
+	if c.Type == "token" {
+		scheme := c.Scheme
+		if c.Header == "" && scheme == "" {
+			scheme = "Bearer"
+		}
+		return StaticToken{Header: c.Header, Scheme: scheme, Token: secret}, nil
+	}
+	if err := checkSignedFields(c.Fields); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+
+	return HMACSigner{Header: c.Header, Fields: c.Fields, Key: secret}, nil
+}
+
+// FaultInjectionConfig is the file representation of FaultInjection.
+// Percentages range from 0 to 100.
+type FaultInjectionConfig struct {
+	DelayPercent float64  `json:"delay_percent,omitempty"`
+	DelayMin     Duration `json:"delay_min,omitempty"`
+	DelayMax     Duration `json:"delay_max,omitempty"`
+	AbortPercent float64  `json:"abort_percent,omitempty"`
+	AbortStatus  int      `json:"abort_status,omitempty"`
+	ResetPercent float64  `json:"reset_percent,omitempty"`
+	Header       string   `json:"header,omitempty"`
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+}
+
+func (c *FaultInjectionConfig) build() (*FaultInjection, error) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, p := range []float64{c.DelayPercent, c.AbortPercent, c.ResetPercent} {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("faults: percentages must be between 0 and 100")
+		}
+	}
+	if c.DelayMin < 0 || c.DelayMax < 0 {
+		return nil, fmt.Errorf("faults: delays must not be negative")
+	}
+	if c.DelayMax < c.DelayMin {
+		c.DelayMax = c.DelayMin
+	}
+	if c.AbortPercent > 0 && (c.AbortStatus < 400 || c.AbortStatus > 599) {
+		return nil, fmt.Errorf("faults: abort_status must be an error status")
+	}
+
+	f := &FaultInjection{
+		DelayPercent: c.DelayPercent,
+		DelayMin:     time.Duration(c.DelayMin),
+		DelayMax:     time.Duration(c.DelayMax),
+		AbortPercent: c.AbortPercent,
+		AbortStatus:  c.AbortStatus,
+		ResetPercent: c.ResetPercent,
+		Header:       c.Header,
+	}
+	for _, cidr := range c.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("faults: %w", err)
+		}
+		f.AllowedPrefixes = append(f.AllowedPrefixes, prefix)
+	}
+
+	return f, nil
+}
+
+// HeaderLimitsConfig is the file representation of HeaderLimits.
+type HeaderLimitsConfig struct {
+	MaxSize  int `json:"max_size,omitempty"`
+	MaxTotal int `json:"max_total,omitempty"`
+	MaxCount int `json:"max_count,omitempty"`
+}
+
+func (c *HeaderLimitsConfig) build() (*HeaderLimits, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MaxSize < 0 || c.MaxTotal < 0 || c.MaxCount < 0 {
+		return nil, fmt.Errorf("header_limits: limits must not be negative")
+	}
+
+	return &HeaderLimits{MaxSize: c.MaxSize, MaxTotal: c.MaxTotal, MaxCount: c.MaxCount}, nil
+}
+
+// BodyBufferConfig is the file representation of BodyBufferPolicy.
+type BodyBufferConfig struct {
+	MaxMemory int64        `json:"max_memory"`
+	Overflow  BodyOverflow `json:"overflow,omitempty"`
+	MaxFile   int64        `json:"max_file,omitempty"`
+	TempDir   string       `json:"temp_dir,omitempty"`
+}
+
+func (c *BodyBufferConfig) build() (*BodyBufferPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.Overflow {
+	case "":
+		c.Overflow = OverflowProceed
+	case OverflowProceed, OverflowReject:
+	case OverflowSpill:
+		if c.MaxFile <= c.MaxMemory {
+			return nil, fmt.Errorf("body_buffer: max_file must exceed max_memory")
+		}
+	default:
+		return nil, fmt.Errorf("body_buffer: unknown overflow %q", c.Overflow)
+	}
+	if c.MaxMemory < 0 {
+		return nil, fmt.Errorf("body_buffer: max_memory must not be negative")
+	}
+
+	return &BodyBufferPolicy{MaxMemory: c.MaxMemory, Overflow: c.Overflow, MaxFile: c.MaxFile, TempDir: c.TempDir}, nil
+}
+
+// RetryConfig is the file representation of RetryPolicy. On lists error
+// classes such as "connect-refused" or "status-503".
+type RetryConfig struct {
+	Attempts int          `json:"attempts"`
+	On       []ErrorClass `json:"on,omitempty"`
+	Repeat   RetryRepeat  `json:"repeat,omitempty"`
+}
+
+func (c *RetryConfig) build() (*RetryPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, class := range c.On {
+		if !slices.Contains(errorClasses, class) {
+			return nil, fmt.Errorf("retry: unknown error class %q", class)
+		}
+	}
+	switch c.Repeat {
+	case "", RepeatAllow, RepeatFail:
+	default:
+		return nil, fmt.Errorf("retry: unknown repeat %q", c.Repeat)
+	}
+
+	return &RetryPolicy{Attempts: c.Attempts, On: c.On, Repeat: c.Repeat}, nil
+}
+
+// RedirectConfig is the file representation of RedirectPolicy. Mode is
+// "pass", "rewrite" or "follow".
+type RedirectConfig struct {
+	Mode    RedirectMode `json:"mode"`
+	MaxHops int          `json:"max_hops,omitempty"`
+}
+
+func (c *RedirectConfig) build() (*RedirectPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.Mode {
+	case RedirectPass, RedirectRewrite, RedirectFollow:
+	default:
+		return nil, fmt.Errorf("redirects: unknown mode %q", c.Mode)
+	}
+	if c.MaxHops < 0 {
+		return nil, fmt.Errorf("redirects: max_hops must not be negative")
+	}
+
+	return &RedirectPolicy{Mode: c.Mode, MaxHops: c.MaxHops}, nil
+}
+
+// CacheConfig is the file representation of ResponseCache.
+type CacheConfig struct {
+	DefaultTTL Duration `json:"default_ttl,omitempty"`
+	MaxEntries int      `json:"max_entries,omitempty"`
+	MaxBody    int64    `json:"max_body,omitempty"`
+	MaxBytes   int64    `json:"max_bytes,omitempty"`
+	Shards     int      `json:"shards,omitempty"`
+	HeapLimit  uint64   `json:"heap_limit,omitempty"`
+
+	FailureBackoff    Duration `json:"failure_backoff,omitempty"`
+	MaxFailureBackoff Duration `json:"max_failure_backoff,omitempty"`
+}
+
+func (c *CacheConfig) build() (*ResponseCache, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.DefaultTTL < 0 || c.MaxEntries < 0 || c.MaxBody < 0 || c.MaxBytes < 0 || c.Shards < 0 {
+		return nil, fmt.Errorf("cache: default_ttl, max_entries, max_body, max_bytes and shards must not be negative")
+	}
+	if c.FailureBackoff < 0 || c.MaxFailureBackoff < 0 {
+		return nil, fmt.Errorf("cache: failure_backoff and max_failure_backoff must not be negative")
+	}
+	if c.MaxFailureBackoff > 0 && c.MaxFailureBackoff < c.FailureBackoff {
+		return nil, fmt.Errorf("cache: max_failure_backoff %s is below failure_backoff %s", time.Duration(c.MaxFailureBackoff), time.Duration(c.FailureBackoff))
+	}
+
+	return &ResponseCache{
+		DefaultTTL: time.Duration(c.DefaultTTL),
+		MaxEntries: c.MaxEntries,
+		MaxBody:    c.MaxBody,
+		MaxBytes:   c.MaxBytes,
+		Shards:     c.Shards,
+		HeapLimit:  c.HeapLimit,
+
+		FailureBackoff:    time.Duration(c.FailureBackoff),
+		MaxFailureBackoff: time.Duration(c.MaxFailureBackoff),
+	}, nil
+}
+
+// IdempotencyConfig is the file representation of IdempotencyKeys.
+type IdempotencyConfig struct {
+	TTL     Duration `json:"ttl,omitempty"`
+	MaxKeys int      `json:"max_keys,omitempty"`
+	MaxBody int64    `json:"max_body,omitempty"`
+}
+
+// JournalConfig is the file representation of Journal.
+type JournalConfig struct {
+	Dir          string   `json:"dir"`
+	MaxEntries   int      `json:"max_entries,omitempty"`
+	MaxBytes     int64    `json:"max_bytes,omitempty"`
+	MaxBody      int64    `json:"max_body,omitempty"`
+	Sync         string   `json:"sync,omitempty"`
+	SyncInterval Duration `json:"sync_interval,omitempty"`
+	Backoff      Duration `json:"backoff,omitempty"`
+	MaxBackoff   Duration `json:"max_backoff,omitempty"`
+}
+
+func (c *JournalConfig) build() (*Journal, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Dir == "" {
+		return nil, fmt.Errorf("journal: dir is required")
+	}
+	if c.MaxEntries < 0 || c.MaxBytes < 0 || c.MaxBody < 0 || c.SyncInterval < 0 || c.Backoff < 0 || c.MaxBackoff < 0 {
+		return nil, fmt.Errorf("journal: max_entries, max_bytes, max_body, sync_interval, backoff and max_backoff must not be negative")
+	}
+	switch sync := JournalSync(c.Sync); sync {
+	case "", JournalSyncAlways, JournalSyncInterval, JournalSyncNever:
+	default:
+		return nil, fmt.Errorf("journal: unknown sync %q, want always, interval or never", sync)
+	}
+
+	return &Journal{
+		Dir:          c.Dir,
+		MaxEntries:   c.MaxEntries,
+		MaxBytes:     c.MaxBytes,
+		MaxBody:      c.MaxBody,
+		Sync:         JournalSync(c.Sync),
+		SyncInterval: time.Duration(c.SyncInterval),
+		Backoff:      time.Duration(c.Backoff),
+		MaxBackoff:   time.Duration(c.MaxBackoff),
+	}, nil
+}
+
+// TransformConfig is the file representation of BodyTransform.
+type TransformConfig struct {
+	Steps         []TransformStepConfig `json:"steps"`
+	MaxBody       int64                 `json:"max_body,omitempty"`
+	FailureStatus int                   `json:"failure_status,omitempty"`
+}
+
+// TransformStepConfig describes a RequestTransformer. Type
+// "gzip_decompress" sets GzipDecompress and "json_field" a JSONField
+// setting Path from From. Any other type names a transformer registered
+// with RegisterTransformer, which takes no further settings.
+type TransformStepConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+	From string `json:"from,omitempty"`
+}
+
+func (c *TransformConfig) build() (*BodyTransform, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if len(c.Steps) == 0 {
+		return nil, fmt.Errorf("transform: steps are required")
+	}
+	if c.MaxBody < 0 {
+		return nil, fmt.Errorf("transform: max_body must not be negative")
+	}
+	if err := checkTransformStatus(c.FailureStatus); err != nil {
+		return nil, fmt.Errorf("transform: %w", err)
+	}
+	t := &BodyTransform{MaxBody: c.MaxBody, FailureStatus: c.FailureStatus}
+	for _, step := range c.Steps {
+		switch step.Type {
+		case "gzip_decompress":
+			t.Transformers = append(t.Transformers, GzipDecompress{})
+		case "json_field":
+			f := JSONField{Path: step.Path, From: step.From}
+			if err := checkJSONField(f); err != nil {
+				return nil, fmt.Errorf("transform: %w", err)
+			}
+			t.Transformers = append(t.Transformers, f)
+		default:
+			transformer, ok := registeredTransformer(step.Type)
+			if !ok {
+				return nil, fmt.Errorf("transform: unknown type %q", step.Type)
+			}
+			t.Transformers = append(t.Transformers, transformer)
+		}
+	}
+
+	return t, nil
+}
+
+// AuthRequestConfig is the file representation of AuthRequest.
+// FailurePolicy is "closed", the default, or "open".
+type AuthRequestConfig struct {
+	URL             string   `json:"url"`
+	Timeout         Duration `json:"timeout,omitempty"`
+	RequestHeaders  []string `json:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+	DenyHeaders     []string `json:"deny_headers,omitempty"`
+	FailurePolicy   string   `json:"failure_policy,omitempty"`
+	MaxIdleConns    int      `json:"max_idle_conns,omitempty"`
+	CacheTTL        Duration `json:"cache_ttl,omitempty"`
+}
+
+func (c *AuthRequestConfig) build() (*AuthRequest, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("auth_request: url must be an absolute http or https URL, got %q", c.URL)
+	}
+	if c.Timeout < 0 || c.MaxIdleConns < 0 || c.CacheTTL < 0 {
+		return nil, fmt.Errorf("auth_request: timeout, max_idle_conns and cache_ttl must not be negative")
+	}
+	var failOpen bool
+	switch c.FailurePolicy {
+	case "", "closed":
+	case "open":
+		failOpen = true
+	default:
+		return nil, fmt.Errorf("auth_request: unknown failure_policy %q, want closed or open", c.FailurePolicy)
+	}
+
+	return &AuthRequest{
+		URL:             c.URL,
+		Timeout:         time.Duration(c.Timeout),
+		RequestHeaders:  c.RequestHeaders,
+		ResponseHeaders: c.ResponseHeaders,
+		DenyHeaders:     c.DenyHeaders,
+		FailOpen:        failOpen,
+		MaxIdleConns:    c.MaxIdleConns,
+		CacheTTL:        time.Duration(c.CacheTTL),
+	}, nil
+}
+
+// ResponseValidationConfig is the file representation of
+// ResponseValidation.
+type ResponseValidationConfig struct {
+	MinBodyBytes    int64    `json:"min_body_bytes,omitempty"`
+	ContentTypes    []string `json:"content_types,omitempty"`
+	RequiredHeaders []string `json:"required_headers,omitempty"`
+	JSON            bool     `json:"json,omitempty"`
+	MaxJSONBytes    int64    `json:"max_json_bytes,omitempty"`
+	EjectAfter      int      `json:"eject_after,omitempty"`
+	EjectFor        Duration `json:"eject_for,omitempty"`
+}
+
+func (c *ResponseValidationConfig) build() (*ResponseValidation, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MinBodyBytes < 0 || c.MaxJSONBytes < 0 || c.EjectAfter < 0 || c.EjectFor < 0 {
+		return nil, fmt.Errorf("validate: min_body_bytes, max_json_bytes, eject_after and eject_for must not be negative")
+	}
+
+	return &ResponseValidation{
+		MinBodyBytes:    c.MinBodyBytes,
+		ContentTypes:    c.ContentTypes,
+		RequiredHeaders: c.RequiredHeaders,
+		JSON:            c.JSON,
+		MaxJSONBytes:    c.MaxJSONBytes,
+		EjectAfter:      c.EjectAfter,
+		EjectFor:        time.Duration(c.EjectFor),
+	}, nil
+}
+
+func (c *IdempotencyConfig) build() (*IdempotencyKeys, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.TTL < 0 || c.MaxKeys < 0 || c.MaxBody < 0 {
+		return nil, fmt.Errorf("idempotency: ttl, max_keys and max_body must not be negative")
+	}
+
+	return &IdempotencyKeys{TTL: time.Duration(c.TTL), MaxKeys: c.MaxKeys, MaxBody: c.MaxBody}, nil
+}
+
+// ResponseTemplateConfig is the file representation of ResponseTemplate.
+// The template is Body, or the contents of File.
+type ResponseTemplateConfig struct {
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+	File        string `json:"file,omitempty"`
+}
+
+func (c *ResponseTemplateConfig) build() (*ResponseTemplate, error) {
+	if c.Body != "" && c.File != "" {
+		return nil, fmt.Errorf("body and file are mutually exclusive")
+	}
+	body := c.Body
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		body = string(data)
+	}
+
+	return ParseResponseTemplate(c.ContentType, body)
+}
+
+// StaticResponseConfig is the file representation of StaticResponse.
+type StaticResponseConfig struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	ResponseTemplateConfig
+}
+
+func (c *StaticResponseConfig) build() (*StaticResponse, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Status != 0 && (c.Status < 200 || c.Status > 599) {
+		return nil, fmt.Errorf("static: invalid status %d", c.Status)
+	}
+	s := &StaticResponse{Status: c.Status}
+	if len(c.Headers) > 0 {
+		s.Header = make(http.Header)
+		for name, value := range c.Headers {
+			s.Header.Set(name, value)
+		}
+	}
+	if c.Body != "" || c.File != "" {
+		body, err := c.ResponseTemplateConfig.build()
+		if err != nil {
+			return nil, fmt.Errorf("static: %w", err)
+		}
+		s.Body = body
+	}
+
+	return s, nil
+}
+
+// buildErrorPages parses the error page of each status code.
+func buildErrorPages(pages map[string]*ResponseTemplateConfig, errs *configErrors) map[int]*ResponseTemplate {
+	codes := make([]string, 0, len(pages))
+	for code := range pages {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	built := make(map[int]*ResponseTemplate)
+	for _, code := range codes {
+		page := pages[code]
+		path := fmt.Sprintf("error_pages[%s]", code)
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			errs.add(path, fmt.Errorf("not an error status code"))
+			continue
+		}
+		if page == nil {
+			errs.add(path, fmt.Errorf("page is required"))
+			continue
+		}
+		t, err := page.build()
+		if err != nil {
+			errs.add(path, err)
+			continue
+		}
+		built[status] = t
+	}
+
+	return built
+}
+
+// StaleConfig is the file representation of StalePolicy.
+type StaleConfig struct {
+	WhileRevalidate Duration `json:"while_revalidate,omitempty"`
+	IfError         Duration `json:"if_error,omitempty"`
+}
+
+func (c *StaleConfig) build() (*StalePolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.WhileRevalidate < 0 || c.IfError < 0 {
+		return nil, fmt.Errorf("stale: windows must not be negative")
+	}
+
+	return &StalePolicy{WhileRevalidate: time.Duration(c.WhileRevalidate), IfError: time.Duration(c.IfError)}, nil
+}
+
+// ConnectionsConfig is the file representation of ConnectionLimits.
+type ConnectionsConfig struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout,omitempty"`
+	ReadTimeout       Duration `json:"read_timeout,omitempty"`
+	WriteTimeout      Duration `json:"write_timeout,omitempty"`
+	IdleTimeout       Duration `json:"idle_timeout,omitempty"`
+	MaxLifetime       Duration `json:"max_lifetime,omitempty"`
+	MaxConnections    int      `json:"max_connections,omitempty"`
+}
+
+func (c *ConnectionsConfig) build() (ConnectionLimits, error) {
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 ||
+		c.MaxLifetime < 0 || c.MaxConnections < 0 {
+		return ConnectionLimits{}, fmt.Errorf("connections: limits must not be negative")
+	}
+
+	return ConnectionLimits{
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(c.ReadTimeout),
+		WriteTimeout:      time.Duration(c.WriteTimeout),
+		IdleTimeout:       time.Duration(c.IdleTimeout),
+		MaxLifetime:       time.Duration(c.MaxLifetime),
+		MaxConnections:    c.MaxConnections,
+	}, nil
+}
+
+// StickySessionsConfig is the file representation of StickySessions.
+type StickySessionsConfig struct {
+	Cookie    string        `json:"cookie,omitempty"`
+	OnFailure StickyFailure `json:"on_failure,omitempty"`
+}
+
+func (c *StickySessionsConfig) build() (*StickySessions, error) {
+	if c == nil {
+		return nil, nil
+	}
+	switch c.OnFailure {
+	case "", StickyFail, StickyRepin, StickyBestEffort:
+	default:
+		return nil, fmt.Errorf("sticky_sessions: unknown on_failure %q", c.OnFailure)
+	}
+
+	return StickySessions{Cookie: c.Cookie, OnFailure: c.OnFailure}.withDefaults(), nil
+}
+
+// StreamPolicyConfig is the file representation of StreamPolicy.
+type StreamPolicyConfig struct {
+	MaxDuration Duration `json:"max_duration,omitempty"`
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	DrainGrace  Duration `json:"drain_grace,omitempty"`
+}
+
+func (c *StreamPolicyConfig) build() (*StreamPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.MaxDuration < 0 || c.IdleTimeout < 0 || c.DrainGrace < 0 {
+		return nil, fmt.Errorf("streams: max_duration, idle_timeout and drain_grace must not be negative")
+	}
+
+	return &StreamPolicy{
+		MaxDuration: time.Duration(c.MaxDuration),
+		IdleTimeout: time.Duration(c.IdleTimeout),
+		DrainGrace:  time.Duration(c.DrainGrace),
+	}, nil
+}
+
+// StreamShutdownConfig is the file representation of StreamShutdown.
+type StreamShutdownConfig struct {
+	Grace Duration `json:"grace,omitempty"`
+	Event string   `json:"event,omitempty"`
+}
+
+func (c *StreamShutdownConfig) build() (StreamShutdown, error) {
+	if c.Grace < 0 {
+		return StreamShutdown{}, fmt.Errorf("stream_shutdown: grace must not be negative")
+	}
+
+	return StreamShutdown{Grace: time.Duration(c.Grace), Event: c.Event}, nil
+}
+
+// DNSConfigFile is the file representation of DNSConfig. Servers without
+// a port use port 53.
+type DNSConfigFile struct {
+	Servers     []string `json:"servers,omitempty"`
+	Timeout     Duration `json:"timeout,omitempty"`
+	TTL         Duration `json:"ttl,omitempty"`
+	NegativeTTL Duration `json:"negative_ttl,omitempty"`
+	StaleGrace  Duration `json:"stale_grace,omitempty"`
+}
+
+func (c *DNSConfigFile) build() (DNSConfig, error) {
+	if c.Timeout < 0 || c.TTL < 0 || c.NegativeTTL < 0 || c.StaleGrace < 0 {
+		return DNSConfig{}, fmt.Errorf("dns: durations must not be negative")
+	}
+	d := DNSConfig{
+		Timeout:     time.Duration(c.Timeout),
+		TTL:         time.Duration(c.TTL),
+		NegativeTTL: time.Duration(c.NegativeTTL),
+		StaleGrace:  time.Duration(c.StaleGrace),
+	}
+	for _, server := range c.Servers {
+		if addr, err := netip.ParseAddr(server); err == nil {
+			server = netip.AddrPortFrom(addr, 53).String()
+		}
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			return DNSConfig{}, fmt.Errorf("dns: server %q must be an IP address with an optional port", server)
+		}
+		d.Servers = append(d.Servers, server)
+	}
+
+	return d, nil
+}
+
+// PathNormalizationConfig is the file representation of
+// PathNormalization.
+type PathNormalizationConfig struct {
+	RejectTraversal bool `json:"reject_traversal,omitempty"`
+	LowercaseHost   bool `json:"lowercase_host,omitempty"`
+}
+
+// APIKeysConfig is the file representation of APIKeys.
+type APIKeysConfig struct {
+	Header     string         `json:"header,omitempty"`
+	QueryParam string         `json:"query_param,omitempty"`
+	Keys       []APIKeyConfig `json:"keys,omitempty"`
+	File       string         `json:"file,omitempty"`
+}
+
+func (c *APIKeysConfig) build() (APIKeys, error) {
+	a := APIKeys{Header: c.Header, QueryParam: c.QueryParam, File: c.File}
+	var errs []error
+	for i, kc := range c.Keys {
+		key, err := kc.build()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("api_keys.keys[%d]: %w", i, err))
+		}
+		a.Keys = append(a.Keys, key)
+	}
+
+	return a, errors.Join(errs...)
+}
+
+// SharedRateLimitsConfig is the file representation of SharedRateLimits,
+// with the buckets in the Redis server at Redis.Addr.
+type SharedRateLimitsConfig struct {
+	Redis    RedisConfig `json:"redis"`
+	FailOpen bool        `json:"fail_open,omitempty"`
+	LocalTTL Duration    `json:"local_ttl,omitempty"`
+}
+
+// RedisConfig is the file representation of Redis.
+type RedisConfig struct {
+	Addr      string   `json:"addr"`
+	Password  Redacted `json:"password,omitempty"`
+	DB        int      `json:"db,omitempty"`
+	KeyPrefix string   `json:"key_prefix,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+}
+
+func (c *SharedRateLimitsConfig) build() (SharedRateLimits, error) {
+	r := c.Redis
+	if r.Addr == "" {
+		return SharedRateLimits{}, fmt.Errorf("shared_rate_limits: redis.addr is required")
+	}
+	if r.DB < 0 || r.Timeout < 0 || c.LocalTTL < 0 {
+		return SharedRateLimits{}, fmt.Errorf("shared_rate_limits: db, timeout and local_ttl must not be negative")
+	}
+	store := NewRedisRateLimitStore(Redis{
+		Addr:      r.Addr,
+		Password:  string(r.Password),
+		DB:        r.DB,
+		KeyPrefix: r.KeyPrefix,
+		Timeout:   time.Duration(r.Timeout),
+	})
+
+	return SharedRateLimits{Store: store, FailOpen: c.FailOpen, LocalTTL: time.Duration(c.LocalTTL)}, nil
+}
+
+// GeoIPConfig is the file representation of GeoIP.
+type GeoIPConfig struct {
+	Path             string            `json:"path"`
+	ReloadInterval   Duration          `json:"reload_interval,omitempty"`
+	DefaultCountry   string            `json:"default_country,omitempty"`
+	DefaultContinent string            `json:"default_continent,omitempty"`
+	Regions          map[string]string `json:"regions,omitempty"`
+	RegionLabel      string            `json:"region_label,omitempty"`
+	Header           string            `json:"header,omitempty"`
+}
+
+func (c *GeoIPConfig) build() (GeoIP, error) {
+	if c.Path == "" {
+		return GeoIP{}, fmt.Errorf("geoip: path is required")
+	}
+	if c.ReloadInterval < 0 {
+		return GeoIP{}, fmt.Errorf("geoip: reload_interval must not be negative")
+	}
+	if len(c.Regions) > 0 && c.RegionLabel == "" {
+		return GeoIP{}, fmt.Errorf("geoip: regions require region_label")
+	}
+	regions := make(map[string]string, len(c.Regions))
+	for code, region := range c.Regions {
+		regions[strings.ToUpper(code)] = region
+	}
+
+	return GeoIP{
+		Path:           c.Path,
+		ReloadInterval: time.Duration(c.ReloadInterval),
+		Default:        GeoLocation{Country: strings.ToUpper(c.DefaultCountry), Continent: strings.ToUpper(c.DefaultContinent)},
+		Regions:        regions,
+		RegionLabel:    c.RegionLabel,
+		Header:         c.Header,
+	}, nil
+}
+
+// TenantsConfig is the file representation of Tenants.
+type TenantsConfig struct {
+	Source  TenantSource   `json:"source,omitempty"`
+	Header  string         `json:"header,omitempty"`
+	Key     string         `json:"key,omitempty"`
+	Tenants []TenantConfig `json:"tenants"`
+	Default string         `json:"default,omitempty"`
+}
+
+// TenantConfig is the file representation of a Tenant.
+type TenantConfig struct {
+	Name          string           `json:"name"`
+	IDs           []string         `json:"ids,omitempty"`
+	Selector      string           `json:"selector,omitempty"`
+	RateLimit     *RateLimitConfig `json:"rate_limit,omitempty"`
+	MaxConcurrent int              `json:"max_concurrent,omitempty"`
+}
+
+func (c *TenantsConfig) build() (Tenants, error) {
+	t := Tenants{Source: c.Source, Header: c.Header, Key: c.Key, Default: c.Default}
+	var errs []error
+	if c.Key != "" && (c.Source != "" || c.Header != "") {
+		errs = append(errs, fmt.Errorf("tenants: key replaces source and header"))
+	}
+	for i, tc := range c.Tenants {
+		selector, err := ParseSelector(tc.Selector)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenants.tenants[%d]: %w", i, err))
+		}
+		tenant := Tenant{Name: tc.Name, IDs: tc.IDs, Selector: selector, MaxConcurrent: tc.MaxConcurrent}
+		if tc.RateLimit != nil {
+			tenant.RateLimit = &RateLimit{PerSecond: tc.RateLimit.PerSecond, Burst: tc.RateLimit.Burst, Key: tc.RateLimit.Key}
+		}
+		t.Tenants = append(t.Tenants, tenant)
+	}
+
+	return t, errors.Join(errs...)
+}
+
+// APIKeyConfig is the file representation of an APIKey, also used in the
+// API key file. SHA256 is the hex SHA-256 of the key, never the key itself.
+type APIKeyConfig struct {
+	ID        string           `json:"id"`
+	SHA256    Redacted         `json:"sha256"`
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	Selector  string           `json:"selector,omitempty"`
+}
+
+// RateLimitConfig is the file representation of a RateLimit.
+type RateLimitConfig struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst,omitempty"`
+	Key       string  `json:"key,omitempty"`
+}
+
+func (c *APIKeyConfig) build() (APIKey, error) {
+	selector, err := ParseSelector(c.Selector)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key := APIKey{ID: c.ID, SHA256: string(c.SHA256), Selector: selector}
+	if c.RateLimit != nil {
+		key.RateLimit = &RateLimit{PerSecond: c.RateLimit.PerSecond, Burst: c.RateLimit.Burst, Key: c.RateLimit.Key}
+	}
+
+	return key, nil
+}
+
+// AdaptiveWeightsConfig is the file representation of AdaptiveWeights.
+type AdaptiveWeightsConfig struct {
+	Interval    Duration `json:"interval,omitempty"`
+	Floor       float64  `json:"floor,omitempty"`
+	Cap         float64  `json:"cap,omitempty"`
+	MaxStep     float64  `json:"max_step,omitempty"`
+	MinRequests uint64   `json:"min_requests,omitempty"`
+}
+
+func (c *AdaptiveWeightsConfig) build() (AdaptiveWeights, error) {
+	if c.Interval < 0 || c.Floor < 0 || c.Cap < 0 || c.MaxStep < 0 {
+		return AdaptiveWeights{}, fmt.Errorf("adaptive_weights: settings must not be negative")
+	}
+	if c.Floor >= 1 || c.Cap != 0 && c.Cap <= 1 {
+		return AdaptiveWeights{}, fmt.Errorf("adaptive_weights: floor must be below 1 and cap above 1")
+	}
+
+	return AdaptiveWeights{
+		Interval:    time.Duration(c.Interval),
+		Floor:       c.Floor,
+		Cap:         c.Cap,
+		MaxStep:     c.MaxStep,
+		MinRequests: c.MinRequests,
+	}, nil
+}
+
+// AlertsConfig is the file representation of Alerts.
+type AlertsConfig struct {
+	Window Duration          `json:"window,omitempty"`
+	Rules  []AlertRuleConfig `json:"rules"`
+}
+
+// AlertRuleConfig is the file representation of an AlertRule. ErrorRate is
+// a fraction, 0.05 for 5% of requests failing.
+type AlertRuleConfig struct {
+	Name        string   `json:"name"`
+	Selector    string   `json:"selector,omitempty"`
+	LatencyP95  Duration `json:"latency_p95,omitempty"`
+	ErrorRate   float64  `json:"error_rate,omitempty"`
+	MinHealthy  int      `json:"min_healthy,omitempty"`
+	For         int      `json:"for,omitempty"`
+	Cooldown    Duration `json:"cooldown,omitempty"`
+	MinRequests uint64   `json:"min_requests,omitempty"`
+}
+
+func (c *AlertsConfig) build() (Alerts, error) {
+	if c.Window < 0 {
+		return Alerts{}, fmt.Errorf("alerts: window must not be negative")
+	}
+	a := Alerts{Window: time.Duration(c.Window)}
+	names := make(map[string]bool, len(c.Rules))
+	for i, rc := range c.Rules {
+		if rc.Name == "" || names[rc.Name] {
+			return Alerts{}, fmt.Errorf("alerts: rules[%d]: names must be set and unique", i)
+		}
+		names[rc.Name] = true
+		selector, err := ParseSelector(rc.Selector)
+		if err != nil {
+			return Alerts{}, fmt.Errorf("alerts: rule %q: selector: %w", rc.Name, err)
+		}
+		conditions := 0
+		for _, set := range []bool{rc.LatencyP95 != 0, rc.ErrorRate != 0, rc.MinHealthy != 0} {
+			if set {
+				conditions++
+			}
+		}
+		if conditions != 1 {
+			return Alerts{}, fmt.Errorf("alerts: rule %q: exactly one of latency_p95, error_rate and min_healthy is required", rc.Name)
+		}
+		if rc.LatencyP95 < 0 || rc.ErrorRate < 0 || rc.ErrorRate >= 1 || rc.MinHealthy < 0 || rc.For < 0 || rc.Cooldown < 0 {
+			return Alerts{}, fmt.Errorf("alerts: rule %q: settings must not be negative, and error_rate must be below 1", rc.Name)
+		}
+		a.Rules = append(a.Rules, AlertRule{
+			Name:        rc.Name,
+			Selector:    selector,
+			LatencyP95:  time.Duration(rc.LatencyP95),
+			ErrorRate:   rc.ErrorRate,
+			MinHealthy:  rc.MinHealthy,
+			For:         rc.For,
+			Cooldown:    time.Duration(rc.Cooldown),
+			MinRequests: rc.MinRequests,
+		})
+	}
+
+	return a, nil
+}
+
+// RampConfig is the file representation of a Ramp. Baseline and Target
+// are label selectors, and MaxErrorRateIncrease a fraction, 0.01 for the
+// target failing 1% more of its requests than the baseline.
+type RampConfig struct {
+	Name                 string           `json:"name"`
+	Baseline             string           `json:"baseline"`
+	Target               string           `json:"target"`
+	Steps                []RampStepConfig `json:"steps"`
+	MaxErrorRateIncrease float64          `json:"max_error_rate_increase,omitempty"`
+	MaxLatencyRatio      float64          `json:"max_latency_ratio,omitempty"`
+	MinRequests          uint64           `json:"min_requests,omitempty"`
+	OnBreach             RampAction       `json:"on_breach,omitempty"`
+	CheckInterval        Duration         `json:"check_interval,omitempty"`
+	StateFile            string           `json:"state_file,omitempty"`
+}
+
+// RampStepConfig is the file representation of a RampStep.
+type RampStepConfig struct {
+	Percent  int      `json:"percent"`
+	Duration Duration `json:"duration"`
+}
+
+func (c *RampConfig) build() (Ramp, error) {
+	if c.Name == "" {
+		return Ramp{}, fmt.Errorf("ramp: name is required")
+	}
+	baseline, err := ParseSelector(c.Baseline)
+	if err != nil {
+		return Ramp{}, fmt.Errorf("ramp %q: baseline: %w", c.Name, err)
+	}
+	target, err := ParseSelector(c.Target)
+	if err != nil {
+		return Ramp{}, fmt.Errorf("ramp %q: target: %w", c.Name, err)
+	}
+	if c.CheckInterval < 0 {
+		return Ramp{}, fmt.Errorf("ramp %q: check_interval must not be negative", c.Name)
+	}
+	r := Ramp{
+		Name:                 c.Name,
+		Baseline:             baseline,
+		Target:               target,
+		MaxErrorRateIncrease: c.MaxErrorRateIncrease,
+		MaxLatencyRatio:      c.MaxLatencyRatio,
+		MinRequests:          c.MinRequests,
+		OnBreach:             c.OnBreach,
+		CheckInterval:        time.Duration(c.CheckInterval),
+		StateFile:            c.StateFile,
+	}
+	if r.OnBreach == "" {
+		r.OnBreach = RampRollback
+	}
+	for _, s := range c.Steps {
+		r.Steps = append(r.Steps, RampStep{Percent: s.Percent, Duration: time.Duration(s.Duration)})
+	}
+
+	return r, r.validate()
+}
+
+// FeedbackConfig is the file representation of Feedback. Selector picks
+// the servers whose feedback is heeded.
+type FeedbackConfig struct {
+	Header   string   `json:"header,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+	LoadTTL  Duration `json:"load_ttl,omitempty"`
+	DrainFor Duration `json:"drain_for,omitempty"`
+	MaxDrain Duration `json:"max_drain,omitempty"`
+}
+
+func (c *FeedbackConfig) build() (Feedback, error) {
+	selector, err := ParseSelector(c.Selector)
+	if err != nil {
+		return Feedback{}, fmt.Errorf("feedback: selector: %w", err)
+	}
+	if c.LoadTTL < 0 || c.DrainFor < 0 || c.MaxDrain < 0 {
+		return Feedback{}, fmt.Errorf("feedback: load_ttl, drain_for and max_drain must not be negative")
+	}
+	if c.MaxDrain != 0 && c.DrainFor > c.MaxDrain {
+		return Feedback{}, fmt.Errorf("feedback: drain_for must not exceed max_drain")
+	}
+
+	return Feedback{
+		Header:   c.Header,
+		Selector: selector,
+		LoadTTL:  time.Duration(c.LoadTTL),
+		DrainFor: time.Duration(c.DrainFor),
+		MaxDrain: time.Duration(c.MaxDrain),
+	}, nil
+}
+
+// DeadlineConfig is the file representation of RequestDeadline. Format is
+// "millis" or "rfc3339".
+type DeadlineConfig struct {
+	Timeout      Duration       `json:"timeout"`
+	Header       string         `json:"header,omitempty"`
+	Format       DeadlineFormat `json:"format,omitempty"`
+	TrustedCIDRs []string       `json:"trusted_cidrs,omitempty"`
+}
+
+func (c *DeadlineConfig) build() (RequestDeadline, error) {
+	switch c.Format {
+	case "", DeadlineMillis, DeadlineRFC3339:
+	default:
+		return RequestDeadline{}, fmt.Errorf("deadline: unknown format %q", c.Format)
+	}
+	if c.Timeout < 0 {
+		return RequestDeadline{}, fmt.Errorf("deadline: timeout must not be negative")
+	}
+	d := RequestDeadline{Timeout: time.Duration(c.Timeout), Header: c.Header, Format: c.Format}
+	for _, cidr := range c.TrustedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return RequestDeadline{}, fmt.Errorf("deadline: %w", err)
+		}
+		d.TrustedPrefixes = append(d.TrustedPrefixes, prefix)
+	}
+
+	return d, nil
+}
+
+// ComparisonConfig is the file representation of Comparison.
+type ComparisonConfig struct {
+	Headers      []string `json:"headers,omitempty"`
+	IgnoreFields []string `json:"ignore_fields,omitempty"`
+}
+
+func (c *ComparisonConfig) build() *Comparison {
+	if c == nil {
+		return nil
+	}
+
+	return &Comparison{Headers: c.Headers, IgnoreFields: c.IgnoreFields}
+}
+
+// MirrorConfig is the file representation of Mirror, with the candidate
+// given by address.
+type MirrorConfig struct {
+	Candidate     string           `json:"candidate"`
+	SamplePercent float64          `json:"sample_percent"`
+	Compare       ComparisonConfig `json:"compare,omitempty"`
+	MaxBody       int              `json:"max_body,omitempty"`
+	QueueSize     int              `json:"queue_size,omitempty"`
+}
+
+func (c *MirrorConfig) build() (Mirror, error) {
+	if c.SamplePercent <= 0 || c.SamplePercent > 100 {
+		return Mirror{}, fmt.Errorf("mirror: sample_percent must be between 0 and 100")
+	}
+	candidate, err := newSimpleServer(c.Candidate)
+	if err != nil {
+		return Mirror{}, fmt.Errorf("mirror: %w", err)
+	}
+
+	return Mirror{
+		Candidate:     candidate,
+		SamplePercent: c.SamplePercent,
+		Compare:       *c.Compare.build(),
+		MaxBody:       c.MaxBody,
+		QueueSize:     c.QueueSize,
+	}, nil
+}
+
+// loadConfig reads and decodes the JSON configuration file at path. It does
+// no validation of its own; that is left to Build.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("decode config %s: %w", path, err)
+	}
+	cfg.path = path
+	cfg.hash = fmt.Sprintf("%x", sha256.Sum256(data))
+	cfg.loadedAt = time.Now()
+
+	return &cfg, nil
+}
+
+// withDryRun leaves out opening the request journals, for configurations
+// that are only validated.
+func withDryRun() Option {
+	return func(lb *LoadBalancer) {
+		lb.dryRun = true
+	}
+}
+
+// withServerDefaults records the defaults applied to servers added at
+// runtime.
+func withServerDefaults(d *ServerConfig) Option {
+	return func(lb *LoadBalancer) {
+		lb.serverDefaults = d
+	}
+}
+
+// newServerFromConfig constructs the server described by sc, which has its
+// defaults applied already, with the given further options.
+func newServerFromConfig(sc ServerConfig, opts ...ServerOption) (Server, error) {
+	var errs configErrors
+	server := buildServer(sc, fmt.Sprintf("server %q", sc.Address), &errs, opts...)
+
+	return server, errs.err()
+}
+
+// buildServer constructs the server described by sc with the given further
+// options, adding every problem to errs under path. It returns nil if there
+// were any.
+func buildServer(sc ServerConfig, path string, errs *configErrors, extra ...ServerOption) Server {
+	n := errs.len()
+	opts := append(extra[:len(extra):len(extra)], WithName(sc.Name), WithLabels(sc.Labels))
+	if sc.Weight != nil {
+		if *sc.Weight < 0 {
+			errs.add(path, fmt.Errorf("weight: %w", ErrInvalidWeight))
+		}
+		opts = append(opts, WithWeight(*sc.Weight))
+	}
+	if sc.Priority != 0 {
+		opts = append(opts, WithPriority(sc.Priority))
+	}
+	if sc.MaxConcurrent < 0 {
+		errs.add(path, fmt.Errorf("max_concurrent must not be negative"))
+	}
+	opts = append(opts, WithMaxConcurrent(sc.MaxConcurrent))
+	if sc.ResponseHeaderTimeout > 0 {
+		opts = append(opts, WithResponseHeaderTimeout(time.Duration(sc.ResponseHeaderTimeout)))
+	}
+	if sc.FirstByteTimeout < 0 {
+		errs.add(path, fmt.Errorf("first_byte_timeout must not be negative"))
+	}
+	opts = append(opts, WithFirstByteTimeout(time.Duration(sc.FirstByteTimeout)))
+	if sc.ConnMaxAge < 0 {
+		errs.add(path, fmt.Errorf("conn_max_age must not be negative"))
+	}
+	if sc.ConnMaxAge > 0 {
+		opts = append(opts, WithConnMaxAge(time.Duration(sc.ConnMaxAge)))
+	}
+	if sc.TLSSessionCacheSize != 0 {
+		opts = append(opts, WithTLSSessionCache(sc.TLSSessionCacheSize))
+	}
+	if sc.H2C {
+		opts = append(opts, WithH2C())
+	}
+	if sc.Required {
+		opts = append(opts, WithRequired())
+	}
+	if sc.TLS != nil {
+		t, err := sc.TLS.build()
+		if err != nil {
+			errs.add(path, fmt.Errorf("tls: %w", err))
+		}
+		opts = append(opts, WithUpstreamTLS(t))
+	}
+	if sc.ExternalScheme != nil {
+		e, err := sc.ExternalScheme.build()
+		errs.add(path, err)
+		opts = append(opts, WithExternalScheme(e))
+	}
+	var windows []MaintenanceWindow
+	for i, mc := range sc.Maintenance {
+		w, err := mc.build()
+		errs.add(fmt.Sprintf("%s.maintenance[%d]", path, i), err)
+		windows = append(windows, w)
+	}
+	opts = append(opts, WithMaintenance(windows...))
+	if sc.HealthCheck != nil {
+		hc, err := sc.HealthCheck.build()
+		if err != nil {
+			errs.add(path, fmt.Errorf("health_check: %w", err))
+		}
+		opts = append(opts, WithHealthCheck(hc))
+	}
+	if sc.Prewarm != nil {
+		p, err := sc.Prewarm.build()
+		errs.add(path, err)
+		opts = append(opts, WithPrewarm(p))
+	}
+	if sc.AcceptEncoding != nil {
+		e, err := sc.AcceptEncoding.build()
+		errs.add(path, err)
+		opts = append(opts, WithUpstreamEncoding(e))
+	}
+	signer, err := sc.Auth.build()
+	errs.add(path, err)
+	if signer != nil {
+		opts = append(opts, WithSigner(signer))
+	}
+
+	opts = append(opts, withServerConfig(sc))
+
+	server, err := newSimpleServer(sc.Address, opts...)
+	if err != nil {
+		errs.add(path, err)
+		return nil
+	}
+	if errs.len() > n {
+		return nil
+	}
+
+	return server
+}
+
+// setHashLoadFactor applies a configured load factor to the consistent-hash
+// strategies of a chain.
+func setHashLoadFactor(strategies []Strategy, factor float64) {
+	if factor == 0 {
+		return
+	}
+	for _, s := range strategies {
+		if ch, ok := s.(*consistentHash); ok {
+			ch.loadFactor = factor
+		}
+	}
+}
+
+// Build validates cfg and constructs the servers, routes and load balancer it
+// describes, filling in defaults. Configuration files are decoded into a
+// Config and built the same way, so a file and the equivalent Config always
+// yield the same load balancer.
+func (cfg *Config) Build() (*LoadBalancer, error) {
+	return cfg.build(false)
+}
+
+// Validate reports the problems Build would find in cfg, without opening the
+// access log or recording files.
+func (cfg *Config) Validate() error {
+	_, err := cfg.build(true)
+	return err
+}
+
+// build implements Build. A dry run performs every check but leaves out the
+// options that open files or start work. Every problem found is reported,
+// joined into one error, before anything is opened.
+func (cfg *Config) build(dryRun bool) (*LoadBalancer, error) {
+	var errs configErrors
+	if cfg.HashLoadFactor != 0 && cfg.HashLoadFactor < 1 {
+		errs.add("", fmt.Errorf("hash_load_factor must be at least 1"))
+	}
+	if d := cfg.ServerDefaults; d != nil && d.Address != "" {
+		errs.add("server_defaults", fmt.Errorf("address cannot have a default"))
+	}
+	var serverOpts []ServerOption
+	var dns *DNSCache
+	if cfg.DNS != nil {
+		d, err := cfg.DNS.build()
+		errs.add("", err)
+		dns = NewDNSCache(d)
+		serverOpts = append(serverOpts, WithResolver(dns))
+	}
+	var servers []Server
+	seen, named := make(map[string]int), make(map[string]int)
+	for i, sc := range cfg.Servers {
+		path := fmt.Sprintf("servers[%d]", i)
+		server := buildServer(sc.withDefaults(cfg.ServerDefaults), path, &errs, serverOpts...)
+		if server == nil {
+			continue
+		}
+		key := normalizeAddress(server.Address())
+		if prev, ok := seen[key]; ok {
+			errs.add(path, fmt.Errorf("%w: same backend as servers[%d]", ErrServerExists, prev))
+			continue
+		}
+		if prev, ok := named[serverName(server)]; ok {
+			errs.add(path, fmt.Errorf("%w: name %q is taken by servers[%d]", ErrServerExists, serverName(server), prev))
+			continue
+		}
+		seen[key], named[serverName(server)] = i, i
+		servers = append(servers, server)
+	}
+	allowEmpty := cfg.AllowEmptyPool || cfg.DockerDiscovery != nil || cfg.SRVDiscovery != nil || cfg.ControlPlane != nil
+	if len(cfg.Servers) == 0 {
+		errs.add("", checkPool(nil, allowEmpty))
+	}
+
+	var routes []Route
+	for i, rc := range cfg.Routes {
+		path := routePath(i, rc.Name)
+		selector, err := ParseSelector(rc.Selector)
+		errs.add(path, err)
+		switch rc.Fallback {
+		case "":
+			rc.Fallback = FallbackFail
+		case FallbackFail, FallbackIgnore:
+		default:
+			errs.add(path, fmt.Errorf("unknown fallback %q", rc.Fallback))
+		}
+		retry, err := rc.Retry.build()
+		errs.add(path, err)
+		bodyBuffer, err := rc.BodyBuffer.build()
+		errs.add(path, err)
+		strategies, err := newStrategyChain(rc.Strategies)
+		if err != nil {
+			errs.add(path, fmt.Errorf("strategies: %w", err))
+		}
+		setHashLoadFactor(strategies, cfg.HashLoadFactor)
+		headerLimits, err := rc.HeaderLimits.build()
+		errs.add(path, err)
+		redirects, err := rc.Redirects.build()
+		errs.add(path, err)
+		signer, err := rc.Auth.build()
+		errs.add(path, err)
+		stale, err := rc.Stale.build()
+		errs.add(path, err)
+		if rc.NegativeTTL < 0 {
+			errs.add(path, fmt.Errorf("negative_ttl must not be negative"))
+		}
+		if rc.FirstByteTimeout < 0 {
+			errs.add(path, fmt.Errorf("first_byte_timeout must not be negative"))
+		}
+		sticky, err := rc.StickySessions.build()
+		errs.add(path, err)
+		streams, err := rc.Streams.build()
+		errs.add(path, err)
+		idempotency, err := rc.Idempotency.build()
+		errs.add(path, err)
+		static, err := rc.Static.build()
+		errs.add(path, err)
+		validate, err := rc.Validate.build()
+		errs.add(path, err)
+		journal, err := rc.Journal.build()
+		errs.add(path, err)
+		transform, err := rc.Transform.build()
+		errs.add(path, err)
+		authRequest, err := rc.AuthRequest.build()
+		errs.add(path, err)
+		readWrite, err := rc.ReadWrite.build()
+		errs.add(path, err)
+		methods, err := rc.Methods.build()
+		errs.add(path, err)
+		faults, err := rc.Faults.build()
+		errs.add(path, err)
+		if faults != nil && !cfg.UnsafeFaultInjection {
+			errs.add(path, fmt.Errorf("faults require unsafe_fault_injection"))
+		}
+		if len(rc.Countries) > 0 && cfg.GeoIP == nil {
+			errs.add(path, fmt.Errorf("countries require geoip"))
+		}
+		var countries []string
+		for _, country := range rc.Countries {
+			countries = append(countries, strings.ToUpper(country))
+		}
+		route := Route{
+			Name:             rc.Name,
+			PathPrefix:       rc.PathPrefix,
+			PathPattern:      rc.PathPattern,
+			CaseInsensitive:  rc.CaseInsensitive,
+			TrailingSlash:    rc.TrailingSlash,
+			SetHeaders:       rc.SetHeaders,
+			Selector:         selector,
+			HeaderSelectors:  rc.HeaderSelectors,
+			Fallback:         rc.Fallback,
+			Retry:            retry,
+			BodyBuffer:       bodyBuffer,
+			Strategies:       strategies,
+			HeaderLimits:     headerLimits,
+			Faults:           faults,
+			Sensitive:        rc.Sensitive,
+			RawPath:          rc.RawPath,
+			Sticky:           sticky,
+			Streams:          streams,
+			Redirects:        redirects,
+			Signer:           signer,
+			Stale:            stale,
+			NegativeTTL:      time.Duration(rc.NegativeTTL),
+			Compare:          rc.Compare.build(),
+			Idempotency:      idempotency,
+			Static:           static,
+			Countries:        countries,
+			Validate:         validate,
+			Journal:          journal,
+			Transform:        transform,
+			AuthRequest:      authRequest,
+			GRPCService:      rc.GRPCService,
+			ReadWrite:        readWrite,
+			Methods:          methods,
+			FirstByteTimeout: time.Duration(rc.FirstByteTimeout),
+		}
+		errs.add(path, route.compile())
+		routes = append(routes, route)
+	}
+	conflicts := analyzeRoutes(routes)
+	if cfg.StrictRoutes {
+		for _, c := range conflicts {
+			errs.add(c.Route, c)
+		}
+	}
+
+	names := cfg.Strategies
+	if len(names) == 0 {
+		names = []string{cfg.Strategy}
+	} else if cfg.Strategy != "" {
+		errs.add("", fmt.Errorf("strategy and strategies are mutually exclusive"))
+	}
+	strategies, err := newStrategyChain(names)
+	if err != nil {
+		errs.add("", fmt.Errorf("strategies: %w", err))
+	}
+	setHashLoadFactor(strategies, cfg.HashLoadFactor)
+
+	opts := []Option{
+		WithRoutes(routes...), WithStrategyChain(strategies...), withConfigHash(cfg.hash), withConfig(cfg),
+		withServerDefaults(cfg.ServerDefaults),
+	}
+	level := slog.LevelInfo
+	if cfg.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			errs.add("", fmt.Errorf("log_level: %w", err))
+		}
+	}
+	opts = append(opts, WithLogLevel(level),
+		WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if q := cfg.Queue; q != nil {
+		switch q.Shed {
+		case "":
+			q.Shed = ShedNewest
+		case ShedNewest, ShedOldest:
+		default:
+			errs.add("", fmt.Errorf("queue: unknown shed policy %q", q.Shed))
+		}
+		if q.Depth <= 0 || q.MaxWait <= 0 {
+			errs.add("", fmt.Errorf("queue: depth and max_wait must be positive"))
+		}
+		opts = append(opts, WithQueue(QueueConfig{Depth: q.Depth, MaxWait: time.Duration(q.MaxWait), Shed: q.Shed}))
+	}
+	readiness := Readiness{MinHealthy: defaultReadiness.MinHealthy, LogProbes: cfg.LogProbes, MaxProbeAge: time.Duration(cfg.MaxProbeAge)}
+	if cfg.MaxProbeAge < 0 {
+		errs.add("", fmt.Errorf("max_probe_age must not be negative"))
+	}
+	if cfg.MinHealthyServers != nil {
+		if *cfg.MinHealthyServers < 0 {
+			errs.add("", fmt.Errorf("min_healthy_servers must not be negative"))
+		}
+		readiness.MinHealthy = *cfg.MinHealthyServers
+	}
+	opts = append(opts, WithReadiness(readiness))
+	retry, err := cfg.Retry.build()
+	errs.add("", err)
+	if retry != nil {
+		opts = append(opts, WithRetryPolicy(*retry))
+	}
+	redirects, err := cfg.Redirects.build()
+	errs.add("", err)
+	if redirects != nil {
+		opts = append(opts, WithRedirectPolicy(*redirects))
+	}
+	if cfg.Connections != nil {
+		c, err := cfg.Connections.build()
+		errs.add("", err)
+		opts = append(opts, WithConnectionLimits(c))
+	}
+	if n := cfg.PathNormalization; n != nil {
+		opts = append(opts, WithPathNormalization(PathNormalization{
+			RejectTraversal: n.RejectTraversal,
+			LowercaseHost:   n.LowercaseHost,
+		}))
+	}
+	if cfg.APIKeys != nil {
+		a, err := cfg.APIKeys.build()
+		errs.add("", err)
+		opts = append(opts, WithAPIKeys(a))
+	}
+	if dns != nil {
+		opts = append(opts, WithDNS(dns))
+	}
+	if sticky, err := cfg.StickySessions.build(); err != nil {
+		errs.add("", err)
+	} else if sticky != nil {
+		opts = append(opts, WithStickySessions(*sticky))
+	}
+	if streams, err := cfg.Streams.build(); err != nil {
+		errs.add("", err)
+	} else if streams != nil {
+		opts = append(opts, WithStreamPolicy(*streams))
+	}
+	if cfg.StreamShutdown != nil {
+		s, err := cfg.StreamShutdown.build()
+		errs.add("", err)
+		opts = append(opts, WithStreamShutdown(s))
+	}
+	if cfg.Tenants != nil {
+		t, err := cfg.Tenants.build()
+		errs.add("", err)
+		opts = append(opts, WithTenants(t))
+	}
+	if cfg.SharedRateLimits != nil {
+		s, err := cfg.SharedRateLimits.build()
+		errs.add("", err)
+		opts = append(opts, WithSharedRateLimits(s))
+	}
+	if cfg.GeoIP != nil {
+		g, err := cfg.GeoIP.build()
+		errs.add("", err)
+		opts = append(opts, WithGeoIP(g))
+	}
+	if cfg.AdaptiveWeights != nil {
+		a, err := cfg.AdaptiveWeights.build()
+		errs.add("", err)
+		opts = append(opts, WithAdaptiveWeights(a))
+	}
+	if cfg.Alerts != nil {
+		a, err := cfg.Alerts.build()
+		errs.add("", err)
+		opts = append(opts, WithAlerts(a))
+	}
+	if cfg.Ramp != nil {
+		r, err := cfg.Ramp.build()
+		errs.add("", err)
+		opts = append(opts, WithRamp(r))
+	}
+	if cfg.Feedback != nil {
+		f, err := cfg.Feedback.build()
+		errs.add("", err)
+		opts = append(opts, WithFeedback(f))
+	}
+	if cfg.Deadline != nil {
+		d, err := cfg.Deadline.build()
+		errs.add("", err)
+		opts = append(opts, WithRequestDeadline(d))
+	}
+	var mirror *Mirror
+	if cfg.Mirror != nil {
+		m, err := cfg.Mirror.build()
+		errs.add("", err)
+		mirror = &m
+	}
+	cache, err := cfg.Cache.build()
+	errs.add("", err)
+	if cache != nil {
+		opts = append(opts, WithResponseCache(*cache))
+	}
+	if len(cfg.ErrorPages) > 0 {
+		opts = append(opts, WithErrorPages(buildErrorPages(cfg.ErrorPages, &errs)))
+	}
+	if len(cfg.TemplateVars) > 0 {
+		opts = append(opts, WithTemplateVars(cfg.TemplateVars))
+	}
+	bodyBuffer, err := cfg.BodyBuffer.build()
+	errs.add("", err)
+	if bodyBuffer != nil {
+		opts = append(opts, WithBodyBuffer(*bodyBuffer))
+	}
+	headerLimits, err := cfg.HeaderLimits.build()
+	errs.add("", err)
+	if headerLimits != nil {
+		opts = append(opts, WithHeaderLimits(*headerLimits))
+	}
+	if r := cfg.Recording; r != nil {
+		if r.Path == "" || r.SamplePercent <= 0 || r.SamplePercent > 100 {
+			errs.add("", fmt.Errorf("recording: path and a sample_percent between 0 and 100 are required"))
+		}
+		for i, name := range r.Routes {
+			if !slices.ContainsFunc(cfg.Routes, func(rc RouteConfig) bool { return rc.Name == name }) {
+				errs.add("", fmt.Errorf("recording.routes[%d]: unknown route %q", i, name))
+			}
+		}
+	}
+	if cfg.UnsafeFaultInjection {
+		opts = append(opts, WithUnsafeFaultInjection())
+	}
+	if cfg.BackendOverride != nil {
+		o, err := cfg.BackendOverride.build()
+		errs.add("", err)
+		opts = append(opts, WithBackendOverride(o))
+	}
+	if cfg.Debug != nil {
+		d, err := cfg.Debug.build()
+		errs.add("", err)
+		opts = append(opts, WithDebugExplain(d))
+	}
+	if cfg.InstanceID != "" {
+		opts = append(opts, WithInstanceID(cfg.InstanceID))
+	}
+	if cfg.ServedBy != nil {
+		s, err := cfg.ServedBy.build()
+		errs.add("", err)
+		opts = append(opts, WithServedBy(s))
+	}
+	if cfg.Warmup != nil {
+		w, err := cfg.Warmup.build()
+		errs.add("", err)
+		opts = append(opts, WithWarmup(w))
+	}
+	if cfg.Listeners < 0 || cfg.Listeners > 0 && !cfg.ReusePort {
+		errs.add("", fmt.Errorf("listeners must be positive and requires reuse_port"))
+	}
+	errs.add("", cfg.checkListeners())
+	if s := cfg.State; s != nil {
+		if s.Path == "" || s.Interval < 0 || s.MaxAge < 0 {
+			errs.add("", fmt.Errorf("state: path is required and durations must not be negative"))
+		}
+		if s.Interval == 0 {
+			s.Interval = Duration(defaultStateInterval)
+		}
+		if s.MaxAge == 0 {
+			s.MaxAge = Duration(defaultStateMaxAge)
+		}
+	}
+	if cfg.Passthrough != nil {
+		p, err := cfg.Passthrough.build()
+		errs.add("", err)
+		opts = append(opts, WithPassthrough(p))
+	}
+	if cfg.TLS != nil {
+		l, err := cfg.TLS.build()
+		errs.add("", err)
+		opts = append(opts, WithListenerTLS(l))
+	}
+	if cfg.HealthHistory < 0 {
+		errs.add("", fmt.Errorf("health_history must not be negative"))
+	}
+	if cfg.HealthHistory > 0 {
+		opts = append(opts, WithHealthHistory(cfg.HealthHistory))
+	}
+	if cfg.RecentErrors < 0 {
+		errs.add("", fmt.Errorf("recent_errors must not be negative"))
+	}
+	if cfg.RecentErrors > 0 {
+		opts = append(opts, WithRecentErrors(cfg.RecentErrors))
+	}
+	if f := cfg.FlapDetection; f != nil {
+		if f.Transitions <= 0 || f.Window <= 0 || f.Quiet < 0 {
+			errs.add("", fmt.Errorf("flap_detection: transitions and window must be positive and quiet must not be negative"))
+		}
+		opts = append(opts, WithFlapDetection(FlapDetection{
+			Transitions: f.Transitions,
+			Window:      time.Duration(f.Window),
+			Quiet:       time.Duration(f.Quiet),
+		}))
+	}
+	if f := cfg.FairnessAudit; f != nil {
+		if audit, err := f.build(); err != nil {
+			errs.add("", err)
+		} else {
+			opts = append(opts, WithFairnessAudit(audit))
+		}
+	}
+	if s := cfg.Snapshot; s != nil && (s.Path == "" || s.Interval <= 0) {
+		errs.add("", fmt.Errorf("snapshot: path and interval are required"))
+	}
+	if allowEmpty {
+		opts = append(opts, WithAllowEmpty())
+	}
+	if c := cfg.SRVDiscovery; c != nil {
+		srv, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithSRVDiscovery(srv))
+	}
+	if c := cfg.ControlPlane; c != nil {
+		control, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithControlPlane(control))
+	}
+	if c := cfg.FDGuard; c != nil {
+		guard, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithFDGuard(guard))
+	}
+	if c := cfg.Gossip; c != nil {
+		gossip, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithGossip(gossip))
+	}
+	if c := cfg.CapabilityProbe; c != nil {
+		probe, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithCapabilityProbe(probe))
+	}
+	if c := cfg.Startup; c != nil {
+		startup, err := c.build()
+		errs.add("", err)
+		opts = append(opts, WithStartup(startup))
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
+	// Everything below opens files or starts work, so it only happens for
+	// a valid configuration.
+	if dryRun {
+		return NewLoadBalancer(cfg.Port, servers, append(opts, withDryRun())...)
+	}
+	if mirror != nil {
+		opts = append(opts, WithMirror(*mirror))
+	}
+	if r := cfg.Recording; r != nil {
+		f, err := openRotatingFile(r.Path, r.Rotate.build())
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRecording(f, Recording{
+			SamplePercent: r.SamplePercent,
+			Routes:        r.Routes,
+			RedactHeaders: r.RedactHeaders,
+			MaxBody:       r.MaxBody,
+			QueueSize:     r.QueueSize,
+		}))
+	}
+	if cfg.UnsafeFaultInjection {
+		fmt.Println("warning: fault injection is enabled")
+	}
+	for _, c := range conflicts {
+		fmt.Printf("warning: %s: %v\n", c.Route, c)
+	}
+	if f := cfg.AccessLogFormat; f != nil {
+		opts = append(opts, WithAccessLogFormat(f.build()))
+	}
+	switch cfg.AccessLog {
+	case "":
+	case "-":
+		opts = append(opts, WithAccessLog(os.Stdout))
+	default:
+		f, err := openRotatingFile(cfg.AccessLog, cfg.AccessLogRotate.build())
+		if err != nil {
+			return nil, fmt.Errorf("open access log: %w", err)
+		}
+		opts = append(opts, WithAccessLog(f))
+	}
+
+	return NewLoadBalancer(cfg.Port, servers, opts...)
+}
+
+// checkListeners reports listeners configured on the same port.
+func (cfg *Config) checkListeners() error {
+	ports := map[string]string{}
+	var conflicts []error
+	for _, l := range []struct{ name, port string }{
+		{"port", cfg.Port},
+		{"admin_port", cfg.AdminPort},
+		{"passthrough.port", cfg.passthroughPort()},
+		{"tls.port", cfg.tlsPort()},
+	} {
+		if l.port == "" {
+			continue
+		}
+		if prev, ok := ports[l.port]; ok {
+			conflicts = append(conflicts, fmt.Errorf("%s: port %s is already used by %s", l.name, l.port, prev))
+			continue
+		}
+		ports[l.port] = l.name
+	}
+
+	return errors.Join(conflicts...)
+}
+
+// passthroughPort returns the port of the passthrough listener, if any.
+func (cfg *Config) passthroughPort() string {
+	if cfg.Passthrough == nil {
+		return ""
+	}
+
+	return cfg.Passthrough.Port
+}
+
+// tlsPort returns the port of the HTTPS listener, if any.
+func (cfg *Config) tlsPort() string {
+	if cfg.TLS == nil {
+		return ""
+	}
+
+	return cfg.TLS.Port
+}
+
+// ConfigError is a configuration problem at a position in the
+// configuration, such as "servers[2]" or "routes[api]".
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configErrors collects the problems found while building a configuration
+// so they can be reported together.
+type configErrors struct {
+	errs []error
+}
+
+// add records err, if any, at path. Errors at the top level, whose message
+// names the setting already, have an empty path. Joined errors are added
+// one by one.
+func (c *configErrors) add(path string, err error) {
+	if err == nil {
+		return
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			c.add(path, err)
+		}
+		return
+	}
+	if path != "" {
+		err = &ConfigError{Path: path, Err: err}
+	}
+	c.errs = append(c.errs, err)
+}
+
+func (c *configErrors) len() int {
+	return len(c.errs)
+}
+
+// err returns the collected problems joined, or nil.
+func (c *configErrors) err() error {
+	return errors.Join(c.errs...)
+}
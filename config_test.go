@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_LabelsAndRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"port": "8000",
+		"servers": [
+			{"address": "http://server1.com", "labels": {"version": "v1"}},
+			{"address": "http://server2.com", "labels": {"version": "v2"}}
+		],
+		"routes": [
+			{"name": "v2", "path_prefix": "/v2", "selector": "version in (v2,v3)", "fallback": "ignore"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Failed to build load balancer: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		server, err := lb.selectServer(httptest.NewRequest("GET", "/v2/x", nil))
+		if err != nil || server.Address() != "http://server2.com" {
+			t.Errorf("Expected server2 for the v2 route, got %v, %v", server, err)
+		}
+	}
+	if len(lb.configHash) != 64 {
+		t.Errorf("Expected a SHA-256 config hash, got %q", lb.configHash)
+	}
+	if lb.routeList()[0].Fallback != FallbackIgnore {
+		t.Errorf("Expected fallback ignore, got %q", lb.routeList()[0].Fallback)
+	}
+}
+
+func TestConfig_InvalidRoute(t *testing.T) {
+	for _, rc := range []RouteConfig{
+		{Name: "bad-selector", Selector: "version"},
+		{Name: "bad-fallback", Fallback: "maybe"},
+	} {
+		cfg := &Config{Routes: []RouteConfig{rc}}
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected route %q to be rejected", rc.Name)
+		}
+	}
+}
+
+func TestConfig_ServerDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"port": "8000",
+		"server_defaults": {
+			"labels": {"zone": "a", "tier": "standard"},
+			"weight": 2,
+			"max_concurrent": 50,
+			"response_header_timeout": "5s",
+			"health_check": {"path": "/healthz", "interval": "10s", "timeout": "2s"}
+		},
+		"servers": [
+			{"address": "http://server1.com"},
+			{"address": "http://server2.com", "labels": {"tier": "premium"}, "weight": 5,
+			 "health_check": {"interval": "1s"}},
+			{"address": "http://server3.com", "weight": 0, "max_concurrent": 0, "response_header_timeout": "0s",
+			 "health_check": {"timeout": "0s"}}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Failed to build load balancer: %v", err)
+	}
+	stats := lb.Stats()
+
+	// server1 inherits everything
+	c := stats[0].Config
+	if *c.Weight != 2 || c.MaxConcurrent != 50 || c.ResponseHeaderTimeout != Duration(5*time.Second) ||
+		c.Labels["zone"] != "a" || c.Labels["tier"] != "standard" || c.HealthCheck.Path != "/healthz" {
+		t.Errorf("Expected server1 to inherit every default, got %+v", c)
+	}
+	if stats[0].Weight != 2 {
+		t.Errorf("Expected the inherited weight to apply, got %d", stats[0].Weight)
+	}
+
+	// server2 overrides some fields and inherits the rest
+	c = stats[1].Config
+	if *c.Weight != 5 || c.Labels["tier"] != "premium" || c.Labels["zone"] != "a" {
+		t.Errorf("Expected server2's weight and tier to win, got %+v", c)
+	}
+	if hc := c.HealthCheck; hc.Interval != Duration(time.Second) || hc.Path != "/healthz" || hc.Timeout != Duration(2*time.Second) {
+		t.Errorf("Expected server2's interval with the default path and timeout, got %+v", hc)
+	}
+
+	// Explicit zeros override the defaults
+	c = stats[2].Config
+	if *c.Weight != 0 || c.MaxConcurrent != 0 || c.ResponseHeaderTimeout != 0 || c.HealthCheck.Timeout != 0 {
+		t.Errorf("Expected server3's explicit zeros to win, got %+v", c)
+	}
+	if stats[2].Weight != 0 {
+		t.Errorf("Expected weight 0, got %d", stats[2].Weight)
+	}
+
+	// Servers added at runtime inherit too
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("POST", "/admin/servers", strings.NewReader(`{"address": "http://server4.com"}`)))
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	if !strings.Contains(rw.Body.String(), `"address":"http://server4.com","labels":{"tier":"standard","zone":"a"},"weight":2,"max_concurrent":50`) {
+		t.Errorf("Expected server4's effective config in the status, got %s", rw.Body.String())
+	}
+}
+
+// TestConfig_FileAndCodeAgree runs the same request sequence against a
+// load balancer built from a file and one built from the equivalent Config.
+func TestConfig_FileAndCodeAgree(t *testing.T) {
+	backend := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if name == "server1" && req.URL.Path == "/flaky" {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+			rw.Write([]byte(name))
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	addr1, addr2, addr3 := backend("server1"), backend("server2"), backend("server3")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"port": "8000",
+		"server_defaults": {"labels": {"zone": "a"}},
+		"servers": [
+			{"address": "` + addr1 + `", "labels": {"version": "v1"}},
+			{"address": "` + addr2 + `", "labels": {"version": "v2"}},
+			{"address": "` + addr3 + `", "labels": {"version": "v2", "zone": "b"}}
+		],
+		"routes": [
+			{"name": "v2", "path_prefix": "/v2", "selector": "version=v2,zone=a"},
+			{"name": "flaky", "path_prefix": "/flaky", "selector": "", "retry": {"attempts": 2, "on": ["status-503"]}}
+		],
+		"strategy": "round-robin",
+		"header_limits": {"max_count": 50}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromCode := &Config{
+		Port:           "8000",
+		ServerDefaults: &ServerConfig{Labels: map[string]string{"zone": "a"}},
+		Servers: []ServerConfig{
+			{Address: addr1, Labels: map[string]string{"version": "v1"}},
+			{Address: addr2, Labels: map[string]string{"version": "v2"}},
+			{Address: addr3, Labels: map[string]string{"version": "v2", "zone": "b"}},
+		},
+		Routes: []RouteConfig{
+			{Name: "v2", PathPrefix: "/v2", Selector: "version=v2,zone=a"},
+			{Name: "flaky", PathPrefix: "/flaky", Retry: &RetryConfig{Attempts: 2, On: []ErrorClass{ClassStatus503}}},
+		},
+		Strategy:     "round-robin",
+		HeaderLimits: &HeaderLimitsConfig{MaxCount: 50},
+	}
+
+	script := []string{"/", "/v2/a", "/", "/flaky", "/v2/b", "/", "/flaky", "/", "/flaky"}
+	run := func(cfg *Config) []string {
+		t.Helper()
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("Expected the config to be valid, got %v", err)
+		}
+		lb, err := cfg.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, path := range script {
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+			got = append(got, fmt.Sprintf("%s %d %s", path, rw.Code, rw.Body.String()))
+		}
+		return got
+	}
+	want, got := run(fromFile), run(fromCode)
+	if !slices.Equal(want, got) {
+		t.Errorf("Expected the same responses from both configs\nfile: %q\ncode: %q", want, got)
+	}
+	if want[1] != "/v2/a 200 server2" || want[3] != "/flaky 200 server2" {
+		t.Errorf("Expected the routes to apply, got %q", want)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	cfg := &Config{Port: "8000", Servers: []ServerConfig{{Address: "http://server1.com"}}, AccessLog: logPath}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("Expected Validate not to open the access log, got %v", err)
+	}
+
+	for _, cfg := range []*Config{
+		{Port: "8000"},
+		{Port: "8000", AllowEmptyPool: true, Strategy: "random"},
+		{Port: "8000", AllowEmptyPool: true, Routes: []RouteConfig{{Name: "r", Faults: &FaultInjectionConfig{AbortPercent: 10}}}},
+		{Port: "8000", AllowEmptyPool: true, Queue: &QueueConfigFile{Depth: 1}},
+	} {
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("Expected %+v to be invalid", cfg)
+			continue
+		}
+		if _, buildErr := cfg.Build(); buildErr == nil || buildErr.Error() != err.Error() {
+			t.Errorf("Expected Build to fail like Validate with %v, got %v", err, buildErr)
+		}
+	}
+}
+
+func TestConfig_ReportsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	data := `{
+		"port": "8000",
+		"admin_port": "8000",
+		"servers": [
+			{"address": "http://server1.com"},
+			{"address": "server2.com"},
+			{"address": "http://SERVER1.com/"},
+			{"address": "https://server3.com", "health_check": {"path": "/", "ca_file": "` + filepath.Join(dir, "missing.pem") + `"}}
+		],
+		"routes": [
+			{"name": "api", "path_prefix": "/api", "retry": {"attempts": 2, "on": ["sometimes"]}}
+		],
+		"recording": {"path": "rec.jsonl", "sample_percent": 10, "routes": ["apy"]}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if code := runCheck([]string{path}, &out); code != 1 {
+		t.Errorf("Expected check to fail, got %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		`error: servers[1]: invalid server address "server2.com"`,
+		`error: servers[2]: server already exists: same backend as servers[0]`,
+		`error: servers[3]: health_check: read CA bundle`,
+		`error: routes[api]: retry: unknown error class "sometimes"`,
+		`error: recording.routes[0]: unknown route "apy"`,
+		`error: admin_port: port 8000 is already used by port`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d problems, got:\n%s", len(want), out.String())
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("Expected problem %d to start with %q, got %q", i, prefix, lines[i])
+		}
+	}
+
+	// The problems keep their sentinels
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); !errors.Is(err, ErrInvalidAddress) || !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected the joined error to wrap the sentinels, got %v", err)
+	}
+
+	out.Reset()
+	if code := runCheck([]string{filepath.Join(dir, "absent.json")}, &out); code != 1 || !strings.HasPrefix(out.String(), "error: read config") {
+		t.Errorf("Expected a missing file to fail the check, got %d %q", code, out.String())
+	}
+}
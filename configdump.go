@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces secrets in configuration dumps.
+const redactedValue = "<redacted>"
+
+// ConfigDump is the effective configuration of a load balancer, as served
+// by GET /admin/config. Secrets are redacted. RouteConflicts lists the
+// conflicts found between the routes in effect.
+type ConfigDump struct {
+	Source         ConfigSource    `json:"source"`
+	Config         Config          `json:"config"`
+	RouteConflicts []RouteConflict `json:"route_conflicts,omitempty"`
+}
+
+// ConfigSource identifies where a configuration came from. Path and SHA256
+// are empty for the built-in defaults.
+type ConfigSource struct {
+	Path     string    `json:"path,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// withConfig records the configuration the load balancer was built from
+// for ConfigDump.
+func withConfig(cfg *Config) Option {
+	return func(lb *LoadBalancer) {
+		loaded := cfg.loadedAt
+		if loaded.IsZero() {
+			loaded = time.Now()
+		}
+		lb.config = &ConfigDump{
+			Source: ConfigSource{Path: cfg.path, SHA256: cfg.hash, LoadedAt: loaded},
+			Config: cfg.effective(),
+		}
+	}
+}
+
+// effective returns a copy of cfg with its defaults filled in and the
+// server defaults applied to every server.
+func (cfg *Config) effective() Config {
+	e := *cfg
+	e.Servers = make([]ServerConfig, len(cfg.Servers))
+	for i, sc := range cfg.Servers {
+		e.Servers[i] = sc.withDefaults(cfg.ServerDefaults).effective()
+	}
+	e.Routes = make([]RouteConfig, len(cfg.Routes))
+	for i, rc := range cfg.Routes {
+		if rc.Fallback == "" {
+			rc.Fallback = FallbackFail
+		}
+		e.Routes[i] = rc
+	}
+	if e.Strategy == "" && len(e.Strategies) == 0 {
+		e.Strategy = "round-robin"
+	}
+	if e.HashLoadFactor == 0 {
+		e.HashLoadFactor = defaultHashLoadFactor
+	}
+	if e.LogLevel == "" {
+		e.LogLevel = "info"
+	}
+	if e.InstanceID == "" {
+		e.InstanceID = defaultInstanceID()
+	}
+	if e.MinHealthyServers == nil {
+		minHealthy := defaultReadiness.MinHealthy
+		e.MinHealthyServers = &minHealthy
+	}
+	if e.HealthHistory == 0 {
+		e.HealthHistory = defaultHealthHistory
+	}
+	if q := e.Queue; q != nil && q.Shed == "" {
+		q := *q
+		q.Shed = ShedNewest
+		e.Queue = &q
+	}
+	if f := e.FairnessAudit; f != nil {
+		f := *f
+		if f.Window == 0 {
+			f.Window = Duration(defaultFairnessWindow)
+		}
+		if f.History == 0 {
+			f.History = defaultFairnessHistory
+		}
+		if f.WarnWindows == 0 {
+			f.WarnWindows = defaultFairnessWarnWindows
+		}
+		e.FairnessAudit = &f
+	}
+	if s := e.State; s != nil {
+		s := *s
+		if s.Interval == 0 {
+			s.Interval = Duration(defaultStateInterval)
+		}
+		if s.MaxAge == 0 {
+			s.MaxAge = Duration(defaultStateMaxAge)
+		}
+		e.State = &s
+	}
+
+	return e
+}
+
+// effective returns sc with its own defaults filled in.
+func (sc ServerConfig) effective() ServerConfig {
+	if sc.Weight == nil {
+		weight := 1
+		sc.Weight = &weight
+	}
+	if sc.TLSSessionCacheSize == 0 {
+		sc.TLSSessionCacheSize = defaultTLSSessionCacheSize
+	}
+
+	return sc
+}
+
+// ConfigDump returns the effective configuration of the load balancer: the
+// configuration it was built from with defaults filled in, the servers
+// currently in the pool, including those added at runtime, the current
+// log level and the conflicts between the routes in effect. It returns nil
+// for load balancers not built from a Config.
+func (lb *LoadBalancer) ConfigDump() *ConfigDump {
+	if lb.config == nil {
+		return nil
+	}
+	dump := *lb.config
+	dump.Config.InstanceID = lb.instanceID
+	dump.Config.LogLevel = strings.ToLower(lb.logs.level.Level().String())
+	dump.RouteConflicts = analyzeRoutes(lb.routeList())
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	dump.Config.Servers = make([]ServerConfig, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		sc := ServerConfig{Address: s.Address()}
+		if c, ok := s.(configured); ok && c.Config() != nil {
+			sc = *c.Config()
+		} else if w := serverWeight(s); w != 1 {
+			sc.Weight = &w
+		}
+		// Labels may have been replaced since the server was built.
+		sc.Labels = serverLabels(s)
+		dump.Config.Servers = append(dump.Config.Servers, sc.effective())
+	}
+
+	return &dump
+}
+
+// handleConfig serves the effective configuration with secrets redacted.
+func (lb *LoadBalancer) handleConfig(rw http.ResponseWriter, req *http.Request) {
+	dump := lb.ConfigDump()
+	if dump == nil {
+		writeJSONError(rw, http.StatusNotFound, errors.New("load balancer was not built from a configuration"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, dump)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigDump_DefaultsAndRedaction(t *testing.T) {
+	t.Setenv("LB_TEST_DUMP_TOKEN", "token-value")
+	keyHash := HashAPIKey("api-key-value")
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"port": "8000",
+		"server_defaults": {"weight": 2, "labels": {"zone": "a"}},
+		"servers": [
+			{"address": "http://server1.com", "auth": {"type": "token", "secret": "env:LB_TEST_DUMP_TOKEN"}},
+			{"address": "http://server2.com", "weight": 5}
+		],
+		"routes": [{"name": "api", "path_prefix": "/api"}],
+		"backend_override": {"enabled": true, "secret": "override-secret"},
+		"api_keys": {"keys": [{"id": "partner", "sha256": "` + keyHash + `"}]},
+		"state": {"path": "state.json"}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Failed to build load balancer: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/config", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the config, got %d", rw.Code)
+	}
+	body := rw.Body.String()
+	for _, secret := range []string{"env:LB_TEST_DUMP_TOKEN", "token-value", "override-secret", keyHash} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %q to be redacted", secret)
+		}
+	}
+
+	var dump ConfigDump
+	if err := json.Unmarshal(rw.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("Failed to decode the dump: %v", err)
+	}
+	if dump.Source.Path != path || dump.Source.SHA256 != lb.configHash || dump.Source.LoadedAt.IsZero() {
+		t.Errorf("Expected the source to identify the file, got %+v", dump.Source)
+	}
+	c := dump.Config
+	if len(c.Servers) != 2 {
+		t.Fatalf("Expected both servers, got %+v", c.Servers)
+	}
+	if s := c.Servers[0]; *s.Weight != 2 || s.Labels["zone"] != "a" || s.TLSSessionCacheSize != defaultTLSSessionCacheSize {
+		t.Errorf("Expected server defaults to be filled in, got %+v", s)
+	}
+	if *c.Servers[1].Weight != 5 {
+		t.Errorf("Expected the server's own weight, got %d", *c.Servers[1].Weight)
+	}
+	for name, secret := range map[string]Redacted{
+		"auth":             c.Servers[0].Auth.Secret,
+		"backend_override": c.BackendOverride.Secret,
+		"api_keys":         c.APIKeys.Keys[0].SHA256,
+	} {
+		if secret != redactedValue {
+			t.Errorf("Expected the %s secret to read %q, got %q", name, redactedValue, secret)
+		}
+	}
+	if c.Routes[0].Fallback != FallbackFail || c.Strategy != "round-robin" || c.HashLoadFactor != defaultHashLoadFactor ||
+		c.HealthHistory != defaultHealthHistory || *c.MinHealthyServers != 1 || c.LogLevel != "info" ||
+		c.State.Interval != Duration(defaultStateInterval) || c.InstanceID == "" {
+		t.Errorf("Expected defaults to be filled in, got %+v", c)
+	}
+}
+
+func TestConfigDump_Runtime(t *testing.T) {
+	cfg := &Config{Port: "8000", Servers: []ServerConfig{{Address: "http://server1.com"}}}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.AddServer(&MockServer{addr: "http://server2.com", isAlive: true}); err != nil {
+		t.Fatal(err)
+	}
+	lb.SetLogLevel(slog.LevelDebug, time.Minute)
+
+	dump := lb.ConfigDump()
+	if dump.Source.Path != "" || dump.Source.SHA256 != "" {
+		t.Errorf("Expected no file for a built-in config, got %+v", dump.Source)
+	}
+	if len(dump.Config.Servers) != 2 || dump.Config.Servers[1].Address != "http://server2.com" {
+		t.Errorf("Expected the server added at runtime, got %+v", dump.Config.Servers)
+	}
+	if dump.Config.LogLevel != "debug" {
+		t.Errorf("Expected the current log level, got %q", dump.Config.LogLevel)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnectionLimits bounds the client connections of the proxy listeners.
+// The timeouts are those of http.Server. Connections older than
+// MaxLifetime are closed once their current request completes, so clients
+// reconnect and spread over instances. At most MaxConnections connections
+// are open across all proxy listeners; beyond that new connections wait in
+// the kernel's accept queue, failing once it is full, while established
+// connections keep being served. Zero values leave a limit off.
+type ConnectionLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxLifetime       time.Duration
+	MaxConnections    int
+}
+
+// WithConnectionLimits sets the limits of client connections.
+func WithConnectionLimits(c ConnectionLimits) Option {
+	return func(lb *LoadBalancer) {
+		lb.connLimits = c
+		if c.MaxConnections > 0 {
+			lb.conns.slots = make(chan struct{}, c.MaxConnections)
+		}
+	}
+}
+
+// connTracker follows the client connections of the proxy listeners
+// through their states.
+type connTracker struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]*trackedConn
+	expired uint64
+
+	// slots holds a token per open connection when connections are
+	// limited.
+	slots chan struct{}
+}
+
+// trackedConn is the state of a client connection. expired is set once
+// the connection has outlived the maximum lifetime, and shed for
+// connections accepted while short of file descriptors.
+type trackedConn struct {
+	state   http.ConnState
+	expired bool
+	shed    bool
+	timer   *time.Timer
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]*trackedConn)}
+}
+
+// NewServer returns the http.Server serving handler on the proxy listeners
+// with the connection limits applied. Besides HTTP/1 and HTTP/2 over TLS,
+// it accepts cleartext HTTP/2 with prior knowledge, as gRPC clients
+// without TLS send.
+func (lb *LoadBalancer) NewServer(handler http.Handler) *http.Server {
+	c := lb.connLimits
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Protocols:         protocols,
+		Handler:           handler,
+		MaxHeaderBytes:    lb.MaxHeaderBytes(),
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ConnState:         lb.trackConn,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, conn)
+		},
+	}
+}
+
+// connContextKey is the context key of the client connection of a request.
+type connContextKey struct{}
+
+// connOf returns the client connection req arrived on, or nil.
+func connOf(req *http.Request) net.Conn {
+	conn, _ := req.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+// trackConn records a connection state change, closing connections past
+// their lifetime once they are idle.
+func (lb *LoadBalancer) trackConn(conn net.Conn, state http.ConnState) {
+	t := lb.conns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc := t.conns[conn]
+	switch state {
+	case http.StateNew:
+		tc = &trackedConn{shed: lb.fds != nil && lb.fds.isShedding()}
+		t.conns[conn] = tc
+		if lifetime := lb.connLimits.MaxLifetime; lifetime > 0 {
+			tc.timer = time.AfterFunc(lifetime, func() { lb.expireConn(conn) })
+		}
+	case http.StateHijacked, http.StateClosed:
+		if tc != nil && tc.timer != nil {
+			tc.timer.Stop()
+		}
+		delete(t.conns, conn)
+		return
+	}
+	if tc == nil {
+		return
+	}
+	tc.state = state
+	if state == http.StateIdle && tc.expired {
+		t.expired++
+		conn.Close()
+	}
+}
+
+// expireConn marks a connection as past its lifetime, closing it at once
+// if it is idle.
+func (lb *LoadBalancer) expireConn(conn net.Conn) {
+	t := lb.conns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc := t.conns[conn]
+	if tc == nil {
+		return
+	}
+	tc.expired = true
+	if tc.state == http.StateIdle {
+		t.expired++
+		conn.Close()
+	}
+}
+
+// LimitListener returns ln limited to the maximum number of connections,
+// shared by every listener it wraps. It returns ln without a limit.
+func (lb *LoadBalancer) LimitListener(ln net.Listener) net.Listener {
+	if lb.conns.slots == nil {
+		return ln
+	}
+
+	return &limitListener{Listener: ln, slots: lb.conns.slots, done: make(chan struct{})}
+}
+
+// limitListener stops accepting while all connection slots are taken.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+
+	return &limitedConn{Conn: conn, slots: l.slots}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitedConn frees its slot when closed.
+type limitedConn struct {
+	net.Conn
+	slots       chan struct{}
+	releaseOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(func() { <-c.slots })
+
+	return err
+}
+
+// shed reports whether conn was accepted while shedding.
+func (t *connTracker) shed(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc := t.conns[conn]
+	return tc != nil && tc.shed
+}
+
+// writeMetrics renders the connection counts by state.
+func (t *connTracker) writeMetrics(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := map[http.ConnState]int{}
+	for _, tc := range t.conns {
+		counts[tc.state]++
+	}
+	fmt.Fprintln(w, "# HELP lb_connections Open client connections by state.")
+	fmt.Fprintln(w, "# TYPE lb_connections gauge")
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		fmt.Fprintf(w, "lb_connections{state=%q} %d\n", state, counts[state])
+	}
+	if t.slots != nil {
+		fmt.Fprintln(w, "# HELP lb_connections_max Maximum number of open client connections.")
+		fmt.Fprintln(w, "# TYPE lb_connections_max gauge")
+		fmt.Fprintf(w, "lb_connections_max %d\n", cap(t.slots))
+	}
+	fmt.Fprintln(w, "# HELP lb_connections_expired_total Client connections closed for exceeding their maximum lifetime.")
+	fmt.Fprintln(w, "# TYPE lb_connections_expired_total counter")
+	fmt.Fprintf(w, "lb_connections_expired_total %d\n", t.expired)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveLimited serves lb on a local listener with its connection limits
+// and returns the address.
+func serveLimited(t *testing.T, lb *LoadBalancer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := lb.NewServer(lb.Handler())
+	go srv.Serve(lb.LimitListener(ln))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// keepAliveGet sends a keep-alive request on conn and reads the response.
+func keepAliveGet(conn net.Conn, r *bufio.Reader) (*http.Response, error) {
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\n\r\n"); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// waitClosed reports whether the server closes conn within timeout.
+func waitClosed(conn net.Conn, r *bufio.Reader, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := r.ReadByte()
+	return err == io.EOF
+}
+
+func TestConnections_IdleTimeoutAndLifetime(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	for _, limits := range []ConnectionLimits{
+		{IdleTimeout: 100 * time.Millisecond},
+		{IdleTimeout: time.Minute, MaxLifetime: 100 * time.Millisecond},
+	} {
+		lb := newTestLoadBalancer(t, []Server{server}, WithConnectionLimits(limits))
+		conn, err := net.Dial("tcp", serveLimited(t, lb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := keepAliveGet(conn, r); err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, "idle connection in the metrics", func() bool {
+			metrics := httptest.NewRecorder()
+			lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+			return strings.Contains(metrics.Body.String(), `lb_connections{state="idle"} 1`)
+		})
+		if !waitClosed(conn, r, 5*time.Second) {
+			t.Errorf("%+v: expected the idle connection to be closed", limits)
+		}
+	}
+}
+
+func TestConnections_AcceptLimit(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server}, WithConnectionLimits(ConnectionLimits{MaxConnections: 1}))
+	addr := serveLimited(t, lb)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstReader := bufio.NewReader(first)
+	if _, err := keepAliveGet(first, firstReader); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second connection waits in the accept queue
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	responses := make(chan error, 1)
+	go func() {
+		_, err := keepAliveGet(second, bufio.NewReader(second))
+		responses <- err
+	}()
+	select {
+	case err := <-responses:
+		t.Fatalf("Expected the second connection to wait, got a response (%v)", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Established traffic continues
+	if resp, err := keepAliveGet(first, firstReader); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the established connection to be served, got %v", err)
+	}
+
+	first.Close()
+	select {
+	case err := <-responses:
+		if err != nil {
+			t.Errorf("Expected the waiting connection to be served, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the waiting connection to be accepted once a slot freed")
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultControlPlaneInterval = 30 * time.Second
+	defaultControlPlaneHistory  = 10
+	defaultControlPlaneTimeout  = 10 * time.Second
+
+	// maxConfigDocument bounds the configuration documents read from a
+	// control plane.
+	maxConfigDocument = 16 << 20
+)
+
+// ControlPlaneAlgorithm is how configuration documents are signed.
+type ControlPlaneAlgorithm string
+
+const (
+	// ControlPlaneHMAC signs documents with HMAC-SHA256 under a shared key.
+	ControlPlaneHMAC ControlPlaneAlgorithm = "hmac-sha256"
+
+	// ControlPlaneEd25519 signs documents with an Ed25519 private key. The
+	// key held locally is the public key, base64 encoded.
+	ControlPlaneEd25519 ControlPlaneAlgorithm = "ed25519"
+)
+
+// ConfigDocument is the document a control plane serves: a configuration,
+// in the format of configuration files, with its version and signature.
+// Signature is the base64 signature of the version, a newline and the bytes
+// of Config exactly as served.
+type ConfigDocument struct {
+	Version   string          `json:"version"`
+	Config    json.RawMessage `json:"config"`
+	Signature string          `json:"signature"`
+}
+
+// signed returns the bytes the signature of d covers.
+func (d *ConfigDocument) signed() []byte {
+	return append([]byte(d.Version+"\n"), d.Config...)
+}
+
+// ControlPlane pulls the configuration from a control plane, so that
+// several instances carry the same servers and routes. The document at URL
+// is fetched every Interval, 30s by default, with If-None-Match so that an
+// unchanged document is not downloaded again. Its signature is verified
+// with Key under Algorithm, and its configuration is validated as a file
+// would be, before its servers and routes replace those in effect. Other
+// settings take effect at the next restart. When a document cannot be
+// fetched, verified or applied, the configuration in effect is kept.
+//
+// The last History documents applied, 10 by default, are kept so that an
+// instance can be pinned to one of them in an emergency.
+type ControlPlane struct {
+	URL       string
+	Interval  time.Duration
+	Algorithm ControlPlaneAlgorithm
+	Key       *Secret
+	History   int
+	Client    *http.Client
+}
+
+// WithControlPlane pulls the configuration from a control plane. Pulling
+// runs in RunControlPlane. The servers given to the load balancer are
+// managed by the control plane, and are removed once its documents no
+// longer list them.
+func WithControlPlane(c ControlPlane) Option {
+	return func(lb *LoadBalancer) {
+		if c.Interval <= 0 {
+			c.Interval = defaultControlPlaneInterval
+		}
+		if c.History <= 0 {
+			c.History = defaultControlPlaneHistory
+		}
+		if c.Client == nil {
+			c.Client = &http.Client{Timeout: defaultControlPlaneTimeout}
+		}
+		cp := &controlPlane{
+			config:   c,
+			managed:  make(map[string]bool),
+			removals: make(map[string]chan struct{}),
+			results:  make(map[string]uint64),
+			synced:   lb.now(),
+		}
+		for _, s := range lb.servers {
+			cp.managed[serverName(s)] = true
+		}
+		lb.control = cp
+	}
+}
+
+// appliedDocument is a document applied from the control plane.
+type appliedDocument struct {
+	version   string
+	config    json.RawMessage
+	appliedAt time.Time
+}
+
+// controlPlane tracks the documents applied and the servers they manage.
+type controlPlane struct {
+	config ControlPlane
+
+	// mu is held while a document is applied.
+	mu      sync.Mutex
+	etag    string
+	history []appliedDocument
+	pinned  string
+	synced  time.Time
+	lastErr string
+	results map[string]uint64
+
+	// managed holds the servers of the documents, and removals is closed
+	// for servers listed again while they drain.
+	managed  map[string]bool
+	removals map[string]chan struct{}
+}
+
+// current returns the document in effect, if any.
+func (cp *controlPlane) current() *appliedDocument {
+	if len(cp.history) == 0 {
+		return nil
+	}
+
+	return &cp.history[len(cp.history)-1]
+}
+
+// RunControlPlane pulls and applies the configuration every interval until
+// ctx is done. It returns at once without WithControlPlane.
+func (lb *LoadBalancer) RunControlPlane(ctx context.Context) {
+	if lb.control == nil {
+		return
+	}
+	ticker := time.NewTicker(lb.control.config.Interval)
+	defer ticker.Stop()
+	for {
+		markActive(ctx)
+		if err := lb.syncControlPlane(ctx); err != nil {
+			fmt.Printf("error: control plane: %v, keeping the configuration in effect\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncControlPlane fetches the document once and applies it if it changed,
+// unless the instance is pinned.
+func (lb *LoadBalancer) syncControlPlane(ctx context.Context) error {
+	cp := lb.control
+	cp.mu.Lock()
+	etag, pinned := cp.etag, cp.pinned != ""
+	if pinned {
+		cp.results["pinned"]++
+	}
+	cp.mu.Unlock()
+	if pinned {
+		return nil
+	}
+
+	doc, etag, err := cp.fetch(ctx, etag)
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if err != nil {
+		cp.lastErr = err.Error()
+		cp.results["failed"]++
+		return err
+	}
+	if cp.pinned != "" {
+		// Pinned while fetching.
+		cp.results["pinned"]++
+		return nil
+	}
+	if doc == nil || cp.current() != nil && cp.current().version == doc.Version {
+		cp.etag = etag
+		cp.synced, cp.lastErr = lb.now(), ""
+		cp.results["unchanged"]++
+		return nil
+	}
+	err = cp.verify(doc)
+	if err == nil {
+		err = lb.applyDocumentLocked(doc.Version, doc.Config)
+	}
+	if err != nil {
+		cp.lastErr = err.Error()
+		cp.results["rejected"]++
+		return fmt.Errorf("version %q: %w", doc.Version, err)
+	}
+	cp.etag = etag
+	cp.results["applied"]++
+
+	return nil
+}
+
+// fetch returns the document at the control plane URL, or nil if it is
+// unchanged since the one tagged etag, and its entity tag.
+func (cp *controlPlane) fetch(ctx context.Context, etag string) (*ConfigDocument, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cp.config.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := cp.config.Client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("fetch %s: unexpected status %s", cp.config.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigDocument+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+	if len(data) > maxConfigDocument {
+		return nil, "", fmt.Errorf("fetch: document exceeds %d bytes", maxConfigDocument)
+	}
+	var doc ConfigDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, "", fmt.Errorf("decode document: %w", err)
+	}
+	if doc.Version == "" || len(doc.Config) == 0 {
+		return nil, "", fmt.Errorf("decode document: version and config are required")
+	}
+
+	return &doc, resp.Header.Get("ETag"), nil
+}
+
+// verify checks the signature of doc.
+func (cp *controlPlane) verify(doc *ConfigDocument) error {
+	sig, err := base64.StdEncoding.DecodeString(doc.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	key := cp.config.Key.Value()
+	valid := false
+	switch cp.config.Algorithm {
+	case ControlPlaneHMAC:
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(doc.signed())
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	case ControlPlaneEd25519:
+		pub, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("ed25519 key must be a base64 %d byte public key", ed25519.PublicKeySize)
+		}
+		valid = ed25519.Verify(pub, doc.signed(), sig)
+	default:
+		return fmt.Errorf("unknown algorithm %q", cp.config.Algorithm)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// applyDocumentLocked validates the configuration of a document and applies
+// its servers and routes. control.mu must be held.
+func (lb *LoadBalancer) applyDocumentLocked(version string, data json.RawMessage) error {
+	cp := lb.control
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("decode config: %w", err)
+	}
+	staged, err := cfg.build(true)
+	if err != nil {
+		return err
+	}
+	routes, err := lb.adoptRoutes(staged.routeList())
+	if err != nil {
+		return err
+	}
+	lb.reconcileManagedLocked(staged.servers)
+	lb.routes.Store(&routes)
+	lb.SetAlerts(staged.alerts.config)
+
+	now := lb.now()
+	cp.history = append(cp.history, appliedDocument{version: version, config: data, appliedAt: now})
+	if len(cp.history) > cp.config.History {
+		cp.history = cp.history[len(cp.history)-cp.config.History:]
+	}
+	cp.synced, cp.lastErr = now, ""
+	fmt.Printf("control plane: applied version %q\n", version)
+	lb.events.publish(Event{Type: EventConfigReloaded, Reason: "control plane version " + version})
+
+	return nil
+}
+
+// adoptRoutes prepares routes to replace the routes in effect. Journals and
+// idempotency scopes are set up at startup, so routes can only keep those
+// of the routes in effect.
+func (lb *LoadBalancer) adoptRoutes(routes []Route) ([]Route, error) {
+	journals := make(map[Journal]*Journal, len(lb.journals))
+	for config := range lb.journals {
+		journals[*config] = config
+	}
+	for i := range routes {
+		r := &routes[i]
+		if r.Journal != nil {
+			live, ok := journals[*r.Journal]
+			if !ok {
+				return nil, fmt.Errorf("route %q: journals take effect at restart", r.Name)
+			}
+			r.Journal = live
+		}
+		if r.Idempotency != nil {
+			var scope *idempotencyScope
+			if lb.idempotency != nil {
+				scope = lb.idempotency.scopes[r.Name]
+			}
+			if scope == nil || scope.config != r.Idempotency.withDefaults() {
+				return nil, fmt.Errorf("route %q: idempotency keys take effect at restart", r.Name)
+			}
+		}
+		if r.Faults != nil && !lb.faults.allowed {
+			return nil, fmt.Errorf("route %q: fault injection requires WithUnsafeFaultInjection", r.Name)
+		}
+	}
+
+	return routes, nil
+}
+
+// reconcileManagedLocked adds the servers of a document missing from the
+// pool, updates the address, weight, priority and labels of those present,
+// matched by name, and
+// drains the managed servers it no longer lists, removing them once
+// drained. Servers added otherwise, such as by discovery, are left alone.
+// control.mu must be held.
+func (lb *LoadBalancer) reconcileManagedLocked(servers []Server) {
+	cp := lb.control
+	listed := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		addr := serverName(server)
+		listed[addr] = true
+		lb.mu.Lock()
+		live := lb.findServerLocked(addr)
+		lb.mu.Unlock()
+		if live == nil {
+			if err := lb.AddServer(server); err != nil {
+				fmt.Printf("error: control plane: %v\n", err)
+				continue
+			}
+			cp.managed[addr] = true
+			continue
+		}
+		if !cp.managed[addr] {
+			continue
+		}
+		if live.Address() != server.Address() {
+			if err := lb.SetServerAddress(addr, server.Address()); err != nil {
+				fmt.Printf("error: control plane: %v\n", err)
+			}
+		}
+		if s, ok := live.(*simpleServer); ok {
+			s.SetWeight(serverWeight(server))
+			s.SetPriority(serverPriority(server))
+			s.SetLabels(serverLabels(server))
+		}
+		if cancel, ok := cp.removals[addr]; ok {
+			close(cancel)
+			delete(cp.removals, addr)
+			lb.Undrain(addr)
+		}
+	}
+
+	for addr := range cp.managed {
+		if listed[addr] || cp.removals[addr] != nil {
+			continue
+		}
+		done, err := lb.Drain(addr)
+		if err != nil {
+			delete(cp.managed, addr)
+			continue
+		}
+		fmt.Printf("control plane: draining %q\n", addr)
+		cancel := make(chan struct{})
+		cp.removals[addr] = cancel
+		go func() {
+			select {
+			case <-cancel:
+				return
+			case <-done:
+			}
+			cp.mu.Lock()
+			defer cp.mu.Unlock()
+			if cp.removals[addr] != cancel {
+				return
+			}
+			delete(cp.removals, addr)
+			delete(cp.managed, addr)
+			if err := lb.RemoveServer(addr); err == nil {
+				fmt.Printf("control plane: removed %q\n", addr)
+			}
+		}()
+	}
+}
+
+// PinConfigVersion applies the kept document of version and stops applying
+// documents from the control plane until UnpinConfigVersion.
+func (lb *LoadBalancer) PinConfigVersion(version string) error {
+	cp := lb.control
+	if cp == nil {
+		return fmt.Errorf("pin config: %w", errors.ErrUnsupported)
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	var doc *appliedDocument
+	for i := range cp.history {
+		if cp.history[i].version == version {
+			doc = &cp.history[i]
+		}
+	}
+	if doc == nil {
+		return fmt.Errorf("pin config: %w: version %q", ErrVersionNotFound, version)
+	}
+	if doc != cp.current() {
+		if err := lb.applyDocumentLocked(doc.version, doc.config); err != nil {
+			return fmt.Errorf("pin config: version %q: %w", version, err)
+		}
+	}
+	cp.pinned = version
+	fmt.Printf("control plane: pinned to version %q\n", version)
+
+	return nil
+}
+
+// UnpinConfigVersion resumes applying documents from the control plane.
+func (lb *LoadBalancer) UnpinConfigVersion() error {
+	cp := lb.control
+	if cp == nil {
+		return fmt.Errorf("unpin config: %w", errors.ErrUnsupported)
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.pinned != "" {
+		fmt.Printf("control plane: unpinned from version %q\n", cp.pinned)
+	}
+	cp.pinned = ""
+	// The document served may be the one in effect before pinning.
+	cp.etag = ""
+
+	return nil
+}
+
+// ControlPlaneStatus describes the configuration pulled from the control
+// plane.
+type ControlPlaneStatus struct {
+	Version   string    `json:"version,omitempty"`
+	AppliedAt time.Time `json:"applied_at,omitzero"`
+	Pinned    string    `json:"pinned,omitempty"`
+	Staleness float64   `json:"staleness_seconds"`
+	Versions  []string  `json:"versions,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// status returns the state of the control plane at now.
+func (cp *controlPlane) status(now time.Time) ControlPlaneStatus {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	s := ControlPlaneStatus{Pinned: cp.pinned, Staleness: now.Sub(cp.synced).Seconds(), Error: cp.lastErr}
+	if doc := cp.current(); doc != nil {
+		s.Version, s.AppliedAt = doc.version, doc.appliedAt
+	}
+	for _, doc := range cp.history {
+		s.Versions = append(s.Versions, doc.version)
+	}
+
+	return s
+}
+
+// writeMetrics renders the staleness of the configuration and the results
+// of pulling documents.
+func (cp *controlPlane) writeMetrics(w io.Writer, now time.Time) {
+	cp.mu.Lock()
+	staleness := now.Sub(cp.synced).Seconds()
+	pinned := 0
+	if cp.pinned != "" {
+		pinned = 1
+	}
+	results := make([]string, 0, len(cp.results))
+	for result := range cp.results {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	var buf bytes.Buffer
+	for _, result := range results {
+		fmt.Fprintf(&buf, "lb_control_plane_syncs_total{result=%q} %d\n", result, cp.results[result])
+	}
+	cp.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_control_plane_staleness_seconds Time since the configuration was last confirmed current with the control plane.")
+	fmt.Fprintln(w, "# TYPE lb_control_plane_staleness_seconds gauge")
+	fmt.Fprintf(w, "lb_control_plane_staleness_seconds %g\n", staleness)
+	fmt.Fprintln(w, "# HELP lb_control_plane_pinned Whether the configuration is pinned to a version.")
+	fmt.Fprintln(w, "# TYPE lb_control_plane_pinned gauge")
+	fmt.Fprintf(w, "lb_control_plane_pinned %d\n", pinned)
+	fmt.Fprintln(w, "# HELP lb_control_plane_syncs_total Control plane syncs, by result.")
+	fmt.Fprintln(w, "# TYPE lb_control_plane_syncs_total counter")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testControlKey = "control-plane-key"
+
+// controlServer serves the configuration document tests rotate.
+type controlServer struct {
+	mu          sync.Mutex
+	doc         []byte
+	etag        string
+	down        bool
+	notModified int
+}
+
+func (c *controlServer) set(doc ConfigDocument) {
+	data, _ := json.Marshal(doc)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.doc, c.etag = data, `"`+doc.Version+`"`
+}
+
+func (c *controlServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if req.Header.Get("If-None-Match") == c.etag {
+		c.notModified++
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("ETag", c.etag)
+	rw.Write(c.doc)
+}
+
+// hmacDocument returns the document of config signed with testControlKey.
+// The config is compacted as it is when the document is served.
+func hmacDocument(version, config string) ConfigDocument {
+	var compact bytes.Buffer
+	json.Compact(&compact, []byte(config))
+	doc := ConfigDocument{Version: version, Config: compact.Bytes()}
+	mac := hmac.New(sha256.New, []byte(testControlKey))
+	mac.Write(doc.signed())
+	doc.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return doc
+}
+
+func newControlledLoadBalancer(t *testing.T) (*LoadBalancer, *controlServer) {
+	control := &controlServer{}
+	srv := httptest.NewServer(control)
+	t.Cleanup(srv.Close)
+	t.Setenv("LB_TEST_CONTROL_KEY", testControlKey)
+	cfg := &Config{
+		Servers: []ServerConfig{{Address: "http://a.example:80"}},
+		ControlPlane: &ControlPlaneConfig{
+			URL: srv.URL, Algorithm: string(ControlPlaneHMAC), Key: "env:LB_TEST_CONTROL_KEY",
+		},
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lb, control
+}
+
+const (
+	controlConfigV1 = `{"servers": [{"address": "http://a.example:80"}, {"address": "http://b.example:80", "labels": {"tier": "gold"}}],
+		"routes": [{"name": "api", "path_prefix": "/api/"}]}`
+	controlConfigV2 = `{"servers": [{"address": "http://b.example:80", "weight": 3}, {"address": "http://c.example:80"}],
+		"routes": [{"name": "v2", "path_prefix": "/v2/"}]}`
+)
+
+func routeNames(lb *LoadBalancer) []string {
+	var names []string
+	for _, r := range lb.routeList() {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+func TestControlPlane_AppliesRotatedDocuments(t *testing.T) {
+	lb, control := newControlledLoadBalancer(t)
+	ctx := context.Background()
+
+	control.set(hmacDocument("v1", controlConfigV1))
+	if err := lb.syncControlPlane(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := poolOf(t, lb, 2); len(got) != 2 || strings.Join(routeNames(lb), ",") != "api" {
+		t.Fatalf("Expected version 1 applied, got pool %v and routes %v", got, routeNames(lb))
+	}
+
+	// Unchanged documents are not downloaded again.
+	if err := lb.syncControlPlane(ctx); err != nil || control.notModified != 1 {
+		t.Errorf("Expected a conditional fetch answered 304, got %v after %d", err, control.notModified)
+	}
+
+	control.set(hmacDocument("v2", controlConfigV2))
+	if err := lb.syncControlPlane(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]int{"http://b.example:80": {3, 0}, "http://c.example:80": {1, 0}}
+	if got := poolOf(t, lb, 2); len(got) != 2 || got["http://b.example:80"] != want["http://b.example:80"] || got["http://c.example:80"] != want["http://c.example:80"] {
+		t.Errorf("Expected pool %v, got %v", want, got)
+	}
+	if lb.matchRoute(httptest.NewRequest("GET", "/v2/x", nil)) == nil || lb.matchRoute(httptest.NewRequest("GET", "/api/x", nil)) != nil {
+		t.Errorf("Expected the routes of version 2, got %v", routeNames(lb))
+	}
+	if s := lb.control.status(lb.now()); s.Version != "v2" || strings.Join(s.Versions, ",") != "v1,v2" {
+		t.Errorf("Expected version v2 applied after v1, got %+v", s)
+	}
+}
+
+func TestControlPlane_RejectsInvalidDocuments(t *testing.T) {
+	lb, control := newControlledLoadBalancer(t)
+	ctx := context.Background()
+	control.set(hmacDocument("v1", controlConfigV1))
+	if err := lb.syncControlPlane(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := hmacDocument("v2", controlConfigV1)
+	forged.Config = json.RawMessage(controlConfigV2)
+	invalid := hmacDocument("v3", `{"servers": [{"address": "http://d.example:80", "weight": -1}]}`)
+	for _, doc := range []ConfigDocument{forged, invalid} {
+		control.set(doc)
+		if err := lb.syncControlPlane(ctx); err == nil {
+			t.Errorf("Expected version %s to be rejected", doc.Version)
+		}
+		if got := poolOf(t, lb, 2); len(got) != 2 || lb.control.status(lb.now()).Version != "v1" {
+			t.Errorf("Expected version 1 kept, got pool %v", got)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rw.Body.String(), `lb_control_plane_syncs_total{result="rejected"} 2`) {
+		t.Error("Expected the rejections to be counted")
+	}
+}
+
+func TestControlPlane_Ed25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LB_TEST_CONTROL_PUB", base64.StdEncoding.EncodeToString(pub))
+	key, err := LoadSecret("env:LB_TEST_CONTROL_PUB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &controlPlane{config: ControlPlane{Algorithm: ControlPlaneEd25519, Key: key}}
+
+	doc := ConfigDocument{Version: "v1", Config: json.RawMessage(controlConfigV1)}
+	doc.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, doc.signed()))
+	if err := cp.verify(&doc); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	doc.Version = "v2"
+	if err := cp.verify(&doc); err == nil {
+		t.Error("Expected a signature over another version to be rejected")
+	}
+}
+
+func TestControlPlane_Staleness(t *testing.T) {
+	lb, control := newControlledLoadBalancer(t)
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	control.set(hmacDocument("v1", controlConfigV1))
+	if err := lb.syncControlPlane(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	control.mu.Lock()
+	control.down = true
+	control.mu.Unlock()
+	now = now.Add(90 * time.Second)
+	if err := lb.syncControlPlane(context.Background()); err == nil {
+		t.Fatal("Expected the fetch to fail")
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"lb_control_plane_staleness_seconds 90",
+		`lb_control_plane_syncs_total{result="failed"} 1`,
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+	var status struct {
+		ControlPlane ControlPlaneStatus `json:"control_plane"`
+	}
+	rw = httptest.NewRecorder()
+	lb.handleStatus(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	if err := json.NewDecoder(rw.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if s := status.ControlPlane; s.Version != "v1" || s.Staleness != 90 || !strings.Contains(s.Error, "500") {
+		t.Errorf("Expected version v1 reported 90s stale with the fetch error, got %+v", s)
+	}
+}
+
+func TestControlPlane_Pinning(t *testing.T) {
+	lb, control := newControlledLoadBalancer(t)
+	ctx := context.Background()
+	admin := lb.AdminHandler()
+	for _, doc := range []ConfigDocument{hmacDocument("v1", controlConfigV1), hmacDocument("v2", controlConfigV2)} {
+		control.set(doc)
+		if err := lb.syncControlPlane(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/config/pin", strings.NewReader(`{"version": "v0"}`)))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown version, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/config/pin", strings.NewReader(`{"version": "v1"}`)))
+	if rw.Code != http.StatusOK || strings.Join(routeNames(lb), ",") != "api" {
+		t.Fatalf("Expected version 1 pinned, got %d with routes %v", rw.Code, routeNames(lb))
+	}
+	if err := lb.syncControlPlane(ctx); err != nil || strings.Join(routeNames(lb), ",") != "api" {
+		t.Errorf("Expected the pin to hold against the control plane, got %v with routes %v", err, routeNames(lb))
+	}
+
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("DELETE", "/admin/config/pin", nil))
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rw.Code)
+	}
+	if err := lb.syncControlPlane(ctx); err != nil || strings.Join(routeNames(lb), ",") != "v2" {
+		t.Errorf("Expected version 2 applied again once unpinned, got %v with routes %v", err, routeNames(lb))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// defaultDeadlineHeader carries the deadline of a request to servers.
+const defaultDeadlineHeader = "X-Request-Deadline"
+
+// DeadlineFormat is how a deadline is written to servers.
+type DeadlineFormat string
+
+const (
+	// DeadlineMillis writes the milliseconds remaining until the deadline.
+	DeadlineMillis DeadlineFormat = "millis"
+
+	// DeadlineRFC3339 writes the deadline as an RFC 3339 timestamp.
+	DeadlineRFC3339 DeadlineFormat = "rfc3339"
+)
+
+// RequestDeadline bounds the time a request may take from its arrival and
+// tells servers the budget left in Header, X-Request-Deadline by default, in
+// Format, milliseconds by default. The budget is computed for every attempt,
+// so a retry advertises only what the earlier attempts left. Requests from
+// addresses in TrustedPrefixes may carry a deadline of their own in Header,
+// as milliseconds remaining or an RFC 3339 timestamp, and the earlier of
+// the two applies; the header is dropped from all other requests. Requests
+// whose deadline passes before an attempt starts fail with 504.
+type RequestDeadline struct {
+	Timeout         time.Duration
+	Header          string
+	Format          DeadlineFormat
+	TrustedPrefixes []netip.Prefix
+}
+
+// WithRequestDeadline sets the request deadline.
+func WithRequestDeadline(d RequestDeadline) Option {
+	return func(lb *LoadBalancer) {
+		if d.Header == "" {
+			d.Header = defaultDeadlineHeader
+		}
+		if d.Format == "" {
+			d.Format = DeadlineMillis
+		}
+		lb.deadline = &d
+	}
+}
+
+// requestDeadline returns the deadline of req, which arrived at start, or
+// the zero time if it has none. It removes the deadline header from req.
+func (lb *LoadBalancer) requestDeadline(req *http.Request, start time.Time) time.Time {
+	d := lb.deadline
+	if d == nil {
+		return time.Time{}
+	}
+	inbound := req.Header.Get(d.Header)
+	req.Header.Del(d.Header)
+
+	var deadline time.Time
+	if d.Timeout > 0 {
+		deadline = start.Add(d.Timeout)
+	}
+	if inbound == "" || !clientIn(req, d.TrustedPrefixes) {
+		return deadline
+	}
+	if theirs, ok := parseDeadline(inbound, start); ok && (deadline.IsZero() || theirs.Before(deadline)) {
+		return theirs
+	}
+
+	return deadline
+}
+
+// parseDeadline parses a deadline header received at now.
+func parseDeadline(value string, now time.Time) (time.Time, bool) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return now.Add(time.Duration(ms) * time.Millisecond), true
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+
+	return t, err == nil
+}
+
+// withDeadline returns req bounded by deadline, which is measured by lb.now,
+// and the function releasing its resources.
+func (lb *LoadBalancer) withDeadline(req *http.Request, deadline time.Time) (*http.Request, context.CancelFunc) {
+	if deadline.IsZero() {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), deadline.Sub(lb.now()))
+
+	return req.WithContext(ctx), cancel
+}
+
+// setDeadlineHeader tells the server of the next attempt of req the budget
+// left until deadline. It returns ErrDeadlineExceeded when none is left.
+func (lb *LoadBalancer) setDeadlineHeader(req *http.Request, deadline time.Time) error {
+	if deadline.IsZero() {
+		return nil
+	}
+	remaining := deadline.Sub(lb.now())
+	if remaining <= 0 {
+		return ErrDeadlineExceeded
+	}
+
+	value := strconv.FormatInt(remaining.Milliseconds(), 10)
+	if lb.deadline.Format == DeadlineRFC3339 {
+		value = deadline.UTC().Format(time.RFC3339Nano)
+	}
+	req.Header.Set(lb.deadline.Header, value)
+
+	return nil
+}
+
+// clientIn reports whether req comes from an address in prefixes.
+func clientIn(req *http.Request, prefixes []netip.Prefix) bool {
+	addr, ok := clientAddr(req)
+	if !ok {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
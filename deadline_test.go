@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeadline_PropagatedToAttempts(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	var seen []string
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, req.Header.Get("X-Request-Deadline"))
+		now = now.Add(300 * time.Millisecond)
+		if len(seen) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, handler), newBackendServer(t, handler)},
+		WithRetryPolicy(RetryPolicy{Attempts: 2}),
+		WithRequestDeadline(RequestDeadline{Timeout: 2 * time.Second}))
+	lb.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the retry to succeed, got %d", rw.Code)
+	}
+	if len(seen) != 2 || seen[0] != "2000" || seen[1] != "1700" {
+		t.Errorf("Expected the retry to advertise the remaining budget, got %v", seen)
+	}
+}
+
+func TestDeadline_TrustedClients(t *testing.T) {
+	var seen string
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		seen = req.Header.Get("X-Request-Deadline")
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithRequestDeadline(RequestDeadline{
+		Timeout:         2 * time.Second,
+		TrustedPrefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		remote, inbound, want string
+	}{
+		{"10.1.2.3:1234", "500", "500"},
+		{"10.1.2.3:1234", "5000", "2000"},
+		{"10.1.2.3:1234", now.Add(time.Second).Format(time.RFC3339Nano), "1000"},
+		{"192.0.2.1:1234", "500", "2000"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set("X-Request-Deadline", tt.inbound)
+		lb.serveProxy(httptest.NewRecorder(), req)
+		if seen != tt.want {
+			t.Errorf("%s with %s: expected %s, got %s", tt.remote, tt.inbound, tt.want, seen)
+		}
+	}
+}
+
+func TestDeadline_FormatAndExpiry(t *testing.T) {
+	var seen string
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		seen = req.Header.Get("X-Deadline")
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithRequestDeadline(RequestDeadline{
+		Timeout:         time.Second,
+		Header:          "X-Deadline",
+		Format:          DeadlineRFC3339,
+		TrustedPrefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}))
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if seen != "2026-10-15T12:00:01Z" {
+		t.Errorf("Expected an RFC 3339 deadline, got %q", seen)
+	}
+
+	// A deadline already passed fails without reaching the server
+	seen = ""
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Deadline", "2026-10-15T11:59:59Z")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	if rw.Code != http.StatusGatewayTimeout || seen != "" {
+		t.Errorf("Expected a 504 without an attempt, got %d (server saw %q)", rw.Code, seen)
+	}
+}
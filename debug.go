@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// debugHeader carries the explanation of a debugged request in the
+	// response.
+	debugHeader = "X-LB-Debug"
+
+	// debugSecretHeader carries the shared secret asking for an
+	// explanation.
+	debugSecretHeader = "X-LB-Debug-Secret"
+)
+
+// DebugExplain explains why requests went to their server. Requests
+// carrying Secret in X-LB-Debug-Secret, or every request with Always set,
+// as in development, get the explanation in the X-LB-Debug response header
+// as JSON and in an info log entry. Without it nothing is collected.
+type DebugExplain struct {
+	Always bool
+	Secret string
+}
+
+// WithDebugExplain enables explaining server selection. It is disabled by
+// default.
+func WithDebugExplain(d DebugExplain) Option {
+	return func(lb *LoadBalancer) {
+		lb.debug = &d
+	}
+}
+
+// Explanation is how the server of a request was chosen: the route and
+// selector applied, the strategy that decided and those that passed, the
+// affinity key hashed, the servers considered, the failed attempts before
+// the one to Server and the upstream error that one failed with, if any.
+type Explanation struct {
+	Route      string               `json:"route,omitempty"`
+	Selector   string               `json:"selector,omitempty"`
+	Fallback   bool                 `json:"fallback,omitempty"`
+	Strategy   string               `json:"strategy,omitempty"`
+	Passed     []string             `json:"passed,omitempty"`
+	Affinity   string               `json:"affinity,omitempty"`
+	Candidates []ExplainedCandidate `json:"candidates,omitempty"`
+	Attempts   []ExplainedAttempt   `json:"attempts,omitempty"`
+	Repeated   bool                 `json:"repeated,omitempty"`
+	Server     string               `json:"server,omitempty"`
+	Error      string               `json:"error,omitempty"`
+}
+
+// ExplainedCandidate is a server considered for a request. Excluded says
+// why it could not be selected: down, warming, draining, maintenance,
+// labels, saturated or attempted, for servers already attempted for the
+// request, unless every server was and the attempt is Repeated.
+type ExplainedCandidate struct {
+	Address  string `json:"address"`
+	Alive    bool   `json:"alive"`
+	Weight   int    `json:"weight"`
+	InFlight int64  `json:"in_flight"`
+	Excluded string `json:"excluded,omitempty"`
+}
+
+// ExplainedAttempt is a failed attempt that was retried.
+type ExplainedAttempt struct {
+	Server string     `json:"server"`
+	Class  ErrorClass `json:"class"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// affinityKeyed is implemented by strategies deciding on a key derived from
+// the request.
+type affinityKeyed interface {
+	affinityKey(req *http.Request) (string, bool)
+}
+
+// startDebug strips the debug secret from req and, when the request is to
+// be explained, returns the explanation to fill in, kept in the request's
+// info.
+func (lb *LoadBalancer) startDebug(req *http.Request) *Explanation {
+	if lb.debug == nil {
+		return nil
+	}
+	secret := req.Header.Get(debugSecretHeader)
+	req.Header.Del(debugSecretHeader)
+	info := requestInfo(req)
+	if info == nil || !lb.debug.Always && (lb.debug.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(lb.debug.Secret)) != 1) {
+		return nil
+	}
+	info.explanation = &Explanation{}
+
+	return info.explanation
+}
+
+// explanationFor returns the explanation collected for req, or nil. It is
+// only consulted with debugging enabled, so other requests pay nothing.
+func (lb *LoadBalancer) explanationFor(req *http.Request) *Explanation {
+	if lb.debug == nil {
+		return nil
+	}
+	if info := requestInfo(req); info != nil {
+		return info.explanation
+	}
+
+	return nil
+}
+
+// explainCandidatesLocked records every server of the pool as considered
+// for req under selector at now. lb.mu must be held.
+func (lb *LoadBalancer) explainCandidatesLocked(e *Explanation, req *http.Request, selector Selector, now time.Time) {
+	attempted := attemptedFor(req)
+	e.Selector = selector.String()
+	e.Candidates = e.Candidates[:0]
+	for _, server := range lb.servers {
+		addr := serverName(server)
+		c := ExplainedCandidate{
+			Address:  addr,
+			Alive:    lb.aliveLocked(server, now),
+			Weight:   lb.effectiveWeightLocked(server),
+			InFlight: lb.countersFor(addr).inFlight,
+		}
+		_, maintenance := maintenanceUntil(server, now)
+		limit := serverMaxConcurrent(server)
+		switch {
+		case !c.Alive:
+			c.Excluded = "down"
+		case lb.warming[addr] != nil:
+			c.Excluded = "warming"
+		case lb.drainingLocked(addr):
+			c.Excluded = "draining"
+		case maintenance:
+			c.Excluded = "maintenance"
+		case !selector.Matches(serverLabels(server)):
+			c.Excluded = "labels"
+		case limit > 0 && c.InFlight >= int64(limit):
+			c.Excluded = "saturated"
+		case attempted.has(server):
+			c.Excluded = "attempted"
+		}
+		e.Candidates = append(e.Candidates, c)
+	}
+}
+
+// decided records strategy choosing the server for req.
+func (e *Explanation) decided(strategy Strategy, req *http.Request) {
+	e.Strategy = strategy.Name()
+	e.Affinity = ""
+	if k, ok := strategy.(affinityKeyed); ok {
+		e.Affinity, _ = k.affinityKey(req)
+	}
+}
+
+// chosen records that the request was sent to server by a mechanism other
+// than the strategies, such as "sticky" or "override", with the affinity
+// key it followed, if any.
+func (e *Explanation) chosen(how string, server Server, affinity string) {
+	if e == nil || server == nil {
+		return
+	}
+	e.Strategy, e.Server, e.Affinity, e.Candidates = how, serverName(server), affinity, nil
+}
+
+// attempt records an attempt to server, setting the explanation so far on
+// the response headers of rw.
+func (e *Explanation) attempt(rw http.ResponseWriter, server Server) {
+	if e == nil {
+		return
+	}
+	e.Server, e.Error = serverName(server), ""
+	e.annotate(rw)
+}
+
+// annotate sets the explanation on the response headers of rw.
+func (e *Explanation) annotate(rw http.ResponseWriter) {
+	if e != nil {
+		rw.Header().Set(debugHeader, e.String())
+	}
+}
+
+// failed records a failed attempt to server that is retried.
+func (e *Explanation) failed(server Server, class ErrorClass) {
+	if e == nil {
+		return
+	}
+	e.Attempts = append(e.Attempts, ExplainedAttempt{Server: serverName(server), Class: class, Error: e.Error})
+	e.Error = ""
+}
+
+func (e *Explanation) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// logExplanation logs the explanation of req.
+func (lb *LoadBalancer) logExplanation(req *http.Request, e *Explanation) {
+	lb.logger.Info("selection explained", "method", req.Method, "path", req.URL.Path, "explanation", e.String())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// explain sends req through lb and decodes the explanation it returns, or
+// returns nil without one.
+func explain(t *testing.T, lb *LoadBalancer, req *http.Request) *Explanation {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	header := rw.Header().Get(debugHeader)
+	if header == "" {
+		return nil
+	}
+	var e Explanation
+	if err := json.Unmarshal([]byte(header), &e); err != nil {
+		t.Fatalf("Failed to decode the explanation %q: %v", header, err)
+	}
+	return &e
+}
+
+func debugRequest(path, secret string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set(debugSecretHeader, secret)
+	return req
+}
+
+func TestDebugExplain_RouteAndCandidates(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://server1.com", isAlive: true, labels: map[string]string{"team": "b"}},
+		&MockServer{addr: "http://server2.com", isAlive: false, labels: map[string]string{"team": "a"}},
+		&MockServer{addr: "http://server3.com", isAlive: true, labels: map[string]string{"team": "a"}},
+	}, WithRoutes(Route{
+		Name:       "api",
+		PathPrefix: "/api",
+		Selector:   Selector{{Key: "team", Operator: OpEquals, Values: []string{"a"}}},
+	}), WithDebugExplain(DebugExplain{Secret: "s3cret"}))
+
+	e := explain(t, lb, debugRequest("/api/users", "s3cret"))
+	if e == nil {
+		t.Fatal("Expected an explanation")
+	}
+	if e.Route != "api" || e.Strategy != "round-robin" || e.Server != "http://server3.com" {
+		t.Errorf("Expected route api, round-robin and server3, got %+v", e)
+	}
+	excluded := map[string]string{}
+	for _, c := range e.Candidates {
+		excluded[c.Address] = c.Excluded
+	}
+	want := map[string]string{"http://server1.com": "labels", "http://server2.com": "down", "http://server3.com": ""}
+	for addr, reason := range want {
+		if got, ok := excluded[addr]; !ok || got != reason {
+			t.Errorf("Expected %s excluded for %q, got %q", addr, reason, got)
+		}
+	}
+}
+
+func TestDebugExplain_AffinityKey(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://server1.com", isAlive: true},
+		&MockServer{addr: "http://server2.com", isAlive: true},
+	}, WithStrategyChain(HashStrategy("header-hash", HeaderKey("X-Tenant")), &roundRobin{}),
+		WithDebugExplain(DebugExplain{Always: true}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	e := explain(t, lb, req)
+	want := hashCandidate("acme", []Candidate{{Server: lb.servers[0]}, {Server: lb.servers[1]}}).Address()
+	if e == nil || e.Strategy != "header-hash" || e.Affinity != "acme" || e.Server != want {
+		t.Errorf("Expected header-hash on acme to choose %s, got %+v", want, e)
+	}
+
+	e = explain(t, lb, httptest.NewRequest("GET", "/", nil))
+	if e == nil || e.Strategy != "round-robin" || len(e.Passed) != 1 || e.Passed[0] != "header-hash" {
+		t.Errorf("Expected header-hash to pass to round-robin, got %+v", e)
+	}
+}
+
+func TestDebugExplain_Retries(t *testing.T) {
+	refusing := newRefusingServer(t)
+	ok := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{refusing, ok},
+		WithRetryPolicy(RetryPolicy{Attempts: 2}), WithDebugExplain(DebugExplain{Always: true}))
+
+	e := explain(t, lb, httptest.NewRequest("GET", "/", nil))
+	if e == nil || e.Server != ok.Address() {
+		t.Fatalf("Expected the retry to reach %s, got %+v", ok.Address(), e)
+	}
+	if len(e.Attempts) != 1 || e.Attempts[0].Server != refusing.Address() || e.Attempts[0].Class != ClassConnectRefused {
+		t.Errorf("Expected the refused attempt, got %+v", e.Attempts)
+	}
+}
+
+func TestDebugExplain_RequiresSecret(t *testing.T) {
+	var forwarded http.Header
+	backend := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+	})
+	lb := newTestLoadBalancer(t, []Server{backend}, WithDebugExplain(DebugExplain{Secret: "s3cret"}))
+
+	if e := explain(t, lb, debugRequest("/", "wrong")); e != nil {
+		t.Errorf("Expected no explanation with the wrong secret, got %+v", e)
+	}
+	if forwarded.Get(debugSecretHeader) != "" {
+		t.Error("Expected the debug secret to be stripped before forwarding")
+	}
+	if e := explain(t, lb, httptest.NewRequest("GET", "/", nil)); e != nil {
+		t.Errorf("Expected no explanation without a secret, got %+v", e)
+	}
+
+	plain := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+	if e := explain(t, plain, debugRequest("/", "s3cret")); e != nil {
+		t.Errorf("Expected no explanation with debugging disabled, got %+v", e)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"load-balancer/discovery/docker"
+)
+
+// applyDockerEvent adds, removes or updates the liveness of the server
+// contributed by a container. Removed servers take no new requests while
+// requests in flight complete.
+func (lb *LoadBalancer) applyDockerEvent(e docker.Event) {
+	b := e.Backend
+	switch e.Type {
+	case docker.Added:
+		opts := append(lb.serverOptions(), WithWeight(b.Weight), WithLabels(map[string]string{"container": b.Name}))
+		server, err := newSimpleServer(b.Address, opts...)
+		if err != nil {
+			fmt.Printf("error: docker discovery: container %s: %v\n", b.Name, err)
+			return
+		}
+		server.SetAlive(b.Alive())
+		if err := lb.AddServer(server); err != nil {
+			fmt.Printf("error: docker discovery: container %s: %v\n", b.Name, err)
+			return
+		}
+		fmt.Printf("docker discovery: added %q for container %s\n", b.Address, b.Name)
+	case docker.Removed:
+		if err := lb.RemoveServer(b.Address); err != nil {
+			fmt.Printf("error: docker discovery: container %s: %v\n", b.Name, err)
+			return
+		}
+		fmt.Printf("docker discovery: removed %q of container %s\n", b.Address, b.Name)
+	case docker.HealthChanged:
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		for _, s := range lb.servers {
+			if s.Address() == b.Address {
+				if setter, ok := s.(HealthSettable); ok {
+					setter.SetAlive(b.Alive())
+					lb.observeHealthLocked(s)
+				}
+			}
+		}
+		fmt.Printf("docker discovery: container %s is %s\n", b.Name, b.Health)
+	}
+}
@@ -0,0 +1,412 @@
+// Package docker discovers load balancer backends from the labels of running
+// Docker containers. It talks to the Docker Engine API over its unix socket
+// and reports containers appearing, disappearing and changing health as
+// events.
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSocket is where the Docker daemon listens by default.
+	DefaultSocket = "/var/run/docker.sock"
+
+	// DefaultLabelPrefix prefixes the container labels read by the
+	// Discoverer, as in "lb.enable=true".
+	DefaultLabelPrefix = "lb"
+
+	// DefaultHost is the host published ports are reached at.
+	DefaultHost = "127.0.0.1"
+
+	// retryDelay is how long Run waits before reconnecting after the event
+	// stream fails.
+	retryDelay = time.Second
+)
+
+// Config configures a Discoverer. Containers take part when labeled
+// "<prefix>.enable=true" and may further set:
+//
+//	<prefix>.port    container port whose published port is used, by
+//	                 default the first published TCP port
+//	<prefix>.path    path prefix appended to the backend address
+//	<prefix>.scheme  "http" (the default) or "https"
+//	<prefix>.weight  backend weight, 1 by default
+type Config struct {
+	Socket      string
+	LabelPrefix string
+	Host        string
+}
+
+// Health is the Docker health status of a container.
+type Health string
+
+const (
+	// HealthNone means the container has no health check.
+	HealthNone      Health = ""
+	HealthStarting  Health = "starting"
+	HealthHealthy   Health = "healthy"
+	HealthUnhealthy Health = "unhealthy"
+)
+
+// Backend is a server contributed by a container.
+type Backend struct {
+	ContainerID string
+	Name        string
+	Address     string
+	Weight      int
+	Health      Health
+}
+
+// Alive reports whether the balancer should consider the backend alive:
+// containers without a health check are alive, others once they are healthy.
+func (b Backend) Alive() bool {
+	return b.Health == HealthNone || b.Health == HealthHealthy
+}
+
+// EventType says what happened to a backend.
+type EventType string
+
+const (
+	Added         EventType = "added"
+	Removed       EventType = "removed"
+	HealthChanged EventType = "health-changed"
+)
+
+// Event reports a change to the discovered backends.
+type Event struct {
+	Type    EventType
+	Backend Backend
+}
+
+// Discoverer tracks the backends contributed by containers.
+type Discoverer struct {
+	cfg    Config
+	client *http.Client
+
+	mu    sync.Mutex
+	known map[string]Backend
+
+	synced   chan struct{}
+	syncOnce sync.Once
+}
+
+// New returns a Discoverer for cfg, filling in defaults for empty fields.
+func New(cfg Config) *Discoverer {
+	if cfg.Socket == "" {
+		cfg.Socket = DefaultSocket
+	}
+	if cfg.LabelPrefix == "" {
+		cfg.LabelPrefix = DefaultLabelPrefix
+	}
+	if cfg.Host == "" {
+		cfg.Host = DefaultHost
+	}
+
+	return &Discoverer{
+		cfg: cfg,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.Socket)
+			},
+		}},
+		known:  make(map[string]Backend),
+		synced: make(chan struct{}),
+	}
+}
+
+// Synced returns a channel closed once the running containers were first
+// reported.
+func (d *Discoverer) Synced() <-chan struct{} {
+	return d.synced
+}
+
+// Run reports the backends of running containers to handle and then follows
+// container events until ctx is done. When the event stream fails it
+// reconnects, reporting whatever changed in the meantime.
+func (d *Discoverer) Run(ctx context.Context, handle func(Event)) error {
+	for {
+		err := d.Watch(ctx, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Printf("error: docker discovery: %v, reconnecting\n", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// Watch synchronizes the known backends with the running containers and
+// reports changes to handle until the event stream ends or ctx is done.
+func (d *Discoverer) Watch(ctx context.Context, handle func(Event)) error {
+	// Subscribe before listing so that no change falls in between.
+	resp, err := d.get(ctx, "/events", map[string][]string{
+		"type":  {"container"},
+		"label": {d.label("enable") + "=true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	backends, err := d.list(ctx, nil)
+	if err != nil {
+		return err
+	}
+	d.sync(backends, handle)
+	d.syncOnce.Do(func() { close(d.synced) })
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var msg struct {
+			Action string `json:"Action"`
+			Actor  struct {
+				ID string `json:"ID"`
+			} `json:"Actor"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return fmt.Errorf("decode event: %w", err)
+		}
+		if err := d.handleEvent(ctx, msg.Action, msg.Actor.ID, handle); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("event stream closed")
+}
+
+// handleEvent applies a container event.
+func (d *Discoverer) handleEvent(ctx context.Context, action, id string, handle func(Event)) error {
+	switch {
+	case action == "start":
+		backends, err := d.list(ctx, []string{id})
+		if err != nil {
+			return err
+		}
+		for _, b := range backends {
+			d.add(b, handle)
+		}
+	case action == "die" || action == "destroy":
+		d.remove(id, handle)
+	case strings.HasPrefix(action, "health_status"):
+		health := Health(strings.TrimSpace(strings.TrimPrefix(action, "health_status:")))
+		d.mu.Lock()
+		b, ok := d.known[id]
+		changed := ok && b.Health != health
+		if changed {
+			b.Health = health
+			d.known[id] = b
+		}
+		d.mu.Unlock()
+		if changed {
+			handle(Event{Type: HealthChanged, Backend: b})
+		}
+	}
+
+	return nil
+}
+
+// sync reports the difference between the known backends and backends.
+func (d *Discoverer) sync(backends []Backend, handle func(Event)) {
+	running := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		running[b.ContainerID] = true
+		d.add(b, handle)
+	}
+
+	d.mu.Lock()
+	var gone []string
+	for id := range d.known {
+		if !running[id] {
+			gone = append(gone, id)
+		}
+	}
+	d.mu.Unlock()
+	for _, id := range gone {
+		d.remove(id, handle)
+	}
+}
+
+// add records b, reporting it as added, or as changed health if it is
+// already known.
+func (d *Discoverer) add(b Backend, handle func(Event)) {
+	d.mu.Lock()
+	old, ok := d.known[b.ContainerID]
+	d.known[b.ContainerID] = b
+	d.mu.Unlock()
+
+	switch {
+	case !ok:
+		handle(Event{Type: Added, Backend: b})
+	case old.Address != b.Address || old.Weight != b.Weight:
+		handle(Event{Type: Removed, Backend: old})
+		handle(Event{Type: Added, Backend: b})
+	case old.Health != b.Health:
+		handle(Event{Type: HealthChanged, Backend: b})
+	}
+}
+
+// remove forgets the backend of the container with the given ID.
+func (d *Discoverer) remove(id string, handle func(Event)) {
+	d.mu.Lock()
+	b, ok := d.known[id]
+	delete(d.known, id)
+	d.mu.Unlock()
+
+	if ok {
+		handle(Event{Type: Removed, Backend: b})
+	}
+}
+
+// container is the part of a GET /containers/json entry the Discoverer uses.
+type container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Status string            `json:"Status"`
+	Ports  []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+}
+
+// list returns the backends of the running, enabled containers, restricted
+// to the given IDs if there are any. Containers whose backend cannot be
+// determined are skipped with an error message.
+func (d *Discoverer) list(ctx context.Context, ids []string) ([]Backend, error) {
+	filters := map[string][]string{
+		"status": {"running"},
+		"label":  {d.label("enable") + "=true"},
+	}
+	if len(ids) > 0 {
+		filters["id"] = ids
+	}
+	resp, err := d.get(ctx, "/containers/json", filters)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []container
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("decode containers: %w", err)
+	}
+
+	var backends []Backend
+	for _, c := range containers {
+		b, err := d.backend(c)
+		if err != nil {
+			fmt.Printf("error: docker discovery: container %s: %v\n", c.ID, err)
+			continue
+		}
+		backends = append(backends, b)
+	}
+
+	return backends, nil
+}
+
+// backend derives the backend of c from its labels and published ports.
+func (d *Discoverer) backend(c container) (Backend, error) {
+	b := Backend{ContainerID: c.ID, Weight: 1, Health: parseHealth(c.Status)}
+	if len(c.Names) > 0 {
+		b.Name = strings.TrimPrefix(c.Names[0], "/")
+	}
+
+	if w, ok := c.Labels[d.label("weight")]; ok {
+		weight, err := strconv.Atoi(w)
+		if err != nil || weight < 0 {
+			return Backend{}, fmt.Errorf("invalid weight %q", w)
+		}
+		b.Weight = weight
+	}
+
+	private := 0
+	if p, ok := c.Labels[d.label("port")]; ok {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return Backend{}, fmt.Errorf("invalid port %q", p)
+		}
+		private = port
+	}
+	public := 0
+	for _, p := range c.Ports {
+		if p.PublicPort != 0 && p.Type == "tcp" && (private == 0 || p.PrivatePort == private) {
+			public = p.PublicPort
+			break
+		}
+	}
+	if public == 0 {
+		return Backend{}, fmt.Errorf("no published port")
+	}
+
+	scheme := c.Labels[d.label("scheme")]
+	if scheme == "" {
+		scheme = "http"
+	}
+	b.Address = fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(d.cfg.Host, strconv.Itoa(public)), c.Labels[d.label("path")])
+
+	return b, nil
+}
+
+// parseHealth extracts the health from a container status such as
+// "Up 5 minutes (healthy)".
+func parseHealth(status string) Health {
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		return HealthHealthy
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return HealthUnhealthy
+	case strings.HasSuffix(status, "(health: starting)"):
+		return HealthStarting
+	}
+
+	return HealthNone
+}
+
+// label returns the full name of the label with the given suffix.
+func (d *Discoverer) label(name string) string {
+	return d.cfg.LabelPrefix + "." + name
+}
+
+// get sends a GET request for path with the given filters to the Docker API.
+func (d *Discoverer) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	encoded, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	u := "http://docker" + path + "?filters=" + url.QueryEscape(string(encoded))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", path, resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,213 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDocker is a Docker API serving a mutable container list and replaying
+// the events sent to it.
+type stubDocker struct {
+	mu         sync.Mutex
+	containers []map[string]any
+	filters    []string
+	events     chan string
+}
+
+func newStubDocker(t *testing.T) (*stubDocker, string) {
+	stub := &stubDocker{events: make(chan string, 16)}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(stub)
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return stub, socket
+}
+
+func (s *stubDocker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var filters map[string][]string
+	json.Unmarshal([]byte(req.URL.Query().Get("filters")), &filters)
+	s.mu.Lock()
+	s.filters = append(s.filters, req.URL.Path+" "+req.URL.Query().Get("filters"))
+	s.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/containers/json":
+		s.mu.Lock()
+		var list []map[string]any
+		for _, c := range s.containers {
+			if ids := filters["id"]; len(ids) == 0 || slices.Contains(ids, c["Id"].(string)) {
+				list = append(list, c)
+			}
+		}
+		s.mu.Unlock()
+		json.NewEncoder(rw).Encode(list)
+	case "/events":
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case event, ok := <-s.events:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(rw, event)
+				rw.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (s *stubDocker) setContainers(containers ...map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers = containers
+}
+
+// containerEntry returns a container list entry publishing private port 80 at
+// public.
+func containerEntry(id string, public int, status string, labels map[string]string) map[string]any {
+	return map[string]any{
+		"Id":     id,
+		"Names":  []string{"/" + id},
+		"Labels": labels,
+		"Status": status,
+		"Ports": []map[string]any{
+			{"IP": "0.0.0.0", "PrivatePort": 9090, "PublicPort": public + 1, "Type": "tcp"},
+			{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": public, "Type": "tcp"},
+		},
+	}
+}
+
+// collect runs the discoverer until ctx is done, sending its events to the
+// returned channel.
+func collect(ctx context.Context, d *Discoverer) <-chan Event {
+	events := make(chan Event, 16)
+	go d.Run(ctx, func(e Event) { events <- e })
+	return events
+}
+
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an event, got none")
+		return Event{}
+	}
+}
+
+func TestDiscoverer_ListAndEvents(t *testing.T) {
+	stub, socket := newStubDocker(t)
+	stub.setContainers(containerEntry("web1", 32768, "Up 5 minutes", map[string]string{
+		"lb.enable": "true", "lb.port": "80", "lb.path": "/api", "lb.weight": "3",
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := New(Config{Socket: socket})
+	events := collect(ctx, d)
+
+	// Running containers are reported at startup
+	e := next(t, events)
+	want := Backend{ContainerID: "web1", Name: "web1", Address: "http://127.0.0.1:32768/api", Weight: 3}
+	if e.Type != Added || e.Backend != want {
+		t.Errorf("Expected %+v to be added, got %s %+v", want, e.Type, e.Backend)
+	}
+	select {
+	case <-d.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the first sync to be signalled")
+	}
+
+	// A started container with a health check is added as not alive
+	stub.setContainers(
+		containerEntry("web1", 32768, "Up 5 minutes", map[string]string{"lb.enable": "true", "lb.port": "80", "lb.path": "/api", "lb.weight": "3"}),
+		containerEntry("web2", 32770, "Up 1 second (health: starting)", map[string]string{"lb.enable": "true"}),
+	)
+	stub.events <- `{"Type":"container","Action":"start","Actor":{"ID":"web2"}}`
+	e = next(t, events)
+	if e.Type != Added || e.Backend.Address != "http://127.0.0.1:32771" || e.Backend.Weight != 1 || e.Backend.Alive() {
+		t.Errorf("Expected web2 to be added at its first published port and not alive, got %s %+v", e.Type, e.Backend)
+	}
+
+	stub.events <- `{"Type":"container","Action":"health_status: healthy","Actor":{"ID":"web2"}}`
+	e = next(t, events)
+	if e.Type != HealthChanged || e.Backend.ContainerID != "web2" || !e.Backend.Alive() {
+		t.Errorf("Expected web2 to become healthy, got %s %+v", e.Type, e.Backend)
+	}
+	stub.events <- `{"Type":"container","Action":"health_status: unhealthy","Actor":{"ID":"web2"}}`
+	if e = next(t, events); e.Type != HealthChanged || e.Backend.Alive() {
+		t.Errorf("Expected web2 to become unhealthy, got %s %+v", e.Type, e.Backend)
+	}
+
+	stub.events <- `{"Type":"container","Action":"die","Actor":{"ID":"web1"}}`
+	if e = next(t, events); e.Type != Removed || e.Backend.Address != "http://127.0.0.1:32768/api" {
+		t.Errorf("Expected web1 to be removed, got %s %+v", e.Type, e.Backend)
+	}
+
+	stub.mu.Lock()
+	filter := stub.filters[0]
+	stub.mu.Unlock()
+	if filter != `/events {"label":["lb.enable=true"],"type":["container"]}` {
+		t.Errorf("Expected events to be filtered by label, got %s", filter)
+	}
+}
+
+func TestDiscoverer_ResyncAfterReconnect(t *testing.T) {
+	stub, socket := newStubDocker(t)
+	stub.setContainers(
+		containerEntry("web1", 32768, "Up", map[string]string{"custom.enable": "true"}),
+		containerEntry("web2", 32770, "Up", map[string]string{"custom.enable": "true"}),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := collect(ctx, New(Config{Socket: socket, LabelPrefix: "custom", Host: "docker.internal"}))
+
+	added := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		e := next(t, events)
+		added[e.Backend.Address] = e.Type == Added
+	}
+	if !added["http://docker.internal:32769"] || !added["http://docker.internal:32771"] {
+		t.Errorf("Expected both containers to be added, got %v", added)
+	}
+
+	// web2 stops while the event stream is down
+	stub.setContainers(containerEntry("web1", 32768, "Up", map[string]string{"custom.enable": "true"}))
+	close(stub.events)
+	if e := next(t, events); e.Type != Removed || e.Backend.ContainerID != "web2" {
+		t.Errorf("Expected web2 to be removed after reconnecting, got %s %+v", e.Type, e.Backend)
+	}
+}
+
+func TestParseHealth(t *testing.T) {
+	tests := map[string]Health{
+		"Up 5 minutes":                    HealthNone,
+		"Up 5 minutes (healthy)":          HealthHealthy,
+		"Up 5 minutes (unhealthy)":        HealthUnhealthy,
+		"Up 2 seconds (health: starting)": HealthStarting,
+	}
+	for status, want := range tests {
+		if got := parseHealth(status); got != want {
+			t.Errorf("%q: Expected %q, got %q", status, want, got)
+		}
+	}
+}
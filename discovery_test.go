@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"load-balancer/discovery/docker"
+)
+
+func TestApplyDockerEvent(t *testing.T) {
+	lb := newTestLoadBalancer(t, nil, WithAllowEmpty())
+	backend := docker.Backend{ContainerID: "c1", Name: "web1", Address: "http://127.0.0.1:32768", Weight: 2, Health: docker.HealthStarting}
+
+	// Containers still starting are added but not selected
+	lb.applyDockerEvent(docker.Event{Type: docker.Added, Backend: backend})
+	stats := lb.Stats()
+	if len(stats) != 1 || stats[0].Address != backend.Address || stats[0].Alive || stats[0].Weight != 2 {
+		t.Fatalf("Expected a dead server with weight 2, got %+v", stats)
+	}
+	if stats[0].Labels["container"] != "web1" {
+		t.Errorf("Expected the container label, got %v", stats[0].Labels)
+	}
+
+	backend.Health = docker.HealthHealthy
+	lb.applyDockerEvent(docker.Event{Type: docker.HealthChanged, Backend: backend})
+	if server, err := lb.getNextAvailableServer(); err != nil || server.Address() != backend.Address {
+		t.Errorf("Expected the healthy container to be selected, got %v", err)
+	}
+
+	lb.applyDockerEvent(docker.Event{Type: docker.Removed, Backend: backend})
+	if stats := lb.Stats(); len(stats) != 0 {
+		t.Errorf("Expected the server to be removed, got %+v", stats)
+	}
+}
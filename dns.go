@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSTimeout     = 2 * time.Second
+	defaultDNSTTL         = 30 * time.Second
+	defaultDNSNegativeTTL = 5 * time.Second
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSConfig configures the resolution of server hostnames. Servers lists
+// the DNS servers to query as "host:port", tried in turn; the system
+// configuration is used without any. Lookups are cut off after Timeout, 2s
+// by default. Addresses are cached for TTL, 30s by default, and failed
+// lookups for NegativeTTL, 5s by default. With StaleGrace set, a host whose
+// lookup fails keeps its last addresses for up to StaleGrace past their
+// TTL, retrying every NegativeTTL.
+type DNSConfig struct {
+	Servers     []string
+	Timeout     time.Duration
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	StaleGrace  time.Duration
+}
+
+// DNSCache resolves server hostnames for upstream dials, caching the
+// results. One cache is meant to be shared by every server.
+type DNSCache struct {
+	config   DNSConfig
+	resolver Resolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	pending map[string]*dnsLookup
+
+	lookups      *histogram
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+	failed       atomic.Uint64
+	stale        atomic.Uint64
+}
+
+// dnsEntry is the cached result of a lookup. A failed lookup has err set,
+// unless the previous addresses are kept as stale until staleUntil.
+type dnsEntry struct {
+	addrs      []string
+	err        error
+	expires    time.Time
+	staleUntil time.Time
+}
+
+// dnsLookup is a lookup in progress, shared by the dials waiting for it.
+type dnsLookup struct {
+	done  chan struct{}
+	addrs []string
+	err   error
+}
+
+// NewDNSCache returns a cache resolving with the DNS servers of c.
+func NewDNSCache(c DNSConfig) *DNSCache {
+	resolver := net.DefaultResolver
+	if len(c.Servers) > 0 {
+		var next atomic.Uint64
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := c.Servers[next.Add(1)%uint64(len(c.Servers))]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return newDNSCache(c, resolver)
+}
+
+func newDNSCache(c DNSConfig, resolver Resolver) *DNSCache {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultDNSTimeout
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultDNSTTL
+	}
+	if c.NegativeTTL <= 0 {
+		c.NegativeTTL = defaultDNSNegativeTTL
+	}
+
+	return &DNSCache{
+		config:   c,
+		resolver: resolver,
+		now:      time.Now,
+		entries:  make(map[string]*dnsEntry),
+		pending:  make(map[string]*dnsLookup),
+		lookups:  newHistogram(defaultLatencyBuckets),
+	}
+}
+
+// LookupHost returns the addresses of host, from the cache while they are
+// fresh. Concurrent lookups of the same host are made once.
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	c.mu.Lock()
+	if e := c.entries[host]; e != nil && c.now().Before(e.expires) {
+		c.mu.Unlock()
+		if e.err != nil {
+			c.negativeHits.Add(1)
+			return nil, e.err
+		}
+		c.hits.Add(1)
+		return e.addrs, nil
+	}
+	c.misses.Add(1)
+	l := c.pending[host]
+	if l == nil {
+		l = &dnsLookup{done: make(chan struct{})}
+		c.pending[host] = l
+		// The lookup outlives the dial that started it, which other dials
+		// may be waiting on.
+		go c.lookup(context.WithoutCancel(ctx), host, l)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.addrs, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup resolves host, caching the result.
+func (c *DNSCache) lookup(ctx context.Context, host string, l *dnsLookup) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	c.lookups.Observe(time.Since(start))
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if ctx.Err() != nil && err != nil {
+		err = &net.DNSError{Err: "lookup timed out", Name: host, IsTimeout: true}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	prev := c.entries[host]
+	switch {
+	case err == nil:
+		c.entries[host] = &dnsEntry{
+			addrs:      addrs,
+			expires:    now.Add(c.config.TTL),
+			staleUntil: now.Add(c.config.TTL + c.config.StaleGrace),
+		}
+	case prev != nil && prev.err == nil && now.Before(prev.staleUntil):
+		c.failed.Add(1)
+		c.stale.Add(1)
+		addrs, err = prev.addrs, nil
+		prev.expires = now.Add(c.config.NegativeTTL)
+	default:
+		c.failed.Add(1)
+		c.entries[host] = &dnsEntry{err: err, expires: now.Add(c.config.NegativeTTL)}
+	}
+	delete(c.pending, host)
+	l.addrs, l.err = addrs, err
+	close(l.done)
+}
+
+// dialer wraps dial to resolve hostnames through the cache, dialing the
+// addresses in turn until one connects.
+func (c *DNSCache) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := c.LookupHost(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
+
+// WithResolver resolves the server's hostname through c.
+func WithResolver(c *DNSCache) ServerOption {
+	return func(s *simpleServer) {
+		s.transport.DialContext = c.dialer(s.transport.DialContext)
+	}
+}
+
+// WithDNS resolves the hostnames of servers the load balancer creates
+// itself, through the admin API or discovery, through c and exports its
+// metrics. Servers passed in are built with WithResolver.
+func WithDNS(c *DNSCache) Option {
+	return func(lb *LoadBalancer) {
+		lb.dns = c
+	}
+}
+
+// serverOptions returns the options of servers the load balancer creates.
+func (lb *LoadBalancer) serverOptions() []ServerOption {
+	if lb.dns == nil {
+		return nil
+	}
+
+	return []ServerOption{WithResolver(lb.dns)}
+}
+
+// writeMetrics renders the lookup latency and cache results.
+func (c *DNSCache) writeMetrics(w io.Writer) {
+	c.lookups.write(w, "lb_dns_lookup_duration_seconds", "Time taken by DNS lookups of server hostnames.")
+	fmt.Fprintln(w, "# HELP lb_dns_cache_requests_total Resolutions of server hostnames by cache result.")
+	fmt.Fprintln(w, "# TYPE lb_dns_cache_requests_total counter")
+	fmt.Fprintf(w, "lb_dns_cache_requests_total{result=\"hit\"} %d\n", c.hits.Load())
+	fmt.Fprintf(w, "lb_dns_cache_requests_total{result=\"negative_hit\"} %d\n", c.negativeHits.Load())
+	fmt.Fprintf(w, "lb_dns_cache_requests_total{result=\"miss\"} %d\n", c.misses.Load())
+	fmt.Fprintln(w, "# HELP lb_dns_lookup_errors_total Failed DNS lookups of server hostnames.")
+	fmt.Fprintln(w, "# TYPE lb_dns_lookup_errors_total counter")
+	fmt.Fprintf(w, "lb_dns_lookup_errors_total %d\n", c.failed.Load())
+	fmt.Fprintln(w, "# HELP lb_dns_stale_total Failed lookups answered with the previous addresses.")
+	fmt.Fprintln(w, "# TYPE lb_dns_stale_total counter")
+	fmt.Fprintf(w, "lb_dns_stale_total %d\n", c.stale.Load())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from addrs, or fails with err, counting
+// them. With hang set it blocks until the lookup is cancelled.
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs []string
+	err   error
+	hang  bool
+	calls int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	r.calls++
+	addrs, err, hang := r.addrs, r.err, r.hang
+	r.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return addrs, err
+}
+
+func (r *fakeResolver) set(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func (r *fakeResolver) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func newFakeDNSCache(c DNSConfig, r Resolver) (*DNSCache, *time.Time) {
+	cache := newDNSCache(c, r)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func TestDNSCache_CachesAddresses(t *testing.T) {
+	r := &fakeResolver{addrs: []string{"10.0.0.1"}}
+	cache, now := newFakeDNSCache(DNSConfig{TTL: time.Minute}, r)
+
+	for range 3 {
+		addrs, err := cache.LookupHost(context.Background(), "backend.test")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatalf("Expected the resolved address, got %v, %v", addrs, err)
+		}
+	}
+	if r.callCount() != 1 {
+		t.Errorf("Expected one lookup while cached, got %d", r.callCount())
+	}
+
+	*now = now.Add(time.Minute)
+	cache.LookupHost(context.Background(), "backend.test")
+	if r.callCount() != 2 {
+		t.Errorf("Expected a lookup once the TTL passed, got %d", r.callCount())
+	}
+	if cache.hits.Load() != 2 || cache.misses.Load() != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %d and %d", cache.hits.Load(), cache.misses.Load())
+	}
+}
+
+func TestDNSCache_NegativeCaching(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "backend.test", IsNotFound: true}
+	r := &fakeResolver{err: notFound}
+	cache, now := newFakeDNSCache(DNSConfig{NegativeTTL: 5 * time.Second}, r)
+
+	for range 2 {
+		if _, err := cache.LookupHost(context.Background(), "backend.test"); !errors.Is(err, notFound) {
+			t.Fatalf("Expected the lookup error, got %v", err)
+		}
+	}
+	if r.callCount() != 1 {
+		t.Errorf("Expected the failure to be cached, got %d lookups", r.callCount())
+	}
+
+	r.set([]string{"10.0.0.1"}, nil)
+	*now = now.Add(5 * time.Second)
+	if addrs, err := cache.LookupHost(context.Background(), "backend.test"); err != nil || len(addrs) != 1 {
+		t.Errorf("Expected a new lookup after the negative TTL, got %v, %v", addrs, err)
+	}
+}
+
+func TestDNSCache_StaleOnError(t *testing.T) {
+	r := &fakeResolver{addrs: []string{"10.0.0.1"}}
+	cache, now := newFakeDNSCache(DNSConfig{TTL: 30 * time.Second, NegativeTTL: 5 * time.Second, StaleGrace: time.Minute}, r)
+	cache.LookupHost(context.Background(), "backend.test")
+
+	r.set(nil, errors.New("server misbehaving"))
+	*now = now.Add(40 * time.Second)
+	for range 2 {
+		addrs, err := cache.LookupHost(context.Background(), "backend.test")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatalf("Expected the last known address within the grace period, got %v, %v", addrs, err)
+		}
+	}
+	if r.callCount() != 2 || cache.stale.Load() != 1 {
+		t.Errorf("Expected one failed refresh answered stale, got %d lookups, %d stale", r.callCount(), cache.stale.Load())
+	}
+
+	*now = now.Add(time.Minute)
+	if _, err := cache.LookupHost(context.Background(), "backend.test"); err == nil {
+		t.Error("Expected the failure once the grace period passed")
+	}
+}
+
+func TestDNSCache_LookupTimeout(t *testing.T) {
+	cache := newDNSCache(DNSConfig{Timeout: 50 * time.Millisecond}, &fakeResolver{hang: true})
+
+	start := time.Now()
+	_, err := cache.LookupHost(context.Background(), "backend.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to be cut off, took %v", elapsed)
+	}
+}
+
+func TestDNSCache_UpstreamDials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	r := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	cache := newDNSCache(DNSConfig{}, r)
+
+	server, err := newSimpleServer("http://backend.test:"+u.Port(), WithResolver(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithDNS(cache))
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the hostname to resolve through the cache, got %d", rw.Code)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`lb_dns_cache_requests_total{result="miss"} 1`,
+		`lb_dns_lookup_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultDrainTimeout bounds POST /admin/drain with wait set when the
+// request names no timeout.
+const defaultDrainTimeout = 30 * time.Second
+
+// drainState tracks a server taken out of selection by Drain. done is
+// closed once the server has no requests in flight. A server drained with
+// a fade is fading until fadeUntil, zero once the fade is over.
+type drainState struct {
+	done   chan struct{}
+	closed bool
+
+	fade      time.Duration
+	fadeUntil time.Time
+	timer     *time.Timer
+}
+
+// DrainFade is the fade of a server drained with DrainFade, as reported in
+// its stats. Weight is the part of its weight left.
+type DrainFade struct {
+	Until  time.Time `json:"until"`
+	Weight float64   `json:"weight"`
+}
+
+// Drain stops selecting the server with the given name or address, compared
+// normalized, and returns a channel closed once its in-flight requests have
+// completed. Draining a server that is already draining returns the same
+// channel, ending its fade if it is fading. Requests forced to the server
+// with the backend override still reach it. Its streams are closed after
+// the DrainGrace of their stream policy. It returns ErrServerNotFound for
+// unknown servers.
+func (lb *LoadBalancer) Drain(addr string) (<-chan struct{}, error) {
+	return lb.DrainFade(addr, 0)
+}
+
+// DrainFade drains the server with the given name or address like Drain, but
+// gradually: over fade, the share of selections the server is offered in
+// falls from all of them to none, as though its weight ramped down to
+// zero, and only then is it out of selection, waiting for its requests in
+// flight. This spares the other servers the load spike of a server
+// leaving at once. Should the server go down while fading, it is drained
+// at once. Draining a server that is already draining returns the same
+// channel and leaves its fade as it is.
+func (lb *LoadBalancer) DrainFade(addr string, fade time.Duration) (<-chan struct{}, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	server := lb.findServerLocked(addr)
+	if server == nil {
+		return nil, fmt.Errorf("drain %q: %w", addr, ErrServerNotFound)
+	}
+	addr = serverName(server)
+	if d := lb.drains[addr]; d != nil {
+		if fade <= 0 {
+			lb.endFadeLocked(addr)
+		}
+		return d.done, nil
+	}
+
+	return lb.drainLocked(addr, fade, lb.now().Add(fade)).done, nil
+}
+
+// drainLocked takes the server with the given name out of selection,
+// fading it out over fade until until if fade is positive. lb.mu must be
+// held.
+func (lb *LoadBalancer) drainLocked(addr string, fade time.Duration, until time.Time) *drainState {
+	d := &drainState{done: make(chan struct{})}
+	lb.drains[addr] = d
+	lb.events.publish(Event{Type: EventDrainStarted, Backend: addr})
+	if fade > 0 {
+		d.fade, d.fadeUntil = fade, until
+		d.timer = time.AfterFunc(until.Sub(lb.now()), func() {
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			if lb.drains[addr] == d {
+				lb.endFadeLocked(addr)
+			}
+		})
+		return d
+	}
+	lb.checkDrainedLocked(addr)
+	lb.streams.draining(addr, true)
+
+	return d
+}
+
+// Undrain returns a drained server to selection. It returns
+// ErrServerNotFound for unknown servers.
+func (lb *LoadBalancer) Undrain(addr string) error {
+	lb.mu.Lock()
+	server := lb.findServerLocked(addr)
+	if server != nil {
+		if d := lb.drains[serverName(server)]; d != nil && d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(lb.drains, serverName(server))
+		delete(lb.credits, serverName(server))
+	}
+	lb.mu.Unlock()
+	if server == nil {
+		return fmt.Errorf("undrain %q: %w", addr, ErrServerNotFound)
+	}
+	lb.streams.draining(serverName(server), false)
+
+	if lb.queue != nil {
+		lb.queue.notify()
+	}
+
+	return nil
+}
+
+// findServerLocked returns the server with the given name or, failing that,
+// normalized address, or nil. lb.mu must be held.
+func (lb *LoadBalancer) findServerLocked(ref string) Server {
+	for _, s := range lb.servers {
+		if serverName(s) == ref {
+			return s
+		}
+	}
+	key := normalizeAddress(ref)
+	for _, s := range lb.servers {
+		if normalizeAddress(s.Address()) == key {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// checkDrainedLocked completes the drain of the server with the given
+// address once nothing is in flight. lb.mu must be held.
+func (lb *LoadBalancer) checkDrainedLocked(addr string) {
+	d := lb.drains[addr]
+	if d == nil || d.closed || d.fade > 0 || lb.countersFor(addr).inFlight > 0 {
+		return
+	}
+	d.closed = true
+	close(d.done)
+	lb.events.publish(Event{Type: EventDrainCompleted, Backend: addr})
+}
+
+// drainingLocked reports whether the server with the given name is
+// drained and past any fade. lb.mu must be held.
+func (lb *LoadBalancer) drainingLocked(addr string) bool {
+	if lb.drains[addr] == nil {
+		return false
+	}
+	_, fading := lb.fadeLocked(addr, lb.now())
+
+	return !fading
+}
+
+// fadeLocked returns the part of its weight left to the server with the
+// given name if it is fading at now, ending the fade once it is over.
+// lb.mu must be held.
+func (lb *LoadBalancer) fadeLocked(addr string, now time.Time) (float64, bool) {
+	d := lb.drains[addr]
+	if d == nil || d.fade <= 0 {
+		return 0, false
+	}
+	left := d.fadeUntil.Sub(now)
+	if left <= 0 {
+		lb.endFadeLocked(addr)
+		return 0, false
+	}
+
+	return min(float64(left)/float64(d.fade), 1), true
+}
+
+// endFadeLocked ends the fade of the server with the given name, if it
+// is fading, leaving it drained. lb.mu must be held.
+func (lb *LoadBalancer) endFadeLocked(addr string) {
+	d := lb.drains[addr]
+	if d == nil || d.fade <= 0 {
+		return
+	}
+	d.fade = 0
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	lb.checkDrainedLocked(addr)
+	lb.streams.draining(addr, true)
+}
+
+// pickFadingLocked apportions selections to the candidates fading out or
+// ramping up, each getting the share of selections its
+// partial weight earns among the weights of all candidates. It returns the
+// partial server whose turn it is, or nil and the candidates left for the
+// strategy, which are the partial ones only when no other is left. lb.mu
+// must be held.
+func (lb *LoadBalancer) pickFadingLocked(candidates []Candidate, now time.Time) (Server, []Candidate) {
+	var total float64
+	weights := make([]float64, len(candidates))
+	partial := make([]bool, len(candidates))
+	for i, c := range candidates {
+		weights[i] = float64(max(c.Weight, 1))
+		if share, ok := lb.partialWeightLocked(c.Server, now); ok {
+			weights[i] *= share
+			partial[i] = true
+		}
+		total += weights[i]
+	}
+	others := make([]Candidate, 0, len(candidates))
+	for i, c := range candidates {
+		if !partial[i] {
+			others = append(others, c)
+		}
+	}
+	if len(others) == 0 || len(others) == len(candidates) {
+		return nil, candidates
+	}
+
+	var server Server
+	for i, c := range candidates {
+		if !partial[i] {
+			continue
+		}
+		name := serverName(c.Server)
+		lb.credits[name] += weights[i] / total
+		if lb.credits[name] >= 1 && server == nil {
+			server = c.Server
+		}
+	}
+	if server != nil {
+		lb.credits[serverName(server)]--
+		return server, nil
+	}
+
+	return nil, others
+}
+
+// partialWeightLocked returns the part of its weight server is selected
+// with while it fades out through DrainFade or ramps up after warm-up or a
+// maintenance window. lb.mu must be held.
+func (lb *LoadBalancer) partialWeightLocked(server Server, now time.Time) (float64, bool) {
+	if left, fading := lb.fadeLocked(serverName(server), now); fading {
+		return left, true
+	}
+	if ramp := lb.slowStartLocked(server, now); ramp != nil {
+		return ramp.Weight, true
+	}
+
+	return 0, false
+}
+
+// fadeStatusLocked returns the fade of the server with the given name,
+// or nil if it is not fading. lb.mu must be held.
+func (lb *LoadBalancer) fadeStatusLocked(addr string, now time.Time) *DrainFade {
+	weight, fading := lb.fadeLocked(addr, now)
+	if !fading {
+		return nil
+	}
+
+	return &DrainFade{Until: lb.drains[addr].fadeUntil, Weight: weight}
+}
+
+// inFlight returns the number of requests in flight to the server with the
+// given name.
+func (lb *LoadBalancer) inFlight(addr string) int64 {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if server := lb.findServerLocked(addr); server != nil {
+		return lb.countersFor(serverName(server)).inFlight
+	}
+
+	return 0
+}
+
+// drainResult is the response of the drain endpoints.
+type drainResult struct {
+	URL      string `json:"url"`
+	Drained  bool   `json:"drained"`
+	InFlight int64  `json:"in_flight"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleDrain takes a server out of selection, immediately or, with mode
+// "fade", gradually over fade. With wait set the response is held until
+// the server has no requests in flight, answering 200, or the timeout
+// elapses, answering 504 with the requests still in flight. The timeout
+// defaults to 30s after the fade:
+//
+//	{"url": "http://10.0.0.5:8080", "mode": "fade", "fade": "2m", "wait": true}
+func (lb *LoadBalancer) handleDrain(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URL     string   `json:"url"`
+		Mode    string   `json:"mode"`
+		Fade    Duration `json:"fade"`
+		Wait    bool     `json:"wait"`
+		Timeout Duration `json:"timeout"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	if body.Timeout < 0 {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("timeout must not be negative"))
+		return
+	}
+	switch body.Mode {
+	case "", "immediate":
+		if body.Fade != 0 {
+			writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("fade needs mode \"fade\""))
+			return
+		}
+	case "fade":
+		if body.Fade <= 0 {
+			writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("mode \"fade\" needs a positive fade"))
+			return
+		}
+	default:
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("unknown drain mode %q, want \"immediate\" or \"fade\"", body.Mode))
+		return
+	}
+
+	done, err := lb.DrainFade(body.URL, time.Duration(body.Fade))
+	if err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+	if !body.Wait {
+		select {
+		case <-done:
+			writeJSON(rw, http.StatusOK, drainResult{URL: body.URL, Drained: true})
+		default:
+			writeJSON(rw, http.StatusAccepted, drainResult{URL: body.URL, InFlight: lb.inFlight(body.URL)})
+		}
+		return
+	}
+
+	timeout := time.Duration(body.Timeout)
+	if timeout == 0 {
+		timeout = time.Duration(body.Fade) + defaultDrainTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		writeJSON(rw, http.StatusOK, drainResult{URL: body.URL, Drained: true})
+	case <-timer.C:
+		writeJSON(rw, http.StatusGatewayTimeout, drainResult{
+			URL:      body.URL,
+			InFlight: lb.inFlight(body.URL),
+			Error:    fmt.Sprintf("requests still in flight after %s", timeout),
+		})
+	case <-req.Context().Done():
+	}
+}
+
+// handleUndrain returns a drained server to selection:
+//
+//	{"url": "http://10.0.0.5:8080"}
+func (lb *LoadBalancer) handleUndrain(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+
+	if err := lb.Undrain(body.URL); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
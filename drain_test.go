@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postAdmin sends body to the admin endpoint path.
+func postAdmin(lb *LoadBalancer, path, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return rw
+}
+
+func TestDrain_WaitsForInFlightRequests(t *testing.T) {
+	release := make(chan struct{}, 2)
+	slow := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+	})
+	other := &MockServer{addr: "http://other.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{slow, other})
+
+	// Round robin sends the first and third request to the slow server
+	var requests sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		}()
+		waitFor(t, "request dispatch", func() bool {
+			stats := lb.Stats()
+			return stats[0].Requests+stats[1].Requests == uint64(i+1)
+		})
+	}
+	waitFor(t, "slow requests", func() bool { return lb.inFlight(slow.Address()) == 2 })
+
+	// Two drain calls for the same server are coalesced
+	body := `{"url": "` + slow.Address() + `", "wait": true, "timeout": "10s"}`
+	results := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- postAdmin(lb, "/admin/drain", body) }()
+	}
+	waitFor(t, "draining", func() bool { return lb.Stats()[0].Draining })
+	for i := 0; i < 4; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	}
+	if lb.Stats()[0].Requests != 2 {
+		t.Errorf("Expected no new requests to a draining server, got %d", lb.Stats()[0].Requests)
+	}
+
+	release <- struct{}{}
+	select {
+	case rw := <-results:
+		t.Fatalf("Expected drain to wait for the last request, got %d %s", rw.Code, rw.Body.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		rw := <-results
+		var result drainResult
+		json.Unmarshal(rw.Body.Bytes(), &result)
+		if rw.Code != http.StatusOK || !result.Drained || result.InFlight != 0 {
+			t.Errorf("Expected the drain to complete, got %d %s", rw.Code, rw.Body.String())
+		}
+	}
+	if n := lb.inFlight(slow.Address()); n != 0 {
+		t.Errorf("Expected the drain to return once nothing was in flight, got %d", n)
+	}
+	requests.Wait()
+
+	if rw := postAdmin(lb, "/admin/undrain", `{"url": "`+slow.Address()+`"}`); rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected undrain to succeed, got %d", rw.Code)
+	}
+	for i := 0; i < 2; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if stats := lb.Stats()[0]; stats.Draining || stats.Requests != 3 {
+		t.Errorf("Expected the undrained server back in rotation, got %+v", stats)
+	}
+}
+
+func TestDrain_TimeoutAndErrors(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) { <-release })
+	lb := newTestLoadBalancer(t, []Server{slow})
+	go lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	waitFor(t, "slow request", func() bool { return lb.inFlight(slow.Address()) == 1 })
+
+	rw := postAdmin(lb, "/admin/drain", `{"url": "`+slow.Address()+`/", "wait": true, "timeout": "20ms"}`)
+	var result drainResult
+	json.Unmarshal(rw.Body.Bytes(), &result)
+	if rw.Code != http.StatusGatewayTimeout || result.Drained || result.InFlight != 1 {
+		t.Errorf("Expected a timeout with 1 request in flight, got %d %s", rw.Code, rw.Body.String())
+	}
+
+	if rw := postAdmin(lb, "/admin/drain", `{"url": "`+slow.Address()+`"}`); rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 without wait, got %d", rw.Code)
+	}
+	for _, path := range []string{"/admin/drain", "/admin/undrain"} {
+		if rw := postAdmin(lb, path, `{"url": "http://unknown.com"}`); rw.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 from %s for an unknown server, got %d", path, rw.Code)
+		}
+	}
+}
+
+func TestDrainFade_DecliningShare(t *testing.T) {
+	fading := &MockServer{addr: "http://fading.com", isAlive: true}
+	other := &MockServer{addr: "http://other.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{fading, other})
+	start := time.Now()
+	now := start
+	lb.now = func() time.Time { return now }
+
+	done, err := lb.DrainFade(fading.Address(), 100*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := lb.Stats()[0]; stats.Draining || stats.Fading == nil || stats.Fading.Weight != 1 {
+		t.Fatalf("Expected the server to be fading and not draining, got %+v", stats)
+	}
+
+	// share selects 200 times at each point of the fade, returning the part
+	// of the selections that went to the fading server.
+	share := func() float64 {
+		n := 0
+		for i := 0; i < 200; i++ {
+			server, err := lb.getNextAvailableServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server == fading {
+				n++
+			}
+			lb.finishRequest(server, http.StatusOK, "", 0, 0, 0)
+		}
+		return float64(n) / 200
+	}
+	// With equal weights, a server with the part f of its weight left gets
+	// f/(1+f) of the selections.
+	for _, at := range []time.Duration{0, 25, 50, 75, 99} {
+		now = start.Add(at * time.Second)
+		left := 1 - float64(at)/100
+		want := left / (1 + left)
+		if got := share(); math.Abs(got-want) > 0.03 {
+			t.Errorf("Expected a share of %.2f at %ds into the fade, got %.2f", want, at, got)
+		}
+	}
+	if stats := lb.Stats()[0]; stats.Fading == nil || *stats.EffectiveWeight > 0.02 {
+		t.Errorf("Expected the effective weight near zero at the end of the fade, got %+v", stats)
+	}
+
+	// After the fade the drain waits for the requests still in flight.
+	lb.mu.Lock()
+	lb.countersFor(fading.Address()).inFlight++
+	lb.mu.Unlock()
+	now = now.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		if server, _ := lb.getNextAvailableServer(); server == fading {
+			t.Fatal("Expected no selections after the fade")
+		}
+	}
+	if stats := lb.Stats()[0]; !stats.Draining || stats.Fading != nil {
+		t.Errorf("Expected the server to be draining after the fade, got %+v", stats)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected the drain to wait for the request in flight")
+	default:
+	}
+	lb.finishRequest(fading, http.StatusOK, "", 0, 0, 0)
+	select {
+	case <-done:
+	default:
+		t.Error("Expected the drain to complete once nothing was in flight")
+	}
+}
+
+func TestDrainFade_DownServerDrainsAtOnce(t *testing.T) {
+	fading := &MockServer{addr: "http://fading.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{fading, &MockServer{addr: "http://other.com", isAlive: true}})
+	done, err := lb.DrainFade(fading.Address(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.observeHealth(fading)
+
+	fading.isAlive = false
+	lb.observeHealth(fading)
+	fading.isAlive = true
+	if stats := lb.Stats()[0]; !stats.Draining || stats.Fading != nil {
+		t.Errorf("Expected a server going down to leave the fade, got %+v", stats)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("Expected the drain to complete with nothing in flight")
+	}
+}
+
+func TestDrainFade_Admin(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server, &MockServer{addr: "http://server2.com", isAlive: true}})
+	for _, body := range []string{
+		`{"url": "http://server1.com", "mode": "fade"}`,
+		`{"url": "http://server1.com", "fade": "1m"}`,
+		`{"url": "http://server1.com", "mode": "slow", "fade": "1m"}`,
+	} {
+		if rw := postAdmin(lb, "/admin/drain", body); rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rw.Code)
+		}
+	}
+
+	rw := postAdmin(lb, "/admin/drain", `{"url": "http://server1.com", "mode": "fade", "fade": "1m"}`)
+	if rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 while fading, got %d %s", rw.Code, rw.Body.String())
+	}
+	if stats := lb.Stats()[0]; stats.Fading == nil || stats.Draining {
+		t.Errorf("Expected the server to be fading, got %+v", stats)
+	}
+
+	// An immediate drain ends the fade.
+	if rw := postAdmin(lb, "/admin/drain", `{"url": "http://server1.com"}`); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 from an immediate drain, got %d", rw.Code)
+	}
+	if stats := lb.Stats()[0]; stats.Fading != nil || !stats.Draining {
+		t.Errorf("Expected the server to be drained, got %+v", stats)
+	}
+}
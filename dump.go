@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// withConfigHash records the hash of the configuration file the load
+// balancer was built from so dumps can identify the active config.
+func withConfigHash(hash string) Option {
+	return func(lb *LoadBalancer) {
+		lb.configHash = hash
+	}
+}
+
+// Dump writes a human-readable snapshot of the load balancer's state to w.
+// The snapshot is taken with the same locking as Stats, so the lock is only
+// held while copying counters and never while writing.
+func (lb *LoadBalancer) Dump(w io.Writer) error {
+	stats := lb.Stats()
+
+	configHash := lb.configHash
+	if configHash == "" {
+		configHash = "(built-in defaults)"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "load balancer state at %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "config sha256: %s\n", configHash)
+	fmt.Fprintf(&b, "strategy: %s\n", strategyNames(lb.strategies))
+	fmt.Fprintf(&b, "goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "pool default: %d servers\n", len(stats))
+
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tADDRESS\tALIVE\tWEIGHT\tIN-FLIGHT\tREQUESTS\tBYTES-IN\tBYTES-OUT\tLABELS\tSTATE\tLAST-PROBE")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			s.Name, s.Address, formatAlive(s), s.Weight, s.InFlight, s.Requests, s.BytesIn, s.BytesOut, formatLabels(s.Labels), formatState(s), formatProbe(s))
+	}
+	tw.Flush()
+
+	workers := lb.Workers()
+	fmt.Fprintf(&b, "workers: %d\n", len(workers))
+	if len(workers) > 0 {
+		tw = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  NAME\tSTATE\tSTARTED\tLAST-ACTIVITY\tRESTARTS\tLAST-PANIC")
+		for _, worker := range workers {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t%s\n", worker.Name, worker.State, worker.Started.Format(time.RFC3339),
+				formatActivity(worker.LastActivity), worker.Restarts, formatPanic(worker.LastPanic))
+		}
+		tw.Flush()
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// formatAlive renders the liveness of a server, flagging a health override.
+func formatAlive(s ServerStats) string {
+	if s.HealthOverride == nil {
+		return fmt.Sprint(s.Alive)
+	}
+
+	return fmt.Sprintf("%t(pinned-%s)", s.Alive, s.HealthOverride.State)
+}
+
+// formatState renders what keeps a server out of selection or at part of
+// its weight: warm-up, maintenance, drains, backoff, ejection, flapping
+// and slow starts.
+func formatState(s ServerStats) string {
+	var states []string
+	if s.Warmup != nil {
+		states = append(states, "warmup-"+s.Warmup.State)
+	}
+	if s.Pending != nil {
+		states = append(states, "pending")
+	}
+	if s.MaintenanceUntil != nil {
+		states = append(states, "maintenance(until="+s.MaintenanceUntil.Format(time.RFC3339)+")")
+	}
+	if s.SlowStart != nil {
+		states = append(states, fmt.Sprintf("slow-start(weight=%.2f,until=%s)", s.SlowStart.Weight, s.SlowStart.Until.Format(time.RFC3339)))
+	}
+	if s.Draining {
+		states = append(states, "draining")
+	}
+	if s.Fading != nil {
+		states = append(states, fmt.Sprintf("fading(weight=%.2f,until=%s)", s.Fading.Weight, s.Fading.Until.Format(time.RFC3339)))
+	}
+	if s.BackoffUntil != nil {
+		states = append(states, "backoff(until="+s.BackoffUntil.Format(time.RFC3339)+")")
+	}
+	if s.EjectedUntil != nil {
+		states = append(states, "ejected(until="+s.EjectedUntil.Format(time.RFC3339)+")")
+	}
+	if s.Flapping {
+		states = append(states, "flapping")
+	}
+	if len(states) == 0 {
+		return "-"
+	}
+
+	return strings.Join(states, ",")
+}
+
+// formatActivity renders when a worker last did work.
+func formatActivity(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// formatPanic renders the first line of the last panic of a worker.
+func formatPanic(last string) string {
+	if last == "" {
+		return "-"
+	}
+	line, _, _ := strings.Cut(last, "\n")
+
+	return line
+}
+
+// formatLabels renders labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// formatProbe renders the last probe result of a server.
+func formatProbe(s ServerStats) string {
+	switch {
+	case s.LastProbe == nil:
+		return "-"
+	case s.LastProbeError != "":
+		return fmt.Sprintf("%s failed: %s", s.LastProbe.Format(time.RFC3339), s.LastProbeError)
+	default:
+		return s.LastProbe.Format(time.RFC3339) + " ok"
+	}
+}
+
+func (lb *LoadBalancer) handleDump(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	lb.Dump(rw)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDump_ReflectsPoolState(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true, labels: map[string]string{"version": "v2", "tier": "premium"}}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: false}
+	lb := newTestLoadBalancer(t, []Server{server1, server2}, withConfigHash("abc123"))
+
+	// One completed request and one still in flight on server1
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if _, err := lb.getNextAvailableServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := lb.Dump(&buf); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	dump := buf.String()
+
+	for _, want := range []string{
+		"config sha256: abc123",
+		"strategy: round-robin",
+		"pool default: 2 servers",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Expected dump to contain %q, got:\n%s", want, dump)
+		}
+	}
+
+	rows := []*regexp.Regexp{
+		regexp.MustCompile(`http://server1\.com\s+true\s+1\s+1\s+2\s+0\s+\d+\s+tier=premium,version=v2`),
+		regexp.MustCompile(`http://server2\.com\s+false\s+1\s+0\s+0\s+0\s+0\s+-`),
+	}
+	for _, row := range rows {
+		if !row.MatchString(dump) {
+			t.Errorf("Expected dump to match %q, got:\n%s", row, dump)
+		}
+	}
+	if !regexp.MustCompile(`goroutines: \d+`).MatchString(dump) {
+		t.Errorf("Expected dump to report the goroutine count, got:\n%s", dump)
+	}
+}
+
+func TestDump_AdminEndpoint(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/dump", nil))
+	if !strings.Contains(rw.Body.String(), "http://server1.com") {
+		t.Errorf("Expected dump endpoint to list server1, got:\n%s", rw.Body.String())
+	}
+	if !strings.Contains(rw.Body.String(), "(built-in defaults)") {
+		t.Errorf("Expected dump to note the built-in config, got:\n%s", rw.Body.String())
+	}
+}
+
+func TestDump_ServerStateAndWorkers(t *testing.T) {
+	maintained := &simpleServer{addr: "http://maintained.com", maintenance: []MaintenanceWindow{{Start: 11 * time.Hour, Duration: 2 * time.Hour}}}
+	maintained.alive.Store(true)
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://drained.com", isAlive: true},
+		&MockServer{addr: "http://fading.com", isAlive: true},
+		&MockServer{addr: "http://backoff.com", isAlive: true},
+		maintained,
+	})
+	now := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+	lb.Drain("http://drained.com")
+	lb.DrainFade("http://fading.com", time.Minute)
+	defer lb.Undrain("http://fading.com")
+	lb.mu.Lock()
+	c := lb.countersFor("http://backoff.com")
+	c.backoffUntil, c.ejectedUntil = now.Add(time.Minute), now.Add(2*time.Minute)
+	lb.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb.Go(ctx, "ticker", func(ctx context.Context) {
+		markActive(ctx)
+		<-ctx.Done()
+	})
+	waitFor(t, "the worker to run", func() bool {
+		workers := lb.Workers()
+		return len(workers) == 1 && !workers[0].LastActivity.IsZero()
+	})
+
+	var buf bytes.Buffer
+	if err := lb.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	for _, want := range []*regexp.Regexp{
+		regexp.MustCompile(`http://drained\.com .* draining\s`),
+		regexp.MustCompile(`http://fading\.com .* fading\(weight=1\.00,until=2026-03-09T12:01:00Z\)\s`),
+		regexp.MustCompile(`http://backoff\.com .* backoff\(until=2026-03-09T12:01:00Z\),ejected\(until=2026-03-09T12:02:00Z\)\s`),
+		regexp.MustCompile(`http://maintained\.com .* maintenance\(until=2026-03-09T13:00:00Z\)\s`),
+		regexp.MustCompile(`workers: 1\n\s+NAME\s+STATE\s+STARTED\s+LAST-ACTIVITY\s+RESTARTS\s+LAST-PANIC\n\s+ticker\s+running\s+\S+\s+\S+\s+0\s+-\n`),
+	} {
+		if !want.MatchString(dump) {
+			t.Errorf("Expected dump to match %q, got:\n%s", want, dump)
+		}
+	}
+}
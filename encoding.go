@@ -0,0 +1,244 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EncodingMode sets the Accept-Encoding sent to a server.
+type EncodingMode string
+
+const (
+	// EncodingPass forwards the client's Accept-Encoding. It is the
+	// default.
+	EncodingPass EncodingMode = "pass"
+
+	// EncodingIdentity asks the server for uncompressed responses.
+	EncodingIdentity EncodingMode = "identity"
+
+	// EncodingForce asks the server for the encodings listed, whatever the
+	// client accepts.
+	EncodingForce EncodingMode = "force"
+)
+
+// decodableEncodings are the content codings the load balancer decodes.
+var decodableEncodings = []string{"gzip", "deflate"}
+
+// UpstreamEncoding controls the content codings negotiated with a server.
+// Responses in a coding the load balancer decodes, gzip or deflate, are
+// decoded when the client does not accept that coding, or when the load
+// balancer needs the plain body to validate it. Decoded responses lose
+// their Content-Length and their ETag turns weak. With EncodingIdentity or
+// EncodingForce every client's request reaches the server alike, so the
+// response only varies on Accept-Encoding through the load balancer's own
+// decoding: cached responses are stored decoded, once for every client,
+// and Vary no longer lists Accept-Encoding for them. Encodings are those
+// forced, which must be decodable.
+type UpstreamEncoding struct {
+	Mode      EncodingMode
+	Encodings []string
+}
+
+// WithUpstreamEncoding sets the content codings negotiated with the server.
+func WithUpstreamEncoding(e UpstreamEncoding) ServerOption {
+	return func(s *simpleServer) {
+		s.encoding = &e
+	}
+}
+
+// validate reports settings that cannot be applied.
+func (e UpstreamEncoding) validate() error {
+	switch e.Mode {
+	case "", EncodingPass, EncodingIdentity:
+		if len(e.Encodings) > 0 {
+			return fmt.Errorf("encodings are only forced with mode %q", EncodingForce)
+		}
+	case EncodingForce:
+		if len(e.Encodings) == 0 {
+			return fmt.Errorf("mode %q requires encodings", EncodingForce)
+		}
+		for _, coding := range e.Encodings {
+			if !slices.Contains(decodableEncodings, coding) {
+				return fmt.Errorf("cannot force encoding %q, only %s", coding, strings.Join(decodableEncodings, " and "))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", e.Mode)
+	}
+
+	return nil
+}
+
+// normalizes reports whether the server receives the same Accept-Encoding
+// whatever the client sent.
+func (e *UpstreamEncoding) normalizes() bool {
+	return e != nil && (e.Mode == EncodingIdentity || e.Mode == EncodingForce)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding values of a request
+// accept coding: listed, or covered by *, with a non-zero q.
+func acceptsEncoding(values []string, coding string) bool {
+	accepted := false
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "x-"+coding {
+				name = coding
+			}
+			if name != coding && name != "*" {
+				continue
+			}
+			q := 1.0
+			if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+			if name == coding {
+				return q > 0
+			}
+			accepted = q > 0
+		}
+	}
+
+	return accepted
+}
+
+// encodingTransport negotiates the content codings of requests to a
+// server and decodes its responses as UpstreamEncoding describes.
+type encodingTransport struct {
+	http.RoundTripper
+	server *simpleServer
+}
+
+func (t encodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := t.server.encoding
+	accepted := req.Header.Values("Accept-Encoding")
+	if e.normalizes() {
+		req = req.Clone(req.Context())
+		if e.Mode == EncodingIdentity {
+			req.Header.Set("Accept-Encoding", "identity")
+		} else {
+			req.Header.Set("Accept-Encoding", strings.Join(e.Encodings, ", "))
+		}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if coding == "x-gzip" {
+		coding = "gzip"
+	}
+	if coding == "" && e.normalizes() {
+		// Every client gets this response alike
+		removeVary(resp.Header, "Accept-Encoding")
+		return resp, nil
+	}
+	if !slices.Contains(decodableEncodings, coding) {
+		return resp, nil
+	}
+	a := attemptFromContext(req.Context())
+	plain := a != nil && (a.plainBody || a.caching && e.normalizes())
+	if plain || !acceptsEncoding(accepted, coding) {
+		decodeResponse(resp, coding)
+		if plain && e.normalizes() {
+			removeVary(resp.Header, "Accept-Encoding")
+			return resp, nil
+		}
+	}
+	if e.normalizes() || resp.Header.Get("Content-Encoding") == "" {
+		addVary(resp.Header, "Accept-Encoding")
+	}
+
+	return resp, nil
+}
+
+// decodeResponse decodes the body of resp from coding, adjusting its
+// headers. Responses without a body only have their headers adjusted.
+func decodeResponse(resp *http.Response, coding string) {
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent ||
+		resp.Request.Method == http.MethodHead {
+		return
+	}
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	resp.Body = &decodingBody{body: resp.Body, coding: coding}
+}
+
+// decodingBody decodes a response body. The decoder is set up on the first
+// read, so that waiting for the first bytes happens while the body is read.
+type decodingBody struct {
+	body    io.ReadCloser
+	coding  string
+	decoder io.ReadCloser
+	err     error
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	if b.decoder == nil && b.err == nil {
+		switch b.coding {
+		case "gzip":
+			b.decoder, b.err = gzip.NewReader(b.body)
+		case "deflate":
+			b.decoder, b.err = zlib.NewReader(b.body)
+		}
+		if b.err != nil {
+			b.err = fmt.Errorf("decode %s response: %w", b.coding, b.err)
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	return b.decoder.Read(p)
+}
+
+func (b *decodingBody) Close() error {
+	if b.decoder != nil {
+		b.decoder.Close()
+	}
+
+	return b.body.Close()
+}
+
+// addVary adds name to the Vary header unless it is listed already.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// removeVary removes name from the Vary header.
+func removeVary(header http.Header, name string) {
+	var kept []string
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed != "" && !strings.EqualFold(listed, name) {
+				kept = append(kept, listed)
+			}
+		}
+	}
+	header.Del("Vary")
+	if len(kept) > 0 {
+		header.Set("Vary", strings.Join(kept, ", "))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newEncodingBackend returns a server answering with body, gzipped when
+// the request accepts gzip or always is set, and the Accept-Encoding it last
+// saw.
+func newEncodingBackend(t *testing.T, body string, always bool, opts ...ServerOption) (Server, func() string, *atomic.Int64) {
+	var mu sync.Mutex
+	var seen string
+	var calls atomic.Int64
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		mu.Lock()
+		seen = req.Header.Get("Accept-Encoding")
+		mu.Unlock()
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "application/json")
+		if !always && !acceptsEncoding(req.Header.Values("Accept-Encoding"), "gzip") {
+			io.WriteString(rw, body)
+			return
+		}
+		rw.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(rw)
+		io.WriteString(zw, body)
+		zw.Close()
+	}, opts...)
+	return server, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen
+	}, &calls
+}
+
+// responseBody returns the body of rw, gunzipped if it is gzip encoded.
+func responseBody(t *testing.T, rw *httptest.ResponseRecorder) string {
+	t.Helper()
+	if rw.Header().Get("Content-Encoding") != "gzip" {
+		return rw.Body.String()
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(rw.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestUpstreamEncoding_Modes(t *testing.T) {
+	const body = `{"hello":"world"}`
+	for _, tt := range []struct {
+		name     string
+		encoding *UpstreamEncoding
+		always   bool
+		accept   string
+		upstream string
+		encoded  bool
+		vary     bool
+	}{
+		{"pass gzip", nil, false, "gzip", "gzip", true, true},
+		{"pass none", nil, false, "", "gzip", false, true}, // the transport decodes
+		{"pass br", nil, false, "br", "br", false, true},
+		{"pass br, gzipped anyway", nil, true, "br", "br", false, true},
+		{"pass gzip refused", nil, true, "gzip;q=0, br", "gzip;q=0, br", false, true},
+		{"identity", &UpstreamEncoding{Mode: EncodingIdentity}, false, "gzip", "identity", false, false},
+		{"identity, gzipped anyway", &UpstreamEncoding{Mode: EncodingIdentity}, true, "br", "identity", false, true},
+		{"force gzip", &UpstreamEncoding{Mode: EncodingForce, Encodings: []string{"gzip"}}, false, "gzip, br", "gzip", true, true},
+		{"force none", &UpstreamEncoding{Mode: EncodingForce, Encodings: []string{"gzip"}}, false, "", "gzip", false, true},
+		{"force br", &UpstreamEncoding{Mode: EncodingForce, Encodings: []string{"gzip", "deflate"}}, false, "br", "gzip, deflate", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []ServerOption
+			if tt.encoding != nil {
+				opts = append(opts, WithUpstreamEncoding(*tt.encoding))
+			}
+			server, seen, _ := newEncodingBackend(t, body, tt.always, opts...)
+			lb := newTestLoadBalancer(t, []Server{server})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, req)
+			if got := seen(); got != tt.upstream {
+				t.Errorf("Expected the server to see Accept-Encoding %q, got %q", tt.upstream, got)
+			}
+			if encoded := rw.Header().Get("Content-Encoding") == "gzip"; encoded != tt.encoded {
+				t.Errorf("Expected encoded %t, got Content-Encoding %q", tt.encoded, rw.Header().Get("Content-Encoding"))
+			}
+			if got := responseBody(t, rw); got != body {
+				t.Errorf("Expected %q, got %q", body, got)
+			}
+			if vary := strings.Contains(rw.Header().Get("Vary"), "Accept-Encoding"); vary != tt.vary {
+				t.Errorf("Expected vary on Accept-Encoding %t, got Vary %q", tt.vary, rw.Header().Get("Vary"))
+			}
+			if !tt.encoded && tt.always && rw.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("Expected a decoded response to have a weak ETag, got %q", rw.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestUpstreamEncoding_ValidationDecodes(t *testing.T) {
+	server, _, _ := newEncodingBackend(t, `{"ok":true}`, false)
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithRoutes(Route{PathPrefix: "/", Validate: &ResponseValidation{JSON: true}}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Encoding") != "" || rw.Body.String() != `{"ok":true}` {
+		t.Errorf("Expected the validated response decoded, got %d %q %q", rw.Code, rw.Header().Get("Content-Encoding"), rw.Body.String())
+	}
+}
+
+func TestUpstreamEncoding_CacheDeduplication(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		encoding *UpstreamEncoding
+		calls    int64
+	}{
+		{"pass", nil, 6}, // every variant replaces the last one stored
+		{"force", &UpstreamEncoding{Mode: EncodingForce, Encodings: []string{"gzip"}}, 1},
+		{"identity", &UpstreamEncoding{Mode: EncodingIdentity}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []ServerOption
+			if tt.encoding != nil {
+				opts = append(opts, WithUpstreamEncoding(*tt.encoding))
+			}
+			server, _, calls := newEncodingBackend(t, "cached body", false, opts...)
+			lb := newTestLoadBalancer(t, []Server{server}, WithResponseCache(ResponseCache{}))
+
+			for range 2 {
+				for _, accept := range []string{"gzip", "", "br"} {
+					rw := cachedGet(lb, "Accept-Encoding", accept)
+					if got := responseBody(t, rw); rw.Code != http.StatusOK || got != "cached body" {
+						t.Fatalf("Expected the response for %q, got %d %q", accept, rw.Code, got)
+					}
+				}
+			}
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("Expected %d requests to the server, got %d", tt.calls, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+var (
+	// ErrPoolEmpty is returned when a selection is attempted against a load
+	// balancer that has no servers registered at all.
+	ErrPoolEmpty = errors.New("server pool is empty")
+
+	// ErrNoAvailableServers is returned when servers are registered but none of
+	// them is currently alive.
+	ErrNoAvailableServers = errors.New("no available servers")
+
+	// ErrNoMatchingServers is returned when servers are alive but none of them
+	// satisfies the label selector of the matched route.
+	ErrNoMatchingServers = errors.New("no servers match selector")
+
+	// ErrStrategyPass is returned by a Strategy that cannot decide for a
+	// request, handing it to the next strategy in the chain. It never reaches
+	// clients.
+	ErrStrategyPass = errors.New("strategy passed")
+
+	// ErrServersSaturated is returned when eligible servers are alive but all
+	// of them are at their concurrency limit.
+	ErrServersSaturated = errors.New("all servers are at capacity")
+
+	// ErrQueueFull is returned when a request is shed because the admission
+	// queue is full.
+	ErrQueueFull = errors.New("admission queue is full")
+
+	// ErrQueueTimeout is returned when a request waited the maximum queue
+	// time without a server becoming available.
+	ErrQueueTimeout = errors.New("timed out waiting in admission queue")
+
+	// ErrClientClosed is returned when the client went away before its request
+	// was dispatched to a server.
+	ErrClientClosed = errors.New("client closed request")
+
+	// ErrBodyTooLarge is returned when a request body exceeds what the body
+	// buffering policy of its route allows.
+	ErrBodyTooLarge = errors.New("request body too large")
+
+	// ErrHeadersTooLarge is returned when request headers exceed the header
+	// limits of their route.
+	ErrHeadersTooLarge = errors.New("request headers too large")
+
+	// ErrFirstByteTimeout is returned when a server did not send the first
+	// byte of its response within the first byte timeout.
+	ErrFirstByteTimeout = errors.New("first byte timeout")
+
+	// ErrMethodNotAllowed is returned when the method policy of a route
+	// rejects the method of a request.
+	ErrMethodNotAllowed = errors.New("method not allowed")
+
+	// ErrServerNotFound is returned when an operation references a server
+	// address that is not part of the pool.
+	ErrServerNotFound = errors.New("server not found")
+
+	// ErrServerExists is returned when a server is added to a pool that already
+	// contains a server with the same address.
+	ErrServerExists = errors.New("server already exists")
+
+	// ErrInvalidWeight is returned when a server has a negative weight.
+	ErrInvalidWeight = errors.New("server weight must not be negative")
+
+	// ErrInvalidAddress is returned when a server address cannot be used as a
+	// proxy target.
+	ErrInvalidAddress = errors.New("invalid server address")
+
+	// ErrReusePortUnsupported is returned when sharded listeners are
+	// requested on a platform without SO_REUSEPORT load balancing.
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT listeners are not supported on this platform")
+
+	// ErrHTTP3Unsupported is returned when an HTTP/3 listener is requested
+	// from a binary built without the http3 tag.
+	ErrHTTP3Unsupported = errors.New("HTTP/3 is not supported by this build, rebuild with -tags http3")
+
+	// ErrRedirectLoop is returned when following a redirect would revisit
+	// a URL of the same redirect chain.
+	ErrRedirectLoop = errors.New("redirect loop")
+
+	// ErrTooManyRedirects is returned when a request needs more redirects
+	// than its redirect policy follows.
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// ErrNotClientHello is returned when a passthrough connection does not
+	// start with a TLS ClientHello.
+	ErrNotClientHello = errors.New("connection did not start with a TLS ClientHello")
+
+	// ErrNoSNIRoute is returned when a passthrough connection matches no SNI
+	// rule and unmatched connections are closed.
+	ErrNoSNIRoute = errors.New("no SNI rule matches")
+
+	// ErrSigning is returned when a signer fails to sign a request to a
+	// server.
+	ErrSigning = errors.New("could not sign request")
+
+	// ErrDeadlineExceeded is returned when the deadline of a request passes
+	// before it could be sent to a server.
+	ErrDeadlineExceeded = errors.New("request deadline exceeded")
+
+	// ErrInvalidPath is returned when path normalization rejects the path
+	// of a request.
+	ErrInvalidPath = errors.New("invalid request path")
+
+	// ErrUnauthorized is returned when a request lacks a known API key.
+	ErrUnauthorized = errors.New("missing or unknown API key")
+
+	// ErrRateLimited is returned when a request exceeds the rate limit of
+	// its API key.
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrTenantSaturated is returned when a tenant has the maximum number of
+	// requests in flight.
+	ErrTenantSaturated = errors.New("tenant has too many requests in flight")
+
+	// ErrUnknownTenant is returned when a request belongs to no configured
+	// tenant and there is no default tenant.
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	// ErrInvalidResponse is returned when a server's response fails the
+	// response validation of its route.
+	ErrInvalidResponse = errors.New("invalid upstream response")
+
+	// ErrJournalFull is returned when a route's request journal is at its
+	// entry or size limit.
+	ErrJournalFull = errors.New("request journal is full")
+
+	// ErrTransform is returned when the body transformation of a route
+	// fails for a request.
+	ErrTransform = errors.New("could not transform request body")
+
+	// ErrVersionNotFound is returned when pinning a configuration version
+	// that is not among the versions kept.
+	ErrVersionNotFound = errors.New("configuration version not found")
+
+	// ErrAuthUnavailable is returned when the auth service of a route
+	// fails to answer for a request and the route fails closed.
+	ErrAuthUnavailable = errors.New("auth service unavailable")
+
+	// ErrCacheBackoff is returned when requests for a cached resource whose
+	// responses keep failing are held back from servers and no stale
+	// response may be served in their place.
+	ErrCacheBackoff = errors.New("upstream failing, holding requests back")
+
+	// ErrServersAttempted is returned when a retry finds every available
+	// server attempted for its request and its retry policy does not
+	// repeat attempts.
+	ErrServersAttempted = errors.New("every available server was attempted")
+
+	// ErrShuttingDown is returned for upgrade requests arriving once the
+	// load balancer began shutting down.
+	ErrShuttingDown = errors.New("shutting down, not accepting upgrades")
+)
+
+// statusClientClosedRequest is the non-standard status logged for requests
+// abandoned by the client before a response was sent.
+const statusClientClosedRequest = 499
+
+// Phase identifies the stage of an upstream exchange in which a failure
+// occurred.
+type Phase string
+
+const (
+	// PhaseDial covers establishing the connection to the upstream server.
+	PhaseDial Phase = "dial"
+
+	// PhaseRoundTrip covers writing the request and reading the response
+	// headers once a connection is available.
+	PhaseRoundTrip Phase = "round-trip"
+)
+
+// ErrorClass categorizes upstream failures for retry policies, logs and
+// metrics.
+type ErrorClass string
+
+const (
+	// ClassConnectRefused is a connection actively refused by the server.
+	ClassConnectRefused ErrorClass = "connect-refused"
+
+	// ClassConnectTimeout is a connection attempt that timed out.
+	ClassConnectTimeout ErrorClass = "connect-timeout"
+
+	// ClassConnectError is any other failure to connect, such as a DNS
+	// lookup failure or an unreachable network.
+	ClassConnectError ErrorClass = "connect-error"
+
+	// ClassTLS is a failed TLS handshake or certificate verification.
+	ClassTLS ErrorClass = "tls"
+
+	// ClassResponseHeaderTimeout is a server that accepted the request but
+	// did not send response headers in time.
+	ClassResponseHeaderTimeout ErrorClass = "response-header-timeout"
+
+	// ClassFirstByteTimeout is a server that did not send the first byte of
+	// its response, headers or body, within the first byte timeout.
+	ClassFirstByteTimeout ErrorClass = "first-byte-timeout"
+
+	// ClassBodyRead is a failure reading the response body after the headers
+	// were received. It is never retried.
+	ClassBodyRead ErrorClass = "body-read"
+
+	// ClassStatus502, ClassStatus503 and ClassStatus504 are responses the
+	// server itself answered with the corresponding status.
+	ClassStatus502 ErrorClass = "status-502"
+	ClassStatus503 ErrorClass = "status-503"
+	ClassStatus504 ErrorClass = "status-504"
+
+	// ClassInvalidResponse is a response rejected by the response
+	// validation of its route.
+	ClassInvalidResponse ErrorClass = "invalid-response"
+
+	// ClassOther is any other failure while exchanging the request.
+	ClassOther ErrorClass = "other"
+)
+
+// errorClasses lists every known class, for validating configuration.
+var errorClasses = []ErrorClass{
+	ClassConnectRefused, ClassConnectTimeout, ClassConnectError, ClassTLS,
+	ClassResponseHeaderTimeout, ClassFirstByteTimeout, ClassBodyRead,
+	ClassStatus502, ClassStatus503, ClassStatus504, ClassInvalidResponse, ClassOther,
+}
+
+// classifyTransportError returns the class of an error returned by the
+// transport while proxying a request.
+func classifyTransportError(err error) ErrorClass {
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrInvalidResponse):
+		return ClassInvalidResponse
+	case errors.Is(err, ErrFirstByteTimeout):
+		return ClassFirstByteTimeout
+	case errors.As(err, new(tls.RecordHeaderError)), errors.As(err, new(tls.AlertError)),
+		errors.As(err, new(*tls.CertificateVerificationError)),
+		errors.As(err, new(x509.UnknownAuthorityError)), errors.As(err, new(x509.HostnameError)),
+		errors.As(err, new(x509.CertificateInvalidError)):
+		return ClassTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		switch {
+		case opErr.Timeout():
+			return ClassConnectTimeout
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return ClassConnectRefused
+		default:
+			return ClassConnectError
+		}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ClassResponseHeaderTimeout
+	default:
+		return ClassOther
+	}
+}
+
+// classifyStatus returns the class of a response status the server answered
+// with, or "" if the status is not a failure.
+func classifyStatus(status int) ErrorClass {
+	switch status {
+	case http.StatusBadGateway:
+		return ClassStatus502
+	case http.StatusServiceUnavailable:
+		return ClassStatus503
+	case http.StatusGatewayTimeout:
+		return ClassStatus504
+	default:
+		return ""
+	}
+}
+
+// UpstreamError describes a failure while proxying a request to a specific
+// server. It wraps the underlying transport error so errors.Is and errors.As
+// keep working through the chain.
+type UpstreamError struct {
+	Server string
+	Phase  Phase
+	Class  ErrorClass
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s failed during %s (%s): %v", e.Server, e.Phase, e.Class, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// newUpstreamError wraps a transport error returned while proxying to server,
+// classifying it into the phase it happened in.
+func newUpstreamError(server string, err error) *UpstreamError {
+	phase := PhaseRoundTrip
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		phase = PhaseDial
+	}
+
+	return &UpstreamError{Server: server, Phase: phase, Class: classifyTransportError(err), Err: err}
+}
+
+// statusForError maps an error returned by the load balancer to the HTTP
+// status code reported to the client. It is the single place where the error
+// taxonomy is translated into responses.
+func statusForError(err error) int {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrPoolEmpty), errors.Is(err, ErrNoAvailableServers),
+		errors.Is(err, ErrNoMatchingServers), errors.Is(err, ErrServersSaturated),
+		errors.Is(err, ErrQueueFull), errors.Is(err, ErrQueueTimeout), errors.Is(err, ErrJournalFull),
+		errors.Is(err, ErrAuthUnavailable), errors.Is(err, ErrCacheBackoff), errors.Is(err, ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrClientClosed):
+		return statusClientClosedRequest
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrHeadersTooLarge):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrUnknownTenant):
+		return http.StatusForbidden
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrTenantSaturated):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrServerNotFound), errors.Is(err, ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrServerExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidAddress), errors.Is(err, ErrInvalidWeight), errors.Is(err, ErrInvalidPath),
+		errors.Is(err, ErrTransform), errors.Is(err, errors.ErrUnsupported):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrDeadlineExceeded), errors.Is(err, ErrFirstByteTimeout),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.As(err, new(*UpstreamError)),
+		errors.Is(err, ErrRedirectLoop), errors.Is(err, ErrTooManyRedirects), errors.Is(err, ErrServersAttempted):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError reports err to the client using the status code derived from
+// the error taxonomy.
+func writeError(rw http.ResponseWriter, err error) {
+	// Upstream errors name servers, which clients need not know.
+	if grpcResponse(rw) && !errors.As(err, new(*UpstreamError)) {
+		writeGRPCStatus(rw, statusForError(err), err.Error())
+		return
+	}
+	writeStatus(rw, statusForError(err))
+}
+
+// writeStatus answers rw with the error page for status, or a plain message
+// if there is none or it fails to render. gRPC requests are answered with
+// the matching grpc-status instead.
+func writeStatus(rw http.ResponseWriter, status int) {
+	if grpcResponse(rw) {
+		writeGRPCStatus(rw, status, http.StatusText(status))
+		return
+	}
+	if p := pageRequestOf(rw); p != nil && p.write(rw, status) {
+		return
+	}
+	http.Error(rw, http.StatusText(status), status)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrors_EmptyPool(t *testing.T) {
+	lb := newTestLoadBalancer(t, nil, WithAllowEmpty())
+
+	_, err := lb.getNextAvailableServer()
+	if !errors.Is(err, ErrPoolEmpty) {
+		t.Errorf("Expected ErrPoolEmpty, got %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", rw.Code)
+	}
+}
+
+func TestErrors_NoAvailableServers(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: false}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: false}
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+
+	_, err := lb.getNextAvailableServer()
+	if !errors.Is(err, ErrNoAvailableServers) {
+		t.Errorf("Expected ErrNoAvailableServers, got %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", rw.Code)
+	}
+}
+
+func TestErrors_AddRemoveServer(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1})
+
+	err := lb.AddServer(&MockServer{addr: "http://server1.com", isAlive: true})
+	if !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected ErrServerExists, got %v", err)
+	}
+
+	err = lb.RemoveServer("http://unknown.com")
+	if !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("Expected ErrServerNotFound, got %v", err)
+	}
+
+	if err := lb.RemoveServer("http://server1.com"); err != nil {
+		t.Errorf("Expected server1 to be removed, got %v", err)
+	}
+	_, err = lb.getNextAvailableServer()
+	if !errors.Is(err, ErrPoolEmpty) {
+		t.Errorf("Expected ErrPoolEmpty after removal, got %v", err)
+	}
+}
+
+func TestErrors_InvalidAddress(t *testing.T) {
+	for _, addr := range []string{"", "server1.com", "://bad"} {
+		if _, err := newSimpleServer(addr); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("Expected ErrInvalidAddress for %q, got %v", addr, err)
+		}
+	}
+}
+
+func TestErrors_UpstreamDialFailure(t *testing.T) {
+	// Reserve an address and close it so dialing it is refused
+	backend := httptest.NewServer(http.NotFoundHandler())
+	addr := backend.URL
+	backend.Close()
+
+	server, err := newSimpleServer(addr)
+	if err != nil {
+		t.Fatalf("Expected server to be created, got %v", err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", rw.Code)
+	}
+}
+
+func TestErrors_UpstreamErrorWrapping(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := error(newUpstreamError("http://server1.com", cause))
+	wrapped := errors.Join(errors.New("retry exhausted"), err)
+
+	var upstreamErr *UpstreamError
+	if !errors.As(wrapped, &upstreamErr) {
+		t.Fatalf("Expected errors.As to find UpstreamError in %v", wrapped)
+	}
+	if upstreamErr.Server != "http://server1.com" || upstreamErr.Phase != PhaseRoundTrip {
+		t.Errorf("Unexpected upstream error fields: %+v", upstreamErr)
+	}
+	if !errors.Is(wrapped, cause) {
+		t.Errorf("Expected errors.Is to match the underlying cause")
+	}
+	if status := statusForError(wrapped); status != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", status)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultEventBuffer is the number of events a subscription holds when the
+// subscriber names no buffer.
+const defaultEventBuffer = 64
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	EventBackendAdded   EventType = "backend_added"
+	EventBackendRemoved EventType = "backend_removed"
+
+	// EventHealthChanged reports a server going up or down, in Alive.
+	EventHealthChanged EventType = "health_changed"
+
+	// EventBreakerOpened and EventBreakerClosed report a server held out
+	// of selection despite being alive, such as for flapping, and its
+	// release.
+	EventBreakerOpened EventType = "breaker_opened"
+	EventBreakerClosed EventType = "breaker_closed"
+
+	EventDrainStarted   EventType = "drain_started"
+	EventDrainCompleted EventType = "drain_completed"
+
+	// EventConfigReloaded reports configuration read again at runtime,
+	// naming what in Reason.
+	EventConfigReloaded EventType = "config_reloaded"
+
+	// EventAlertFired and EventAlertResolved report an alert rule firing
+	// and its condition clearing, described by Alert.
+	EventAlertFired    EventType = "alert_fired"
+	EventAlertResolved EventType = "alert_resolved"
+
+	// EventRampChanged reports a decision of the ramp, described by Ramp.
+	EventRampChanged EventType = "ramp_changed"
+
+	// EventCertificateExpiring reports the listener certificate coming
+	// within the expiry warning, described in Reason.
+	EventCertificateExpiring EventType = "certificate_expiring"
+)
+
+// Event is a change of the pool or the load balancer. Seq numbers the
+// events of a load balancer in the order they happened, so the events of
+// each backend arrive in order and gaps reveal dropped events.
+type Event struct {
+	Seq     uint64        `json:"seq"`
+	Type    EventType     `json:"type"`
+	Time    time.Time     `json:"time"`
+	Backend string        `json:"backend,omitempty"`
+	Alive   *bool         `json:"alive,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Alert   *Alert        `json:"alert,omitempty"`
+	Ramp    *RampDecision `json:"ramp,omitempty"`
+}
+
+// Subscription receives events on C until it is closed. A subscriber that
+// falls behind by more than its buffer misses the newer events, which are
+// counted by Dropped, rather than holding up the load balancer.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	bus     *eventBus
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of events the subscriber missed.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the subscription and closes C.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// eventBus delivers events to the subscriptions.
+type eventBus struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[*Subscription]struct{}
+	dropped atomic.Uint64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+// publish numbers e and delivers it to every subscription with room for it.
+// State changes publish while still holding the lock guarding the state, so
+// events are numbered in the order the changes happened.
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for s := range b.subs {
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events of the load balancer
+// holding up to buffer events, 64 if buffer is not positive.
+func (lb *LoadBalancer) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, bus: lb.events}
+
+	lb.events.mu.Lock()
+	defer lb.events.mu.Unlock()
+	lb.events.subs[s] = struct{}{}
+
+	return s
+}
+
+// healthEvent returns the event of server turning alive or not.
+func healthEvent(server Server, alive bool, reason string) Event {
+	return Event{Type: EventHealthChanged, Backend: serverName(server), Alive: &alive, Reason: reason}
+}
+
+// writeMetrics renders the subscribers and the events they missed.
+func (b *eventBus) writeMetrics(w io.Writer) {
+	b.mu.Lock()
+	subs := len(b.subs)
+	b.mu.Unlock()
+	fmt.Fprintln(w, "# HELP lb_event_subscribers Subscribers to pool events.")
+	fmt.Fprintln(w, "# TYPE lb_event_subscribers gauge")
+	fmt.Fprintf(w, "lb_event_subscribers %d\n", subs)
+	fmt.Fprintln(w, "# HELP lb_events_dropped_total Events missed by subscribers that fell behind.")
+	fmt.Fprintln(w, "# TYPE lb_events_dropped_total counter")
+	fmt.Fprintf(w, "lb_events_dropped_total %d\n", b.dropped.Load())
+}
+
+// handleEvents streams events as server-sent events until the client goes
+// away, each with its sequence number as ID, its type as event name and
+// the Event as JSON data.
+func (lb *LoadBalancer) handleEvents(rw http.ResponseWriter, req *http.Request) {
+	sub := lb.Subscribe(0)
+	defer sub.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(rw)
+	rc.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e := <-sub.C:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
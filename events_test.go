@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of sub, failing the test after a while.
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case e := <-sub.C:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+// flipHealth takes server down as its probes would see it.
+func flipHealth(lb *LoadBalancer, server *MockServer) {
+	lb.observeHealth(server)
+	server.isAlive = false
+	lb.observeHealth(server)
+}
+
+func TestEvents_Subscribe(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	sub := lb.Subscribe(16)
+	defer sub.Close()
+
+	flipHealth(lb, server1)
+	if _, err := lb.Drain(server2.addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.AddServer(&MockServer{addr: "http://server3.com", isAlive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.RemoveServer(server1.addr); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ     EventType
+		backend string
+	}{
+		{EventHealthChanged, server1.addr},
+		{EventDrainStarted, server2.addr},
+		{EventDrainCompleted, server2.addr},
+		{EventBackendAdded, "http://server3.com"},
+		{EventBackendRemoved, server1.addr},
+	}
+	var last uint64
+	for i, w := range want {
+		e := nextEvent(t, sub)
+		if e.Type != w.typ || e.Backend != w.backend {
+			t.Errorf("Event %d: expected %s of %s, got %s of %s", i, w.typ, w.backend, e.Type, e.Backend)
+		}
+		if e.Seq <= last {
+			t.Errorf("Event %d: expected increasing sequence numbers, got %d after %d", i, e.Seq, last)
+		}
+		last = e.Seq
+		if e.Type == EventHealthChanged && (e.Alive == nil || *e.Alive) {
+			t.Errorf("Expected the health change to report the server down, got %v", e.Alive)
+		}
+	}
+}
+
+func TestEvents_DrainCompletesAfterRequests(t *testing.T) {
+	release := make(chan struct{})
+	backend := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) { <-release })
+	lb := newTestLoadBalancer(t, []Server{backend})
+	sub := lb.Subscribe(16)
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	waitFor(t, "the request in flight", func() bool { return lb.inFlight(backend.Address()) == 1 })
+	lb.Drain(backend.Address())
+	if e := nextEvent(t, sub); e.Type != EventDrainStarted {
+		t.Fatalf("Expected the drain to start, got %s", e.Type)
+	}
+	select {
+	case e := <-sub.C:
+		t.Fatalf("Expected no event while the request is in flight, got %s", e.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	if e := nextEvent(t, sub); e.Type != EventDrainCompleted || e.Backend != backend.Address() {
+		t.Errorf("Expected the drain to complete, got %s of %s", e.Type, e.Backend)
+	}
+}
+
+func TestEvents_SlowSubscriberDrops(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server})
+	slow := lb.Subscribe(1)
+	defer slow.Close()
+	fast := lb.Subscribe(8)
+	defer fast.Close()
+
+	for range 3 {
+		lb.events.publish(Event{Type: EventConfigReloaded, Reason: "secrets"})
+	}
+	if e := nextEvent(t, slow); e.Seq != 1 {
+		t.Errorf("Expected the first event, got %d", e.Seq)
+	}
+	if slow.Dropped() != 2 || fast.Dropped() != 0 {
+		t.Errorf("Expected only the slow subscriber to drop 2 events, got %d and %d", slow.Dropped(), fast.Dropped())
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if e := nextEvent(t, fast); e.Seq != want {
+			t.Errorf("Expected event %d, got %d", want, e.Seq)
+		}
+	}
+
+	slow.Close()
+	if _, ok := <-slow.C; ok {
+		t.Error("Expected the closed subscription's channel to be closed")
+	}
+}
+
+func TestEvents_AdminStream(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	admin := httptest.NewServer(lb.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	resp, err := http.Get(admin.URL + "/admin/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+	waitFor(t, "the subscription", func() bool {
+		lb.events.mu.Lock()
+		defer lb.events.mu.Unlock()
+		return len(lb.events.subs) == 1
+	})
+
+	flipHealth(lb, server1)
+	lb.Drain(server2.addr)
+
+	br := bufio.NewReader(resp.Body)
+	var events []Event
+	for len(events) < 3 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("Failed to decode %q: %v", data, err)
+		}
+		events = append(events, e)
+	}
+	want := []EventType{EventHealthChanged, EventDrainStarted, EventDrainCompleted}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("Event %d: expected %s, got %s", i, want[i], e.Type)
+		}
+	}
+	if events[0].Backend != server1.addr || *events[0].Alive || events[1].Backend != server2.addr {
+		t.Errorf("Expected the payloads to name the servers, got %+v", events)
+	}
+}
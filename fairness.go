@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFairnessWindow      = time.Minute
+	defaultFairnessHistory     = 60
+	defaultFairnessWarnWindows = 3
+)
+
+// FairnessAudit counts the servers the strategies select over consecutive
+// windows of Window, 1m by default, keeping the last History, 60 by
+// default, and scores how evenly each window spread its traffic. Counts are
+// divided by the server's weight, so weighted pools are even when traffic
+// follows the weights. Servers not selected within a window, such as down
+// or drained ones, are not scored. With WarnRatio set, a warning is logged
+// once the max/min ratio of WarnWindows consecutive windows, 3 by default,
+// exceeds it.
+type FairnessAudit struct {
+	Window      time.Duration
+	History     int
+	WarnRatio   float64
+	WarnWindows int
+}
+
+// WithFairnessAudit enables the selection fairness audit.
+func WithFairnessAudit(f FairnessAudit) Option {
+	return func(lb *LoadBalancer) {
+		lb.fairness = newFairnessRecorder(f)
+	}
+}
+
+// FairnessWindow is the selections of one window and their imbalance
+// scores: the ratio of the most to the least selected server and the
+// coefficient of variation of the selections, both per unit of weight.
+type FairnessWindow struct {
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Selections map[string]uint64 `json:"selections"`
+	MaxMin     float64           `json:"max_min_ratio"`
+	CV         float64           `json:"coefficient_of_variation"`
+	Imbalanced bool              `json:"imbalanced,omitempty"`
+}
+
+// FairnessReport is the fairness audit served by GET /admin/fairness.
+// Windows holds the completed windows, oldest first.
+type FairnessReport struct {
+	Window   string           `json:"window"`
+	Current  FairnessWindow   `json:"current"`
+	Windows  []FairnessWindow `json:"windows"`
+	Streak   int              `json:"imbalanced_streak"`
+	Warnings uint64           `json:"warnings"`
+}
+
+// fairnessRecorder counts selections into the current window, closing it
+// once Window has passed.
+type fairnessRecorder struct {
+	cfg FairnessAudit
+
+	mu       sync.Mutex
+	start    time.Time
+	counts   map[string]uint64
+	weights  map[string]int
+	windows  []FairnessWindow
+	streak   int
+	warnings uint64
+}
+
+func newFairnessRecorder(f FairnessAudit) *fairnessRecorder {
+	if f.Window <= 0 {
+		f.Window = defaultFairnessWindow
+	}
+	if f.History <= 0 {
+		f.History = defaultFairnessHistory
+	}
+	if f.WarnWindows <= 0 {
+		f.WarnWindows = defaultFairnessWarnWindows
+	}
+
+	return &fairnessRecorder{cfg: f, counts: make(map[string]uint64), weights: make(map[string]int)}
+}
+
+// record counts a selection of server at now.
+func (r *fairnessRecorder) record(server Server, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advanceLocked(now)
+	addr := serverName(server)
+	r.counts[addr]++
+	r.weights[addr] = serverWeight(server)
+}
+
+// advanceLocked closes the windows that ended by now. r.mu must be held.
+func (r *fairnessRecorder) advanceLocked(now time.Time) {
+	if r.start.IsZero() {
+		r.start = now
+		return
+	}
+	for closed := 0; !now.Before(r.start.Add(r.cfg.Window)); closed++ {
+		if closed == r.cfg.History {
+			// Every kept window would be empty; skip to the current one.
+			r.start = r.start.Add(now.Sub(r.start).Truncate(r.cfg.Window))
+			break
+		}
+		w := r.currentLocked(r.start.Add(r.cfg.Window))
+		r.closeLocked(w)
+		r.start = w.End
+		clear(r.counts)
+		clear(r.weights)
+	}
+}
+
+// currentLocked scores the selections of the current window, ending at end.
+// r.mu must be held.
+func (r *fairnessRecorder) currentLocked(end time.Time) FairnessWindow {
+	w := FairnessWindow{Start: r.start, End: end, Selections: make(map[string]uint64, len(r.counts))}
+	var shares []float64
+	for addr, n := range r.counts {
+		w.Selections[addr] = n
+		shares = append(shares, float64(n)/float64(max(r.weights[addr], 1)))
+	}
+	w.MaxMin, w.CV = imbalance(shares)
+	w.Imbalanced = r.cfg.WarnRatio > 0 && w.MaxMin > r.cfg.WarnRatio
+
+	return w
+}
+
+// closeLocked appends the completed window w, warning once it extends a
+// streak of imbalanced windows to WarnWindows. r.mu must be held.
+func (r *fairnessRecorder) closeLocked(w FairnessWindow) {
+	if len(r.windows) == r.cfg.History {
+		r.windows = append(r.windows[:0], r.windows[1:]...)
+	}
+	r.windows = append(r.windows, w)
+
+	if !w.Imbalanced {
+		r.streak = 0
+		return
+	}
+	r.streak++
+	if r.streak == r.cfg.WarnWindows {
+		r.warnings++
+		fmt.Printf("warning: selection imbalance above %.2f for %d consecutive windows of %s since %s (max/min %.2f, cv %.2f)\n",
+			r.cfg.WarnRatio, r.streak, r.cfg.Window, r.windows[len(r.windows)-r.streak].Start.Format(time.RFC3339), w.MaxMin, w.CV)
+	}
+}
+
+// imbalance returns the max/min ratio and the coefficient of variation of
+// shares, 1 and 0 for fewer than two shares.
+func imbalance(shares []float64) (ratio, cv float64) {
+	if len(shares) < 2 {
+		return 1, 0
+	}
+	lo, hi, sum := shares[0], shares[0], 0.0
+	for _, s := range shares {
+		lo, hi, sum = min(lo, s), max(hi, s), sum+s
+	}
+	mean := sum / float64(len(shares))
+	var variance float64
+	for _, s := range shares {
+		variance += (s - mean) * (s - mean)
+	}
+	variance /= float64(len(shares))
+
+	return hi / lo, math.Sqrt(variance) / mean
+}
+
+// Report returns the audit as of now.
+func (r *fairnessRecorder) Report(now time.Time) FairnessReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advanceLocked(now)
+	return FairnessReport{
+		Window:   r.cfg.Window.String(),
+		Current:  r.currentLocked(now),
+		Windows:  append([]FairnessWindow(nil), r.windows...),
+		Streak:   r.streak,
+		Warnings: r.warnings,
+	}
+}
+
+// last returns the last completed window as of now, if any.
+func (r *fairnessRecorder) last(now time.Time) (FairnessWindow, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advanceLocked(now)
+	if len(r.windows) == 0 {
+		return FairnessWindow{}, false
+	}
+
+	return r.windows[len(r.windows)-1], true
+}
+
+// status summarizes the last completed window for /admin/status.
+func (r *fairnessRecorder) status(now time.Time) map[string]any {
+	w, ok := r.last(now)
+	if !ok {
+		return nil
+	}
+
+	return map[string]any{"window_end": w.End, "max_min_ratio": w.MaxMin, "coefficient_of_variation": w.CV, "imbalanced": w.Imbalanced}
+}
+
+// writeMetrics renders the scores of the last completed window and the
+// warnings logged.
+func (r *fairnessRecorder) writeMetrics(w io.Writer, now time.Time) {
+	last, ok := r.last(now)
+	if ok {
+		fmt.Fprintln(w, "# HELP lb_selection_imbalance_ratio Ratio of the most to the least selected server per unit of weight in the last audit window.")
+		fmt.Fprintln(w, "# TYPE lb_selection_imbalance_ratio gauge")
+		fmt.Fprintf(w, "lb_selection_imbalance_ratio %g\n", last.MaxMin)
+		fmt.Fprintln(w, "# HELP lb_selection_imbalance_cv Coefficient of variation of server selections per unit of weight in the last audit window.")
+		fmt.Fprintln(w, "# TYPE lb_selection_imbalance_cv gauge")
+		fmt.Fprintf(w, "lb_selection_imbalance_cv %g\n", last.CV)
+	}
+	r.mu.Lock()
+	warnings := r.warnings
+	r.mu.Unlock()
+	fmt.Fprintln(w, "# HELP lb_selection_imbalance_warnings_total Streaks of imbalanced audit windows warned about.")
+	fmt.Fprintln(w, "# TYPE lb_selection_imbalance_warnings_total counter")
+	fmt.Fprintf(w, "lb_selection_imbalance_warnings_total %d\n", warnings)
+}
+
+// handleFairness serves the per-window breakdown of the fairness audit.
+func (lb *LoadBalancer) handleFairness(rw http.ResponseWriter, req *http.Request) {
+	if lb.fairness == nil {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("fairness audit is not configured"))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, lb.fairness.Report(lb.now()))
+}
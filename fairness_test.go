@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordWindow records n[i] selections of servers[i] within the window
+// starting at start.
+func recordWindow(r *fairnessRecorder, start time.Time, servers []Server, n ...int) {
+	for i, server := range servers {
+		for range n[i] {
+			r.record(server, start.Add(time.Second))
+		}
+	}
+}
+
+func TestFairnessAudit_Scores(t *testing.T) {
+	servers := []Server{
+		&MockServer{addr: "http://server1.com", isAlive: true},
+		&MockServer{addr: "http://server2.com", isAlive: true},
+		&MockServer{addr: "http://server3.com", isAlive: true},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newFairnessRecorder(FairnessAudit{Window: time.Minute})
+	r.record(servers[0], start)
+
+	recordWindow(r, start, servers, 99, 100, 100)
+	recordWindow(r, start.Add(time.Minute), servers, 200, 100, 50)
+	report := r.Report(start.Add(2 * time.Minute))
+
+	if len(report.Windows) != 2 {
+		t.Fatalf("Expected two completed windows, got %d", len(report.Windows))
+	}
+	even, skewed := report.Windows[0], report.Windows[1]
+	if even.MaxMin != 1 || even.CV != 0 || even.Selections["http://server1.com"] != 100 {
+		t.Errorf("Expected an even window, got %+v", even)
+	}
+	if skewed.MaxMin != 4 {
+		t.Errorf("Expected a max/min ratio of 4, got %g", skewed.MaxMin)
+	}
+	// Selections 200, 100 and 50 have a mean of 350/3.
+	mean := 350.0 / 3
+	cv := math.Sqrt(((200-mean)*(200-mean)+(100-mean)*(100-mean)+(50-mean)*(50-mean))/3) / mean
+	if math.Abs(skewed.CV-cv) > 1e-9 {
+		t.Errorf("Expected a coefficient of variation of %g, got %g", cv, skewed.CV)
+	}
+	if !skewed.Start.Equal(start.Add(time.Minute)) || !skewed.End.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("Expected the window bounds, got %v to %v", skewed.Start, skewed.End)
+	}
+}
+
+func TestFairnessAudit_Weighted(t *testing.T) {
+	heavy := &slowMockServer{addr: "http://server1.com", weight: 3}
+	light := &MockServer{addr: "http://server2.com", isAlive: true}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newFairnessRecorder(FairnessAudit{Window: time.Minute})
+	r.record(light, start)
+
+	recordWindow(r, start, []Server{heavy, light}, 300, 99)
+	w, _ := r.last(start.Add(time.Minute))
+	if w.MaxMin != 1 || w.CV != 0 {
+		t.Errorf("Expected traffic following the weights to be even, got %g and %g", w.MaxMin, w.CV)
+	}
+}
+
+func TestFairnessAudit_WarnsOnConsecutiveWindows(t *testing.T) {
+	servers := []Server{
+		&MockServer{addr: "http://server1.com", isAlive: true},
+		&MockServer{addr: "http://server2.com", isAlive: true},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newFairnessRecorder(FairnessAudit{Window: time.Minute, WarnRatio: 2, WarnWindows: 3})
+	r.record(servers[0], start)
+
+	patterns := [][]int{{29, 10}, {30, 10}, {10, 10}, {30, 10}, {30, 10}, {30, 10}, {30, 10}}
+	for i, n := range patterns {
+		recordWindow(r, start.Add(time.Duration(i)*time.Minute), servers, n...)
+	}
+	report := r.Report(start.Add(time.Duration(len(patterns)) * time.Minute))
+
+	if report.Warnings != 1 {
+		t.Errorf("Expected one warning for the streak of four, got %d", report.Warnings)
+	}
+	if report.Streak != 4 {
+		t.Errorf("Expected an imbalanced streak of 4, got %d", report.Streak)
+	}
+	for i, w := range report.Windows {
+		if want := i != 2; w.Imbalanced != want {
+			t.Errorf("Expected window %d imbalanced=%v, got %v", i, want, w.Imbalanced)
+		}
+	}
+}
+
+func TestFairnessAudit_History(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newFairnessRecorder(FairnessAudit{Window: time.Minute, History: 3})
+	r.record(server, start)
+
+	report := r.Report(start.Add(time.Hour + 30*time.Second))
+	if len(report.Windows) != 3 {
+		t.Fatalf("Expected the history to be bounded, got %d windows", len(report.Windows))
+	}
+	if !report.Current.Start.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected the current window to start on the hour, got %v", report.Current.Start)
+	}
+}
+
+func TestFairnessAudit_Admin(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://server1.com", isAlive: true},
+		&MockServer{addr: "http://server2.com", isAlive: true},
+	}, WithFairnessAudit(FairnessAudit{Window: time.Minute}))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	for range 10 {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	now = now.Add(time.Minute)
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/fairness", nil))
+	var report FairnessReport
+	if err := json.Unmarshal(rw.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode the report: %v", err)
+	}
+	if len(report.Windows) != 1 || report.Windows[0].Selections["http://server1.com"] != 5 || report.Windows[0].MaxMin != 1 {
+		t.Errorf("Expected round robin to be even, got %+v", report.Windows)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{"lb_selection_imbalance_ratio 1", "lb_selection_imbalance_cv 0"} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
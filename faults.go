@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FaultInjection injects failures into a route's requests to exercise the
+// resilience of clients. Percentages range from 0 to 100 and each fault is
+// decided independently:
+//
+//   - DelayPercent of requests are held for a random duration between
+//     DelayMin and DelayMax before being proxied.
+//   - AbortPercent of requests are answered with AbortStatus without
+//     contacting a server.
+//   - ResetPercent of requests have their connection closed after part of
+//     the response was sent.
+//
+// When Header or AllowedPrefixes are set, only requests carrying the header
+// or coming from an address in one of the prefixes are affected. Fault
+// injection is refused unless WithUnsafeFaultInjection is given.
+type FaultInjection struct {
+	DelayPercent float64
+	DelayMin     time.Duration
+	DelayMax     time.Duration
+
+	AbortPercent float64
+	AbortStatus  int
+
+	ResetPercent float64
+
+	Header          string
+	AllowedPrefixes []netip.Prefix
+}
+
+// The kinds of injected faults, as reported in logs and metrics.
+const (
+	faultDelay = "delay"
+	faultAbort = "abort"
+	faultReset = "reset"
+)
+
+// WithUnsafeFaultInjection allows routes to inject faults. Without it
+// NewLoadBalancer rejects routes with a FaultInjection.
+func WithUnsafeFaultInjection() Option {
+	return func(lb *LoadBalancer) {
+		lb.faults.allowed = true
+	}
+}
+
+// faultInjector decides and counts the faults injected by a load balancer.
+type faultInjector struct {
+	allowed bool
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	counts map[[2]string]uint64
+
+	// sleep waits for an injected delay; tests replace it.
+	sleep func(ctx context.Context, d time.Duration)
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		rand:   rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		counts: make(map[[2]string]uint64),
+		sleep: func(ctx context.Context, d time.Duration) {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+		},
+	}
+}
+
+// checkFaults rejects routes injecting faults unless that was allowed.
+func (lb *LoadBalancer) checkFaults() error {
+	for _, route := range lb.routeList() {
+		if route.Faults != nil && !lb.faults.allowed {
+			return fmt.Errorf("route %q: fault injection requires WithUnsafeFaultInjection", route.Name)
+		}
+	}
+
+	return nil
+}
+
+// faultDecision is the set of faults injected into one request.
+type faultDecision struct {
+	route  string
+	delay  time.Duration
+	abort  int
+	reset  bool
+	events []string
+}
+
+// decide draws the faults for req under f, counting them for route.
+func (fi *faultInjector) decide(route string, f *FaultInjection, req *http.Request) faultDecision {
+	d := faultDecision{route: route}
+	if !f.targets(req) {
+		return d
+	}
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	if fi.rand.Float64()*100 < f.DelayPercent {
+		d.delay = f.DelayMin
+		if f.DelayMax > f.DelayMin {
+			d.delay += time.Duration(fi.rand.Int64N(int64(f.DelayMax - f.DelayMin + 1)))
+		}
+		d.events = append(d.events, faultDelay)
+	}
+	if fi.rand.Float64()*100 < f.AbortPercent {
+		d.abort = f.AbortStatus
+		d.events = append(d.events, faultAbort)
+	} else if fi.rand.Float64()*100 < f.ResetPercent {
+		d.reset = true
+		d.events = append(d.events, faultReset)
+	}
+	for _, event := range d.events {
+		fi.counts[[2]string{route, event}]++
+	}
+
+	return d
+}
+
+// targets reports whether req is subject to fault injection.
+func (f *FaultInjection) targets(req *http.Request) bool {
+	if f.Header == "" && len(f.AllowedPrefixes) == 0 {
+		return true
+	}
+	if f.Header != "" && req.Header.Get(f.Header) != "" {
+		return true
+	}
+
+	addr, ok := clientAddr(req)
+	if !ok {
+		return false
+	}
+	for _, prefix := range f.AllowedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// injectFaults draws the faults of req's route and applies its delay. It
+// returns a zero decision for routes without fault injection.
+func (lb *LoadBalancer) injectFaults(req *http.Request) faultDecision {
+	route := lb.matchRoute(req)
+	if route == nil || route.Faults == nil {
+		return faultDecision{}
+	}
+
+	d := lb.faults.decide(route.Name, route.Faults, req)
+	if len(d.events) > 0 {
+		fmt.Printf("fault injection: %s %s on route %q: %v\n", req.Method, req.URL.Path, route.Name, d.events)
+	}
+	if d.delay > 0 {
+		lb.faults.sleep(req.Context(), d.delay)
+	}
+
+	return d
+}
+
+// writeMetrics renders the injected fault counters.
+func (fi *faultInjector) writeMetrics(w io.Writer) {
+	fi.mu.Lock()
+	keys := make([][2]string, 0, len(fi.counts))
+	for k := range fi.counts {
+		keys = append(keys, k)
+	}
+	counts := make([]uint64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for i, k := range keys {
+		counts[i] = fi.counts[k]
+	}
+	fi.mu.Unlock()
+
+	if len(keys) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# HELP lb_fault_injections_total Faults injected into requests by route and kind.")
+	fmt.Fprintln(w, "# TYPE lb_fault_injections_total counter")
+	for i, k := range keys {
+		fmt.Fprintf(w, "lb_fault_injections_total{route=%q,fault=%q} %d\n", k[0], k[1], counts[i])
+	}
+}
+
+// truncatingWriter passes on the first half of the first body write, or a
+// single byte of smaller ones, and drops the rest, so the connection can be
+// aborted in the middle of the response.
+type truncatingWriter struct {
+	http.ResponseWriter
+	truncated bool
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if w.truncated {
+		return len(p), nil
+	}
+	w.truncated = true
+	if _, err := w.ResponseWriter.Write(p[:max(len(p)/2, min(len(p), 1))]); err != nil {
+		return 0, err
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+
+	return len(p), nil
+}
+
+func (w *truncatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
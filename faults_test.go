@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection_Percentages(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	faults := &FaultInjection{
+		DelayPercent: 30, DelayMin: 10 * time.Millisecond, DelayMax: 50 * time.Millisecond,
+		AbortPercent: 20, AbortStatus: http.StatusServiceUnavailable,
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithUnsafeFaultInjection(),
+		WithRoutes(Route{Name: "chaos", PathPrefix: "/chaos/", Faults: faults}, Route{Name: "other", PathPrefix: "/"}))
+	lb.faults.rand = rand.New(rand.NewPCG(1, 2))
+	var delays []time.Duration
+	lb.faults.sleep = func(ctx context.Context, d time.Duration) { delays = append(delays, d) }
+
+	const n = 10000
+	aborted := 0
+	for i := 0; i < n; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/chaos/x", nil))
+		if rw.Code == http.StatusServiceUnavailable {
+			aborted++
+		}
+	}
+	if aborted < n*18/100 || aborted > n*22/100 {
+		t.Errorf("Expected about 20%% of requests to be aborted, got %d of %d", aborted, n)
+	}
+	if server.callCount != n-aborted {
+		t.Errorf("Expected aborted requests not to reach the server, got %d calls", server.callCount)
+	}
+	if len(delays) < n*28/100 || len(delays) > n*32/100 {
+		t.Errorf("Expected about 30%% of requests to be delayed, got %d of %d", len(delays), n)
+	}
+	for _, d := range delays {
+		if d < faults.DelayMin || d > faults.DelayMax {
+			t.Fatalf("Expected delays between %v and %v, got %v", faults.DelayMin, faults.DelayMax, d)
+		}
+	}
+
+	// Other routes are untouched
+	injected := len(delays)
+	for i := 0; i < 1000; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/other", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 outside the chaos route, got %d", rw.Code)
+		}
+	}
+	if len(delays) != injected {
+		t.Errorf("Expected no delays outside the chaos route, got %d", len(delays)-injected)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`lb_fault_injections_total{route="chaos",fault="abort"} ` + strconv.Itoa(aborted),
+		`lb_fault_injections_total{route="chaos",fault="delay"} ` + strconv.Itoa(len(delays)),
+	} {
+		if !strings.Contains(rw.Body.String(), want+"\n") {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestFaultInjection_Targeting(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server}, WithUnsafeFaultInjection(),
+		WithRoutes(Route{Name: "chaos", PathPrefix: "/", Faults: &FaultInjection{
+			AbortPercent: 100, AbortStatus: http.StatusBadGateway,
+			Header: "X-Chaos", AllowedPrefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		status     int
+	}{
+		{"untargeted client", "192.0.2.1:1234", "", http.StatusOK},
+		{"header", "192.0.2.1:1234", "1", http.StatusBadGateway},
+		{"allowed client", "10.1.2.3:1234", "", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set("X-Chaos", tt.header)
+		}
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != tt.status {
+			t.Errorf("%s: Expected status %d, got %d", tt.name, tt.status, rw.Code)
+		}
+	}
+}
+
+func TestFaultInjection_Reset(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1000)
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(body)
+	})
+	var accessLog syncBuffer
+	lb := newTestLoadBalancer(t, []Server{server}, WithUnsafeFaultInjection(), WithAccessLog(&accessLog),
+		WithRoutes(Route{Name: "chaos", PathPrefix: "/", Faults: &FaultInjection{ResetPercent: 100}}))
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("Expected the connection to be aborted, got a complete body")
+	}
+	if len(got) == 0 || len(got) >= len(body) {
+		t.Errorf("Expected part of the body before the abort, got %d bytes", len(got))
+	}
+
+	// The request is accounted for despite the abort
+	if s := lb.Stats()[0]; s.InFlight != 0 || s.Requests != 1 {
+		t.Errorf("Expected 1 completed request, got %d with %d in flight", s.Requests, s.InFlight)
+	}
+	entries := accessLogEntries(t, &accessLog)
+	if len(entries) != 1 || entries[0]["faults"] != "reset" {
+		t.Errorf("Expected the reset to be logged, got %v", entries)
+	}
+}
+
+func TestFaultInjection_RequiresUnsafeFlag(t *testing.T) {
+	route := Route{Name: "chaos", Faults: &FaultInjection{AbortPercent: 100, AbortStatus: 500}}
+	if _, err := NewLoadBalancer("8000", []Server{&MockServer{addr: "http://server1.com"}}, WithRoutes(route)); err == nil {
+		t.Errorf("Expected fault injection without WithUnsafeFaultInjection to be rejected")
+	}
+
+	cfg := &Config{
+		Port:    "8000",
+		Servers: []ServerConfig{{Address: "http://server1.com"}},
+		Routes:  []RouteConfig{{Name: "chaos", PathPrefix: "/", Faults: &FaultInjectionConfig{AbortPercent: 5, AbortStatus: 503}}},
+	}
+	if _, err := cfg.Build(); err == nil {
+		t.Errorf("Expected faults without unsafe_fault_injection to be rejected")
+	}
+	cfg.UnsafeFaultInjection = true
+	if _, err := cfg.Build(); err != nil {
+		t.Errorf("Expected faults with unsafe_fault_injection to be accepted, got %v", err)
+	}
+	cfg.Routes[0].Faults.AbortPercent = 150
+	if _, err := cfg.Build(); err == nil {
+		t.Errorf("Expected a percentage above 100 to be rejected")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFDHighWater = 0.9
+	defaultFDLowWater  = 0.8
+	defaultFDInterval  = time.Second
+
+	// fdBaseline covers the descriptors open whatever the traffic: the
+	// standard streams, listeners, log and journal files and DNS lookups.
+	fdBaseline = 64
+
+	// fdClientEstimate stands in for the client connections when they are
+	// not limited.
+	fdClientEstimate = 1024
+)
+
+// FDGuard guards against running out of file descriptors. At startup the
+// open file limit is compared with the descriptors the configuration may
+// need, as estimated by EstimateFDs; a lower limit is logged, or refused
+// with Enforce set.
+//
+// While running, the open descriptors are counted every Interval, 1s by
+// default. Once they reach HighWater of the limit, 0.9 by default, new
+// client connections are answered with 503 and closed, and idle connections
+// to servers are closed at every count. Established client connections keep
+// being served. Shedding stops once the count is back to LowWater of the
+// limit, 0.8 by default. Count and Limit replace how descriptors and the
+// limit are read, which by default is from /proc/self/fd or /dev/fd, or
+// failing that by counting the connections of the load balancer, and from
+// RLIMIT_NOFILE.
+type FDGuard struct {
+	Enforce   bool
+	HighWater float64
+	LowWater  float64
+	Interval  time.Duration
+	Count     func() (int, error)
+	Limit     func() (int, error)
+}
+
+// WithFDGuard guards against running out of file descriptors. Counting
+// runs in RunFDGuard. NewLoadBalancer fails if Enforce is set and the limit
+// is below the estimate.
+func WithFDGuard(g FDGuard) Option {
+	return func(lb *LoadBalancer) {
+		if g.HighWater <= 0 {
+			g.HighWater = defaultFDHighWater
+		}
+		if g.LowWater <= 0 {
+			g.LowWater = defaultFDLowWater
+		}
+		if g.Interval <= 0 {
+			g.Interval = defaultFDInterval
+		}
+		if g.Limit == nil {
+			g.Limit = openFileLimit
+		}
+		if g.Count == nil {
+			g.Count = func() (int, error) { return lb.countFDs(), nil }
+		}
+		lb.fds = &fdGuard{config: g}
+	}
+}
+
+// FDEstimate is the number of file descriptors a configuration may need:
+// the baseline, a descriptor per client connection, 1024 if they are not
+// limited, one per request in flight to servers, bounded by the servers'
+// MaxConcurrent when all of them have one, and the idle connections kept
+// to each server, its health check and the auth services of routes.
+type FDEstimate struct {
+	Baseline int `json:"baseline"`
+	Clients  int `json:"clients"`
+	Upstream int `json:"upstream"`
+	Idle     int `json:"idle"`
+	Total    int `json:"total"`
+}
+
+// EstimateFDs returns the file descriptors the configuration may need.
+func (lb *LoadBalancer) EstimateFDs() FDEstimate {
+	e := FDEstimate{Baseline: fdBaseline, Clients: lb.connLimits.MaxConnections}
+	if e.Clients <= 0 {
+		e.Clients = fdClientEstimate
+	}
+
+	lb.mu.Lock()
+	limited := len(lb.servers) > 0
+	concurrent := 0
+	for _, server := range lb.servers {
+		if n := serverMaxConcurrent(server); n > 0 {
+			concurrent += n
+		} else {
+			limited = false
+		}
+		e.Idle += http.DefaultMaxIdleConnsPerHost
+		if checked, ok := server.(healthChecked); ok && checked.healthInterval() > 0 {
+			e.Idle++
+		}
+	}
+	lb.mu.Unlock()
+	e.Upstream = e.Clients
+	if limited {
+		e.Upstream = min(concurrent, e.Clients)
+	}
+	for _, route := range lb.routeList() {
+		if route.AuthRequest != nil {
+			e.Idle += route.AuthRequest.withDefaults().MaxIdleConns
+		}
+	}
+	e.Total = e.Baseline + e.Clients + e.Upstream + e.Idle
+
+	return e
+}
+
+// checkFDLimit compares the open file limit with the estimate.
+func (lb *LoadBalancer) checkFDLimit() error {
+	limit, err := lb.fds.config.Limit()
+	if err != nil {
+		fmt.Printf("warning: cannot read the open file limit: %v\n", err)
+		return nil
+	}
+	lb.fds.limit = limit
+	e := lb.EstimateFDs()
+	if limit >= e.Total {
+		return nil
+	}
+	err = fmt.Errorf("open file limit %d is below the %d file descriptors the configuration may need (%d baseline, %d clients, %d upstream, %d idle)",
+		limit, e.Total, e.Baseline, e.Clients, e.Upstream, e.Idle)
+	if lb.fds.config.Enforce {
+		return err
+	}
+	fmt.Printf("warning: %v\n", err)
+
+	return nil
+}
+
+// fdGuard tracks the open descriptors and whether new connections are
+// shed.
+type fdGuard struct {
+	config FDGuard
+
+	mu       sync.Mutex
+	limit    int
+	open     int
+	shedding bool
+	shed     uint64
+}
+
+// observe records open descriptors against the limit and reports whether
+// shedding started or stopped.
+func (g *fdGuard) observe(open, limit int) (started, stopped bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.open, g.limit = open, limit
+	switch {
+	case !g.shedding && float64(open) >= g.config.HighWater*float64(limit):
+		g.shedding = true
+		return true, false
+	case g.shedding && float64(open) <= g.config.LowWater*float64(limit):
+		g.shedding = false
+		return false, true
+	}
+
+	return false, false
+}
+
+func (g *fdGuard) isShedding() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.shedding
+}
+
+func (g *fdGuard) countShed() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.shed++
+}
+
+// writeMetrics renders the descriptor usage and the connections shed.
+func (g *fdGuard) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_open_fds Open file descriptors at the last count.")
+	fmt.Fprintln(w, "# TYPE lb_open_fds gauge")
+	fmt.Fprintf(w, "lb_open_fds %d\n", g.open)
+	fmt.Fprintln(w, "# HELP lb_fd_limit Open file limit of the process.")
+	fmt.Fprintln(w, "# TYPE lb_fd_limit gauge")
+	fmt.Fprintf(w, "lb_fd_limit %d\n", g.limit)
+	shedding := 0
+	if g.shedding {
+		shedding = 1
+	}
+	fmt.Fprintln(w, "# HELP lb_fd_shedding Whether new connections are shed for lack of file descriptors.")
+	fmt.Fprintln(w, "# TYPE lb_fd_shedding gauge")
+	fmt.Fprintf(w, "lb_fd_shedding %d\n", shedding)
+	fmt.Fprintln(w, "# HELP lb_fd_shed_connections_total Client connections answered with 503 for lack of file descriptors.")
+	fmt.Fprintln(w, "# TYPE lb_fd_shed_connections_total counter")
+	fmt.Fprintf(w, "lb_fd_shed_connections_total %d\n", g.shed)
+}
+
+// RunFDGuard counts the open file descriptors until ctx is done. It returns
+// at once without an FDGuard.
+func (lb *LoadBalancer) RunFDGuard(ctx context.Context) {
+	if lb.fds == nil {
+		return
+	}
+	ticker := time.NewTicker(lb.fds.config.Interval)
+	defer ticker.Stop()
+	for {
+		markActive(ctx)
+		lb.checkFDs()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkFDs counts the open descriptors once, starting or stopping shedding
+// as they cross the water marks.
+func (lb *LoadBalancer) checkFDs() {
+	g := lb.fds
+	open, err := g.config.Count()
+	if err != nil {
+		fmt.Printf("error: count file descriptors: %v\n", err)
+		return
+	}
+	limit, err := g.config.Limit()
+	if err != nil {
+		fmt.Printf("error: read the open file limit: %v\n", err)
+		return
+	}
+	started, stopped := g.observe(open, limit)
+	switch {
+	case started:
+		fmt.Printf("warning: %d of %d file descriptors open, shedding new connections\n", open, limit)
+	case stopped:
+		fmt.Printf("%d of %d file descriptors open, accepting new connections again\n", open, limit)
+	}
+	if g.isShedding() {
+		lb.closeIdleConnections()
+	}
+}
+
+// closeIdleConnections closes the idle connections to servers and auth
+// services.
+func (lb *LoadBalancer) closeIdleConnections() {
+	lb.mu.Lock()
+	servers := append([]Server(nil), lb.servers...)
+	lb.mu.Unlock()
+	for _, server := range servers {
+		if s, ok := server.(idleCloser); ok {
+			s.CloseIdleConnections()
+		}
+	}
+	lb.auth.closeIdleConnections()
+}
+
+// idleCloser is implemented by servers that can close their idle
+// connections.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+// countFDs returns the open descriptors listed by the system, or else the
+// connections of the load balancer and the baseline.
+func (lb *LoadBalancer) countFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Reading the directory opens a descriptor of its own.
+			return max(len(entries)-1, 0)
+		}
+	}
+
+	n := fdBaseline
+	lb.conns.mu.Lock()
+	n += len(lb.conns.conns)
+	lb.conns.mu.Unlock()
+	lb.mu.Lock()
+	servers := append([]Server(nil), lb.servers...)
+	lb.mu.Unlock()
+	for _, server := range servers {
+		if r, ok := server.(transportReporter); ok {
+			n += int(r.TransportStats().OpenConnections)
+		}
+	}
+
+	return n
+}
+
+// shedConn answers requests on connections accepted while shedding with
+// 503, closing the connection, and reports whether it did.
+func (lb *LoadBalancer) shedConn(rw http.ResponseWriter, req *http.Request) bool {
+	if lb.fds == nil || !lb.conns.shed(connOf(req)) {
+		return false
+	}
+	lb.fds.countShed()
+	rw.Header().Set("Connection", "close")
+	rw.Header().Set("Retry-After", "1")
+	writeStatus(rw, http.StatusServiceUnavailable)
+
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// openFileLimit reports errors.ErrUnsupported: only Unix systems have an
+// open file limit to read.
+func openFileLimit() (int, error) {
+	return 0, fmt.Errorf("open file limit: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEstimateFDs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   FDEstimate
+	}{
+		{
+			name:   "unlimited",
+			config: `{"servers": [{"address": "http://a:80"}, {"address": "http://b:80"}]}`,
+			want:   FDEstimate{Baseline: 64, Clients: 1024, Upstream: 1024, Idle: 4, Total: 2116},
+		},
+		{
+			name: "limited",
+			config: `{"connections": {"max_connections": 500},
+				"servers": [{"address": "http://a:80", "max_concurrent": 100, "health_check": {"path": "/health", "interval": "5s"}},
+					{"address": "http://b:80", "max_concurrent": 50, "health_check": {"path": "/health", "interval": "5s"}}]}`,
+			want: FDEstimate{Baseline: 64, Clients: 500, Upstream: 150, Idle: 6, Total: 720},
+		},
+		{
+			name: "partly limited with auth",
+			config: `{"connections": {"max_connections": 200},
+				"servers": [{"address": "http://a:80", "max_concurrent": 100}, {"address": "http://b:80"}],
+				"routes": [{"name": "api", "path_prefix": "/api/", "auth_request": {"url": "http://auth:80/check", "max_idle_conns": 10}}]}`,
+			want: FDEstimate{Baseline: 64, Clients: 200, Upstream: 200, Idle: 14, Total: 478},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			if err := json.Unmarshal([]byte(tc.config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			lb, err := cfg.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lb.EstimateFDs(); got != tc.want {
+				t.Errorf("Expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFDGuard_StartupLimit(t *testing.T) {
+	servers := []Server{&MockServer{addr: "http://server1.com", isAlive: true}}
+	limit := func() (int, error) { return 1000, nil }
+
+	if _, err := NewLoadBalancer("8000", servers, WithFDGuard(FDGuard{Limit: limit})); err != nil {
+		t.Errorf("Expected a low limit only to be logged, got %v", err)
+	}
+	_, err := NewLoadBalancer("8000", servers, WithFDGuard(FDGuard{Limit: limit, Enforce: true}))
+	if err == nil || !strings.Contains(err.Error(), "1000") {
+		t.Errorf("Expected a low limit to be refused, got %v", err)
+	}
+	_, err = NewLoadBalancer("8000", servers, WithFDGuard(FDGuard{Limit: limit, Enforce: true}),
+		WithConnectionLimits(ConnectionLimits{MaxConnections: 400}))
+	if err != nil {
+		t.Errorf("Expected the limit to suffice for 400 connections, got %v", err)
+	}
+}
+
+// idleClosingServer counts the times its idle connections are closed.
+type idleClosingServer struct {
+	*simpleServer
+	closed atomic.Int32
+}
+
+func (s *idleClosingServer) CloseIdleConnections() {
+	s.closed.Add(1)
+	s.simpleServer.CloseIdleConnections()
+}
+
+func TestFDGuard_SheddingAndRecovery(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	simple, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &idleClosingServer{simpleServer: simple}
+	var open atomic.Int64
+	lb := newTestLoadBalancer(t, []Server{server}, WithFDGuard(FDGuard{
+		Count: func() (int, error) { return int(open.Load()), nil },
+		Limit: func() (int, error) { return 1000, nil },
+	}))
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = lb.NewServer(lb.Handler())
+	srv.Start()
+	defer srv.Close()
+
+	established := &http.Client{Transport: &http.Transport{}}
+	get := func(client *http.Client) int {
+		resp, err := client.Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(established); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	for _, step := range []struct {
+		open     int64
+		shedding bool
+	}{
+		{850, false},
+		{900, true},
+		{850, true}, // Between the water marks, shedding goes on.
+		{800, false},
+		{950, true},
+	} {
+		open.Store(step.open)
+		lb.checkFDs()
+		if got := lb.fds.isShedding(); got != step.shedding {
+			t.Fatalf("Expected shedding %v at %d open descriptors, got %v", step.shedding, step.open, got)
+		}
+	}
+	if server.closed.Load() != 3 {
+		t.Errorf("Expected idle connections closed at every count while shedding, got %d", server.closed.Load())
+	}
+
+	if code := get(&http.Client{Transport: &http.Transport{}}); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a new connection to be shed with 503, got %d", code)
+	}
+	if code := get(established); code != http.StatusOK {
+		t.Errorf("Expected the established connection to be served, got %d", code)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"lb_open_fds 950", "lb_fd_limit 1000", "lb_fd_shedding 1", "lb_fd_shed_connections_total 1"} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+
+	open.Store(100)
+	lb.checkFDs()
+	if code := get(&http.Client{Transport: &http.Transport{}}); code != http.StatusOK {
+		t.Errorf("Expected new connections served after recovery, got %d", code)
+	}
+}
+
+func TestFDGuardConfig(t *testing.T) {
+	for _, bad := range []FDGuardConfig{
+		{HighWater: 1.5},
+		{HighWater: 0.5, LowWater: 0.6},
+		{LowWater: -0.1},
+	} {
+		if _, err := bad.build(); err == nil {
+			t.Errorf("Expected fd guard %+v to be rejected", bad)
+		}
+	}
+	if g, err := (&FDGuardConfig{HighWater: 0.95}).build(); err != nil || g.LowWater != defaultFDLowWater {
+		t.Errorf("Expected the default low water mark, got %+v, %v", g, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"math"
+	"syscall"
+)
+
+// openFileLimit returns the soft RLIMIT_NOFILE of the process.
+func openFileLimit() (int, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+
+	return int(min(uint64(rlimit.Cur), math.MaxInt32)), nil
+}
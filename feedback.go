@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedbackHeader   = "X-LB-Feedback"
+	defaultFeedbackLoadTTL  = 10 * time.Second
+	defaultFeedbackDrainFor = 10 * time.Second
+	defaultFeedbackMaxDrain = time.Minute
+)
+
+// Feedback lets servers report their own saturation in a response header,
+// e.g. "X-LB-Feedback: load=0.9;drain=true". A load sets the server's
+// reported load, as a health check's load path does, fresh for LoadTTL,
+// 10s by default. Drain takes the server out of selection for DrainFor,
+// 10s by default, or for the duration given, as in drain=30s, capped at
+// MaxDrain, a minute by default. Headers with unknown keys or invalid
+// values are ignored as a whole. Feedback trusts the servers, so only the
+// servers matching Selector, every server without one, are heeded. The
+// header never reaches clients.
+type Feedback struct {
+	Header   string
+	Selector Selector
+	LoadTTL  time.Duration
+	DrainFor time.Duration
+	MaxDrain time.Duration
+}
+
+// WithFeedback heeds the load and drain requests servers send in
+// responses.
+func WithFeedback(f Feedback) Option {
+	return func(lb *LoadBalancer) {
+		if f.Header == "" {
+			f.Header = defaultFeedbackHeader
+		}
+		if f.LoadTTL == 0 {
+			f.LoadTTL = defaultFeedbackLoadTTL
+		}
+		if f.DrainFor == 0 {
+			f.DrainFor = defaultFeedbackDrainFor
+		}
+		if f.MaxDrain == 0 {
+			f.MaxDrain = defaultFeedbackMaxDrain
+		}
+		lb.feedback = &f
+	}
+}
+
+// feedbackReport is a parsed feedback header. A drain of 0 requests none.
+type feedbackReport struct {
+	load  *float64
+	drain time.Duration
+}
+
+// parse parses a feedback header value of semicolon separated
+// key=value pairs, each key at most once. drain=true requests a drain of
+// f.DrainFor.
+func (f *Feedback) parse(value string) (feedbackReport, error) {
+	var r feedbackReport
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" || seen[key] {
+			return feedbackReport{}, fmt.Errorf("malformed pair %q", strings.TrimSpace(part))
+		}
+		seen[key] = true
+		switch key {
+		case "load":
+			load, err := strconv.ParseFloat(val, 64)
+			if err != nil || load < 0 || math.IsInf(load, 0) || math.IsNaN(load) {
+				return feedbackReport{}, fmt.Errorf("invalid load %q", val)
+			}
+			r.load = &load
+		case "drain":
+			switch val {
+			case "true":
+				r.drain = f.DrainFor
+			case "false":
+				r.drain = 0
+			default:
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					return feedbackReport{}, fmt.Errorf("invalid drain %q", val)
+				}
+				r.drain = d
+			}
+			r.drain = min(r.drain, f.MaxDrain)
+		default:
+			return feedbackReport{}, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	return r, nil
+}
+
+// loadReceiver is implemented by servers that accept loads reported in
+// feedback.
+type loadReceiver interface {
+	receiveLoad(report LoadReport)
+}
+
+func (s *simpleServer) receiveLoad(report LoadReport) {
+	s.load.Store(&report)
+}
+
+// feedbackHook returns the function removing the feedback header from the
+// responses of server and heeding it, or nil without feedback.
+func (lb *LoadBalancer) feedbackHook(server Server) func(header http.Header) {
+	f := lb.feedback
+	if f == nil {
+		return nil
+	}
+	trusted := f.Selector.Matches(serverLabels(server))
+
+	return func(header http.Header) {
+		value := header.Get(f.Header)
+		if value == "" {
+			return
+		}
+		header.Del(f.Header)
+		if !trusted {
+			return
+		}
+		report, err := f.parse(value)
+		if err != nil {
+			fmt.Printf("error: feedback of server %s: %v\n", serverName(server), err)
+			return
+		}
+		lb.heedFeedback(server, report)
+	}
+}
+
+// heedFeedback applies report of server.
+func (lb *LoadBalancer) heedFeedback(server Server, report feedbackReport) {
+	now := lb.now()
+	if r, ok := server.(loadReceiver); ok && report.load != nil {
+		r.receiveLoad(LoadReport{Load: *report.load, Time: now, ttl: lb.feedback.LoadTTL})
+	}
+	if report.drain <= 0 {
+		return
+	}
+	name := serverName(server)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(name)
+	until := now.Add(report.drain)
+	extended := lb.backingOffLocked(name, now)
+	if until.After(c.backoffUntil) {
+		c.backoffUntil = until
+		lb.startBackoffLocked(name, c)
+	}
+	if !extended {
+		fmt.Printf("server %s asked to drain, backing off for %s\n", name, report.drain)
+		lb.events.publish(Event{Type: EventBreakerOpened, Backend: name, Reason: "feedback"})
+	}
+}
+
+// startBackoffLocked holds the server with the given name, whose counters
+// are c, out of selection until c.backoffUntil, ending the backoff then
+// even if no request notices. lb.mu must be held.
+func (lb *LoadBalancer) startBackoffLocked(name string, c *serverCounters) {
+	c.backingOff = true
+	if c.backoffTimer != nil {
+		c.backoffTimer.Stop()
+	}
+	c.backoffTimer = time.AfterFunc(c.backoffUntil.Sub(lb.now()), func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.counters[name] == c {
+			lb.backingOffLocked(name, lb.now())
+		}
+	})
+}
+
+// backingOffLocked reports whether the server with the given name asked
+// through feedback to be out of selection at now, publishing the end of
+// its backoff once it is over. lb.mu must be held.
+func (lb *LoadBalancer) backingOffLocked(name string, now time.Time) bool {
+	c := lb.counters[name]
+	if c == nil {
+		return false
+	}
+	if now.Before(c.backoffUntil) {
+		return true
+	}
+	if c.backingOff {
+		c.backingOff = false
+		fmt.Printf("server %s is done backing off\n", name)
+		lb.events.publish(Event{Type: EventBreakerClosed, Backend: name, Reason: "feedback"})
+	}
+
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFeedback_Parse(t *testing.T) {
+	f := &Feedback{DrainFor: 10 * time.Second, MaxDrain: time.Minute}
+	for _, tt := range []struct {
+		value string
+		load  float64
+		drain time.Duration
+		valid bool
+	}{
+		{"load=0.9", 0.9, 0, true},
+		{"load=0.9;drain=true", 0.9, 10 * time.Second, true},
+		{" drain=30s ; load=2 ", 2, 30 * time.Second, true},
+		{"drain=false", -1, 0, true},
+		{"drain=8760h", -1, time.Minute, true}, // capped
+		{"load=-1", 0, 0, false},
+		{"load=NaN", 0, 0, false},
+		{"load=+Inf", 0, 0, false},
+		{"load=high", 0, 0, false},
+		{"drain=0s", 0, 0, false},
+		{"drain=forever", 0, 0, false},
+		{"load=0.5;load=0.1", 0, 0, false},
+		{"load=0.5;weight=3", 0, 0, false},
+		{"load", 0, 0, false},
+		{"load=0.5;", 0, 0, false},
+	} {
+		r, err := f.parse(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid %t, got %v", tt.value, tt.valid, err)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		if tt.load >= 0 && (r.load == nil || *r.load != tt.load) || tt.load < 0 && r.load != nil {
+			t.Errorf("%q: expected load %g, got %v", tt.value, tt.load, r.load)
+		}
+		if r.drain != tt.drain {
+			t.Errorf("%q: expected drain %s, got %s", tt.value, tt.drain, r.drain)
+		}
+	}
+}
+
+func TestFeedback_RisingLoad(t *testing.T) {
+	var requests atomic.Int64
+	rising := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-LB-Feedback", fmt.Sprintf("load=%g", float64(requests.Add(1))/10))
+		rw.Header().Set("X-Backend", "rising")
+	})
+	steady := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-LB-Feedback", "load=1")
+		rw.Header().Set("X-Backend", "steady")
+	})
+	lb := newTestLoadBalancer(t, []Server{rising, steady},
+		WithStrategy(&leastReportedLoad{now: time.Now}), WithFeedback(Feedback{}))
+
+	served := map[string][]int{}
+	for i := 0; i < 40; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Header().Get("X-LB-Feedback") != "" {
+			t.Fatal("Expected the feedback header not to reach the client")
+		}
+		served[rw.Header().Get("X-Backend")] = append(served[rw.Header().Get("X-Backend")], i)
+	}
+	// The rising server takes the requests while its load is below 1, then
+	// ties once and loses every request after
+	if len(served["rising"]) != 11 || len(served["steady"]) != 29 {
+		t.Errorf("Expected the rising server to lose its share, got %v", served)
+	}
+	if last := served["rising"][len(served["rising"])-1]; last > 12 {
+		t.Errorf("Expected the rising server to stop being selected, got request %d", last)
+	}
+	if report := lb.Stats()[0].ReportedLoad; report == nil || report.Load != 1.1 || report.Stale {
+		t.Errorf("Expected the last reported load of the rising server, got %+v", report)
+	}
+}
+
+func TestFeedback_Drain(t *testing.T) {
+	var drain atomic.Bool
+	draining := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		if drain.Load() {
+			rw.Header().Set("X-Drain-Me", "drain=8760h")
+		}
+		rw.Header().Set("X-Backend", "draining")
+	}, WithLabels(map[string]string{"feedback": "trusted"}))
+	untrusted := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Drain-Me", "drain=true")
+		rw.Header().Set("X-Backend", "untrusted")
+	})
+	lb := newTestLoadBalancer(t, []Server{draining, untrusted}, WithFeedback(Feedback{
+		Header:   "X-Drain-Me",
+		Selector: Selector{{Key: "feedback", Operator: OpEquals, Values: []string{"trusted"}}},
+		MaxDrain: 30 * time.Second,
+	}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	sub := lb.Subscribe(16)
+	defer sub.Close()
+	breakerEvents := func() []string {
+		var got []string
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == EventBreakerOpened || e.Type == EventBreakerClosed {
+					got = append(got, string(e.Type)+" "+e.Reason)
+				}
+			default:
+				return got
+			}
+		}
+	}
+	serve := func() string {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Header().Get("X-Drain-Me") != "" {
+			t.Fatal("Expected the feedback header not to reach the client")
+		}
+		return rw.Header().Get("X-Backend")
+	}
+
+	// The untrusted server's drain requests are ignored
+	for i := 0; i < 4; i++ {
+		serve()
+	}
+	drain.Store(true)
+	if got := serve(); got != "draining" {
+		t.Fatalf("Expected round-robin to reach the draining server, got %s", got)
+	}
+	drain.Store(false)
+	until := lb.Stats()[0].BackoffUntil
+	if until == nil || !until.Equal(now.Add(30*time.Second)) {
+		t.Fatalf("Expected the drain to be capped at 30s, got %v", until)
+	}
+	for i := 0; i < 4; i++ {
+		if got := serve(); got != "untrusted" {
+			t.Fatalf("Expected the draining server to be out of selection, got %s", got)
+		}
+	}
+
+	now = now.Add(30 * time.Second)
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		served[serve()]++
+	}
+	if served["draining"] != 2 || lb.Stats()[0].BackoffUntil != nil {
+		t.Errorf("Expected the server back after its drain, got %v", served)
+	}
+	if got := breakerEvents(); !slices.Equal(got, []string{"breaker_opened feedback", "breaker_closed feedback"}) {
+		t.Errorf("Expected the backoff to open and close the breaker once, got %v", got)
+	}
+}
+
+func TestFeedback_BackoffEndsWithoutTraffic(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server}, WithFeedback(Feedback{Header: "X-Drain-Me"}))
+	sub := lb.Subscribe(4)
+	defer sub.Close()
+
+	lb.heedFeedback(server, feedbackReport{drain: 20 * time.Millisecond})
+	lb.heedFeedback(server, feedbackReport{drain: 40 * time.Millisecond})
+	var got []EventType
+	for len(got) < 2 {
+		select {
+		case e := <-sub.C:
+			got = append(got, e.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the backoff to end on its own, got %v", got)
+		}
+	}
+	if !slices.Equal(got, []EventType{EventBreakerOpened, EventBreakerClosed}) {
+		t.Errorf("Expected one open and one close event for the extended backoff, got %v", got)
+	}
+	if stats := lb.Stats()[0]; stats.BackoffUntil != nil {
+		t.Errorf("Expected the backoff to be over, got %v", stats.BackoffUntil)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// FirstByteTimed is implemented by servers that must start responding
+// within a time limit.
+type FirstByteTimed interface {
+	FirstByteTimeout() time.Duration
+}
+
+// WithFirstByteTimeout limits how long the server may take to send the
+// first byte of a response, as the route's first byte timeout does.
+func WithFirstByteTimeout(d time.Duration) ServerOption {
+	return func(s *simpleServer) {
+		s.firstByte = d
+	}
+}
+
+func (s *simpleServer) FirstByteTimeout() time.Duration {
+	return s.firstByte
+}
+
+// firstByteTimeoutFor returns the first byte timeout of an attempt of req
+// on server: the route's, or else the server's, or 0 for none.
+func (lb *LoadBalancer) firstByteTimeoutFor(req *http.Request, server Server) time.Duration {
+	if route := lb.matchRoute(req); route != nil && route.FirstByteTimeout > 0 {
+		return route.FirstByteTimeout
+	}
+	if t, ok := server.(FirstByteTimed); ok {
+		return t.FirstByteTimeout()
+	}
+
+	return 0
+}
+
+// withFirstByteTimeout returns the context of an attempt that is canceled
+// with ErrFirstByteTimeout unless w sees the first byte of the response
+// within d, and the function ending the attempt. A d of 0 sets no timeout.
+func (w *attemptWriter) withFirstByteTimeout(ctx context.Context, d time.Duration) (context.Context, func()) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	w.firstByte = time.AfterFunc(d, func() { cancel(ErrFirstByteTimeout) })
+
+	return ctx, func() {
+		w.firstByte.Stop()
+		cancel(nil)
+	}
+}
+
+// awaitFirstByte waits for the first byte of the body of resp, so that a
+// server sending its headers at once but stalling before the body fails the
+// attempt before anything reaches the client. It returns
+// ErrFirstByteTimeout if the timeout expired first.
+func (w *attemptWriter) awaitFirstByte(resp *http.Response) error {
+	if w.firstByte == nil {
+		return nil
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == http.NoBody || resp.ContentLength == 0 ||
+		resp.Request.Method == http.MethodHead {
+		w.firstByte.Stop()
+		return nil
+	}
+	br := bufio.NewReader(resp.Body)
+	_, err := br.Peek(1)
+	// The timeout may expire just as the byte arrives, canceling the
+	// attempt all the same.
+	if !w.firstByte.Stop() && errors.Is(context.Cause(resp.Request.Context()), ErrFirstByteTimeout) {
+		if err == nil {
+			err = context.Canceled
+		}
+		return fmt.Errorf("%w: %v", ErrFirstByteTimeout, err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+
+	return nil
+}
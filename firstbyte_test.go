@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingHandler answers after delay, or when the request is canceled,
+// optionally sending its headers first.
+func stallingHandler(delay time.Duration, headersFirst bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if headersFirst {
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		io.WriteString(rw, "late")
+	}
+}
+
+func TestFirstByteTimeout_Retried(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		headersFirst bool
+	}{
+		{"headers", false},
+		{"body", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &syncBuffer{}
+			stalled := newBackendServer(t, stallingHandler(2*time.Second, tt.headersFirst))
+			healthy := newBackendServer(t, okHandler)
+			lb := newTestLoadBalancer(t, []Server{stalled, healthy},
+				WithRoutes(Route{PathPrefix: "/", FirstByteTimeout: 100 * time.Millisecond}),
+				WithRetryPolicy(RetryPolicy{Attempts: 2, On: []ErrorClass{ClassFirstByteTimeout}}),
+				WithAccessLog(log))
+
+			rw := httptest.NewRecorder()
+			start := time.Now()
+			lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+			if rw.Code != http.StatusOK || rw.Header().Get("X-Backend") != "ok" {
+				t.Fatalf("Expected the healthy backend to answer, got %d from %q", rw.Code, rw.Header().Get("X-Backend"))
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected the stalled attempt to be cut off, took %s", elapsed)
+			}
+			upstream := accessLogEntries(t, log)[0]["upstream"].([]any)
+			if len(upstream) != 2 || upstream[0].(map[string]any)["error_class"] != string(ClassFirstByteTimeout) {
+				t.Errorf("Expected a first byte timeout then a success, got %v", upstream)
+			}
+		})
+	}
+}
+
+func TestFirstByteTimeout_NotRetried(t *testing.T) {
+	stalled := newBackendServer(t, stallingHandler(2*time.Second, false), WithFirstByteTimeout(100*time.Millisecond))
+	lb := newTestLoadBalancer(t, []Server{stalled})
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for a server-level first byte timeout, got %d", rw.Code)
+	}
+}
+
+func TestFirstByteTimeout_SlowStream(t *testing.T) {
+	streaming := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(rw, "chunk\n")
+			rw.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	})
+	lb := newTestLoadBalancer(t, []Server{streaming},
+		WithRoutes(Route{PathPrefix: "/", FirstByteTimeout: 100 * time.Millisecond}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != strings.Repeat("chunk\n", 3) {
+		t.Errorf("Expected the slow stream to complete, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestFirstByteTimeout_ConfigDump(t *testing.T) {
+	var cfg Config
+	data := `{
+		"port": "8000",
+		"servers": [{"address": "http://server1.com", "first_byte_timeout": "1s"}],
+		"routes": [{"name": "events", "path_prefix": "/events", "first_byte_timeout": "500ms"}],
+		"deadline": {"timeout": "30s"}
+	}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lb.routeList()[0].FirstByteTimeout; got != 500*time.Millisecond {
+		t.Errorf("Expected a route first byte timeout of 500ms, got %s", got)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/config", nil))
+	for _, want := range []string{`"first_byte_timeout":"500ms"`, `"first_byte_timeout":"1s"`, `"timeout":"30s"`} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected the config dump to contain %s, got %s", want, rw.Body.String())
+		}
+	}
+}
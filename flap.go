@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultHealthHistory is the number of health transitions kept per server.
+const defaultHealthHistory = 16
+
+// HealthTransition is a change of a server's liveness.
+type HealthTransition struct {
+	Time  time.Time `json:"time"`
+	Alive bool      `json:"alive"`
+}
+
+// FlapDetection holds down servers whose health flaps. A server with more
+// than Transitions health transitions within Window is flapping and kept out
+// of selection until it has been alive for Quiet without a transition.
+type FlapDetection struct {
+	Transitions int
+	Window      time.Duration
+	Quiet       time.Duration
+}
+
+// WithFlapDetection enables flap detection.
+func WithFlapDetection(f FlapDetection) Option {
+	return func(lb *LoadBalancer) {
+		lb.flap = &f
+	}
+}
+
+// WithHealthHistory sets the number of health transitions kept per server,
+// 16 by default.
+func WithHealthHistory(size int) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthHistorySize = size
+	}
+}
+
+// healthHistory tracks the health transitions of a server. The first
+// observation only sets the baseline.
+type healthHistory struct {
+	observed    bool
+	alive       bool
+	transitions []HealthTransition
+	flapping    bool
+	flaps       uint64
+}
+
+// observeHealth records the liveness of server after a probe or health
+// update, detecting flapping and releasing servers that have been quiet.
+func (lb *LoadBalancer) observeHealth(server Server) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.observeHealthLocked(server)
+}
+
+// observeHealthLocked is observeHealth with lb.mu held.
+func (lb *LoadBalancer) observeHealthLocked(server Server) {
+	addr := serverName(server)
+	h := lb.health[addr]
+	if h == nil {
+		h = &healthHistory{}
+		lb.health[addr] = h
+	}
+	alive, now := server.IsAlive(), lb.now()
+	if !h.observed {
+		h.observed, h.alive = true, alive
+		return
+	}
+
+	if alive != h.alive {
+		h.alive = alive
+		size := lb.healthHistorySize
+		if size <= 0 {
+			size = defaultHealthHistory
+		}
+		if lb.flap != nil {
+			// Flaps are counted in the history, which must hold them.
+			size = max(size, lb.flap.Transitions+1)
+		}
+		if len(h.transitions) >= size {
+			h.transitions = append(h.transitions[:0], h.transitions[len(h.transitions)-size+1:]...)
+		}
+		h.transitions = append(h.transitions, HealthTransition{Time: now, Alive: alive})
+		lb.events.publish(healthEvent(server, alive, "probe"))
+		if !alive {
+			// A fading server that goes down is drained at once.
+			lb.endFadeLocked(addr)
+		}
+	}
+	if lb.flap == nil {
+		return
+	}
+
+	recent := 0
+	for _, t := range h.transitions {
+		if now.Sub(t.Time) <= lb.flap.Window {
+			recent++
+		}
+	}
+	switch {
+	case !h.flapping && recent > lb.flap.Transitions:
+		h.flapping = true
+		h.flaps++
+		fmt.Printf("server %s is flapping (%d health transitions in %s), holding it down\n", addr, recent, lb.flap.Window)
+		lb.events.publish(Event{Type: EventBreakerOpened, Backend: addr, Reason: "flapping"})
+	case h.flapping && alive && now.Sub(h.transitions[len(h.transitions)-1].Time) >= lb.flap.Quiet:
+		h.flapping = false
+		fmt.Printf("server %s is stable again after %s\n", addr, lb.flap.Quiet)
+		lb.events.publish(Event{Type: EventBreakerClosed, Backend: addr, Reason: "flapping"})
+	}
+}
+
+// flappingLocked reports whether the server with the given name is held
+// down for flapping. lb.mu must be held.
+func (lb *LoadBalancer) flappingLocked(addr string) bool {
+	h := lb.health[addr]
+	return h != nil && h.flapping
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlapDetection_HoldsDownAndReleases(t *testing.T) {
+	flappy := newCapableServer("http://flappy.com", 1)
+	steady := newCapableServer("http://steady.com", 1)
+	lb := newTestLoadBalancer(t, []Server{flappy, steady},
+		WithFlapDetection(FlapDetection{Transitions: 3, Window: time.Minute, Quiet: 2 * time.Minute}),
+		WithHealthHistory(4))
+	now := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	probe := func(alive bool) {
+		flappy.SetAlive(alive)
+		lb.observeHealth(flappy)
+		now = now.Add(10 * time.Second)
+	}
+	selected := func() string {
+		server, err := lb.getNextAvailableServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server.Address()
+	}
+
+	// Up, down, up, down: three transitions are tolerated
+	for _, alive := range []bool{true, false, true, false} {
+		probe(alive)
+	}
+	if lb.Stats()[0].Flapping {
+		t.Fatalf("Expected three transitions not to count as flapping")
+	}
+	probe(true)
+	stats := lb.Stats()[0]
+	if !stats.Flapping || stats.Flaps != 1 {
+		t.Fatalf("Expected the fourth transition within a minute to mark the server flapping, got %+v", stats)
+	}
+	if len(stats.HealthHistory) != 4 || !stats.HealthHistory[3].Alive {
+		t.Errorf("Expected the last 4 transitions, got %+v", stats.HealthHistory)
+	}
+	for i := 0; i < 4; i++ {
+		if addr := selected(); addr != steady.addr {
+			t.Fatalf("Expected the flapping server to be held down although alive, got %s", addr)
+		}
+	}
+
+	// Healthy but not yet quiet for long enough
+	for i := 0; i < 11; i++ {
+		probe(true)
+	}
+	if !lb.Stats()[0].Flapping {
+		t.Fatalf("Expected the server to stay held down during the quiet period")
+	}
+	probe(true)
+	if lb.Stats()[0].Flapping {
+		t.Fatalf("Expected the server to be released after two quiet minutes")
+	}
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		counts[selected()]++
+	}
+	if counts[flappy.addr] != 2 {
+		t.Errorf("Expected the released server back in rotation, got %v", counts)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_server_flapping{server="http://flappy.com"} 0`, `lb_server_flaps_total{server="http://flappy.com"} 1`} {
+		if !strings.Contains(metrics.Body.String(), want+"\n") {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestFlapDetection_HistoryWithoutDetection(t *testing.T) {
+	server := newCapableServer("http://server1.com", 1)
+	lb := newTestLoadBalancer(t, []Server{server}, WithHealthHistory(2))
+
+	for i := 0; i < 10; i++ {
+		server.SetAlive(i%2 == 0)
+		lb.observeHealth(server)
+	}
+	stats := lb.Stats()[0]
+	if len(stats.HealthHistory) != 2 || stats.Flapping {
+		t.Errorf("Expected a history of 2 transitions and no flap detection, got %+v", stats)
+	}
+	if _, err := lb.getNextAvailableServer(); !errors.Is(err, ErrNoAvailableServers) {
+		t.Errorf("Expected only liveness to apply, got %v", err)
+	}
+}
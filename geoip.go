@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultGeoIPReloadInterval = time.Minute
+
+// GeoLocation is where a client address is registered, as ISO 3166 country
+// and two letter continent codes, e.g. "DE" and "EU".
+type GeoLocation struct {
+	Country   string
+	Continent string
+}
+
+// GeoIPReader looks up the location of client addresses.
+type GeoIPReader interface {
+	// Lookup returns the location of addr, if known.
+	Lookup(addr netip.Addr) (GeoLocation, bool)
+}
+
+// GeoIP resolves the location of each client from its address. The
+// location is looked up in the MaxMind DB at Path, which is checked for
+// changes every ReloadInterval, a minute by default, or in Reader if set.
+// Private, loopback and link-local addresses, and addresses the database
+// does not know, are given the Default location.
+//
+// Regions maps country codes, or continent codes for countries not listed,
+// to the region serving them. Requests prefer servers whose RegionLabel
+// label names their region, falling back to the other servers when none of
+// the region is available. The country is set in Header on requests to
+// servers, if set, replacing any value sent by the client.
+type GeoIP struct {
+	Path           string
+	Reader         GeoIPReader
+	ReloadInterval time.Duration
+	Default        GeoLocation
+	Regions        map[string]string
+	RegionLabel    string
+	Header         string
+}
+
+// WithGeoIP resolves the location of clients, for routing by country and
+// region.
+func WithGeoIP(g GeoIP) Option {
+	return func(lb *LoadBalancer) {
+		if g.ReloadInterval <= 0 {
+			g.ReloadInterval = defaultGeoIPReloadInterval
+		}
+		lb.geo = &geoIPResolver{config: g, requests: make(map[string]uint64)}
+		if g.Reader != nil {
+			lb.geo.db.Store(&geoDatabase{reader: g.Reader})
+		}
+	}
+}
+
+// geoDatabase is a loaded GeoIP database and the file it was read from.
+type geoDatabase struct {
+	reader  GeoIPReader
+	modTime time.Time
+	size    int64
+}
+
+// geoIPResolver resolves client locations with the current database.
+type geoIPResolver struct {
+	config GeoIP
+	db     atomic.Pointer[geoDatabase]
+
+	mu       sync.Mutex
+	requests map[string]uint64
+
+	reloads      atomic.Uint64
+	reloadErrors atomic.Uint64
+}
+
+// load reads the database at the configured path if it changed since it
+// was last read.
+func (g *geoIPResolver) load() error {
+	info, err := os.Stat(g.config.Path)
+	if err != nil {
+		return err
+	}
+	if db := g.db.Load(); db != nil && db.modTime.Equal(info.ModTime()) && db.size == info.Size() {
+		return nil
+	}
+	reader, err := OpenMaxMindDB(g.config.Path)
+	if err != nil {
+		return err
+	}
+	g.db.Store(&geoDatabase{reader: reader, modTime: info.ModTime(), size: info.Size()})
+	g.reloads.Add(1)
+
+	return nil
+}
+
+// LoadGeoIP reads the GeoIP database from its path, if one is configured.
+func (lb *LoadBalancer) LoadGeoIP() error {
+	if lb.geo == nil || lb.geo.config.Reader != nil || lb.geo.config.Path == "" {
+		return nil
+	}
+
+	return lb.geo.load()
+}
+
+// RunGeoIPReload reloads the GeoIP database whenever its file changes until
+// ctx is done. If a changed file cannot be read, the database in use is
+// kept.
+func (lb *LoadBalancer) RunGeoIPReload(ctx context.Context) {
+	if lb.geo == nil || lb.geo.config.Reader != nil || lb.geo.config.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(lb.geo.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			markActive(ctx)
+			if err := lb.geo.load(); err != nil {
+				lb.geo.reloadErrors.Add(1)
+				fmt.Printf("error: reload geoip database: %v\n", err)
+			}
+		}
+	}
+}
+
+// resolve returns the location of the client at addr.
+func (g *geoIPResolver) resolve(addr netip.Addr) GeoLocation {
+	if !addr.IsValid() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return g.config.Default
+	}
+	db := g.db.Load()
+	if db == nil {
+		return g.config.Default
+	}
+	loc, ok := db.reader.Lookup(addr)
+	if !ok {
+		return g.config.Default
+	}
+
+	return loc
+}
+
+// region returns the region serving loc, if any.
+func (g *geoIPResolver) region(loc GeoLocation) string {
+	if region, ok := g.config.Regions[loc.Country]; ok && loc.Country != "" {
+		return region
+	}
+	if loc.Continent == "" {
+		return ""
+	}
+
+	return g.config.Regions[loc.Continent]
+}
+
+// locateClient resolves the location of the client of req, stores it in
+// the request's info and sets the configured header to its country.
+func (lb *LoadBalancer) locateClient(req *http.Request) {
+	info := requestInfo(req)
+	if lb.geo == nil || info == nil {
+		return
+	}
+	addr, _ := clientAddr(req)
+	loc := lb.geo.resolve(addr)
+	country := loc.Country
+	if country == "" {
+		country = "unknown"
+	}
+	lb.geo.mu.Lock()
+	lb.geo.requests[country]++
+	lb.geo.mu.Unlock()
+
+	if h := lb.geo.config.Header; h != "" {
+		if loc.Country != "" {
+			req.Header.Set(h, loc.Country)
+		} else {
+			req.Header.Del(h)
+		}
+	}
+
+	info.location, info.located = loc, true
+}
+
+// clientCountry returns the country of the client of req, if known.
+func clientCountry(req *http.Request) string {
+	return requestInfo(req).Country()
+}
+
+// geoSelector returns the selector of the servers of the region of the
+// client of req, if any.
+func (lb *LoadBalancer) geoSelector(req *http.Request) Selector {
+	if lb.geo == nil || lb.geo.config.RegionLabel == "" {
+		return nil
+	}
+	info := requestInfo(req)
+	if info == nil || !info.located {
+		return nil
+	}
+	region := lb.geo.region(info.location)
+	if region == "" {
+		return nil
+	}
+
+	return Selector{{Key: lb.geo.config.RegionLabel, Operator: OpEquals, Values: []string{region}}}
+}
+
+// writeMetrics renders the requests by client country and the database
+// reloads.
+func (g *geoIPResolver) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	countries := make([]string, 0, len(g.requests))
+	for country := range g.requests {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	fmt.Fprintln(w, "# HELP lb_geoip_requests_total Requests by client country.")
+	fmt.Fprintln(w, "# TYPE lb_geoip_requests_total counter")
+	for _, country := range countries {
+		fmt.Fprintf(w, "lb_geoip_requests_total{country=%q} %d\n", country, g.requests[country])
+	}
+	g.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_geoip_reloads_total GeoIP database loads, by result.")
+	fmt.Fprintln(w, "# TYPE lb_geoip_reloads_total counter")
+	fmt.Fprintf(w, "lb_geoip_reloads_total{result=\"success\"} %d\n", g.reloads.Load())
+	fmt.Fprintf(w, "lb_geoip_reloads_total{result=\"error\"} %d\n", g.reloadErrors.Load())
+}
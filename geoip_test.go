@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGeoIP is a GeoIPReader locating the addresses of a few prefixes.
+type fakeGeoIP map[netip.Prefix]GeoLocation
+
+func (f fakeGeoIP) Lookup(addr netip.Addr) (GeoLocation, bool) {
+	for prefix, loc := range f {
+		if prefix.Contains(addr) {
+			return loc, true
+		}
+	}
+
+	return GeoLocation{}, false
+}
+
+var testGeoIP = fakeGeoIP{
+	netip.MustParsePrefix("81.2.69.0/24"):  {Country: "DE", Continent: "EU"},
+	netip.MustParsePrefix("8.8.8.0/24"):    {Country: "US", Continent: "NA"},
+	netip.MustParsePrefix("175.16.0.0/16"): {Country: "CN", Continent: "AS"},
+}
+
+// geoGet sends a GET request for path from the client at remote.
+func geoGet(lb *LoadBalancer, path, remote string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remote + ":5000"
+	req.Header.Set("X-Client-Country", "FR")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	return rw
+}
+
+func TestGeoIP_RoutesByRegion(t *testing.T) {
+	regional := func(region string) Server {
+		return newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(region + ":" + req.Header.Get("X-Client-Country")))
+		}, WithLabels(map[string]string{"region": region}))
+	}
+	lb := newTestLoadBalancer(t, []Server{regional("eu"), regional("us")}, WithGeoIP(GeoIP{
+		Reader:      testGeoIP,
+		Default:     GeoLocation{Continent: "NA"},
+		Regions:     map[string]string{"DE": "eu", "NA": "us"},
+		RegionLabel: "region",
+		Header:      "X-Client-Country",
+	}))
+
+	for _, tt := range []struct {
+		remote string
+		want   string
+	}{
+		{"81.2.69.10", "eu:DE"},
+		{"8.8.8.8", "us:US"},
+		{"203.0.113.9", "us:"},
+		{"10.1.2.3", "us:"},
+	} {
+		for range 4 {
+			if rw := geoGet(lb, "/", tt.remote); rw.Body.String() != tt.want {
+				t.Errorf("Expected %s to be served by %q, got %q", tt.remote, tt.want, rw.Body.String())
+			}
+		}
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`lb_geoip_requests_total{country="DE"} 4`,
+		`lb_geoip_requests_total{country="US"} 4`,
+		`lb_geoip_requests_total{country="unknown"} 8`,
+	} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
+
+func TestGeoIP_RegionFallback(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {},
+		WithLabels(map[string]string{"region": "us"}))
+	lb := newTestLoadBalancer(t, []Server{server}, WithGeoIP(GeoIP{
+		Reader:      testGeoIP,
+		Regions:     map[string]string{"AS": "ap"},
+		RegionLabel: "region",
+	}))
+
+	if rw := geoGet(lb, "/", "175.16.1.1"); rw.Code != http.StatusOK {
+		t.Errorf("Expected a region without servers to fall back to the others, got %d", rw.Code)
+	}
+}
+
+func TestGeoIP_CountryRoutes(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}},
+		WithGeoIP(GeoIP{Reader: testGeoIP}),
+		WithRoutes(
+			Route{Name: "dach", PathPrefix: "/", Countries: []string{"DE", "AT", "CH"}, Static: &StaticResponse{Status: http.StatusTeapot}},
+			Route{Name: "rest", PathPrefix: "/", Static: &StaticResponse{Status: http.StatusGone}},
+		))
+
+	for remote, want := range map[string]int{
+		"81.2.69.10":  http.StatusTeapot,
+		"8.8.8.8":     http.StatusGone,
+		"203.0.113.9": http.StatusGone,
+	} {
+		if rw := geoGet(lb, "/", remote); rw.Code != want {
+			t.Errorf("Expected %s to get %d, got %d", remote, want, rw.Code)
+		}
+	}
+}
+
+// mmdbEncode encodes v, a string, uint32, map or mmdbPtr, in the data
+// section format of a MaxMind DB.
+func mmdbEncode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{mmdbString<<5 | byte(len(v))}, v...)
+	case uint32:
+		return binary.BigEndian.AppendUint32([]byte{mmdbUint32<<5 | 4}, v)
+	case mmdbPtr:
+		return []byte{mmdbPointer<<5 | byte(v>>8), byte(v)}
+	case map[string]any:
+		b := []byte{mmdbMap<<5 | byte(len(v))}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// mmdbPtr is a pointer into the data section, below 2048.
+type mmdbPtr uint16
+
+// buildMMDB returns an IPv6 MaxMind DB with the given record size, mapping
+// each prefix to the data at its offset in data.
+func buildMMDB(recordSize int, data []byte, prefixes map[netip.Prefix]int) []byte {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	dataRecords := map[[2]int]int{}
+	for prefix, offset := range prefixes {
+		addr := prefix.Addr()
+		bits := prefix.Bits()
+		if addr.Is4() {
+			addr = netip.AddrFrom16([16]byte(append(make([]byte, 12), addr.AsSlice()...)))
+			bits += 96
+		}
+		b := addr.As16()
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(b[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				dataRecords[[2]int{node, bit}] = offset
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	n := len(nodes)
+	var tree []byte
+	for i, node := range nodes {
+		var records [2]uint32
+		for bit, next := range node {
+			switch offset, ok := dataRecords[[2]int{i, bit}]; {
+			case ok:
+				records[bit] = uint32(n + 16 + offset)
+			case next == empty:
+				records[bit] = uint32(n)
+			default:
+				records[bit] = uint32(next)
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0x0f)<<4|byte(right>>24&0x0f), byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, left)
+			tree = binary.BigEndian.AppendUint32(tree, right)
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, mmdbEncode(map[string]any{
+		"node_count":  uint32(n),
+		"record_size": uint32(recordSize),
+		"ip_version":  uint32(6),
+	})...)
+}
+
+// testMMDB returns a MaxMind DB locating 81.2.69.0/24 in Germany,
+// 8.8.8.0/24 in the United States and 2001:db8::/32 in Japan, the last
+// through a pointer and the registered country.
+func testMMDB(recordSize int, germany string) []byte {
+	var data []byte
+	record := func(v any) int {
+		offset := len(data)
+		data = append(data, mmdbEncode(v)...)
+		return offset
+	}
+	asia := record(map[string]any{"code": "AS"})
+	de := record(map[string]any{
+		"continent": map[string]any{"code": "EU"},
+		"country":   map[string]any{"iso_code": germany, "geoname_id": uint32(2921044)},
+	})
+	us := record(map[string]any{
+		"continent": map[string]any{"code": "NA"},
+		"country":   map[string]any{"iso_code": "US"},
+	})
+	jp := record(map[string]any{
+		"continent":          mmdbPtr(asia),
+		"registered_country": map[string]any{"iso_code": "JP"},
+	})
+
+	return buildMMDB(recordSize, data, map[netip.Prefix]int{
+		netip.MustParsePrefix("81.2.69.0/24"):  de,
+		netip.MustParsePrefix("8.8.8.0/24"):    us,
+		netip.MustParsePrefix("2001:db8::/32"): jp,
+	})
+}
+
+func TestMaxMindDB_Lookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		db, err := parseMaxMindDB(testMMDB(recordSize, "DE"))
+		if err != nil {
+			t.Fatalf("record size %d: %v", recordSize, err)
+		}
+		for addr, want := range map[string]GeoLocation{
+			"81.2.69.10":        {Country: "DE", Continent: "EU"},
+			"::ffff:81.2.69.10": {Country: "DE", Continent: "EU"},
+			"8.8.8.8":           {Country: "US", Continent: "NA"},
+			"2001:db8::1":       {Country: "JP", Continent: "AS"},
+			"203.0.113.9":       {},
+			"2001:db9::1":       {},
+		} {
+			loc, ok := db.Lookup(netip.MustParseAddr(addr))
+			if loc != want || ok != (want != GeoLocation{}) {
+				t.Errorf("record size %d: expected %s to be located in %v, got %v, %t", recordSize, addr, want, loc, ok)
+			}
+		}
+	}
+
+	if _, err := parseMaxMindDB([]byte("not a database")); err == nil {
+		t.Error("Expected a file without metadata to be rejected")
+	}
+}
+
+func TestGeoIP_ReloadsChangedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, testMMDB(24, "DE"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}},
+		WithGeoIP(GeoIP{Path: path, ReloadInterval: time.Millisecond}))
+	if err := lb.LoadGeoIP(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lb.geo.resolve(netip.MustParseAddr("81.2.69.10")); got.Country != "DE" {
+		t.Fatalf("Expected the database to be loaded, got %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.RunGeoIPReload(ctx)
+
+	if err := os.WriteFile(path+".tmp", testMMDB(28, "AT"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the database to be reloaded", func() bool {
+		return lb.geo.resolve(netip.MustParseAddr("81.2.69.10")).Country == "AT"
+	})
+
+	if err := os.WriteFile(path, []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reload to fail", func() bool { return lb.geo.reloadErrors.Load() > 0 })
+	if got := lb.geo.resolve(netip.MustParseAddr("81.2.69.10")); got.Country != "AT" {
+		t.Errorf("Expected the previous database to be kept, got %v", got)
+	}
+}
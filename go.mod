@@ -1,3 +1,18 @@
 module load-balancer
 
-go 1.22.5
+go 1.24
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/quic-go/quic-go v0.59.0
+	go.uber.org/goleak v1.3.0
+	golang.org/x/crypto v0.41.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// gossipSignatureHeader carries the base64 HMAC-SHA256 of a gossip
+	// message body under the shared key.
+	gossipSignatureHeader = "X-Gossip-Signature"
+
+	// gossipPath is the admin path peers receive messages on.
+	gossipPath = "/admin/gossip"
+
+	defaultGossipTimeout = 2 * time.Second
+	defaultGossipBuffer  = 256
+	maxGossipMessage     = 64 << 10
+)
+
+// Gossip shares what this instance learns about the health of servers with
+// other instances of the load balancer, so that a server one of them finds
+// down stops receiving traffic from all of them without each waiting for
+// its own probes to fail.
+//
+// Servers going down or up in probes, and servers held out of selection by
+// a breaker, are sent to the admin API of each of Peers, given as base
+// URLs, in messages signed with HMAC-SHA256 under Key. A peer told that a
+// server is down probes it at once, outside its probe schedule, or, with
+// TrustFor set, holds it out of selection for TrustFor without probing. A
+// peer told that a server is up releases it and probes it at once. Each
+// message is sent once, within Timeout, 2s by default; a peer that misses
+// one still finds the change in its own probes.
+type Gossip struct {
+	Peers    []string
+	Key      *Secret
+	TrustFor time.Duration
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+// WithGossip shares server health with peers. Messages are sent by
+// RunGossip and received by the admin API.
+func WithGossip(g Gossip) Option {
+	return func(lb *LoadBalancer) {
+		if g.Timeout <= 0 {
+			g.Timeout = defaultGossipTimeout
+		}
+		if g.Client == nil {
+			g.Client = &http.Client{Timeout: g.Timeout}
+		}
+		lb.gossip = &gossiper{
+			config:   g,
+			boot:     time.Now().UnixNano(),
+			seen:     make(map[gossipSource]gossipMark),
+			probing:  make(map[string]bool),
+			sent:     make(map[string]uint64),
+			received: make(map[string]uint64),
+		}
+		lb.peerDown = make(map[string]time.Time)
+	}
+}
+
+// GossipMessage reports that Backend went down or up on the instance
+// Instance. Boot identifies the run of the instance, and Seq numbers its
+// messages within the run, so that peers apply each message once and
+// ignore messages older than one they applied for the same backend.
+type GossipMessage struct {
+	Instance string `json:"instance"`
+	Boot     int64  `json:"boot"`
+	Seq      uint64 `json:"seq"`
+	Backend  string `json:"backend"`
+	Alive    bool   `json:"alive"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// gossipSource is a backend as reported by an instance.
+type gossipSource struct {
+	instance, backend string
+}
+
+// gossipMark is the newest message applied from a source.
+type gossipMark struct {
+	boot int64
+	seq  uint64
+}
+
+// Gossip results reported in metrics.
+const (
+	gossipSent      = "ok"
+	gossipSendError = "failed"
+
+	gossipApplied   = "applied"
+	gossipDuplicate = "duplicate"
+	gossipUnknown   = "unknown_backend"
+	gossipRejected  = "rejected"
+)
+
+// gossiper sends the health changes of this instance and applies those of
+// its peers.
+type gossiper struct {
+	config Gossip
+	boot   int64
+	seq    atomic.Uint64
+
+	mu       sync.Mutex
+	seen     map[gossipSource]gossipMark
+	probing  map[string]bool
+	sent     map[string]uint64
+	received map[string]uint64
+}
+
+func (g *gossiper) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(g.config.Key.Value()))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (g *gossiper) verify(body []byte, signature string) bool {
+	return hmac.Equal([]byte(g.sign(body)), []byte(signature))
+}
+
+// accept reports whether m is newer than every message applied from its
+// source, and records it as applied if so.
+func (g *gossiper) accept(m *GossipMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	source := gossipSource{m.Instance, m.Backend}
+	last, ok := g.seen[source]
+	if ok && (m.Boot < last.boot || m.Boot == last.boot && m.Seq <= last.seq) {
+		return false
+	}
+	g.seen[source] = gossipMark{m.Boot, m.Seq}
+
+	return true
+}
+
+func (g *gossiper) countSent(result string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sent[result]++
+}
+
+func (g *gossiper) countReceived(result string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received[result]++
+}
+
+// writeMetrics renders the messages sent to and received from peers.
+func (g *gossiper) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_gossip_sent_total Health messages sent to peers, by result.")
+	fmt.Fprintln(w, "# TYPE lb_gossip_sent_total counter")
+	for _, result := range []string{gossipSent, gossipSendError} {
+		fmt.Fprintf(w, "lb_gossip_sent_total{result=%q} %d\n", result, g.sent[result])
+	}
+	fmt.Fprintln(w, "# HELP lb_gossip_received_total Health messages received from peers, by result.")
+	fmt.Fprintln(w, "# TYPE lb_gossip_received_total counter")
+	for _, result := range []string{gossipApplied, gossipDuplicate, gossipUnknown, gossipRejected} {
+		fmt.Fprintf(w, "lb_gossip_received_total{result=%q} %d\n", result, g.received[result])
+	}
+}
+
+// RunGossip sends the health changes of servers to the peers until ctx is
+// done. Changes learned from peers are not sent on.
+func (lb *LoadBalancer) RunGossip(ctx context.Context) {
+	if lb.gossip == nil {
+		return
+	}
+	sub := lb.Subscribe(defaultGossipBuffer)
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub.C:
+			markActive(ctx)
+			if m := lb.gossipMessage(e); m != nil {
+				lb.broadcast(ctx, m)
+			}
+		}
+	}
+}
+
+// gossipMessage returns the message reporting e to peers, or nil if e is
+// not shared.
+func (lb *LoadBalancer) gossipMessage(e Event) *GossipMessage {
+	m := &GossipMessage{Instance: lb.instanceID, Boot: lb.gossip.boot, Backend: e.Backend}
+	switch {
+	case e.Type == EventHealthChanged && e.Alive != nil && e.Reason == "probe":
+		m.Alive, m.Reason = *e.Alive, e.Reason
+	case e.Type == EventBreakerOpened:
+		m.Reason = "breaker: " + e.Reason
+	default:
+		return nil
+	}
+	m.Seq = lb.gossip.seq.Add(1)
+
+	return m
+}
+
+// broadcast sends m to every peer, waiting for all of them so that each
+// peer receives the messages in order.
+func (lb *LoadBalancer) broadcast(ctx context.Context, m *GossipMessage) {
+	g := lb.gossip
+	body, err := json.Marshal(m)
+	if err != nil {
+		fmt.Printf("error: gossip: %v\n", err)
+		return
+	}
+	signature := g.sign(body)
+
+	var wg sync.WaitGroup
+	for _, peer := range g.config.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.send(ctx, peer, body, signature); err != nil {
+				g.countSent(gossipSendError)
+				fmt.Printf("error: gossip to %s: %v\n", peer, err)
+				return
+			}
+			g.countSent(gossipSent)
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *gossiper) send(ctx context.Context, peer string, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(ctx, g.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+gossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gossipSignatureHeader, signature)
+	resp, err := g.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxGossipMessage))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("peer answered %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// handleGossip applies a message from a peer.
+func (lb *LoadBalancer) handleGossip(rw http.ResponseWriter, req *http.Request) {
+	g := lb.gossip
+	if g == nil {
+		writeJSONError(rw, http.StatusNotFound, errors.New("gossip is not enabled"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxGossipMessage))
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("read message: %w", err))
+		return
+	}
+	if !g.verify(body, req.Header.Get(gossipSignatureHeader)) {
+		g.countReceived(gossipRejected)
+		writeJSONError(rw, http.StatusUnauthorized, errors.New("invalid gossip signature"))
+		return
+	}
+	var m GossipMessage
+	if err := json.Unmarshal(body, &m); err != nil || m.Instance == "" || m.Backend == "" {
+		g.countReceived(gossipRejected)
+		writeJSONError(rw, http.StatusBadRequest, errors.New("invalid gossip message"))
+		return
+	}
+
+	lb.applyGossip(&m)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// applyGossip acts on m.
+func (lb *LoadBalancer) applyGossip(m *GossipMessage) {
+	g := lb.gossip
+	if m.Instance == lb.instanceID || !g.accept(m) {
+		g.countReceived(gossipDuplicate)
+		return
+	}
+
+	lb.mu.Lock()
+	server := lb.findServerLocked(m.Backend)
+	if server == nil {
+		lb.mu.Unlock()
+		g.countReceived(gossipUnknown)
+		return
+	}
+	addr, now := serverName(server), lb.now()
+	was := lb.aliveLocked(server, now)
+	if m.Alive {
+		delete(lb.peerDown, addr)
+	} else if g.config.TrustFor > 0 {
+		lb.peerDown[addr] = now.Add(g.config.TrustFor)
+	}
+	if alive := lb.aliveLocked(server, now); alive != was {
+		if alive {
+			fmt.Printf("server %s released by peer %s\n", addr, m.Instance)
+		} else {
+			fmt.Printf("server %s reported down by peer %s, holding it out for %s\n", addr, m.Instance, g.config.TrustFor)
+		}
+		lb.events.publish(healthEvent(server, alive, "peer"))
+	}
+	ctx := lb.healthCtx
+	lb.mu.Unlock()
+	g.countReceived(gossipApplied)
+
+	if lb.queue != nil {
+		lb.queue.notify()
+	}
+	if m.Alive || g.config.TrustFor <= 0 {
+		lb.probeNow(ctx, server)
+	}
+}
+
+// probeNow probes server in the background outside its probe schedule, if
+// health checks are running and no such probe is already underway.
+func (lb *LoadBalancer) probeNow(ctx context.Context, server Server) {
+	checked, ok := server.(healthChecked)
+	if !ok || ctx == nil || checked.healthInterval() == 0 {
+		return
+	}
+	g := lb.gossip
+	addr := serverName(server)
+	g.mu.Lock()
+	if g.probing[addr] {
+		g.mu.Unlock()
+		return
+	}
+	g.probing[addr] = true
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			g.mu.Lock()
+			delete(g.probing, addr)
+			g.mu.Unlock()
+		}()
+		if err := checked.Probe(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("health check of %s failed: %v\n", addr, err)
+		}
+		if ctx.Err() == nil {
+			lb.observeHealth(server)
+		}
+	}()
+}
+
+// peerDownLocked reports whether a peer's report holds the server with the
+// given name out of selection at now. lb.mu must be held.
+func (lb *LoadBalancer) peerDownLocked(addr string, now time.Time) bool {
+	until, ok := lb.peerDown[addr]
+	if ok && !now.Before(until) {
+		delete(lb.peerDown, addr)
+		return false
+	}
+
+	return ok
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gossipPeer is the admin API of an instance, started before the instance
+// exists so that peers can name each other.
+type gossipPeer struct {
+	srv     *httptest.Server
+	handler atomic.Pointer[http.Handler]
+}
+
+func newGossipPeer(t *testing.T) *gossipPeer {
+	p := &gossipPeer{}
+	p.srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		(*p.handler.Load()).ServeHTTP(rw, req)
+	}))
+	t.Cleanup(p.srv.Close)
+
+	return p
+}
+
+func gossipKey(t *testing.T) *Secret {
+	t.Setenv("LB_TEST_GOSSIP_KEY", "gossip-key")
+	key, err := LoadSecret("env:LB_TEST_GOSSIP_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// newGossipInstance returns an instance with its own server for backend,
+// probed every interval, serving its admin API on self.
+func newGossipInstance(t *testing.T, id, backend string, interval time.Duration, self, peer *gossipPeer, g Gossip) (*LoadBalancer, *simpleServer) {
+	server, err := newSimpleServer(backend, WithHealthCheck(HealthCheck{Path: "/health", Interval: interval}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != nil {
+		g.Peers = []string{peer.srv.URL}
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithInstanceID(id), WithGossip(g))
+	if self != nil {
+		handler := lb.AdminHandler()
+		self.handler.Store(&handler)
+	}
+
+	return lb, server
+}
+
+func TestGossip_PeerProbesReportedDownServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	key := gossipKey(t)
+	peerA, peerB := newGossipPeer(t), newGossipPeer(t)
+	a, serverA := newGossipInstance(t, "a", backend.URL, 20*time.Millisecond, peerA, peerB, Gossip{Key: key})
+	b, serverB := newGossipInstance(t, "b", backend.URL, time.Hour, peerB, peerA, Gossip{Key: key})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, lb := range []*LoadBalancer{a, b} {
+		go lb.RunHealthChecks(ctx)
+		go lb.RunGossip(ctx)
+	}
+	waitFor(t, "the first probes", func() bool { return serverA.LastProbe() != nil && serverB.LastProbe() != nil })
+
+	// Only a probes again in time to notice; b learns of it from a.
+	backend.Close()
+	waitFor(t, "b to probe the server reported down", func() bool { return !serverB.IsAlive() })
+	if _, err := b.getNextAvailableServer(); err == nil {
+		t.Error("Expected b to stop selecting the server")
+	}
+
+	rw := httptest.NewRecorder()
+	b.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rw.Body.String(), `lb_gossip_received_total{result="applied"} 1`) {
+		t.Errorf("Expected b to apply one message, got\n%s", rw.Body.String())
+	}
+}
+
+func postGossip(lb *LoadBalancer, m GossipMessage, signature string) int {
+	body, _ := json.Marshal(m)
+	req := httptest.NewRequest("POST", "/admin/gossip", strings.NewReader(string(body)))
+	if signature == "" {
+		signature = lb.gossip.sign(body)
+	}
+	req.Header.Set(gossipSignatureHeader, signature)
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, req)
+
+	return rw.Code
+}
+
+func TestGossip_TrustsPeerForBoundedTime(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	b, server := newGossipInstance(t, "b", backend.URL, time.Hour, nil, nil, Gossip{Key: gossipKey(t), TrustFor: time.Minute})
+	server.alive.Store(true)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	events := b.Subscribe(8)
+	defer events.Close()
+
+	down := GossipMessage{Instance: "a", Boot: 1, Seq: 2, Backend: backend.URL, Reason: "probe"}
+	if code := postGossip(b, down, "forged"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a forged message, got %d", code)
+	}
+	if _, err := b.getNextAvailableServer(); err != nil {
+		t.Fatal("Expected a forged message to be ignored")
+	}
+	if code := postGossip(b, down, ""); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	if _, err := b.getNextAvailableServer(); err == nil {
+		t.Error("Expected the server reported down to be held out")
+	}
+	if e := <-events.C; e.Type != EventHealthChanged || *e.Alive || e.Reason != "peer" {
+		t.Errorf("Expected a health event from the peer, got %+v", e)
+	}
+
+	// Messages are applied once, and never older ones.
+	up := down
+	up.Seq, up.Alive = 1, true
+	postGossip(b, down, "")
+	postGossip(b, up, "")
+	if _, err := b.getNextAvailableServer(); err == nil {
+		t.Error("Expected duplicate and older messages to be ignored")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := b.getNextAvailableServer(); err != nil {
+		t.Errorf("Expected the report to expire, got %v", err)
+	}
+	rw := httptest.NewRecorder()
+	b.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`lb_gossip_received_total{result="applied"} 1`,
+		`lb_gossip_received_total{result="duplicate"} 2`,
+		`lb_gossip_received_total{result="rejected"} 1`,
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestGossipConfig(t *testing.T) {
+	t.Setenv("LB_TEST_GOSSIP_KEY", "gossip-key")
+	cfg := &Config{
+		Servers: []ServerConfig{{Address: "http://localhost:9001"}},
+		Gossip:  &GossipConfig{Peers: []string{"http://lb-2:9090"}, Key: "env:LB_TEST_GOSSIP_KEY", TrustFor: Duration(time.Minute)},
+	}
+	if _, err := cfg.Build(); err != nil {
+		t.Fatalf("Expected gossip to build, got %v", err)
+	}
+
+	for _, bad := range []GossipConfig{
+		{Key: "env:LB_TEST_GOSSIP_KEY"},
+		{Peers: []string{"lb-2:9090"}, Key: "env:LB_TEST_GOSSIP_KEY"},
+		{Peers: []string{"http://lb-2:9090"}, Key: "env:LB_TEST_GOSSIP_MISSING"},
+		{Peers: []string{"http://lb-2:9090"}, Key: "env:LB_TEST_GOSSIP_KEY", TrustFor: Duration(-time.Second)},
+	} {
+		cfg.Gossip = &bad
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected gossip %+v to be rejected", bad)
+		}
+	}
+}
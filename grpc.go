@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes the load balancer answers with.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcHealthServing is the SERVING status of the gRPC health protocol.
+const grpcHealthServing = 1
+
+// isGRPC reports whether req is a gRPC request, by its content type.
+// gRPC-Web requests are not, as they expect HTTP errors.
+func isGRPC(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// grpcCodeFor returns the gRPC status code reporting an HTTP status the
+// load balancer answers with.
+func grpcCodeFor(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge, http.StatusRequestHeaderFieldsTooLarge:
+		return grpcResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case statusClientClosedRequest:
+		return grpcCanceled
+	case http.StatusInternalServerError:
+		return grpcInternal
+	}
+	if status >= 500 {
+		return grpcUnavailable
+	}
+
+	return grpcUnknown
+}
+
+// writeGRPCStatus answers a gRPC request with a trailers-only response
+// carrying the gRPC status for status and message. gRPC clients expect HTTP
+// 200 with the outcome in grpc-status rather than an HTTP error.
+func writeGRPCStatus(rw http.ResponseWriter, status int, message string) {
+	h := rw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcCodeFor(status)))
+	h.Set("Grpc-Message", encodeGRPCMessage(message))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes message for the grpc-message header.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// grpcResponse reports whether rw answers a gRPC request.
+func grpcResponse(rw http.ResponseWriter) bool {
+	cw := countingWriterOf(rw)
+	return cw != nil && cw.grpc
+}
+
+// grpcFrame returns msg as a length-prefixed, uncompressed gRPC message.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+
+	return append(frame, msg...)
+}
+
+// probeGRPC asks target, the Check method of the gRPC health service, for
+// the status of the configured service.
+func (hc *HealthCheck) probeGRPC(ctx context.Context, client *http.Client, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout())
+	defer cancel()
+
+	// HealthCheckRequest has the service name as field 1.
+	var msg []byte
+	if s := hc.GRPCService; s != "" {
+		msg = binary.AppendUvarint([]byte{0x0a}, uint64(len(s)))
+		msg = append(msg, s...)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check %s returned %s", target, resp.Status)
+	}
+	// Trailers-only responses carry the status in the headers.
+	trailer := resp.Trailer
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = resp.Header
+	}
+	if code := trailer.Get("Grpc-Status"); code != strconv.Itoa(grpcOK) {
+		return fmt.Errorf("health check %s returned grpc-status %s: %s", target, code, trailer.Get("Grpc-Message"))
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return fmt.Errorf("health check %s returned a malformed message", target)
+	}
+	if status := grpcHealthStatus(body[5:]); status != grpcHealthServing {
+		return fmt.Errorf("health check %s returned serving status %d", target, status)
+	}
+
+	return nil
+}
+
+// grpcHealthStatus returns the status, field 1, of a HealthCheckResponse.
+// It is 0, UNKNOWN, when absent or malformed.
+func grpcHealthStatus(msg []byte) uint64 {
+	status := uint64(0)
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = v
+			}
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0
+		}
+	}
+
+	return status
+}
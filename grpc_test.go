@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newGRPCStub returns a cleartext HTTP/2 server answering every gRPC method
+// with a message holding name, and health checks of the service name with
+// SERVING.
+func newGRPCStub(t *testing.T, name string) *httptest.Server {
+	stub := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || !isGRPC(req) {
+			http.Error(rw, "gRPC over HTTP/2 required", http.StatusBadRequest)
+			return
+		}
+		request, _ := io.ReadAll(req.Body)
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		if req.URL.Path == "/grpc.health.v1.Health/Check" {
+			status := byte(2) // NOT_SERVING
+			if bytes.Equal(request, grpcFrame(append([]byte{0x0a, byte(len(name))}, name...))) {
+				status = grpcHealthServing
+			}
+			rw.Write(grpcFrame([]byte{0x08, status}))
+		} else {
+			rw.Write(grpcFrame([]byte(name)))
+		}
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	stub.Config.Protocols = new(http.Protocols)
+	stub.Config.Protocols.SetUnencryptedHTTP2(true)
+	stub.Start()
+	t.Cleanup(stub.Close)
+
+	return stub
+}
+
+// grpcCall calls method on the cleartext HTTP/2 server at base.
+func grpcCall(t *testing.T, base, method string) (*http.Response, []byte) {
+	t.Helper()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	req, _ := http.NewRequest(http.MethodPost, base+method, bytes.NewReader(grpcFrame(nil)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, body
+}
+
+func TestGRPC_RoutesByService(t *testing.T) {
+	var servers []Server
+	for _, name := range []string{"a", "b"} {
+		server, err := newSimpleServer(newGRPCStub(t, name).URL, WithH2C(), WithLabels(map[string]string{"service": name}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+	lb := newTestLoadBalancer(t, servers, WithRoutes(
+		Route{GRPCService: "pkg.ServiceA", Selector: Selector{{Key: "service", Operator: OpEquals, Values: []string{"a"}}}, Fallback: FallbackFail},
+		Route{GRPCService: "pkg.ServiceB", Selector: Selector{{Key: "service", Operator: OpEquals, Values: []string{"b"}}}, Fallback: FallbackFail},
+	))
+	front := httptest.NewUnstartedServer(nil)
+	front.Config = lb.NewServer(http.HandlerFunc(lb.serveProxy))
+	front.Start()
+	defer front.Close()
+
+	for method, want := range map[string]string{
+		"/pkg.ServiceA/Get":  "a",
+		"/pkg.ServiceB/Get":  "b",
+		"/pkg.ServiceA/List": "a",
+	} {
+		for range 3 {
+			resp, body := grpcCall(t, front.URL, method)
+			if resp.ProtoMajor != 2 {
+				t.Errorf("Expected HTTP/2 to the client, got %s", resp.Proto)
+			}
+			if !bytes.Equal(body, grpcFrame([]byte(want))) || resp.Trailer.Get("Grpc-Status") != "0" {
+				t.Errorf("Expected %s to reach service %s with its trailers, got %q, %v", method, want, body, resp.Trailer)
+			}
+		}
+	}
+
+	if err := lb.RemoveServer(servers[0].Address()); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := grpcCall(t, front.URL, "/pkg.ServiceA/Get")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "14" || len(body) != 0 {
+		t.Errorf("Expected a trailers-only UNAVAILABLE response, got %d with %v and %q", resp.StatusCode, resp.Header, body)
+	}
+	if resp.Header.Get("Grpc-Message") == "" {
+		t.Error("Expected the failure to be described in grpc-message")
+	}
+}
+
+func TestGRPC_HealthCheck(t *testing.T) {
+	stub := newGRPCStub(t, "pkg.ServiceA")
+	for service, healthy := range map[string]bool{"pkg.ServiceA": true, "pkg.ServiceB": false} {
+		server, err := newSimpleServer(stub.URL, WithH2C(), WithHealthCheck(HealthCheck{GRPC: true, GRPCService: service}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Probe(context.Background()); (err == nil) != healthy || server.IsAlive() != healthy {
+			t.Errorf("Expected %s to be healthy %t, got %v", service, healthy, err)
+		}
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	if got := encodeGRPCMessage("no servers: 100%\n"); got != "no servers: 100%25%0A" {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
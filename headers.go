@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HeaderLimits bounds the request headers forwarded to servers. MaxSize
+// limits a single header, MaxTotal all headers together, both counting the
+// bytes of names and values, and MaxCount the number of header lines.
+// Zero leaves a dimension unlimited. Requests exceeding a limit are
+// rejected with 431 Request Header Fields Too Large.
+type HeaderLimits struct {
+	MaxSize  int
+	MaxTotal int
+	MaxCount int
+}
+
+// WithHeaderLimits sets the header limits of requests whose route has none.
+func WithHeaderLimits(limits HeaderLimits) Option {
+	return func(lb *LoadBalancer) {
+		lb.headerLimits = limits
+	}
+}
+
+// headerLimitsFor returns the header limits applying to req.
+func (lb *LoadBalancer) headerLimitsFor(req *http.Request) HeaderLimits {
+	if route := lb.matchRoute(req); route != nil && route.HeaderLimits != nil {
+		return *route.HeaderLimits
+	}
+
+	return lb.headerLimits
+}
+
+// check returns ErrHeadersTooLarge if header exceeds the limits.
+func (l HeaderLimits) check(header http.Header) error {
+	count, total := 0, 0
+	for name, values := range header {
+		for _, value := range values {
+			size := len(name) + len(value)
+			if l.MaxSize > 0 && size > l.MaxSize {
+				return fmt.Errorf("%w: %s is %d bytes, limit %d", ErrHeadersTooLarge, name, size, l.MaxSize)
+			}
+			count++
+			total += size
+		}
+	}
+	if l.MaxCount > 0 && count > l.MaxCount {
+		return fmt.Errorf("%w: %d headers, limit %d", ErrHeadersTooLarge, count, l.MaxCount)
+	}
+	if l.MaxTotal > 0 && total > l.MaxTotal {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrHeadersTooLarge, total, l.MaxTotal)
+	}
+
+	return nil
+}
+
+// MaxHeaderBytes returns the value for http.Server.MaxHeaderBytes of the
+// proxy listeners: the largest MaxTotal of the load balancer and its
+// routes, or 0 for the net/http default if any of them is unlimited. The
+// server then rejects what no route could accept before the request is
+// parsed in full.
+func (lb *LoadBalancer) MaxHeaderBytes() int {
+	limit := lb.headerLimits.MaxTotal
+	if limit == 0 {
+		return 0
+	}
+	for _, route := range lb.routeList() {
+		if route.HeaderLimits == nil {
+			continue
+		}
+		if route.HeaderLimits.MaxTotal == 0 {
+			return 0
+		}
+		limit = max(limit, route.HeaderLimits.MaxTotal)
+	}
+
+	return limit
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithHeaderLimits(HeaderLimits{MaxSize: 100, MaxTotal: 200, MaxCount: 5}),
+		WithRoutes(Route{Name: "uploads", PathPrefix: "/uploads/", HeaderLimits: &HeaderLimits{MaxSize: 1000}}))
+
+	// Names and values count, so X-Big plus 95 bytes is exactly 100
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"just under every limit", "/", http.Header{
+			"X-Big": {strings.Repeat("a", 95)},
+			"X-A":   {strings.Repeat("b", 47)},
+			"X-B":   {"1", "2", "3"},
+		}, http.StatusOK},
+		{"single header too large", "/", http.Header{"Cookie": {strings.Repeat("a", 95)}}, http.StatusRequestHeaderFieldsTooLarge},
+		{"too many bytes", "/", http.Header{
+			"X-A": {strings.Repeat("a", 90)},
+			"X-B": {strings.Repeat("b", 90)},
+			"X-C": {strings.Repeat("c", 20)},
+		}, http.StatusRequestHeaderFieldsTooLarge},
+		{"too many headers", "/", http.Header{"X-A": {"1", "2", "3"}, "X-B": {"4", "5", "6"}}, http.StatusRequestHeaderFieldsTooLarge},
+		{"route override", "/uploads/x", http.Header{"Cookie": {strings.Repeat("a", 900)}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		calls := server.callCount
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header = tt.header
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != tt.status {
+			t.Errorf("%s: Expected status %d, got %d", tt.name, tt.status, rw.Code)
+		}
+		if want := map[bool]int{true: 1, false: 0}[tt.status == http.StatusOK]; server.callCount-calls != want {
+			t.Errorf("%s: Expected %d backend calls, got %d", tt.name, want, server.callCount-calls)
+		}
+	}
+}
+
+func TestHeaderLimits_MaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		limits HeaderLimits
+		routes []Route
+		want   int
+	}{
+		{HeaderLimits{}, nil, 0},
+		{HeaderLimits{MaxTotal: 8 << 10}, nil, 8 << 10},
+		{HeaderLimits{MaxTotal: 8 << 10}, []Route{{HeaderLimits: &HeaderLimits{MaxTotal: 64 << 10}}, {}}, 64 << 10},
+		{HeaderLimits{MaxTotal: 8 << 10}, []Route{{HeaderLimits: &HeaderLimits{MaxCount: 10}}}, 0},
+	}
+	for i, tt := range tests {
+		lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com"}},
+			WithHeaderLimits(tt.limits), WithRoutes(tt.routes...))
+		if got := lb.MaxHeaderBytes(); got != tt.want {
+			t.Errorf("case %d: Expected %d, got %d", i, tt.want, got)
+		}
+	}
+}
+
+func TestHeaderLimits_Config(t *testing.T) {
+	cfg := &Config{
+		Port:         "8000",
+		Servers:      []ServerConfig{{Address: "http://server1.com"}},
+		HeaderLimits: &HeaderLimitsConfig{MaxCount: 2},
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 3; i++ {
+		req.Header.Set(fmt.Sprintf("X-%d", i), "v")
+	}
+	if err := lb.headerLimitsFor(req).check(req.Header); err == nil {
+		t.Errorf("Expected 3 headers to exceed the configured limit")
+	}
+
+	cfg.HeaderLimits.MaxCount = -1
+	if _, err := cfg.Build(); err == nil {
+		t.Errorf("Expected a negative limit to be rejected")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+
+	// defaultLoadStaleIntervals is how many probe intervals a reported load
+	// stays fresh.
+	defaultLoadStaleIntervals = 3
+)
+
+// HealthCheck configures active probing of a server. The TLS and Host
+// settings are independent of the proxy transport so probes sent to a
+// backend's IP can still present the SNI name and Host its certificate and
+// routing expect.
+type HealthCheck struct {
+	// Path is requested on every probe; any 2xx response marks the server
+	// alive.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Host overrides the Host header of probe requests.
+	Host string
+
+	// ServerName overrides the TLS server name (SNI) used to verify the
+	// backend certificate.
+	ServerName string
+
+	// RootCAs verifies backend certificates instead of the system pool.
+	RootCAs *x509.CertPool
+
+	// InsecureSkipVerify disables certificate verification for probes only.
+	InsecureSkipVerify bool
+
+	// Port probes a different port than the serving one, e.g. an admin port.
+	Port string
+
+	// GRPC probes with the gRPC health checking protocol instead of
+	// requesting Path, asking for the status of GRPCService, or of the
+	// server as a whole if empty. Only SERVING marks the server alive.
+	GRPC        bool
+	GRPCService string
+
+	// LoadPath is the dot separated path of a number in the JSON body of
+	// successful probe responses, such as "load.queue_depth", taken as the
+	// load the server reports. The load is stale after LoadStaleIntervals
+	// probe intervals without a new report, 3 by default. A response
+	// without the number leaves the server alive.
+	LoadPath           string
+	LoadStaleIntervals int
+}
+
+// ProbeResult records the outcome of the most recent health probe. Load is
+// the load the response reported, if any.
+type ProbeResult struct {
+	Time time.Time
+	Err  error
+	Load *float64
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA bundle %s contains no certificates", path)
+	}
+
+	return pool, nil
+}
+
+// newClient returns the HTTP client used to send probes.
+func (hc *HealthCheck) newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		ServerName:         hc.ServerName,
+		RootCAs:            hc.RootCAs,
+		InsecureSkipVerify: hc.InsecureSkipVerify,
+	}
+	if hc.GRPC {
+		// gRPC needs HTTP/2, over cleartext for http:// servers.
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probeURL returns the URL probed for a server serving at base.
+func (hc *HealthCheck) probeURL(base *url.URL) string {
+	target := *base
+	if hc.Port != "" {
+		target.Host = net.JoinHostPort(target.Hostname(), hc.Port)
+	}
+	target.Path = hc.Path
+	if hc.GRPC {
+		target.Path = "/grpc.health.v1.Health/Check"
+	}
+	target.RawQuery = ""
+
+	return target.String()
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval > 0 {
+		return hc.Interval
+	}
+
+	return defaultHealthInterval
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.Timeout > 0 {
+		return hc.Timeout
+	}
+
+	return defaultHealthTimeout
+}
+
+// staleAfter returns how long a reported load stays fresh.
+func (hc *HealthCheck) staleAfter() time.Duration {
+	intervals := hc.LoadStaleIntervals
+	if intervals <= 0 {
+		intervals = defaultLoadStaleIntervals
+	}
+
+	return time.Duration(intervals) * hc.interval()
+}
+
+// probe sends a single health check request to target, returning the load
+// the response reports if LoadPath is set.
+func (hc *HealthCheck) probe(ctx context.Context, client *http.Client, target string) (*float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("health check %s returned %s", target, resp.Status)
+	}
+	if hc.LoadPath == "" {
+		return nil, nil
+	}
+	load, err := jsonNumberAt(body, hc.LoadPath)
+	if err != nil {
+		fmt.Printf("health check %s: reported load: %v\n", target, err)
+		return nil, nil
+	}
+
+	return &load, nil
+}
+
+// jsonNumberAt returns the number at the dot separated path in the JSON
+// document data.
+func jsonNumberAt(data []byte, path string) (float64, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("%s: not found", path)
+		}
+		if v, ok = obj[key]; !ok {
+			return 0, fmt.Errorf("%s: not found", path)
+		}
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s: not a number", path)
+	}
+
+	return n.Float64()
+}
+
+// healthChecked is implemented by servers that can be actively probed.
+// setProbe applies the result of a probe shared through a HealthRegistry.
+type healthChecked interface {
+	Server
+	probeReporter
+	healthCheck() *HealthCheck
+	healthInterval() time.Duration
+	Probe(ctx context.Context) error
+	setProbe(result *ProbeResult)
+}
+
+// probeReporter is implemented by servers that remember their last probe.
+type probeReporter interface {
+	LastProbe() *ProbeResult
+}
+
+// RunHealthChecks probes every server that has a health check configured at
+// its interval until ctx is done. Servers added later are probed as well.
+func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
+	lb.mu.Lock()
+	lb.healthCtx = ctx
+	for _, s := range lb.servers {
+		lb.startHealthCheckLocked(s)
+	}
+	lb.mu.Unlock()
+
+	<-ctx.Done()
+}
+
+// startHealthCheckLocked starts the probe loop of server if health checks are
+// running and the server supports them, or subscribes it to the shared probe
+// of its backend with a health registry. lb.mu must be held.
+func (lb *LoadBalancer) startHealthCheckLocked(server Server) {
+	checked, ok := server.(healthChecked)
+	if !ok || lb.healthCtx == nil || checked.healthInterval() == 0 {
+		return
+	}
+
+	if lb.healthRegistry != nil {
+		lb.healthCancels[serverName(server)] = lb.healthRegistry.subscribe(lb.healthCtx, checked, func() { lb.observeHealth(server) })
+		return
+	}
+	ctx, cancel := context.WithCancel(lb.healthCtx)
+	lb.healthCancels[serverName(server)] = cancel
+	lb.Go(ctx, "health check of "+serverName(server), func(ctx context.Context) {
+		ticker := time.NewTicker(checked.healthInterval())
+		defer ticker.Stop()
+		for {
+			markActive(ctx)
+			if err := checked.Probe(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("health check of %s failed: %v\n", serverName(server), err)
+			}
+			if ctx.Err() == nil {
+				lb.observeHealth(server)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// stopHealthCheckLocked stops the probe loop of the server with the given
+// address. lb.mu must be held.
+func (lb *LoadBalancer) stopHealthCheckLocked(addr string) {
+	if cancel, ok := lb.healthCancels[addr]; ok {
+		cancel()
+		delete(lb.healthCancels, addr)
+	}
+}
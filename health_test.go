@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate valid only for dnsName, and a
+// pool trusting it.
+func newTestCert(t *testing.T, dnsName string, lifetime time.Duration) (tls.Certificate, *x509.CertPool, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool, certPEM
+}
+
+// newTLSBackend starts a TLS server presenting a certificate for dnsName only.
+func newTLSBackend(t *testing.T, dnsName string, handler http.Handler) (*httptest.Server, *x509.CertPool, []byte) {
+	cert, pool, certPEM := newTestCert(t, dnsName, 24*time.Hour)
+	backend := httptest.NewUnstartedServer(handler)
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	return backend, pool, certPEM
+}
+
+func TestHealthCheck_ServerNameAndHost(t *testing.T) {
+	backend, pool, certPEM := newTLSBackend(t, "backend.internal", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" || req.Host != "api.example.com" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	// Probing by IP without SNI control fails certificate verification
+	plain, _ := newSimpleServer(backend.URL, WithHealthCheck(HealthCheck{Path: "/healthz", RootCAs: pool}))
+	if err := plain.Probe(context.Background()); err == nil || plain.IsAlive() {
+		t.Errorf("Expected probe without server name to fail verification")
+	}
+
+	// The SNI name alone is not enough when the backend routes by Host
+	sniOnly, _ := newSimpleServer(backend.URL, WithHealthCheck(HealthCheck{
+		Path: "/healthz", RootCAs: pool, ServerName: "backend.internal",
+	}))
+	if err := sniOnly.Probe(context.Background()); err == nil {
+		t.Errorf("Expected probe without Host override to get 404")
+	}
+
+	// A CA bundle loaded from a file, the server name and the Host header
+	// together mimic real traffic
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, certPEM, 0o644)
+	hc, err := (&HealthCheckConfig{
+		Path: "/healthz", CAFile: caFile, ServerName: "backend.internal", Host: "api.example.com",
+	}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := newSimpleServer(backend.URL, WithHealthCheck(hc))
+	full.SetAlive(false)
+	if err := full.Probe(context.Background()); err != nil || !full.IsAlive() {
+		t.Errorf("Expected probe with server name and host to succeed, got %v", err)
+	}
+	if probe := full.LastProbe(); probe == nil || probe.Err != nil {
+		t.Errorf("Expected a successful last probe, got %+v", probe)
+	}
+
+	// Skipping verification works independently of the proxy transport
+	insecure, _ := newSimpleServer(backend.URL, WithHealthCheck(HealthCheck{
+		Path: "/healthz", Host: "api.example.com", InsecureSkipVerify: true,
+	}))
+	if err := insecure.Probe(context.Background()); err != nil {
+		t.Errorf("Expected insecure probe to succeed, got %v", err)
+	}
+}
+
+func TestHealthCheck_AlternatePort(t *testing.T) {
+	serving := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer serving.Close()
+	admin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer admin.Close()
+
+	adminURL, _ := url.Parse(admin.URL)
+	_, adminPort, _ := net.SplitHostPort(adminURL.Host)
+
+	server, _ := newSimpleServer(serving.URL, WithHealthCheck(HealthCheck{Path: "/health", Port: adminPort}))
+	if err := server.Probe(context.Background()); err != nil {
+		t.Errorf("Expected probe on the admin port to succeed, got %v", err)
+	}
+
+	direct, _ := newSimpleServer(serving.URL, WithHealthCheck(HealthCheck{Path: "/health"}))
+	if err := direct.Probe(context.Background()); err == nil || direct.IsAlive() {
+		t.Errorf("Expected probe on the serving port to fail")
+	}
+}
+
+func TestHealthCheck_RunMarksServersDown(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	server, _ := newSimpleServer(backend.URL, WithHealthCheck(HealthCheck{Path: "/", Interval: 10 * time.Millisecond}))
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.RunHealthChecks(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.IsAlive() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := lb.Stats()[0]
+	if stats.Alive || stats.LastProbe == nil || stats.LastProbeError == "" {
+		t.Errorf("Expected the failing probe to be reported, got %+v", stats)
+	}
+}
+
+func TestHealthRegistry_SharesProbes(t *testing.T) {
+	var probes atomic.Int64
+	var healthy atomic.Bool
+	healthy.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		probes.Add(1)
+		if !healthy.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	registry := NewHealthRegistry()
+	hc := HealthCheck{Path: "/healthz", Interval: 20 * time.Millisecond, Timeout: time.Second}
+	newPool := func(addr string, hc HealthCheck) *LoadBalancer {
+		server, err := newSimpleServer(addr, WithHealthCheck(hc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb := newTestLoadBalancer(t, []Server{server}, WithHealthRegistry(registry))
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go lb.RunHealthChecks(ctx)
+		return lb
+	}
+	// The same backend, spelled differently, in two pools
+	pool1 := newPool(backend.URL, hc)
+	pool2 := newPool(backend.URL+"/", hc)
+	waitFor(t, "both subscriptions", func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		for _, c := range registry.checks {
+			return len(registry.checks) == 1 && len(c.subscribers) == 2
+		}
+		return false
+	})
+
+	// One probe stream: 10 intervals yield about 10 probes, not 20
+	before := probes.Load()
+	time.Sleep(10 * hc.Interval)
+	if n := probes.Load() - before; n > 14 {
+		t.Errorf("Expected a single probe stream, got %d probes in 10 intervals", n)
+	}
+
+	healthy.Store(false)
+	waitFor(t, "both pools to see the server down", func() bool {
+		return !pool1.Stats()[0].Alive && !pool2.Stats()[0].Alive
+	})
+	if p1, p2 := pool1.Stats()[0], pool2.Stats()[0]; p1.LastProbeError == "" || p2.LastProbeError != p1.LastProbeError {
+		t.Errorf("Expected both pools to report the same probe, got %q and %q", p1.LastProbeError, p2.LastProbeError)
+	}
+	healthy.Store(true)
+	waitFor(t, "both pools to see the server up", func() bool {
+		return pool1.Stats()[0].Alive && pool2.Stats()[0].Alive
+	})
+
+	// A genuinely different health check gets its own probe
+	other := hc
+	other.Path = "/ready"
+	newPool(backend.URL, other)
+	waitFor(t, "a separate check", func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return len(registry.checks) == 2
+	})
+
+	// Probes of the shared check stop with the last server referencing it
+	if err := pool1.RemoveServer(backend.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool2.RemoveServer(backend.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	remaining := len(registry.checks)
+	registry.mu.Unlock()
+	if remaining != 1 {
+		t.Errorf("Expected only the separate check left, got %d", remaining)
+	}
+}
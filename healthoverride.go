@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthState is the liveness forced on a server by a health override.
+type HealthState string
+
+const (
+	// HealthUp selects the server whatever its probes report.
+	HealthUp HealthState = "up"
+
+	// HealthDown keeps the server out of selection whatever its probes
+	// report.
+	HealthDown HealthState = "down"
+
+	// HealthAuto clears the override and returns the server to its probes.
+	HealthAuto HealthState = "auto"
+)
+
+// HealthOverride is an override of a server's liveness. Expires is unset
+// for overrides that last until cleared.
+type HealthOverride struct {
+	State   HealthState `json:"state"`
+	Expires *time.Time  `json:"expires,omitempty"`
+}
+
+// active reports whether the override still applies at now.
+func (o *HealthOverride) active(now time.Time) bool {
+	return o.Expires == nil || now.Before(*o.Expires)
+}
+
+// SetHealthOverride pins the liveness of the server with the given name or
+// address, compared normalized, regardless of probe results and flap
+// detection, for ttl or until cleared if ttl is zero. HealthAuto clears the
+// override. It returns ErrServerNotFound for unknown servers.
+func (lb *LoadBalancer) SetHealthOverride(addr string, state HealthState, ttl time.Duration) error {
+	switch state {
+	case HealthUp, HealthDown, HealthAuto:
+	default:
+		return fmt.Errorf("health override %q: unknown state %q", addr, state)
+	}
+	if ttl < 0 {
+		return fmt.Errorf("health override %q: ttl must not be negative", addr)
+	}
+
+	lb.mu.Lock()
+	server := lb.findServerLocked(addr)
+	if server != nil {
+		was := lb.aliveLocked(server, lb.now())
+		if state == HealthAuto {
+			delete(lb.healthOverrides, serverName(server))
+		} else {
+			o := &HealthOverride{State: state}
+			if ttl > 0 {
+				expires := lb.now().Add(ttl)
+				o.Expires = &expires
+			}
+			lb.healthOverrides[serverName(server)] = o
+		}
+		if alive := lb.aliveLocked(server, lb.now()); alive != was {
+			lb.events.publish(healthEvent(server, alive, "override"))
+		}
+	}
+	lb.mu.Unlock()
+	if server == nil {
+		return fmt.Errorf("health override %q: %w", addr, ErrServerNotFound)
+	}
+
+	if lb.queue != nil {
+		lb.queue.notify()
+	}
+
+	return nil
+}
+
+// ClearHealthOverride returns the server with the given name or address to
+// its probes. It returns ErrServerNotFound for unknown servers.
+func (lb *LoadBalancer) ClearHealthOverride(addr string) error {
+	return lb.SetHealthOverride(addr, HealthAuto, 0)
+}
+
+// healthOverrideLocked returns the override of the server with the given
+// address in effect at now, or nil, dropping an expired one. lb.mu must be
+// held.
+func (lb *LoadBalancer) healthOverrideLocked(addr string, now time.Time) *HealthOverride {
+	o := lb.healthOverrides[addr]
+	if o != nil && !o.active(now) {
+		delete(lb.healthOverrides, addr)
+		return nil
+	}
+
+	return o
+}
+
+// aliveLocked reports whether server counts as alive at now: as pinned by
+// its health override, or else alive, resolved and not held down for
+// flapping, invalid responses, a peer's report or its own feedback. lb.mu
+// must be held.
+func (lb *LoadBalancer) aliveLocked(server Server, now time.Time) bool {
+	if o := lb.healthOverrideLocked(serverName(server), now); o != nil {
+		return o.State == HealthUp
+	}
+
+	return server.IsAlive() && lb.pending[serverName(server)] == nil && !lb.flappingLocked(serverName(server)) &&
+		!lb.ejectedLocked(serverName(server), now) && !lb.peerDownLocked(serverName(server), now) &&
+		!lb.backingOffLocked(serverName(server), now)
+}
+
+// handleHealthOverride pins or releases a server's liveness. The ttl is
+// optional; without one the override lasts until set to "auto":
+//
+//	{"url": "http://10.0.0.5:8080", "state": "up", "ttl": "10m"}
+func (lb *LoadBalancer) handleHealthOverride(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URL   string      `json:"url"`
+		State HealthState `json:"state"`
+		TTL   Duration    `json:"ttl"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+	switch body.State {
+	case HealthUp, HealthDown, HealthAuto:
+	default:
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("state must be up, down or auto"))
+		return
+	}
+	if body.TTL < 0 {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("ttl must not be negative"))
+		return
+	}
+
+	if err := lb.SetHealthOverride(body.URL, body.State, time.Duration(body.TTL)); err != nil {
+		writeJSONError(rw, statusForError(err), err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthOverride_PinsLiveness(t *testing.T) {
+	failing := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	failing.(*simpleServer).SetAlive(false)
+	lb := newTestLoadBalancer(t, []Server{failing})
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	get := func() int {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		return rw.Code
+	}
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the down server to be skipped, got %d", code)
+	}
+
+	rw := postAdmin(lb, "/admin/backends/health", `{"url": "`+failing.Address()+`", "state": "up", "ttl": "10m"}`)
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected the override to be set, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("Expected the pinned server to receive traffic, got %d", code)
+	}
+
+	rw = httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	var status struct {
+		Servers []ServerStats `json:"servers"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	o := status.Servers[0].HealthOverride
+	if o == nil || o.State != HealthUp || o.Expires == nil || !o.Expires.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("Expected the status to show the override, got %+v", o)
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `lb_server_health_override{server="`+failing.Address()+`"} 1`) {
+		t.Errorf("Expected the override in the metrics, got:\n%s", metrics.Body.String())
+	}
+
+	// Once the TTL expires the probes are in control again
+	now = now.Add(11 * time.Minute)
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the expired override to release the server, got %d", code)
+	}
+	if o := lb.Stats()[0].HealthOverride; o != nil {
+		t.Errorf("Expected no override after expiry, got %+v", o)
+	}
+}
+
+func TestHealthOverride_DownAndAuto(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	if err := lb.SetHealthOverride(server.Address(), HealthDown, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.getNextAvailableServer(); err == nil {
+		t.Errorf("Expected the pinned-down server not to be selected")
+	}
+	if err := lb.ClearHealthOverride(server.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.getNextAvailableServer(); err != nil {
+		t.Errorf("Expected the server back in selection, got %v", err)
+	}
+
+	for body, want := range map[string]int{
+		`{"url": "http://unknown.com", "state": "up"}`:                     http.StatusNotFound,
+		`{"url": "` + server.Address() + `", "state": "sideways"}`:         http.StatusBadRequest,
+		`{"url": "` + server.Address() + `", "state": "up", "ttl": "-1m"}`: http.StatusBadRequest,
+	} {
+		if rw := postAdmin(lb, "/admin/backends/health", body); rw.Code != want {
+			t.Errorf("%s: expected %d, got %d", body, want, rw.Code)
+		}
+	}
+}
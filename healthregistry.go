@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthRegistry shares active health checks between load balancers that
+// serve the same backend. Servers with the same normalized address and an
+// identical health check are probed once; every server sharing the probe
+// receives its result. Servers whose health checks differ, including ones
+// using separately loaded CA pools, keep their own probe. A probe stops when
+// the last server sharing it is removed or its load balancer stops health
+// checking.
+type HealthRegistry struct {
+	mu     sync.Mutex
+	checks map[healthKey]*sharedCheck
+}
+
+// NewHealthRegistry returns an empty registry.
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{checks: make(map[healthKey]*sharedCheck)}
+}
+
+// WithHealthRegistry probes servers through r instead of per load balancer.
+func WithHealthRegistry(r *HealthRegistry) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthRegistry = r
+	}
+}
+
+type healthKey struct {
+	addr  string
+	check HealthCheck
+}
+
+// sharedCheck is the probe loop of one backend and its subscribers. The
+// first subscriber sends the probes.
+type sharedCheck struct {
+	cancel      context.CancelFunc
+	subscribers []*healthSubscriber
+}
+
+// healthSubscriber is a server receiving the results of a shared probe.
+// observe is called after each result is applied.
+type healthSubscriber struct {
+	server  healthChecked
+	observe func()
+}
+
+// subscribe adds server to the probe of its backend, starting the probe if
+// it is the first subscriber. The server is unsubscribed by the returned
+// function or when ctx is done.
+func (r *HealthRegistry) subscribe(ctx context.Context, server healthChecked, observe func()) context.CancelFunc {
+	key := healthKey{addr: normalizeAddress(server.Address()), check: *server.healthCheck()}
+	sub := &healthSubscriber{server: server, observe: observe}
+
+	r.mu.Lock()
+	c := r.checks[key]
+	if c == nil {
+		probeCtx, cancel := context.WithCancel(context.Background())
+		c = &sharedCheck{cancel: cancel}
+		r.checks[key] = c
+		go r.run(probeCtx, key, c)
+	}
+	c.subscribers = append(c.subscribers, sub)
+	prober := c.subscribers[0].server
+	r.mu.Unlock()
+
+	// A late subscriber starts from the latest shared result
+	if result := prober.LastProbe(); result != nil && prober != server {
+		server.setProbe(result)
+	}
+
+	var once sync.Once
+	unsubscribe := func() { once.Do(func() { r.unsubscribe(key, sub) }) }
+	stop := context.AfterFunc(ctx, unsubscribe)
+
+	return func() {
+		stop()
+		unsubscribe()
+	}
+}
+
+func (r *HealthRegistry) unsubscribe(key healthKey, sub *healthSubscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.checks[key]
+	for i, s := range c.subscribers {
+		if s == sub {
+			c.subscribers = append(c.subscribers[:i:i], c.subscribers[i+1:]...)
+			break
+		}
+	}
+	if len(c.subscribers) == 0 {
+		c.cancel()
+		delete(r.checks, key)
+	}
+}
+
+// run probes the backend of key at its interval until ctx is done.
+func (r *HealthRegistry) run(ctx context.Context, key healthKey, c *sharedCheck) {
+	ticker := time.NewTicker(key.check.interval())
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		subscribers := c.subscribers
+		r.mu.Unlock()
+		if len(subscribers) > 0 {
+			prober := subscribers[0].server
+			if err := prober.Probe(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("health check of %s failed: %v\n", prober.Address(), err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			result := prober.LastProbe()
+			for _, s := range subscribers {
+				if s.server != prober {
+					s.server.setProbe(result)
+				}
+				s.observe()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
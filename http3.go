@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultAltSvcMaxAge is how long clients may remember the HTTP/3
+// listener without ListenerTLS.AltSvcMaxAge.
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// ListenerTLS serves the proxied traffic over HTTPS on Port with
+// Certificate. With HTTP3 set, it is served over HTTP/3 on the same UDP
+// port as well, which the responses of the TCP listeners advertise in an
+// Alt-Svc header clients may remember for AltSvcMaxAge. HTTP/3 needs a
+// binary built with the http3 tag.
+type ListenerTLS struct {
+	Port         string
+	Certificate  tls.Certificate
+	HTTP3        bool
+	AltSvcMaxAge time.Duration
+
+	// CertFile and KeyFile, if set, are read again by ReloadSecrets so
+	// that rotated certificates are served.
+	CertFile string
+	KeyFile  string
+
+	// OCSPStapling staples the response of the certificate's OCSP
+	// responder to handshakes, renewed in the background. Handshakes go
+	// without a staple while none is valid.
+	OCSPStapling bool
+
+	// ExpiryWarning is how close to its expiry the certificate is warned
+	// about, 30 days by default.
+	ExpiryWarning time.Duration
+}
+
+// WithListenerTLS serves the proxied traffic over HTTPS, and over HTTP/3 if
+// enabled.
+func WithListenerTLS(l ListenerTLS) Option {
+	return func(lb *LoadBalancer) {
+		if l.AltSvcMaxAge <= 0 {
+			l.AltSvcMaxAge = defaultAltSvcMaxAge
+		}
+		if l.ExpiryWarning <= 0 {
+			l.ExpiryWarning = defaultCertExpiryWarning
+		}
+		lb.listenerTLS = &l
+		if l.HTTP3 {
+			lb.altSvc = fmt.Sprintf(`h3=":%s"; ma=%d`, l.Port, int(l.AltSvcMaxAge.Seconds()))
+		}
+	}
+}
+
+// TLSConfig returns the TLS configuration of the HTTPS and HTTP/3
+// listeners, or nil without ListenerTLS.
+func (lb *LoadBalancer) TLSConfig() *tls.Config {
+	if lb.listenerTLS == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return lb.listenerCert.get(lb.now()), nil
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// advertiseHTTP3 points clients of the TCP listeners to the HTTP/3
+// listener.
+func (lb *LoadBalancer) advertiseHTTP3(rw http.ResponseWriter, req *http.Request) {
+	if lb.altSvc != "" && req.ProtoMajor < 3 {
+		rw.Header().Set("Alt-Svc", lb.altSvc)
+	}
+}
+
+// HTTP3Server serves requests over QUIC. Shutdown sends clients a GOAWAY,
+// waits for their requests up to ctx and closes their connections with
+// H3_NO_ERROR.
+type HTTP3Server interface {
+	Serve(conn net.PacketConn) error
+	Shutdown(ctx context.Context) error
+}
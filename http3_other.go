@@ -0,0 +1,11 @@
+//go:build !http3
+
+package main
+
+import "net/http"
+
+// NewHTTP3Server reports ErrHTTP3Unsupported: the QUIC implementation is
+// only built in with the http3 tag.
+func (lb *LoadBalancer) NewHTTP3Server(handler http.Handler) (HTTP3Server, error) {
+	return nil, ErrHTTP3Unsupported
+}
@@ -0,0 +1,22 @@
+//go:build http3
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewHTTP3Server returns a server of handler over HTTP/3 with the TLS
+// configuration of the HTTPS listener. Requests reach servers over the
+// protocol configured for each, as those of the TCP listeners do; the
+// connection limits of the TCP listeners do not apply.
+func (lb *LoadBalancer) NewHTTP3Server(handler http.Handler) (HTTP3Server, error) {
+	return &http3.Server{
+		Handler:        handler,
+		TLSConfig:      lb.TLSConfig(),
+		MaxHeaderBytes: lb.MaxHeaderBytes(),
+		IdleTimeout:    lb.connLimits.IdleTimeout,
+	}, nil
+}
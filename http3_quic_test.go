@@ -0,0 +1,70 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3_ProxiesRequests(t *testing.T) {
+	cert, pool, _ := newTestCert(t, "lb.example", time.Hour)
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		// Servers are reached over their own protocol.
+		io.WriteString(rw, req.Proto)
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithListenerTLS(ListenerTLS{Port: "8443", Certificate: cert, HTTP3: true}))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	quic, err := lb.NewHTTP3Server(lb.Handler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- quic.Serve(conn) }()
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "lb.example"}}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("https://" + conn.LocalAddr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || string(body) != "HTTP/1.1" {
+		t.Errorf("Expected an HTTP/3 response proxied over HTTP/1.1, got %s and %q", resp.Proto, body)
+	}
+	if got := resp.Header.Get("Alt-Svc"); got != "" {
+		t.Errorf("Expected no Alt-Svc over HTTP/3, got %q", got)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `lb_requests_total{protocol="HTTP/3.0"} 1`; !strings.Contains(metrics.Body.String(), want+"\n") {
+		t.Errorf("Expected metrics to contain %q", want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := quic.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a graceful shutdown, got %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected the server to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTLS serves the proxied traffic of lb over HTTPS as main does,
+// returning a client trusting the certificate of lb.example.
+func serveTLS(t *testing.T, lb *LoadBalancer) (string, *http.Client) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := lb.NewServer(lb.Handler())
+	go srv.Serve(tls.NewListener(lb.LimitListener(ln), lb.TLSConfig()))
+	t.Cleanup(func() { srv.Close() })
+
+	pool := x509.NewCertPool()
+	pool.AddCert(lb.listenerTLS.Certificate.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "lb.example"},
+		ForceAttemptHTTP2: true,
+	}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	return "https://" + ln.Addr().String(), client
+}
+
+func TestListenerTLS_AdvertisesHTTP3(t *testing.T) {
+	cert, _, _ := newTestCert(t, "lb.example", time.Hour)
+	server := newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{server}, WithListenerTLS(ListenerTLS{Port: "8443", Certificate: cert, HTTP3: true}))
+	url, client := serveTLS(t, lb)
+
+	resp, err := client.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 over TLS, got %s", resp.Proto)
+	}
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":8443"; ma=86400`; got != want {
+		t.Errorf("Expected Alt-Svc %q, got %q", want, got)
+	}
+
+	// Requests over HTTP/3 already use it.
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/3.0", 3, 0
+	lb.Handler().ServeHTTP(rw, req)
+	if got := rw.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("Expected no Alt-Svc over HTTP/3, got %q", got)
+	}
+}
+
+func TestListenerTLS_WithoutHTTP3(t *testing.T) {
+	cert, _, _ := newTestCert(t, "lb.example", time.Hour)
+	server := newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{server}, WithListenerTLS(ListenerTLS{Port: "8443", Certificate: cert}))
+	url, client := serveTLS(t, lb)
+
+	resp, err := client.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to be proxied, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Alt-Svc"); got != "" {
+		t.Errorf("Expected no Alt-Svc without HTTP/3, got %q", got)
+	}
+}
+
+func TestListenerTLSConfig(t *testing.T) {
+	cert, _, certPEM := newTestCert(t, "lb.example", time.Hour)
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+
+	build := func(c *ListenerTLSConfig) (*LoadBalancer, error) {
+		return (&Config{
+			Port:    "0",
+			Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}},
+			TLS:     c,
+		}).Build()
+	}
+	lb, err := build(&ListenerTLSConfig{Port: "8443", CertFile: certFile, KeyFile: keyFile, HTTP3: true, AltSvcMaxAge: Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.TLSConfig() == nil || lb.altSvc != `h3=":8443"; ma=3600` {
+		t.Errorf("Expected the HTTPS listener advertising HTTP/3, got %q", lb.altSvc)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config *ListenerTLSConfig
+		want   string
+	}{
+		{"no key", &ListenerTLSConfig{Port: "8443", CertFile: certFile}, "port, cert_file and key_file are required"},
+		{"unreadable", &ListenerTLSConfig{Port: "8443", CertFile: certFile, KeyFile: certFile}, "tls:"},
+		{"negative max age", &ListenerTLSConfig{Port: "8443", CertFile: certFile, KeyFile: keyFile, AltSvcMaxAge: Duration(-time.Second)}, "alt_svc_max_age and expiry_warning must not be negative"},
+		{"port in use", &ListenerTLSConfig{Port: "0", CertFile: certFile, KeyFile: keyFile}, "tls.port: port 0 is already used by port"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := build(tc.config); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected an error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader carries the key identifying duplicates of a
+	// request.
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayHeader marks responses shared with a duplicate.
+	idempotentReplayHeader = "Idempotent-Replay"
+
+	defaultIdempotencyTTL  = 24 * time.Hour
+	defaultIdempotencyKeys = 10000
+	defaultIdempotencyBody = 1 << 20
+)
+
+// IdempotencyKeys deduplicates the requests of a route carrying an
+// Idempotency-Key header, such as webhook deliveries retried by clients.
+// The first request with a key is proxied. Duplicates arriving while it is
+// in flight wait for it and share its response, and duplicates within TTL
+// of its completion, 24 hours by default, get the stored response; both
+// carry an Idempotent-Replay header. Keys are scoped to the route name. At
+// most MaxKeys keys, 10000 by default, are remembered; the least recently
+// used is forgotten first. Responses with a body over MaxBody, 1 MiB by
+// default, 5xx responses and failures are not stored, so the next duplicate
+// is proxied again. Requests without the header pass through.
+type IdempotencyKeys struct {
+	TTL     time.Duration
+	MaxKeys int
+	MaxBody int64
+}
+
+func (k IdempotencyKeys) withDefaults() IdempotencyKeys {
+	if k.TTL <= 0 {
+		k.TTL = defaultIdempotencyTTL
+	}
+	if k.MaxKeys <= 0 {
+		k.MaxKeys = defaultIdempotencyKeys
+	}
+	if k.MaxBody <= 0 {
+		k.MaxBody = defaultIdempotencyBody
+	}
+
+	return k
+}
+
+// Idempotency results reported in the access log and metrics.
+const (
+	idempotencyMiss   = "miss"
+	idempotencyShared = "shared"
+	idempotencyReplay = "replay"
+)
+
+// storedResponse is the response to a request with an idempotency key.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// serve answers rw with r. Headers already set on rw take precedence over
+// the stored ones.
+func (r *storedResponse) serve(rw http.ResponseWriter) {
+	header := rw.Header()
+	for name, values := range r.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+	header.Set(idempotentReplayHeader, "true")
+	header.Set("Content-Length", strconv.Itoa(len(r.body)))
+	rw.WriteHeader(r.status)
+	rw.Write(r.body)
+}
+
+// idempotentCall is the request proxied for a key. It is in flight until
+// done is closed; response is then its stored response, or nil if it could
+// not be stored.
+type idempotentCall struct {
+	key      string
+	done     chan struct{}
+	finished bool
+	response *storedResponse
+	expires  time.Time
+}
+
+// idempotencyScope holds the keys of a route, most recently used first.
+type idempotencyScope struct {
+	config  IdempotencyKeys
+	calls   map[string]*list.Element
+	lru     *list.List
+	results map[string]uint64
+}
+
+func (s *idempotencyScope) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.calls, el.Value.(*idempotentCall).key)
+}
+
+// idempotencyStore holds the keys of the routes deduplicating requests, by
+// route name.
+type idempotencyStore struct {
+	mu     sync.Mutex
+	scopes map[string]*idempotencyScope
+}
+
+// newIdempotencyStore returns the store for the routes with IdempotencyKeys,
+// or nil if there are none.
+func newIdempotencyStore(routes []Route) *idempotencyStore {
+	s := &idempotencyStore{scopes: make(map[string]*idempotencyScope)}
+	for _, route := range routes {
+		if route.Idempotency == nil || s.scopes[route.Name] != nil {
+			continue
+		}
+		s.scopes[route.Name] = &idempotencyScope{
+			config:  route.Idempotency.withDefaults(),
+			calls:   make(map[string]*list.Element),
+			lru:     list.New(),
+			results: make(map[string]uint64),
+		}
+	}
+	if len(s.scopes) == 0 {
+		return nil
+	}
+
+	return s
+}
+
+// join returns the call for key on route at now and whether it was just
+// started, making the request the one to proxy.
+func (s *idempotencyStore) join(route, key string, now time.Time) (*idempotencyScope, *idempotentCall, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := s.scopes[route]
+	if el := scope.calls[key]; el != nil {
+		c := el.Value.(*idempotentCall)
+		if !c.finished || now.Before(c.expires) {
+			scope.lru.MoveToFront(el)
+			return scope, c, false
+		}
+		scope.remove(el)
+	}
+	c := &idempotentCall{key: key, done: make(chan struct{})}
+	scope.calls[key] = scope.lru.PushFront(c)
+	for scope.lru.Len() > scope.config.MaxKeys {
+		scope.remove(scope.lru.Back())
+	}
+
+	return scope, c, true
+}
+
+// finish completes c with response, forgetting its key if there is no
+// response to store, and releases the duplicates waiting for it.
+func (s *idempotencyStore) finish(scope *idempotencyScope, c *idempotentCall, response *storedResponse, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.finished = true
+	if response != nil {
+		c.response = response
+		c.expires = now.Add(scope.config.TTL)
+	} else if el := scope.calls[c.key]; el != nil && el.Value == c {
+		scope.remove(el)
+	}
+	close(c.done)
+}
+
+func (s *idempotencyStore) count(scope *idempotencyScope, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope.results[result]++
+}
+
+// writeMetrics renders the deduplication counters of each route.
+func (s *idempotencyStore) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]string, 0, len(s.scopes))
+	for route := range s.scopes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP lb_idempotency_requests_total Requests with an idempotency key, by route and result.")
+	fmt.Fprintln(w, "# TYPE lb_idempotency_requests_total counter")
+	for _, route := range routes {
+		scope := s.scopes[route]
+		for _, result := range []string{idempotencyMiss, idempotencyShared, idempotencyReplay} {
+			fmt.Fprintf(w, "lb_idempotency_requests_total{route=%q,result=%q} %d\n", route, result, scope.results[result])
+		}
+	}
+	fmt.Fprintln(w, "# HELP lb_idempotency_keys Idempotency keys remembered, by route.")
+	fmt.Fprintln(w, "# TYPE lb_idempotency_keys gauge")
+	for _, route := range routes {
+		fmt.Fprintf(w, "lb_idempotency_keys{route=%q} %d\n", route, s.scopes[route].lru.Len())
+	}
+}
+
+// idempotentExchange sits between the attempts of the request proxied for
+// a key and the client, capturing the response for the duplicates.
+type idempotentExchange struct {
+	http.ResponseWriter
+	store *idempotencyStore
+	scope *idempotencyScope
+	call  *idempotentCall
+
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	tooLarge bool
+
+	// complete is set once the response was passed on in full.
+	complete bool
+}
+
+func (x *idempotentExchange) WriteHeader(status int) {
+	if x.status == 0 && status >= http.StatusOK {
+		x.status = status
+		x.header = x.ResponseWriter.Header().Clone()
+	}
+	x.ResponseWriter.WriteHeader(status)
+}
+
+func (x *idempotentExchange) Write(p []byte) (int, error) {
+	if x.status == 0 {
+		x.WriteHeader(http.StatusOK)
+	}
+	if !x.tooLarge {
+		if int64(x.body.Len()+len(p)) > x.scope.config.MaxBody {
+			x.tooLarge = true
+			x.body = bytes.Buffer{}
+		} else {
+			x.body.Write(p)
+		}
+	}
+
+	return x.ResponseWriter.Write(p)
+}
+
+func (x *idempotentExchange) Flush() {
+	http.NewResponseController(x.ResponseWriter).Flush()
+}
+
+func (x *idempotentExchange) Unwrap() http.ResponseWriter {
+	return x.ResponseWriter
+}
+
+// finish stores the captured response if it is complete and may be
+// replayed, and releases the duplicates waiting for it.
+func (x *idempotentExchange) finish(now time.Time) {
+	var response *storedResponse
+	if x.complete && !x.tooLarge && x.status != 0 && x.status < http.StatusInternalServerError {
+		response = &storedResponse{status: x.status, header: x.header, body: bytes.Clone(x.body.Bytes())}
+		response.header.Del(idempotentReplayHeader)
+	}
+	x.store.finish(x.scope, x.call, response, now)
+}
+
+// finishIdempotent finishes x, if any.
+func (lb *LoadBalancer) finishIdempotent(x *idempotentExchange) {
+	if x != nil {
+		x.finish(lb.now())
+	}
+}
+
+// serveIdempotent answers req with the response to an earlier request with
+// the same idempotency key, waiting for it while it is in flight, and
+// reports the result. Otherwise it returns the exchange capturing the
+// response for later duplicates, or nil for requests without a key or on
+// routes not deduplicating them.
+func (lb *LoadBalancer) serveIdempotent(rw http.ResponseWriter, req *http.Request) (bool, string, *idempotentExchange) {
+	key := req.Header.Get(idempotencyKeyHeader)
+	if lb.idempotency == nil || key == "" {
+		return false, "", nil
+	}
+	route := lb.matchRoute(req)
+	if route == nil || route.Idempotency == nil {
+		return false, "", nil
+	}
+
+	for {
+		scope, call, first := lb.idempotency.join(route.Name, key, lb.now())
+		if first {
+			lb.idempotency.count(scope, idempotencyMiss)
+			return false, idempotencyMiss, &idempotentExchange{ResponseWriter: rw, store: lb.idempotency, scope: scope, call: call}
+		}
+		result := idempotencyReplay
+		select {
+		case <-call.done:
+		default:
+			result = idempotencyShared
+			select {
+			case <-call.done:
+			case <-req.Context().Done():
+				writeError(rw, ErrClientClosed)
+				return true, result, nil
+			}
+		}
+		if call.response != nil {
+			call.response.serve(rw)
+			lb.idempotency.count(scope, result)
+			return true, result, nil
+		}
+		// The response of the request proxied for the key could not be
+		// stored, so this request takes its place.
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookBalancer proxies to a backend answering with the number of
+// requests it received, through handler first if set, with the /hooks
+// route deduplicating under keys.
+func newWebhookBalancer(t *testing.T, keys IdempotencyKeys, handler func(n int64, rw http.ResponseWriter)) (*LoadBalancer, *atomic.Int64) {
+	var calls atomic.Int64
+	backend := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		n := calls.Add(1)
+		if handler != nil {
+			handler(n, rw)
+		}
+		fmt.Fprintf(rw, "delivery %d", n)
+	})
+	lb := newTestLoadBalancer(t, []Server{backend}, WithRoutes(
+		Route{Name: "webhooks", PathPrefix: "/hooks", Idempotency: &keys},
+		Route{Name: "api", PathPrefix: "/api"},
+	))
+
+	return lb, &calls
+}
+
+func postWithKey(lb *LoadBalancer, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	return rw
+}
+
+func TestIdempotency_ConcurrentDuplicates(t *testing.T) {
+	release := make(chan struct{})
+	lb, calls := newWebhookBalancer(t, IdempotencyKeys{}, func(n int64, rw http.ResponseWriter) {
+		<-release
+	})
+
+	responses := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = postWithKey(lb, "/hooks/github", "delivery-1")
+	}()
+	waitFor(t, "the first request to reach the backend", func() bool { return calls.Load() == 1 })
+	for i := 1; i < len(responses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = postWithKey(lb, "/hooks/github", "delivery-1")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected exactly one upstream call, got %d", n)
+	}
+	for i, rw := range responses {
+		if rw.Code != http.StatusOK || rw.Body.String() != "delivery 1" {
+			t.Errorf("Response %d: expected the first delivery, got %d %q", i, rw.Code, rw.Body.String())
+		}
+		if replayed := rw.Header().Get(idempotentReplayHeader) == "true"; replayed != (i > 0) {
+			t.Errorf("Response %d: expected replayed=%v, got %v", i, i > 0, replayed)
+		}
+	}
+}
+
+func TestIdempotency_SequentialDuplicates(t *testing.T) {
+	lb, calls := newWebhookBalancer(t, IdempotencyKeys{TTL: time.Minute}, nil)
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	for range 3 {
+		rw := postWithKey(lb, "/hooks/github", "delivery-1")
+		if rw.Body.String() != "delivery 1" {
+			t.Errorf("Expected the first delivery, got %q", rw.Body.String())
+		}
+	}
+	if rw := postWithKey(lb, "/hooks/github", "delivery-2"); rw.Header().Get(idempotentReplayHeader) != "" {
+		t.Error("Expected a new key to be proxied")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected one upstream call per key, got %d", n)
+	}
+
+	postWithKey(lb, "/hooks/github", "")
+	postWithKey(lb, "/hooks/github", "")
+	postWithKey(lb, "/api/users", "delivery-1")
+	postWithKey(lb, "/api/users", "delivery-1")
+	if n := calls.Load(); n != 6 {
+		t.Errorf("Expected requests without keys or dedup to pass through, got %d upstream calls", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if rw := postWithKey(lb, "/hooks/github", "delivery-1"); rw.Header().Get(idempotentReplayHeader) != "" {
+		t.Error("Expected an expired key to be proxied again")
+	}
+	if n := calls.Load(); n != 7 {
+		t.Errorf("Expected 7 upstream calls, got %d", n)
+	}
+}
+
+func TestIdempotency_UnstoredResponses(t *testing.T) {
+	lb, calls := newWebhookBalancer(t, IdempotencyKeys{MaxBody: 32}, func(n int64, rw http.ResponseWriter) {
+		switch n {
+		case 1:
+			rw.WriteHeader(http.StatusInternalServerError)
+		case 3:
+			fmt.Fprint(rw, strings.Repeat("x", 64))
+		}
+	})
+
+	for i, want := range []int64{1, 2, 2} {
+		postWithKey(lb, "/hooks/github", "failed")
+		if n := calls.Load(); n != want {
+			t.Errorf("Request %d: expected %d upstream calls after a failure, got %d", i, want, n)
+		}
+	}
+	for i, want := range []int64{3, 4, 4} {
+		postWithKey(lb, "/hooks/github", "large")
+		if n := calls.Load(); n != want {
+			t.Errorf("Request %d: expected %d upstream calls after a large response, got %d", i, want, n)
+		}
+	}
+}
+
+func TestIdempotency_MaxKeys(t *testing.T) {
+	lb, calls := newWebhookBalancer(t, IdempotencyKeys{MaxKeys: 2}, nil)
+
+	for _, key := range []string{"a", "b", "c", "b", "a"} {
+		postWithKey(lb, "/hooks/github", key)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("Expected the oldest key to be forgotten, got %d upstream calls", n)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`lb_idempotency_requests_total{route="webhooks",result="miss"} 4`,
+		`lb_idempotency_requests_total{route="webhooks",result="replay"} 1`,
+		`lb_idempotency_keys{route="webhooks"} 2`,
+	} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
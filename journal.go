@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultJournalMaxEntries   = 10000
+	defaultJournalMaxBytes     = 64 << 20
+	defaultJournalMaxBody      = 64 << 10
+	defaultJournalSyncInterval = time.Second
+	defaultJournalBackoff      = time.Second
+	defaultJournalMaxBackoff   = time.Minute
+
+	// journalFileName is the name of the journal file in its directory.
+	journalFileName = "journal.log"
+
+	// journalCompactBytes is the size of acknowledged records above which
+	// the journal is rewritten once they outweigh the pending ones.
+	journalCompactBytes = 1 << 20
+
+	// journalEntryHeader names the journal entry of accepted and delivered
+	// requests, so that servers can recognize redeliveries.
+	journalEntryHeader = "X-Journal-Entry"
+)
+
+// JournalSync decides when journal appends are flushed to stable storage.
+type JournalSync string
+
+const (
+	// JournalSyncAlways flushes every request before acknowledging it, so
+	// no acknowledged request is lost in a crash.
+	JournalSyncAlways JournalSync = "always"
+
+	// JournalSyncInterval flushes every SyncInterval, losing at most the
+	// requests of one interval in a crash of the machine.
+	JournalSyncInterval JournalSync = "interval"
+
+	// JournalSyncNever leaves flushing to the operating system.
+	JournalSyncNever JournalSync = "never"
+)
+
+// Journal gives a route at-least-once delivery for small requests, such as
+// webhooks, that must survive brief outages of the whole pool. Instead of
+// being proxied, requests are appended to a journal in Dir and answered
+// with 202 Accepted and their entry number in X-Journal-Entry. A dispatcher
+// sends them through the load balancer in order, retrying failures with
+// exponential backoff from Backoff, 1s by default, to MaxBackoff, 1m by
+// default, until a server answers with anything but a 5xx, 408 or 429.
+// Entries are removed once delivered, and replayed after a restart until
+// they are. Servers may see an entry again if the load balancer stops
+// between delivering and removing it, and should deduplicate by
+// X-Journal-Entry.
+//
+// Bodies above MaxBody, 64KiB by default, are rejected with 413. Once the
+// journal holds MaxEntries entries, 10000 by default, or MaxBytes bytes,
+// 64MiB by default, requests are rejected with 503. Appends are flushed as
+// Sync decides, always by default. Journaling is meant for the few routes
+// needing it, not for general proxying: clients never see the servers'
+// responses.
+type Journal struct {
+	Dir          string
+	MaxEntries   int
+	MaxBytes     int64
+	MaxBody      int64
+	Sync         JournalSync
+	SyncInterval time.Duration
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+}
+
+// journalEntry is a request held in a journal.
+type journalEntry struct {
+	ID         uint64      `json:"id"`
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+
+	// size is the size of the entry's record in the journal file.
+	size int64
+}
+
+// journalRecord is a record of the journal file: an accepted entry, or the
+// ID of a delivered one.
+type journalRecord struct {
+	Entry *journalEntry `json:"entry,omitempty"`
+	Ack   uint64        `json:"ack,omitempty"`
+}
+
+// journal is the journal of a route and its pending entries, oldest first.
+type journal struct {
+	config Journal
+	route  string
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	live    int64
+	pending []*journalEntry
+	nextID  uint64
+	dirty   bool
+
+	wake chan struct{}
+
+	accepted  atomic.Uint64
+	full      atomic.Uint64
+	tooLarge  atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	failures  atomic.Uint64
+}
+
+// openJournals opens the journals of routes, replaying their pending
+// entries. Routes sharing a Journal share its journal, but distinct
+// journals must not share a directory.
+func openJournals(routes []Route) (map[*Journal]*journal, error) {
+	journals := make(map[*Journal]*journal)
+	dirs := make(map[string]string)
+	for _, r := range routes {
+		if r.Journal == nil || journals[r.Journal] != nil {
+			continue
+		}
+		dir := filepath.Clean(r.Journal.Dir)
+		var err error
+		if other, ok := dirs[dir]; ok {
+			err = fmt.Errorf("journal directory %s is used by route %q", dir, other)
+		} else {
+			dirs[dir] = r.Name
+			journals[r.Journal], err = openJournal(*r.Journal, r.Name)
+		}
+		if err != nil {
+			for _, opened := range journals {
+				if opened != nil {
+					opened.close()
+				}
+			}
+			return nil, fmt.Errorf("route %q: %w", r.Name, err)
+		}
+	}
+
+	return journals, nil
+}
+
+func openJournal(config Journal, route string) (*journal, error) {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultJournalMaxEntries
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultJournalMaxBytes
+	}
+	if config.MaxBody <= 0 {
+		config.MaxBody = defaultJournalMaxBody
+	}
+	if config.Sync == "" {
+		config.Sync = JournalSyncAlways
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultJournalSyncInterval
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultJournalBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultJournalMaxBackoff
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(config.Dir, journalFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	j := &journal{config: config, route: route, file: file, nextID: 1, wake: make(chan struct{}, 1)}
+	if err := j.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("journal %s: %w", file.Name(), err)
+	}
+
+	return j, nil
+}
+
+// replay reads the journal file, keeping the entries not acknowledged. A
+// torn record at the end, left by a crash during an append, is truncated.
+func (j *journal) replay() error {
+	pending := make(map[uint64]*journalEntry)
+	r := bufio.NewReader(j.file)
+	var offset int64
+	for {
+		payload, n, err := readJournalRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("journal %s: truncating after %d bytes: %v\n", j.file.Name(), offset, err)
+			}
+			break
+		}
+		var record journalRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			fmt.Printf("journal %s: truncating after %d bytes: %v\n", j.file.Name(), offset, err)
+			break
+		}
+		offset += n
+		switch {
+		case record.Entry != nil:
+			record.Entry.size = n
+			pending[record.Entry.ID] = record.Entry
+			j.nextID = max(j.nextID, record.Entry.ID+1)
+		case record.Ack != 0:
+			delete(pending, record.Ack)
+		}
+	}
+	if err := j.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = offset
+
+	for _, e := range pending {
+		j.pending = append(j.pending, e)
+		j.live += e.size
+	}
+	sort.Slice(j.pending, func(a, b int) bool { return j.pending[a].ID < j.pending[b].ID })
+
+	return nil
+}
+
+// readJournalRecord reads a record framed by its length and CRC-32,
+// returning its payload and size.
+func readJournalRecord(r io.Reader) ([]byte, int64, error) {
+	var frame [8]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, fmt.Errorf("torn record")
+		}
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(frame[:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("torn record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:]) {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	return payload, int64(len(frame) + len(payload)), nil
+}
+
+// encodeJournalRecord frames record for the journal file.
+func encodeJournalRecord(record journalRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+
+	return append(b, payload...), nil
+}
+
+// writeLocked appends b to the journal file. j.mu must be held.
+func (j *journal) writeLocked(b []byte) error {
+	if _, err := j.file.Write(b); err != nil {
+		// Drop whatever part of the record was written.
+		j.file.Truncate(j.size)
+		j.file.Seek(j.size, io.SeekStart)
+		return err
+	}
+	j.size += int64(len(b))
+
+	return nil
+}
+
+// append journals e, assigning its ID. It returns ErrJournalFull when the
+// journal is at its limits.
+func (j *journal) append(e *journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.ID = j.nextID
+	b, err := encodeJournalRecord(journalRecord{Entry: e})
+	if err != nil {
+		return err
+	}
+	if len(j.pending) >= j.config.MaxEntries || j.live+int64(len(b)) > j.config.MaxBytes {
+		j.full.Add(1)
+		return ErrJournalFull
+	}
+	if err := j.writeLocked(b); err != nil {
+		return err
+	}
+	if j.config.Sync == JournalSyncAlways {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		j.dirty = true
+	}
+	j.nextID++
+	e.size = int64(len(b))
+	j.pending = append(j.pending, e)
+	j.live += e.size
+	j.accepted.Add(1)
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// head returns the oldest pending entry, or nil.
+func (j *journal) head() *journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) == 0 {
+		return nil
+	}
+
+	return j.pending[0]
+}
+
+// ack removes the oldest pending entry e once delivered. The journal file
+// is emptied when nothing is pending and compacted when acknowledged
+// records dominate it.
+func (j *journal) ack(e *journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) == 0 || j.pending[0] != e {
+		return nil
+	}
+	j.pending = j.pending[1:]
+	j.live -= e.size
+
+	if len(j.pending) == 0 {
+		if err := j.file.Truncate(0); err != nil {
+			return err
+		}
+		j.size = 0
+		_, err := j.file.Seek(0, io.SeekStart)
+		return err
+	}
+	b, err := encodeJournalRecord(journalRecord{Ack: e.ID})
+	if err != nil {
+		return err
+	}
+	if err := j.writeLocked(b); err != nil {
+		return err
+	}
+	j.dirty = true
+	if dead := j.size - j.live; dead > journalCompactBytes && dead > j.live {
+		return j.compactLocked()
+	}
+
+	return nil
+}
+
+// compactLocked rewrites the journal file with only the pending entries.
+// j.mu must be held.
+func (j *journal) compactLocked() error {
+	path := j.file.Name()
+	tmp, err := os.CreateTemp(j.config.Dir, journalFileName+".*")
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, e := range j.pending {
+		b, err := encodeJournalRecord(journalRecord{Entry: e})
+		if err == nil {
+			_, err = tmp.Write(b)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		size += int64(len(b))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	j.file.Close()
+	j.file, j.size, j.live, j.dirty = tmp, size, size, false
+
+	return nil
+}
+
+// sync flushes appends made since the last flush.
+func (j *journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+
+	return j.file.Sync()
+}
+
+// close flushes and closes the journal file.
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.dirty {
+		j.file.Sync()
+	}
+
+	return j.file.Close()
+}
+
+// journalDeliveryKey marks requests the dispatcher delivers from a
+// journal, which are proxied rather than journaled again.
+type journalDeliveryKey struct{}
+
+// serveJournaled journals req for delivery by the dispatcher and answers it
+// with 202 Accepted.
+func (lb *LoadBalancer) serveJournaled(rw http.ResponseWriter, req *http.Request, config *Journal) error {
+	j := lb.journals[config]
+	body, err := io.ReadAll(io.LimitReader(req.Body, j.config.MaxBody+1))
+	if err != nil {
+		writeError(rw, err)
+		return err
+	}
+	if int64(len(body)) > j.config.MaxBody {
+		j.tooLarge.Add(1)
+		writeError(rw, ErrBodyTooLarge)
+		return ErrBodyTooLarge
+	}
+	e := &journalEntry{
+		Time:       lb.now(),
+		Method:     req.Method,
+		URI:        req.URL.RequestURI(),
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		Header:     req.Header.Clone(),
+		Body:       body,
+	}
+	if err := j.append(e); err != nil {
+		if errors.Is(err, ErrJournalFull) {
+			rw.Header().Set("Retry-After", "1")
+		}
+		writeError(rw, err)
+		return err
+	}
+	rw.Header().Set(journalEntryHeader, strconv.FormatUint(e.ID, 10))
+	rw.WriteHeader(http.StatusAccepted)
+
+	return nil
+}
+
+// RunJournals delivers the entries of every journal until ctx is done,
+// flushing journals synced at an interval.
+func (lb *LoadBalancer) RunJournals(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, j := range lb.journals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.dispatchJournal(ctx, j)
+		}()
+		if j.config.Sync == JournalSyncInterval {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(j.config.SyncInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						markActive(ctx)
+						if err := j.sync(); err != nil {
+							fmt.Printf("error: sync journal of route %q: %v\n", j.route, err)
+						}
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// dispatchJournal delivers the entries of j in order, backing off while
+// deliveries fail.
+func (lb *LoadBalancer) dispatchJournal(ctx context.Context, j *journal) {
+	backoff := time.Duration(0)
+	for ctx.Err() == nil {
+		e := j.head()
+		if e == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-j.wake:
+			}
+			continue
+		}
+
+		markActive(ctx)
+		status := lb.deliverJournaled(ctx, e)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case status >= 500 || status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+			j.failures.Add(1)
+			backoff = min(max(2*backoff, j.config.Backoff), j.config.MaxBackoff)
+			fmt.Printf("error: delivering journal entry %d of route %q failed with %d, retrying in %s\n", e.ID, j.route, status, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		case status >= 400:
+			j.dropped.Add(1)
+			fmt.Printf("error: journal entry %d of route %q was rejected with %d, dropping it\n", e.ID, j.route, status)
+		default:
+			j.delivered.Add(1)
+		}
+		backoff = 0
+		if err := j.ack(e); err != nil {
+			fmt.Printf("error: journal of route %q: %v\n", j.route, err)
+		}
+	}
+}
+
+// deliverJournaled sends e through the load balancer, returning the status
+// it was answered with, or 0 if the response was aborted.
+func (lb *LoadBalancer) deliverJournaled(ctx context.Context, e *journalEntry) (status int) {
+	ctx = context.WithValue(ctx, journalDeliveryKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, e.Method, "http://"+e.Host+e.URI, bytes.NewReader(e.Body))
+	if err != nil {
+		fmt.Printf("error: journal entry %d: %v\n", e.ID, err)
+		return http.StatusBadRequest
+	}
+	if e.Header != nil {
+		req.Header = e.Header.Clone()
+	}
+	req.Header.Set(journalEntryHeader, strconv.FormatUint(e.ID, 10))
+	req.RemoteAddr = e.RemoteAddr
+	req.RequestURI = e.URI
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			status = 0
+		}
+	}()
+	rw := &journalResponse{header: make(http.Header)}
+	lb.serveProxy(rw, req)
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+
+	return rw.status
+}
+
+// journalDelivery reports whether req is delivered from a journal.
+func journalDelivery(req *http.Request) bool {
+	delivery, _ := req.Context().Value(journalDeliveryKey{}).(bool)
+	return delivery
+}
+
+// journalResponse records the status of a delivery and discards its body.
+type journalResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *journalResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *journalResponse) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+}
+
+func (r *journalResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// writeJournalMetrics renders the depth, age and outcomes of each journal.
+func (lb *LoadBalancer) writeJournalMetrics(w io.Writer) {
+	journals := make([]*journal, 0, len(lb.journals))
+	for _, j := range lb.journals {
+		journals = append(journals, j)
+	}
+	sort.Slice(journals, func(a, b int) bool { return journals[a].route < journals[b].route })
+	now := lb.now()
+
+	fmt.Fprintln(w, "# HELP lb_journal_entries Requests journaled and not yet delivered.")
+	fmt.Fprintln(w, "# TYPE lb_journal_entries gauge")
+	for _, j := range journals {
+		j.mu.Lock()
+		fmt.Fprintf(w, "lb_journal_entries{route=%q} %d\n", j.route, len(j.pending))
+		j.mu.Unlock()
+	}
+	fmt.Fprintln(w, "# HELP lb_journal_bytes Size of the journaled requests not yet delivered.")
+	fmt.Fprintln(w, "# TYPE lb_journal_bytes gauge")
+	for _, j := range journals {
+		j.mu.Lock()
+		fmt.Fprintf(w, "lb_journal_bytes{route=%q} %d\n", j.route, j.live)
+		j.mu.Unlock()
+	}
+	fmt.Fprintln(w, "# HELP lb_journal_oldest_age_seconds Age of the oldest request not yet delivered.")
+	fmt.Fprintln(w, "# TYPE lb_journal_oldest_age_seconds gauge")
+	for _, j := range journals {
+		age := 0.0
+		if e := j.head(); e != nil {
+			age = max(now.Sub(e.Time).Seconds(), 0)
+		}
+		fmt.Fprintf(w, "lb_journal_oldest_age_seconds{route=%q} %g\n", j.route, age)
+	}
+	fmt.Fprintln(w, "# HELP lb_journal_requests_total Requests to journaled routes, by result.")
+	fmt.Fprintln(w, "# TYPE lb_journal_requests_total counter")
+	for _, j := range journals {
+		fmt.Fprintf(w, "lb_journal_requests_total{route=%q,result=\"accepted\"} %d\n", j.route, j.accepted.Load())
+		fmt.Fprintf(w, "lb_journal_requests_total{route=%q,result=\"full\"} %d\n", j.route, j.full.Load())
+		fmt.Fprintf(w, "lb_journal_requests_total{route=%q,result=\"too_large\"} %d\n", j.route, j.tooLarge.Load())
+	}
+	fmt.Fprintln(w, "# HELP lb_journal_deliveries_total Delivery attempts of journaled requests, by result.")
+	fmt.Fprintln(w, "# TYPE lb_journal_deliveries_total counter")
+	for _, j := range journals {
+		fmt.Fprintf(w, "lb_journal_deliveries_total{route=%q,result=\"delivered\"} %d\n", j.route, j.delivered.Load())
+		fmt.Fprintf(w, "lb_journal_deliveries_total{route=%q,result=\"rejected\"} %d\n", j.route, j.dropped.Load())
+		fmt.Fprintf(w, "lb_journal_deliveries_total{route=%q,result=\"failed\"} %d\n", j.route, j.failures.Load())
+	}
+}
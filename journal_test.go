@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// journalBackend counts the deliveries of each body, failing with 503 while
+// down.
+type journalBackend struct {
+	down atomic.Bool
+
+	mu        sync.Mutex
+	delivered map[string]int
+	entries   map[string]string
+}
+
+func newJournalBackend(t *testing.T) (*journalBackend, Server) {
+	b := &journalBackend{delivered: make(map[string]int), entries: make(map[string]string)}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if b.down.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		b.mu.Lock()
+		b.delivered[string(body)]++
+		b.entries[string(body)] = req.Header.Get(journalEntryHeader)
+		b.mu.Unlock()
+	}))
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, server
+}
+
+func (b *journalBackend) deliveries() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delivered := make(map[string]int, len(b.delivered))
+	for body, n := range b.delivered {
+		delivered[body] = n
+	}
+
+	return delivered
+}
+
+// postJournaled posts body to lb and returns the response.
+func postJournaled(lb *LoadBalancer, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("POST", "/hooks/", strings.NewReader(body)))
+	return rw
+}
+
+// runJournals runs the dispatcher of lb until the returned function is
+// called.
+func runJournals(lb *LoadBalancer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		lb.RunJournals(ctx)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitDrained waits for the journals of lb to be empty.
+func waitDrained(t *testing.T, lb *LoadBalancer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, j := range lb.journals {
+		for j.head() != nil {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the journal to drain")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func journalRoute(dir string) Route {
+	return Route{Name: "hooks", PathPrefix: "/hooks/", Journal: &Journal{
+		Dir: dir, Backoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond,
+	}}
+}
+
+func TestJournal_DeliversOnceAfterOutage(t *testing.T) {
+	backend, server := newJournalBackend(t)
+	backend.down.Store(true)
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(journalRoute(t.TempDir())))
+	defer lb.Close()
+	stop := runJournals(lb)
+	defer stop()
+
+	bodies := []string{"a", "b", "c", "d"}
+	for _, body := range bodies {
+		rw := postJournaled(lb, body)
+		if rw.Code != http.StatusAccepted || rw.Header().Get(journalEntryHeader) == "" {
+			t.Fatalf("Expected 202 with an entry number, got %d and %v", rw.Code, rw.Header())
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := backend.deliveries(); len(got) != 0 {
+		t.Fatalf("Expected nothing delivered while the backend is down, got %v", got)
+	}
+
+	backend.down.Store(false)
+	waitDrained(t, lb)
+	got := backend.deliveries()
+	for _, body := range bodies {
+		if got[body] != 1 {
+			t.Errorf("Expected %q delivered once, got %d", body, got[body])
+		}
+	}
+	if backend.entries["a"] != "1" || backend.entries["d"] != "4" {
+		t.Errorf("Expected deliveries to carry their entry numbers, got %v", backend.entries)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`lb_journal_entries{route="hooks"} 0`,
+		`lb_journal_requests_total{route="hooks",result="accepted"} 4`,
+		`lb_journal_deliveries_total{route="hooks",result="delivered"} 4`,
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestJournal_ReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	backend, server := newJournalBackend(t)
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(journalRoute(dir)))
+	stop := runJournals(lb)
+	rw := postJournaled(lb, "first")
+	waitDrained(t, lb)
+
+	// The backend goes down with entries pending, and the load balancer is
+	// stopped, the last append torn.
+	backend.down.Store(true)
+	for _, body := range []string{"second", "third"} {
+		if rw = postJournaled(lb, body); rw.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d", rw.Code)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	lb.Close()
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	backend.down.Store(false)
+	lb = newTestLoadBalancer(t, []Server{server}, WithRoutes(journalRoute(dir)))
+	defer lb.Close()
+	if rw = postJournaled(lb, "fourth"); rw.Header().Get(journalEntryHeader) != "4" {
+		t.Errorf("Expected entry numbers to continue after a restart, got %q", rw.Header().Get(journalEntryHeader))
+	}
+	stop = runJournals(lb)
+	defer stop()
+	waitDrained(t, lb)
+
+	got := backend.deliveries()
+	for _, body := range []string{"first", "second", "third", "fourth"} {
+		if got[body] != 1 {
+			t.Errorf("Expected %q delivered once, got %d", body, got[body])
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, journalFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("Expected the drained journal to be emptied, got %v, %v", info, err)
+	}
+}
+
+func TestJournal_Limits(t *testing.T) {
+	_, server := newJournalBackend(t)
+	route := journalRoute(t.TempDir())
+	route.Journal.MaxEntries = 2
+	route.Journal.MaxBody = 4
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(route))
+	defer lb.Close()
+
+	if rw := postJournaled(lb, "large"); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body above max_body, got %d", rw.Code)
+	}
+	for range 2 {
+		if rw := postJournaled(lb, "ok"); rw.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d", rw.Code)
+		}
+	}
+	rw := postJournaled(lb, "full")
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After from a full journal, got %d and %v", rw.Code, rw.Header())
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// WithConnMaxAge closes idle HTTP/1 connections to the server once they are
+// older than d, so that connections a middlebox dropped silently, or the
+// server is about to close, are not reused. By default connections are kept
+// until the server closes them or they idle for the transport's
+// IdleConnTimeout.
+func WithConnMaxAge(d time.Duration) ServerOption {
+	return func(s *simpleServer) {
+		s.conns.maxAge = d
+	}
+}
+
+// staleConnTransport resends a request once, on a fresh connection, when
+// it failed on a reused connection before any response arrived, and the
+// connection was closed before the request could reach the server: nothing
+// was written yet, or, for idempotent methods, the load balancer retired
+// the connection as it was handed out. Non-idempotent requests that were
+// written are never resent, as the server may have read and acted on them.
+// This is independent of the retry policy, which decides on failures of
+// servers.
+//
+// The body must be replayable, that is absent or buffered for retries.
+type staleConnTransport struct {
+	transport interface {
+		http.RoundTripper
+		idleCloser
+	}
+	counters *transportCounters
+}
+
+func (t staleConnTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := &connAttempt{}
+	resp, err := t.transport.RoundTrip(attempt.traced(req))
+	if err == nil || !attempt.stale(req) || req.Context().Err() != nil {
+		return resp, err
+	}
+	retry, ok := rewound(req)
+	if !ok {
+		return resp, err
+	}
+	fmt.Printf("resending %s %s on a fresh connection: %v\n", req.Method, req.URL.Path, err)
+	t.counters.staleRetries.Add(1)
+	// Connections idle as long as the stale one are likely stale as well.
+	t.transport.CloseIdleConnections()
+
+	return t.transport.RoundTrip((&connAttempt{}).traced(retry))
+}
+
+// rewound returns req ready to be sent again, if its body can be.
+func rewound(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry := req.WithContext(req.Context())
+	retry.Body = body
+
+	return retry, true
+}
+
+// connAttempt follows a request through the transport, telling whether it
+// failed on a stale connection and retiring its connection once idle.
+type connAttempt struct {
+	mu        sync.Mutex
+	conn      *countedConn
+	reused    bool
+	wrote     bool
+	responded bool
+}
+
+// traced returns req with the hooks of the attempt installed.
+func (a *connAttempt) traced(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := dialedConn(info.Conn)
+			conn.busy()
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.conn, a.reused, a.wrote, a.responded = conn, info.Reused, false, false
+		},
+		WroteHeaders: func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.wrote = true
+		},
+		GotFirstResponseByte: func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.responded = true
+		},
+		PutIdleConn: func(err error) {
+			a.mu.Lock()
+			conn := a.conn
+			a.mu.Unlock()
+			if err == nil {
+				conn.idle()
+			}
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// stale reports whether the failed attempt of req went over a reused
+// connection that was closed before req could reach the server.
+func (a *connAttempt) stale(req *http.Request) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.reused || a.responded {
+		return false
+	}
+	if !a.wrote {
+		return true
+	}
+
+	return idempotent(req.Method) && a.conn.isRetired()
+}
+
+// idempotent reports whether requests with method have the same effect
+// when received twice.
+func idempotent(method string) bool {
+	return !isWrite(method) || method == http.MethodPut || method == http.MethodDelete
+}
+
+// dialedConn returns the connection the transport dialed underneath conn,
+// or nil if it did not count it.
+func dialedConn(conn net.Conn) *countedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*countedConn)
+
+	return c
+}
+
+// busy stops the retirement of the connection, which serves a request.
+func (c *countedConn) busy() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.retire != nil {
+		c.retire.Stop()
+		c.retire = nil
+	}
+}
+
+// idle schedules the retirement of the connection, which went back to the
+// idle pool, for when it reaches the maximum age.
+func (c *countedConn) idle() {
+	if c == nil || c.counters.maxAge <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.retired || c.retire != nil {
+		return
+	}
+	c.retire = time.AfterFunc(time.Until(c.opened.Add(c.counters.maxAge)), c.retireIdle)
+}
+
+// retireIdle closes the connection unless it was handed out meanwhile.
+func (c *countedConn) retireIdle() {
+	c.mu.Lock()
+	if c.retire == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.retire, c.retired = nil, true
+	c.mu.Unlock()
+
+	c.counters.retired.Add(1)
+	c.Close()
+}
+
+func (c *countedConn) isRetired() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.retired
+}
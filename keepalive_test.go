@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// staleTransport fails the first request on a reused connection, conn,
+// after writing its headers if wrote, answering any further request with
+// the body it received.
+type staleTransport struct {
+	conn         *countedConn
+	wrote        bool
+	responded    bool
+	calls        int
+	closedIdle   int
+	resentBodies []string
+}
+
+func (f *staleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	trace := httptrace.ContextClientTrace(req.Context())
+	if f.calls == 1 {
+		info := httptrace.GotConnInfo{Reused: true}
+		if f.conn != nil {
+			info.Conn = f.conn
+		}
+		trace.GotConn(info)
+		if f.wrote {
+			trace.WroteHeaders()
+		}
+		if f.responded {
+			trace.GotFirstResponseByte()
+		}
+		return nil, io.EOF
+	}
+	trace.GotConn(httptrace.GotConnInfo{})
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	f.resentBodies = append(f.resentBodies, string(body))
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func (f *staleTransport) CloseIdleConnections() {
+	f.closedIdle++
+}
+
+func TestStaleConn_Resent(t *testing.T) {
+	withBody := func() *http.Request {
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader("order"))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("order")), nil }
+		return req
+	}
+	retired := &countedConn{retired: true}
+	for _, tt := range []struct {
+		name      string
+		req       *http.Request
+		conn      *countedConn
+		wrote     bool
+		responded bool
+		resent    bool
+	}{
+		{"nothing written", httptest.NewRequest("POST", "/orders", nil), nil, false, false, true},
+		{"replayable body", withBody(), nil, false, false, true},
+		{"body not replayable", httptest.NewRequest("POST", "/orders", strings.NewReader("order")), nil, false, false, false},
+		{"written", httptest.NewRequest("GET", "/orders", nil), nil, true, false, false},
+		{"written on a retired connection", httptest.NewRequest("GET", "/orders", nil), retired, true, false, true},
+		{"written to be run twice", httptest.NewRequest("POST", "/orders", nil), retired, true, false, false},
+		{"response started", httptest.NewRequest("GET", "/orders", nil), nil, false, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &staleTransport{conn: tt.conn, wrote: tt.wrote, responded: tt.responded}
+			counters := &transportCounters{}
+			resp, err := staleConnTransport{transport: inner, counters: counters}.RoundTrip(tt.req)
+			if !tt.resent {
+				if err == nil || inner.calls != 1 || counters.staleRetries.Load() != 0 {
+					t.Errorf("Expected the failure to be returned, got %v after %d calls", err, inner.calls)
+				}
+				return
+			}
+			if err != nil || resp.StatusCode != http.StatusOK || inner.calls != 2 {
+				t.Fatalf("Expected the request to be resent, got %v after %d calls", err, inner.calls)
+			}
+			if inner.closedIdle != 1 || counters.staleRetries.Load() != 1 {
+				t.Errorf("Expected the idle connections closed and the retry counted, got %d and %d",
+					inner.closedIdle, counters.staleRetries.Load())
+			}
+			if tt.req.GetBody != nil && inner.resentBodies[0] != "order" {
+				t.Errorf("Expected the body to be resent, got %q", inner.resentBodies[0])
+			}
+		})
+	}
+}
+
+// newKeepAliveServer returns the URL of a server that keeps connections
+// alive for keepAlive. A request arriving on a connection idle for longer
+// crossed the server closing it, so the connection is closed unanswered.
+func newKeepAliveServer(t *testing.T, keepAlive time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for idleSince := time.Now(); ; idleSince = time.Now() {
+					req, err := http.ReadRequest(r)
+					if err != nil || time.Since(idleSince) > keepAlive {
+						return
+					}
+					io.Copy(io.Discard, req.Body)
+					if _, err := io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String()
+}
+
+func TestConnMaxAge_ServerClosingIdleConnections(t *testing.T) {
+	server, err := newSimpleServer(newKeepAliveServer(t, 40*time.Millisecond), WithConnMaxAge(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The retry policy buffers bodies for replay but does not retry the
+	// failures of stale connections itself.
+	lb := newTestLoadBalancer(t, []Server{server}, WithRetryPolicy(RetryPolicy{Attempts: 2, On: []ErrorClass{ClassStatus503}}))
+
+	// Requests arrive before, around and after the keep-alive of the
+	// server ends; none of them may be sent over a connection it closed.
+	for i := range 30 {
+		time.Sleep(time.Duration(i%6) * 12 * time.Millisecond)
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("POST", "/orders", strings.NewReader("order")))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, rw.Code)
+		}
+	}
+	stats := server.TransportStats()
+	if stats.RetiredConnections == 0 || stats.ConnectionsReused == 0 {
+		t.Errorf("Expected connections to be reused, then retired, got %+v", stats)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"lb_server_connections_retired_total{", "lb_server_stale_connection_retries_total{"} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+}
+
+func TestConnMaxAgeConfig(t *testing.T) {
+	_, err := (&Config{
+		Port:    "0",
+		Servers: []ServerConfig{{Address: "http://127.0.0.1:9", ConnMaxAge: Duration(-time.Second)}},
+	}).Build()
+	if err == nil || !strings.Contains(err.Error(), "conn_max_age must not be negative") {
+		t.Errorf("Expected a negative age to be rejected, got %v", err)
+	}
+}
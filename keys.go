@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// KeyExtractor derives an affinity key such as a tenant ID from a request.
+// It reports false when the request carries no key, in which case hash
+// strategies pass to the next strategy in the chain.
+type KeyExtractor func(req *http.Request) (string, bool)
+
+// ClientIPKey extracts the IP address the request came from.
+func ClientIPKey() KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		return host, err == nil && host != ""
+	}
+}
+
+// HeaderKey extracts the value of the named request header.
+func HeaderKey(name string) KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		value := req.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// HostKey extracts the host the request was sent to, without port.
+func HostKey() KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, host != ""
+	}
+}
+
+// APIKeyIDKey extracts the ID of the API key the request was authenticated
+// with.
+func APIKeyIDKey() KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		id := apiKeyID(req)
+		return id, id != ""
+	}
+}
+
+// CookieKey extracts the value of the named cookie.
+func CookieKey(name string) KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		c, err := req.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		return c.Value, c.Value != ""
+	}
+}
+
+// QueryKey extracts the value of the named query parameter.
+func QueryKey(name string) KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		value := req.URL.Query().Get(name)
+		return value, value != ""
+	}
+}
+
+// PathKey extracts a capture group of re matched against the request path:
+// the group named "key" if re has one, the first group otherwise.
+func PathKey(re *regexp.Regexp) (KeyExtractor, error) {
+	group := re.SubexpIndex("key")
+	if group < 0 {
+		if re.NumSubexp() == 0 {
+			return nil, fmt.Errorf("path key %q has no capture group", re)
+		}
+		group = 1
+	}
+
+	return func(req *http.Request) (string, bool) {
+		m := re.FindStringSubmatch(req.URL.Path)
+		if m == nil || m[group] == "" {
+			return "", false
+		}
+		return m[group], true
+	}, nil
+}
+
+// PathParamKey extracts the named parameter the pattern of the request's
+// route captured from its path.
+func PathParamKey(name string) KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		value, ok := PathParam(req, name)
+		return value, ok && value != ""
+	}
+}
+
+// FirstKey extracts the key of the first of extractors that finds one.
+func FirstKey(extractors ...KeyExtractor) KeyExtractor {
+	return func(req *http.Request) (string, bool) {
+		for _, extract := range extractors {
+			if key, ok := extract(req); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
+
+// newKeyExtractor returns the extractor described by spec: "client-ip",
+// "host", "api-key", "header:<name>", "cookie:<name>", "query:<name>",
+// "path:<regexp>", "path-param:<name>" or the name of a registered
+// extractor.
+func newKeyExtractor(spec string) (KeyExtractor, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "client-ip":
+		return ClientIPKey(), nil
+	case "host":
+		return HostKey(), nil
+	case "api-key":
+		return APIKeyIDKey(), nil
+	case "header", "cookie", "query", "path", "path-param":
+		if arg == "" {
+			return nil, fmt.Errorf("key %q needs an argument, as in %q", kind, kind+":<name>")
+		}
+	}
+
+	switch kind {
+	case "header":
+		return HeaderKey(arg), nil
+	case "cookie":
+		return CookieKey(arg), nil
+	case "query":
+		return QueryKey(arg), nil
+	case "path":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return PathKey(re)
+	case "path-param":
+		return PathParamKey(arg), nil
+	}
+	if extract, ok := registeredKeyExtractor(spec); ok {
+		return extract, nil
+	}
+
+	return nil, fmt.Errorf("unknown key %q", spec)
+}
+
+var (
+	keyExtractorsMu sync.RWMutex
+	keyExtractors   = map[string]KeyExtractor{}
+)
+
+// RegisterKeyExtractor makes a custom extractor, such as one reading a JWT
+// claim, available to configuration as the strategy "hash:<name>".
+func RegisterKeyExtractor(name string, extract KeyExtractor) {
+	keyExtractorsMu.Lock()
+	defer keyExtractorsMu.Unlock()
+
+	keyExtractors[name] = extract
+}
+
+// registeredKeyExtractor returns the extractor registered under name.
+func registeredKeyExtractor(name string) (KeyExtractor, bool) {
+	keyExtractorsMu.RLock()
+	defer keyExtractorsMu.RUnlock()
+
+	extract, ok := keyExtractors[name]
+	return extract, ok
+}
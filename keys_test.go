@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestKeyExtractors_BuiltIn(t *testing.T) {
+	pathKey, err := PathKey(regexp.MustCompile(`^/tenants/([^/]+)/`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	namedPathKey, err := PathKey(regexp.MustCompile(`^/(?P<region>[a-z]+)/(?P<key>\d+)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/tenants/acme/orders?tenant=globex", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.Header.Set("X-Tenant", "initech")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	authed, info := WithRequestInfo(httptest.NewRequest("GET", "http://api.example.com:8443/", nil))
+	info.apiKey = &APIKey{ID: "team-a"}
+
+	tests := []struct {
+		name    string
+		extract KeyExtractor
+		req     *http.Request
+		want    string
+		ok      bool
+	}{
+		{"client ip", ClientIPKey(), req, "203.0.113.7", true},
+		{"header", HeaderKey("X-Tenant"), req, "initech", true},
+		{"missing header", HeaderKey("X-Missing"), req, "", false},
+		{"cookie", CookieKey("session"), req, "abc", true},
+		{"missing cookie", CookieKey("other"), req, "", false},
+		{"query", QueryKey("tenant"), req, "globex", true},
+		{"missing query", QueryKey("other"), req, "", false},
+		{"path", pathKey, req, "acme", true},
+		{"path mismatch", pathKey, httptest.NewRequest("GET", "/health", nil), "", false},
+		{"named path group", namedPathKey, httptest.NewRequest("GET", "/eu/42", nil), "42", true},
+		{"host", HostKey(), authed, "api.example.com", true},
+		{"api key id", APIKeyIDKey(), authed, "team-a", true},
+		{"no api key", APIKeyIDKey(), req, "", false},
+		{"first key", FirstKey(HeaderKey("X-Missing"), QueryKey("tenant")), req, "globex", true},
+		{"no first key", FirstKey(HeaderKey("X-Missing"), CookieKey("other")), req, "", false},
+	}
+	for _, tt := range tests {
+		key, ok := tt.extract(tt.req)
+		if key != tt.want || ok != tt.ok {
+			t.Errorf("%s: Expected (%q, %v), got (%q, %v)", tt.name, tt.want, tt.ok, key, ok)
+		}
+	}
+
+	if _, err := PathKey(regexp.MustCompile(`^/tenants/`)); err == nil {
+		t.Errorf("Expected a path key without capture group to be rejected")
+	}
+}
+
+func TestKeyExtractors_CustomRegistered(t *testing.T) {
+	// A stand-in for a JWT claim extractor
+	RegisterKeyExtractor("bearer-subject", func(req *http.Request) (string, bool) {
+		return strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	})
+	strategy, err := newStrategy("hash:bearer-subject")
+	if err != nil {
+		t.Fatalf("Expected the registered extractor to be usable, got %v", err)
+	}
+	if _, err := newStrategy("hash:unregistered"); err == nil {
+		t.Errorf("Expected an unregistered extractor to be rejected")
+	}
+
+	candidates := []Candidate{
+		{Server: &MockServer{addr: "http://server1.com"}},
+		{Server: &MockServer{addr: "http://server2.com"}},
+		{Server: &MockServer{addr: "http://server3.com"}},
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer tenant-7")
+		server, err := strategy.Select(req, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[server.Address()] = true
+	}
+	if len(seen) != 1 {
+		t.Errorf("Expected one server for the same subject, got %v", seen)
+	}
+	if _, err := strategy.Select(httptest.NewRequest("GET", "/", nil), candidates); err != ErrStrategyPass {
+		t.Errorf("Expected a request without the key to pass, got %v", err)
+	}
+}
+
+func TestKeyExtractors_PerRouteWithFallback(t *testing.T) {
+	cfg := &Config{
+		Port: "8000",
+		Servers: []ServerConfig{
+			{Address: "http://server1.com"}, {Address: "http://server2.com"}, {Address: "http://server3.com"},
+		},
+		Routes: []RouteConfig{{
+			Name:       "tenants",
+			PathPrefix: "/tenants/",
+			Strategies: []string{`path-hash:^/tenants/([^/]+)`, "round-robin"},
+		}},
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tenant in the path pins the server
+	first, _ := lb.selectServer(httptest.NewRequest("GET", "/tenants/acme/orders", nil))
+	for i := 0; i < 3; i++ {
+		server, _ := lb.selectServer(httptest.NewRequest("GET", "/tenants/acme/invoices", nil))
+		if server != first {
+			t.Errorf("Expected tenant acme to stay on %s, got %s", first.Address(), server.Address())
+		}
+	}
+
+	// Without a tenant the chain falls through to round-robin
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		server, err := lb.selectServer(httptest.NewRequest("GET", "/tenants/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[server.Address()] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected round-robin across all servers, got %v", seen)
+	}
+}
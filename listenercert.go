@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// defaultCertExpiryWarning is how close to its expiry the listener
+	// certificate is warned about without ListenerTLS.ExpiryWarning.
+	defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+	// ocspRetry is how soon a failed OCSP fetch is tried again, and
+	// ocspRefresh how often responses without a next update are renewed.
+	ocspRetry   = time.Minute
+	ocspRefresh = time.Hour
+
+	// certCheckInterval bounds the time between two checks of the
+	// listener certificate.
+	certCheckInterval = time.Hour
+
+	// maxOCSPResponse bounds the OCSP responses read from a responder.
+	maxOCSPResponse = 1 << 20
+)
+
+// errNoOCSP is returned when the certificate cannot be stapled.
+var errNoOCSP = errors.New("certificate names no OCSP responder or lacks its issuer")
+
+// listenerCert is the certificate of the TLS listener, with its OCSP staple
+// and the monitoring of its expiry.
+type listenerCert struct {
+	stapling bool
+	warning  time.Duration
+	certFile string
+	keyFile  string
+	client   *http.Client
+
+	// served is what handshakes are answered with; it is swapped whole so
+	// that handshakes take no lock.
+	served atomic.Pointer[servedCert]
+
+	mu     sync.Mutex
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+
+	// expiring is set once the certificate came within warning of its
+	// expiry; nextOCSP is when the staple is due for renewal.
+	expiring bool
+	nextOCSP time.Time
+
+	// wake is poked when the certificate is reloaded.
+	wake chan struct{}
+
+	ocspOK, ocspFailed, reloads atomic.Uint64
+}
+
+// servedCert is the certificate served, and the same certificate with an
+// OCSP staple valid until until, if one was fetched.
+type servedCert struct {
+	plain   *tls.Certificate
+	stapled *tls.Certificate
+	until   time.Time
+}
+
+func newListenerCert(l *ListenerTLS) (*listenerCert, error) {
+	c := &listenerCert{
+		stapling: l.OCSPStapling,
+		warning:  l.ExpiryWarning,
+		certFile: l.CertFile,
+		keyFile:  l.KeyFile,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		wake:     make(chan struct{}, 1),
+	}
+	if err := c.set(l.Certificate); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// set makes cert the certificate served, starting its monitoring over.
+func (c *listenerCert) set(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("tls: no certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		issuer, _ = x509.ParseCertificate(cert.Certificate[1])
+	}
+	cert.OCSPStaple = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.leaf, c.issuer = leaf, issuer
+	c.expiring = false
+	c.nextOCSP = time.Time{}
+	c.served.Store(&servedCert{plain: &cert})
+
+	return nil
+}
+
+// reload reads the certificate files again, if configured.
+func (c *listenerCert) reload() error {
+	if c.certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("reload tls certificate: %w", err)
+	}
+	if err := c.set(cert); err != nil {
+		return err
+	}
+	c.reloads.Add(1)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// get returns the certificate to serve at now, stapled while the staple is
+// valid.
+func (c *listenerCert) get(now time.Time) *tls.Certificate {
+	s := c.served.Load()
+	if s.stapled != nil && (s.until.IsZero() || now.Before(s.until)) {
+		return s.stapled
+	}
+
+	return s.plain
+}
+
+// name names the certificate in logs and metrics.
+func (c *listenerCert) name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leaf.Subject.CommonName != "" {
+		return c.leaf.Subject.CommonName
+	}
+	if len(c.leaf.DNSNames) > 0 {
+		return c.leaf.DNSNames[0]
+	}
+
+	return c.leaf.SerialNumber.Text(16)
+}
+
+// canStaple reports whether the certificate can be stapled.
+func (c *listenerCert) canStaple() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stapling && c.issuer != nil && len(c.leaf.OCSPServer) > 0
+}
+
+// refreshOCSP fetches a fresh staple at now. When the responder fails, the
+// staple fetched before is served until it expires, then none.
+func (c *listenerCert) refreshOCSP(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	leaf, issuer := c.leaf, c.issuer
+	c.mu.Unlock()
+	if issuer == nil || len(leaf.OCSPServer) == 0 {
+		return errNoOCSP
+	}
+	raw, resp, err := fetchOCSP(ctx, c.client, leaf, issuer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leaf != leaf {
+		// The certificate was reloaded meanwhile.
+		return nil
+	}
+	if err != nil {
+		c.ocspFailed.Add(1)
+		c.nextOCSP = now.Add(jittered(ocspRetry))
+		return err
+	}
+	c.ocspOK.Add(1)
+	served := c.served.Load()
+	stapled := *served.plain
+	stapled.OCSPStaple = raw
+	c.served.Store(&servedCert{plain: served.plain, stapled: &stapled, until: resp.NextUpdate})
+
+	// Renewing halfway through the validity of the response leaves time
+	// to retry a failing responder before the staple expires.
+	refresh := ocspRefresh
+	if !resp.NextUpdate.IsZero() {
+		refresh = resp.NextUpdate.Sub(now) / 2
+	}
+	c.nextOCSP = now.Add(max(jittered(refresh), ocspRetry))
+
+	return nil
+}
+
+// fetchOCSP asks the responder of leaf for its status, returning the raw
+// response to staple. Only good statuses are stapled.
+func fetchOCSP(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %s answered %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("responder %s reports the certificate as not good (status %d)", leaf.OCSPServer[0], parsed.Status)
+	}
+
+	return raw, parsed, nil
+}
+
+// jittered returns d give or take a tenth, so that instances sharing a
+// certificate do not hit its responder at once.
+func jittered(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+
+	return d - d/10 + rand.N(d/5+1)
+}
+
+// checkExpiry returns how long the certificate has left at now, and whether
+// it came within the warning of its expiry since the last check.
+func (c *listenerCert) checkExpiry(now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	left := c.leaf.NotAfter.Sub(now)
+	if left >= c.warning {
+		c.expiring = false
+		return left, false
+	}
+	crossed := !c.expiring
+	c.expiring = true
+
+	return left, crossed
+}
+
+// nextCheck returns how long to wait at now before the staple is due or the
+// certificate comes within the warning of its expiry.
+func (c *listenerCert) nextCheck(now time.Time) time.Duration {
+	stapling := c.canStaple()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wait := certCheckInterval
+	if stapling {
+		wait = min(wait, c.nextOCSP.Sub(now))
+	}
+	if !c.expiring {
+		wait = min(wait, c.leaf.NotAfter.Add(-c.warning).Sub(now))
+	}
+
+	return max(wait, 0)
+}
+
+// ocspDue reports whether the staple is to be renewed at now.
+func (c *listenerCert) ocspDue(now time.Time) bool {
+	if !c.canStaple() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !now.Before(c.nextOCSP)
+}
+
+// writeMetrics renders the expiry of the certificate at now and its OCSP
+// stapling.
+func (c *listenerCert) writeMetrics(w io.Writer, now time.Time) {
+	c.mu.Lock()
+	left := c.leaf.NotAfter.Sub(now)
+	c.mu.Unlock()
+	stapled := 0
+	if c.get(now).OCSPStaple != nil {
+		stapled = 1
+	}
+	fmt.Fprintln(w, "# HELP lb_tls_certificate_expiry_days Days until the listener certificate expires.")
+	fmt.Fprintln(w, "# TYPE lb_tls_certificate_expiry_days gauge")
+	fmt.Fprintf(w, "lb_tls_certificate_expiry_days{certificate=%q} %.2f\n", c.name(), left.Hours()/24)
+	fmt.Fprintln(w, "# HELP lb_tls_certificate_reloads_total Times the listener certificate was read again.")
+	fmt.Fprintln(w, "# TYPE lb_tls_certificate_reloads_total counter")
+	fmt.Fprintf(w, "lb_tls_certificate_reloads_total %d\n", c.reloads.Load())
+	fmt.Fprintln(w, "# HELP lb_tls_ocsp_stapled Whether handshakes are served an OCSP staple.")
+	fmt.Fprintln(w, "# TYPE lb_tls_ocsp_stapled gauge")
+	fmt.Fprintf(w, "lb_tls_ocsp_stapled %d\n", stapled)
+	fmt.Fprintln(w, "# HELP lb_tls_ocsp_fetches_total OCSP responses fetched for the staple by result.")
+	fmt.Fprintln(w, "# TYPE lb_tls_ocsp_fetches_total counter")
+	fmt.Fprintf(w, "lb_tls_ocsp_fetches_total{result=\"ok\"} %d\n", c.ocspOK.Load())
+	fmt.Fprintf(w, "lb_tls_ocsp_fetches_total{result=\"error\"} %d\n", c.ocspFailed.Load())
+}
+
+// ReloadListenerCertificate reads the certificate files of the TLS
+// listener again, starting the monitoring of the certificate over.
+func (lb *LoadBalancer) ReloadListenerCertificate() error {
+	if lb.listenerCert == nil {
+		return nil
+	}
+
+	return lb.listenerCert.reload()
+}
+
+// RunCertificateMonitor keeps the OCSP staple of the listener certificate
+// fresh and reports the certificate coming within the expiry warning until
+// ctx is done: with a warning at startup, and with an
+// EventCertificateExpiring as well at runtime or after a reload.
+func (lb *LoadBalancer) RunCertificateMonitor(ctx context.Context) {
+	c := lb.listenerCert
+	if c == nil {
+		return
+	}
+	lb.checkCertExpiry(false)
+	for {
+		timer := time.NewTimer(c.nextCheck(lb.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-c.wake:
+			timer.Stop()
+		}
+		markActive(ctx)
+		if now := lb.now(); c.ocspDue(now) {
+			if err := c.refreshOCSP(ctx, now); err != nil && ctx.Err() == nil {
+				fmt.Printf("error: OCSP staple of %q: %v\n", c.name(), err)
+			}
+		}
+		lb.checkCertExpiry(true)
+	}
+}
+
+// checkCertExpiry warns when the listener certificate came within the
+// expiry warning, publishing an event at runtime.
+func (lb *LoadBalancer) checkCertExpiry(runtime bool) {
+	c := lb.listenerCert
+	left, crossed := c.checkExpiry(lb.now())
+	if !crossed {
+		return
+	}
+	reason := fmt.Sprintf("TLS certificate %q expires in %s", c.name(), left.Round(time.Minute))
+	if left <= 0 {
+		reason = fmt.Sprintf("TLS certificate %q has expired", c.name())
+	}
+	fmt.Printf("warning: %s\n", reason)
+	if runtime {
+		lb.events.publish(Event{Type: EventCertificateExpiring, Reason: reason})
+	}
+}
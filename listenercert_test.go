@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestChain returns a certificate for lb.example valid for lifetime,
+// issued by the test CA ca and naming ocspURL as its responder.
+func newTestChain(t *testing.T, ca tls.Certificate, ocspURL string, lifetime time.Duration) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "lb.example"},
+		DNSNames:     []string{"lb.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertFiles writes cert and its key as PEM files into dir.
+func writeCertFiles(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain []byte
+	for _, c := range cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, chain, 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+
+	return certFile, keyFile
+}
+
+// ocspResponder answers OCSP requests for certificates of ca as good for
+// validity, unless failing.
+type ocspResponder struct {
+	ca       tls.Certificate
+	validity atomic.Int64
+	failing  atomic.Bool
+	requests atomic.Int32
+}
+
+func (r *ocspResponder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.requests.Add(1)
+	if r.failing.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	ocspReq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	resp, err := ocsp.CreateResponse(r.ca.Leaf, r.ca.Leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: ocspReq.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Duration(r.validity.Load())),
+	}, r.ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/ocsp-response")
+	rw.Write(resp)
+}
+
+// handshakeStaple returns the OCSP staple of a TLS handshake with addr.
+func handshakeStaple(t *testing.T, addr string) []byte {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "lb.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().OCSPResponse
+}
+
+func TestListenerCert_OCSPStapling(t *testing.T) {
+	ca, _, _ := newTestCert(t, "ca.example", 24*time.Hour)
+	responder := &ocspResponder{ca: ca}
+	responder.validity.Store(int64(time.Hour))
+	stub := httptest.NewServer(responder)
+	defer stub.Close()
+	cert := newTestChain(t, ca, stub.URL, 24*time.Hour)
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)}, WithListenerTLS(ListenerTLS{Port: "8443", Certificate: cert, OCSPStapling: true}))
+	now := time.Now()
+	var clock atomic.Pointer[time.Time]
+	clock.Store(&now)
+	lb.now = func() time.Time { return *clock.Load() }
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := lb.NewServer(lb.Handler())
+	go srv.Serve(tls.NewListener(ln, lb.TLSConfig()))
+	defer srv.Close()
+
+	if staple := handshakeStaple(t, ln.Addr().String()); staple != nil {
+		t.Errorf("Expected no staple before one is fetched, got %d bytes", len(staple))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.RunCertificateMonitor(ctx)
+	}()
+	waitFor(t, "the staple", func() bool { return lb.listenerCert.get(lb.now()).OCSPStaple != nil })
+	cancel()
+	<-done
+	staple := handshakeStaple(t, ln.Addr().String())
+	if resp, err := ocsp.ParseResponseForCert(staple, cert.Leaf, ca.Leaf); err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("Expected a good staple in the handshake, got %v", err)
+	}
+	c := lb.listenerCert
+	if next := c.nextOCSP.Sub(now); next < 27*time.Minute || next > 33*time.Minute {
+		t.Errorf("Expected the staple to be renewed halfway through its validity with jitter, in %s", next)
+	}
+
+	// A failing responder keeps the staple until it expires.
+	responder.failing.Store(true)
+	if err := c.refreshOCSP(context.Background(), now); err == nil {
+		t.Error("Expected the failing responder to be reported")
+	}
+	if c.get(now).OCSPStaple == nil {
+		t.Error("Expected the staple to be kept while valid")
+	}
+	if next := c.nextOCSP.Sub(now); next < 54*time.Second || next > 66*time.Second {
+		t.Errorf("Expected the responder to be tried again in about a minute, in %s", next)
+	}
+	later := now.Add(2 * time.Hour)
+	clock.Store(&later)
+	if staple := handshakeStaple(t, ln.Addr().String()); staple != nil {
+		t.Error("Expected no staple once it expired")
+	}
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"lb_tls_ocsp_stapled 0", `lb_tls_ocsp_fetches_total{result="ok"} 1`, `lb_tls_ocsp_fetches_total{result="error"} 1`} {
+		if !strings.Contains(metrics.Body.String(), want+"\n") {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+
+	// The staple is back once the responder recovers.
+	responder.failing.Store(false)
+	responder.validity.Store(int64(4 * time.Hour))
+	if err := c.refreshOCSP(context.Background(), later); err != nil {
+		t.Fatal(err)
+	}
+	if staple := handshakeStaple(t, ln.Addr().String()); staple == nil {
+		t.Error("Expected the renewed staple in the handshake")
+	}
+	if n := responder.requests.Load(); n != 3 {
+		t.Errorf("Expected 3 requests to the responder, got %d", n)
+	}
+}
+
+func TestListenerCert_NoResponder(t *testing.T) {
+	ca, _, _ := newTestCert(t, "ca.example", 24*time.Hour)
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)}, WithListenerTLS(ListenerTLS{
+		Port: "8443", Certificate: newTestChain(t, ca, "", 24*time.Hour), OCSPStapling: true,
+	}))
+	if lb.listenerCert.canStaple() {
+		t.Error("Expected a certificate without responder not to be stapled")
+	}
+	if err := lb.listenerCert.refreshOCSP(context.Background(), time.Now()); err != errNoOCSP {
+		t.Errorf("Expected errNoOCSP, got %v", err)
+	}
+}
+
+func TestListenerCert_ExpiryMonitoring(t *testing.T) {
+	ca, _, _ := newTestCert(t, "ca.example", 365*24*time.Hour)
+	dir := t.TempDir()
+	cert := newTestChain(t, ca, "", 5*24*time.Hour)
+	certFile, keyFile := writeCertFiles(t, dir, cert)
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)}, WithListenerTLS(ListenerTLS{
+		Port: "8443", Certificate: cert, CertFile: certFile, KeyFile: keyFile, ExpiryWarning: 3 * 24 * time.Hour,
+	}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	sub := lb.Subscribe(8)
+	defer sub.Close()
+	expiryDays := func() string {
+		t.Helper()
+		metrics := httptest.NewRecorder()
+		lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+		for _, line := range strings.Split(metrics.Body.String(), "\n") {
+			if v, ok := strings.CutPrefix(line, `lb_tls_certificate_expiry_days{certificate="lb.example"} `); ok {
+				return v
+			}
+		}
+		t.Fatal("Expected the expiry of the certificate in the metrics")
+		return ""
+	}
+	expiring := func() []Event {
+		var events []Event
+		for {
+			select {
+			case e := <-sub.C:
+				if e.Type == EventCertificateExpiring {
+					events = append(events, e)
+				}
+			default:
+				return events
+			}
+		}
+	}
+
+	lb.checkCertExpiry(false)
+	if got := expiring(); len(got) != 0 {
+		t.Errorf("Expected no event while the certificate is far from expiring, got %v", got)
+	}
+	now = now.Add(60 * time.Hour)
+	if want := fmt.Sprintf("%.2f", cert.Leaf.NotAfter.Sub(now).Hours()/24); expiryDays() != want {
+		t.Errorf("Expected %s days until expiry, got %s", want, expiryDays())
+	}
+	lb.checkCertExpiry(true)
+	lb.checkCertExpiry(true)
+	if got := expiring(); len(got) != 1 || !strings.Contains(got[0].Reason, `"lb.example" expires in 60h`) {
+		t.Errorf("Expected one event on crossing the warning, got %v", got)
+	}
+
+	// A rotated certificate starts the monitoring over.
+	rotated := newTestChain(t, ca, "", 30*24*time.Hour)
+	writeCertFiles(t, dir, rotated)
+	if err := lb.ReloadListenerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	lb.checkCertExpiry(true)
+	if got := expiring(); len(got) != 0 {
+		t.Errorf("Expected no event for the rotated certificate, got %v", got)
+	}
+	if want := fmt.Sprintf("%.2f", rotated.Leaf.NotAfter.Sub(now).Hours()/24); expiryDays() != want {
+		t.Errorf("Expected %s days until expiry after the reload, got %s", want, expiryDays())
+	}
+	writeCertFiles(t, dir, newTestChain(t, ca, "", 24*time.Hour))
+	if err := lb.ReloadListenerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	lb.checkCertExpiry(true)
+	if got := expiring(); len(got) != 1 || !strings.Contains(got[0].Reason, "has expired") {
+		t.Errorf("Expected an event for the reloaded expired certificate, got %v", got)
+	}
+}
+
+func TestListenerCert_StartupWarning(t *testing.T) {
+	ca, _, _ := newTestCert(t, "ca.example", 24*time.Hour)
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)}, WithListenerTLS(ListenerTLS{
+		Port: "8443", Certificate: newTestChain(t, ca, "", 24*time.Hour),
+	}))
+	sub := lb.Subscribe(8)
+	defer sub.Close()
+
+	lb.checkCertExpiry(false)
+	if !lb.listenerCert.expiring {
+		t.Error("Expected a certificate within the default warning to be reported")
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("Expected only a warning at startup, got event %v", e)
+	default:
+	}
+}
@@ -0,0 +1,1577 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SelectorFallback controls what happens when a route's selector matches no
+// alive server.
+type SelectorFallback string
+
+const (
+	// FallbackFail rejects the request with ErrNoMatchingServers.
+	FallbackFail SelectorFallback = "fail"
+
+	// FallbackIgnore drops the selector and selects from every alive server.
+	FallbackIgnore SelectorFallback = "ignore"
+)
+
+// Route constrains selection for requests whose path starts with PathPrefix,
+// or matches PathPattern, to the servers matching Selector. HeaderSelectors
+// maps request header names to label keys, so a request carrying
+// "X-Tier: premium" with {"X-Tier": "tier"} additionally requires
+// tier=premium.
+type Route struct {
+	Name            string
+	PathPrefix      string
+	Selector        Selector
+	HeaderSelectors map[string]string
+	Fallback        SelectorFallback
+
+	// PathPattern matches whole paths instead of a prefix, e.g.
+	// "/users/{id}/avatar", where {id} captures a path segment and a final
+	// {rest...} the remainder of the path. Captured parameters feed the key
+	// extractor "path-param:<name>" and the {path.<name>} placeholders of
+	// SetHeaders.
+	PathPattern string
+
+	// CaseInsensitive matches PathPrefix, or the literal segments of
+	// PathPattern, regardless of case.
+	CaseInsensitive bool
+
+	// TrailingSlash sets how paths differing from the route's prefix or
+	// pattern only by a trailing slash are treated.
+	TrailingSlash TrailingSlash
+
+	// SetHeaders sets request headers on the route's requests. Values may
+	// hold {path.<name>} placeholders.
+	SetHeaders map[string]string
+
+	// Retry overrides the load balancer's retry policy for the route.
+	Retry *RetryPolicy
+
+	// BodyBuffer overrides the load balancer's body buffering policy for the
+	// route.
+	BodyBuffer *BodyBufferPolicy
+
+	// Strategies overrides the load balancer's strategy chain for the route,
+	// e.g. to hash on a tenant ID found only in the route's paths.
+	Strategies []Strategy
+
+	// HeaderLimits overrides the load balancer's header limits for the
+	// route, e.g. for an API that legitimately needs large headers.
+	HeaderLimits *HeaderLimits
+
+	// Faults injects failures into the route's requests. It requires
+	// WithUnsafeFaultInjection.
+	Faults *FaultInjection
+
+	// Sensitive marks routes whose request bodies must never be recorded.
+	Sensitive bool
+
+	// RawPath exempts the route from path normalization, forwarding its
+	// paths byte for byte. It is matched against the path as received.
+	RawPath bool
+
+	// Redirects overrides the load balancer's redirect policy for the route.
+	Redirects *RedirectPolicy
+
+	// Signer signs the route's requests to servers, before any signer of
+	// the server.
+	Signer Signer
+
+	// Stale overrides the stale windows cached responses of the route
+	// announce.
+	Stale *StalePolicy
+
+	// NegativeTTL caches the route's 404 and 410 responses for that long.
+	// They are not cached without it.
+	NegativeTTL time.Duration
+
+	// Compare overrides how mirrored responses of the route are compared.
+	Compare *Comparison
+
+	// Sticky overrides the sticky sessions of the load balancer for the
+	// route.
+	Sticky *StickySessions
+
+	// Streams overrides the load balancer's stream policy for the route.
+	Streams *StreamPolicy
+
+	// Idempotency deduplicates the route's requests carrying an
+	// Idempotency-Key header.
+	Idempotency *IdempotencyKeys
+
+	// Static answers the route's requests without contacting a server.
+	Static *StaticResponse
+
+	// Validate rejects the route's responses that fail validation.
+	Validate *ResponseValidation
+
+	// Journal accepts the route's requests into a journal and delivers
+	// them in the background, at least once.
+	Journal *Journal
+
+	// Transform rewrites the route's request bodies before they are sent to
+	// servers.
+	Transform *BodyTransform
+
+	// AuthRequest consults an auth service before the route's requests are
+	// proxied.
+	AuthRequest *AuthRequest
+
+	// Countries restricts the route to clients in the listed countries,
+	// given as ISO 3166 codes. It requires WithGeoIP.
+	Countries []string
+
+	// GRPCService restricts the route to the methods of a gRPC service,
+	// given by its full name, e.g. "helloworld.Greeter". Unlike a path
+	// prefix, it never matches services whose name merely starts with it.
+	GRPCService string
+
+	// ReadWrite sends the route's writes to other servers than its reads.
+	ReadWrite *ReadWriteSplit
+
+	// Methods restricts the methods of the route's requests.
+	Methods *MethodPolicy
+
+	// FirstByteTimeout fails attempts whose server did not send the first
+	// byte of its response, headers or body, that long after the attempt
+	// started, overriding the server's. Nothing has reached the client by
+	// then, so the failure, of class ClassFirstByteTimeout, is retried as
+	// the retry policy allows. Unlike the request deadline, it does not
+	// limit how long the response may then take, as streams do.
+	FirstByteTimeout time.Duration
+
+	// path is the compiled PathPattern.
+	path *pathPattern
+}
+
+// selectorFor returns the effective selector of the route for req at now.
+func (r *Route) selectorFor(req *http.Request, now time.Time) Selector {
+	selector := r.Selector
+	if r.ReadWrite != nil && r.ReadWrite.primary(req, now) {
+		selector = r.ReadWrite.Writes
+	}
+	for header, key := range r.HeaderSelectors {
+		if value := req.Header.Get(header); value != "" {
+			selector = append(selector[:len(selector):len(selector)], Requirement{
+				Key:      key,
+				Operator: OpEquals,
+				Values:   []string{value},
+			})
+		}
+	}
+
+	return selector
+}
+
+// Option configures optional settings of a LoadBalancer.
+type Option func(*LoadBalancer)
+
+// WithRoutes installs routes that constrain server selection by label. Routes
+// are matched in order and the first matching path prefix wins.
+func WithRoutes(routes ...Route) Option {
+	return func(lb *LoadBalancer) {
+		lb.routes.Store(&routes)
+	}
+}
+
+// routeList returns the routes in effect. Routes are replaced as a whole,
+// so the slice returned is never modified.
+func (lb *LoadBalancer) routeList() []Route {
+	if routes := lb.routes.Load(); routes != nil {
+		return *routes
+	}
+
+	return nil
+}
+
+// WithAccessLog writes one structured JSON line per proxied request to w.
+func WithAccessLog(w io.Writer) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessLog = slog.New(slog.NewJSONHandler(w, nil))
+		lb.accessOut = w
+	}
+}
+
+// WithLogger sets the logger for operational messages such as per-request
+// strategy decisions, which are logged at debug level. By default they are
+// discarded. Messages below the level set with WithLogLevel or SetLogLevel
+// are dropped before reaching the logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(lb *LoadBalancer) {
+		lb.logger = logger
+	}
+}
+
+// serverCounters holds the cumulative traffic counters of a server.
+type serverCounters struct {
+	requests uint64
+	inFlight int64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+	latency  *histogram
+
+	// failures counts failed attempts by class, including retried ones.
+	failures map[ErrorClass]uint64
+
+	// invalidStreak counts the invalid responses in a row of validated
+	// attempts; the server is ejected until ejectedUntil once it reaches
+	// the route's limit.
+	invalidStreak int
+	ejectedUntil  time.Time
+	ejections     uint64
+
+	// backoffUntil is when the drain the server asked for in feedback
+	// ends. backingOff is set until its end is published, which
+	// backoffTimer does should no request notice it first.
+	backoffUntil time.Time
+	backingOff   bool
+	backoffTimer *time.Timer
+}
+
+type LoadBalancer struct {
+	port         string
+	mu           sync.Mutex
+	strategies   []Strategy
+	servers      []Server
+	routes       atomic.Pointer[[]Route]
+	counters     map[string]*serverCounters
+	accessLog    *slog.Logger
+	accessFormat *accessLogFormat
+	accessOut    io.Writer
+	logger       *slog.Logger
+	configHash   string
+	config       *ConfigDump
+	queue        *admissionQueue
+	warmup       *Warmup
+	retry        *RetryPolicy
+	redirects    *RedirectPolicy
+	bodyBuffer   BodyBufferPolicy
+	headerLimits HeaderLimits
+	readiness    Readiness
+	listening    atomic.Bool
+	started      chan struct{}
+	startup      Startup
+
+	// recentErrors are the last upstream errors, for /admin/errors.
+	recentErrors *errorRing
+
+	// workers runs the background workers.
+	workers *supervisor
+
+	draining        atomic.Bool
+	allowEmpty      bool
+	dryRun          bool
+	override        *BackendOverride
+	debug           *DebugExplain
+	warming         map[string]*warmupState
+	slowStarts      map[string]time.Time
+	pending         map[string]*pendingState
+	feedback        *Feedback
+	instanceID      string
+	servedBy        *ServedBy
+	logs            *logControl
+	faults          *faultInjector
+	requests        *requestTimings
+	recorder        *recorder
+	flap            *FlapDetection
+	cache           *responseStore
+	idempotency     *idempotencyStore
+	auth            *authRequestStore
+	journals        map[*Journal]*journal
+	errorPages      map[int]*ResponseTemplate
+	templateVars    map[string]string
+	mirror          *mirrorer
+	deadline        *RequestDeadline
+	adaptive        *weightController
+	apiKeys         *apiKeyStore
+	tenants         *tenantRegistry
+	sharedLimits    *sharedRateLimiter
+	geo             *geoIPResolver
+	srv             *srvDiscoverer
+	control         *controlPlane
+	gossip          *gossiper
+	fds             *fdGuard
+	capabilityProbe *CapabilityProbe
+	sticky          *StickySessions
+	fairness        *fairnessRecorder
+	streamPolicy    *StreamPolicy
+	streams         *streamTracker
+	events          *eventBus
+	dns             *DNSCache
+	connLimits      ConnectionLimits
+	normalize       *PathNormalization
+	conns           *connTracker
+
+	passthrough      *Passthrough
+	passthroughStats *passthroughStats
+
+	// listenerTLS is the HTTPS listener, and altSvc the Alt-Svc header
+	// advertising its HTTP/3 listener.
+	listenerTLS  *ListenerTLS
+	listenerCert *listenerCert
+	altSvc       string
+
+	// drains holds the servers taken out of selection with Drain.
+	drains map[string]*drainState
+
+	// credits accrue the share of selections offered to servers fading
+	// out or ramping up.
+	credits map[string]float64
+
+	// healthOverrides holds the servers whose liveness is pinned with
+	// SetHealthOverride.
+	healthOverrides map[string]*HealthOverride
+
+	// capabilities holds what capability probes found about servers.
+	capabilities map[string]*Capabilities
+
+	// peerDown holds the servers reported down by peers, until when their
+	// reports are trusted.
+	peerDown map[string]time.Time
+
+	// health is the health history of each server by address.
+	health            map[string]*healthHistory
+	healthHistorySize int
+
+	accessLogOff   atomic.Bool
+	serverDefaults *ServerConfig
+
+	// now returns the current time for maintenance windows; tests replace
+	// it.
+	now func() time.Time
+
+	healthCtx      context.Context
+	healthCancels  map[string]context.CancelFunc
+	healthRegistry *HealthRegistry
+
+	alerts *alertEvaluator
+	ramp   *rampScheduler
+}
+
+// NewLoadBalancer creates a load balancer for servers. It rejects pools that
+// violate the pool invariants: an empty pool without WithAllowEmpty, negative
+// weights, or the same backend listed twice.
+func NewLoadBalancer(port string, servers []Server, opts ...Option) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		port:         port,
+		strategies:   []Strategy{&roundRobin{}},
+		servers:      servers,
+		counters:     make(map[string]*serverCounters),
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		warming:      make(map[string]*warmupState),
+		slowStarts:   make(map[string]time.Time),
+		pending:      make(map[string]*pendingState),
+		health:       make(map[string]*healthHistory),
+		drains:       make(map[string]*drainState),
+		credits:      make(map[string]float64),
+		bodyBuffer:   defaultBodyBuffer,
+		readiness:    defaultReadiness,
+		startup:      defaultStartup,
+		started:      make(chan struct{}),
+		recentErrors: newErrorRing(defaultRecentErrors),
+		workers:      newSupervisor(),
+		logs:         newLogControl(),
+		faults:       newFaultInjector(),
+		requests:     newRequestTimings(),
+		conns:        newConnTracker(),
+		streams:      newStreamTracker(),
+		events:       newEventBus(),
+		auth:         newAuthRequestStore(),
+		alerts:       newAlertEvaluator(),
+		now:          time.Now,
+
+		healthOverrides: make(map[string]*HealthOverride),
+		healthCancels:   make(map[string]context.CancelFunc),
+	}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	if err := checkPool(servers, lb.allowEmpty); err != nil {
+		return nil, err
+	}
+	if err := lb.checkFaults(); err != nil {
+		return nil, err
+	}
+	if routes := lb.routes.Load(); routes != nil {
+		compiled, err := compileRoutes(*routes)
+		if err != nil {
+			return nil, err
+		}
+		lb.routes.Store(&compiled)
+	}
+	lb.idempotency = newIdempotencyStore(lb.routeList())
+	if lb.fds != nil {
+		if err := lb.checkFDLimit(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.apiKeys != nil {
+		if err := lb.apiKeys.reload(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.tenants != nil {
+		if err := lb.tenants.init(lb.apiKeys != nil); err != nil {
+			return nil, err
+		}
+	}
+	if lb.listenerTLS != nil {
+		cert, err := newListenerCert(lb.listenerTLS)
+		if err != nil {
+			return nil, err
+		}
+		lb.listenerCert = cert
+	}
+	if lb.ramp != nil {
+		if err := lb.ramp.plan.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if lb.accessFormat != nil {
+		if err := lb.accessFormat.init(); err != nil {
+			return nil, err
+		}
+		lb.accessFormat.out = lb.accessOut
+	}
+	if !lb.dryRun {
+		journals, err := openJournals(lb.routeList())
+		if err != nil {
+			return nil, err
+		}
+		lb.journals = journals
+	}
+	if lb.instanceID == "" {
+		lb.instanceID = defaultInstanceID()
+	}
+	lb.logger = slog.New(&leveledHandler{Handler: lb.logger.Handler(), level: lb.logs.level}).
+		With(slog.String("instance", lb.instanceID))
+	if lb.accessLog != nil {
+		lb.accessLog = lb.accessLog.With(slog.String("instance", lb.instanceID))
+	}
+	lb.mu.Lock()
+	for _, server := range lb.servers {
+		lb.adoptClock(server)
+		lb.probeCapabilitiesLocked(server)
+	}
+	lb.mu.Unlock()
+	if lb.mirror != nil {
+		lb.Go(context.Background(), "mirror", lb.mirror.run)
+	}
+	if lb.recorder != nil {
+		lb.Go(context.Background(), "recorder", lb.recorder.run)
+	}
+
+	return lb, nil
+}
+
+// AddServer registers a new server with the load balancer. It returns
+// ErrServerExists if the same backend is already registered, comparing
+// normalized addresses, or another server has the same name, and
+// ErrInvalidWeight for a negative weight.
+// With warm-up enabled the server is not selected until warm-up finishes.
+func (lb *LoadBalancer) AddServer(server Server) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if err := checkServer(server); err != nil {
+		return err
+	}
+	key, name := normalizeAddress(server.Address()), serverName(server)
+	for _, s := range lb.servers {
+		if normalizeAddress(s.Address()) == key {
+			return fmt.Errorf("add %q: %w: same backend as %q", server.Address(), ErrServerExists, s.Address())
+		}
+		if serverName(s) == name {
+			return fmt.Errorf("add %q: %w: name %q is taken by %q", server.Address(), ErrServerExists, name, s.Address())
+		}
+	}
+	lb.servers = append(lb.servers, server)
+	lb.events.publish(Event{Type: EventBackendAdded, Backend: serverName(server)})
+	lb.adoptClock(server)
+	lb.startHealthCheckLocked(server)
+	_, warmable := server.(Warmable)
+	if warmable || lb.warmup != nil && len(lb.warmup.Requests) > 0 {
+		lb.startWarmupLocked(server)
+	}
+	lb.probeCapabilitiesLocked(server)
+
+	return nil
+}
+
+// RemoveServer unregisters the server with the given name or address and
+// closes it if it implements io.Closer. It returns ErrServerNotFound if no
+// such server is registered.
+func (lb *LoadBalancer) RemoveServer(ref string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	server := lb.findServerLocked(ref)
+	for i, s := range lb.servers {
+		if s == server {
+			addr := serverName(s)
+			lb.servers = append(lb.servers[:i:i], lb.servers[i+1:]...)
+			delete(lb.counters, addr)
+			delete(lb.warming, addr)
+			delete(lb.slowStarts, addr)
+			delete(lb.credits, addr)
+			delete(lb.pending, addr)
+			delete(lb.health, addr)
+			if d := lb.drains[addr]; d != nil && d.timer != nil {
+				d.timer.Stop()
+			}
+			delete(lb.drains, addr)
+			delete(lb.healthOverrides, addr)
+			delete(lb.capabilities, addr)
+			if lb.adaptive != nil {
+				delete(lb.adaptive.factors, addr)
+				delete(lb.adaptive.last, addr)
+			}
+			lb.stopHealthCheckLocked(addr)
+			closeServer(s)
+			lb.events.publish(Event{Type: EventBackendRemoved, Backend: addr})
+			return nil
+		}
+	}
+
+	return fmt.Errorf("remove %q: %w", ref, ErrServerNotFound)
+}
+
+// Close closes every server implementing io.Closer and the request
+// journals. It is called on shutdown once requests have drained.
+func (lb *LoadBalancer) Close() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, s := range lb.servers {
+		closeServer(s)
+	}
+	for _, j := range lb.journals {
+		j.close()
+	}
+	if lb.passthroughStats != nil {
+		lb.passthroughStats.closeAll()
+	}
+}
+
+// SetServerLabels replaces the labels of the server with the given name or
+// address. Servers that do not support runtime label updates report
+// errors.ErrUnsupported.
+func (lb *LoadBalancer) SetServerLabels(ref string, labels map[string]string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	s := lb.findServerLocked(ref)
+	if s == nil {
+		return fmt.Errorf("set labels on %q: %w", ref, ErrServerNotFound)
+	}
+	setter, ok := s.(interface{ SetLabels(map[string]string) })
+	if !ok {
+		return fmt.Errorf("set labels on %q: %w", ref, errors.ErrUnsupported)
+	}
+	setter.SetLabels(labels)
+
+	return nil
+}
+
+// SetServerAddress moves the server with the given name or address to addr,
+// keeping its name and with it its counters, sticky sessions and state.
+// Its idle connections to the old address are closed. It returns
+// ErrServerExists if another server has addr, and servers that cannot move
+// report errors.ErrUnsupported.
+func (lb *LoadBalancer) SetServerAddress(ref, addr string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	server := lb.findServerLocked(ref)
+	if server == nil {
+		return fmt.Errorf("set address of %q: %w", ref, ErrServerNotFound)
+	}
+	key := normalizeAddress(addr)
+	for _, s := range lb.servers {
+		if s != server && normalizeAddress(s.Address()) == key {
+			return fmt.Errorf("set address of %q: %w: same backend as %q", ref, ErrServerExists, serverName(s))
+		}
+	}
+	setter, ok := server.(interface{ SetAddress(string) error })
+	if !ok {
+		return fmt.Errorf("set address of %q: %w", ref, errors.ErrUnsupported)
+	}
+	from := server.Address()
+	if err := setter.SetAddress(addr); err != nil {
+		return fmt.Errorf("set address of %q: %w", ref, err)
+	}
+	fmt.Printf("server %s moved from %s to %s\n", serverName(server), from, addr)
+	delete(lb.capabilities, serverName(server))
+	lb.probeCapabilitiesLocked(server)
+
+	return nil
+}
+
+// ServerStats is a point-in-time snapshot of a server's state. BytesIn and
+// BytesOut count request bytes received from and response bytes sent to
+// clients, including bytes relayed over hijacked connections. Name is the
+// server's identity, which outlives changes of its Address.
+type ServerStats struct {
+	Name     string            `json:"name"`
+	Address  string            `json:"address"`
+	Alive    bool              `json:"alive"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Weight   int               `json:"weight"`
+	Requests uint64            `json:"requests"`
+	InFlight int64             `json:"in_flight"`
+	Errors   uint64            `json:"errors"`
+	BytesIn  uint64            `json:"bytes_in"`
+	BytesOut uint64            `json:"bytes_out"`
+
+	// Latency quantiles in milliseconds, estimated from a histogram.
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP95 float64 `json:"latency_p95_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+
+	LastProbe      *time.Time `json:"last_probe,omitempty"`
+	LastProbeError string     `json:"last_probe_error,omitempty"`
+
+	// Failures counts failed attempts by error class.
+	Failures map[ErrorClass]uint64 `json:"failures,omitempty"`
+
+	// Warmup is set while the server is being warmed up or after a
+	// fail-closed warm-up failed.
+	Warmup *WarmupStatus `json:"warmup,omitempty"`
+
+	// Pending is set while the server's hostname does not resolve yet.
+	Pending *PendingStatus `json:"pending,omitempty"`
+
+	// MaintenanceUntil is set while the server is out of selection for a
+	// scheduled maintenance window, including its lead time.
+	MaintenanceUntil *time.Time `json:"maintenance_until,omitempty"`
+
+	// HealthHistory lists the most recent health transitions, oldest first.
+	// Flapping is set while the server is held down for flapping, and Flaps
+	// counts how often it was.
+	HealthHistory []HealthTransition `json:"health_history,omitempty"`
+	Flapping      bool               `json:"flapping,omitempty"`
+	Flaps         uint64             `json:"flaps,omitempty"`
+
+	// EjectedUntil is set while the server is out of selection for
+	// invalid responses or failed passthrough dials, and Ejections counts
+	// how often it was.
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    uint64     `json:"ejections,omitempty"`
+
+	// BackoffUntil is set while the server is out of selection for a
+	// drain it asked for in feedback.
+	BackoffUntil *time.Time `json:"backoff_until,omitempty"`
+
+	// Draining is set while the server is out of selection through Drain.
+	// Fading is set instead while it is fading out through DrainFade.
+	Draining bool       `json:"draining,omitempty"`
+	Fading   *DrainFade `json:"fading,omitempty"`
+
+	// SlowStart is set while the server ramps up after its warm-up or a
+	// maintenance window.
+	SlowStart *DrainFade `json:"slow_start,omitempty"`
+
+	// EffectiveWeight is the weight the server is selected with under
+	// adaptive weights, a fade or a slow start.
+	EffectiveWeight *float64 `json:"effective_weight,omitempty"`
+
+	// ReportedLoad is the load the server last reported in its health
+	// checks, if any.
+	ReportedLoad *LoadReport `json:"reported_load,omitempty"`
+
+	// HealthOverride is set while the server's liveness is pinned by
+	// SetHealthOverride; Alive still reports its probes.
+	HealthOverride *HealthOverride `json:"health_override,omitempty"`
+
+	// Transport describes the connections to servers that instrument their
+	// transport.
+	Transport *TransportStats `json:"transport,omitempty"`
+
+	// Config is the effective configuration of servers built from one,
+	// with the server defaults applied.
+	Config *ServerConfig `json:"config,omitempty"`
+
+	// Capabilities is what the capability probe found when the server was
+	// registered, once it finished.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Stats returns a consistent snapshot of every registered server.
+func (lb *LoadBalancer) Stats() []ServerStats {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	stats := make([]ServerStats, len(lb.servers))
+	now := lb.now()
+	for i, s := range lb.servers {
+		stats[i] = ServerStats{
+			Name:    serverName(s),
+			Address: s.Address(),
+			Alive:   s.IsAlive(),
+			Labels:  serverLabels(s),
+			Weight:  serverWeight(s),
+		}
+		if c := lb.counters[serverName(s)]; c != nil {
+			stats[i].Requests = c.requests
+			stats[i].InFlight = c.inFlight
+			stats[i].Errors = c.errors
+			stats[i].LatencyP50 = c.latency.Quantile(0.50) * 1000
+			stats[i].LatencyP95 = c.latency.Quantile(0.95) * 1000
+			stats[i].LatencyP99 = c.latency.Quantile(0.99) * 1000
+			stats[i].BytesIn = c.bytesIn
+			stats[i].BytesOut = c.bytesOut
+			if len(c.failures) > 0 {
+				stats[i].Failures = maps.Clone(c.failures)
+			}
+			if now.Before(c.ejectedUntil) {
+				until := c.ejectedUntil
+				stats[i].EjectedUntil = &until
+			}
+			stats[i].Ejections = c.ejections
+			if now.Before(c.backoffUntil) {
+				until := c.backoffUntil
+				stats[i].BackoffUntil = &until
+			}
+		}
+		if w := lb.warming[serverName(s)]; w != nil {
+			stats[i].Warmup = w.status()
+		}
+		if p := lb.pending[serverName(s)]; p != nil {
+			status := p.status
+			stats[i].Pending = &status
+		}
+		if until, ok := maintenanceUntil(s, now); ok {
+			stats[i].MaintenanceUntil = &until
+		} else {
+			stats[i].SlowStart = lb.slowStartLocked(s, now)
+		}
+		if h := lb.health[serverName(s)]; h != nil {
+			stats[i].HealthHistory = slices.Clone(h.transitions)
+			stats[i].Flapping = h.flapping
+			stats[i].Flaps = h.flaps
+		}
+		stats[i].Draining = lb.drainingLocked(serverName(s))
+		stats[i].Fading = lb.fadeStatusLocked(serverName(s), now)
+		if lb.adaptive != nil || stats[i].Fading != nil || stats[i].SlowStart != nil {
+			weight := float64(stats[i].Weight)
+			if lb.adaptive != nil {
+				weight *= lb.adaptive.factor(serverName(s))
+			}
+			if stats[i].Fading != nil {
+				weight *= stats[i].Fading.Weight
+			} else if stats[i].SlowStart != nil {
+				weight *= stats[i].SlowStart.Weight
+			}
+			stats[i].EffectiveWeight = &weight
+		}
+		if o := lb.healthOverrideLocked(serverName(s), now); o != nil {
+			override := *o
+			stats[i].HealthOverride = &override
+		}
+		if c, ok := s.(configured); ok {
+			stats[i].Config = c.Config()
+		}
+		if r, ok := s.(transportReporter); ok {
+			t := r.TransportStats()
+			stats[i].Transport = &t
+		}
+		if r, ok := s.(LoadReporter); ok {
+			stats[i].ReportedLoad = r.ReportedLoad(now)
+		}
+		if r, ok := s.(probeReporter); ok {
+			if probe := r.LastProbe(); probe != nil {
+				stats[i].LastProbe = &probe.Time
+				if probe.Err != nil {
+					stats[i].LastProbeError = probe.Err.Error()
+				}
+			}
+		}
+		stats[i].Capabilities = lb.capabilities[serverName(s)]
+	}
+
+	return stats
+}
+
+// getNextAvailableServer selects the next available server using the
+// configured strategy, round-robin by default. It checks the servers'
+// availability and skips any that are not alive, ensuring the load balancer
+// forwards requests to active servers only.
+// It returns ErrPoolEmpty when no servers are registered and
+// ErrNoAvailableServers when every registered server is down.
+func (lb *LoadBalancer) getNextAvailableServer() (Server, error) {
+	return lb.getNextMatchingServer(nil, nil)
+}
+
+// getNextMatchingServer behaves like getNextAvailableServer but selects for
+// req and only considers servers whose labels satisfy selector. It returns
+// ErrNoMatchingServers when servers are alive but none of them matches, and
+// ErrServersSaturated when every matching server is at its concurrency limit.
+func (lb *LoadBalancer) getNextMatchingServer(req *http.Request, selector Selector) (Server, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	now := lb.now()
+	candidates, err := lb.candidatesLocked(req, selector, now)
+	if err != nil {
+		return nil, err
+	}
+	candidates = lb.rampCandidates(req, candidates)
+	server, candidates := lb.pickFadingLocked(candidates, now)
+	if server == nil {
+		if server, err = lb.pick(req, candidates); err != nil {
+			return nil, err
+		}
+	}
+	lb.claimLocked(server, now)
+
+	return server, nil
+}
+
+// candidatesLocked returns the servers of the lowest priority group that
+// may be selected for req under selector at now, with the errors of
+// getNextMatchingServer if there are none. lb.mu must be held.
+func (lb *LoadBalancer) candidatesLocked(req *http.Request, selector Selector, now time.Time) ([]Candidate, error) {
+	if len(lb.servers) == 0 {
+		return nil, ErrPoolEmpty
+	}
+
+	anyAlive, anyMatching := false, false
+	var candidates []Candidate
+	for _, server := range lb.servers {
+		if !lb.aliveLocked(server, now) || lb.warming[serverName(server)] != nil ||
+			lb.drainingLocked(serverName(server)) {
+			continue
+		}
+		if _, ok := maintenanceUntil(server, now); ok {
+			continue
+		}
+		anyAlive = true
+		if !selector.Matches(serverLabels(server)) {
+			continue
+		}
+		anyMatching = true
+		inFlight := lb.countersFor(serverName(server)).inFlight
+		if limit := serverMaxConcurrent(server); limit > 0 && inFlight >= int64(limit) {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Server:   server,
+			Weight:   lb.effectiveWeightLocked(server),
+			InFlight: inFlight,
+		})
+	}
+	if e := lb.explanationFor(req); e != nil {
+		lb.explainCandidatesLocked(e, req, selector, now)
+	}
+
+	candidates, err := lb.unattempted(req, candidates)
+	if err != nil {
+		return nil, err
+	}
+	candidates = lowestPriority(candidates)
+	switch {
+	case len(candidates) > 0:
+		return candidates, nil
+	case anyMatching:
+		return nil, ErrServersSaturated
+	case anyAlive:
+		return nil, fmt.Errorf("selector %q: %w", selector, ErrNoMatchingServers)
+	default:
+		return nil, ErrNoAvailableServers
+	}
+}
+
+// claimLocked accounts for a request or connection sent to server, which
+// finishRequest or finishConnection ends. lb.mu must be held.
+func (lb *LoadBalancer) claimLocked(server Server, now time.Time) {
+	if lb.fairness != nil {
+		lb.fairness.record(server, now)
+	}
+	c := lb.countersFor(serverName(server))
+	c.requests++
+	c.inFlight++
+}
+
+// lowestPriority returns the candidates of the lowest priority group.
+func lowestPriority(candidates []Candidate) []Candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	lowest := serverPriority(candidates[0].Server)
+	for _, c := range candidates[1:] {
+		lowest = min(lowest, serverPriority(c.Server))
+	}
+
+	return slices.DeleteFunc(candidates, func(c Candidate) bool { return serverPriority(c.Server) != lowest })
+}
+
+// pick offers req to each strategy of the chain in turn until one decides,
+// using the chain of the matching route if it has one. It returns
+// ErrNoAvailableServers if every strategy passes. lb.mu must be held.
+func (lb *LoadBalancer) pick(req *http.Request, candidates []Candidate) (Server, error) {
+	strategies := lb.strategies
+	if req != nil {
+		if route := lb.matchRoute(req); route != nil && len(route.Strategies) > 0 {
+			strategies = route.Strategies
+		}
+	}
+
+	e := lb.explanationFor(req)
+	if e != nil {
+		e.Passed = e.Passed[:0]
+	}
+	for _, strategy := range strategies {
+		server, err := strategy.Select(req, candidates)
+		if errors.Is(err, ErrStrategyPass) {
+			if e != nil {
+				e.Passed = append(e.Passed, strategy.Name())
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lb.logger.Debug("selected server", "strategy", strategy.Name(), "server", serverName(server))
+		if e != nil {
+			e.decided(strategy, req)
+		}
+		if info := requestInfo(req); info != nil {
+			info.strategy, info.decidedReq = strategy, req
+		}
+		return server, nil
+	}
+
+	return nil, ErrNoAvailableServers
+}
+
+// countersFor returns the counters of the server with the given name,
+// creating them on first use. lb.mu must be held.
+func (lb *LoadBalancer) countersFor(addr string) *serverCounters {
+	c, ok := lb.counters[addr]
+	if !ok {
+		c = &serverCounters{
+			latency:  newHistogram(defaultLatencyBuckets),
+			failures: make(map[ErrorClass]uint64),
+		}
+		lb.counters[addr] = c
+	}
+
+	return c
+}
+
+// finishRequest marks a request to server as completed and adds its outcome,
+// latency and the bytes it transferred to the server's cumulative counters.
+// Responses with a 5xx status count as errors, and a non-empty class counts
+// as a failure of that class.
+func (lb *LoadBalancer) finishRequest(server Server, status int, class ErrorClass, duration time.Duration, bytesIn, bytesOut int64) {
+	lb.mu.Lock()
+	c := lb.countersFor(serverName(server))
+	c.inFlight--
+	lb.checkDrainedLocked(serverName(server))
+	if status >= 500 {
+		c.errors++
+	}
+	if class != "" {
+		c.failures[class]++
+	}
+	c.bytesIn += uint64(bytesIn)
+	c.bytesOut += uint64(bytesOut)
+	c.latency.Observe(duration)
+	lb.mu.Unlock()
+
+	if lb.queue != nil {
+		lb.queue.notify()
+	}
+}
+
+// matchRoute returns the first route whose path prefix or pattern, and gRPC
+// service and countries if any, match req, or nil.
+func (lb *LoadBalancer) matchRoute(req *http.Request) *Route {
+	// Features look the route up many times; the info of the request keeps
+	// the match until the path changes.
+	info := requestInfo(req)
+	if info != nil && info.routed && info.routePath == req.URL.Path {
+		return info.route
+	}
+	route := lb.findRoute(req)
+	if info != nil {
+		info.route, info.routePath, info.routed = route, req.URL.Path, true
+	}
+
+	return route
+}
+
+// findRoute returns the first route matching req, or nil.
+func (lb *LoadBalancer) findRoute(req *http.Request) *Route {
+	routes := lb.routeList()
+	for i := range routes {
+		if !routes[i].matchesPath(req.URL.Path) {
+			continue
+		}
+		if s := routes[i].GRPCService; s != "" && !strings.HasPrefix(req.URL.Path, "/"+s+"/") {
+			continue
+		}
+		if countries := routes[i].Countries; len(countries) > 0 && !slices.Contains(countries, clientCountry(req)) {
+			continue
+		}
+		return &routes[i]
+	}
+
+	return nil
+}
+
+// selectServer picks the server for req, applying the selector of the
+// matching route and its fallback policy when the selected subset is empty.
+// Servers of the client's region are preferred when there are any.
+func (lb *LoadBalancer) selectServer(req *http.Request) (Server, error) {
+	keySelector := apiKeySelector(req)
+	keySelector = append(keySelector[:len(keySelector):len(keySelector)], tenantSelector(req)...)
+	if region := lb.geoSelector(req); region != nil {
+		server, err := lb.selectServerWith(req, append(keySelector[:len(keySelector):len(keySelector)], region...))
+		if !errors.Is(err, ErrNoMatchingServers) {
+			return server, err
+		}
+	}
+
+	return lb.selectServerWith(req, keySelector)
+}
+
+// selectServerWith picks the server for req among those matching
+// keySelector.
+func (lb *LoadBalancer) selectServerWith(req *http.Request, keySelector Selector) (Server, error) {
+	route := lb.matchRoute(req)
+	if route == nil {
+		return lb.getNextMatchingServer(req, keySelector)
+	}
+	e := lb.explanationFor(req)
+	if e != nil {
+		e.Route = route.Name
+	}
+
+	selector := route.selectorFor(req, lb.now())
+	server, err := lb.getNextMatchingServer(req, append(selector[:len(selector):len(selector)], keySelector...))
+	if errors.Is(err, ErrNoMatchingServers) && route.Fallback == FallbackIgnore {
+		if e != nil {
+			e.Fallback = true
+		}
+		return lb.getNextMatchingServer(req, keySelector)
+	}
+
+	return server, err
+}
+
+// serveProxy forwards incoming HTTP requests to the next available server
+// in the load balancer's server pool. It uses the configured strategy to
+// select the target server and logs the forwarding action. Failed attempts
+// are retried on a newly selected server as the retry policy allows.
+func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	req, info := WithRequestInfo(req)
+	req = req.WithContext(withLogger(req.Context(), lb.logger))
+	clientAddr(req)
+	lb.locateClient(req)
+	cw := newCountingResponseWriter(rw)
+	cw.grpc = isGRPC(req)
+	if lb.errorPages != nil {
+		cw.page = &pageRequest{lb: lb, req: req}
+	}
+	lb.setServedBy(cw, nil)
+	replayable := req.Body == nil || req.Body == http.NoBody
+	if !replayable {
+		req.Body = &countingReader{ReadCloser: req.Body, n: &cw.read}
+	}
+	lb.startRecording(req)
+
+	if req.Header.Get("Upgrade") != "" && lb.draining.Load() {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, ErrShuttingDown)
+		cw.Header().Set("Connection", "close")
+		writeError(cw, ErrShuttingDown)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if err := lb.normalizeRequest(req); err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.EscapedPath(), err)
+		writeError(cw, err)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if lb.applyRoutePath(cw, req) {
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if answered, err := lb.checkMethod(cw, req); answered {
+		if err != nil {
+			fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		}
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if err := lb.headerLimitsFor(req).check(req.Header); err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		writeError(cw, err)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if err := lb.checkAPIKey(cw, req); err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	// Headers set by the auth service may identify the tenant.
+	req, err := lb.authorize(cw, req)
+	if err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	tenant, err := lb.admitTenant(cw, req)
+	if err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		lb.logAccess(req, cw, start, accessEntry{})
+		return
+	}
+	if tenant != nil {
+		defer func() { tenant.release(cw.Status(), time.Since(start)) }()
+	}
+
+	deadline := lb.requestDeadline(req, lb.now())
+	req, cancel := lb.withDeadline(req, deadline)
+	defer cancel()
+	// Every stream is watched so that shutdown can end it; only its policy
+	// limits it before. Requests under a policy and upgrades are watched
+	// from the start, other event streams once their response arrives.
+	if streamPolicy := lb.streamPolicyFor(req); streamPolicy != nil || req.Header.Get("Upgrade") != "" {
+		if streamPolicy == nil {
+			streamPolicy = &StreamPolicy{}
+		}
+		ctx, cancelStream := context.WithCancel(req.Context())
+		defer cancelStream()
+		req = req.WithContext(ctx)
+		cw.stream = lb.watchStream(req, cw, streamPolicy, cancelStream)
+	} else {
+		cw.streams = lb
+	}
+	defer func() { cw.stream.stop() }()
+
+	fault := lb.injectFaults(req)
+	if fault.abort != 0 {
+		writeStatus(cw, fault.abort)
+		lb.logAccess(req, cw, start, accessEntry{faults: fault.events})
+		return
+	}
+	if fault.reset {
+		// The connection is aborted once the request is accounted for.
+		cw.ResponseWriter = &truncatingWriter{ResponseWriter: cw.ResponseWriter}
+		defer panic(http.ErrAbortHandler)
+	}
+	if err := lb.transformBody(cw, req); err != nil {
+		fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+		lb.logAccess(req, cw, start, accessEntry{faults: fault.events})
+		return
+	}
+
+	if route := lb.matchRoute(req); route != nil && route.Static != nil {
+		lb.serveStatic(cw, req, route.Static)
+		lb.logAccess(req, cw, start, accessEntry{faults: fault.events})
+		return
+	} else if route != nil && route.Journal != nil && !journalDelivery(req) {
+		if err := lb.serveJournaled(cw, req, route.Journal); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+		lb.logAccess(req, cw, start, accessEntry{faults: fault.events})
+		return
+	}
+
+	explanation := lb.startDebug(req)
+	if explanation != nil {
+		defer lb.logExplanation(req, explanation)
+	}
+	override, err := lb.backendOverride(req)
+	explanation.chosen("override", override, "")
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		writeError(cw, err)
+		lb.logAccess(req, cw, start, accessEntry{override: true, faults: fault.events})
+		return
+	}
+	var idempotent *idempotentExchange
+	idempotency := ""
+	if override == nil {
+		var served bool
+		if served, idempotency, idempotent = lb.serveIdempotent(cw, req); served {
+			lb.logAccess(req, cw, start, accessEntry{faults: fault.events, idempotency: idempotency})
+			return
+		}
+		defer lb.finishIdempotent(idempotent)
+	}
+	var mirror *mirrorWriter
+	var session *stickySession
+	var attempted *attemptedServers
+	if override == nil {
+		attempted = trackAttempted(req)
+		mirror = lb.startMirror(req)
+		session = lb.stickySession(req)
+	}
+
+	// Buffer the body up front when the request may need to be replayed.
+	// Overridden requests must reach the named server, so they are not
+	// retried elsewhere.
+	policy := lb.retryPolicyFor(req)
+	if override != nil {
+		policy = nil
+	}
+	var body *replayableBody
+	if !replayable && (policy != nil && policy.Attempts > 1 || lb.redirectPolicyFor(req).follows()) {
+		var rest io.ReadCloser
+		body, rest, err = bufferBody(req.Body, lb.bodyBufferFor(req))
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			writeError(cw, err)
+			lb.logAccess(req, cw, start, accessEntry{faults: fault.events})
+			return
+		}
+		if body != nil {
+			defer body.Close()
+			replayable = true
+		} else {
+			fmt.Printf("request body of %s %s exceeds the buffer, not retrying\n", req.Method, req.URL.Path)
+			req.Body = rest
+		}
+	}
+
+	entry := accessEntry{server: override, override: override != nil, faults: fault.events, sticky: session, idempotency: idempotency}
+	var exchange *cacheExchange
+	if override == nil {
+		var served string
+		if served, exchange, req = lb.serveCached(cw, req); served != "" {
+			entry.cache = served
+			lb.logAccess(req, cw, start, entry)
+			return
+		}
+		if exchange != nil {
+			defer func() { exchange.settle(lb.now()) }()
+		}
+	}
+	if override == nil {
+		entry.server = lb.claimPinned(session)
+		if entry.server != nil {
+			explanation.chosen("sticky", entry.server, opaqueServerID(entry.server))
+		}
+		if entry.server == nil && session != nil && session.pinned != nil {
+			err = session.unavailable()
+		}
+		if entry.server == nil && err == nil {
+			entry.server, entry.queueWait, err = lb.admit(req)
+		}
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			explanation.annotate(cw)
+			if exchange != nil && exchange.canServeStale() {
+				entry.cache = exchange.serveStale()
+				lb.logAccess(req, cw, start, entry)
+				return
+			}
+			writeError(cw, err)
+			lb.logAccess(req, cw, start, entry)
+			return
+		}
+	}
+
+	var out http.ResponseWriter = cw
+	if exchange != nil {
+		out = exchange
+	}
+	if idempotent != nil {
+		idempotent.ResponseWriter = out
+		out = idempotent
+	}
+	if mirror != nil {
+		mirror.ResponseWriter = out
+		out = mirror
+	}
+	validation := lb.validationFor(req)
+	pin := lb.pinHook(req)
+	hops, visited := 0, map[string]bool{}
+	for entry.attempts = 1; ; entry.attempts++ {
+		fmt.Printf("forwarding request to address %q\n", entry.server.Address())
+		attempted.add(entry.server)
+		visited[redirectKey(entry.server, req.Method, req.URL)] = true
+		if body != nil {
+			req.Body = body.reader()
+			req.GetBody = func() (io.ReadCloser, error) { return body.reader(), nil }
+		}
+		if err := lb.setDeadlineHeader(req, deadline); err != nil {
+			fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+			lb.finishRequest(entry.server, statusForError(err), "", 0, cw.read.Load(), cw.written.Load())
+			writeError(cw, err)
+			lb.logAccess(req, cw, start, entry)
+			return
+		}
+
+		var retryable func(ErrorClass) bool
+		if policy != nil && replayable && entry.attempts < policy.Attempts && session.retries(entry.server) {
+			retryable = policy.retries
+		}
+		info.backend = entry.server
+		lb.setServedBy(cw, entry.server)
+		cw.page.attempt(entry.server)
+		explanation.attempt(cw, entry.server)
+		aw := newAttemptWriter(out, retryable)
+		aw.redirect = lb.redirectHook(req, entry.server, replayable)
+		aw.onCommit = joinCommitHooks(session.commitHook(entry.server), pin)
+		aw.validation = validation
+		aw.feedback = lb.feedbackHook(entry.server)
+		aw.plainBody = validation.readsBody()
+		aw.caching = exchange != nil
+		aw.explanation = explanation
+		ctx := lb.withRouteSigner(context.WithValue(req.Context(), attemptKey{}, aw), req)
+		ctx, endAttempt := aw.withFirstByteTimeout(ctx, lb.firstByteTimeoutFor(req, entry.server))
+		cw.attach(entry.server)
+		aborted := serveAttempt(entry.server, aw, req.WithContext(ctx))
+		endAttempt()
+
+		status := cw.Status()
+		if aw.discarded || exchange != nil && exchange.heldBack() {
+			status = aw.status
+		}
+		entry.class = aw.class
+		attempt := aw.record(entry.server)
+		if aw.err != nil {
+			lb.recordUpstreamError(req, entry.attempts, attempt, aw.err)
+		}
+		info.attempts = append(info.attempts, attempt)
+		lb.finishRequest(entry.server, status, aw.class, attempt.duration, cw.read.Load(), cw.written.Load())
+		lb.observeValidation(entry.server, validation, aw.class)
+		if r := aw.follow; r != nil {
+			hops++
+			switch {
+			case hops > lb.redirectPolicyFor(req).maxHops():
+				err = ErrTooManyRedirects
+			case visited[redirectKey(r.server, r.method, r.url)]:
+				err = ErrRedirectLoop
+			}
+			if err != nil {
+				fmt.Printf("error: %s %s: %v\n", req.Method, req.URL.Path, err)
+				writeError(cw, err)
+				lb.logAccess(req, cw, start, entry)
+				return
+			}
+			fmt.Printf("following redirect to %s on %q\n", r.url.RequestURI(), serverName(r.server))
+			if r.method != req.Method {
+				body = nil
+			}
+			req = redirectedRequest(req, r)
+			entry.server = r.server
+			lb.claimRedirect(r.server)
+			continue
+		}
+		if !aw.discarded {
+			if exchange != nil {
+				entry.cache = exchange.finish()
+			}
+			if idempotent != nil {
+				idempotent.complete = !aborted
+			}
+			if mirror != nil {
+				lb.finishMirror(mirror)
+			}
+			lb.logAccess(req, cw, start, entry)
+			if aborted {
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+
+		fmt.Printf("error: attempt %d to %q failed (%s), retrying\n", entry.attempts, serverName(entry.server), aw.class)
+		session.failed(entry.server)
+		explanation.failed(entry.server, aw.class)
+		next, wait, err := lb.admit(req)
+		entry.queueWait += wait
+		if err != nil {
+			if exchange != nil && staleReplaces(aw.status) && exchange.canServeStale() {
+				entry.cache = exchange.serveStale()
+				lb.logAccess(req, cw, start, entry)
+				return
+			}
+			// Nothing was sent yet, so report the failure that was held back.
+			writeStatus(cw, aw.status)
+			lb.logAccess(req, cw, start, entry)
+			return
+		}
+		entry.server = next
+	}
+}
+
+// serveAttempt has server serve req, reporting whether it aborted the
+// response with http.ErrAbortHandler, as the proxy does when copying a
+// response body fails, e.g. once a stream is cut off. The caller accounts
+// for the request before passing the abort on.
+func serveAttempt(server Server, rw http.ResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			aborted = true
+		}
+	}()
+	server.Serve(rw, req)
+
+	return false
+}
+
+// admit selects the server for req, parking it in the admission queue while
+// every eligible server is saturated. Requests arriving while others are
+// queued join the back of the queue so admission stays FIFO.
+func (lb *LoadBalancer) admit(req *http.Request) (Server, time.Duration, error) {
+	if lb.queue == nil {
+		server, err := lb.selectServer(req)
+		return server, 0, err
+	}
+
+	if lb.queue.Len() == 0 {
+		server, err := lb.selectServer(req)
+		if !errors.Is(err, ErrServersSaturated) {
+			return server, 0, err
+		}
+	}
+	server, wait, err := lb.waitForServer(req)
+	lb.queue.wait.Observe(wait)
+
+	return server, wait, err
+}
+
+// accessEntry is what the access log records about the handling of a
+// request beyond the request and response themselves.
+type accessEntry struct {
+	server    Server
+	queueWait time.Duration
+	attempts  int
+	class     ErrorClass
+	override  bool
+	faults    []string
+	cache     string
+	sticky    *stickySession
+
+	// idempotency is the idempotency key result: miss, shared or replay.
+	idempotency string
+}
+
+// upstreamAttempt is the access log representation of an attemptRecord.
+type upstreamAttempt struct {
+	Backend    string     `json:"backend"`
+	Status     int        `json:"status"`
+	ErrorClass ErrorClass `json:"error_class,omitempty"`
+	DurationMS float64    `json:"duration_ms"`
+	TTFBMS     float64    `json:"ttfb_ms"`
+}
+
+// logAccess records the timings of a completed request in the request
+// metrics, queues it for the traffic recording if it was sampled and writes
+// its access log entry. The byte counts are those
+// actually transferred, not the announced Content-Length. ttfb_ms is the
+// time to first byte of the attempt that answered the client.
+func (lb *LoadBalancer) logAccess(req *http.Request, cw *countingResponseWriter, start time.Time, e accessEntry) {
+	duration := time.Since(start)
+	info := requestInfo(req)
+	var attempts []attemptRecord
+	if info != nil {
+		attempts = info.attempts
+	}
+	lb.requests.observe(req.Proto, duration, attempts)
+	lb.finishRecording(req, cw, duration, e.server)
+	if lb.accessLog == nil || lb.accessLogOff.Load() {
+		return
+	}
+
+	upstream := make([]upstreamAttempt, len(attempts))
+	var ttfb time.Duration
+	for i, a := range attempts {
+		upstream[i] = upstreamAttempt{
+			Backend:    serverName(a.server),
+			Status:     a.status,
+			ErrorClass: a.class,
+			DurationMS: float64(a.duration.Microseconds()) / 1000,
+			TTFBMS:     float64(a.ttfb.Microseconds()) / 1000,
+		}
+		ttfb = a.ttfb
+	}
+
+	backend, route := "", ""
+	if e.server != nil {
+		backend = serverName(e.server)
+	}
+	if r := lb.matchRoute(req); r != nil {
+		route = r.Name
+	}
+	clientIP := ""
+	if addr, ok := clientAddr(req); ok {
+		clientIP = addr.String()
+	}
+	values := map[string]slog.Value{
+		"method":           slog.StringValue(req.Method),
+		"host":             slog.StringValue(req.Host),
+		"path":             slog.StringValue(req.URL.Path),
+		"query":            slog.StringValue(req.URL.RawQuery),
+		"protocol":         slog.StringValue(req.Proto),
+		"status":           slog.IntValue(cw.Status()),
+		"backend":          slog.StringValue(backend),
+		"backend_id":       slog.StringValue(lb.backendID(e.server)),
+		"duration_ms":      slog.Float64Value(float64(duration.Microseconds()) / 1000),
+		"queue_wait_ms":    slog.Float64Value(float64(e.queueWait.Microseconds()) / 1000),
+		"ttfb_ms":          slog.Float64Value(float64(ttfb.Microseconds()) / 1000),
+		"bytes_in":         slog.Int64Value(cw.read.Load()),
+		"bytes_out":        slog.Int64Value(cw.written.Load()),
+		"hijacked":         slog.BoolValue(cw.hijacked),
+		"attempts":         slog.IntValue(e.attempts),
+		"retries":          slog.IntValue(max(e.attempts-1, 0)),
+		"upstream":         slog.AnyValue(upstream),
+		"error_class":      slog.StringValue(string(e.class)),
+		"backend_override": slog.BoolValue(e.override),
+		"faults":           slog.StringValue(strings.Join(e.faults, ",")),
+		"cache":            slog.StringValue(e.cache),
+		"idempotency":      slog.StringValue(e.idempotency),
+		"api_key":          slog.StringValue(apiKeyID(req)),
+		"tenant":           slog.StringValue(tenantName(req)),
+		"country":          slog.StringValue(clientCountry(req)),
+		"sticky":           slog.StringValue(e.sticky.result()),
+		"time":             slog.StringValue(start.Format(time.RFC3339Nano)),
+		"client_ip":        slog.StringValue(clientIP),
+		"user_agent":       slog.StringValue(req.UserAgent()),
+		"request_id":       slog.StringValue(requestID(req)),
+		"route":            slog.StringValue(route),
+		"instance":         slog.StringValue(lb.instanceID),
+	}
+
+	if f := lb.accessFormat; f != nil {
+		if !f.sample(cw.Status(), duration) {
+			return
+		}
+		if f.custom() {
+			if err := f.write(values); err != nil {
+				fmt.Printf("error: access log: %v\n", err)
+			}
+			return
+		}
+	}
+	attrs := make([]slog.Attr, len(defaultAccessLogFields))
+	for i, field := range defaultAccessLogFields {
+		attrs[i] = slog.Attr{Key: field, Value: values[field]}
+	}
+	lb.accessLog.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+}
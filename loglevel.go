@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// leveledHandler gates a handler on a level that can change at runtime.
+type leveledHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// logControl holds the runtime logging settings of a load balancer.
+type logControl struct {
+	level *slog.LevelVar
+
+	// afterFunc schedules reverting a temporary level; tests replace it.
+	afterFunc func(time.Duration, func()) (stop func() bool)
+
+	mu       sync.Mutex
+	base     slog.Level
+	revertAt time.Time
+	stop     func() bool
+
+	// generation identifies the latest change, so that a revert firing
+	// after being replaced does nothing.
+	generation int
+}
+
+func newLogControl() *logControl {
+	return &logControl{
+		level: new(slog.LevelVar),
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+	}
+}
+
+// WithLogLevel sets the initial level of operational logging. It defaults to
+// info.
+func WithLogLevel(level slog.Level) Option {
+	return func(lb *LoadBalancer) {
+		lb.logs.level.Set(level)
+		lb.logs.base = level
+	}
+}
+
+// SetLogLevel changes the level of operational logging. With a positive
+// duration the change is temporary and the previous level is restored when
+// it expires, so debug logging cannot be left on by accident; otherwise the
+// change is permanent and cancels any pending revert.
+func (lb *LoadBalancer) SetLogLevel(level slog.Level, d time.Duration) {
+	c := lb.logs
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+		c.revertAt = time.Time{}
+	}
+	c.level.Set(level)
+	if d <= 0 {
+		c.base = level
+		return
+	}
+
+	generation := c.generation
+	c.stop = c.afterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.generation != generation {
+			return
+		}
+		c.level.Set(c.base)
+		c.stop = nil
+		c.revertAt = time.Time{}
+	})
+	c.revertAt = time.Now().Add(d)
+}
+
+// SetAccessLog turns the access log on or off at runtime. It has no effect
+// without WithAccessLog.
+func (lb *LoadBalancer) SetAccessLog(enabled bool) {
+	lb.accessLogOff.Store(!enabled)
+}
+
+// logStatus describes the runtime logging settings.
+type logStatus struct {
+	Level     string     `json:"level"`
+	RevertAt  *time.Time `json:"revert_at,omitempty"`
+	RevertTo  string     `json:"revert_to,omitempty"`
+	AccessLog bool       `json:"access_log"`
+}
+
+// logStatus returns the current runtime logging settings.
+func (lb *LoadBalancer) logStatus() logStatus {
+	c := lb.logs
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := logStatus{
+		Level:     c.level.Level().String(),
+		AccessLog: lb.accessLog != nil && !lb.accessLogOff.Load(),
+	}
+	if !c.revertAt.IsZero() {
+		revertAt := c.revertAt
+		s.RevertAt = &revertAt
+		s.RevertTo = c.base.String()
+	}
+
+	return s
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTimer captures the revert scheduled by a temporary log level.
+type fakeTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func (ft *fakeTimer) afterFunc(d time.Duration, f func()) func() bool {
+	ft.d, ft.f, ft.stopped = d, f, false
+	return func() bool {
+		ft.stopped = true
+		return true
+	}
+}
+
+func setLogLevel(t *testing.T, lb *LoadBalancer, body string) logStatus {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/loglevel", strings.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	var status logStatus
+	if err := json.NewDecoder(rw.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestLogLevel_Endpoint(t *testing.T) {
+	log := &syncBuffer{}
+	servers := []Server{&MockServer{addr: "http://server1.com", isAlive: true}}
+	lb := newTestLoadBalancer(t, servers, WithLogger(slog.New(slog.NewJSONHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	// Debug lines are dropped at the default level
+	lb.getNextAvailableServer()
+	if log.String() != "" {
+		t.Errorf("Expected no debug lines at info level, got %q", log.String())
+	}
+
+	if status := setLogLevel(t, lb, `{"level": "debug"}`); status.Level != "DEBUG" || status.RevertAt != nil {
+		t.Errorf("Expected a permanent debug level, got %+v", status)
+	}
+	lb.getNextAvailableServer()
+	if !strings.Contains(log.String(), "selected server") {
+		t.Errorf("Expected debug lines at debug level, got %q", log.String())
+	}
+
+	setLogLevel(t, lb, `{"level": "info"}`)
+	before := log.String()
+	lb.getNextAvailableServer()
+	if log.String() != before {
+		t.Errorf("Expected debug lines to stop, got %q", strings.TrimPrefix(log.String(), before))
+	}
+
+	// The level is visible in the status endpoint
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	if !strings.Contains(rw.Body.String(), `"logging":{"level":"INFO","access_log":false}`) {
+		t.Errorf("Expected the log level in the status, got %s", rw.Body.String())
+	}
+
+	for _, body := range []string{`{}`, `{"level": "loud"}`, `{"duration": "5m"}`, `{"level": "debug", "duration": "-5m"}`} {
+		rw := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/loglevel", strings.NewReader(body)))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: Expected status 400, got %d", body, rw.Code)
+		}
+	}
+}
+
+func TestLogLevel_TemporaryReverts(t *testing.T) {
+	log := &syncBuffer{}
+	servers := []Server{&MockServer{addr: "http://server1.com", isAlive: true}}
+	lb := newTestLoadBalancer(t, servers, WithLogLevel(slog.LevelWarn),
+		WithLogger(slog.New(slog.NewJSONHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	timer := &fakeTimer{}
+	lb.logs.afterFunc = timer.afterFunc
+
+	status := setLogLevel(t, lb, `{"level": "debug", "duration": "5m"}`)
+	if status.Level != "DEBUG" || status.RevertAt == nil || status.RevertTo != "WARN" || timer.d != 5*time.Minute {
+		t.Errorf("Expected debug reverting to warn in 5m, got %+v after %s", status, timer.d)
+	}
+	lb.getNextAvailableServer()
+	if !strings.Contains(log.String(), "selected server") {
+		t.Errorf("Expected debug lines while the temporary level holds")
+	}
+
+	timer.f()
+	if status := lb.logStatus(); status.Level != "WARN" || status.RevertAt != nil {
+		t.Errorf("Expected the level to revert to warn, got %+v", status)
+	}
+	before := log.String()
+	lb.getNextAvailableServer()
+	if log.String() != before {
+		t.Errorf("Expected no debug lines after the revert")
+	}
+
+	// A permanent change cancels a pending revert
+	setLogLevel(t, lb, `{"level": "debug", "duration": "5m"}`)
+	revert := timer.f
+	setLogLevel(t, lb, `{"level": "error"}`)
+	revert()
+	if !timer.stopped || lb.logStatus().Level != "ERROR" {
+		t.Errorf("Expected the permanent level to stick, got %+v", lb.logStatus())
+	}
+}
+
+func TestLogLevel_AccessLogToggle(t *testing.T) {
+	log := &syncBuffer{}
+	servers := []Server{&MockServer{addr: "http://server1.com", isAlive: true}}
+	lb := newTestLoadBalancer(t, servers, WithAccessLog(log))
+
+	if status := setLogLevel(t, lb, `{"access_log": false}`); status.AccessLog {
+		t.Errorf("Expected the access log to be off, got %+v", status)
+	}
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/off", nil))
+	setLogLevel(t, lb, `{"access_log": true}`)
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/on", nil))
+
+	entries := accessLogEntries(t, log)
+	if len(entries) != 1 || entries[0]["path"] != "/on" {
+		t.Errorf("Expected only the request made while enabled to be logged, got %v", entries)
+	}
+}
@@ -1,110 +1,409 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"load-balancer/discovery/docker"
 )
 
-type Server interface {
-	Address() string
-	IsAlive() bool
-	Serve(rw http.ResponseWriter, req *http.Request)
-}
+// defaultShutdownTimeout is used when the configuration does not set one.
+const defaultShutdownTimeout = 30 * time.Second
 
-type simpleServer struct {
-	addr  string
-	proxy *httputil.ReverseProxy
+// defaultConfig is used when no configuration file is given.
+func defaultConfig() *Config {
+	return &Config{
+		Port:      "8000",
+		AdminPort: "8001",
+		AccessLog: "-",
+		Servers: []ServerConfig{
+			{Address: "https://www.facebook.com"},
+			{Address: "https://www.bing.com"},
+			{Address: "https://www.duckduckgo.com"},
+		},
+	}
 }
 
-func (s *simpleServer) Address() string { 
-	return s.addr 
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout))
+	}
 
-func (s *simpleServer) IsAlive() bool {
-	 return true 
-}
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	dumpConfig := flag.Bool("dump-config", false, "print the effective configuration, secrets redacted, at startup")
+	flag.Parse()
 
-func (s *simpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
-	s.proxy.ServeHTTP(rw, req)
-}
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		handleErr(err)
+	}
 
-// newSimpleServer returns a simple server that proxies incoming requests to the
-// specified target address.
-func newSimpleServer(addr string) *simpleServer {
-	serverUrl, err := url.Parse(addr)
+	lb, err := cfg.Build()
 	handleErr(err)
+	healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+	defer stopHealthChecks()
 
-	return &simpleServer{
-		addr:  addr,
-		proxy: httputil.NewSingleHostReverseProxy(serverUrl),
+	upgrader, err := NewUpgrader()
+	handleErr(err)
+
+	servers := []*http.Server{}
+	serveOn := func(srv *http.Server, ln net.Listener) {
+		servers = append(servers, srv)
+		fmt.Printf("serving requests at '%s'\n", ln.Addr())
+		go func() {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				handleErr(err)
+			}
+		}()
 	}
-}
+	serveProxy := func(ln net.Listener) {
+		serveOn(lb.NewServer(lb.Handler()), lb.LimitListener(ln))
+	}
+	var passthrough net.Listener
+	var quic HTTP3Server
+	var snapshots io.Closer
 
-type LoadBalancer struct {
-	port            string
-	roundRobinCount int
-	servers         []Server
-}
+	// Traffic listeners are bound last, once the pool is discovered and
+	// probed, so that no request is turned away while starting.
+	err = lb.Start(context.Background(), StartupPhase{
+		Name: "pools",
+		Run: func(ctx context.Context) error {
+			if err := lb.LoadGeoIP(); err != nil {
+				return err
+			}
+			if err := lb.ResolveServers(healthCtx); err != nil {
+				return err
+			}
+			if s := cfg.State; s != nil {
+				if err := lb.LoadState(s.Path, time.Duration(s.MaxAge)); err != nil {
+					fmt.Printf("error: %v, starting without saved state\n", err)
+				}
+			}
+			if err := lb.LoadRamp(); err != nil {
+				fmt.Printf("error: %v, starting the ramp over\n", err)
+			}
+			if *dumpConfig {
+				data, err := json.MarshalIndent(lb.ConfigDump(), "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s\n", data)
+			}
+			return nil
+		},
+	}, StartupPhase{
+		Name:    "discovery",
+		Timeout: lb.startup.DiscoveryTimeout,
+		Run: func(ctx context.Context) error {
+			var synced []<-chan struct{}
+			if d := cfg.DockerDiscovery; d != nil {
+				discoverer := docker.New(docker.Config{Socket: d.Socket, LabelPrefix: d.LabelPrefix, Host: d.Host})
+				lb.Go(healthCtx, "docker discovery", func(ctx context.Context) {
+					discoverer.Run(ctx, lb.applyDockerEvent)
+				})
+				synced = append(synced, discoverer.Synced())
+			}
+			lb.Go(healthCtx, "srv discovery", lb.RunSRVDiscovery)
+			lb.Go(healthCtx, "control plane", lb.RunControlPlane)
+			return lb.WaitForDiscovery(ctx, synced...)
+		},
+	}, StartupPhase{
+		Name:    "health checks",
+		Timeout: lb.startup.HealthTimeout,
+		Run: func(ctx context.Context) error {
+			lb.Go(healthCtx, "health checks", lb.RunHealthChecks)
+			return lb.WaitForProbes(ctx)
+		},
+	}, StartupPhase{
+		Name: "background tasks",
+		Run: func(ctx context.Context) error {
+			lb.Go(healthCtx, "weight adjustment", lb.RunWeightAdjustment)
+			lb.Go(healthCtx, "geoip reload", lb.RunGeoIPReload)
+			lb.Go(healthCtx, "cache memory watch", lb.RunCacheMemoryWatch)
+			lb.Go(healthCtx, "gossip", lb.RunGossip)
+			lb.Go(healthCtx, "fd guard", lb.RunFDGuard)
+			lb.Go(healthCtx, "prewarm", lb.RunPrewarm)
+			lb.Go(healthCtx, "alerts", lb.RunAlerts)
+			lb.Go(healthCtx, "certificates", lb.RunCertificateMonitor)
+			lb.Go(healthCtx, "ramp", lb.RunRamps)
+			lb.Go(healthCtx, "journals", lb.RunJournals)
+			if s := cfg.Snapshot; s != nil {
+				f, err := openRotatingFile(s.Path, s.Rotate.build())
+				if err != nil {
+					return err
+				}
+				snapshots = f
+				lb.Go(healthCtx, "snapshots", func(ctx context.Context) {
+					lb.RunSnapshots(ctx, f, time.Duration(s.Interval))
+				})
+			}
+			if s := cfg.State; s != nil {
+				lb.Go(healthCtx, "state saver", func(ctx context.Context) {
+					lb.RunStateSaver(ctx, s.Path, time.Duration(s.Interval))
+				})
+			}
+			return nil
+		},
+	}, StartupPhase{
+		Name: "admin listener",
+		Run: func(ctx context.Context) error {
+			if cfg.AdminPort == "" {
+				return nil
+			}
+			admin := &http.Server{Handler: lb.AdminHandler(), MaxHeaderBytes: lb.MaxHeaderBytes()}
+			ln, err := upgrader.Listen("tcp", ":"+cfg.AdminPort)
+			if err != nil {
+				return err
+			}
+			serveOn(admin, ln)
+			return nil
+		},
+	}, StartupPhase{
+		Name: "traffic listeners",
+		Run: func(ctx context.Context) error {
+			var listeners []net.Listener
+			if cfg.ReusePort {
+				n := cfg.Listeners
+				if n == 0 {
+					n = runtime.GOMAXPROCS(0)
+				}
+				shards, err := upgrader.ListenShards("tcp", ":"+lb.port, n)
+				if err != nil {
+					return err
+				}
+				listeners = append(listeners, shards...)
+			} else {
+				ln, err := upgrader.Listen("tcp", ":"+lb.port)
+				if err != nil {
+					return err
+				}
+				listeners = append(listeners, ln)
+			}
+			if cfg.UnixSocket != "" {
+				ln, err := upgrader.Listen("unix", cfg.UnixSocket)
+				if err != nil {
+					return err
+				}
+				listeners = append(listeners, ln)
+			}
+			if p := cfg.Passthrough; p != nil {
+				var err error
+				if passthrough, err = upgrader.Listen("tcp", ":"+p.Port); err != nil {
+					return err
+				}
+			}
+			var secure net.Listener
+			var quicConn net.PacketConn
+			if t := cfg.TLS; t != nil {
+				var err error
+				if secure, err = upgrader.Listen("tcp", ":"+t.Port); err != nil {
+					return err
+				}
+				if t.HTTP3 {
+					if quic, err = lb.NewHTTP3Server(lb.Handler()); err != nil {
+						return err
+					}
+					if quicConn, err = upgrader.ListenPacket("udp", ":"+t.Port); err != nil {
+						return err
+					}
+				}
+			}
+			for _, ln := range listeners {
+				serveProxy(ln)
+			}
+			if secure != nil {
+				// TLS is terminated on the connections the limit admitted.
+				serveOn(lb.NewServer(lb.Handler()), tls.NewListener(lb.LimitListener(secure), lb.TLSConfig()))
+			}
+			if quic != nil {
+				fmt.Printf("serving HTTP/3 at '%s'\n", quicConn.LocalAddr())
+				go func() {
+					if err := quic.Serve(quicConn); !errors.Is(err, http.ErrServerClosed) {
+						handleErr(err)
+					}
+				}()
+			}
+			if passthrough != nil {
+				fmt.Printf("passing TLS through at '%s'\n", passthrough.Addr())
+				go func() {
+					if err := lb.ServePassthrough(passthrough); !errors.Is(err, net.ErrClosed) {
+						handleErr(err)
+					}
+				}()
+			}
+			return upgrader.Ready()
+		},
+	})
+	handleErr(err)
 
-func NewLoadBalancer(port string, servers []Server) *LoadBalancer {
-	return &LoadBalancer{
-		port:            port,
-		roundRobinCount: 0,
-		servers:         servers,
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout)
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
 	}
-}
 
-// getNextAvailableServer selects the next available server using round-robin
-// strategy. It checks the servers' availability and skips any that are not
-// alive, ensuring the load balancer forwards requests to active servers only.
-func (lb *LoadBalancer) getNextAvailableServer() Server {
-	server := lb.servers[lb.roundRobinCount%len(lb.servers)]
-	for !server.IsAlive() {
-		lb.roundRobinCount++
-		server = lb.servers[lb.roundRobinCount%len(lb.servers)]
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGUSR1 {
+			lb.Dump(os.Stderr)
+			continue
+		}
+		if sig == syscall.SIGHUP {
+			if err := lb.ReloadSecrets(); err != nil {
+				fmt.Printf("error: reload secrets: %v\n", err)
+			} else {
+				fmt.Println("reloaded secrets")
+			}
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := upgrader.Upgrade(ctx)
+			cancel()
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			break
+		}
+		lb.BeginShutdown()
+		if delay := time.Duration(cfg.PreStopDelay); delay > 0 {
+			fmt.Printf("failing readiness for %s before shutting down\n", delay)
+			time.Sleep(delay)
+		}
+		break
 	}
-	lb.roundRobinCount++
 
-	return server
+	if passthrough != nil {
+		passthrough.Close()
+	}
+	// Streams would hold the drain up to its timeout, so they end within
+	// their own grace meanwhile.
+	streams := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		streams <- lb.ShutdownStreams(ctx)
+	}()
+	// HTTP/3 clients are sent a GOAWAY and drain alongside the others.
+	quicDone := make(chan error, 1)
+	go func() {
+		if quic == nil {
+			quicDone <- nil
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		quicDone <- quic.Shutdown(ctx)
+	}()
+	shutdown(servers, shutdownTimeout)
+	if err := <-streams; err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+	if err := <-quicDone; err != nil {
+		fmt.Printf("error: shutdown: %v\n", err)
+	}
+	// Workers, journal deliveries among them, stop before the journals are
+	// closed.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := lb.Shutdown(ctx); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+	cancel()
+	if snapshots != nil {
+		snapshots.Close()
+	}
+	lb.Close()
+	if s := cfg.State; s != nil {
+		if err := lb.SaveState(s.Path); err != nil {
+			fmt.Printf("error: save state: %v\n", err)
+		}
+	}
 }
 
-// serveProxy forwards incoming HTTP requests to the next available server
-// in the load balancer's server pool. It uses the round-robin strategy to
-// select the target server and logs the forwarding action. This function
-// ensures that requests are served by active servers.
-func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
-	targetServer := lb.getNextAvailableServer()
-
-	fmt.Printf("forwarding request to address %q\n", targetServer.Address())
+// shutdown stops every server from accepting new connections at once and
+// waits up to timeout for in-flight requests to complete.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	targetServer.Serve(rw, req)
+	fmt.Printf("shutting down, draining for up to %s\n", timeout)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				fmt.Printf("error: shutdown: %v\n", err)
+			}
+		}()
+	}
+	wg.Wait()
 }
 
-func main() {
-	servers := []Server{
-		newSimpleServer("https://www.facebook.com"),
-		newSimpleServer("https://www.bing.com"),
-		newSimpleServer("https://www.duckduckgo.com"),
+// runCheck validates a configuration file without starting the load
+// balancer, printing every problem found and warning about conflicting
+// routes.
+func runCheck(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: load-balancer check CONFIG")
 	}
-
-	lb := NewLoadBalancer("8000", servers)
-	handleRedirect := func(rw http.ResponseWriter, req *http.Request) {
-		lb.serveProxy(rw, req)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
 	}
 
-	http.HandleFunc("/", handleRedirect)
+	cfg, err := loadConfig(fs.Arg(0))
+	var lb *LoadBalancer
+	if err == nil {
+		lb, err = cfg.build(true)
+	}
+	if err != nil {
+		printErrors(w, err)
+		return 1
+	}
+	for _, c := range analyzeRoutes(lb.routeList()) {
+		fmt.Fprintf(w, "warning: %s: %v\n", c.Route, c)
+	}
+	fmt.Fprintf(w, "%s: ok\n", fs.Arg(0))
 
-	fmt.Printf("serving requests at 'localhost:%s'\n", lb.port)
+	return 0
+}
 
-	http.ListenAndServe(":"+lb.port, nil)
+// printErrors writes err to w, one line per joined error.
+func printErrors(w io.Writer, err error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
 }
 
 func handleErr(err error) {
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
+		printErrors(os.Stdout, err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"go.uber.org/goleak"
 )
 
+// TestMain fails the package if goroutines are left running after the
+// tests. Listeners the upgrade tests hand to a child turn blocking, so the
+// servers they start with http.Serve cannot be stopped.
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, goleak.IgnoreAnyFunction("net/http.Serve"))
+}
+
 // MockServer is a mock implementation of the Server interface.
 type MockServer struct {
 	addr      string
 	isAlive   bool
 	callCount int
+	labels    map[string]string
 }
 
 func (m *MockServer) Address() string {
@@ -21,12 +33,34 @@ func (m *MockServer) IsAlive() bool {
 	return m.isAlive
 }
 
+func (m *MockServer) Labels() map[string]string {
+	return m.labels
+}
+
 func (m *MockServer) Serve(rw http.ResponseWriter, req *http.Request) {
 	m.callCount++
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("Request served by " + m.addr))
 }
 
+// newTestLoadBalancer creates a load balancer, failing the test if the pool
+// is rejected. Its workers are stopped when the test ends.
+func newTestLoadBalancer(t *testing.T, servers []Server, opts ...Option) *LoadBalancer {
+	t.Helper()
+	lb, err := NewLoadBalancer("8000", servers, opts...)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer failed: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lb.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return lb
+}
+
 func TestLoadBalancer_RoundRobin(t *testing.T) {
 	// Create mock servers
 	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
@@ -34,7 +68,7 @@ func TestLoadBalancer_RoundRobin(t *testing.T) {
 	server3 := &MockServer{addr: "http://server3.com", isAlive: true}
 
 	// Initialize the load balancer
-	lb := NewLoadBalancer("8000", []Server{server1, server2, server3})
+	lb := newTestLoadBalancer(t, []Server{server1, server2, server3})
 
 	// Create a request and response recorder
 	req := httptest.NewRequest("GET", "/", nil)
@@ -70,7 +104,7 @@ func TestLoadBalancer_SkipInactiveServers(t *testing.T) {
 	server3 := &MockServer{addr: "http://server3.com", isAlive: true}
 
 	// Initialize the load balancer
-	lb := NewLoadBalancer("8000", []Server{server1, server2, server3})
+	lb := newTestLoadBalancer(t, []Server{server1, server2, server3})
 
 	// Create a request and response recorder
 	req := httptest.NewRequest("GET", "/", nil)
@@ -103,7 +137,7 @@ func TestLoadBalancer_ServeRequests(t *testing.T) {
 	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
 
 	// Initialize the load balancer
-	lb := NewLoadBalancer("8000", []Server{server1, server2})
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
 
 	// Create a request and response recorder
 	req := httptest.NewRequest("GET", "/", nil)
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// MaintenanceWindow is a recurring period in which a server is out of
+// selection, such as a nightly reboot. The window opens at Start, a time of
+// day in Location (UTC if nil), on each of Days or every day if Days is
+// empty, and lasts Duration. The server is drained Lead before the window
+// opens so requests in flight can complete, and returns to selection when
+// the window closes. With SlowStart, the share of selections it is offered
+// then ramps up from none to its full weight over SlowStart, the reverse of
+// DrainFade, sparing a cold server a full share at once. Duration, Lead
+// and SlowStart must not exceed a day.
+type MaintenanceWindow struct {
+	Start     time.Duration
+	Duration  time.Duration
+	Days      []time.Weekday
+	Location  *time.Location
+	Lead      time.Duration
+	SlowStart time.Duration
+}
+
+// until reports whether t falls into the window or its lead time and, if
+// so, when the window closes.
+func (w MaintenanceWindow) until(t time.Time) (time.Time, bool) {
+	// A window opening yesterday may still be open, one opening tomorrow
+	// may already be in its lead time.
+	for _, start := range w.starts(t, -1, 1) {
+		end := start.Add(w.Duration)
+		if !t.Before(start.Add(-w.Lead)) && t.Before(end) {
+			return end, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// ramp reports whether t falls into the slow start after the window and,
+// if so, the part of its weight the server is selected with and when the
+// slow start ends.
+func (w MaintenanceWindow) ramp(t time.Time) (float64, time.Time, bool) {
+	if w.SlowStart <= 0 {
+		return 0, time.Time{}, false
+	}
+	// A window opening two days ago may have closed yesterday and still be
+	// followed by its slow start.
+	for _, start := range w.starts(t, -2, 0) {
+		end := start.Add(w.Duration)
+		if !t.Before(end) && t.Before(end.Add(w.SlowStart)) {
+			return float64(t.Sub(end)) / float64(w.SlowStart), end.Add(w.SlowStart), true
+		}
+	}
+
+	return 0, time.Time{}, false
+}
+
+// starts returns the times the window opens on the days from first to last
+// relative to the day of t.
+func (w MaintenanceWindow) starts(t time.Time, first, last int) []time.Time {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+
+	var starts []time.Time
+	for offset := first; offset <= last; offset++ {
+		day := local.AddDate(0, 0, offset)
+		start := time.Date(day.Year(), day.Month(), day.Day(),
+			int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute), 0, 0, loc)
+		if len(w.Days) == 0 || slices.Contains(w.Days, start.Weekday()) {
+			starts = append(starts, start)
+		}
+	}
+
+	return starts
+}
+
+// WithMaintenance sets the recurring maintenance windows of the server.
+func WithMaintenance(windows ...MaintenanceWindow) ServerOption {
+	return func(s *simpleServer) {
+		s.maintenance = windows
+	}
+}
+
+// Maintained is implemented by servers with scheduled maintenance windows.
+type Maintained interface {
+	MaintenanceWindows() []MaintenanceWindow
+}
+
+// maintenanceUntil reports whether server is in maintenance at t and, if
+// so, when its maintenance ends. Windows that overlap or follow each other
+// without a gap are merged, looking at most a week ahead.
+func maintenanceUntil(server Server, t time.Time) (time.Time, bool) {
+	m, ok := server.(Maintained)
+	if !ok {
+		return time.Time{}, false
+	}
+	windows := m.MaintenanceWindows()
+
+	until := t
+	for until.Sub(t) < 7*24*time.Hour {
+		next := until
+		for _, w := range windows {
+			if end, ok := w.until(until); ok && end.After(next) {
+				next = end
+			}
+		}
+		if !next.After(until) {
+			break
+		}
+		until = next
+	}
+	if until.Equal(t) {
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// maintenanceRamp returns the slow start server, out of maintenance at t,
+// is in after a window, with the part of its weight it is selected with.
+// Of overlapping slow starts, the one least advanced counts.
+func maintenanceRamp(server Server, t time.Time) (*DrainFade, bool) {
+	m, ok := server.(Maintained)
+	if !ok {
+		return nil, false
+	}
+
+	var ramp *DrainFade
+	for _, w := range m.MaintenanceWindows() {
+		if weight, until, ok := w.ramp(t); ok && (ramp == nil || weight < ramp.Weight) {
+			ramp = &DrainFade{Until: until, Weight: weight}
+		}
+	}
+
+	return ramp, ramp != nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance_DrainAndRecover(t *testing.T) {
+	cfg := &Config{
+		Port: "8000",
+		Servers: []ServerConfig{
+			{Address: "http://server1.com"},
+			{Address: "http://server2.com", Maintenance: []MaintenanceWindowConfig{{
+				Start: "03:00", Duration: Duration(30 * time.Minute), Lead: Duration(5 * time.Minute),
+				Timezone: "Europe/Berlin",
+			}}},
+		},
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	var now time.Time
+	lb.now = func() time.Time { return now }
+
+	selected := func() map[string]bool {
+		seen := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			server, err := lb.getNextAvailableServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[server.Address()] = true
+		}
+		return seen
+	}
+
+	tests := []struct {
+		at          time.Time
+		maintenance bool
+	}{
+		{time.Date(2026, 3, 10, 2, 54, 0, 0, berlin), false},
+		{time.Date(2026, 3, 10, 2, 55, 0, 0, berlin), true}, // lead time
+		{time.Date(2026, 3, 10, 3, 29, 0, 0, berlin), true},
+		{time.Date(2026, 3, 10, 3, 30, 0, 0, berlin), false},
+		{time.Date(2026, 3, 11, 3, 10, 0, 0, berlin), true}, // the next night
+	}
+	for _, tt := range tests {
+		now = tt.at
+		seen := selected()
+		if seen["http://server2.com"] == tt.maintenance || !seen["http://server1.com"] {
+			t.Errorf("%s: Expected server2 selected %v, got %v", tt.at, !tt.maintenance, seen)
+		}
+
+		stats := lb.Stats()
+		if stats[1].MaintenanceUntil != nil != tt.maintenance || !stats[1].Alive {
+			t.Errorf("%s: Expected maintenance %v while alive, got %+v", tt.at, tt.maintenance, stats[1])
+		}
+		if tt.maintenance && !stats[1].MaintenanceUntil.Equal(time.Date(tt.at.Year(), tt.at.Month(), tt.at.Day(), 3, 30, 0, 0, berlin)) {
+			t.Errorf("%s: Expected maintenance until 03:30, got %s", tt.at, stats[1].MaintenanceUntil)
+		}
+	}
+
+	now = time.Date(2026, 3, 10, 3, 0, 0, 0, berlin)
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rw.Body.String(), `lb_server_maintenance{server="http://server2.com"} 1`) ||
+		!strings.Contains(rw.Body.String(), `lb_server_up{server="http://server2.com"} 1`) {
+		t.Errorf("Expected server2 in maintenance but up, got:\n%s", rw.Body.String())
+	}
+}
+
+func TestMaintenance_Windows(t *testing.T) {
+	// Sundays 23:00 to 01:00 UTC, crossing midnight
+	w := MaintenanceWindow{Start: 23 * time.Hour, Duration: 2 * time.Hour, Days: []time.Weekday{time.Sunday}}
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2026, 3, 8, 23, 30, 0, 0, time.UTC), true}, // Sunday
+		{time.Date(2026, 3, 9, 0, 30, 0, 0, time.UTC), true},  // Monday, window opened Sunday
+		{time.Date(2026, 3, 9, 23, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if _, ok := w.until(tt.at); ok != tt.want {
+			t.Errorf("%s: Expected %v, got %v", tt.at, tt.want, ok)
+		}
+	}
+
+	// Back-to-back windows merge
+	server := &simpleServer{maintenance: []MaintenanceWindow{
+		{Start: 2 * time.Hour, Duration: time.Hour},
+		{Start: 3 * time.Hour, Duration: time.Hour},
+	}}
+	until, ok := maintenanceUntil(server, time.Date(2026, 3, 9, 2, 30, 0, 0, time.UTC))
+	if !ok || !until.Equal(time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected maintenance until 04:00, got %s, %v", until, ok)
+	}
+
+	for _, c := range []MaintenanceWindowConfig{
+		{Start: "3am", Duration: Duration(time.Hour)},
+		{Start: "03:00"},
+		{Start: "03:00", Duration: Duration(time.Hour), Days: []string{"someday"}},
+		{Start: "03:00", Duration: Duration(time.Hour), Timezone: "Nowhere/Special"},
+		{Start: "03:00", Duration: Duration(time.Hour), SlowStart: Duration(25 * time.Hour)},
+	} {
+		if _, err := c.build(); err == nil {
+			t.Errorf("Expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestMaintenance_SlowStart(t *testing.T) {
+	server1 := &simpleServer{addr: "http://server1.com"}
+	server2 := &simpleServer{addr: "http://server2.com", maintenance: []MaintenanceWindow{
+		{Start: 3 * time.Hour, Duration: 30 * time.Minute, SlowStart: 10 * time.Minute},
+	}}
+	server1.alive.Store(true)
+	server2.alive.Store(true)
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	var now time.Time
+	lb.now = func() time.Time { return now }
+	shareOf := func(addr string) float64 {
+		picked := 0
+		for i := 0; i < 300; i++ {
+			server, err := lb.getNextAvailableServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server.Address() == addr {
+				picked++
+			}
+			lb.finishRequest(server, http.StatusOK, "", 0, 0, 0)
+		}
+		return float64(picked) / 300
+	}
+
+	tests := []struct {
+		at     time.Time
+		weight float64
+		share  float64
+	}{
+		{time.Date(2026, 3, 9, 3, 30, 0, 0, time.UTC), 0, 0},
+		{time.Date(2026, 3, 9, 3, 35, 0, 0, time.UTC), 0.5, 1.0 / 3},
+		{time.Date(2026, 3, 9, 3, 40, 0, 0, time.UTC), 1, 0.5},
+	}
+	for _, tt := range tests {
+		now = tt.at
+		if share := shareOf("http://server2.com"); share < tt.share-0.02 || share > tt.share+0.02 {
+			t.Errorf("%s: Expected server2 to get %.2f of the selections, got %.2f", tt.at, tt.share, share)
+		}
+		stats := lb.Stats()[1]
+		if tt.weight == 1 {
+			if stats.SlowStart != nil {
+				t.Errorf("%s: Expected the slow start to be over, got %+v", tt.at, stats.SlowStart)
+			}
+			continue
+		}
+		if stats.SlowStart == nil || stats.SlowStart.Weight != tt.weight ||
+			!stats.SlowStart.Until.Equal(time.Date(2026, 3, 9, 3, 40, 0, 0, time.UTC)) {
+			t.Errorf("%s: Expected a slow start at weight %.1f until 03:40, got %+v", tt.at, tt.weight, stats.SlowStart)
+		}
+		if want := float64(stats.Weight) * tt.weight; stats.EffectiveWeight == nil || *stats.EffectiveWeight != want {
+			t.Errorf("%s: Expected effective weight %.1f, got %v", tt.at, want, stats.EffectiveWeight)
+		}
+	}
+}
+
+func TestMaintenance_ManualDrainOutlastsWindow(t *testing.T) {
+	server1 := &simpleServer{addr: "http://server1.com"}
+	server2 := &simpleServer{addr: "http://server2.com", maintenance: []MaintenanceWindow{
+		{Start: 3 * time.Hour, Duration: 30 * time.Minute, SlowStart: 10 * time.Minute},
+	}}
+	server1.alive.Store(true)
+	server2.alive.Store(true)
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	now := time.Date(2026, 3, 9, 3, 10, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+	if _, err := lb.Drain("http://server2.com"); err != nil {
+		t.Fatal(err)
+	}
+	selected := func() bool {
+		for i := 0; i < 10; i++ {
+			server, err := lb.getNextAvailableServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb.finishRequest(server, http.StatusOK, "", 0, 0, 0)
+			if server == server2 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, at := range []time.Time{
+		time.Date(2026, 3, 9, 3, 35, 0, 0, time.UTC), // slow start
+		time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC),
+	} {
+		now = at
+		if selected() {
+			t.Errorf("%s: Expected the drained server to stay out of selection after the window", at)
+		}
+		if stats := lb.Stats()[1]; !stats.Draining {
+			t.Errorf("%s: Expected the server to stay drained, got %+v", at, stats)
+		}
+	}
+
+	if err := lb.Undrain("http://server2.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !selected() {
+		t.Error("Expected the undrained server to be selected")
+	}
+}
+
+func TestMaintenance_Readiness(t *testing.T) {
+	server := &simpleServer{addr: "http://server1.com", maintenance: []MaintenanceWindow{{Start: 3 * time.Hour, Duration: time.Hour}}}
+	server.alive.Store(true)
+	lb := newTestLoadBalancer(t, []Server{server})
+	lb.MarkListening()
+	lb.now = func() time.Time { return time.Date(2026, 3, 9, 3, 30, 0, 0, time.UTC) }
+
+	rw := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/readyz", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready with the only server in maintenance, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// MethodPolicy restricts the methods of a route's requests. Requests with
+// any other method are answered with 405 Method Not Allowed and an Allow
+// header listing the methods, without contacting a server. Allowing GET
+// allows HEAD as well.
+//
+// With SynthesizeOptions, OPTIONS requests, CORS preflights included, are
+// answered by the load balancer from Allow instead of being proxied.
+//
+// CONNECT is rejected on every route unless its policy allows it.
+type MethodPolicy struct {
+	Allow             []string
+	SynthesizeOptions bool
+}
+
+// validMethod reports whether m is an HTTP token, as methods are.
+func validMethod(m string) bool {
+	return m != "" && !strings.ContainsFunc(m, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	})
+}
+
+// allows reports whether the policy accepts method. Without a policy every
+// method but CONNECT is accepted.
+func (p *MethodPolicy) allows(method string) bool {
+	if p == nil {
+		return method != http.MethodConnect
+	}
+	if p.SynthesizeOptions && method == http.MethodOptions {
+		return true
+	}
+	if method == http.MethodHead && slices.Contains(p.Allow, http.MethodGet) {
+		return true
+	}
+
+	return slices.Contains(p.Allow, method)
+}
+
+// allowHeader returns the Allow header of the policy's responses, or "" if
+// there is no policy to list the methods of.
+func (p *MethodPolicy) allowHeader() string {
+	if p == nil {
+		return ""
+	}
+	methods := slices.Clone(p.Allow)
+	if slices.Contains(methods, http.MethodGet) {
+		methods = append(methods, http.MethodHead)
+	}
+	if p.SynthesizeOptions {
+		methods = append(methods, http.MethodOptions)
+	}
+	slices.Sort(methods)
+
+	return strings.Join(slices.Compact(methods), ", ")
+}
+
+// checkMethod answers requests the method policy of their route rejects, and
+// OPTIONS requests it synthesizes the response of. It returns
+// ErrMethodNotAllowed for rejected requests and whether the request was
+// answered.
+func (lb *LoadBalancer) checkMethod(rw http.ResponseWriter, req *http.Request) (bool, error) {
+	var policy *MethodPolicy
+	if route := lb.matchRoute(req); route != nil {
+		policy = route.Methods
+	}
+	if !policy.allows(req.Method) {
+		if allow := policy.allowHeader(); allow != "" {
+			rw.Header().Set("Allow", allow)
+		}
+		err := fmt.Errorf("%w: %s", ErrMethodNotAllowed, req.Method)
+		writeError(rw, err)
+		return true, err
+	}
+	if policy != nil && policy.SynthesizeOptions && req.Method == http.MethodOptions {
+		rw.Header().Set("Allow", policy.allowHeader())
+		rw.Header().Set("Content-Length", "0")
+		rw.WriteHeader(http.StatusNoContent)
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend returns a server counting the requests it receives.
+func countingBackend(t *testing.T) (Server, *atomic.Int64) {
+	var calls atomic.Int64
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		okHandler(rw, req)
+	})
+	return server, &calls
+}
+
+func TestMethods_NotAllowed(t *testing.T) {
+	server, calls := countingBackend(t)
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{
+		PathPrefix: "/api",
+		Methods:    &MethodPolicy{Allow: []string{"POST", "GET"}},
+	}))
+
+	for _, method := range []string{"TRACE", "PROPFIND", "DELETE", "OPTIONS"} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest(method, "/api/items", nil))
+		if rw.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected %s to be rejected with 405, got %d", method, rw.Code)
+		}
+		if allow := rw.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+			t.Errorf("Expected Allow: GET, HEAD, POST, got %q", allow)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("Expected rejected methods to never reach the backend, got %d requests", calls.Load())
+	}
+
+	for _, method := range []string{"GET", "HEAD", "POST"} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest(method, "/api/items", nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected %s to be proxied, got %d", method, rw.Code)
+		}
+	}
+}
+
+func TestMethods_SynthesizedOptions(t *testing.T) {
+	server, calls := countingBackend(t)
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{
+		PathPrefix: "/api",
+		Methods:    &MethodPolicy{Allow: []string{"PUT", "POST"}, SynthesizeOptions: true},
+	}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("OPTIONS", "/api/items", nil))
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Allow") != "OPTIONS, POST, PUT" {
+		t.Errorf("Expected a synthesized 204 with Allow: OPTIONS, POST, PUT, got %d %q", rw.Code, rw.Header().Get("Allow"))
+	}
+	if calls.Load() != 0 {
+		t.Errorf("Expected OPTIONS to be answered without the backend, got %d requests", calls.Load())
+	}
+}
+
+func TestMethods_Unconfigured(t *testing.T) {
+	server, calls := countingBackend(t)
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	for _, method := range []string{"GET", "OPTIONS", "TRACE", "PROPFIND"} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest(method, "/", nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected %s to be proxied without a method policy, got %d", method, rw.Code)
+		}
+	}
+	if calls.Load() != 4 {
+		t.Errorf("Expected 4 requests at the backend, got %d", calls.Load())
+	}
+}
+
+func TestMethods_Connect(t *testing.T) {
+	server, calls := countingBackend(t)
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(
+		Route{PathPrefix: "/tunnel", Methods: &MethodPolicy{Allow: []string{"CONNECT"}}},
+		Route{PathPrefix: "/api", Methods: &MethodPolicy{Allow: []string{"GET"}}},
+	))
+
+	for _, path := range []string{"/", "/api"} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("CONNECT", path, nil))
+		if rw.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected CONNECT %s to be rejected, got %d", path, rw.Code)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("Expected rejected CONNECT requests to never reach the backend, got %d requests", calls.Load())
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("CONNECT", "/tunnel", nil))
+	if rw.Code == http.StatusMethodNotAllowed || calls.Load() != 1 {
+		t.Errorf("Expected CONNECT to be proxied where allowed, got %d", rw.Code)
+	}
+}
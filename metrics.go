@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeMetrics renders stats in the Prometheus text exposition format. Server
+// labels are exported as additional metric labels prefixed with "label_".
+func writeMetrics(w io.Writer, stats []ServerStats) {
+	fmt.Fprintln(w, "# HELP lb_server_up Whether the server is currently alive.")
+	fmt.Fprintln(w, "# TYPE lb_server_up gauge")
+	for _, s := range stats {
+		up := 0
+		if s.Alive {
+			up = 1
+		}
+		fmt.Fprintf(w, "lb_server_up{%s} %d\n", metricLabels(s), up)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_maintenance Whether the server is out of selection for scheduled maintenance.")
+	fmt.Fprintln(w, "# TYPE lb_server_maintenance gauge")
+	for _, s := range stats {
+		maintenance := 0
+		if s.MaintenanceUntil != nil {
+			maintenance = 1
+		}
+		fmt.Fprintf(w, "lb_server_maintenance{%s} %d\n", metricLabels(s), maintenance)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_flapping Whether the server is held down for flapping health.")
+	fmt.Fprintln(w, "# TYPE lb_server_flapping gauge")
+	for _, s := range stats {
+		flapping := 0
+		if s.Flapping {
+			flapping = 1
+		}
+		fmt.Fprintf(w, "lb_server_flapping{%s} %d\n", metricLabels(s), flapping)
+	}
+	fmt.Fprintln(w, "# HELP lb_server_flaps_total Times the server was detected flapping.")
+	fmt.Fprintln(w, "# TYPE lb_server_flaps_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_flaps_total{%s} %d\n", metricLabels(s), s.Flaps)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_ejected Whether the server is ejected from selection for invalid responses.")
+	fmt.Fprintln(w, "# TYPE lb_server_ejected gauge")
+	for _, s := range stats {
+		ejected := 0
+		if s.EjectedUntil != nil {
+			ejected = 1
+		}
+		fmt.Fprintf(w, "lb_server_ejected{%s} %d\n", metricLabels(s), ejected)
+	}
+	fmt.Fprintln(w, "# HELP lb_server_ejections_total Times the server was ejected for invalid responses.")
+	fmt.Fprintln(w, "# TYPE lb_server_ejections_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_ejections_total{%s} %d\n", metricLabels(s), s.Ejections)
+	}
+	fmt.Fprintln(w, "# HELP lb_server_backing_off Whether the server is out of selection for a drain it asked for in feedback.")
+	fmt.Fprintln(w, "# TYPE lb_server_backing_off gauge")
+	for _, s := range stats {
+		backingOff := 0
+		if s.BackoffUntil != nil {
+			backingOff = 1
+		}
+		fmt.Fprintf(w, "lb_server_backing_off{%s} %d\n", metricLabels(s), backingOff)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_health_override Liveness pinned by a health override: 1 up, -1 down, 0 none.")
+	fmt.Fprintln(w, "# TYPE lb_server_health_override gauge")
+	for _, s := range stats {
+		override := 0
+		switch {
+		case s.HealthOverride == nil:
+		case s.HealthOverride.State == HealthUp:
+			override = 1
+		default:
+			override = -1
+		}
+		fmt.Fprintf(w, "lb_server_health_override{%s} %d\n", metricLabels(s), override)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_weight Relative capacity of the server.")
+	fmt.Fprintln(w, "# TYPE lb_server_weight gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_weight{%s} %d\n", metricLabels(s), s.Weight)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_effective_weight Weight the server is selected with under adaptive weights.")
+	fmt.Fprintln(w, "# TYPE lb_server_effective_weight gauge")
+	for _, s := range stats {
+		if s.EffectiveWeight != nil {
+			fmt.Fprintf(w, "lb_server_effective_weight{%s} %g\n", metricLabels(s), *s.EffectiveWeight)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_reported_load Load the server last reported in its health checks.")
+	fmt.Fprintln(w, "# TYPE lb_server_reported_load gauge")
+	for _, s := range stats {
+		if s.ReportedLoad != nil {
+			fmt.Fprintf(w, "lb_server_reported_load{%s} %g\n", metricLabels(s), s.ReportedLoad.Load)
+		}
+	}
+	fmt.Fprintln(w, "# HELP lb_server_reported_load_stale Whether the load the server last reported is too old to select by.")
+	fmt.Fprintln(w, "# TYPE lb_server_reported_load_stale gauge")
+	for _, s := range stats {
+		if s.ReportedLoad != nil {
+			stale := 0
+			if s.ReportedLoad.Stale {
+				stale = 1
+			}
+			fmt.Fprintf(w, "lb_server_reported_load_stale{%s} %d\n", metricLabels(s), stale)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_requests_total Requests forwarded to the server.")
+	fmt.Fprintln(w, "# TYPE lb_server_requests_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_requests_total{%s} %d\n", metricLabels(s), s.Requests)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_errors_total Requests to the server answered with a 5xx status.")
+	fmt.Fprintln(w, "# TYPE lb_server_errors_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_errors_total{%s} %d\n", metricLabels(s), s.Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_failures_total Failed upstream attempts by error class, including retried ones.")
+	fmt.Fprintln(w, "# TYPE lb_server_failures_total counter")
+	for _, s := range stats {
+		classes := make([]string, 0, len(s.Failures))
+		for class := range s.Failures {
+			classes = append(classes, string(class))
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "lb_server_failures_total{%s,class=%q} %d\n", metricLabels(s), class, s.Failures[ErrorClass(class)])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_in_flight_requests Requests currently being served by the server.")
+	fmt.Fprintln(w, "# TYPE lb_server_in_flight_requests gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_in_flight_requests{%s} %d\n", metricLabels(s), s.InFlight)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_received_bytes_total Request bytes received from clients for the server.")
+	fmt.Fprintln(w, "# TYPE lb_server_received_bytes_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_received_bytes_total{%s} %d\n", metricLabels(s), s.BytesIn)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_server_sent_bytes_total Response bytes sent to clients from the server.")
+	fmt.Fprintln(w, "# TYPE lb_server_sent_bytes_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "lb_server_sent_bytes_total{%s} %d\n", metricLabels(s), s.BytesOut)
+	}
+
+	writeTransportMetrics(w, stats)
+}
+
+// writeTransportMetrics renders the connection metrics of servers that
+// instrument their transport.
+func writeTransportMetrics(w io.Writer, stats []ServerStats) {
+	metrics := []struct {
+		name, kind, help string
+		value            func(*TransportStats) any
+	}{
+		{"lb_server_connections_opened_total", "counter", "Connections opened to the server.",
+			func(t *TransportStats) any { return t.ConnectionsOpened }},
+		{"lb_server_connections_reused_total", "counter", "Requests sent over a previously used connection.",
+			func(t *TransportStats) any { return t.ConnectionsReused }},
+		{"lb_server_tls_handshakes_total", "counter", "TLS handshakes completed with the server.",
+			func(t *TransportStats) any { return t.TLSHandshakes }},
+		{"lb_server_tls_resumed_total", "counter", "TLS handshakes that resumed an earlier session.",
+			func(t *TransportStats) any { return t.TLSResumed }},
+		{"lb_server_connections_open", "gauge", "Connections currently open to the server.",
+			func(t *TransportStats) any { return t.OpenConnections }},
+		{"lb_server_connections_idle", "gauge", "Open connections to the server not serving a request.",
+			func(t *TransportStats) any { return t.IdleConnections }},
+		{"lb_server_requests_per_connection", "gauge", "Average requests sent over each connection opened to the server.",
+			func(t *TransportStats) any { return t.RequestsPerConnection }},
+		{"lb_server_prewarm_probes_total", "counter", "Probes sent to keep idle connections open to the server.",
+			func(t *TransportStats) any { return t.PrewarmProbes }},
+		{"lb_server_connections_prewarmed_total", "counter", "Connections to the server opened by pre-warming.",
+			func(t *TransportStats) any { return t.PrewarmedConnections }},
+		{"lb_server_stale_connection_retries_total", "counter", "Requests resent on a fresh connection after failing on a stale one.",
+			func(t *TransportStats) any { return t.StaleRetries }},
+		{"lb_server_connections_retired_total", "counter", "Idle connections to the server closed at their maximum age.",
+			func(t *TransportStats) any { return t.RetiredConnections }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, s := range stats {
+			if s.Transport != nil {
+				fmt.Fprintf(w, "%s{%s} %v\n", m.name, metricLabels(s), m.value(s.Transport))
+			}
+		}
+	}
+}
+
+// metricLabels formats the label set identifying a server in metrics.
+func metricLabels(s ServerStats) string {
+	pairs := []string{fmt.Sprintf("server=%q", s.Name)}
+
+	keys := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("label_%s=%q", sanitizeMetricName(k), s.Labels[k]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// sanitizeMetricName replaces characters that are not valid in a Prometheus
+// label name with underscores.
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// handleMetrics serves the load balancer's metrics.
+func (lb *LoadBalancer) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(rw, "# HELP lb_instance_info The instance ID of this load balancer, for joining with other metrics.")
+	fmt.Fprintln(rw, "# TYPE lb_instance_info gauge")
+	fmt.Fprintf(rw, "lb_instance_info{instance=%q} 1\n", lb.instanceID)
+	writeMetrics(rw, lb.Stats())
+	lb.writeStrategyMetrics(rw)
+	lb.faults.writeMetrics(rw)
+	lb.requests.write(rw)
+	lb.conns.writeMetrics(rw)
+	lb.streams.writeMetrics(rw)
+	lb.events.writeMetrics(rw)
+	lb.auth.writeMetrics(rw)
+	lb.workers.writeMetrics(rw)
+	if lb.recorder != nil {
+		lb.recorder.writeMetrics(rw)
+	}
+	if lb.mirror != nil {
+		lb.mirror.writeMetrics(rw)
+	}
+	if lb.cache != nil {
+		lb.cache.writeMetrics(rw)
+	}
+	if lb.idempotency != nil {
+		lb.idempotency.writeMetrics(rw)
+	}
+	if lb.dns != nil {
+		lb.dns.writeMetrics(rw)
+	}
+	if lb.fairness != nil {
+		lb.fairness.writeMetrics(rw, lb.now())
+	}
+	if lb.tenants != nil {
+		lb.tenants.writeMetrics(rw)
+	}
+	if lb.apiKeys != nil {
+		lb.apiKeys.writeMetrics(rw)
+	}
+	if lb.sharedLimits != nil {
+		lb.sharedLimits.writeMetrics(rw)
+	}
+	if lb.geo != nil {
+		lb.geo.writeMetrics(rw)
+	}
+	if lb.srv != nil {
+		lb.srv.writeMetrics(rw)
+	}
+	if lb.control != nil {
+		lb.control.writeMetrics(rw, lb.now())
+	}
+	if lb.gossip != nil {
+		lb.gossip.writeMetrics(rw)
+	}
+	if lb.fds != nil {
+		lb.fds.writeMetrics(rw)
+	}
+	if lb.accessFormat != nil {
+		lb.accessFormat.writeMetrics(rw)
+	}
+	if lb.ramp != nil {
+		lb.ramp.writeMetrics(rw)
+	}
+	if len(lb.journals) > 0 {
+		lb.writeJournalMetrics(rw)
+	}
+	if lb.passthroughStats != nil {
+		lb.passthroughStats.writeMetrics(rw)
+	}
+	if lb.listenerCert != nil {
+		lb.listenerCert.writeMetrics(rw, lb.now())
+	}
+	if lb.queue != nil {
+		fmt.Fprintln(rw, "# HELP lb_queue_length Requests waiting in the admission queue.")
+		fmt.Fprintln(rw, "# TYPE lb_queue_length gauge")
+		fmt.Fprintf(rw, "lb_queue_length %d\n", lb.queue.Len())
+		lb.queue.wait.write(rw, "lb_queue_wait_seconds", "Time requests spent in the admission queue.")
+	}
+}
+
+// writeStrategyMetrics renders the overflow counters of bounded-load
+// strategies, labeled with the route whose chain they belong to; the
+// load balancer's own chain has an empty route label.
+func (lb *LoadBalancer) writeStrategyMetrics(w io.Writer) {
+	chains := map[string][]Strategy{"": lb.strategies}
+	names := []string{""}
+	for _, route := range lb.routeList() {
+		if len(route.Strategies) > 0 {
+			chains[route.Name] = route.Strategies
+			names = append(names, route.Name)
+		}
+	}
+
+	header := false
+	for _, route := range names {
+		for _, s := range chains[route] {
+			r, ok := s.(overflowReporter)
+			if !ok {
+				continue
+			}
+			if !header {
+				fmt.Fprintln(w, "# HELP lb_strategy_overflows_total Requests rerouted because the server their key maps to was at the load bound.")
+				fmt.Fprintln(w, "# TYPE lb_strategy_overflows_total counter")
+				header = true
+			}
+			fmt.Fprintf(w, "lb_strategy_overflows_total{route=%q,strategy=%q} %d\n", route, s.Name(), r.Overflows())
+		}
+	}
+}
+
+// requestTimings aggregates the timings logged per request in the access
+// log.
+type requestTimings struct {
+	duration *histogram
+	ttfb     *histogram
+
+	mu       sync.Mutex
+	requests map[string]uint64
+	attempts uint64
+}
+
+func newRequestTimings() *requestTimings {
+	return &requestTimings{
+		duration: newHistogram(defaultLatencyBuckets),
+		ttfb:     newHistogram(defaultLatencyBuckets),
+		requests: make(map[string]uint64),
+	}
+}
+
+// observe records a request over the given protocol, such as "HTTP/1.1",
+// that took duration and made the given upstream attempts. Time to first
+// byte is that of the last attempt, the one that answered the client, if the
+// server responded.
+func (t *requestTimings) observe(protocol string, duration time.Duration, attempts []attemptRecord) {
+	t.duration.Observe(duration)
+	if n := len(attempts); n > 0 && attempts[n-1].ttfb > 0 {
+		t.ttfb.Observe(attempts[n-1].ttfb)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests[protocol]++
+	t.attempts += uint64(len(attempts))
+}
+
+func (t *requestTimings) write(w io.Writer) {
+	t.mu.Lock()
+	requests, attempts := make(map[string]uint64, len(t.requests)), t.attempts
+	protocols := make([]string, 0, len(t.requests))
+	for protocol, n := range t.requests {
+		requests[protocol] = n
+		protocols = append(protocols, protocol)
+	}
+	t.mu.Unlock()
+	sort.Strings(protocols)
+
+	fmt.Fprintln(w, "# HELP lb_requests_total Requests handled by client protocol, including those answered without contacting a server.")
+	fmt.Fprintln(w, "# TYPE lb_requests_total counter")
+	for _, protocol := range protocols {
+		fmt.Fprintf(w, "lb_requests_total{protocol=%q} %d\n", protocol, requests[protocol])
+	}
+	fmt.Fprintln(w, "# HELP lb_upstream_attempts_total Upstream attempts made for the handled requests, including retries.")
+	fmt.Fprintln(w, "# TYPE lb_upstream_attempts_total counter")
+	fmt.Fprintf(w, "lb_upstream_attempts_total %d\n", attempts)
+	t.duration.write(w, "lb_request_duration_seconds", "Time from receiving a request to completing its response, as observed by the client.")
+	t.ttfb.write(w, "lb_upstream_ttfb_seconds", "Time to first byte of the upstream attempt that answered the client.")
+}
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of latency
+// histograms.
+var defaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative histogram of observations in seconds.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records a duration.
+func (h *histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Quantile estimates the q-quantile of the observations by linear
+// interpolation within the bucket containing it. Observations above the
+// largest bucket are reported as that bucket's bound.
+func (h *histogram) Quantile(q float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return quantile(h.buckets, h.counts, h.count, q)
+}
+
+// quantile implements Quantile for cumulative bucket counts of count
+// observations.
+func quantile(buckets []float64, counts []uint64, count uint64, q float64) float64 {
+	if count == 0 {
+		return 0
+	}
+	rank := q * float64(count)
+	lower, prev := 0.0, uint64(0)
+	for i, le := range buckets {
+		if float64(counts[i]) >= rank {
+			inBucket := counts[i] - prev
+			if inBucket == 0 {
+				return le
+			}
+			return lower + (le-lower)*(rank-float64(prev))/float64(inBucket)
+		}
+		lower, prev = le, counts[i]
+	}
+
+	return buckets[len(buckets)-1]
+}
+
+// write renders the histogram named name in the Prometheus text format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	h.writeSeriesLocked(w, name, "")
+}
+
+// writeSeries renders the samples of the histogram named name with the
+// given labels, without its HELP and TYPE lines, for histograms of several
+// series.
+func (h *histogram) writeSeries(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeSeriesLocked(w, name, labels)
+}
+
+func (h *histogram) writeSeriesLocked(w io.Writer, name, labels string) {
+	prefix, braced := "", ""
+	if labels != "" {
+		prefix, braced = labels+",", "{"+labels+"}"
+	}
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, braced, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braced, h.count)
+}
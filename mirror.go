@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// defaultMirrorMaxBody bounds the bytes of a body kept for comparison.
+	defaultMirrorMaxBody = 64 << 10
+
+	// defaultMirrorQueue is the number of comparisons waiting to run.
+	defaultMirrorQueue = 64
+
+	// maxMirrorPaths bounds the paths broken down in the mirror report;
+	// further paths are counted under mirrorOtherPaths.
+	maxMirrorPaths = 100
+
+	// mirrorReportPaths is the number of paths listed in the report.
+	mirrorReportPaths = 20
+
+	mirrorOtherPaths = "(other)"
+)
+
+// Comparison controls how the responses of the primary server and the
+// mirror candidate are compared. The statuses are always compared, as are
+// the values of Headers. Bodies are compared after Normalize, if set; JSON
+// bodies are compared as values without the object fields named in
+// IgnoreFields, at any depth, such as timestamps or request IDs.
+type Comparison struct {
+	Headers      []string
+	IgnoreFields []string
+	Normalize    func(body []byte) []byte
+}
+
+// Mirror sends SamplePercent of the requests, after their response has been
+// sent to the client, to Candidate as well and compares the responses as
+// the route's Comparison, or Compare, says. Only the first MaxBody bytes of
+// a body, 64 KiB by default, are kept: requests with longer bodies are
+// skipped and longer responses are compared by hash alone. Comparisons
+// run off the request path through a queue of QueueSize, 64 by default;
+// requests arriving while it is full are dropped and counted.
+type Mirror struct {
+	Candidate     Server
+	SamplePercent float64
+	Compare       Comparison
+	MaxBody       int
+	QueueSize     int
+}
+
+// WithMirror enables mirroring to a candidate server.
+func WithMirror(m Mirror) Option {
+	return func(lb *LoadBalancer) {
+		lb.mirror = newMirrorer(m)
+	}
+}
+
+// mirrorer compares mirrored responses from a background worker.
+type mirrorer struct {
+	cfg   Mirror
+	queue chan *mirrorWriter
+
+	dropped atomic.Uint64
+	skipped atomic.Uint64
+
+	mu     sync.Mutex
+	report mirrorCounts
+	paths  map[string]*mirrorCounts
+}
+
+// mirrorCounts are the comparisons of a path, or of all paths.
+type mirrorCounts struct {
+	compared       uint64
+	matched        uint64
+	lastDifference string
+}
+
+func newMirrorer(cfg Mirror) *mirrorer {
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = defaultMirrorMaxBody
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultMirrorQueue
+	}
+	return &mirrorer{cfg: cfg, queue: make(chan *mirrorWriter, cfg.QueueSize), paths: make(map[string]*mirrorCounts)}
+}
+
+// run compares the queued mirrored requests until ctx is done.
+func (m *mirrorer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case w := <-m.queue:
+			markActive(ctx)
+			candidate := newResponseCapture(m.cfg.MaxBody)
+			m.cfg.Candidate.Serve(candidate, w.request())
+			m.observe(w.path, w.primary.compare(candidate, w.compare))
+		}
+	}
+}
+
+// observe counts a comparison of path that found difference, empty for a
+// match.
+func (m *mirrorer) observe(path, difference string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := m.paths[path]
+	if counts == nil {
+		if len(m.paths) >= maxMirrorPaths {
+			path = mirrorOtherPaths
+		}
+		if counts = m.paths[path]; counts == nil {
+			counts = &mirrorCounts{}
+			m.paths[path] = counts
+		}
+	}
+	for _, c := range []*mirrorCounts{&m.report, counts} {
+		c.compared++
+		if difference == "" {
+			c.matched++
+		} else {
+			c.lastDifference = difference
+		}
+	}
+}
+
+// mirrorWriter captures the response a client receives to a mirrored
+// request, along with what is needed to send the request to the candidate.
+type mirrorWriter struct {
+	http.ResponseWriter
+	primary *responseCapture
+
+	method  string
+	uri     string
+	host    string
+	path    string
+	header  http.Header
+	body    *captureReader
+	compare Comparison
+}
+
+// startMirror samples req for mirroring and, if it is to be mirrored,
+// starts capturing its body. The returned writer must be placed in front
+// of the client's response writer.
+func (lb *LoadBalancer) startMirror(req *http.Request) *mirrorWriter {
+	m := lb.mirror
+	if m == nil || rand.Float64()*100 >= m.cfg.SamplePercent {
+		return nil
+	}
+
+	w := &mirrorWriter{
+		primary: newResponseCapture(m.cfg.MaxBody),
+		method:  req.Method,
+		uri:     req.URL.RequestURI(),
+		host:    req.Host,
+		path:    req.URL.Path,
+		header:  req.Header.Clone(),
+		compare: m.cfg.Compare,
+	}
+	if route := lb.matchRoute(req); route != nil && route.Compare != nil {
+		w.compare = *route.Compare
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		w.body = &captureReader{ReadCloser: req.Body, limit: m.cfg.MaxBody}
+		req.Body = w.body
+	}
+
+	return w
+}
+
+// finishMirror queues the comparison of a completed request, dropping it
+// when the queue is full.
+func (lb *LoadBalancer) finishMirror(w *mirrorWriter) {
+	if w.body != nil {
+		if _, truncated := w.body.captured(); truncated {
+			lb.mirror.skipped.Add(1)
+			return
+		}
+	}
+
+	select {
+	case lb.mirror.queue <- w:
+	default:
+		lb.mirror.dropped.Add(1)
+	}
+}
+
+// request returns the request to send to the candidate.
+func (w *mirrorWriter) request() *http.Request {
+	var body []byte
+	if w.body != nil {
+		body, _ = w.body.captured()
+	}
+	req, _ := http.NewRequestWithContext(context.Background(), w.method, w.uri, bytes.NewReader(body))
+	req.Header = w.header
+	req.Host = w.host
+
+	return req
+}
+
+func (w *mirrorWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		w.primary.header = w.ResponseWriter.Header().Clone()
+		w.primary.WriteHeader(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	if w.primary.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.primary.Write(p)
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *mirrorWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *mirrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseCapture keeps the status, headers and the first bytes of the body
+// of a response, and the hash of the whole body.
+type responseCapture struct {
+	header    http.Header
+	status    int
+	limit     int
+	body      bytes.Buffer
+	hash      hash.Hash
+	truncated bool
+}
+
+func newResponseCapture(limit int) *responseCapture {
+	return &responseCapture{header: http.Header{}, limit: limit, hash: sha256.New()}
+}
+
+func (c *responseCapture) Header() http.Header { return c.header }
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 && status >= http.StatusOK {
+		c.status = status
+	}
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.hash.Write(p)
+	if room := c.limit - c.body.Len(); room < len(p) {
+		c.body.Write(p[:max(room, 0)])
+		c.truncated = true
+	} else {
+		c.body.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// compare returns how the candidate response differs from c, or "" if it
+// matches.
+func (c *responseCapture) compare(candidate *responseCapture, cmp Comparison) string {
+	if c.status != candidate.status {
+		return fmt.Sprintf("status %d != %d", c.status, candidate.status)
+	}
+	for _, name := range cmp.Headers {
+		if !slices.Equal(c.header.Values(name), candidate.header.Values(name)) {
+			return "header " + http.CanonicalHeaderKey(name)
+		}
+	}
+	if c.truncated || candidate.truncated {
+		if !bytes.Equal(c.hash.Sum(nil), candidate.hash.Sum(nil)) {
+			return "body"
+		}
+		return ""
+	}
+
+	a, b := c.body.Bytes(), candidate.body.Bytes()
+	if cmp.Normalize != nil {
+		a, b = cmp.Normalize(a), cmp.Normalize(b)
+	}
+	var av, bv any
+	if json.Unmarshal(a, &av) == nil && json.Unmarshal(b, &bv) == nil {
+		if !reflect.DeepEqual(withoutFields(av, cmp.IgnoreFields), withoutFields(bv, cmp.IgnoreFields)) {
+			return "body"
+		}
+		return ""
+	}
+	if !bytes.Equal(a, b) {
+		return "body"
+	}
+
+	return ""
+}
+
+// withoutFields returns v, a decoded JSON value, without the object fields
+// named in fields at any depth.
+func withoutFields(v any, fields []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if slices.Contains(fields, k) {
+				delete(v, k)
+				continue
+			}
+			v[k] = withoutFields(child, fields)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = withoutFields(child, fields)
+		}
+	}
+
+	return v
+}
+
+// MirrorPathReport is the comparison breakdown of a path.
+type MirrorPathReport struct {
+	Path           string  `json:"path"`
+	Compared       uint64  `json:"compared"`
+	Matched        uint64  `json:"matched"`
+	MatchRate      float64 `json:"match_rate"`
+	LastDifference string  `json:"last_difference,omitempty"`
+}
+
+// MirrorReport summarizes the comparisons of mirrored requests. Paths lists
+// the paths with the most mismatches first.
+type MirrorReport struct {
+	Compared  uint64             `json:"compared"`
+	Matched   uint64             `json:"matched"`
+	MatchRate float64            `json:"match_rate"`
+	Dropped   uint64             `json:"dropped"`
+	Skipped   uint64             `json:"skipped"`
+	Paths     []MirrorPathReport `json:"paths"`
+}
+
+func matchRate(c *mirrorCounts) float64 {
+	if c.compared == 0 {
+		return 0
+	}
+
+	return float64(c.matched) / float64(c.compared)
+}
+
+// Report returns the comparisons since the start or the last reset.
+func (m *mirrorer) Report() MirrorReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := MirrorReport{
+		Compared:  m.report.compared,
+		Matched:   m.report.matched,
+		MatchRate: matchRate(&m.report),
+		Dropped:   m.dropped.Load(),
+		Skipped:   m.skipped.Load(),
+		Paths:     []MirrorPathReport{},
+	}
+	for path, c := range m.paths {
+		r.Paths = append(r.Paths, MirrorPathReport{
+			Path:           path,
+			Compared:       c.compared,
+			Matched:        c.matched,
+			MatchRate:      matchRate(c),
+			LastDifference: c.lastDifference,
+		})
+	}
+	sort.Slice(r.Paths, func(i, j int) bool {
+		mi, mj := r.Paths[i].Compared-r.Paths[i].Matched, r.Paths[j].Compared-r.Paths[j].Matched
+		if mi != mj {
+			return mi > mj
+		}
+		return r.Paths[i].Path < r.Paths[j].Path
+	})
+	if len(r.Paths) > mirrorReportPaths {
+		r.Paths = r.Paths[:mirrorReportPaths]
+	}
+
+	return r
+}
+
+// reset clears the comparisons.
+func (m *mirrorer) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.report = mirrorCounts{}
+	clear(m.paths)
+	m.dropped.Store(0)
+	m.skipped.Store(0)
+}
+
+// writeMetrics renders the mirror counters.
+func (m *mirrorer) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	compared, matched := m.report.compared, m.report.matched
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_mirror_comparisons_total Mirrored requests compared, by result.")
+	fmt.Fprintln(w, "# TYPE lb_mirror_comparisons_total counter")
+	fmt.Fprintf(w, "lb_mirror_comparisons_total{result=\"match\"} %d\n", matched)
+	fmt.Fprintf(w, "lb_mirror_comparisons_total{result=\"mismatch\"} %d\n", compared-matched)
+	fmt.Fprintln(w, "# HELP lb_mirror_dropped_total Mirrored requests dropped because the comparison queue was full.")
+	fmt.Fprintln(w, "# TYPE lb_mirror_dropped_total counter")
+	fmt.Fprintf(w, "lb_mirror_dropped_total %d\n", m.dropped.Load())
+	fmt.Fprintln(w, "# HELP lb_mirror_skipped_total Mirrored requests skipped because their body exceeded the capture limit.")
+	fmt.Fprintln(w, "# TYPE lb_mirror_skipped_total counter")
+	fmt.Fprintf(w, "lb_mirror_skipped_total %d\n", m.skipped.Load())
+}
+
+// handleMirror reports the comparisons of mirrored requests.
+func (lb *LoadBalancer) handleMirror(rw http.ResponseWriter, req *http.Request) {
+	if lb.mirror == nil {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("mirroring is not configured"))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, lb.mirror.Report())
+}
+
+// handleMirrorReset clears the comparisons of mirrored requests.
+func (lb *LoadBalancer) handleMirrorReset(rw http.ResponseWriter, req *http.Request) {
+	if lb.mirror == nil {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("mirroring is not configured"))
+		return
+	}
+
+	lb.mirror.reset()
+	rw.WriteHeader(http.StatusNoContent)
+}
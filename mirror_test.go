@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirror_ComparisonReport(t *testing.T) {
+	var stamp atomic.Int64
+	handler := func(candidate bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.URL.Path == "/diverge" && candidate:
+				rw.WriteHeader(http.StatusInternalServerError)
+			case req.Method == "POST":
+				body, _ := io.ReadAll(req.Body)
+				rw.Write(body)
+			default:
+				rw.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(rw, `{"id": 1, "items": [{"name": "a", "ts": %d}], "ts": %d}`, stamp.Add(1), stamp.Add(1))
+			}
+		}
+	}
+	primary := newBackendServer(t, handler(false))
+	candidate := newBackendServer(t, handler(true))
+	lb := newTestLoadBalancer(t, []Server{primary},
+		WithMirror(Mirror{Candidate: candidate, SamplePercent: 100, Compare: Comparison{
+			Headers:      []string{"Content-Type"},
+			IgnoreFields: []string{"ts"},
+		}}),
+		WithRoutes(
+			Route{Name: "strict", PathPrefix: "/strict", Compare: &Comparison{}},
+			Route{Name: "default", PathPrefix: "/"},
+		))
+
+	for _, tt := range []struct{ method, path, body string }{
+		{"GET", "/match", ""},
+		{"GET", "/match", ""},
+		{"GET", "/match", ""},
+		{"POST", "/echo", "payload"},
+		{"GET", "/diverge", ""},
+		{"GET", "/diverge", ""},
+		{"GET", "/strict", ""},
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected the primary response for %s, got %d", tt.path, rw.Code)
+		}
+	}
+	waitFor(t, "comparisons", func() bool { return lb.mirror.Report().Compared == 7 })
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/mirror", nil))
+	var report MirrorReport
+	if err := json.Unmarshal(rw.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Matched != 4 || report.MatchRate != 4.0/7 {
+		t.Errorf("Expected 4 of 7 matches, got %d (%f)", report.Matched, report.MatchRate)
+	}
+	want := []MirrorPathReport{
+		{Path: "/diverge", Compared: 2, MatchRate: 0, LastDifference: "status 200 != 500"},
+		{Path: "/strict", Compared: 1, MatchRate: 0, LastDifference: "body"},
+		{Path: "/echo", Compared: 1, Matched: 1, MatchRate: 1},
+		{Path: "/match", Compared: 3, Matched: 3, MatchRate: 1},
+	}
+	if len(report.Paths) != len(want) {
+		t.Fatalf("Expected %d paths, got %+v", len(want), report.Paths)
+	}
+	for i, p := range report.Paths {
+		if p != want[i] {
+			t.Errorf("Expected path %d to be %+v, got %+v", i, want[i], p)
+		}
+	}
+
+	lb.AdminHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/mirror/reset", nil))
+	if r := lb.mirror.Report(); r.Compared != 0 || len(r.Paths) != 0 {
+		t.Errorf("Expected an empty report after reset, got %+v", r)
+	}
+}
+
+func TestMirror_BodyLimits(t *testing.T) {
+	primary := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, strings.Repeat("a", 100)+"primary")
+	})
+	candidate := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, strings.Repeat("a", 100)+"candidate")
+	})
+	lb := newTestLoadBalancer(t, []Server{primary},
+		WithMirror(Mirror{Candidate: candidate, SamplePercent: 100, MaxBody: 16}))
+
+	// Long responses are still compared by hash
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	waitFor(t, "comparison", func() bool { return lb.mirror.Report().Compared == 1 })
+	if r := lb.mirror.Report(); r.Matched != 0 {
+		t.Errorf("Expected the long bodies to differ, got %+v", r)
+	}
+
+	// Requests with long bodies are not mirrored
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("b", 32))))
+	if r := lb.mirror.Report(); r.Skipped != 1 {
+		t.Errorf("Expected the long request to be skipped, got %+v", r)
+	}
+}
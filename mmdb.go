@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errMMDBFormat reports a file that is not a valid MaxMind DB.
+var errMMDBFormat = errors.New("invalid MaxMind DB")
+
+// MaxMindDB is a GeoIPReader for GeoIP2 and GeoLite2 country and city
+// databases in the MaxMind DB format. Each location found is decoded once
+// and then served from memory.
+type MaxMindDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint
+
+	mu        sync.Mutex
+	locations map[uint]GeoLocation
+}
+
+// OpenMaxMindDB reads the MaxMind DB at path into memory.
+func OpenMaxMindDB(path string) (*MaxMindDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseMaxMindDB(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return db, nil
+}
+
+func parseMaxMindDB(data []byte) (*MaxMindDB, error) {
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errMMDBFormat)
+	}
+	start := i + len(mmdbMetadataMarker)
+	meta, _, err := (&mmdbDecoder{data: data[start:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", errMMDBFormat, err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errMMDBFormat)
+	}
+	uintField := func(name string) uint {
+		v, _ := fields[name].(uint64)
+		return uint(v)
+	}
+
+	db := &MaxMindDB{
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+		locations:  make(map[uint]GeoLocation),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: record size %d", errMMDBFormat, db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: ip version %d", errMMDBFormat, db.ipVersion)
+	}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	if db.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file", errMMDBFormat)
+	}
+	db.data = data[:i]
+
+	// IPv4 addresses are found under ::/96 in IPv6 databases.
+	if db.ipVersion == 6 {
+		for range 96 {
+			if db.ipv4Start >= db.nodeCount {
+				break
+			}
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *MaxMindDB) record(node, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the location of addr, if the database has one.
+func (db *MaxMindDB) Lookup(addr netip.Addr) (GeoLocation, bool) {
+	addr = addr.Unmap()
+	node := uint(0)
+	bits := addr.AsSlice()
+	if addr.Is4() {
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return GeoLocation{}, false
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return GeoLocation{}, false
+	}
+	offset := node - db.nodeCount - 16
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if loc, ok := db.locations[offset]; ok {
+		return loc, loc != GeoLocation{}
+	}
+	var loc GeoLocation
+	d := &mmdbDecoder{data: db.data[db.treeSize+16:]}
+	if v, _, err := d.decode(offset); err == nil {
+		loc = geoLocationOf(v)
+	}
+	db.locations[offset] = loc
+
+	return loc, loc != GeoLocation{}
+}
+
+// geoLocationOf extracts the country and continent codes of a GeoIP2
+// record, falling back to the registered country.
+func geoLocationOf(v any) GeoLocation {
+	record, _ := v.(map[string]any)
+	code := func(field, key string) string {
+		m, _ := record[field].(map[string]any)
+		s, _ := m[key].(string)
+		return s
+	}
+	loc := GeoLocation{Country: code("country", "iso_code"), Continent: code("continent", "code")}
+	if loc.Country == "" {
+		loc.Country = code("registered_country", "iso_code")
+	}
+
+	return loc
+}
+
+// mmdbDecoder decodes the data section of a MaxMind DB.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// Data types of the MaxMind DB format.
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBool    = 14
+	mmdbFloat   = 15
+)
+
+// decode decodes the value at offset, returning it and the offset after it.
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == mmdbPointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target)
+		return v, next, err
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			var key, value any
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, size)
+		for i := range a {
+			a[i], offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, fmt.Errorf("value exceeds the data section")
+	}
+	b := d.data[offset : offset+size]
+	next := offset + size
+	switch kind {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes, mmdbUint128:
+		return bytes.Clone(b), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// control decodes the control byte at offset, returning the type and size
+// of the value and the offset of its payload. For pointers, size holds the
+// size and value bits of the control byte.
+func (d *mmdbDecoder) control(offset uint) (kind, size, next uint, err error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("offset %d exceeds the data section", offset)
+	}
+	ctrl := d.data[offset]
+	offset++
+	kind = uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		return kind, uint(ctrl & 0x1f), offset, nil
+	}
+	if kind == 0 {
+		if offset >= uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("truncated extended type")
+		}
+		kind = 7 + uint(d.data[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("truncated size")
+		}
+		var extra uint
+		for _, c := range d.data[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	return kind, size, offset, nil
+}
+
+// pointer decodes the pointer with the size and value bits bits whose
+// payload is at offset, returning its target and the offset after it.
+func (d *mmdbDecoder) pointer(bits, offset uint) (uint, uint, error) {
+	n := bits>>3 + 1
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, fmt.Errorf("truncated pointer")
+	}
+	var p uint
+	if n < 4 {
+		p = bits & 0x7
+	}
+	for _, c := range d.data[offset : offset+n] {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+
+	return p, offset + n, nil
+}
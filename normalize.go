@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PathNormalization cleans request paths before they are routed and
+// forwarded: duplicate slashes are collapsed and dot segments, including
+// percent-encoded ones, are resolved. Paths whose ".." segments climb above
+// the root are clamped to it, or rejected with 400 with RejectTraversal.
+// Paths containing NUL or other control characters, encoded or not, are
+// always rejected. LowercaseHost also lowercases the Host header. Routes
+// with RawPath set receive their requests' paths untouched; they are
+// matched against the path as received.
+type PathNormalization struct {
+	RejectTraversal bool
+	LowercaseHost   bool
+}
+
+// WithPathNormalization enables path normalization.
+func WithPathNormalization(p PathNormalization) Option {
+	return func(lb *LoadBalancer) {
+		lb.normalize = &p
+	}
+}
+
+// normalizeRequest applies path normalization to req in place. It returns
+// ErrInvalidPath for paths that are rejected.
+func (lb *LoadBalancer) normalizeRequest(req *http.Request) error {
+	p := lb.normalize
+	if p == nil {
+		return nil
+	}
+	if i := strings.IndexFunc(req.URL.Path, isControl); i >= 0 {
+		return fmt.Errorf("%w: control character %q", ErrInvalidPath, req.URL.Path[i])
+	}
+	if p.LowercaseHost {
+		req.Host = strings.ToLower(req.Host)
+	}
+	if route := lb.matchRoute(req); route != nil && route.RawPath {
+		return nil
+	}
+
+	cleaned, escapes := cleanPath(req.URL.EscapedPath())
+	if escapes && p.RejectTraversal {
+		return fmt.Errorf("%w: %q escapes the root", ErrInvalidPath, req.URL.EscapedPath())
+	}
+	decoded, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	req.URL.Path, req.URL.RawPath = decoded, cleaned
+
+	return nil
+}
+
+// isControl reports whether r is NUL or another ASCII control character.
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// cleanPath collapses duplicate slashes and resolves the dot segments of
+// the escaped path p, keeping a trailing slash. It reports whether ".."
+// segments climbed above the root, which they are clamped to.
+func cleanPath(p string) (cleaned string, escapes bool) {
+	parts := strings.Split(p, "/")
+	last := dotSegment(parts[len(parts)-1])
+	trailing := last == "" || last == "." || last == ".."
+
+	var segments []string
+	for _, seg := range parts {
+		switch dotSegment(seg) {
+		case "", ".":
+		case "..":
+			if len(segments) == 0 {
+				escapes = true
+				continue
+			}
+			segments = segments[:len(segments)-1]
+		default:
+			segments = append(segments, seg)
+		}
+	}
+
+	cleaned = "/" + strings.Join(segments, "/")
+	if trailing && len(segments) > 0 {
+		cleaned += "/"
+	}
+
+	return cleaned, escapes
+}
+
+// dotSegment returns "." or ".." for dot segments, also percent-encoded
+// ones, and seg itself otherwise.
+func dotSegment(seg string) string {
+	switch strings.ReplaceAll(strings.ReplaceAll(seg, "%2e", "."), "%2E", ".") {
+	case ".":
+		return "."
+	case "..":
+		return ".."
+	}
+
+	return seg
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathNormalization_Corpus(t *testing.T) {
+	var seen string
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		seen = req.RequestURI
+	})
+
+	for _, tt := range []struct {
+		path    string
+		reject  bool
+		want    string
+		wantErr bool
+	}{
+		{path: "/a/b", want: "/a/b"},
+		{path: "//a//b", want: "/a/b"},
+		{path: "/a/./b/../c", want: "/a/c"},
+		{path: "/a/b/", want: "/a/b/"},
+		{path: "/a/b/.", want: "/a/b/"},
+		{path: "/a/..", want: "/"},
+		{path: "/a/%2e%2e/b", want: "/b"},
+		{path: "/a/%2E/b", want: "/a/b"},
+		{path: "/a%2Fb/../c", want: "/c"},
+		{path: "/a%2Fb/c", want: "/a%2Fb/c"},
+		{path: "/a/b?x=/../", want: "/a/b?x=/../"},
+		{path: "/../../etc/passwd", want: "/etc/passwd"},
+		{path: "/a/%2e%2e/%2e%2e/etc/passwd", want: "/etc/passwd"},
+		{path: "/../../etc/passwd", reject: true, wantErr: true},
+		{path: "/a/%2e%2e/%2e%2e/etc/passwd", reject: true, wantErr: true},
+		{path: "/a/../b", reject: true, want: "/b"},
+		{path: "/a%00b", wantErr: true},
+		{path: "/a%0d%0aX-Injected:%201", wantErr: true},
+		{path: "/a%7fb", wantErr: true},
+	} {
+		lb := newTestLoadBalancer(t, []Server{server},
+			WithPathNormalization(PathNormalization{RejectTraversal: tt.reject}))
+		seen = ""
+
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", tt.path, nil))
+		if tt.wantErr {
+			if rw.Code != http.StatusBadRequest || seen != "" {
+				t.Errorf("%s (reject %v): Expected 400 without reaching the server, got %d forwarding %q",
+					tt.path, tt.reject, rw.Code, seen)
+			}
+			continue
+		}
+		if rw.Code != http.StatusOK || seen != tt.want {
+			t.Errorf("%s (reject %v): Expected %q to be forwarded, got %d forwarding %q",
+				tt.path, tt.reject, tt.want, rw.Code, seen)
+		}
+	}
+}
+
+func TestPathNormalization_RawRoute(t *testing.T) {
+	var seen string
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		seen = req.RequestURI
+	})
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithPathNormalization(PathNormalization{RejectTraversal: true}),
+		WithRoutes(Route{Name: "raw", PathPrefix: "/raw/", RawPath: true}))
+
+	for path, want := range map[string]string{
+		"/raw//a/../b":       "/raw//a/../b",
+		"/raw/%2e%2e/%2e%2e": "/raw/%2e%2e/%2e%2e",
+		"/other//a/../b":     "/other/b",
+	} {
+		seen = ""
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK || seen != want {
+			t.Errorf("%s: Expected %q to be forwarded, got %d forwarding %q", path, want, rw.Code, seen)
+		}
+	}
+
+	seen = ""
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/raw/a%00b", nil))
+	if rw.Code != http.StatusBadRequest || seen != "" {
+		t.Errorf("Expected control characters to be rejected on raw routes too, got %d", rw.Code)
+	}
+}
+
+func TestPathNormalization_LowercaseHost(t *testing.T) {
+	var seen string
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		seen = req.Host
+	})
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithPathNormalization(PathNormalization{LowercaseHost: true}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "API.Example.COM"
+	lb.serveProxy(httptest.NewRecorder(), req)
+	if seen != "api.example.com" {
+		t.Errorf("Expected the host to be lowercased, got %q", seen)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+)
+
+const (
+	// backendOverrideHeader names the pool member a debugging request is
+	// forced to by name or address, e.g. "X-LB-Backend: http://10.0.0.5:8080".
+	backendOverrideHeader = "X-LB-Backend"
+
+	// backendOverrideSecretHeader carries the shared secret authorizing an
+	// override.
+	backendOverrideSecretHeader = "X-LB-Backend-Secret"
+)
+
+// BackendOverride gates forcing requests to a specific server with the
+// X-LB-Backend header. Overrides are honored only when Enabled is set and the
+// request either carries Secret in X-LB-Backend-Secret or comes from an
+// address in AllowedPrefixes; with neither configured nothing is authorized.
+// Only servers already in the pool can be targeted.
+type BackendOverride struct {
+	Enabled         bool
+	Secret          string
+	AllowedPrefixes []netip.Prefix
+}
+
+// WithBackendOverride configures the backend override header. It is disabled
+// by default.
+func WithBackendOverride(o BackendOverride) Option {
+	return func(lb *LoadBalancer) {
+		lb.override = &o
+	}
+}
+
+// authorized reports whether req, which carried secret, may override its
+// backend.
+func (o *BackendOverride) authorized(req *http.Request, secret string) bool {
+	if o == nil || !o.Enabled {
+		return false
+	}
+	if o.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(o.Secret)) == 1 {
+		return true
+	}
+
+	addr, ok := clientAddr(req)
+	if !ok {
+		return false
+	}
+	for _, prefix := range o.AllowedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backendOverride strips the override headers from req and returns the
+// server an authorized request is forced to, or nil. Unauthorized overrides
+// are ignored. Values naming no server in the pool are rejected with
+// ErrInvalidAddress if they are not URLs either, and ErrServerNotFound
+// otherwise.
+func (lb *LoadBalancer) backendOverride(req *http.Request) (Server, error) {
+	addr := req.Header.Get(backendOverrideHeader)
+	secret := req.Header.Get(backendOverrideSecretHeader)
+	req.Header.Del(backendOverrideHeader)
+	req.Header.Del(backendOverrideSecretHeader)
+	if addr == "" {
+		return nil, nil
+	}
+	if !lb.override.authorized(req, secret) {
+		fmt.Printf("ignoring unauthorized backend override to %q from %s\n", addr, req.RemoteAddr)
+		return nil, nil
+	}
+
+	server, err := lb.forceServer(addr)
+	if errors.Is(err, ErrServerNotFound) {
+		if u, perr := url.Parse(addr); perr != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("backend override: %w %q", ErrInvalidAddress, addr)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backend override: %w", err)
+	}
+	fmt.Printf("WARNING: backend override: %s %s from %s forced to %q\n", req.Method, req.URL.Path, req.RemoteAddr, serverName(server))
+
+	return server, nil
+}
+
+// forceServer selects the pool member with the given name or address
+// regardless of strategy, health and concurrency limits.
+func (lb *LoadBalancer) forceServer(ref string) (Server, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	s := lb.findServerLocked(ref)
+	if s == nil {
+		return nil, fmt.Errorf("%q: %w", ref, ErrServerNotFound)
+	}
+	c := lb.countersFor(serverName(s))
+	c.requests++
+	c.inFlight++
+
+	return s, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// headerMockServer records the headers of the last request it served.
+type headerMockServer struct {
+	MockServer
+	header http.Header
+}
+
+func (m *headerMockServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	m.header = req.Header.Clone()
+	m.MockServer.Serve(rw, req)
+}
+
+func newOverrideLoadBalancer(t *testing.T, opts ...Option) (*LoadBalancer, *headerMockServer, *headerMockServer) {
+	server1 := &headerMockServer{MockServer: MockServer{addr: "http://10.0.0.4:8080", isAlive: true}}
+	server2 := &headerMockServer{MockServer: MockServer{addr: "http://10.0.0.5:8080", isAlive: true}}
+	return newTestLoadBalancer(t, []Server{server1, server2}, opts...), server1, server2
+}
+
+// overrideRequest returns a request from remote asking for backend.
+func overrideRequest(remote, backend, secret string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remote
+	req.Header.Set(backendOverrideHeader, backend)
+	if secret != "" {
+		req.Header.Set(backendOverrideSecretHeader, secret)
+	}
+	return req
+}
+
+func TestBackendOverride_Authorized(t *testing.T) {
+	log := &syncBuffer{}
+	lb, server1, server2 := newOverrideLoadBalancer(t, WithAccessLog(log), WithBackendOverride(BackendOverride{
+		Enabled:         true,
+		Secret:          "s3cret",
+		AllowedPrefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}))
+
+	// Both the secret and an allowlisted address authorize the override
+	for _, req := range []*http.Request{
+		overrideRequest("203.0.113.9:1234", "http://10.0.0.5:8080", "s3cret"),
+		overrideRequest("192.0.2.7:1234", "HTTP://10.0.0.5:8080/", ""),
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rw.Code)
+		}
+	}
+	if server1.callCount != 0 || server2.callCount != 2 {
+		t.Errorf("Expected both requests on server2, got %d:%d", server1.callCount, server2.callCount)
+	}
+	if server2.header.Get(backendOverrideHeader) != "" {
+		t.Errorf("Expected the override header to be stripped")
+	}
+	for _, entry := range accessLogEntries(t, log) {
+		if entry["backend_override"] != true {
+			t.Errorf("Expected the override to be logged, got %v", entry)
+		}
+	}
+
+	// Neither a wrong secret nor another address is authorized
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, overrideRequest("203.0.113.9:1234", "http://10.0.0.5:8080", "guess"))
+	if server1.callCount != 1 {
+		t.Errorf("Expected an unauthorized override to be ignored")
+	}
+	if server1.header.Get(backendOverrideHeader) != "" || server1.header.Get(backendOverrideSecretHeader) != "" {
+		t.Errorf("Expected the override headers to be stripped, got %v", server1.header)
+	}
+}
+
+func TestBackendOverride_Disabled(t *testing.T) {
+	// The secret alone does not enable the feature
+	lb, server1, server2 := newOverrideLoadBalancer(t, WithBackendOverride(BackendOverride{Secret: "s3cret"}))
+
+	for i := 0; i < 2; i++ {
+		lb.serveProxy(httptest.NewRecorder(), overrideRequest("192.0.2.7:1234", "http://10.0.0.5:8080", "s3cret"))
+	}
+	if server1.callCount != 1 || server2.callCount != 1 {
+		t.Errorf("Expected the strategy to decide, got %d:%d", server1.callCount, server2.callCount)
+	}
+	for _, h := range []http.Header{server1.header, server2.header} {
+		if h.Get(backendOverrideHeader) != "" || h.Get(backendOverrideSecretHeader) != "" {
+			t.Errorf("Expected the override headers to be stripped, got %v", h)
+		}
+	}
+
+	// Enabled without a secret or allowlist authorizes nothing
+	lb, server1, _ = newOverrideLoadBalancer(t, WithBackendOverride(BackendOverride{Enabled: true}))
+	lb.serveProxy(httptest.NewRecorder(), overrideRequest("192.0.2.7:1234", "http://10.0.0.5:8080", ""))
+	if server1.callCount != 1 {
+		t.Errorf("Expected the override to be ignored")
+	}
+	if _, err := (&BackendOverrideConfig{Enabled: true}).build(); err == nil {
+		t.Errorf("Expected enabling without a secret or allowlist to be rejected")
+	}
+}
+
+func TestBackendOverride_UnknownBackend(t *testing.T) {
+	lb, server1, server2 := newOverrideLoadBalancer(t, WithBackendOverride(BackendOverride{Enabled: true, Secret: "s3cret"}))
+
+	for backend, want := range map[string]int{
+		"http://10.0.0.6:8080": http.StatusNotFound,
+		"10.0.0.5:8080":        http.StatusBadRequest,
+		"http://evil.example":  http.StatusNotFound,
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, overrideRequest("203.0.113.9:1234", backend, "s3cret"))
+		if rw.Code != want {
+			t.Errorf("Expected status %d for %q, got %d", want, backend, rw.Code)
+		}
+	}
+	if server1.callCount+server2.callCount != 0 {
+		t.Errorf("Expected rejected overrides never to be proxied")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request, which error pages show.
+const requestIDHeader = "X-Request-ID"
+
+// ResponseTemplate renders the body of responses made by the load balancer
+// itself, its error pages and static responses, from a Go template executed
+// with ResponseData. Templates for text/html are html/template templates,
+// escaping what they insert, and text/template templates otherwise.
+type ResponseTemplate struct {
+	contentType string
+	tmpl        interface {
+		Execute(w io.Writer, data any) error
+	}
+}
+
+// ParseResponseTemplate parses body as the template of responses of
+// contentType, text/plain by default. It also executes the template once to
+// reject references to fields ResponseData does not have.
+func ParseResponseTemplate(contentType, body string) (*ResponseTemplate, error) {
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	t := &ResponseTemplate{contentType: contentType}
+	if mediaType == "text/html" {
+		t.tmpl, err = htmltemplate.New("response").Parse(body)
+	} else {
+		t.tmpl, err = template.New("response").Parse(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.tmpl.Execute(io.Discard, ResponseData{}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// ResponseData is what response templates are executed with. Backend is the
+// server last attempted, if any, and RetryAfter the Retry-After header of
+// the response, if set. Vars holds the variables set with WithTemplateVars.
+type ResponseData struct {
+	RequestID  string
+	Status     int
+	StatusText string
+	RetryAfter string
+	Route      string
+	Backend    string
+	Timestamp  time.Time
+	Vars       map[string]string
+}
+
+// StaticResponse answers a route's requests without contacting a server,
+// with Status, 200 by default, Header and Body, if set.
+type StaticResponse struct {
+	Status int
+	Header http.Header
+	Body   *ResponseTemplate
+}
+
+// WithErrorPages renders the error responses of the load balancer, such as
+// a 503 when no server is available, from the templates for their status
+// code. Responses of servers are passed on unchanged.
+func WithErrorPages(pages map[int]*ResponseTemplate) Option {
+	return func(lb *LoadBalancer) {
+		lb.errorPages = pages
+	}
+}
+
+// WithTemplateVars sets the Vars response templates are executed with, such
+// as a support URL.
+func WithTemplateVars(vars map[string]string) Option {
+	return func(lb *LoadBalancer) {
+		lb.templateVars = vars
+	}
+}
+
+// pageRequest is the request whose error responses are rendered from the
+// error pages.
+type pageRequest struct {
+	lb      *LoadBalancer
+	req     *http.Request
+	backend Server
+}
+
+// attempt records server as the one last attempted.
+func (p *pageRequest) attempt(server Server) {
+	if p != nil {
+		p.backend = server
+	}
+}
+
+// pageRequestOf returns the page request of the countingResponseWriter rw
+// wraps, or nil.
+func pageRequestOf(rw http.ResponseWriter) *pageRequest {
+	if cw := countingWriterOf(rw); cw != nil {
+		return cw.page
+	}
+
+	return nil
+}
+
+// write answers rw with the error page for status, reporting whether there
+// is one and it rendered.
+func (p *pageRequest) write(rw http.ResponseWriter, status int) bool {
+	t := p.lb.errorPages[status]
+	if t == nil {
+		return false
+	}
+	var backend string
+	if p.backend != nil {
+		backend = serverName(p.backend)
+	}
+
+	return p.lb.renderResponse(rw, p.req, t, status, backend)
+}
+
+// renderResponse answers rw to req with status and the body rendered from
+// t, reporting whether it rendered. Nothing is written if it did not.
+func (lb *LoadBalancer) renderResponse(rw http.ResponseWriter, req *http.Request, t *ResponseTemplate, status int, backend string) bool {
+	data := ResponseData{
+		RequestID:  requestID(req),
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RetryAfter: rw.Header().Get("Retry-After"),
+		Backend:    backend,
+		Timestamp:  lb.now().UTC(),
+		Vars:       lb.templateVars,
+	}
+	if data.RequestID == "" {
+		data.RequestID = newRequestID()
+		if info := requestInfo(req); info != nil {
+			info.requestID = data.RequestID
+		}
+	}
+	if route := lb.matchRoute(req); route != nil {
+		data.Route = route.Name
+	}
+	var body bytes.Buffer
+	if err := t.tmpl.Execute(&body, data); err != nil {
+		lb.logger.Warn("response template failed", "status", status, "path", req.URL.Path, "error", err)
+		return false
+	}
+
+	header := rw.Header()
+	header.Set("Content-Type", t.contentType)
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set(requestIDHeader, data.RequestID)
+	rw.WriteHeader(status)
+	rw.Write(body.Bytes())
+
+	return true
+}
+
+// serveStatic answers req with the static response of its route.
+func (lb *LoadBalancer) serveStatic(rw http.ResponseWriter, req *http.Request, s *StaticResponse) {
+	status := s.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	for name, values := range s.Header {
+		rw.Header()[name] = values
+	}
+	if s.Body == nil {
+		rw.WriteHeader(status)
+		return
+	}
+	if !lb.renderResponse(rw, req, s.Body, status, "") {
+		http.Error(rw, http.StatusText(status), status)
+	}
+}
+
+// newRequestID returns a random ID for a request that came without one.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
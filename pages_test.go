@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustParseTemplate(t *testing.T, contentType, body string) *ResponseTemplate {
+	t.Helper()
+	tmpl, err := ParseResponseTemplate(contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tmpl
+}
+
+func TestResponseTemplate_RejectedAtParse(t *testing.T) {
+	for _, body := range []string{
+		"{{.RequestID",
+		"{{.Unknown}}",
+		"{{template \"missing\"}}",
+	} {
+		if _, err := ParseResponseTemplate("text/html", body); err == nil {
+			t.Errorf("Expected %q to be rejected", body)
+		}
+	}
+
+	cfg := &Config{
+		Port:       "8000",
+		Servers:    []ServerConfig{{Address: "http://server1.com"}},
+		ErrorPages: map[string]*ResponseTemplateConfig{"503": {Body: "{{.Nope}}"}},
+		Routes: []RouteConfig{{
+			Name:       "status",
+			PathPrefix: "/status",
+			Static:     &StaticResponseConfig{ResponseTemplateConfig: ResponseTemplateConfig{Body: "{{if}}"}},
+		}},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected the bad templates to fail validation")
+	}
+	for _, path := range []string{"error_pages[503]", "routes[status]"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("Expected a problem at %s, got %v", path, err)
+		}
+	}
+}
+
+func TestErrorPages_Rendered503(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://server1.com", isAlive: false},
+	}, WithRoutes(Route{Name: "api", PathPrefix: "/api"}),
+		WithErrorPages(map[int]*ResponseTemplate{
+			http.StatusServiceUnavailable: mustParseTemplate(t, "text/html; charset=utf-8",
+				`<p>{{.Status}} on {{.Route}}, request {{.RequestID}}. <a href="{{.Vars.support}}">Help</a> {{.Vars.note}}</p>`),
+		}),
+		WithTemplateVars(map[string]string{"support": "https://support.example.com", "note": "<soon>"}))
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	want := `<p>503 on api, request req-42. <a href="https://support.example.com">Help</a> &lt;soon&gt;</p>`
+	if rw.Code != http.StatusServiceUnavailable || rw.Body.String() != want {
+		t.Errorf("Expected the rendered page, got %d %q", rw.Code, rw.Body.String())
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Expected the page's content type, got %q", ct)
+	}
+
+	// Statuses without a page keep the plain message.
+	lb.errorPages = map[int]*ResponseTemplate{http.StatusBadGateway: lb.errorPages[http.StatusServiceUnavailable]}
+	rw = httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(rw.Body.String(), http.StatusText(http.StatusServiceUnavailable)) {
+		t.Errorf("Expected the plain message, got %q", rw.Body.String())
+	}
+}
+
+func TestErrorPages_UpstreamFailure(t *testing.T) {
+	refusing := newRefusingServer(t)
+	lb := newTestLoadBalancer(t, []Server{refusing}, WithErrorPages(map[int]*ResponseTemplate{
+		http.StatusBadGateway: mustParseTemplate(t, "", "{{.Backend}} failed at {{.Timestamp.Year}}"),
+	}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway || !strings.HasPrefix(rw.Body.String(), refusing.Address()+" failed at ") {
+		t.Errorf("Expected the page naming the backend, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestErrorPages_RenderFailureFallsBack(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{
+		&MockServer{addr: "http://server1.com", isAlive: false},
+	}, WithErrorPages(map[int]*ResponseTemplate{
+		// Vars are only set at request time, so this passes the parse check.
+		http.StatusServiceUnavailable: mustParseTemplate(t, "", `{{if .Vars}}{{call .Vars}}{{end}}`),
+	}), WithTemplateVars(map[string]string{"support": "https://support.example.com"}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable || strings.TrimSpace(rw.Body.String()) != http.StatusText(http.StatusServiceUnavailable) {
+		t.Errorf("Expected the plain message, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestStaticResponse_Route(t *testing.T) {
+	backend := &MockServer{addr: "http://server1.com", isAlive: true}
+	cfg := &Config{
+		Port:         "8000",
+		Servers:      []ServerConfig{{Address: backend.addr}},
+		TemplateVars: map[string]string{"version": "1.4.2"},
+		Routes: []RouteConfig{{
+			Name:       "version",
+			PathPrefix: "/version",
+			Static: &StaticResponseConfig{
+				Status:  http.StatusOK,
+				Headers: map[string]string{"Cache-Control": "no-store"},
+				ResponseTemplateConfig: ResponseTemplateConfig{
+					ContentType: "application/json",
+					Body:        `{"version":"{{.Vars.version}}","route":"{{.Route}}","id":"{{.RequestID}}"}`,
+				},
+			},
+		}},
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/version", nil)
+	req.Header.Set(requestIDHeader, "abc")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	want := `{"version":"1.4.2","route":"version","id":"abc"}`
+	if rw.Code != http.StatusOK || rw.Body.String() != want {
+		t.Errorf("Expected %q, got %d %q", want, rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Content-Type") != "application/json" || rw.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected the configured headers, got %v", rw.Header())
+	}
+	if stats := lb.Stats(); stats[0].Requests != 0 {
+		t.Errorf("Expected no server to be contacted, got %d requests", stats[0].Requests)
+	}
+}
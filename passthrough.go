@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHandshakeTimeout bounds the wait for a passthrough ClientHello.
+	defaultHandshakeTimeout = 10 * time.Second
+
+	// defaultPassthroughFailAfter is how many dials in a row must fail to
+	// eject a server, for defaultPassthroughEjectFor.
+	defaultPassthroughFailAfter = 3
+	defaultPassthroughEjectFor  = 30 * time.Second
+
+	// passthroughLeastConnections balances passthrough connections by the
+	// connections open to each server.
+	passthroughLeastConnections = "least-connections"
+)
+
+// SNIRule routes passthrough connections for Host to the servers matching
+// Selector. Host is an exact name or a wildcard such as "*.example.com",
+// which matches one or more labels in front of example.com.
+type SNIRule struct {
+	Host     string
+	Selector Selector
+}
+
+// Passthrough proxies TLS connections to servers without terminating TLS.
+// The server name a client sends in its ClientHello selects the first
+// matching rule. Connections without a server name or matching rule use the
+// servers matching Default, or are closed if CloseUnmatched is set. Within
+// the selected servers the normal strategy chain decides, unless Balance
+// is "least-connections".
+type Passthrough struct {
+	Rules          []SNIRule
+	Default        Selector
+	CloseUnmatched bool
+
+	// HandshakeTimeout bounds the wait for the ClientHello, 10s by default.
+	HandshakeTimeout time.Duration
+
+	// Balance is "least-connections" to send each connection to the server
+	// with the fewest connections open or being dialed, breaking ties
+	// round-robin.
+	Balance string
+
+	// DialRetries is how many more servers are tried when dialing a server
+	// fails; with least connections each is the least loaded of those not
+	// yet tried. FailAfter dials failing in a row, 3 by default, eject a
+	// server from selection for EjectFor, 30s by default, as invalid
+	// responses do.
+	DialRetries int
+	FailAfter   int
+	EjectFor    time.Duration
+}
+
+// WithPassthrough configures TLS passthrough for ServePassthrough.
+func WithPassthrough(p Passthrough) Option {
+	return func(lb *LoadBalancer) {
+		if p.FailAfter <= 0 {
+			p.FailAfter = defaultPassthroughFailAfter
+		}
+		if p.EjectFor <= 0 {
+			p.EjectFor = defaultPassthroughEjectFor
+		}
+		lb.passthrough = &p
+		lb.passthroughStats = newPassthroughStats()
+	}
+}
+
+// match returns the rule for serverName, or nil.
+func (p *Passthrough) match(serverName string) *SNIRule {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil
+	}
+	for i, r := range p.Rules {
+		host := strings.ToLower(r.Host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				return &p.Rules[i]
+			}
+			continue
+		}
+		if name == host {
+			return &p.Rules[i]
+		}
+	}
+
+	return nil
+}
+
+// ServePassthrough accepts TLS connections on ln and splices each one to a
+// server selected by its SNI name until ln is closed.
+func (lb *LoadBalancer) ServePassthrough(ln net.Listener) error {
+	if lb.passthrough == nil {
+		return fmt.Errorf("passthrough is not configured")
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go lb.handlePassthrough(conn)
+	}
+}
+
+// handlePassthrough proxies a single passthrough connection.
+func (lb *LoadBalancer) handlePassthrough(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+
+	timeout := lb.passthrough.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetReadDeadline(start.Add(timeout))
+	serverName, hello, err := peekServerName(conn)
+	if err != nil {
+		fmt.Printf("error: passthrough from %s: %v\n", conn.RemoteAddr(), err)
+		lb.passthroughStats.reject()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	rule := lb.passthrough.match(serverName)
+	selector, label := lb.passthrough.Default, "default"
+	if rule != nil {
+		selector, label = rule.Selector, rule.Host
+	} else if lb.passthrough.CloseUnmatched {
+		fmt.Printf("error: passthrough for %q: %v\n", serverName, ErrNoSNIRoute)
+		lb.passthroughStats.reject()
+		return
+	}
+
+	server, backend, err := lb.dialPassthrough(selector, timeout)
+	if err != nil {
+		fmt.Printf("error: passthrough for %q: %v\n", serverName, err)
+		lb.passthroughStats.reject()
+		return
+	}
+	lb.passthroughStats.track(conn, backend)
+	var in, out int64
+	defer func() {
+		duration := time.Since(start)
+		backend.Close()
+		lb.passthroughStats.closed(server, conn)
+		lb.finishConnection(server, in, out)
+		lb.passthroughStats.observe(label, in, out)
+		lb.logConnection(conn, serverName, server, duration, in, out)
+	}()
+
+	if _, err := backend.Write(hello); err != nil {
+		fmt.Printf("error: passthrough for %q to %q: %v\n", serverName, server.Address(), err)
+		return
+	}
+	in, out = splice(conn, backend)
+	in += int64(len(hello))
+}
+
+// dialPassthrough selects a server under selector and connects to it,
+// trying up to DialRetries more servers if dialing fails. The connection
+// is accounted for until finishConnection.
+func (lb *LoadBalancer) dialPassthrough(selector Selector, timeout time.Duration) (Server, net.Conn, error) {
+	tried := make(map[Server]bool)
+	for attempt := 0; ; attempt++ {
+		server, err := lb.selectPassthrough(selector, tried)
+		if err != nil {
+			return nil, nil, err
+		}
+		tried[server] = true
+		backend, err := net.DialTimeout("tcp", passthroughAddress(server), timeout)
+		lb.passthroughStats.dialed(server, err == nil)
+		if err == nil {
+			return server, backend, nil
+		}
+		lb.finishConnection(server, 0, 0)
+		lb.observeDialFailure(server)
+		if attempt >= lb.passthrough.DialRetries {
+			return nil, nil, fmt.Errorf("dial %q: %w", server.Address(), err)
+		}
+		fmt.Printf("error: passthrough dial to %q: %v, trying another server\n", server.Address(), err)
+	}
+}
+
+// selectPassthrough selects the server for a passthrough connection under
+// selector, avoiding the servers tried with least connections.
+func (lb *LoadBalancer) selectPassthrough(selector Selector, tried map[Server]bool) (Server, error) {
+	if lb.passthrough.Balance != passthroughLeastConnections {
+		server, err := lb.getNextMatchingServer(nil, selector)
+		if err == nil {
+			lb.passthroughStats.dialing(server)
+		}
+		return server, err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	now := lb.now()
+	candidates, err := lb.candidatesLocked(nil, selector, now)
+	if err != nil {
+		return nil, err
+	}
+	server := lb.passthroughStats.leastConnected(candidates, tried)
+	if server == nil {
+		return nil, ErrNoAvailableServers
+	}
+	lb.claimLocked(server, now)
+
+	return server, nil
+}
+
+// observeDialFailure ejects server for EjectFor once FailAfter dials to it
+// failed in a row.
+func (lb *LoadBalancer) observeDialFailure(server Server) {
+	if !lb.passthroughStats.failedTimes(server, lb.passthrough.FailAfter) {
+		return
+	}
+	addr := serverName(server)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(addr)
+	c.ejectedUntil = lb.now().Add(lb.passthrough.EjectFor)
+	c.ejections++
+	fmt.Printf("server %s failed %d passthrough dials in a row, ejecting it for %s\n", addr, lb.passthrough.FailAfter, lb.passthrough.EjectFor)
+	lb.events.publish(Event{Type: EventBreakerOpened, Backend: addr, Reason: "dial_failures"})
+}
+
+// peekServerName reads the ClientHello from conn and returns the SNI name it
+// carries, empty if none, together with the bytes read, which must be
+// forwarded before the rest of the connection.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var info *tls.ClientHelloInfo
+	errPeeked := errors.New("peeked")
+	err := tls.Server(peekConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = chi
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if info == nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrNotClientHello, err)
+	}
+
+	return info.ServerName, hello.Bytes(), nil
+}
+
+// peekConn lets the TLS stack read a ClientHello without answering it.
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c peekConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c peekConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// splice copies between client and backend in both directions until both
+// are done and returns the bytes sent by the client and by the backend. A
+// direction failing, as when either side resets, closes both connections,
+// ending the other direction too.
+func splice(client, backend net.Conn) (in, out int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var err error
+		if in, err = io.Copy(backend, client); err != nil {
+			client.Close()
+			backend.Close()
+			return
+		}
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		var err error
+		if out, err = io.Copy(client, backend); err != nil {
+			client.Close()
+			backend.Close()
+			return
+		}
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	return in, out
+}
+
+// closeWrite signals the end of the stream to conn, closing it entirely if
+// it cannot be half-closed.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// passthroughAddress returns the host and port to dial for server. The port
+// defaults to 443, or 80 for http:// addresses.
+func passthroughAddress(server Server) string {
+	u, err := url.Parse(server.Address())
+	if err != nil || u.Host == "" {
+		return server.Address()
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	return net.JoinHostPort(u.Hostname(), "443")
+}
+
+// finishConnection marks a passthrough connection to server as closed and
+// adds the bytes it transferred to the server's counters.
+func (lb *LoadBalancer) finishConnection(server Server, bytesIn, bytesOut int64) {
+	lb.mu.Lock()
+	c := lb.countersFor(serverName(server))
+	c.inFlight--
+	lb.checkDrainedLocked(serverName(server))
+	c.bytesIn += uint64(bytesIn)
+	c.bytesOut += uint64(bytesOut)
+	lb.mu.Unlock()
+
+	if lb.queue != nil {
+		lb.queue.notify()
+	}
+}
+
+// logConnection writes the access log entry of a passthrough connection.
+func (lb *LoadBalancer) logConnection(conn net.Conn, sni string, server Server, duration time.Duration, in, out int64) {
+	if lb.accessLog == nil || lb.accessLogOff.Load() {
+		return
+	}
+	lb.accessLog.LogAttrs(context.Background(), slog.LevelInfo, "connection",
+		slog.String("remote", conn.RemoteAddr().String()),
+		slog.String("sni", sni),
+		slog.String("backend", serverName(server)),
+		slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+		slog.Int64("bytes_in", in),
+		slog.Int64("bytes_out", out),
+	)
+}
+
+// passthroughStats counts passthrough connections by the SNI rule they
+// matched. Rules rather than the names clients send keep the label values
+// bounded; the access log has the names. By server address it counts the
+// connections open and being dialed, and the dials failed in total and in
+// a row.
+type passthroughStats struct {
+	mu       sync.Mutex
+	rules    map[string]*passthroughCounters
+	rejected uint64
+	servers  map[string]*passthroughServer
+	next     int
+
+	// conns maps the open client connections to their backend connections.
+	conns map[net.Conn]net.Conn
+}
+
+type passthroughCounters struct {
+	connections uint64
+	bytesIn     uint64
+	bytesOut    uint64
+}
+
+type passthroughServer struct {
+	open        int64
+	dialing     int64
+	dialErrors  uint64
+	failedInRow int
+}
+
+func newPassthroughStats() *passthroughStats {
+	return &passthroughStats{
+		rules:   make(map[string]*passthroughCounters),
+		servers: make(map[string]*passthroughServer),
+		conns:   make(map[net.Conn]net.Conn),
+	}
+}
+
+// serverLocked returns the counters of the server with the given name.
+// s.mu must be held.
+func (s *passthroughStats) serverLocked(addr string) *passthroughServer {
+	c := s.servers[addr]
+	if c == nil {
+		c = &passthroughServer{}
+		s.servers[addr] = c
+	}
+
+	return c
+}
+
+// leastConnected returns the candidate not in tried with the fewest
+// connections open or being dialed, breaking ties round-robin, and counts
+// a dial to it, or nil if every candidate was tried.
+func (s *passthroughStats) leastConnected(candidates []Candidate, tried map[Server]bool) Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var least []Server
+	fewest := int64(-1)
+	for _, c := range candidates {
+		if tried[c.Server] {
+			continue
+		}
+		sc := s.serverLocked(serverName(c.Server))
+		switch n := sc.open + sc.dialing; {
+		case fewest < 0 || n < fewest:
+			least, fewest = append(least[:0], c.Server), n
+		case n == fewest:
+			least = append(least, c.Server)
+		}
+	}
+	if len(least) == 0 {
+		return nil
+	}
+	server := least[s.next%len(least)]
+	s.next++
+	s.serverLocked(serverName(server)).dialing++
+
+	return server
+}
+
+// dialing counts a dial to server.
+func (s *passthroughStats) dialing(server Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverLocked(serverName(server)).dialing++
+}
+
+// dialed counts the end of a dial to server, and the connection opened if
+// it succeeded.
+func (s *passthroughStats) dialed(server Server, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.serverLocked(serverName(server))
+	c.dialing--
+	if ok {
+		c.open++
+		c.failedInRow = 0
+		return
+	}
+	c.dialErrors++
+	c.failedInRow++
+}
+
+// failedTimes reports whether n dials to server failed in a row, and if so
+// starts counting again.
+func (s *passthroughStats) failedTimes(server Server, n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.serverLocked(serverName(server))
+	if c.failedInRow < n {
+		return false
+	}
+	c.failedInRow = 0
+
+	return true
+}
+
+// track records the open client connection and its backend connection, so
+// that closeAll can close them.
+func (s *passthroughStats) track(client, backend net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[client] = backend
+}
+
+// closed counts the end of a connection to server from client.
+func (s *passthroughStats) closed(server Server, client net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, client)
+	s.serverLocked(serverName(server)).open--
+}
+
+// closeAll closes every open passthrough connection on both sides. Their
+// handlers count them closed as their splices end.
+func (s *passthroughStats) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client, backend := range s.conns {
+		client.Close()
+		backend.Close()
+	}
+}
+
+func (s *passthroughStats) observe(rule string, in, out int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.rules[rule]
+	if c == nil {
+		c = &passthroughCounters{}
+		s.rules[rule] = c
+	}
+	c.connections++
+	c.bytesIn += uint64(in)
+	c.bytesOut += uint64(out)
+}
+
+func (s *passthroughStats) reject() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected++
+}
+
+// writeMetrics renders the passthrough counters.
+func (s *passthroughStats) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := make([]string, 0, len(s.rules))
+	for rule := range s.rules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	fmt.Fprintln(w, "# HELP lb_passthrough_connections_total Passthrough connections proxied, by SNI rule.")
+	fmt.Fprintln(w, "# TYPE lb_passthrough_connections_total counter")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "lb_passthrough_connections_total{sni=%q} %d\n", rule, s.rules[rule].connections)
+	}
+	fmt.Fprintln(w, "# HELP lb_passthrough_bytes_total Bytes proxied on passthrough connections, by SNI rule and direction.")
+	fmt.Fprintln(w, "# TYPE lb_passthrough_bytes_total counter")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "lb_passthrough_bytes_total{sni=%q,direction=\"in\"} %d\n", rule, s.rules[rule].bytesIn)
+		fmt.Fprintf(w, "lb_passthrough_bytes_total{sni=%q,direction=\"out\"} %d\n", rule, s.rules[rule].bytesOut)
+	}
+	fmt.Fprintln(w, "# HELP lb_passthrough_rejected_total Passthrough connections closed without reaching a server.")
+	fmt.Fprintln(w, "# TYPE lb_passthrough_rejected_total counter")
+	fmt.Fprintf(w, "lb_passthrough_rejected_total %d\n", s.rejected)
+
+	addrs := make([]string, 0, len(s.servers))
+	for addr := range s.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Fprintln(w, "# HELP lb_passthrough_open_connections Passthrough connections open, by server.")
+	fmt.Fprintln(w, "# TYPE lb_passthrough_open_connections gauge")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "lb_passthrough_open_connections{server=%q} %d\n", addr, s.servers[addr].open)
+	}
+	fmt.Fprintln(w, "# HELP lb_passthrough_dial_errors_total Failed passthrough dials, by server.")
+	fmt.Fprintln(w, "# TYPE lb_passthrough_dial_errors_total counter")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "lb_passthrough_dial_errors_total{server=%q} %d\n", addr, s.servers[addr].dialErrors)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startPassthrough serves passthrough for lb on a free port.
+func startPassthrough(t *testing.T, lb *LoadBalancer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go lb.ServePassthrough(ln)
+
+	return ln.Addr().String()
+}
+
+// getThrough requests / over HTTPS from addr, presenting serverName.
+func getThrough(addr, serverName string) (string, error) {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+func TestPassthrough_RoutesBySNI(t *testing.T) {
+	var servers []Server
+	for _, app := range []string{"a", "b"} {
+		backend := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.TLS.ServerName == "" {
+				t.Errorf("Expected the backend to terminate TLS with the client's SNI")
+			}
+			rw.Write([]byte(app + " via " + req.TLS.ServerName))
+		}))
+		t.Cleanup(backend.Close)
+		server, err := newSimpleServer(backend.URL, WithLabels(map[string]string{"app": app}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, servers, WithAccessLog(log), WithPassthrough(Passthrough{
+		Rules: []SNIRule{
+			{Host: "a.example.com", Selector: Selector{{Key: "app", Operator: OpEquals, Values: []string{"a"}}}},
+			{Host: "*.b.example.com", Selector: Selector{{Key: "app", Operator: OpEquals, Values: []string{"b"}}}},
+		},
+		CloseUnmatched: true,
+	}))
+	addr := startPassthrough(t, lb)
+
+	for serverName, want := range map[string]string{
+		"a.example.com":        "a via a.example.com",
+		"x.b.example.com":      "b via x.b.example.com",
+		"A.EXAMPLE.COM":        "a via A.EXAMPLE.COM",
+		"deep.x.b.example.com": "b via deep.x.b.example.com",
+	} {
+		for i := 0; i < 2; i++ {
+			got, err := getThrough(addr, serverName)
+			if err != nil || got != want {
+				t.Errorf("Expected %q for %s, got %q, %v", want, serverName, got, err)
+			}
+		}
+	}
+
+	// Unmatched names and connections without SNI are closed
+	for _, serverName := range []string{"b.example.com", ""} {
+		if _, err := getThrough(addr, serverName); err == nil {
+			t.Errorf("Expected a connection for %q to be closed", serverName)
+		}
+	}
+
+	waitFor(t, "access log", func() bool { return strings.Count(log.String(), "\n") == 8 })
+	if entry := accessLogEntries(t, log)[0]; entry["msg"] != "connection" || entry["bytes_in"].(float64) == 0 || entry["bytes_out"].(float64) == 0 {
+		t.Errorf("Expected a connection entry with the bytes transferred, got %v", entry)
+	}
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`lb_passthrough_connections_total{sni="a.example.com"} 4`,
+		`lb_passthrough_connections_total{sni="*.b.example.com"} 4`,
+		`lb_passthrough_rejected_total 2`,
+	} {
+		if !strings.Contains(metrics.Body.String(), want+"\n") {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+	if stats := lb.Stats(); stats[0].InFlight != 0 || stats[0].Requests != 4 || stats[0].BytesIn == 0 {
+		t.Errorf("Expected the connections in the server counters, got %+v", stats[0])
+	}
+}
+
+// recordingConn keeps a copy of everything written to it.
+type recordingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	return c.Conn.Write(p)
+}
+
+func TestPassthrough_DefaultKeepsBytesIntact(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The ClientHello is the first flight, the client waits for an answer
+		var buf [16 << 10]byte
+		n, _ := conn.Read(buf[:])
+		received <- buf[:n]
+	}()
+	server, err := newSimpleServer("https://" + backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithPassthrough(Passthrough{}))
+	addr := startPassthrough(t, lb)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &recordingConn{Conn: conn}
+	if err := tls.Client(rc, &tls.Config{InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatal("Expected the handshake to fail against a silent backend")
+	}
+	got := <-received
+	if string(got) != string(rc.written) {
+		t.Errorf("Expected the ClientHello to reach the backend intact, got %d bytes of %d", len(got), len(rc.written))
+	}
+	if name, _, err := peekServerName(&replayConn{data: got}); err != nil || name != "" {
+		t.Errorf("Expected a ClientHello without SNI at the backend, got %q, %v", name, err)
+	}
+}
+
+// replayConn serves data to reads.
+type replayConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestPassthrough_NotTLS(t *testing.T) {
+	_, _, err := peekServerName(&replayConn{data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")})
+	if !errors.Is(err, ErrNotClientHello) {
+		t.Errorf("Expected ErrNotClientHello, got %v", err)
+	}
+}
+
+// tcpBackend is a TCP server holding every connection open until the
+// client closes it or the test does.
+type tcpBackend struct {
+	ln    net.Listener
+	conns chan net.Conn
+}
+
+func newTCPBackend(t *testing.T, accepted chan<- *tcpBackend) *tcpBackend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &tcpBackend{ln: ln, conns: make(chan net.Conn, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+			b.conns <- conn
+			accepted <- b
+		}
+	}()
+
+	return b
+}
+
+func (b *tcpBackend) address() string {
+	return "https://" + b.ln.Addr().String()
+}
+
+// openThrough opens a passthrough connection to addr and returns the
+// backend it reached. The client waits for a ServerHello until closed.
+func openThrough(t *testing.T, addr string, accepted <-chan *tcpBackend) (net.Conn, *tcpBackend) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go tls.Client(conn, &tls.Config{ServerName: "app.example.com", InsecureSkipVerify: true}).Handshake()
+	select {
+	case b := <-accepted:
+		return conn, b
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to reach a backend")
+		return nil, nil
+	}
+}
+
+func openConnections(lb *LoadBalancer, addr string) int64 {
+	lb.passthroughStats.mu.Lock()
+	defer lb.passthroughStats.mu.Unlock()
+	return lb.passthroughStats.serverLocked(addr).open
+}
+
+func TestPassthrough_LeastConnections(t *testing.T) {
+	accepted := make(chan *tcpBackend, 16)
+	var backends []*tcpBackend
+	var servers []Server
+	for i := 0; i < 3; i++ {
+		b := newTCPBackend(t, accepted)
+		server, err := newSimpleServer(b.address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends, servers = append(backends, b), append(servers, server)
+	}
+	lb := newTestLoadBalancer(t, servers, WithPassthrough(Passthrough{Balance: passthroughLeastConnections}))
+	addr := startPassthrough(t, lb)
+
+	// Connections held open spread evenly.
+	held := make(map[*tcpBackend]int)
+	for i := 0; i < 6; i++ {
+		_, b := openThrough(t, addr, accepted)
+		held[b]++
+	}
+	for i, b := range backends {
+		if held[b] != 2 || openConnections(lb, b.address()) != 2 {
+			t.Errorf("Expected 2 connections open to backend %d, got %d, counted %d", i, held[b], openConnections(lb, b.address()))
+		}
+	}
+
+	// The third backend resets its connections; new ones go to it until it
+	// catches up.
+	for i := 0; i < 2; i++ {
+		conn := <-backends[2].conns
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	waitFor(t, "the reset connections to be counted closed", func() bool { return openConnections(lb, backends[2].address()) == 0 })
+	for i := 0; i < 2; i++ {
+		if _, b := openThrough(t, addr, accepted); b != backends[2] {
+			t.Errorf("Expected connection %d to go to the least connected backend", i)
+		}
+	}
+
+	// The client closing counts as well.
+	conn, b := openThrough(t, addr, accepted)
+	conn.Close()
+	waitFor(t, "the closed connection to be counted", func() bool { return openConnections(lb, b.address()) == 2 })
+
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	want := fmt.Sprintf("lb_passthrough_open_connections{server=%q} 2\n", backends[0].address())
+	if !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %q", want)
+	}
+
+	// Shutdown closes the connections still open.
+	lb.Close()
+	for i, b := range backends {
+		waitFor(t, fmt.Sprintf("backend %d to have no connections open", i), func() bool { return openConnections(lb, b.address()) == 0 })
+	}
+	if stats := lb.Stats(); stats[0].InFlight != 0 {
+		t.Errorf("Expected no connections in flight after Close, got %+v", stats[0])
+	}
+}
+
+func TestPassthrough_DialFailures(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := newSimpleServer("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	accepted := make(chan *tcpBackend, 16)
+	b := newTCPBackend(t, accepted)
+	live, err := newSimpleServer(b.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{dead, live}, WithPassthrough(Passthrough{
+		Balance:     passthroughLeastConnections,
+		DialRetries: 1,
+		FailAfter:   2,
+	}))
+	addr := startPassthrough(t, lb)
+
+	// The dead server has no connections and is tried first until it is
+	// ejected; each connection is retried on the live one.
+	for i := 0; i < 4; i++ {
+		if _, got := openThrough(t, addr, accepted); got != b {
+			t.Fatalf("Expected connection %d to reach the live backend", i)
+		}
+	}
+	var ejected *ServerStats
+	for _, s := range lb.Stats() {
+		if s.Address == dead.Address() {
+			ejected = &s
+		}
+	}
+	if ejected == nil || ejected.EjectedUntil == nil || ejected.Ejections != 1 {
+		t.Errorf("Expected the dead server to be ejected once, got %+v", ejected)
+	}
+	if n := openConnections(lb, dead.Address()); n != 0 {
+		t.Errorf("Expected no connections open to the dead server, got %d", n)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	want := fmt.Sprintf("lb_passthrough_dial_errors_total{server=%q} 2\n", dead.Address())
+	if !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %q", want)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// pendingRetryMin and pendingRetryMax bound the backoff between lookups
+	// of the hostname of a pending server.
+	pendingRetryMin = time.Second
+	pendingRetryMax = time.Minute
+)
+
+// WithRequired makes ResolveServers fail when the server's hostname does
+// not resolve, instead of holding the server as pending.
+func WithRequired() ServerOption {
+	return func(s *simpleServer) {
+		s.required = true
+	}
+}
+
+func (s *simpleServer) Required() bool {
+	return s.required
+}
+
+// requiredServer is implemented by servers that may have to resolve at
+// startup.
+type requiredServer interface {
+	Required() bool
+}
+
+// PendingStatus reports in ServerStats why a server is pending: its
+// hostname did not resolve Since, Attempts lookups in a row, and the next
+// lookup is at NextAttempt.
+type PendingStatus struct {
+	Reason      string    `json:"reason"`
+	Since       time.Time `json:"since"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// pendingState tracks a server held out of selection until its hostname
+// resolves. It is guarded by lb.mu.
+type pendingState struct {
+	status PendingStatus
+}
+
+// serverHost returns the hostname of server that must be looked up to
+// reach it, or "" for servers addressed by IP.
+func serverHost(server Server) string {
+	u, err := url.Parse(server.Address())
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return host
+}
+
+// hostResolver returns the resolver server hostnames are looked up with.
+func (lb *LoadBalancer) hostResolver() Resolver {
+	if lb.dns != nil {
+		return lb.dns
+	}
+
+	return net.DefaultResolver
+}
+
+// lookupServer looks up the hostname of server, if it has one.
+func (lb *LoadBalancer) lookupServer(ctx context.Context, server Server) error {
+	host := serverHost(server)
+	if host == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultDNSTimeout)
+	defer cancel()
+	if _, err := lb.hostResolver().LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("resolve %s: %w", host, err)
+	}
+
+	return nil
+}
+
+// ResolveServers looks up the hostnames of the servers in the pool, as
+// done once at startup. A server whose hostname does not resolve is held
+// out of selection as pending and looked up again with backoff until it
+// resolves or ctx is done, so that one missing name does not keep the
+// others from serving. It fails for required servers that do not resolve,
+// and when no server resolved unless the pool may be empty.
+func (lb *LoadBalancer) ResolveServers(ctx context.Context) error {
+	lb.mu.Lock()
+	servers := append([]Server(nil), lb.servers...)
+	lb.mu.Unlock()
+
+	lookups := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lookups[i] = lb.lookupServer(ctx, s)
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	resolved := 0
+	for i, s := range servers {
+		err := lookups[i]
+		if err == nil {
+			resolved++
+			continue
+		}
+		if r, ok := s.(requiredServer); ok && r.Required() {
+			errs = append(errs, fmt.Errorf("server %s is required: %w", serverName(s), err))
+			continue
+		}
+		fmt.Printf("warning: server %s is pending: %v\n", serverName(s), err)
+		lb.startPending(ctx, s, err)
+	}
+	if resolved == 0 && len(servers) > 0 && !lb.allowEmpty {
+		errs = append(errs, fmt.Errorf("%w: no server resolved", ErrNoAvailableServers))
+	}
+
+	return errors.Join(errs...)
+}
+
+// startPending holds server out of selection for err and looks its
+// hostname up again in the background until it resolves, the server is
+// removed or ctx is done.
+func (lb *LoadBalancer) startPending(ctx context.Context, server Server, err error) {
+	name := serverName(server)
+	now := lb.now()
+	state := &pendingState{status: PendingStatus{
+		Reason:      err.Error(),
+		Since:       now,
+		Attempts:    1,
+		NextAttempt: now.Add(pendingRetryMin),
+	}}
+	lb.mu.Lock()
+	lb.pending[name] = state
+	lb.mu.Unlock()
+	lb.events.publish(healthEvent(server, false, "pending"))
+
+	go func() {
+		backoff := pendingRetryMin
+		for {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			err := lb.lookupServer(ctx, server)
+
+			lb.mu.Lock()
+			if lb.pending[name] != state {
+				lb.mu.Unlock()
+				return // removed while pending
+			}
+			if err == nil {
+				delete(lb.pending, name)
+				lb.mu.Unlock()
+				fmt.Printf("server %s resolved, leaving pending\n", name)
+				lb.events.publish(healthEvent(server, true, "resolved"))
+				return
+			}
+			backoff = min(2*backoff, pendingRetryMax)
+			state.status.Reason = err.Error()
+			state.status.Attempts++
+			state.status.NextAttempt = lb.now().Add(backoff)
+			lb.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newNamedBackendServer returns a server reaching a test backend through
+// the hostname backend.test, resolved by dns.
+func newNamedBackendServer(t *testing.T, handler http.HandlerFunc, dns *DNSCache, opts ...ServerOption) Server {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	u, _ := url.Parse(backend.URL)
+	server, err := newSimpleServer("http://backend.test:"+u.Port(), append(opts, WithResolver(dns))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestResolveServers_Pending(t *testing.T) {
+	r := &fakeResolver{err: &net.DNSError{Err: "no such host", Name: "backend.test", IsNotFound: true}}
+	dns := newDNSCache(DNSConfig{NegativeTTL: time.Millisecond}, r)
+	named := newNamedBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Backend", "named")
+	}, dns)
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler), named, newBackendServer(t, okHandler)}, WithDNS(dns))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := lb.Subscribe(10)
+	defer events.Close()
+
+	if err := lb.ResolveServers(ctx); err != nil {
+		t.Fatalf("Expected an unresolved server not to fail startup, got %v", err)
+	}
+	pending := lb.Stats()[1].Pending
+	if pending == nil || pending.Attempts != 1 || pending.Reason != "resolve backend.test: lookup backend.test: no such host" {
+		t.Fatalf("Expected the server to be pending with its reason, got %+v", pending)
+	}
+	if e := <-events.C; e.Type != EventHealthChanged || *e.Alive || e.Reason != "pending" {
+		t.Errorf("Expected a pending event, got %+v", e)
+	}
+	for i := 0; i < 6; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code != http.StatusOK || rw.Header().Get("X-Backend") != "ok" {
+			t.Fatalf("Expected the resolved servers to serve, got %d from %q", rw.Code, rw.Header().Get("X-Backend"))
+		}
+	}
+
+	r.set([]string{"127.0.0.1"}, nil)
+	waitFor(t, "the server to resolve", func() bool { return lb.Stats()[1].Pending == nil })
+	if e := <-events.C; e.Type != EventHealthChanged || !*e.Alive || e.Reason != "resolved" {
+		t.Errorf("Expected a resolved event, got %+v", e)
+	}
+	served := map[string]int{}
+	for i := 0; i < 6; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		served[rw.Header().Get("X-Backend")]++
+	}
+	if served["named"] != 2 || served["ok"] != 4 {
+		t.Errorf("Expected the resolved server to join the rotation, got %v", served)
+	}
+}
+
+func TestResolveServers_Required(t *testing.T) {
+	r := &fakeResolver{err: errors.New("server misbehaving")}
+	dns := newDNSCache(DNSConfig{}, r)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	required := newNamedBackendServer(t, okHandler, dns, WithRequired())
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler), required}, WithDNS(dns))
+	if err := lb.ResolveServers(ctx); err == nil {
+		t.Error("Expected a required server that does not resolve to fail startup")
+	}
+
+	// Without any usable server, startup fails unless the pool may be empty
+	lb = newTestLoadBalancer(t, []Server{newNamedBackendServer(t, okHandler, dns)}, WithDNS(dns))
+	if err := lb.ResolveServers(ctx); !errors.Is(err, ErrNoAvailableServers) {
+		t.Errorf("Expected startup to fail without a resolved server, got %v", err)
+	}
+	lb = newTestLoadBalancer(t, []Server{newNamedBackendServer(t, okHandler, dns)}, WithDNS(dns), WithAllowEmpty())
+	if err := lb.ResolveServers(ctx); err != nil {
+		t.Errorf("Expected pools filled by discovery to start, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// WithAllowEmpty permits constructing a load balancer without servers, for
+// pools that are filled at runtime through AddServer.
+func WithAllowEmpty() Option {
+	return func(lb *LoadBalancer) {
+		lb.allowEmpty = true
+	}
+}
+
+// normalizeAddress returns the canonical form of a server address used to
+// detect duplicates: scheme and host lowercased, the default port of the
+// scheme made explicit and trailing slashes trimmed. Addresses that are not
+// URLs are returned unchanged.
+func normalizeAddress(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return scheme + "://" + host + strings.TrimRight(u.Path, "/")
+}
+
+// checkServer enforces the invariants of a single pool member.
+func checkServer(server Server) error {
+	if serverWeight(server) < 0 {
+		return fmt.Errorf("server %q: %w", serverName(server), ErrInvalidWeight)
+	}
+
+	return nil
+}
+
+// checkPool enforces the invariants of a pool: it is non-empty unless
+// allowEmpty is set, every server is valid and no backend or name appears
+// twice.
+func checkPool(servers []Server, allowEmpty bool) error {
+	if len(servers) == 0 && !allowEmpty {
+		return fmt.Errorf("pool default: %w: at least one server is required", ErrPoolEmpty)
+	}
+
+	seen, named := make(map[string]Server, len(servers)), make(map[string]Server, len(servers))
+	for _, s := range servers {
+		if err := checkServer(s); err != nil {
+			return err
+		}
+		key := normalizeAddress(s.Address())
+		if prev, ok := seen[key]; ok {
+			return fmt.Errorf("pool default: %w: %q and %q are the same backend", ErrServerExists, prev.Address(), s.Address())
+		}
+		if prev, ok := named[serverName(s)]; ok {
+			return fmt.Errorf("pool default: %w: %q and %q are both named %q", ErrServerExists, prev.Address(), s.Address(), serverName(s))
+		}
+		seen[key], named[serverName(s)] = s, s
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPool_NormalizeAddress(t *testing.T) {
+	for addr, want := range map[string]string{
+		"http://server1.com":          "http://server1.com:80",
+		"HTTP://Server1.com:80/":      "http://server1.com:80",
+		"https://server1.com/api//":   "https://server1.com:443/api",
+		"http://server1.com:8080":     "http://server1.com:8080",
+		"http://[::1]/":               "http://[::1]:80",
+		"unix:///var/run/server.sock": "unix:///var/run/server.sock",
+	} {
+		if got := normalizeAddress(addr); got != want {
+			t.Errorf("Expected %q to normalize to %q, got %q", addr, want, got)
+		}
+	}
+}
+
+func TestPool_ConstructorInvariants(t *testing.T) {
+	// An empty pool needs an explicit opt-in
+	if _, err := NewLoadBalancer("8000", nil); !errors.Is(err, ErrPoolEmpty) {
+		t.Errorf("Expected ErrPoolEmpty, got %v", err)
+	}
+	if _, err := NewLoadBalancer("8000", nil, WithAllowEmpty()); err != nil {
+		t.Errorf("Expected an empty pool to be allowed, got %v", err)
+	}
+
+	// The same backend spelled differently is a duplicate
+	server1 := &MockServer{addr: "http://server1.com"}
+	server2 := &MockServer{addr: "HTTP://server1.com:80/"}
+	_, err := NewLoadBalancer("8000", []Server{server1, server2})
+	if !errors.Is(err, ErrServerExists) {
+		t.Fatalf("Expected ErrServerExists, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `"http://server1.com"`) || !strings.Contains(err.Error(), `"HTTP://server1.com:80/"`) {
+		t.Errorf("Expected the error to name both entries, got %v", err)
+	}
+
+	// Weights must not be negative
+	negative, _ := newSimpleServer("http://server3.com", WithWeight(-1))
+	if _, err := NewLoadBalancer("8000", []Server{negative}); !errors.Is(err, ErrInvalidWeight) {
+		t.Errorf("Expected ErrInvalidWeight, got %v", err)
+	}
+}
+
+func TestPool_AddServerInvariants(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "https://server1.com"}})
+
+	err := lb.AddServer(&MockServer{addr: "https://SERVER1.com:443"})
+	if !errors.Is(err, ErrServerExists) || !strings.Contains(err.Error(), `"https://server1.com"`) {
+		t.Errorf("Expected a duplicate naming the existing entry, got %v", err)
+	}
+	negative, _ := newSimpleServer("http://server2.com", WithWeight(-1))
+	if err := lb.AddServer(negative); !errors.Is(err, ErrInvalidWeight) {
+		t.Errorf("Expected ErrInvalidWeight, got %v", err)
+	}
+	if n := len(lb.Stats()); n != 1 {
+		t.Errorf("Expected the pool to be unchanged, got %d servers", n)
+	}
+}
+
+func TestPool_ConfigInvariants(t *testing.T) {
+	negative := -1
+	for name, cfg := range map[string]*Config{
+		"empty":     {Port: "8000"},
+		"duplicate": {Port: "8000", Servers: []ServerConfig{{Address: "http://server1.com"}, {Address: "http://server1.com/"}}},
+		"weight":    {Port: "8000", Servers: []ServerConfig{{Address: "http://server1.com", Weight: &negative}}},
+	} {
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected the %s config to be rejected", name)
+		}
+	}
+
+	if _, err := (&Config{Port: "8000", AllowEmptyPool: true}).Build(); err != nil {
+		t.Errorf("Expected allow_empty_pool to permit an empty pool, got %v", err)
+	}
+}
+
+func TestPool_AdminInvariants(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com"}})
+	handler := lb.AdminHandler()
+
+	for body, want := range map[string]int{
+		`{"address": "http://SERVER1.com:80/"}`:           http.StatusConflict,
+		`{"address": "http://server2.com", "weight": -1}`: http.StatusBadRequest,
+		`{"address": "server3.com"}`:                      http.StatusBadRequest,
+	} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/servers", strings.NewReader(body)))
+		if rw.Code != want {
+			t.Errorf("Expected status %d for %s, got %d: %s", want, body, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultProbeAgeIntervals is how many health intervals of the most often
+// probed server the newest probe may be old without Readiness.MaxProbeAge.
+const defaultProbeAgeIntervals = 3
+
+// defaultPool is the name of the pool of the servers of the load balancer.
+const defaultPool = "default"
+
+// poolHealthReport is the body of /lb/pools/{name}/health. Healthy servers
+// are alive, warmed up, outside maintenance and not draining; the others are
+// counted by why they are not. ProbeAgeSeconds is the age of the newest
+// probe, omitted when no server is health checked.
+type poolHealthReport struct {
+	Pool            string   `json:"pool"`
+	Status          string   `json:"status"`
+	Reasons         []string `json:"reasons,omitempty"`
+	Healthy         int      `json:"healthy"`
+	Total           int      `json:"total"`
+	MinHealthy      int      `json:"min_healthy"`
+	BreakersOpen    int      `json:"breakers_open"`
+	Draining        int      `json:"draining"`
+	Maintenance     int      `json:"maintenance"`
+	Warming         int      `json:"warming"`
+	ProbeAgeSeconds *float64 `json:"probe_age_seconds,omitempty"`
+	MaxProbeSeconds float64  `json:"max_probe_age_seconds,omitempty"`
+}
+
+// poolHealthReport evaluates whether the pool can serve traffic from the
+// state the load balancer already holds, without probing any server.
+func (lb *LoadBalancer) poolHealthReport() poolHealthReport {
+	report := poolHealthReport{Pool: defaultPool, Status: "healthy", MinHealthy: lb.readiness.MinHealthy}
+	var newest time.Time
+	var interval time.Duration
+	checked := false
+
+	lb.mu.Lock()
+	now := lb.now()
+	report.Total = len(lb.servers)
+	for _, s := range lb.servers {
+		addr := serverName(s)
+		if hc, ok := s.(healthChecked); ok && hc.healthCheck() != nil {
+			checked = true
+			if interval == 0 || hc.healthInterval() < interval {
+				interval = hc.healthInterval()
+			}
+			if p := hc.LastProbe(); p != nil && p.Time.After(newest) {
+				newest = p.Time
+			}
+		}
+		switch {
+		case lb.flappingLocked(addr) || lb.ejectedLocked(addr, now) || lb.backingOffLocked(addr, now):
+			report.BreakersOpen++
+		case !lb.aliveLocked(s, now):
+		case lb.drainingLocked(addr):
+			report.Draining++
+		default:
+			if _, ok := maintenanceUntil(s, now); ok {
+				report.Maintenance++
+			} else if lb.warming[addr] != nil {
+				report.Warming++
+			} else {
+				report.Healthy++
+			}
+		}
+	}
+	lb.mu.Unlock()
+
+	// Breakers and drains explain a shortfall but do not fail the check on
+	// their own.
+	unhealthy := report.Healthy < report.MinHealthy
+	if unhealthy {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("%d healthy servers, need %d", report.Healthy, report.MinHealthy))
+	}
+	if report.BreakersOpen > 0 {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("%d servers held down by open breakers", report.BreakersOpen))
+	}
+	if report.Draining > 0 {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("%d servers draining", report.Draining))
+	}
+	if checked {
+		maxAge := lb.readiness.MaxProbeAge
+		if maxAge <= 0 {
+			maxAge = defaultProbeAgeIntervals * interval
+		}
+		report.MaxProbeSeconds = maxAge.Seconds()
+		if newest.IsZero() {
+			unhealthy = true
+			report.Reasons = append(report.Reasons, "no probe has completed yet")
+		} else {
+			age := now.Sub(newest).Seconds()
+			report.ProbeAgeSeconds = &age
+			if now.Sub(newest) > maxAge {
+				unhealthy = true
+				report.Reasons = append(report.Reasons, fmt.Sprintf("newest probe is %s old, more than %s", now.Sub(newest).Round(time.Millisecond), maxAge))
+			}
+		}
+	}
+	if unhealthy {
+		report.Status = "unhealthy"
+	}
+
+	return report
+}
+
+// handlePoolHealth reports whether the pool named in the path meets its
+// minimum of healthy servers with fresh probe data, for upstream load
+// balancers and alerting. It is answered from cached state only.
+func (lb *LoadBalancer) handlePoolHealth(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if name != defaultPool {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+		return
+	}
+	report := lb.poolHealthReport()
+	status := http.StatusOK
+	if report.Status != "healthy" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, status, report)
+}
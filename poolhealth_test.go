@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newProbedServer returns a server health checked every interval whose
+// last probe, at t, ended with err.
+func newProbedServer(t *testing.T, addr string, interval time.Duration, at time.Time, err error) *simpleServer {
+	t.Helper()
+	s, e := newSimpleServer(addr, WithHealthCheck(HealthCheck{Path: "/health", Interval: interval}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.setProbe(&ProbeResult{Time: at, Err: err})
+
+	return s
+}
+
+// poolHealth requests the health of the named pool from the admin API and
+// decodes the JSON body.
+func poolHealth(t *testing.T, lb *LoadBalancer, name string) (int, map[string]any) {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/lb/pools/"+name+"/health", nil))
+	var body map[string]any
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid body %q: %v", rw.Body.String(), err)
+	}
+	return rw.Code, body
+}
+
+func TestPoolHealth(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name    string
+		servers func() []Server
+		setup   func(lb *LoadBalancer)
+		status  int
+		healthy float64
+		reason  string
+	}{
+		{
+			name: "healthy",
+			servers: func() []Server {
+				return []Server{
+					newProbedServer(t, "http://server1.com", time.Second, now.Add(-time.Second), nil),
+					newProbedServer(t, "http://server2.com", time.Second, now.Add(-2*time.Second), nil),
+				}
+			},
+			status:  http.StatusOK,
+			healthy: 2,
+		},
+		{
+			name: "below minimum",
+			servers: func() []Server {
+				return []Server{
+					newProbedServer(t, "http://server1.com", time.Second, now.Add(-time.Second), nil),
+					newProbedServer(t, "http://server2.com", time.Second, now.Add(-time.Second), errors.New("refused")),
+					newProbedServer(t, "http://server3.com", time.Second, now.Add(-time.Second), nil),
+				}
+			},
+			setup: func(lb *LoadBalancer) {
+				lb.mu.Lock()
+				lb.countersFor("http://server3.com").ejectedUntil = now.Add(time.Minute)
+				lb.mu.Unlock()
+			},
+			status:  http.StatusServiceUnavailable,
+			healthy: 1,
+			reason:  "1 servers held down by open breakers",
+		},
+		{
+			name: "stale",
+			servers: func() []Server {
+				return []Server{
+					newProbedServer(t, "http://server1.com", time.Second, now.Add(-4*time.Second), nil),
+					newProbedServer(t, "http://server2.com", time.Second, now.Add(-5*time.Second), nil),
+				}
+			},
+			status:  http.StatusServiceUnavailable,
+			healthy: 2,
+			reason:  "newest probe is 4s old, more than 3s",
+		},
+		{
+			name: "never probed",
+			servers: func() []Server {
+				s, _ := newSimpleServer("http://server1.com", WithHealthCheck(HealthCheck{Path: "/health"}))
+				return []Server{s, &MockServer{addr: "http://server2.com", isAlive: true}}
+			},
+			status:  http.StatusServiceUnavailable,
+			healthy: 2,
+			reason:  "no probe has completed yet",
+		},
+		{
+			name: "not health checked",
+			servers: func() []Server {
+				return []Server{&MockServer{addr: "http://server1.com", isAlive: true}, &MockServer{addr: "http://server2.com", isAlive: true}}
+			},
+			status:  http.StatusOK,
+			healthy: 2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, tt.servers(), WithReadiness(Readiness{MinHealthy: 2}))
+			lb.now = func() time.Time { return now }
+			if tt.setup != nil {
+				tt.setup(lb)
+			}
+
+			status, body := poolHealth(t, lb, "default")
+			if status != tt.status || body["healthy"].(float64) != tt.healthy || body["min_healthy"].(float64) != 2 {
+				t.Errorf("Expected %d with %v healthy servers, got %d %v", tt.status, tt.healthy, status, body)
+			}
+			if tt.reason != "" && !strings.Contains(strings.Join(reasons(body), "; "), tt.reason) {
+				t.Errorf("Expected reason %q, got %v", tt.reason, body["reasons"])
+			}
+			if tt.status == http.StatusOK && body["reasons"] != nil {
+				t.Errorf("Expected no reasons, got %v", body["reasons"])
+			}
+		})
+	}
+}
+
+// reasons returns the reasons of a pool health body.
+func reasons(body map[string]any) []string {
+	var list []string
+	for _, r := range body["reasons"].([]any) {
+		list = append(list, r.(string))
+	}
+
+	return list
+}
+
+func TestPoolHealth_Draining(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	if _, err := lb.Drain("http://server2.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := poolHealth(t, lb, "default")
+	if status != http.StatusOK || body["draining"].(float64) != 1 || body["total"].(float64) != 2 || body["healthy"].(float64) != 1 {
+		t.Errorf("Expected the drain counted without failing the check, got %d %v", status, body)
+	}
+	if _, found := body["probe_age_seconds"]; found {
+		t.Errorf("Expected no probe age without health checks, got %v", body)
+	}
+	if status, _ := poolHealth(t, lb, "other"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown pool, got %d", status)
+	}
+}
+
+func TestPoolHealth_MaxProbeAge(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	server := newProbedServer(t, "http://server1.com", time.Second, now.Add(-5*time.Second), nil)
+	lb := newTestLoadBalancer(t, []Server{server}, WithReadiness(Readiness{MinHealthy: 1, MaxProbeAge: 10 * time.Second}))
+	lb.now = func() time.Time { return now }
+
+	if status, body := poolHealth(t, lb, "default"); status != http.StatusOK || body["probe_age_seconds"].(float64) != 5 {
+		t.Errorf("Expected probe data 5s old to be fresh enough, got %d %v", status, body)
+	}
+
+	_, err := (&Config{Port: "0", Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}}, MaxProbeAge: Duration(-time.Second)}).Build()
+	if err == nil || !strings.Contains(err.Error(), "max_probe_age must not be negative") {
+		t.Errorf("Expected a negative age to be rejected, got %v", err)
+	}
+}
+
+func TestPoolHealth_NotOnTrafficListener(t *testing.T) {
+	backend := newBackendServer(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("backend " + req.URL.Path))
+	}))
+	lb := newTestLoadBalancer(t, []Server{backend})
+
+	rw := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/lb/pools/default/health", nil))
+	if rw.Body.String() != "backend /lb/pools/default/health" {
+		t.Errorf("Expected the path to be proxied, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestPoolHealth_ProbesOnLoadBalancerClock(t *testing.T) {
+	backend := newBackendServer(t, okHandler)
+	server, err := newSimpleServer(backend.Address(), WithHealthCheck(HealthCheck{Path: "/", Interval: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithReadiness(Readiness{MinHealthy: 1, MaxProbeAge: 10 * time.Second}))
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	if err := server.Probe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.LastProbe().Time; !got.Equal(now) {
+		t.Errorf("Expected the probe stamped on the load balancer's clock, got %s", got)
+	}
+	now = now.Add(3 * time.Second)
+	if status, body := poolHealth(t, lb, "default"); status != http.StatusOK || body["probe_age_seconds"].(float64) != 3 {
+		t.Errorf("Expected the probe to be 3s old, got %d %v", status, body)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPrewarmPath is probed to open connections unless Prewarm names
+	// another path.
+	defaultPrewarmPath = "/"
+
+	// prewarmInterval is how often RunPrewarm counts the idle connections of
+	// the servers.
+	prewarmInterval = time.Second
+
+	// prewarmTimeout bounds the probes topping up a server's idle
+	// connections.
+	prewarmTimeout = 10 * time.Second
+)
+
+// Prewarm keeps at least MinIdle idle connections open to a server, so that
+// the first request after a quiet period does not pay for the TCP and TLS
+// handshakes. Whenever fewer are idle, MinIdle HEAD requests to Path, "/" by
+// default, are sent at once, each keeping its connection until all have
+// one, so that the missing connections are dialed.
+//
+// The transport only keeps MaxIdleConnsPerHost idle connections, 2 by
+// default, which caps MinIdle. It does not adopt connections it did not
+// dial itself, so connections are always opened by a probe. Servers that are
+// down, draining, warming up or in maintenance are not pre-warmed.
+type Prewarm struct {
+	MinIdle int
+	Path    string
+}
+
+// WithPrewarm keeps idle connections open to the server.
+func WithPrewarm(p Prewarm) ServerOption {
+	return func(s *simpleServer) {
+		if p.Path == "" {
+			p.Path = defaultPrewarmPath
+		}
+		s.prewarm = &p
+	}
+}
+
+// prewarmer is implemented by servers that keep idle connections open.
+type prewarmer interface {
+	Server
+	prewarmConfig() *Prewarm
+	prewarmConnections(ctx context.Context) error
+}
+
+func (s *simpleServer) prewarmConfig() *Prewarm {
+	return s.prewarm
+}
+
+// maxIdleConnsPerHost returns the number of idle connections transport keeps
+// to a host.
+func maxIdleConnsPerHost(transport *http.Transport) int {
+	if transport.MaxIdleConnsPerHost > 0 {
+		return transport.MaxIdleConnsPerHost
+	}
+
+	return http.DefaultMaxIdleConnsPerHost
+}
+
+// prewarmConnections tops up the idle connections to the server. The probes
+// take the idle connections first and dial the rest; holding every
+// connection until all probes have one keeps them from sharing one.
+func (s *simpleServer) prewarmConnections(ctx context.Context) error {
+	floor := min(s.prewarm.MinIdle, maxIdleConnsPerHost(s.transport))
+	if floor <= 0 || s.conns.stats().IdleConnections >= int64(floor) {
+		return nil
+	}
+	u := *s.target()
+	u.Path, u.RawPath, u.RawQuery = s.prewarm.Path, "", ""
+
+	var held sync.WaitGroup
+	held.Add(floor)
+	all := make(chan struct{})
+	go func() {
+		held.Wait()
+		close(all)
+	}()
+	errs := make(chan error, floor)
+	for range floor {
+		go func() {
+			errs <- s.probeConnection(ctx, u.String(), &held, all)
+		}()
+	}
+	var err error
+	for range floor {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// probeConnection sends one pre-warming probe to target. Once it has a
+// connection, it marks it held and waits until every probe has one before
+// writing the request.
+func (s *simpleServer) probeConnection(ctx context.Context, target string, held *sync.WaitGroup, all <-chan struct{}) error {
+	var once sync.Once
+	release := func() { once.Do(held.Done) }
+	defer release()
+
+	gotConn := false
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				s.conns.handshakes.Add(1)
+				if state.DidResume {
+					s.conns.resumed.Add(1)
+				}
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if gotConn {
+				return
+			}
+			gotConn = true
+			s.conns.active.Add(1)
+			if !info.Reused {
+				s.conns.prewarmed.Add(1)
+			}
+			release()
+			select {
+			case <-all:
+			case <-ctx.Done():
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	s.conns.prewarmProbes.Add(1)
+	resp, err := s.transport.RoundTrip((&connAttempt{}).traced(req))
+	if gotConn {
+		defer s.conns.active.Add(-1)
+	}
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.Body.Close()
+}
+
+// RunPrewarm keeps the idle connections of servers with Prewarm topped up
+// until ctx is done. Servers added later are pre-warmed as well.
+func (lb *LoadBalancer) RunPrewarm(ctx context.Context) {
+	ticker := time.NewTicker(prewarmInterval)
+	defer ticker.Stop()
+
+	for {
+		markActive(ctx)
+		lb.prewarmServers(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prewarmServers tops up the idle connections of every selectable server
+// with Prewarm.
+func (lb *LoadBalancer) prewarmServers(ctx context.Context) {
+	lb.mu.Lock()
+	now := lb.now()
+	var due []prewarmer
+	for _, s := range lb.servers {
+		p, ok := s.(prewarmer)
+		if !ok || p.prewarmConfig() == nil {
+			continue
+		}
+		name := serverName(s)
+		if !lb.aliveLocked(s, now) || lb.drainingLocked(name) || lb.warming[name] != nil {
+			continue
+		}
+		if _, ok := maintenanceUntil(s, now); ok {
+			continue
+		}
+		due = append(due, p)
+	}
+	lb.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+			defer cancel()
+			if err := p.prewarmConnections(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("pre-warming connections to %s failed: %v\n", serverName(p), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrewarm_FirstRequestReusesConnection(t *testing.T) {
+	_, server := newTrustedTLSServer(t, WithPrewarm(Prewarm{MinIdle: 2}))
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	lb.prewarmServers(context.Background())
+	stats := server.TransportStats()
+	if stats.ConnectionsOpened != 2 || stats.IdleConnections != 2 || stats.TLSHandshakes != 2 || stats.PrewarmedConnections != 2 {
+		t.Fatalf("Expected 2 pre-warmed idle connections, got %+v", stats)
+	}
+
+	// A quiet period long enough for the idle connections to be closed
+	server.CloseIdleConnections()
+	waitFor(t, "idle connections closed", func() bool { return server.TransportStats().OpenConnections == 0 })
+	lb.prewarmServers(context.Background())
+	if stats := server.TransportStats(); stats.IdleConnections != 2 || stats.ConnectionsOpened != 4 {
+		t.Fatalf("Expected the idle connections re-established, got %+v", stats)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rw.Code)
+	}
+	stats = server.TransportStats()
+	if stats.ConnectionsOpened != 4 || stats.ConnectionsReused != 1 || stats.TLSHandshakes != 4 {
+		t.Errorf("Expected the request to reuse a pre-warmed connection, got %+v", stats)
+	}
+
+	// The pool is still full; no probe is sent
+	probes := stats.PrewarmProbes
+	lb.prewarmServers(context.Background())
+	if got := server.TransportStats().PrewarmProbes; got != probes {
+		t.Errorf("Expected no probes with the idle connections in place, got %d more", got-probes)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	want := `lb_server_connections_prewarmed_total{server="` + server.Address() + `"} 4`
+	if !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s, got:\n%s", want, metrics.Body.String())
+	}
+}
+
+func TestPrewarm_Bounds(t *testing.T) {
+	_, server := newTrustedTLSServer(t, WithPrewarm(Prewarm{MinIdle: 5}))
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	lb.prewarmServers(context.Background())
+	if stats := server.TransportStats(); stats.IdleConnections != http.DefaultMaxIdleConnsPerHost {
+		t.Errorf("Expected the idle connections capped at %d, got %+v", http.DefaultMaxIdleConnsPerHost, stats)
+	}
+}
+
+func TestPrewarm_PausedForUnavailableServers(t *testing.T) {
+	_, downServer := newTrustedTLSServer(t, WithPrewarm(Prewarm{MinIdle: 1}))
+	_, drained := newTrustedTLSServer(t, WithPrewarm(Prewarm{MinIdle: 1}))
+	lb := newTestLoadBalancer(t, []Server{downServer, drained})
+	downServer.SetAlive(false)
+	if _, err := lb.Drain(drained.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	lb.prewarmServers(context.Background())
+	for _, s := range []*simpleServer{downServer, drained} {
+		if stats := s.TransportStats(); stats.PrewarmProbes != 0 {
+			t.Errorf("Expected no pre-warming of %s, got %+v", s.Address(), stats)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ShedPolicy selects which request is rejected when the admission queue is
+// full.
+type ShedPolicy string
+
+const (
+	// ShedNewest rejects the arriving request.
+	ShedNewest ShedPolicy = "newest"
+
+	// ShedOldest rejects the request that has waited longest and admits the
+	// arriving one.
+	ShedOldest ShedPolicy = "oldest"
+)
+
+// QueueConfig bounds the FIFO queue requests wait in while every eligible
+// server is at its concurrency limit.
+type QueueConfig struct {
+	Depth   int
+	MaxWait time.Duration
+	Shed    ShedPolicy
+}
+
+// WithQueue enables the admission queue.
+func WithQueue(cfg QueueConfig) Option {
+	return func(lb *LoadBalancer) {
+		lb.queue = newAdmissionQueue(cfg)
+	}
+}
+
+// admissionQueue is a bounded FIFO of requests waiting for server capacity.
+// Waiters are woken one at a time as requests complete.
+type admissionQueue struct {
+	cfg     QueueConfig
+	mu      sync.Mutex
+	waiters *list.List
+	wait    *histogram
+}
+
+// queueWaiter is a request parked in the queue. ready receives nil when the
+// request should retry selection or an error when it has been shed.
+type queueWaiter struct {
+	ready chan error
+}
+
+func newAdmissionQueue(cfg QueueConfig) *admissionQueue {
+	return &admissionQueue{
+		cfg:     cfg,
+		waiters: list.New(),
+		wait:    newHistogram(defaultLatencyBuckets),
+	}
+}
+
+// Len returns the number of waiting requests.
+func (q *admissionQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.waiters.Len()
+}
+
+// push parks a new waiter, at the front when it is retrying after losing a
+// race for capacity. It applies the shed policy when the queue is full; a
+// retrying waiter already held its place and is never shed, nor does it shed
+// others, even if that briefly takes the queue past its depth.
+func (q *admissionQueue) push(front bool) (*list.Element, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !front && q.waiters.Len() >= q.cfg.Depth {
+		if q.cfg.Shed != ShedOldest || q.waiters.Len() == 0 {
+			return nil, ErrQueueFull
+		}
+		oldest := q.waiters.Remove(q.waiters.Front()).(*queueWaiter)
+		oldest.ready <- ErrQueueFull
+	}
+
+	w := &queueWaiter{ready: make(chan error, 1)}
+	if front {
+		return q.waiters.PushFront(w), nil
+	}
+
+	return q.waiters.PushBack(w), nil
+}
+
+// remove drops a waiter that gave up. It reports false if the waiter had
+// already been woken or shed.
+func (q *admissionQueue) remove(e *list.Element) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for cur := q.waiters.Front(); cur != nil; cur = cur.Next() {
+		if cur == e {
+			q.waiters.Remove(e)
+			return true
+		}
+	}
+
+	return false
+}
+
+// notify wakes the longest waiting request, if any.
+func (q *admissionQueue) notify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if front := q.waiters.Front(); front != nil {
+		q.waiters.Remove(front).(*queueWaiter).ready <- nil
+	}
+}
+
+// waitForServer parks req in the admission queue until a server has capacity,
+// the maximum wait elapses or the client goes away. Requests whose client has
+// already disconnected never reach a backend.
+func (lb *LoadBalancer) waitForServer(req *http.Request) (Server, time.Duration, error) {
+	q := lb.queue
+	start := time.Now()
+	timer := time.NewTimer(q.cfg.MaxWait)
+	defer timer.Stop()
+
+	retry := false
+	for {
+		if err := req.Context().Err(); err != nil {
+			return nil, time.Since(start), ErrClientClosed
+		}
+
+		e, err := q.push(retry)
+		if err != nil {
+			return nil, time.Since(start), err
+		}
+		w := e.Value.(*queueWaiter)
+
+		woken := false
+		select {
+		case err = <-w.ready:
+			woken = true
+		case <-timer.C:
+			err = ErrQueueTimeout
+		case <-req.Context().Done():
+			err = ErrClientClosed
+		}
+		if err != nil {
+			if !woken && !q.remove(e) {
+				// Woken concurrently; pass the wake-up on to the next waiter.
+				if wakeErr := <-w.ready; wakeErr == nil {
+					q.notify()
+				}
+			}
+			return nil, time.Since(start), err
+		}
+
+		if err := req.Context().Err(); err != nil {
+			q.notify()
+			return nil, time.Since(start), ErrClientClosed
+		}
+		server, err := lb.selectServer(req)
+		if !errors.Is(err, ErrServersSaturated) {
+			return server, time.Since(start), err
+		}
+		retry = true
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limitedMockServer accepts one request at a time and blocks each response
+// until a token is sent on release. It records the order requests arrive in.
+type limitedMockServer struct {
+	addr    string
+	release chan struct{}
+
+	mu     sync.Mutex
+	served []string
+}
+
+func (m *limitedMockServer) Address() string    { return m.addr }
+func (m *limitedMockServer) IsAlive() bool      { return true }
+func (m *limitedMockServer) MaxConcurrent() int { return 1 }
+
+func (m *limitedMockServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	m.served = append(m.served, req.Header.Get("X-Seq"))
+	m.mu.Unlock()
+	<-m.release
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (m *limitedMockServer) Served() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.served...)
+}
+
+// startRequest proxies a request tagged with seq in the background.
+func startRequest(lb *LoadBalancer, ctx context.Context, seq string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	req.Header.Set("X-Seq", seq)
+	go func() {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		done <- rw
+	}()
+
+	return done
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newQueuedLoadBalancer(t *testing.T, cfg QueueConfig) (*LoadBalancer, *limitedMockServer) {
+	server := &limitedMockServer{addr: "http://server1.com", release: make(chan struct{})}
+	return newTestLoadBalancer(t, []Server{server}, WithQueue(cfg)), server
+}
+
+func TestQueue_FIFOOrder(t *testing.T) {
+	lb, server := newQueuedLoadBalancer(t, QueueConfig{Depth: 10, MaxWait: 5 * time.Second})
+
+	// Occupy the only slot, then queue three more requests in order
+	var results []<-chan *httptest.ResponseRecorder
+	results = append(results, startRequest(lb, context.Background(), "0"))
+	waitFor(t, "first request in flight", func() bool { return lb.Stats()[0].InFlight == 1 })
+	for i, seq := range []string{"1", "2", "3"} {
+		results = append(results, startRequest(lb, context.Background(), seq))
+		waitFor(t, "request "+seq+" queued", func() bool { return lb.queue.Len() == i+1 })
+	}
+
+	for range results {
+		server.release <- struct{}{}
+	}
+	for _, result := range results {
+		if rw := <-result; rw.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rw.Code)
+		}
+	}
+
+	if got := strings.Join(server.Served(), ","); got != "0,1,2,3" {
+		t.Errorf("Expected requests served in arrival order, got %s", got)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), "lb_queue_wait_seconds_count 3") {
+		t.Errorf("Expected three queue wait observations, got:\n%s", metrics.Body.String())
+	}
+}
+
+func TestQueue_MaxWaitExpiry(t *testing.T) {
+	lb, server := newQueuedLoadBalancer(t, QueueConfig{Depth: 10, MaxWait: 50 * time.Millisecond})
+	log := &syncBuffer{}
+	WithAccessLog(log)(lb)
+
+	first := startRequest(lb, context.Background(), "0")
+	waitFor(t, "first request in flight", func() bool { return lb.Stats()[0].InFlight == 1 })
+
+	start := time.Now()
+	rw := <-startRequest(lb, context.Background(), "1")
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 after max wait, got %d", rw.Code)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected the request to wait at least 50ms, waited %s", waited)
+	}
+
+	server.release <- struct{}{}
+	<-first
+	if served := server.Served(); len(served) != 1 {
+		t.Errorf("Expected only the first request to reach the backend, got %v", served)
+	}
+
+	entries := accessLogEntries(t, log)
+	if wait := entries[0]["queue_wait_ms"].(float64); wait < 50 {
+		t.Errorf("Expected the access log to record the queue wait, got %v", wait)
+	}
+}
+
+func TestQueue_DiscardOnDisconnect(t *testing.T) {
+	lb, server := newQueuedLoadBalancer(t, QueueConfig{Depth: 10, MaxWait: 5 * time.Second})
+
+	first := startRequest(lb, context.Background(), "0")
+	waitFor(t, "first request in flight", func() bool { return lb.Stats()[0].InFlight == 1 })
+
+	// A client that disconnects while queued is discarded
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := startRequest(lb, ctx, "1")
+	waitFor(t, "request queued", func() bool { return lb.queue.Len() == 1 })
+	cancel()
+	if rw := <-queued; rw.Code != statusClientClosedRequest {
+		t.Errorf("Expected status 499 for a disconnected client, got %d", rw.Code)
+	}
+
+	// A client that is already gone never reaches a backend
+	gone, cancelGone := context.WithCancel(context.Background())
+	cancelGone()
+	if rw := <-startRequest(lb, gone, "2"); rw.Code != statusClientClosedRequest {
+		t.Errorf("Expected status 499 for a client already gone, got %d", rw.Code)
+	}
+
+	server.release <- struct{}{}
+	<-first
+	if served := server.Served(); len(served) != 1 || served[0] != "0" {
+		t.Errorf("Expected only the first request to reach the backend, got %v", served)
+	}
+	if lb.queue.Len() != 0 {
+		t.Errorf("Expected the queue to be empty, got %d", lb.queue.Len())
+	}
+}
+
+func TestQueue_ShedPolicies(t *testing.T) {
+	// Shedding the newest rejects the arriving request
+	lb, server := newQueuedLoadBalancer(t, QueueConfig{Depth: 1, MaxWait: 5 * time.Second, Shed: ShedNewest})
+	first := startRequest(lb, context.Background(), "0")
+	waitFor(t, "first request in flight", func() bool { return lb.Stats()[0].InFlight == 1 })
+	queued := startRequest(lb, context.Background(), "1")
+	waitFor(t, "request queued", func() bool { return lb.queue.Len() == 1 })
+	if rw := <-startRequest(lb, context.Background(), "2"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the newest request to be shed with 503, got %d", rw.Code)
+	}
+	server.release <- struct{}{}
+	server.release <- struct{}{}
+	<-first
+	<-queued
+	if got := strings.Join(server.Served(), ","); got != "0,1" {
+		t.Errorf("Expected requests 0 and 1 to be served, got %s", got)
+	}
+
+	// Shedding the oldest rejects the waiting request instead
+	lb, server = newQueuedLoadBalancer(t, QueueConfig{Depth: 1, MaxWait: 5 * time.Second, Shed: ShedOldest})
+	first = startRequest(lb, context.Background(), "0")
+	waitFor(t, "first request in flight", func() bool { return lb.Stats()[0].InFlight == 1 })
+	oldest := startRequest(lb, context.Background(), "1")
+	waitFor(t, "request queued", func() bool { return lb.queue.Len() == 1 })
+	newest := startRequest(lb, context.Background(), "2")
+	if rw := <-oldest; rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the oldest request to be shed with 503, got %d", rw.Code)
+	}
+	server.release <- struct{}{}
+	server.release <- struct{}{}
+	<-first
+	<-newest
+	if got := strings.Join(server.Served(), ","); got != "0,2" {
+		t.Errorf("Expected requests 0 and 2 to be served, got %s", got)
+	}
+}
+
+func TestQueue_RequeuedWaiterIsNotShed(t *testing.T) {
+	for _, shed := range []ShedPolicy{ShedNewest, ShedOldest} {
+		q := newAdmissionQueue(QueueConfig{Depth: 1, MaxWait: time.Second, Shed: shed})
+		e, err := q.push(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		retrying := e.Value.(*queueWaiter)
+
+		// The waiter is woken, but a new arrival takes its place in the queue
+		// before it loses the race for capacity and queues again.
+		q.notify()
+		<-retrying.ready
+		e, err = q.push(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arrived := e.Value.(*queueWaiter)
+		e, err = q.push(true)
+		if err != nil {
+			t.Fatalf("%s: Expected the re-queued waiter to be kept, got %v", shed, err)
+		}
+		retrying = e.Value.(*queueWaiter)
+		if q.Len() != 2 {
+			t.Errorf("%s: Expected both waiters to be queued, got %d", shed, q.Len())
+		}
+
+		q.notify()
+		select {
+		case err := <-retrying.ready:
+			if err != nil {
+				t.Errorf("%s: Expected the re-queued waiter to be woken, got %v", shed, err)
+			}
+		default:
+			t.Errorf("%s: Expected the re-queued waiter to be woken first", shed)
+		}
+		select {
+		case err := <-arrived.ready:
+			t.Errorf("%s: Expected the new arrival to keep waiting, got %v", shed, err)
+		default:
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRampCheckInterval = 10 * time.Second
+	defaultRampMinRequests   = 20
+)
+
+// RampStep sends Percent of the traffic to the target of a ramp for
+// Duration.
+type RampStep struct {
+	Percent  int
+	Duration time.Duration
+}
+
+// RampAction is what a ramp does when the target breaches its guards.
+type RampAction string
+
+const (
+	RampRollback RampAction = "rollback"
+	RampPause    RampAction = "pause"
+)
+
+// Ramp shifts traffic from the servers matching Baseline to those matching
+// Target in Steps, e.g. 5%, 25%, 50% and 100% for an hour each, advancing
+// on schedule while RunRamps runs. Requests that may go to either pool are
+// split: the target receives the share of the step, and the other servers
+// the request may go to, including those in neither pool, the rest. A
+// request whose pool has no server available goes to the other pool.
+//
+// During every step the target is held against the baseline over the
+// requests completed since the step began. It breaches its guards when its
+// error rate exceeds the baseline's by more than MaxErrorRateIncrease, or
+// its p95 latency exceeds the baseline's by more than a factor of
+// MaxLatencyRatio; a zero threshold disables its guard. Both pools are only
+// judged once they completed MinRequests requests, 20 by default; once the
+// baseline receives too little traffic, it is judged by its last reading.
+// On a breach the ramp rolls back, sending all traffic to the baseline, or
+// with OnBreach set to RampPause, holds its step until resumed.
+//
+// The state of the ramp and its decisions are written to StateFile, if
+// set, so that a restarted load balancer carries on where it stopped.
+type Ramp struct {
+	Name     string
+	Baseline Selector
+	Target   Selector
+	Steps    []RampStep
+
+	MaxErrorRateIncrease float64
+	MaxLatencyRatio      float64
+	MinRequests          uint64
+	OnBreach             RampAction
+
+	// CheckInterval is how often the guards are checked and the schedule
+	// is followed, 10s by default.
+	CheckInterval time.Duration
+	StateFile     string
+}
+
+// WithRamp shifts traffic from a baseline pool to a target pool along the
+// steps of r.
+func WithRamp(r Ramp) Option {
+	return func(lb *LoadBalancer) {
+		if r.MinRequests == 0 {
+			r.MinRequests = defaultRampMinRequests
+		}
+		if r.OnBreach == "" {
+			r.OnBreach = RampRollback
+		}
+		if r.CheckInterval <= 0 {
+			r.CheckInterval = defaultRampCheckInterval
+		}
+		lb.ramp = &rampScheduler{plan: r, status: RampStatus{Name: r.Name, State: RampRunning}}
+	}
+}
+
+// validate enforces the invariants of a ramp.
+func (r *Ramp) validate() error {
+	if len(r.Baseline) == 0 || len(r.Target) == 0 {
+		return fmt.Errorf("ramp %q: baseline and target selectors are required", r.Name)
+	}
+	if len(r.Steps) == 0 {
+		return fmt.Errorf("ramp %q: at least one step is required", r.Name)
+	}
+	for i, step := range r.Steps {
+		if step.Percent < 0 || step.Percent > 100 || step.Duration <= 0 {
+			return fmt.Errorf("ramp %q: steps[%d]: percent must be within 0 and 100, and duration positive", r.Name, i)
+		}
+		if i > 0 && step.Percent < r.Steps[i-1].Percent {
+			return fmt.Errorf("ramp %q: steps[%d]: percent must not decrease", r.Name, i)
+		}
+	}
+	if r.MaxErrorRateIncrease < 0 || r.MaxLatencyRatio < 0 {
+		return fmt.Errorf("ramp %q: thresholds must not be negative", r.Name)
+	}
+	if r.OnBreach != RampRollback && r.OnBreach != RampPause {
+		return fmt.Errorf("ramp %q: unknown action %q on breach, want %q or %q", r.Name, r.OnBreach, RampRollback, RampPause)
+	}
+
+	return nil
+}
+
+// RampState is the state of a ramp.
+type RampState string
+
+const (
+	RampRunning    RampState = "running"
+	RampPaused     RampState = "paused"
+	RampCompleted  RampState = "completed"
+	RampRolledBack RampState = "rolled_back"
+	RampAborted    RampState = "aborted"
+)
+
+// RampStatus is the state of a ramp as /admin/ramp reports it and its state
+// file holds. Fallbacks counts the requests of the step that went to the
+// other pool for lack of servers in theirs. Baseline is the last reading of
+// the baseline judged, and Decisions lists every decision taken, oldest
+// first.
+type RampStatus struct {
+	Name        string         `json:"name"`
+	State       RampState      `json:"state"`
+	Step        int            `json:"step"`
+	Percent     int            `json:"percent"`
+	StepStarted time.Time      `json:"step_started"`
+	PausedAt    *time.Time     `json:"paused_at,omitempty"`
+	Fallbacks   uint64         `json:"fallbacks"`
+	Baseline    *RampReading   `json:"baseline,omitempty"`
+	Decisions   []RampDecision `json:"decisions"`
+}
+
+// RampReading is the activity of a pool over the current step.
+type RampReading struct {
+	Requests   uint64  `json:"requests"`
+	ErrorRate  float64 `json:"error_rate"`
+	P95Seconds float64 `json:"p95_seconds"`
+}
+
+// RampDecision is a change of a ramp: Action taken at Step, which sends
+// Percent of the traffic to the target afterwards, with the readings of
+// both pools it was taken on.
+type RampDecision struct {
+	Time     time.Time    `json:"time"`
+	Action   string       `json:"action"`
+	Step     int          `json:"step"`
+	Percent  int          `json:"percent"`
+	Reason   string       `json:"reason,omitempty"`
+	Baseline *RampReading `json:"baseline,omitempty"`
+	Target   *RampReading `json:"target,omitempty"`
+}
+
+// rampSample is a reading of a server's cumulative counters.
+type rampSample struct {
+	labels  map[string]string
+	buckets []float64
+	adaptiveSample
+}
+
+// rampScheduler holds the plan and state of a ramp.
+type rampScheduler struct {
+	mu     sync.Mutex
+	plan   Ramp
+	status RampStatus
+
+	// start holds the counters of every server when the step began; it is
+	// taken again by the first check after a restart or resume.
+	start map[string]rampSample
+
+	// sent and targeted count the requests split in the step, sentTotal
+	// and targetedTotal those split overall.
+	sent, targeted           uint64
+	sentTotal, targetedTotal uint64
+	fallbacksTotal           uint64
+
+	// saveMu orders the writes of the state file.
+	saveMu sync.Mutex
+}
+
+// percentLocked returns the share of the traffic the target receives. r.mu
+// must be held.
+func (r *rampScheduler) percentLocked() int {
+	switch r.status.State {
+	case RampRolledBack, RampAborted:
+		return 0
+	case RampCompleted:
+		return r.plan.Steps[len(r.plan.Steps)-1].Percent
+	default:
+		return r.plan.Steps[r.status.Step].Percent
+	}
+}
+
+// split reports whether the next request goes to the target, spreading
+// the requests of the step evenly so that exactly the share of the step
+// goes to the target.
+func (r *rampScheduler) split() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sent++
+	r.sentTotal++
+	if r.targeted*100 < uint64(r.percentLocked())*r.sent {
+		r.targeted++
+		r.targetedTotal++
+		return true
+	}
+
+	return false
+}
+
+// fellBack counts a request that went to the other pool than the one it
+// was split to. The split itself is not corrected, so that a target
+// returning from an outage is not sent the requests it missed at once.
+func (r *rampScheduler) fellBack() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Fallbacks++
+	r.fallbacksTotal++
+}
+
+// rampCandidates narrows candidates to the pool the ramp sends req to. The
+// target pool are the candidates matching Target, the baseline pool every
+// other candidate, so that servers in neither pool keep their traffic.
+// Requests whose candidates include neither pool are left alone, and those
+// whose pool has no candidate, such as a target ejected as a whole, fall
+// back to the other pool. The pool is chosen once per request, so that
+// retries stay in it.
+func (lb *LoadBalancer) rampCandidates(req *http.Request, candidates []Candidate) []Candidate {
+	r := lb.ramp
+	if r == nil {
+		return candidates
+	}
+	var target, baseline []Candidate
+	ramped := false
+	for _, c := range candidates {
+		labels := serverLabels(c.Server)
+		if r.plan.Target.Matches(labels) {
+			target = append(target, c)
+			ramped = true
+			continue
+		}
+		baseline = append(baseline, c)
+		ramped = ramped || r.plan.Baseline.Matches(labels)
+	}
+	if !ramped {
+		return candidates
+	}
+
+	info := requestInfo(req)
+	toTarget := false
+	if info != nil && info.rampChosen {
+		toTarget = info.rampTarget
+	} else {
+		toTarget = r.split()
+		if info != nil {
+			info.rampTarget, info.rampChosen = toTarget, true
+		}
+	}
+	chosen, other := baseline, target
+	if toTarget {
+		chosen, other = target, baseline
+	}
+	if len(chosen) > 0 {
+		return chosen
+	}
+	if info == nil || !info.rampFellBack {
+		r.fellBack()
+		if info != nil {
+			info.rampFellBack = true
+		}
+	}
+
+	return other
+}
+
+// reading returns the activity of the servers matching selector since the
+// step began.
+func (r *rampScheduler) reading(samples map[string]rampSample, selector Selector) RampReading {
+	var completed, errs uint64
+	var buckets []float64
+	var counts []uint64
+	for name, s := range samples {
+		if !selector.Matches(s.labels) {
+			continue
+		}
+		prev, ok := r.start[name]
+		if !ok || s.completed < prev.completed || s.errors < prev.errors || len(prev.counts) != len(s.counts) {
+			prev = rampSample{adaptiveSample: adaptiveSample{counts: make([]uint64, len(s.counts))}}
+		}
+		if counts == nil {
+			buckets, counts = s.buckets, make([]uint64, len(s.counts))
+		}
+		if len(s.counts) != len(counts) {
+			continue
+		}
+		completed += s.completed - prev.completed
+		errs += s.errors - prev.errors
+		for i := range counts {
+			counts[i] += s.counts[i] - prev.counts[i]
+		}
+	}
+	reading := RampReading{Requests: completed, P95Seconds: quantile(buckets, counts, completed, 0.95)}
+	if completed > 0 {
+		reading.ErrorRate = float64(errs) / float64(completed)
+	}
+
+	return reading
+}
+
+// breach explains how target breaches the guards against baseline, or
+// returns "".
+func (r *rampScheduler) breach(target, baseline RampReading) string {
+	if r.plan.MaxErrorRateIncrease > 0 && target.ErrorRate > baseline.ErrorRate+r.plan.MaxErrorRateIncrease {
+		return fmt.Sprintf("target error rate %.4f exceeds baseline %.4f by more than %g",
+			target.ErrorRate, baseline.ErrorRate, r.plan.MaxErrorRateIncrease)
+	}
+	if r.plan.MaxLatencyRatio > 0 && target.P95Seconds > baseline.P95Seconds*r.plan.MaxLatencyRatio {
+		return fmt.Sprintf("target p95 %.3fs exceeds baseline %.3fs by more than a factor of %g",
+			target.P95Seconds, baseline.P95Seconds, r.plan.MaxLatencyRatio)
+	}
+
+	return ""
+}
+
+// decideLocked records action at now and returns the decision. r.mu must
+// be held.
+func (r *rampScheduler) decideLocked(now time.Time, action, reason string, baseline, target *RampReading) *RampDecision {
+	d := RampDecision{
+		Time:     now,
+		Action:   action,
+		Step:     r.status.Step,
+		Percent:  r.percentLocked(),
+		Reason:   reason,
+		Baseline: baseline,
+		Target:   target,
+	}
+	r.status.Decisions = append(r.status.Decisions, d)
+
+	return &d
+}
+
+// startStepLocked begins the current step at now. r.mu must be held.
+func (r *rampScheduler) startStepLocked(now time.Time, samples map[string]rampSample) {
+	r.status.StepStarted, r.status.Fallbacks = now, 0
+	r.start = samples
+	r.sent, r.targeted = 0, 0
+}
+
+// check judges the target over the step so far and follows the schedule,
+// returning the decision taken, if any.
+func (r *rampScheduler) check(now time.Time, samples map[string]rampSample) *RampDecision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status.StepStarted.IsZero() {
+		r.startStepLocked(now, samples)
+		return r.decideLocked(now, "start", "", nil, nil)
+	}
+	if r.status.State != RampRunning {
+		return nil
+	}
+	if r.start == nil {
+		r.start = samples
+		return nil
+	}
+
+	baseline, target := r.reading(samples, r.plan.Baseline), r.reading(samples, r.plan.Target)
+	if baseline.Requests >= r.plan.MinRequests {
+		r.status.Baseline = &baseline
+	}
+	if judged := r.status.Baseline; judged != nil && target.Requests >= r.plan.MinRequests {
+		if reason := r.breach(target, *judged); reason != "" {
+			judged := *judged
+			if r.plan.OnBreach == RampPause {
+				r.status.State, r.status.PausedAt = RampPaused, &now
+				return r.decideLocked(now, "pause", reason, &judged, &target)
+			}
+			r.status.State = RampRolledBack
+			return r.decideLocked(now, "rollback", reason, &judged, &target)
+		}
+	}
+
+	step := r.plan.Steps[r.status.Step]
+	if now.Sub(r.status.StepStarted) < step.Duration {
+		return nil
+	}
+	if r.status.Step == len(r.plan.Steps)-1 {
+		r.status.State = RampCompleted
+		return r.decideLocked(now, "complete", "", r.status.Baseline, &target)
+	}
+	r.status.Step++
+	r.startStepLocked(now, samples)
+
+	return r.decideLocked(now, "advance", "", r.status.Baseline, &target)
+}
+
+// control applies an operator action at now and returns the decision.
+func (r *rampScheduler) control(now time.Time, action string) (*RampDecision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case action == "pause" && r.status.State == RampRunning:
+		r.status.State, r.status.PausedAt = RampPaused, &now
+	case action == "resume" && r.status.State == RampPaused:
+		// The paused time does not count towards the step, and the target
+		// is judged afresh from the next check.
+		if r.status.PausedAt != nil && !r.status.StepStarted.IsZero() {
+			r.status.StepStarted = r.status.StepStarted.Add(now.Sub(*r.status.PausedAt))
+		}
+		r.status.State, r.status.PausedAt, r.start = RampRunning, nil, nil
+	case action == "abort" && (r.status.State == RampRunning || r.status.State == RampPaused):
+		r.status.State, r.status.PausedAt = RampAborted, nil
+	default:
+		return nil, fmt.Errorf("cannot %s a ramp that is %s", action, r.status.State)
+	}
+
+	return r.decideLocked(now, action, "operator", nil, nil), nil
+}
+
+// snapshot returns the status of the ramp.
+func (r *rampScheduler) snapshot() RampStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Percent = r.percentLocked()
+	status.Decisions = append([]RampDecision(nil), r.status.Decisions...)
+
+	return status
+}
+
+// rampSamples reads the cumulative counters of every server.
+func (lb *LoadBalancer) rampSamples() map[string]rampSample {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	samples := make(map[string]rampSample, len(lb.servers))
+	for _, s := range lb.servers {
+		c := lb.countersFor(serverName(s))
+		state := c.latency.state()
+		samples[serverName(s)] = rampSample{
+			labels:         serverLabels(s),
+			buckets:        state.Buckets,
+			adaptiveSample: adaptiveSample{counts: state.Counts, completed: state.Count, errors: c.errors},
+		}
+	}
+
+	return samples
+}
+
+// applyRampDecision publishes, logs and saves a decision of the ramp.
+func (lb *LoadBalancer) applyRampDecision(d *RampDecision) {
+	r := lb.ramp
+	fmt.Printf("ramp %s: %s at step %d, %d%% to the target", r.plan.Name, d.Action, d.Step, d.Percent)
+	if d.Reason != "" {
+		fmt.Printf(": %s", d.Reason)
+	}
+	fmt.Println()
+	lb.events.publish(Event{Type: EventRampChanged, Time: d.Time, Reason: d.Action, Ramp: d})
+	if err := lb.saveRamp(); err != nil {
+		fmt.Printf("error: save ramp %s: %v\n", r.plan.Name, err)
+	}
+}
+
+// CheckRamp judges the target of the ramp and follows its schedule once.
+func (lb *LoadBalancer) CheckRamp() {
+	if lb.ramp == nil {
+		return
+	}
+	samples := lb.rampSamples()
+	if d := lb.ramp.check(lb.now(), samples); d != nil {
+		lb.applyRampDecision(d)
+	}
+}
+
+// RunRamps checks the ramp every CheckInterval until ctx is done.
+func (lb *LoadBalancer) RunRamps(ctx context.Context) {
+	if lb.ramp == nil {
+		return
+	}
+	ticker := time.NewTicker(lb.ramp.plan.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		lb.CheckRamp()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			markActive(ctx)
+		}
+	}
+}
+
+// saveRamp writes the state of the ramp to its state file, if it has one.
+func (lb *LoadBalancer) saveRamp() error {
+	r := lb.ramp
+	if r.plan.StateFile == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	data, err := json.MarshalIndent(r.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.plan.StateFile, data)
+}
+
+// LoadRamp restores the state of the ramp from its state file. A missing
+// file is not an error, and the state of another ramp, or one with fewer
+// steps, is ignored; the ramp then starts over.
+func (lb *LoadBalancer) LoadRamp() error {
+	if lb.ramp == nil || lb.ramp.plan.StateFile == "" {
+		return nil
+	}
+	r := lb.ramp
+	data, err := os.ReadFile(r.plan.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load ramp: %w", err)
+	}
+	var status RampStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("load ramp: corrupt state file %s: %w", r.plan.StateFile, err)
+	}
+	if status.Name != r.plan.Name || status.Step < 0 || status.Step >= len(r.plan.Steps) {
+		fmt.Printf("ignoring the state of ramp %q in %s\n", status.Name, r.plan.StateFile)
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+	r.start = nil
+	fmt.Printf("restored ramp %s at step %d, %s\n", status.Name, status.Step, status.State)
+
+	return nil
+}
+
+// handleRamp reports the state of the ramp.
+func (lb *LoadBalancer) handleRamp(rw http.ResponseWriter, req *http.Request) {
+	if lb.ramp == nil {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("no ramp is configured"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, lb.ramp.snapshot())
+}
+
+// handleRampControl pauses, resumes or aborts the ramp, as named by the
+// last segment of the path.
+func (lb *LoadBalancer) handleRampControl(rw http.ResponseWriter, req *http.Request) {
+	if lb.ramp == nil {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("no ramp is configured"))
+		return
+	}
+	action := req.PathValue("action")
+	if action != "pause" && action != "resume" && action != "abort" {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("unknown ramp action %q, want pause, resume or abort", action))
+		return
+	}
+	d, err := lb.ramp.control(lb.now(), action)
+	if err != nil {
+		writeJSONError(rw, http.StatusConflict, err)
+		return
+	}
+	lb.applyRampDecision(d)
+	writeJSON(rw, http.StatusOK, lb.ramp.snapshot())
+}
+
+// writeMetrics renders the share of the traffic the target receives, the
+// state of the ramp and the requests split by pool.
+func (r *rampScheduler) writeMetrics(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_ramp_target_percent Share of the traffic the ramp sends to its target.")
+	fmt.Fprintln(w, "# TYPE lb_ramp_target_percent gauge")
+	fmt.Fprintf(w, "lb_ramp_target_percent{ramp=%q} %d\n", r.plan.Name, r.percentLocked())
+	fmt.Fprintln(w, "# HELP lb_ramp_state State of the ramp.")
+	fmt.Fprintln(w, "# TYPE lb_ramp_state gauge")
+	for _, state := range []RampState{RampRunning, RampPaused, RampCompleted, RampRolledBack, RampAborted} {
+		value := 0
+		if r.status.State == state {
+			value = 1
+		}
+		fmt.Fprintf(w, "lb_ramp_state{ramp=%q,state=%q} %d\n", r.plan.Name, state, value)
+	}
+	fmt.Fprintln(w, "# HELP lb_ramp_requests_total Requests the ramp split, by pool.")
+	fmt.Fprintln(w, "# TYPE lb_ramp_requests_total counter")
+	fmt.Fprintf(w, "lb_ramp_requests_total{ramp=%q,pool=\"baseline\"} %d\n", r.plan.Name, r.sentTotal-r.targetedTotal)
+	fmt.Fprintf(w, "lb_ramp_requests_total{ramp=%q,pool=\"target\"} %d\n", r.plan.Name, r.targetedTotal)
+	fmt.Fprintln(w, "# HELP lb_ramp_fallbacks_total Requests the ramp sent to the other pool for lack of servers in theirs.")
+	fmt.Fprintln(w, "# TYPE lb_ramp_fallbacks_total counter")
+	fmt.Fprintf(w, "lb_ramp_fallbacks_total{ramp=%q} %d\n", r.plan.Name, r.fallbacksTotal)
+}
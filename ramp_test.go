@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRampLoadBalancer returns a load balancer with a stable and a canary
+// server, ramping traffic to the canary along r, and its fake clock.
+func newRampLoadBalancer(t *testing.T, r Ramp) (*LoadBalancer, *time.Time) {
+	t.Helper()
+	r.Name = "canary"
+	r.Baseline = Selector{{Key: "track", Operator: OpEquals, Values: []string{"stable"}}}
+	r.Target = Selector{{Key: "track", Operator: OpEquals, Values: []string{"canary"}}}
+	stable := &MockServer{addr: "http://stable.com", isAlive: true, labels: map[string]string{"track": "stable"}}
+	canary := &MockServer{addr: "http://canary.com", isAlive: true, labels: map[string]string{"track": "canary"}}
+	lb := newTestLoadBalancer(t, []Server{stable, canary}, WithRamp(r))
+	now := time.Date(2026, 10, 15, 2, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	return lb, &now
+}
+
+// rampSteps ramps through 5%, 25%, 50% and 100% for a minute each.
+var rampSteps = []RampStep{
+	{Percent: 5, Duration: time.Minute},
+	{Percent: 25, Duration: time.Minute},
+	{Percent: 50, Duration: time.Minute},
+	{Percent: 100, Duration: time.Minute},
+}
+
+// targeted splits n requests and returns how many went to the canary.
+func targeted(t *testing.T, lb *LoadBalancer, n int) int {
+	t.Helper()
+	canary := 0
+	for range n {
+		server, err := lb.selectServer(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serverName(server) == "http://canary.com" {
+			canary++
+		}
+	}
+
+	return canary
+}
+
+// complete records n completed requests of the server named addr, failed
+// of which failed, each taking latency.
+func complete(lb *LoadBalancer, addr string, n, failed int, latency time.Duration) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(addr)
+	for range n {
+		c.latency.Observe(latency)
+	}
+	c.errors += uint64(failed)
+}
+
+func TestRamp_FullRamp(t *testing.T) {
+	lb, now := newRampLoadBalancer(t, Ramp{Steps: rampSteps, MaxErrorRateIncrease: 0.02, MaxLatencyRatio: 1.5})
+	lb.CheckRamp()
+
+	for i, step := range rampSteps {
+		if got := targeted(t, lb, 100); got != step.Percent {
+			t.Fatalf("Step %d: expected %d of 100 requests to the target, got %d", i, step.Percent, got)
+		}
+		// Both pools serve their share about as well.
+		complete(lb, "http://stable.com", 100-step.Percent, (100-step.Percent)/100, 50*time.Millisecond)
+		complete(lb, "http://canary.com", step.Percent, step.Percent/100, 50*time.Millisecond)
+		*now = now.Add(30 * time.Second)
+		lb.CheckRamp()
+		if status := lb.ramp.snapshot(); status.Step != i || status.State != RampRunning {
+			t.Fatalf("Step %d: expected the step to hold halfway, got %+v", i, status)
+		}
+		*now = now.Add(30 * time.Second)
+		lb.CheckRamp()
+	}
+
+	status := lb.ramp.snapshot()
+	if status.State != RampCompleted || status.Percent != 100 {
+		t.Fatalf("Expected the ramp to complete at 100%%, got %+v", status)
+	}
+	var actions []string
+	for _, d := range status.Decisions {
+		actions = append(actions, d.Action)
+	}
+	if got := strings.Join(actions, ","); got != "start,advance,advance,advance,complete" {
+		t.Errorf("Expected the ramp to start, advance three times and complete, got %s", got)
+	}
+	if got := targeted(t, lb, 10); got != 10 {
+		t.Errorf("Expected all traffic on the target once complete, got %d of 10", got)
+	}
+}
+
+func TestRamp_RollbackOnErrors(t *testing.T) {
+	lb, now := newRampLoadBalancer(t, Ramp{Steps: rampSteps, MaxErrorRateIncrease: 0.02})
+	sub := lb.Subscribe(16)
+	defer sub.Close()
+	lb.CheckRamp()
+
+	// The first step passes, the target failing no more than the baseline.
+	complete(lb, "http://stable.com", 95, 1, 50*time.Millisecond)
+	complete(lb, "http://canary.com", 25, 0, 50*time.Millisecond)
+	*now = now.Add(time.Minute)
+	lb.CheckRamp()
+	if got := targeted(t, lb, 100); got != 25 {
+		t.Fatalf("Expected 25 of 100 requests to the target, got %d", got)
+	}
+
+	// A fifth of the target's requests fail during the second step.
+	complete(lb, "http://stable.com", 75, 1, 50*time.Millisecond)
+	complete(lb, "http://canary.com", 25, 5, 50*time.Millisecond)
+	*now = now.Add(20 * time.Second)
+	lb.CheckRamp()
+
+	status := lb.ramp.snapshot()
+	last := status.Decisions[len(status.Decisions)-1]
+	if status.State != RampRolledBack || status.Percent != 0 || last.Action != "rollback" || last.Step != 1 {
+		t.Fatalf("Expected a rollback during the second step, got %+v", status)
+	}
+	if last.Target.ErrorRate != 0.2 || last.Target.Requests != 25 || last.Baseline.Requests != 75 ||
+		!strings.Contains(last.Reason, "error rate") {
+		t.Errorf("Expected the decision to hold the readings of both pools, got %+v", last)
+	}
+	if got := targeted(t, lb, 100); got != 0 {
+		t.Errorf("Expected all traffic back on the baseline, got %d of 100 requests to the target", got)
+	}
+
+	// Rolled back ramps stay rolled back.
+	*now = now.Add(time.Hour)
+	lb.CheckRamp()
+	if status := lb.ramp.snapshot(); status.State != RampRolledBack || len(status.Decisions) != 3 {
+		t.Errorf("Expected the rollback to stick, got %+v", status)
+	}
+	var types []string
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		types = append(types, e.Ramp.Action)
+	}
+	if got := strings.Join(types, ","); got != "start,advance,rollback" {
+		t.Errorf("Expected the decisions to be published, got %s", got)
+	}
+}
+
+func TestRamp_PauseOnLatencyAndOperatorControl(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "ramp.json")
+	lb, now := newRampLoadBalancer(t, Ramp{Steps: rampSteps, MaxLatencyRatio: 2, OnBreach: RampPause, StateFile: state})
+	lb.CheckRamp()
+
+	complete(lb, "http://stable.com", 95, 0, 50*time.Millisecond)
+	complete(lb, "http://canary.com", 25, 0, 500*time.Millisecond)
+	*now = now.Add(10 * time.Second)
+	lb.CheckRamp()
+	status := lb.ramp.snapshot()
+	if status.State != RampPaused || status.Percent != 5 || !strings.Contains(status.Decisions[1].Reason, "p95") {
+		t.Fatalf("Expected the ramp to pause at 5%%, got %+v", status)
+	}
+	// A paused ramp holds its step.
+	*now = now.Add(time.Hour)
+	lb.CheckRamp()
+	if got := targeted(t, lb, 100); got != 5 {
+		t.Errorf("Expected 5 of 100 requests to the target while paused, got %d", got)
+	}
+
+	control := func(action string) (int, RampStatus) {
+		rw := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("POST", "/admin/ramp/"+action, nil))
+		var status RampStatus
+		json.Unmarshal(rw.Body.Bytes(), &status)
+		return rw.Code, status
+	}
+	if code, _ := control("resume"); code != http.StatusOK {
+		t.Fatalf("Expected the ramp to resume, got %d", code)
+	}
+	// The paused hour does not count towards the step.
+	*now = now.Add(30 * time.Second)
+	lb.CheckRamp()
+	if status := lb.ramp.snapshot(); status.State != RampRunning || status.Step != 0 {
+		t.Errorf("Expected the ramp to keep running at its step, got %+v", status)
+	}
+	if code, _ := control("resume"); code != http.StatusConflict {
+		t.Errorf("Expected resuming a running ramp to conflict, got %d", code)
+	}
+	code, status := control("abort")
+	if code != http.StatusOK || status.State != RampAborted || status.Percent != 0 {
+		t.Errorf("Expected the ramp to abort, got %d %+v", code, status)
+	}
+
+	// The state survives a restart.
+	restarted, _ := newRampLoadBalancer(t, Ramp{Steps: rampSteps, StateFile: state})
+	if err := restarted.LoadRamp(); err != nil {
+		t.Fatal(err)
+	}
+	if status := restarted.ramp.snapshot(); status.State != RampAborted || len(status.Decisions) != 4 {
+		t.Errorf("Expected the aborted ramp and its decisions to be restored, got %+v", status)
+	}
+	if got := targeted(t, restarted, 10); got != 0 {
+		t.Errorf("Expected the restored ramp to send nothing to the target, got %d", got)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_ramp_target_percent{ramp="canary"} 0`, `lb_ramp_state{ramp="canary",state="aborted"} 1`, `lb_ramp_requests_total{ramp="canary",pool="target"} 5`} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+}
+
+func TestRamp_Fallback(t *testing.T) {
+	lb, _ := newRampLoadBalancer(t, Ramp{Steps: []RampStep{{Percent: 50, Duration: time.Minute}}})
+	other := &MockServer{addr: "http://other.com", isAlive: true, labels: map[string]string{"app": "search"}}
+	if err := lb.AddServer(other); err != nil {
+		t.Fatal(err)
+	}
+	lb.CheckRamp()
+
+	// Servers in neither pool keep receiving their share of the baseline.
+	counts := make(map[string]int)
+	for range 100 {
+		server, err := lb.selectServer(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[serverName(server)]++
+	}
+	if counts["http://canary.com"] != 50 || counts["http://other.com"] == 0 {
+		t.Errorf("Expected half the requests on the target and the server in neither pool kept, got %v", counts)
+	}
+
+	// Requests that cannot go to either pool are not split.
+	req := httptest.NewRequest("GET", "/", nil)
+	server, err := lb.getNextMatchingServer(req, Selector{{Key: "app", Operator: OpEquals, Values: []string{"search"}}})
+	if err != nil || serverName(server) != "http://other.com" {
+		t.Errorf("Expected the search server, got %v, %v", server, err)
+	}
+
+	// A target ejected as a whole sends its share to the baseline.
+	lb.mu.Lock()
+	lb.countersFor("http://canary.com").ejectedUntil = lb.now().Add(time.Minute)
+	lb.mu.Unlock()
+	if got := targeted(t, lb, 10); got != 0 {
+		t.Errorf("Expected no request on the ejected target, got %d", got)
+	}
+	if status := lb.ramp.snapshot(); status.Fallbacks != 5 {
+		t.Errorf("Expected the 5 requests split to the target to fall back, got %d", status.Fallbacks)
+	}
+}
+
+func TestRampConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ramp RampConfig
+		want string
+	}{
+		{"decreasing", RampConfig{Name: "r", Baseline: "track=stable", Target: "track=canary", Steps: []RampStepConfig{
+			{Percent: 50, Duration: Duration(time.Minute)}, {Percent: 10, Duration: Duration(time.Minute)},
+		}}, "percent must not decrease"},
+		{"no steps", RampConfig{Name: "r", Baseline: "track=stable", Target: "track=canary"}, "at least one step"},
+		{"no target", RampConfig{Name: "r", Baseline: "track=stable", Steps: []RampStepConfig{{Percent: 5, Duration: Duration(time.Minute)}}}, "selectors are required"},
+		{"action", RampConfig{Name: "r", Baseline: "track=stable", Target: "track=canary", OnBreach: "ignore",
+			Steps: []RampStepConfig{{Percent: 5, Duration: Duration(time.Minute)}}}, "unknown action"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := (&Config{Port: "0", Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}}, Ramp: &tt.ramp}).Build()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
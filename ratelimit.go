@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultLocalTTL is how long tokens leased from a shared store may be
+	// spent locally.
+	defaultLocalTTL = 100 * time.Millisecond
+
+	// failClosedWait is the Retry-After of requests denied because the
+	// shared store failed.
+	failClosedWait = time.Second
+)
+
+// RateLimitStore holds rate limit buckets shared by load balancer
+// instances, so that a limit applies to all of them together rather than
+// to each.
+type RateLimitStore interface {
+	// Take takes up to n tokens, at least one, from the bucket of key,
+	// which refills under limit, at now. It returns the number of tokens
+	// taken or, if there was none, the time until one is available.
+	Take(ctx context.Context, key string, limit RateLimit, n int, now time.Time) (int, time.Duration, error)
+}
+
+// SharedRateLimits keeps the rate limits of API keys and tenants in Store
+// instead of in each instance. Buckets are keyed like the local limiters,
+// by API key ID and tenant name. To keep the store off the path of most
+// requests, a request finding a bucket well stocked leases up to a tenth of
+// its burst, which further requests of the instance spend without asking
+// the store for LocalTTL, 100ms by default. Leased tokens left unspent are
+// forfeit, so leases can only make a limit stricter. When the store fails,
+// requests are allowed if FailOpen is set and denied otherwise.
+type SharedRateLimits struct {
+	Store    RateLimitStore
+	FailOpen bool
+	LocalTTL time.Duration
+}
+
+// WithSharedRateLimits shares the rate limits of API keys and tenants with
+// other instances through a store.
+func WithSharedRateLimits(s SharedRateLimits) Option {
+	return func(lb *LoadBalancer) {
+		if s.LocalTTL <= 0 {
+			s.LocalTTL = defaultLocalTTL
+		}
+		lb.sharedLimits = &sharedRateLimiter{config: s, leases: make(map[string]*rateLease)}
+	}
+}
+
+// rateLease is the tokens of a bucket an instance took ahead of need.
+type rateLease struct {
+	tokens  int
+	expires time.Time
+}
+
+// sharedRateLimiter takes tokens from the shared store, spending leased
+// tokens first.
+type sharedRateLimiter struct {
+	config SharedRateLimits
+
+	mu     sync.Mutex
+	leases map[string]*rateLease
+
+	storeCalls  atomic.Uint64
+	localAllows atomic.Uint64
+	failOpen    atomic.Uint64
+	failClosed  atomic.Uint64
+}
+
+// take takes a token for key under limit at now. If none is left it
+// returns the time until one is.
+func (l *sharedRateLimiter) take(ctx context.Context, key string, limit RateLimit, now time.Time) time.Duration {
+	l.mu.Lock()
+	if lease := l.leases[key]; lease != nil && lease.tokens > 0 && now.Before(lease.expires) {
+		lease.tokens--
+		l.mu.Unlock()
+		l.localAllows.Add(1)
+		return 0
+	}
+	l.mu.Unlock()
+
+	want := max(1, int(limit.burst()/10))
+	taken, wait, err := l.config.Store.Take(ctx, key, limit, want, now)
+	l.storeCalls.Add(1)
+	if err != nil {
+		if logger := loggerFromContext(ctx); logger != nil {
+			logger.Warn("rate limit store failed", "key", key, "fail_open", l.config.FailOpen, "error", err)
+		}
+		if l.config.FailOpen {
+			l.failOpen.Add(1)
+			return 0
+		}
+		l.failClosed.Add(1)
+		return failClosedWait
+	}
+	if taken == 0 {
+		return max(wait, time.Nanosecond)
+	}
+	if taken > 1 {
+		l.mu.Lock()
+		l.leases[key] = &rateLease{tokens: taken - 1, expires: now.Add(l.config.LocalTTL)}
+		l.mu.Unlock()
+	}
+
+	return 0
+}
+
+// writeMetrics renders how shared rate limits were decided.
+func (l *sharedRateLimiter) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP lb_rate_limit_store_requests_total Requests to the shared rate limit store.")
+	fmt.Fprintln(w, "# TYPE lb_rate_limit_store_requests_total counter")
+	fmt.Fprintf(w, "lb_rate_limit_store_requests_total %d\n", l.storeCalls.Load())
+	fmt.Fprintln(w, "# HELP lb_rate_limit_local_allows_total Requests allowed with tokens leased from the shared store.")
+	fmt.Fprintln(w, "# TYPE lb_rate_limit_local_allows_total counter")
+	fmt.Fprintf(w, "lb_rate_limit_local_allows_total %d\n", l.localAllows.Load())
+	fmt.Fprintln(w, "# HELP lb_rate_limit_store_failures_total Requests decided without the shared store because it failed, by outcome.")
+	fmt.Fprintln(w, "# TYPE lb_rate_limit_store_failures_total counter")
+	fmt.Fprintf(w, "lb_rate_limit_store_failures_total{outcome=\"allowed\"} %d\n", l.failOpen.Load())
+	fmt.Fprintf(w, "lb_rate_limit_store_failures_total{outcome=\"denied\"} %d\n", l.failClosed.Load())
+}
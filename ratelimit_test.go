@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newSharedLimitBalancer returns a load balancer whose API key "partner",
+// presented as "s3cret", is limited to limit in the Redis server at addr.
+func newSharedLimitBalancer(t *testing.T, addr string, limit RateLimit, failOpen bool, now time.Time) *LoadBalancer {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithAPIKeys(APIKeys{Keys: []APIKey{{ID: "partner", SHA256: HashAPIKey("s3cret"), RateLimit: &limit}}}),
+		WithSharedRateLimits(SharedRateLimits{
+			Store:    NewRedisRateLimitStore(Redis{Addr: addr}),
+			FailOpen: failOpen,
+		}))
+	lb.now = func() time.Time { return now }
+
+	return lb
+}
+
+func TestSharedRateLimits_SharedAcrossInstances(t *testing.T) {
+	redis := miniredis.RunT(t)
+	now := time.Now()
+	limit := RateLimit{PerSecond: 1, Burst: 5}
+	instances := []*LoadBalancer{
+		newSharedLimitBalancer(t, redis.Addr(), limit, false, now),
+		newSharedLimitBalancer(t, redis.Addr(), limit, false, now),
+	}
+
+	allowed := 0
+	for i := range 10 {
+		rw := keyedGet(instances[i%2], "/", "s3cret")
+		switch rw.Code {
+		case http.StatusOK:
+			allowed++
+		case http.StatusTooManyRequests:
+			if rw.Header().Get("Retry-After") != "1" {
+				t.Errorf("Expected a Retry-After of 1s, got %q", rw.Header().Get("Retry-After"))
+			}
+		default:
+			t.Fatalf("Unexpected status %d", rw.Code)
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected the instances to share a burst of 5, got %d allowed", allowed)
+	}
+	if !redis.Exists("lb:ratelimit:api_key:partner") {
+		t.Errorf("Expected the bucket to be keyed by the key ID, got %v", redis.Keys())
+	}
+}
+
+func TestSharedRateLimits_AtomicUnderConcurrency(t *testing.T) {
+	redis := miniredis.RunT(t)
+	now := time.Now()
+	limit := RateLimit{PerSecond: 0.001, Burst: 20}
+
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 4 {
+		store := NewRedisRateLimitStore(Redis{Addr: redis.Addr(), Timeout: 5 * time.Second})
+		t.Cleanup(func() { store.Close() })
+		for range 25 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n, _, err := store.Take(context.Background(), "bucket", limit, 1+i%2, now)
+				if err != nil {
+					t.Error(err)
+				}
+				taken.Add(int64(n))
+			}()
+		}
+	}
+	wg.Wait()
+
+	if n := taken.Load(); n != 20 {
+		t.Errorf("Expected exactly the burst of 20 tokens to be taken, got %d", n)
+	}
+}
+
+func TestSharedRateLimits_LocalLeases(t *testing.T) {
+	redis := miniredis.RunT(t)
+	lb := newSharedLimitBalancer(t, redis.Addr(), RateLimit{PerSecond: 10, Burst: 100}, false, time.Now())
+
+	for range 10 {
+		if rw := keyedGet(lb, "/", "s3cret"); rw.Code != http.StatusOK {
+			t.Fatalf("Expected the request to be allowed, got %d", rw.Code)
+		}
+	}
+	if calls, local := lb.sharedLimits.storeCalls.Load(), lb.sharedLimits.localAllows.Load(); calls != 1 || local != 9 {
+		t.Errorf("Expected one store call leasing tokens for the other 9 requests, got %d and %d", calls, local)
+	}
+}
+
+func TestSharedRateLimits_StoreUnavailable(t *testing.T) {
+	redis := miniredis.RunT(t)
+	addr := redis.Addr()
+	redis.Close()
+	now := time.Now()
+	limit := RateLimit{PerSecond: 1, Burst: 1}
+
+	open := newSharedLimitBalancer(t, addr, limit, true, now)
+	for range 3 {
+		if rw := keyedGet(open, "/", "s3cret"); rw.Code != http.StatusOK {
+			t.Errorf("Expected failing open to allow, got %d", rw.Code)
+		}
+	}
+	closed := newSharedLimitBalancer(t, addr, limit, false, now)
+	if rw := keyedGet(closed, "/", "s3cret"); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected failing closed to deny with a Retry-After, got %d", rw.Code)
+	}
+
+	for lb, line := range map[*LoadBalancer]string{
+		open:   `lb_rate_limit_store_failures_total{outcome="allowed"} 3`,
+		closed: `lb_rate_limit_store_failures_total{outcome="denied"} 1`,
+	} {
+		metrics := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
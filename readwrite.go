@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultReadWriteCookie names the cookie pinning a client's reads to the
+// primaries.
+const defaultReadWriteCookie = "lb_rw_pin"
+
+// ReadWriteSplit sends a route's writes, requests with any method but GET,
+// HEAD, OPTIONS and TRACE, to the servers matching Writes, the primaries,
+// while its reads go to the servers matching the route's Selector, the
+// replicas.
+//
+// Replicas may lag behind the primaries, so that a client reading right
+// after a write misses it. With PinReads, a client's reads go to the
+// primaries for that long after it wrote, reading its own writes. The pin
+// is kept in a cookie, named Cookie or "lb_rw_pin", that expires with it;
+// other clients' reads are not affected.
+type ReadWriteSplit struct {
+	Writes   Selector
+	PinReads time.Duration
+	Cookie   string
+}
+
+// isWrite reports whether method may change state on the server.
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *ReadWriteSplit) cookie() string {
+	if s.Cookie == "" {
+		return defaultReadWriteCookie
+	}
+
+	return s.Cookie
+}
+
+// primary reports whether req goes to the primaries at now: it is a write,
+// or a read of a client pinned to them. Pins expiring further out than
+// PinReads from now were not set by the load balancer and are ignored.
+func (s *ReadWriteSplit) primary(req *http.Request, now time.Time) bool {
+	if isWrite(req.Method) {
+		return true
+	}
+	if s.PinReads <= 0 {
+		return false
+	}
+	c, err := req.Cookie(s.cookie())
+	if err != nil {
+		return false
+	}
+	ms, err := strconv.ParseInt(c.Value, 10, 64)
+	if err != nil {
+		return false
+	}
+	until := time.UnixMilli(ms)
+
+	return now.Before(until) && !until.After(now.Add(s.PinReads))
+}
+
+// pinHook returns the commit hook pinning the reads of the client of req
+// to the primaries, if req is a write on a route with PinReads, or nil. The
+// pin runs from when the response arrives; failed writes leave none.
+func (lb *LoadBalancer) pinHook(req *http.Request) func(status int, header http.Header) {
+	route := lb.matchRoute(req)
+	if route == nil || route.ReadWrite == nil || route.ReadWrite.PinReads <= 0 || !isWrite(req.Method) {
+		return nil
+	}
+	split := route.ReadWrite
+
+	return func(status int, header http.Header) {
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		until := lb.now().Add(split.PinReads)
+		cookie := &http.Cookie{
+			Name:     split.cookie(),
+			Value:    strconv.FormatInt(until.UnixMilli(), 10),
+			Path:     "/",
+			MaxAge:   int((split.PinReads + time.Second - 1) / time.Second),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		header.Add("Set-Cookie", cookie.String())
+	}
+}
+
+// joinCommitHooks returns a commit hook running every hook that is not nil.
+func joinCommitHooks(hooks ...func(int, http.Header)) func(int, http.Header) {
+	var set []func(int, http.Header)
+	for _, h := range hooks {
+		if h != nil {
+			set = append(set, h)
+		}
+	}
+	switch len(set) {
+	case 0:
+		return nil
+	case 1:
+		return set[0]
+	}
+
+	return func(status int, header http.Header) {
+		for _, h := range set {
+			h(status, header)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadWriteSplit_ReadYourWrites(t *testing.T) {
+	var primary, replicas atomic.Int64
+	servers := []Server{
+		newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) { primary.Add(1) },
+			WithLabels(map[string]string{"role": "primary"})),
+	}
+	for i := 0; i < 2; i++ {
+		servers = append(servers, newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) { replicas.Add(1) },
+			WithLabels(map[string]string{"role": "replica"})))
+	}
+	lb := newTestLoadBalancer(t, servers, WithRoutes(Route{
+		Name:       "db",
+		PathPrefix: "/",
+		Selector:   Selector{{Key: "role", Operator: OpEquals, Values: []string{"replica"}}},
+		ReadWrite: &ReadWriteSplit{
+			Writes:   Selector{{Key: "role", Operator: OpEquals, Values: []string{"primary"}}},
+			PinReads: 2 * time.Second,
+		},
+	}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	send := func(method string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/items", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		return rw
+	}
+	expect := func(what string, wantPrimary, wantReplicas int64) {
+		t.Helper()
+		if primary.Load() != wantPrimary || replicas.Load() != wantReplicas {
+			t.Errorf("%s: expected %d primary and %d replica requests, got %d and %d",
+				what, wantPrimary, wantReplicas, primary.Load(), replicas.Load())
+		}
+	}
+
+	rw := send("POST", nil)
+	var pin *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == defaultReadWriteCookie {
+			pin = c
+		}
+	}
+	if pin == nil || pin.MaxAge != 2 {
+		t.Fatalf("Expected the write to set a pin for 2s, got %v", pin)
+	}
+	expect("the write", 1, 0)
+
+	for i := 0; i < 3; i++ {
+		send("GET", pin)
+	}
+	expect("reads of the writing client", 4, 0)
+	for i := 0; i < 4; i++ {
+		send("GET", nil)
+	}
+	expect("reads of other clients", 4, 4)
+
+	now = now.Add(2 * time.Second)
+	send("GET", pin)
+	expect("reads after the pin expired", 4, 5)
+
+	// A pin reaching further out than PinReads was not set by the load
+	// balancer.
+	forged := &http.Cookie{Name: defaultReadWriteCookie, Value: "99999999999999"}
+	send("GET", forged)
+	expect("reads with a forged pin", 4, 6)
+}
+
+func TestReadWriteSplit_FailedWriteLeavesNoPin(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{
+		Name:       "db",
+		PathPrefix: "/",
+		ReadWrite:  &ReadWriteSplit{PinReads: time.Second},
+	}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("DELETE", "/items/1", nil))
+	if cookies := rw.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no pin after a failed write, got %v", cookies)
+	}
+}
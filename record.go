@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRecordMaxBody = 64 << 10
+	defaultRecordQueue   = 1024
+)
+
+// defaultRedactedHeaders are never recorded.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", backendOverrideSecretHeader}
+
+// Recording samples traffic for later replay. SamplePercent of the requests
+// on Routes, or on all requests if Routes is empty, are written to the
+// recording with their headers minus RedactHeaders and the defaults, and up
+// to MaxBody bytes of their body unless their route is Sensitive. MaxBody
+// defaults to 64 KiB; a negative value records no bodies. Records are
+// written off the request path through a queue of QueueSize; records
+// arriving while it is full are dropped and counted.
+type Recording struct {
+	SamplePercent float64
+	Routes        []string
+	RedactHeaders []string
+	MaxBody       int
+	QueueSize     int
+}
+
+// WithRecording records sampled traffic to w as JSON lines.
+func WithRecording(w io.Writer, r Recording) Option {
+	return func(lb *LoadBalancer) {
+		lb.recorder = newRecorder(w, r)
+	}
+}
+
+// recordedExchange is one line of a recording.
+type recordedExchange struct {
+	Time          time.Time        `json:"time"`
+	Route         string           `json:"route,omitempty"`
+	Method        string           `json:"method"`
+	URI           string           `json:"uri"`
+	Host          string           `json:"host"`
+	Header        http.Header      `json:"header"`
+	Body          []byte           `json:"body,omitempty"`
+	BodyTruncated bool             `json:"body_truncated,omitempty"`
+	Response      recordedResponse `json:"response"`
+}
+
+// recordedResponse summarizes the response the client received.
+type recordedResponse struct {
+	Status     int     `json:"status"`
+	Backend    string  `json:"backend,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// recorder writes sampled exchanges to out from a background worker.
+type recorder struct {
+	cfg    Recording
+	out    io.Writer
+	redact []string
+	queue  chan *recordedExchange
+
+	recorded atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+func newRecorder(w io.Writer, cfg Recording) *recorder {
+	if cfg.MaxBody == 0 {
+		cfg.MaxBody = defaultRecordMaxBody
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultRecordQueue
+	}
+	r := &recorder{cfg: cfg, out: w, queue: make(chan *recordedExchange, cfg.QueueSize)}
+	for _, h := range append(slices.Clone(defaultRedactedHeaders), cfg.RedactHeaders...) {
+		r.redact = append(r.redact, http.CanonicalHeaderKey(h))
+	}
+
+	return r
+}
+
+// run writes the queued exchanges until ctx is done.
+func (r *recorder) run(ctx context.Context) {
+	enc := json.NewEncoder(r.out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.queue:
+			markActive(ctx)
+			if err := enc.Encode(e); err != nil {
+				fmt.Printf("error: write recording: %v\n", err)
+				continue
+			}
+			r.recorded.Add(1)
+		}
+	}
+}
+
+// pendingRecord is a sampled request whose response is still outstanding.
+type pendingRecord struct {
+	exchange *recordedExchange
+	body     *captureReader
+}
+
+// startRecording samples req and, if it is to be recorded, captures its
+// headers and starts capturing its body. The request's info keeps the
+// pending record for finishRecording.
+func (lb *LoadBalancer) startRecording(req *http.Request) {
+	r, info := lb.recorder, requestInfo(req)
+	if r == nil || info == nil || rand.Float64()*100 >= r.cfg.SamplePercent {
+		return
+	}
+	route := lb.matchRoute(req)
+	name := ""
+	if route != nil {
+		name = route.Name
+	}
+	if len(r.cfg.Routes) > 0 && !slices.Contains(r.cfg.Routes, name) {
+		return
+	}
+
+	header := req.Header.Clone()
+	for _, h := range r.redact {
+		header.Del(h)
+	}
+	p := &pendingRecord{exchange: &recordedExchange{
+		Time:   time.Now(),
+		Route:  name,
+		Method: req.Method,
+		URI:    req.URL.RequestURI(),
+		Host:   req.Host,
+		Header: header,
+	}}
+	if req.Body != nil && req.Body != http.NoBody && (route == nil || !route.Sensitive) && r.cfg.MaxBody > 0 {
+		p.body = &captureReader{ReadCloser: req.Body, limit: r.cfg.MaxBody}
+		req.Body = p.body
+	}
+	info.record = p
+}
+
+// finishRecording queues the record of a completed request, if it was
+// sampled, dropping it when the queue is full.
+func (lb *LoadBalancer) finishRecording(req *http.Request, cw *countingResponseWriter, duration time.Duration, server Server) {
+	info := requestInfo(req)
+	if info == nil || info.record == nil {
+		return
+	}
+	p := info.record
+	e := p.exchange
+	if p.body != nil {
+		e.Body, e.BodyTruncated = p.body.captured()
+	}
+	e.Response = recordedResponse{
+		Status:     cw.Status(),
+		Bytes:      cw.written.Load(),
+		DurationMS: float64(duration.Microseconds()) / 1000,
+	}
+	if server != nil {
+		e.Response.Backend = serverName(server)
+	}
+
+	select {
+	case lb.recorder.queue <- e:
+	default:
+		lb.recorder.dropped.Add(1)
+	}
+}
+
+// writeMetrics renders the recorder counters.
+func (r *recorder) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP lb_recorder_recorded_total Exchanges written to the traffic recording.")
+	fmt.Fprintln(w, "# TYPE lb_recorder_recorded_total counter")
+	fmt.Fprintf(w, "lb_recorder_recorded_total %d\n", r.recorded.Load())
+	fmt.Fprintln(w, "# HELP lb_recorder_dropped_total Sampled exchanges dropped because the recording queue was full.")
+	fmt.Fprintln(w, "# TYPE lb_recorder_dropped_total counter")
+	fmt.Fprintf(w, "lb_recorder_dropped_total %d\n", r.dropped.Load())
+}
+
+// captureReader keeps a copy of the first limit bytes read from a request
+// body. The transport may still be reading when the response is complete,
+// hence the lock.
+type captureReader struct {
+	io.ReadCloser
+	limit int
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	if room := r.limit - r.buf.Len(); room < n {
+		r.buf.Write(p[:max(room, 0)])
+		r.truncated = true
+	} else {
+		r.buf.Write(p[:n])
+	}
+	r.mu.Unlock()
+
+	return n, err
+}
+
+// captured returns the bytes captured so far and whether the body was
+// longer.
+func (r *captureReader) captured() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return bytes.Clone(r.buf.Bytes()), r.truncated
+}
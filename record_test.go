@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedExchanges decodes every line of a recording.
+func recordedExchanges(t *testing.T, buf *syncBuffer) []recordedExchange {
+	t.Helper()
+	var exchanges []recordedExchange
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e recordedExchange
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Invalid recording line %q: %v", line, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges
+}
+
+func TestRecording_RecordAndReplay(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		switch req.URL.Path {
+		case "/api/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		case "/api/echo", "/login":
+			rw.WriteHeader(http.StatusCreated)
+		}
+	})
+	recording := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithRoutes(
+			Route{Name: "api", PathPrefix: "/api/"},
+			Route{Name: "login", PathPrefix: "/login", Sensitive: true},
+			Route{Name: "other", PathPrefix: "/"},
+		),
+		WithRecording(recording, Recording{SamplePercent: 100, Routes: []string{"api", "login"}, RedactHeaders: []string{"X-Secret"}, MaxBody: 8}))
+
+	send := func(method, path, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("X-Secret", "s3cret")
+		req.Header.Set("X-Keep", "yes")
+		lb.serveProxy(httptest.NewRecorder(), req)
+	}
+	send("GET", "/api/ok?x=1", "")
+	send("GET", "/api/missing", "")
+	send("POST", "/api/echo", "0123456789")
+	send("POST", "/login", "password=hunter2")
+	send("GET", "/other", "")
+	waitFor(t, "recording", func() bool { return strings.Count(recording.String(), "\n") == 4 })
+
+	exchanges := recordedExchanges(t, recording)
+	for _, e := range exchanges {
+		if e.Header.Get("Authorization") != "" || e.Header.Get("X-Secret") != "" || e.Header.Get("X-Keep") != "yes" {
+			t.Errorf("Expected redacted headers for %s, got %v", e.URI, e.Header)
+		}
+	}
+	if e := exchanges[0]; e.Route != "api" || e.URI != "/api/ok?x=1" || e.Response.Status != 200 || e.Response.Backend != server.Address() {
+		t.Errorf("Expected the first exchange recorded with its response, got %+v", e)
+	}
+	if e := exchanges[2]; string(e.Body) != "01234567" || !e.BodyTruncated || e.Response.Status != 201 {
+		t.Errorf("Expected the body capped at 8 bytes, got %q (truncated %v)", e.Body, e.BodyTruncated)
+	}
+	if e := exchanges[3]; e.Route != "login" || e.Body != nil {
+		t.Errorf("Expected no body recorded on a sensitive route, got %q", e.Body)
+	}
+
+	// Replay against a backend that now fails /api/ok
+	var mu sync.Mutex
+	var replayed []string
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		replayed = append(replayed, req.Method+" "+req.URL.RequestURI()+" "+req.Header.Get("X-Keep")+" "+string(body))
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/api/ok":
+			rw.WriteHeader(http.StatusInternalServerError)
+		case "/api/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		default:
+			rw.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer target.Close()
+
+	report, err := replay(context.Background(), strings.NewReader(recording.String()), target.URL, 0, target.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReplayDiff{{Method: "GET", URI: "/api/ok?x=1", Recorded: 200, Got: 500}}
+	if report.Sent != 4 || report.Matched != 3 || len(report.Diffs) != 1 || report.Diffs[0] != want[0] {
+		t.Errorf("Expected one diff in 4 requests, got %+v", report)
+	}
+	if replayed[2] != "POST /api/echo yes 01234567" {
+		t.Errorf("Expected the recorded request to be replayed, got %q", replayed[2])
+	}
+	var out strings.Builder
+	report.write(&out)
+	if !strings.Contains(out.String(), "GET /api/ok?x=1: recorded 200, got 500\n") {
+		t.Errorf("Expected the diff in the report, got %q", out.String())
+	}
+}
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestRecording_DropsWhenQueueFull(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	defer close(w.release)
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}},
+		WithRecording(w, Recording{SamplePercent: 100, QueueSize: 1}))
+
+	for i := 0; i < 5; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected requests to be served while the recording is stuck, got %d", rw.Code)
+		}
+	}
+	// One record is being written, one is queued, the rest are dropped
+	if dropped := lb.recorder.dropped.Load(); dropped < 3 {
+		t.Errorf("Expected at least 3 dropped records, got %d", dropped)
+	}
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), "lb_recorder_dropped_total ") {
+		t.Errorf("Expected the dropped records in metrics")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectMode decides what happens to redirects a server answers with.
+type RedirectMode string
+
+const (
+	// RedirectPass returns redirects to the client unchanged.
+	RedirectPass RedirectMode = "pass"
+
+	// RedirectRewrite rewrites Location headers naming the server that
+	// answered to the host the client addressed.
+	RedirectRewrite RedirectMode = "rewrite"
+
+	// RedirectFollow follows redirects to servers of the pool internally and
+	// returns the final response to the client.
+	RedirectFollow RedirectMode = "follow"
+)
+
+// defaultRedirectHops bounds the redirects followed for a request.
+const defaultRedirectHops = 5
+
+// RedirectPolicy controls the handling of redirects from servers. A Location
+// names a server when its host matches the server's host and any port it
+// has matches the server's port, so the canonical https URL of a server
+// behind http://host:8080 still counts. In follow mode relative Locations
+// stay on the server that answered, Locations naming other alive servers of
+// the pool go to them and all others reach the client. At most MaxHops
+// redirects, 5 by default, are followed; exceeding it or revisiting a URL
+// answers 502. 303 responses, and 301 and 302 responses to POST, are
+// followed with GET; other redirects keep the method and need a replayable
+// body, and reach the client otherwise.
+type RedirectPolicy struct {
+	Mode    RedirectMode
+	MaxHops int
+}
+
+// WithRedirectPolicy sets the redirect policy of requests whose route has
+// none.
+func WithRedirectPolicy(policy RedirectPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.redirects = &policy
+	}
+}
+
+// redirectPolicyFor returns the redirect policy applying to req, or nil.
+func (lb *LoadBalancer) redirectPolicyFor(req *http.Request) *RedirectPolicy {
+	if route := lb.matchRoute(req); route != nil && route.Redirects != nil {
+		return route.Redirects
+	}
+
+	return lb.redirects
+}
+
+// follows reports whether redirects are followed under the policy.
+func (p *RedirectPolicy) follows() bool {
+	return p != nil && p.Mode == RedirectFollow
+}
+
+func (p *RedirectPolicy) maxHops() int {
+	if p.MaxHops <= 0 {
+		return defaultRedirectHops
+	}
+
+	return p.MaxHops
+}
+
+// redirectTarget is a redirect to follow internally.
+type redirectTarget struct {
+	server Server
+	url    *url.URL
+	method string
+}
+
+// redirectHook returns the hook applying the redirect policy of req to the
+// responses of server, or nil when redirects pass through. The hook returns
+// the redirect to follow, if any, after rewriting header as needed.
+func (lb *LoadBalancer) redirectHook(req *http.Request, server Server, replayable bool) func(status int, header http.Header) *redirectTarget {
+	policy := lb.redirectPolicyFor(req)
+	if policy == nil || policy.Mode == "" || policy.Mode == RedirectPass {
+		return nil
+	}
+
+	return func(status int, header http.Header) *redirectTarget {
+		loc, err := url.Parse(header.Get("Location"))
+		if err != nil || header.Get("Location") == "" {
+			return nil
+		}
+		if policy.Mode == RedirectRewrite {
+			if loc.Host != "" && locationNames(loc, server) {
+				loc.Scheme, loc.Host = clientScheme(req), req.Host
+				header.Set("Location", loc.String())
+			}
+			return nil
+		}
+
+		method := req.Method
+		switch status {
+		case http.StatusSeeOther:
+			if method != http.MethodHead {
+				method = http.MethodGet
+			}
+		case http.StatusMovedPermanently, http.StatusFound:
+			if method == http.MethodPost {
+				method = http.MethodGet
+			}
+		case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			if !replayable {
+				return nil
+			}
+		default:
+			return nil
+		}
+
+		target := server
+		if loc.Host != "" {
+			target = lb.serverNamedBy(loc)
+			if target == nil {
+				return nil
+			}
+		}
+
+		return &redirectTarget{server: target, url: req.URL.ResolveReference(loc), method: method}
+	}
+}
+
+// serverNamedBy returns the alive server of the pool that loc names, or nil.
+func (lb *LoadBalancer) serverNamedBy(loc *url.URL) Server {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	now := lb.now()
+	for _, s := range lb.servers {
+		if lb.aliveLocked(s, now) && locationNames(loc, s) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// claimRedirect counts the request following a redirect to server as a
+// request selected for it.
+func (lb *LoadBalancer) claimRedirect(server Server) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(serverName(server))
+	c.requests++
+	c.inFlight++
+}
+
+// locationNames reports whether loc, a URL with a host, names server.
+func locationNames(loc *url.URL, server Server) bool {
+	u, err := url.Parse(server.Address())
+	if err != nil || !strings.EqualFold(loc.Hostname(), u.Hostname()) {
+		return false
+	}
+	if loc.Port() == "" {
+		return true
+	}
+
+	return loc.Port() == portOf(u)
+}
+
+// portOf returns the port of u, defaulting by scheme.
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+
+	return "80"
+}
+
+// redirectedRequest returns the request following redirect r of req.
+func redirectedRequest(req *http.Request, r *redirectTarget) *http.Request {
+	next := req.Clone(req.Context())
+	next.URL.Path, next.URL.RawPath, next.URL.RawQuery = r.url.Path, r.url.RawPath, r.url.RawQuery
+	if r.method != req.Method {
+		next.Method = r.method
+		next.Body, next.ContentLength = http.NoBody, 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+
+	return next
+}
+
+// redirectKey identifies a request of a redirect chain for loop detection.
+func redirectKey(server Server, method string, u *url.URL) string {
+	return method + " " + server.Address() + u.RequestURI()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedirects_Rewrite(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Location", req.URL.Query().Get("to"))
+		rw.WriteHeader(http.StatusMovedPermanently)
+	})
+	backendURL, _ := url.Parse(server.Address())
+	host, port := backendURL.Hostname(), backendURL.Port()
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(
+		Route{Name: "pass", PathPrefix: "/pass"},
+		Route{Name: "rewrite", PathPrefix: "/", Redirects: &RedirectPolicy{Mode: RedirectRewrite}},
+	))
+
+	for _, tt := range []struct {
+		path, location, want string
+	}{
+		{"/", "https://" + host + "/canonical?x=1", "http://lb.example.com/canonical?x=1"},
+		{"/", "http://" + host + ":" + port + "/p", "http://lb.example.com/p"},
+		{"/", "http://" + host + ":1/p", "http://" + host + ":1/p"},
+		{"/", "https://example.com/elsewhere", "https://example.com/elsewhere"},
+		{"/", "/relative", "/relative"},
+		{"/pass", "https://" + host + "/canonical", "https://" + host + "/canonical"},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://lb.example.com"+tt.path+"?to="+url.QueryEscape(tt.location), nil)
+		lb.serveProxy(rw, req)
+		if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != tt.want {
+			t.Errorf("Expected %s to become %s, got %d %s", tt.location, tt.want, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRedirects_Follow(t *testing.T) {
+	var final Server
+	front := WithLabels(map[string]string{"role": "front"})
+	first := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/start":
+			http.Redirect(rw, req, "/next", http.StatusFound)
+		case req.URL.Path == "/next":
+			http.Redirect(rw, req, final.Address()+"/final", http.StatusMovedPermanently)
+		case req.URL.Path == "/form":
+			http.Redirect(rw, req, "/done", http.StatusSeeOther)
+		case req.URL.Path == "/moved":
+			http.Redirect(rw, req, "/echo", http.StatusTemporaryRedirect)
+		case req.URL.Path == "/loop/a":
+			http.Redirect(rw, req, "/loop/b", http.StatusFound)
+		case req.URL.Path == "/loop/b":
+			http.Redirect(rw, req, "/loop/a", http.StatusFound)
+		case strings.HasPrefix(req.URL.Path, "/hop/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/hop/"))
+			http.Redirect(rw, req, "/hop/"+strconv.Itoa(n+1), http.StatusFound)
+		case req.URL.Path == "/external":
+			http.Redirect(rw, req, "https://example.com/", http.StatusFound)
+		case req.URL.Path == "/done":
+			io.WriteString(rw, req.Method+" done")
+		case req.URL.Path == "/echo":
+			body, _ := io.ReadAll(req.Body)
+			io.WriteString(rw, req.Method+" "+string(body))
+		}
+	}, front)
+	final = newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "final "+req.URL.RawQuery)
+	})
+	// The final server is only reached through a redirect
+	lb := newTestLoadBalancer(t, []Server{first, final},
+		WithRoutes(Route{Name: "front", PathPrefix: "/", Selector: Selector{{Key: "role", Operator: OpEquals, Values: []string{"front"}}}}),
+		WithRedirectPolicy(RedirectPolicy{Mode: RedirectFollow, MaxHops: 3}))
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/start", "", http.StatusOK, "final "},
+		{"POST", "/form", "a=1", http.StatusOK, "GET done"},
+		{"POST", "/moved", "payload", http.StatusOK, "POST payload"},
+		{"GET", "/loop/a", "", http.StatusBadGateway, ""},
+		{"GET", "/hop/0", "", http.StatusBadGateway, ""},
+		{"GET", "/external", "", http.StatusFound, ""},
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rw.Code != tt.status || tt.want != "" && rw.Body.String() != tt.want {
+			t.Errorf("Expected %s %s to answer %d %q, got %d %q", tt.method, tt.path, tt.status, tt.want, rw.Code, rw.Body.String())
+		}
+	}
+
+	for _, s := range lb.Stats() {
+		if s.InFlight != 0 {
+			t.Errorf("Expected no requests in flight to %s, got %d", s.Address, s.InFlight)
+		}
+	}
+}
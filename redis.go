@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisKeyPrefix = "lb:ratelimit:"
+	defaultRedisTimeout   = 100 * time.Millisecond
+
+	// redisMaxIdle bounds the idle connections kept to Redis.
+	redisMaxIdle = 8
+)
+
+// Redis locates the Redis server of a RedisRateLimitStore. Keys are
+// prefixed with KeyPrefix, "lb:ratelimit:" by default, and each command
+// must complete within Timeout, 100ms by default.
+type Redis struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+	Timeout   time.Duration
+}
+
+// redisTokenBucket refills and takes from the token bucket at KEYS[1]
+// atomically. ARGV holds the rate per second, the burst, the tokens wanted
+// and the time in microseconds. It returns the tokens taken and, if none,
+// the microseconds until one is available. Fractional tokens are kept as
+// strings, since Redis truncates numbers returned by scripts.
+const redisTokenBucket = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local want = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) / 1e6 * rate)
+  last = now
+end
+local taken = math.min(want, math.floor(tokens))
+local wait = 0
+if taken >= 1 then
+  tokens = tokens - taken
+else
+  taken = 0
+  wait = math.ceil((1 - tokens) / rate * 1e6)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(last))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {taken, wait}
+`
+
+var redisTokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(redisTokenBucket))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisRateLimitStore keeps rate limit buckets in Redis. Each take runs a
+// Lua script, so instances updating the same bucket concurrently never
+// lose updates.
+type RedisRateLimitStore struct {
+	config Redis
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// NewRedisRateLimitStore returns a store keeping buckets in the Redis
+// server r. Connections are made when first needed.
+func NewRedisRateLimitStore(r Redis) *RedisRateLimitStore {
+	if r.KeyPrefix == "" {
+		r.KeyPrefix = defaultRedisKeyPrefix
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = defaultRedisTimeout
+	}
+
+	return &RedisRateLimitStore{config: r}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, n int, now time.Time) (int, time.Duration, error) {
+	args := []string{
+		"1", s.config.KeyPrefix + key,
+		strconv.FormatFloat(limit.PerSecond, 'f', -1, 64),
+		strconv.FormatFloat(limit.burst(), 'f', -1, 64),
+		strconv.Itoa(n),
+		strconv.FormatInt(now.UnixMicro(), 10),
+	}
+	reply, err := s.do(ctx, append([]string{"EVALSHA", redisTokenBucketSHA}, args...)...)
+	var redisErr redisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		reply, err = s.do(ctx, append([]string{"EVAL", redisTokenBucket}, args...)...)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	taken, ok1 := values[0].(int64)
+	wait, ok2 := values[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	return int(taken), time.Duration(wait) * time.Microsecond, nil
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to Redis speaking RESP.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and returns its reply: a string, int64, []any, nil or
+// a redisError. Connections are reused unless they failed.
+func (s *RedisRateLimitStore) do(ctx context.Context, args ...string) (any, error) {
+	deadline := time.Now().Add(s.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn, err := s.conn(ctx, deadline)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	reply, err := conn.roundTrip(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	s.release(conn)
+
+	return reply, err
+}
+
+// conn returns an idle connection or dials a new one.
+func (s *RedisRateLimitStore) conn(ctx context.Context, deadline time.Time) (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+
+	dialer := net.Dialer{Deadline: deadline}
+	c, err := dialer.DialContext(ctx, "tcp", s.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	conn.SetDeadline(deadline)
+	var setup [][]string
+	if s.config.Password != "" {
+		setup = append(setup, []string{"AUTH", s.config.Password})
+	}
+	if s.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.config.DB)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: %s: %w", args[0], err)
+		}
+	}
+
+	return conn, nil
+}
+
+// release returns conn to the idle connections.
+func (s *RedisRateLimitStore) release(conn *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.idle) >= redisMaxIdle {
+		conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// Close closes the idle connections.
+func (s *RedisRateLimitStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.idle {
+		conn.Close()
+	}
+	s.idle = nil
+
+	return nil
+}
+
+func (c *redisConn) roundTrip(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			// Error replies within arrays are returned as values.
+			v, err := c.readReply()
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				v, err = redisErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"net/http"
+)
+
+// weightedRendezvous is weighted rendezvous hashing: every candidate scores
+// the request's key as -weight/ln(h), h being the hash of the key and the
+// server's name mapped onto (0, 1), and the highest score wins. Keys are
+// spread in proportion to the weights, and a key only moves when its server
+// leaves or another server's score overtakes it, so removing a server moves
+// only its keys and doubling a weight moves only the share of keys the
+// server gains. Servers with weight 0 only get keys when no weighted server
+// is a candidate.
+type weightedRendezvous struct {
+	name    string
+	extract KeyExtractor
+}
+
+// WeightedRendezvousStrategy returns a weighted rendezvous hash strategy
+// named name over the key extract derives from each request.
+func WeightedRendezvousStrategy(name string, extract KeyExtractor) Strategy {
+	return &weightedRendezvous{name: name, extract: extract}
+}
+
+func (s *weightedRendezvous) Name() string {
+	return s.name
+}
+
+func (s *weightedRendezvous) Select(req *http.Request, candidates []Candidate) (Server, error) {
+	if req == nil {
+		return nil, ErrStrategyPass
+	}
+	key, ok := s.extract(req)
+	if !ok {
+		return nil, ErrStrategyPass
+	}
+
+	return rendezvousCandidate(key, candidates), nil
+}
+
+func (s *weightedRendezvous) affinityKey(req *http.Request) (string, bool) {
+	return s.extract(req)
+}
+
+// rendezvousCandidate picks the candidate with the highest weighted score
+// for key. Unweighted candidates score as weight 1 when no candidate is
+// weighted.
+func rendezvousCandidate(key string, candidates []Candidate) Server {
+	weighted := false
+	for _, c := range candidates {
+		if c.Weight > 0 {
+			weighted = true
+			break
+		}
+	}
+
+	var best Server
+	bestScore := math.Inf(-1)
+	for _, c := range candidates {
+		weight := float64(c.Weight)
+		if !weighted {
+			weight = 1
+		}
+		if weight <= 0 {
+			continue
+		}
+		if score := -weight / math.Log(unitHash(key+"\x00"+serverName(c.Server))); score > bestScore {
+			best, bestScore = c.Server, score
+		}
+	}
+
+	return best
+}
+
+// unitHash maps s onto the open interval (0, 1).
+func unitHash(s string) float64 {
+	return (float64(hashKey(s)>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWeightedRendezvous_Distribution(t *testing.T) {
+	strategy, err := newStrategy("weighted-rendezvous:header:X-Tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := make([]Candidate, 4)
+	for i := range candidates {
+		candidates[i] = Candidate{Server: &MockServer{addr: fmt.Sprintf("http://server%d.com", i+1)}, Weight: i + 1}
+	}
+	selectFor := func(tenant string, candidates []Candidate) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		server, err := strategy.Select(req, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server.Address()
+	}
+
+	const keys = 20000
+	before := make(map[string]string, keys)
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		before[tenant] = selectFor(tenant, candidates)
+		counts[before[tenant]]++
+	}
+	for _, c := range candidates {
+		want := float64(keys) * float64(c.Weight) / 10
+		if got := float64(counts[c.Server.Address()]); math.Abs(got-want) > want*0.1 {
+			t.Errorf("Expected about %.0f keys on %s, got %.0f", want, c.Server.Address(), got)
+		}
+	}
+
+	for tenant, want := range before {
+		if got := selectFor(tenant, candidates); got != want {
+			t.Fatalf("Expected %s to stay on %s, got %s", tenant, want, got)
+		}
+	}
+
+	// Doubling the weight of server1 moves keys only onto it, about the
+	// share it gains: from 1/10 to 2/11 of the keys
+	doubled := append([]Candidate(nil), candidates...)
+	doubled[0].Weight = 2
+	moved := 0
+	for tenant, was := range before {
+		got := selectFor(tenant, doubled)
+		if got == was {
+			continue
+		}
+		moved++
+		if got != "http://server1.com" {
+			t.Fatalf("Expected %s to stay on %s or move to server1, got %s", tenant, was, got)
+		}
+	}
+	if share := float64(moved) / keys; share < 0.06 || share > 0.1 {
+		t.Errorf("Expected about 8%% of the keys to move, got %.1f%%", share*100)
+	}
+
+	// Removing a server moves only its keys
+	remaining := candidates[:3]
+	for tenant, was := range before {
+		if got := selectFor(tenant, remaining); was != "http://server4.com" && got != was {
+			t.Fatalf("Expected %s to stay on %s after removing server4, got %s", tenant, was, got)
+		}
+	}
+}
+
+func TestWeightedRendezvous_Unweighted(t *testing.T) {
+	strategy := WeightedRendezvousStrategy("weighted-rendezvous", HeaderKey("X-Tenant"))
+	backup := &MockServer{addr: "http://backup.com"}
+	primary := &MockServer{addr: "http://primary.com"}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	if _, err := strategy.Select(req, []Candidate{{Server: primary, Weight: 1}}); err != ErrStrategyPass {
+		t.Errorf("Expected requests without a key to pass, got %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		req.Header.Set("X-Tenant", fmt.Sprintf("tenant-%d", i))
+		if got, _ := strategy.Select(req, []Candidate{{Server: backup}, {Server: primary, Weight: 1}}); got != primary {
+			t.Fatalf("Expected the weighted server to take every key, got %s", got.Address())
+		}
+		if got, _ := strategy.Select(req, []Candidate{{Server: backup}}); got != backup {
+			t.Fatalf("Expected unweighted servers to take keys alone, got %v", got)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ReplayReport summarizes a replay. Diffs lists the requests whose status
+// differs from the recorded one, or that failed outright.
+type ReplayReport struct {
+	Sent    int
+	Matched int
+	Diffs   []ReplayDiff
+}
+
+// ReplayDiff is a replayed request whose outcome differs from the recording.
+// Got is 0 and Err set when no response was received.
+type ReplayDiff struct {
+	Method   string
+	URI      string
+	Recorded int
+	Got      int
+	Err      string
+}
+
+// write renders the report for the replay subcommand.
+func (r ReplayReport) write(w io.Writer) {
+	fmt.Fprintf(w, "replayed %d requests: %d matched, %d differed\n", r.Sent, r.Matched, len(r.Diffs))
+	for _, d := range r.Diffs {
+		if d.Err != "" {
+			fmt.Fprintf(w, "%s %s: recorded %d, got error: %s\n", d.Method, d.URI, d.Recorded, d.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s: recorded %d, got %d\n", d.Method, d.URI, d.Recorded, d.Got)
+	}
+}
+
+// replay sends the exchanges recorded in r to target, at most rate per
+// second or as fast as possible if rate is 0, and compares the statuses.
+func replay(ctx context.Context, r io.Reader, target string, rate float64, client *http.Client) (ReplayReport, error) {
+	var report ReplayReport
+	base, err := url.Parse(target)
+	if err != nil {
+		return report, fmt.Errorf("replay: %w", err)
+	}
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return report, fmt.Errorf("replay: line %d: %w", line, err)
+		}
+		if tick != nil && report.Sent > 0 {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-tick:
+			}
+		}
+
+		report.Sent++
+		got, err := replayExchange(ctx, client, base, &e)
+		switch {
+		case err != nil:
+			report.Diffs = append(report.Diffs, ReplayDiff{Method: e.Method, URI: e.URI, Recorded: e.Response.Status, Err: err.Error()})
+		case got != e.Response.Status:
+			report.Diffs = append(report.Diffs, ReplayDiff{Method: e.Method, URI: e.URI, Recorded: e.Response.Status, Got: got})
+		default:
+			report.Matched++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("replay: %w", err)
+	}
+
+	return report, nil
+}
+
+// replayExchange sends the request of e to base and returns the status.
+func replayExchange(ctx context.Context, client *http.Client, base *url.URL, e *recordedExchange) (int, error) {
+	u, err := base.Parse(e.URI)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, e.Method, u.String(), bytes.NewReader(e.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = e.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// runReplay implements the replay subcommand. It exits non-zero when any
+// replayed status differs from the recording.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "base URL to replay the recording against")
+	rate := fs.Float64("rate", 0, "requests per second, 0 for as fast as possible")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: load-balancer replay -target URL [-rate N] RECORDING")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *target == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	report, err := replay(context.Background(), f, *target, *rate, http.DefaultClient)
+	report.write(os.Stdout)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return 1
+	}
+	if len(report.Diffs) > 0 {
+		return 1
+	}
+
+	return 0
+}
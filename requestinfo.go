@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// RequestInfo is what the load balancer learns about a request while
+// handling it: who the client is, the route it matched, its tenant and
+// API key, the backend selected and every upstream attempt. Features share
+// it instead of deriving the same facts each on their own.
+//
+// It is filled in by the goroutine handling the request. Middleware may
+// read it from that goroutine or, having called WithRequestInfo before
+// passing the request on, after the handler returned.
+type RequestInfo struct {
+	requestID string
+
+	// clientIP is parsed from remoteAddr, if clientParsed.
+	clientIP     netip.Addr
+	remoteAddr   string
+	clientParsed bool
+
+	location GeoLocation
+	located  bool
+
+	// route is the route matched by routePath, if routed.
+	route     *Route
+	routePath string
+	routed    bool
+
+	apiKey     *APIKey
+	tenant     *tenantState
+	pathParams map[string]string
+
+	// strategy is the strategy that selected backend for decidedReq.
+	strategy   Strategy
+	decidedReq *http.Request
+	backend    Server
+	attempts   []attemptRecord
+
+	// rampTarget tells whether the ramp split the request to its target,
+	// if rampChosen; rampFellBack that it went to the other pool.
+	rampTarget   bool
+	rampChosen   bool
+	rampFellBack bool
+
+	// attempted, explanation and record are set when the features
+	// tracking them are in use for the request.
+	attempted   *attemptedServers
+	explanation *Explanation
+	record      *pendingRecord
+}
+
+type requestInfoKey struct{}
+
+// AttemptInfo is an upstream attempt of a request.
+type AttemptInfo struct {
+	Backend  string
+	Status   int
+	Class    ErrorClass
+	Duration time.Duration
+	TTFB     time.Duration
+}
+
+// WithRequestInfo returns req carrying a RequestInfo, and that info. A
+// request already carrying one is returned as is, so that middleware in
+// front of Handler sees what the load balancer fills in.
+func WithRequestInfo(req *http.Request) (*http.Request, *RequestInfo) {
+	if info := RequestInfoFrom(req.Context()); info != nil {
+		return req, info
+	}
+	info := &RequestInfo{requestID: req.Header.Get(requestIDHeader)}
+
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info)), info
+}
+
+// RequestInfoFrom returns the RequestInfo of the request ctx belongs to,
+// or nil.
+func RequestInfoFrom(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// requestInfo returns the RequestInfo of req, or nil.
+func requestInfo(req *http.Request) *RequestInfo {
+	if req == nil {
+		return nil
+	}
+
+	return RequestInfoFrom(req.Context())
+}
+
+// RequestID returns the ID of the request: its X-Request-ID or, if it had
+// none, the one an error page made up.
+func (i *RequestInfo) RequestID() string {
+	if i == nil {
+		return ""
+	}
+
+	return i.requestID
+}
+
+// ClientIP returns the address the request came from, if it is an IP
+// address.
+func (i *RequestInfo) ClientIP() (netip.Addr, bool) {
+	if i == nil || !i.clientParsed {
+		return netip.Addr{}, false
+	}
+
+	return i.clientIP, i.clientIP.IsValid()
+}
+
+// Country returns the country of the client, if GeoIP located it.
+func (i *RequestInfo) Country() string {
+	if i == nil {
+		return ""
+	}
+
+	return i.location.Country
+}
+
+// Route returns the name of the route the request matched, if any.
+func (i *RequestInfo) Route() (string, bool) {
+	if i == nil || i.route == nil {
+		return "", false
+	}
+
+	return i.route.Name, true
+}
+
+// PathParam returns the value of the named parameter the pattern of the
+// route captured from the path.
+func (i *RequestInfo) PathParam(name string) (string, bool) {
+	if i == nil {
+		return "", false
+	}
+	value, ok := i.pathParams[name]
+
+	return value, ok
+}
+
+// Tenant returns the name of the tenant of the request, if any.
+func (i *RequestInfo) Tenant() string {
+	if i == nil || i.tenant == nil {
+		return ""
+	}
+
+	return i.tenant.tenant.Name
+}
+
+// APIKey returns the ID of the API key the request was authenticated
+// with, if any.
+func (i *RequestInfo) APIKey() string {
+	if i == nil || i.apiKey == nil {
+		return ""
+	}
+
+	return i.apiKey.ID
+}
+
+// AffinityKey returns the key the strategy that selected the backend
+// hashed, if it hashes one.
+func (i *RequestInfo) AffinityKey() (string, bool) {
+	if i == nil {
+		return "", false
+	}
+	k, ok := i.strategy.(affinityKeyed)
+	if !ok {
+		return "", false
+	}
+
+	return k.affinityKey(i.decidedReq)
+}
+
+// Backend returns the name of the server the request was last sent to.
+func (i *RequestInfo) Backend() (string, bool) {
+	if i == nil || i.backend == nil {
+		return "", false
+	}
+
+	return serverName(i.backend), true
+}
+
+// Attempts returns the upstream attempts of the request, in order.
+func (i *RequestInfo) Attempts() []AttemptInfo {
+	if i == nil {
+		return nil
+	}
+	attempts := make([]AttemptInfo, len(i.attempts))
+	for n, a := range i.attempts {
+		attempts[n] = AttemptInfo{Backend: serverName(a.server), Status: a.status, Class: a.class, Duration: a.duration, TTFB: a.ttfb}
+	}
+
+	return attempts
+}
+
+// requestID returns the ID of req, from its info if it has one.
+func requestID(req *http.Request) string {
+	if info := requestInfo(req); info != nil {
+		return info.requestID
+	}
+
+	return req.Header.Get(requestIDHeader)
+}
+
+// clientAddr returns the IP address req came from, parsing it once per
+// request unless its RemoteAddr changes.
+func clientAddr(req *http.Request) (netip.Addr, bool) {
+	info := requestInfo(req)
+	if info != nil && info.clientParsed && info.remoteAddr == req.RemoteAddr {
+		return info.clientIP, info.clientIP.IsValid()
+	}
+	var addr netip.Addr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		addr, _ = netip.ParseAddr(host)
+		addr = addr.Unmap()
+	}
+	if info != nil {
+		info.clientIP, info.remoteAddr, info.clientParsed = addr, req.RemoteAddr, true
+	}
+
+	return addr, addr.IsValid()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRequestInfo_MiddlewareReadsAfterHandler(t *testing.T) {
+	refusing, ok := newRefusingServer(t), newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{refusing, ok},
+		WithRoutes(Route{Name: "api", PathPrefix: "/api/"}),
+		WithRetryPolicy(RetryPolicy{Attempts: 2}),
+	)
+
+	var info *RequestInfo
+	middleware := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, info = WithRequestInfo(req)
+		lb.Handler().ServeHTTP(rw, req)
+	})
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.RemoteAddr = "192.0.2.7:4242"
+	req.Header.Set(requestIDHeader, "req-1")
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	if route, found := info.Route(); !found || route != "api" {
+		t.Errorf("Expected route api, got %q", route)
+	}
+	if backend, found := info.Backend(); !found || backend != serverName(ok) {
+		t.Errorf("Expected the request to end at %s, got %q", serverName(ok), backend)
+	}
+	attempts := info.Attempts()
+	if len(attempts) != 2 || attempts[0].Backend != serverName(refusing) || attempts[0].Class == "" ||
+		attempts[1].Backend != serverName(ok) || attempts[1].Status != http.StatusOK {
+		t.Errorf("Expected a refused attempt followed by a successful one, got %+v", attempts)
+	}
+	if ip, found := info.ClientIP(); !found || ip != netip.MustParseAddr("192.0.2.7") {
+		t.Errorf("Expected client 192.0.2.7, got %s", ip)
+	}
+	if info.RequestID() != "req-1" {
+		t.Errorf("Expected request ID req-1, got %q", info.RequestID())
+	}
+}
+
+func TestRequestInfo_PathParams(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)},
+		WithRoutes(Route{Name: "users", PathPattern: "/users/{id}"}))
+
+	req, info := WithRequestInfo(httptest.NewRequest("GET", "/users/42", nil))
+	lb.serveProxy(httptest.NewRecorder(), req)
+	if id, found := info.PathParam("id"); !found || id != "42" {
+		t.Errorf("Expected id 42, got %q", id)
+	}
+	if _, found := info.PathParam("name"); found {
+		t.Error("Expected no name parameter")
+	}
+}
+
+func TestRequestInfo_Reused(t *testing.T) {
+	req, info := WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	again, same := WithRequestInfo(req)
+	if again != req || same != info {
+		t.Error("Expected a request carrying an info to be returned as is")
+	}
+
+	var none *RequestInfo
+	if _, found := none.Route(); found || none.Tenant() != "" || none.Attempts() != nil {
+		t.Error("Expected a nil info to know nothing")
+	}
+	if RequestInfoFrom(context.Background()) != nil {
+		t.Error("Expected no info in a bare context")
+	}
+}
+
+type (
+	adHocClientKey  struct{}
+	adHocRouteKey   struct{}
+	adHocTenantKey  struct{}
+	adHocBackendKey struct{}
+)
+
+// withAdHocKeys attaches the facts features share the way they did before
+// RequestInfo, each under its own key.
+func withAdHocKeys(req *http.Request, route *Route, tenant *tenantState, backend Server) *http.Request {
+	addr, _ := netip.ParseAddr("192.0.2.7")
+	req = req.WithContext(context.WithValue(req.Context(), adHocClientKey{}, addr))
+	req = req.WithContext(context.WithValue(req.Context(), adHocRouteKey{}, route))
+	req = req.WithContext(context.WithValue(req.Context(), adHocTenantKey{}, tenant))
+
+	return req.WithContext(context.WithValue(req.Context(), adHocBackendKey{}, backend))
+}
+
+// withInfo attaches the same facts as withAdHocKeys to a RequestInfo.
+func withInfo(req *http.Request, route *Route, tenant *tenantState, backend Server) *http.Request {
+	req, info := WithRequestInfo(req)
+	info.clientIP, info.clientParsed = netip.MustParseAddr("192.0.2.7"), true
+	info.route, info.routed = route, true
+	info.tenant = tenant
+	info.backend = backend
+
+	return req
+}
+
+func TestRequestInfo_NoExtraAllocations(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	route, tenant, backend := &Route{Name: "api"}, &tenantState{}, &MockServer{addr: "http://server1.com"}
+
+	adHoc := testing.AllocsPerRun(100, func() { withAdHocKeys(req, route, tenant, backend) })
+	info := testing.AllocsPerRun(100, func() { withInfo(req, route, tenant, backend) })
+	if info > adHoc {
+		t.Errorf("Expected no more allocations than ad-hoc keys (%v), got %v", adHoc, info)
+	}
+}
+
+func BenchmarkRequestInfo(b *testing.B) {
+	req := httptest.NewRequest("GET", "/", nil)
+	route, tenant, backend := &Route{Name: "api"}, &tenantState{}, &MockServer{addr: "http://server1.com"}
+
+	b.Run("ad-hoc", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			withAdHocKeys(req, route, tenant, backend)
+		}
+	})
+	b.Run("info", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			withInfo(req, route, tenant, backend)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRetryClasses are retried when a RetryPolicy names no classes: the
+// failures where the server cannot have started processing the request, and
+// servers explicitly reporting they are unavailable.
+var DefaultRetryClasses = []ErrorClass{
+	ClassConnectRefused, ClassConnectTimeout, ClassConnectError, ClassStatus503,
+}
+
+// RetryPolicy controls retrying failed upstream attempts on another selected
+// server. Attempts is the total number of attempts including the first, so
+// values below 2 disable retries. A failure is never retried once part of
+// the response has been sent to the client. Request bodies are buffered for
+// replay as the route's BodyBufferPolicy allows.
+//
+// Retries, and redirects followed, go to servers not attempted for the
+// request yet. Once every available server was, Repeat decides whether one
+// is attempted again, RepeatAllow and the default, or the request fails
+// with its last failure, RepeatFail.
+type RetryPolicy struct {
+	Attempts int
+	On       []ErrorClass
+	Repeat   RetryRepeat
+}
+
+// RetryRepeat decides what a retry does once every available server was
+// attempted for its request.
+type RetryRepeat string
+
+const (
+	// RepeatAllow attempts a server again.
+	RepeatAllow RetryRepeat = "allow"
+
+	// RepeatFail gives up, answering with the last failure.
+	RepeatFail RetryRepeat = "fail"
+)
+
+// WithRetryPolicy sets the retry policy of requests whose route has none.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.retry = &policy
+	}
+}
+
+// retries reports whether class is retryable under the policy.
+func (p *RetryPolicy) retries(class ErrorClass) bool {
+	if len(p.On) == 0 {
+		return slices.Contains(DefaultRetryClasses, class)
+	}
+
+	return slices.Contains(p.On, class)
+}
+
+// retryPolicyFor returns the retry policy applying to req, or nil.
+func (lb *LoadBalancer) retryPolicyFor(req *http.Request) *RetryPolicy {
+	if route := lb.matchRoute(req); route != nil && route.Retry != nil {
+		return route.Retry
+	}
+
+	return lb.retry
+}
+
+type attemptKey struct{}
+
+// attemptedServers are the servers attempted for a request, in order.
+type attemptedServers struct {
+	servers []Server
+}
+
+// trackAttempted starts tracking the servers attempted for req in its
+// info.
+func trackAttempted(req *http.Request) *attemptedServers {
+	info := requestInfo(req)
+	if info == nil {
+		return nil
+	}
+	info.attempted = &attemptedServers{}
+
+	return info.attempted
+}
+
+// attemptedFor returns the servers attempted for req, or nil if they are
+// not tracked.
+func attemptedFor(req *http.Request) *attemptedServers {
+	if info := requestInfo(req); info != nil {
+		return info.attempted
+	}
+
+	return nil
+}
+
+// add records an attempt to server.
+func (a *attemptedServers) add(server Server) {
+	if a != nil && !a.has(server) {
+		a.servers = append(a.servers, server)
+	}
+}
+
+// has reports whether server was attempted.
+func (a *attemptedServers) has(server Server) bool {
+	return a != nil && slices.Contains(a.servers, server)
+}
+
+// unattempted drops the candidates already attempted for req. Once every
+// candidate was, the retry policy of req decides between attempting one
+// again and failing with ErrServersAttempted.
+func (lb *LoadBalancer) unattempted(req *http.Request, candidates []Candidate) ([]Candidate, error) {
+	a := attemptedFor(req)
+	if a == nil || len(a.servers) == 0 || len(candidates) == 0 {
+		return candidates, nil
+	}
+	rest := slices.DeleteFunc(slices.Clone(candidates), func(c Candidate) bool { return a.has(c.Server) })
+	if len(rest) > 0 {
+		return rest, nil
+	}
+	if p := lb.retryPolicyFor(req); p != nil && p.Repeat == RepeatFail {
+		return nil, ErrServersAttempted
+	}
+	if e := lb.explanationFor(req); e != nil {
+		e.Repeated = true
+	}
+
+	return candidates, nil
+}
+
+// attemptFromContext returns the attempt a proxied request belongs to, or
+// nil outside of serveProxy.
+func attemptFromContext(ctx context.Context) *attemptWriter {
+	w, _ := ctx.Value(attemptKey{}).(*attemptWriter)
+	return w
+}
+
+// attemptWriter is the response writer of one upstream attempt. It records
+// the class of the attempt's failure and, while retrying is still allowed,
+// holds back failed responses so the request can be sent to another server
+// without anything reaching the client. Headers are staged until the
+// response is committed.
+type attemptWriter struct {
+	rw        http.ResponseWriter
+	header    http.Header
+	retryable func(ErrorClass) bool
+
+	status    int
+	class     ErrorClass
+	committed bool
+	discarded bool
+
+	start time.Time
+	ttfb  time.Duration
+
+	// redirect applies the redirect policy to a redirect response; follow
+	// holds the redirect to follow instead of committing the response.
+	redirect func(status int, header http.Header) *redirectTarget
+	follow   *redirectTarget
+
+	// onCommit, if set, may amend the headers of the response that reaches
+	// the client.
+	onCommit func(status int, header http.Header)
+
+	// validation, if set, rejects invalid responses of the server.
+	validation *ResponseValidation
+
+	// feedback, if set, takes the feedback of the server out of the
+	// response headers and heeds it.
+	feedback func(header http.Header)
+
+	// plainBody is set when the response body must reach the load
+	// balancer decoded, and caching when the response may be cached.
+	plainBody bool
+	caching   bool
+
+	// firstByte, if set, cancels the attempt unless stopped by the first
+	// byte of the response.
+	firstByte *time.Timer
+
+	// events is the body of the response if it is an event stream.
+	events *classifyingBody
+
+	// err is the upstream error the attempt failed with, if any, and
+	// explanation the debug explanation of the request, if asked for.
+	err         *UpstreamError
+	explanation *Explanation
+}
+
+func newAttemptWriter(rw http.ResponseWriter, retryable func(ErrorClass) bool) *attemptWriter {
+	return &attemptWriter{rw: rw, header: rw.Header().Clone(), retryable: retryable, start: time.Now()}
+}
+
+// attemptRecord is the outcome of one upstream attempt as reported in the
+// access log. TTFB is zero when the server did not respond.
+type attemptRecord struct {
+	server   Server
+	status   int
+	class    ErrorClass
+	duration time.Duration
+	ttfb     time.Duration
+}
+
+// record returns the outcome of the attempt, which was sent to server.
+func (w *attemptWriter) record(server Server) attemptRecord {
+	return attemptRecord{server: server, status: w.status, class: w.class, duration: time.Since(w.start), ttfb: w.ttfb}
+}
+
+// recordFailure sets the class of the attempt's failure, keeping the first
+// one recorded.
+func (w *attemptWriter) recordFailure(class ErrorClass) {
+	if w.class == "" {
+		w.class = class
+	}
+}
+
+// recordError records the upstream error the attempt failed with. Only a
+// request asking for a debug explanation is told about it; the client
+// otherwise sees no more than the status.
+func (w *attemptWriter) recordError(err *UpstreamError) {
+	if w.err == nil {
+		w.err = err
+	}
+	w.recordFailure(err.Class)
+	if e := w.explanation; e != nil {
+		e.Error = err.Error()
+		e.annotate(w)
+	}
+}
+
+func (w *attemptWriter) Header() http.Header {
+	if w.committed {
+		return w.rw.Header()
+	}
+
+	return w.header
+}
+
+func (w *attemptWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		w.rw.WriteHeader(status)
+		return
+	}
+
+	w.status = status
+	if w.feedback != nil {
+		w.feedback(w.header)
+	}
+	// Transport failures are recorded before the proxy writes its error
+	// response, which is no byte from the server.
+	if w.class == "" {
+		w.ttfb = time.Since(w.start)
+	}
+	if w.redirect != nil && status >= 300 && status < 400 {
+		if w.follow = w.redirect(status, w.header); w.follow != nil {
+			w.discarded = true
+			return
+		}
+	}
+	w.recordFailure(classifyStatus(status))
+	if w.class != "" && w.retryable != nil && w.retryable(w.class) {
+		w.discarded = true
+		return
+	}
+	if w.onCommit != nil {
+		w.onCommit(status, w.header)
+	}
+	w.commit()
+	if w.events != nil {
+		if cw := countingWriterOf(w.rw); cw != nil {
+			cw.watchEventStream(w.events)
+		}
+	}
+	w.rw.WriteHeader(status)
+}
+
+func (w *attemptWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return len(p), nil
+	}
+
+	return w.rw.Write(p)
+}
+
+// commit replaces the client's headers with the staged ones.
+func (w *attemptWriter) commit() {
+	dst := w.rw.Header()
+	clear(dst)
+	for k, v := range w.header {
+		dst[k] = v
+	}
+	w.committed = true
+}
+
+func (w *attemptWriter) Flush() {
+	if !w.discarded {
+		http.NewResponseController(w.rw).Flush()
+	}
+}
+
+func (w *attemptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.commit()
+	return http.NewResponseController(w.rw).Hijack()
+}
+
+func (w *attemptWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+// classifyingBody reports failures reading an upstream response body to the
+// attempt the response belongs to, except once the load balancer cut it
+// off.
+type classifyingBody struct {
+	io.ReadCloser
+	req    *http.Request
+	cutOff atomic.Bool
+}
+
+// cut closes the body for the load balancer, ending the response.
+func (b *classifyingBody) cut() {
+	b.cutOff.Store(true)
+	b.Close()
+}
+
+func (b *classifyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.req.Context().Err() == nil && !b.cutOff.Load() {
+		if a := attemptFromContext(b.req.Context()); a != nil {
+			a.recordFailure(ClassBodyRead)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// newBackendServer returns a simpleServer proxying to a test backend running
+// handler.
+func newBackendServer(t *testing.T, handler http.HandlerFunc, opts ...ServerOption) Server {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// newRefusingServer returns a simpleServer whose address refuses connections.
+func newRefusingServer(t *testing.T) Server {
+	t.Helper()
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func okHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Backend", "ok")
+	rw.Write([]byte("ok"))
+}
+
+func statusHandler(status int) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Backend", "failing")
+		rw.WriteHeader(status)
+	}
+}
+
+func TestRetry_ClassifiesTransportErrors(t *testing.T) {
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	dialRefused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	dialDNS := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}
+	readTimeout := &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+
+	for err, want := range map[error]ErrorClass{
+		dialTimeout:                  ClassConnectTimeout,
+		dialRefused:                  ClassConnectRefused,
+		dialDNS:                      ClassConnectError,
+		readTimeout:                  ClassResponseHeaderTimeout,
+		errors.New("unexpected EOF"): ClassOther,
+	} {
+		if got := classifyTransportError(err); got != want {
+			t.Errorf("Expected %v to be classified %s, got %s", err, want, got)
+		}
+	}
+}
+
+func TestRetry_DefaultClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing Server
+		retried bool
+	}{
+		{"connect refused", newRefusingServer(t), true},
+		{"status 503", newBackendServer(t, statusHandler(http.StatusServiceUnavailable)), true},
+		{"status 502", newBackendServer(t, statusHandler(http.StatusBadGateway)), false},
+		{"status 504", newBackendServer(t, statusHandler(http.StatusGatewayTimeout)), false},
+		{"response header timeout", newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}, WithResponseHeaderTimeout(10*time.Millisecond)), false},
+	}
+	for _, tt := range tests {
+		healthy := newBackendServer(t, okHandler)
+		lb := newTestLoadBalancer(t, []Server{tt.failing, healthy}, WithRetryPolicy(RetryPolicy{Attempts: 2}))
+
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if got := rw.Code == http.StatusOK; got != tt.retried {
+			t.Errorf("%s: Expected retried=%v, got status %d", tt.name, tt.retried, rw.Code)
+		}
+		if tt.retried && rw.Header().Get("X-Backend") != "ok" {
+			t.Errorf("%s: Expected only the retried response's headers, got %v", tt.name, rw.Header())
+		}
+	}
+}
+
+func TestRetry_ConfiguredClasses(t *testing.T) {
+	// A route may retry 502s, the rest of the traffic may not
+	failing := newBackendServer(t, statusHandler(http.StatusBadGateway))
+	healthy := newBackendServer(t, okHandler)
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{failing, healthy},
+		WithRoutes(Route{Name: "api", PathPrefix: "/api", Retry: &RetryPolicy{Attempts: 3, On: []ErrorClass{ClassStatus502}}}),
+		WithRetryPolicy(RetryPolicy{Attempts: 3}),
+		WithAccessLog(log))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/api/users", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the 502 to be retried on /api, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Expected the 502 not to be retried outside /api, got %d", rw.Code)
+	}
+
+	entries := accessLogEntries(t, log)
+	if entries[0]["attempts"].(float64) != 2 || entries[0]["error_class"] != "" {
+		t.Errorf("Expected the retried request to log 2 attempts, got %v", entries[0])
+	}
+	if entries[1]["attempts"].(float64) != 1 || entries[1]["error_class"] != "status-502" {
+		t.Errorf("Expected the failed request to log its class, got %v", entries[1])
+	}
+
+	if failures := lb.Stats()[0].Failures[ClassStatus502]; failures != 2 {
+		t.Errorf("Expected 2 status-502 failures, got %d", failures)
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	want := `lb_server_failures_total{server="` + failing.Address() + `",class="status-502"} 2`
+	if !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s, got:\n%s", want, metrics.Body.String())
+	}
+}
+
+func TestRetry_TLSFailure(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer backend.Close()
+	untrusted, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthy := newBackendServer(t, okHandler)
+
+	// TLS failures are not retried unless configured
+	for _, tt := range []struct {
+		policy RetryPolicy
+		status int
+	}{
+		{RetryPolicy{Attempts: 2}, http.StatusBadGateway},
+		{RetryPolicy{Attempts: 2, On: []ErrorClass{ClassTLS}}, http.StatusOK},
+	} {
+		lb := newTestLoadBalancer(t, []Server{untrusted, healthy}, WithRetryPolicy(tt.policy))
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code != tt.status {
+			t.Errorf("Expected status %d with retry on %v, got %d", tt.status, tt.policy.On, rw.Code)
+		}
+		if failures := lb.Stats()[0].Failures[ClassTLS]; failures != 1 {
+			t.Errorf("Expected 1 tls failure, got %v", lb.Stats()[0].Failures)
+		}
+	}
+}
+
+func TestRetry_NeverAfterResponseStarted(t *testing.T) {
+	// The backend sends headers, then drops the connection mid-body
+	truncating := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		conn, buf, _ := http.NewResponseController(rw).Hijack()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+		buf.Flush()
+		conn.Close()
+	})
+	healthy := newBackendServer(t, okHandler)
+	lb := newTestLoadBalancer(t, []Server{truncating, healthy},
+		WithRetryPolicy(RetryPolicy{Attempts: 3, On: []ErrorClass{ClassBodyRead, ClassOther}}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK || !strings.HasPrefix(rw.Body.String(), "partial") {
+		t.Errorf("Expected the partial response to reach the client, got %d %q", rw.Code, rw.Body.String())
+	}
+	if stats := lb.Stats(); stats[0].Failures[ClassBodyRead] != 1 || stats[1].Requests != 0 {
+		t.Errorf("Expected a body-read failure and no retry, got %+v", stats)
+	}
+}
+
+func TestRetry_AttemptTimings(t *testing.T) {
+	failing := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	})
+	healthy := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		rw.Write([]byte("ok"))
+	})
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{failing, healthy}, WithRetryPolicy(RetryPolicy{Attempts: 2}), WithAccessLog(log))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the retry to succeed, got %d", rw.Code)
+	}
+
+	entry := accessLogEntries(t, log)[0]
+	upstream, _ := entry["upstream"].([]any)
+	if len(upstream) != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %v", entry["upstream"])
+	}
+	first, second := upstream[0].(map[string]any), upstream[1].(map[string]any)
+	if first["backend"] != failing.Address() || first["status"].(float64) != 503 || first["error_class"] != "status-503" {
+		t.Errorf("Expected the failed first attempt, got %v", first)
+	}
+	if second["backend"] != healthy.Address() || second["status"].(float64) != 200 || second["error_class"] != nil {
+		t.Errorf("Expected the successful retry, got %v", second)
+	}
+	if ttfb := first["ttfb_ms"].(float64); ttfb < 10 || ttfb > first["duration_ms"].(float64) {
+		t.Errorf("Expected the first attempt's TTFB between 10ms and its duration, got %v", first)
+	}
+	ttfb, attempt := second["ttfb_ms"].(float64), second["duration_ms"].(float64)
+	if ttfb < 20 || attempt < ttfb+10 {
+		t.Errorf("Expected the retry's TTFB of at least 20ms and its body 10ms later, got %v", second)
+	}
+	if entry["ttfb_ms"].(float64) != ttfb {
+		t.Errorf("Expected the request's TTFB to be the retry's, got %v", entry["ttfb_ms"])
+	}
+	if total := entry["duration_ms"].(float64); total < first["duration_ms"].(float64)+attempt {
+		t.Errorf("Expected the total duration to cover both attempts, got %v", total)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_requests_total{protocol="HTTP/1.1"} 1` + "\n", "lb_upstream_attempts_total 2\n", "lb_upstream_ttfb_seconds_count 1\n"} {
+		if !strings.Contains(metrics.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+// upstreamBackends returns the backends of the attempts logged in entry.
+func upstreamBackends(entry map[string]any) []string {
+	var backends []string
+	for _, a := range entry["upstream"].([]any) {
+		backends = append(backends, a.(map[string]any)["backend"].(string))
+	}
+	return backends
+}
+
+func TestRetry_DistinctServers(t *testing.T) {
+	failing := []Server{
+		newBackendServer(t, statusHandler(http.StatusServiceUnavailable)),
+		newBackendServer(t, statusHandler(http.StatusServiceUnavailable)),
+	}
+	healthy := newBackendServer(t, okHandler)
+	log := &syncBuffer{}
+	// Hashing on a header would send every attempt to the same server.
+	lb := newTestLoadBalancer(t, []Server{failing[0], failing[1], healthy},
+		WithStrategy(HashStrategy("header-hash", HeaderKey("X-User"))),
+		WithRetryPolicy(RetryPolicy{Attempts: 3}),
+		WithAccessLog(log))
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected user-%d to reach the healthy server, got %d", i, rw.Code)
+		}
+	}
+	for _, entry := range accessLogEntries(t, log) {
+		backends := upstreamBackends(entry)
+		seen := make(map[string]bool)
+		for _, b := range backends {
+			if seen[b] {
+				t.Errorf("Expected every attempt on a distinct server, got %v", backends)
+			}
+			seen[b] = true
+		}
+		if backends[len(backends)-1] != healthy.Address() {
+			t.Errorf("Expected the last attempt on the healthy server, got %v", backends)
+		}
+	}
+}
+
+func TestRetry_EveryServerAttempted(t *testing.T) {
+	for _, tt := range []struct {
+		repeat   RetryRepeat
+		attempts int
+	}{
+		{"", 5},
+		{RepeatAllow, 5},
+		{RepeatFail, 2},
+	} {
+		t.Run(string(tt.repeat), func(t *testing.T) {
+			var calls atomic.Int64
+			failing := func(rw http.ResponseWriter, req *http.Request) {
+				calls.Add(1)
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+			log := &syncBuffer{}
+			lb := newTestLoadBalancer(t, []Server{newBackendServer(t, failing), newBackendServer(t, failing)},
+				WithRetryPolicy(RetryPolicy{Attempts: 5, Repeat: tt.repeat}),
+				WithDebugExplain(DebugExplain{Always: true}),
+				WithAccessLog(log))
+
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+			if rw.Code != http.StatusServiceUnavailable || calls.Load() != int64(tt.attempts) {
+				t.Errorf("Expected %d attempts ending in 503, got %d and %d", tt.attempts, calls.Load(), rw.Code)
+			}
+			if got := len(upstreamBackends(accessLogEntries(t, log)[0])); got != tt.attempts {
+				t.Errorf("Expected %d attempts in the access log, got %d", tt.attempts, got)
+			}
+			var e Explanation
+			if err := json.Unmarshal([]byte(rw.Header().Get(debugHeader)), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Repeated != (tt.repeat != RepeatFail) || len(e.Attempts) != tt.attempts-1 {
+				t.Errorf("Expected the explanation to list the retried attempts, got %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le || sparc64)
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define
+// for Linux. MIPS and SPARC use a different value and are not supported.
+const soReusePort = 0xf
+
+// listenReusePort listens on address with SO_REUSEPORT set, so that several
+// sockets can bind the same address and the kernel spreads incoming
+// connections across them.
+func listenReusePort(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	return lc.Listen(context.Background(), network, address)
+}
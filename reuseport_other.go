@@ -0,0 +1,12 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le || sparc64
+
+package main
+
+import "net"
+
+// listenReusePort reports ErrReusePortUnsupported: only Linux balances
+// connections across sockets sharing a port, and SO_REUSEPORT is only
+// defined here for its common architectures.
+func listenReusePort(network, address string) (net.Listener, error) {
+	return nil, ErrReusePortUnsupported
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenShards returns n sharded listeners on a free port, skipping the test
+// where SO_REUSEPORT is unsupported.
+func listenShards(tb testing.TB, u *Upgrader, n int) []net.Listener {
+	tb.Helper()
+	shards, err := u.ListenShards("tcp", "127.0.0.1:0", n)
+	if errors.Is(err, ErrReusePortUnsupported) {
+		tb.Skip(err)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return shards
+}
+
+func TestListenShards_SpreadsConnections(t *testing.T) {
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := listenShards(t, u, 4)
+
+	counts := make([]atomic.Int64, len(shards))
+	var servers []*http.Server
+	done := make(chan error, len(shards))
+	for i, ln := range shards {
+		if ln.Addr().String() != shards[0].Addr().String() {
+			t.Fatalf("Expected every shard on %s, got %s", shards[0].Addr(), ln.Addr())
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			counts[i].Add(1)
+		})}
+		servers = append(servers, srv)
+		go func() { done <- srv.Serve(ln) }()
+	}
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 200; i++ {
+		resp, err := client.Get("http://" + shards[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for i := range counts {
+		if counts[i].Load() == 0 {
+			t.Errorf("Expected shard %d to receive connections, got none", i)
+		}
+	}
+
+	shutdown(servers, 2*time.Second)
+	for range shards {
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Expected every shard to close cleanly, got %v", err)
+		}
+	}
+	if _, err := net.Dial("tcp", shards[0].Addr().String()); err == nil {
+		t.Errorf("Expected no listener left after shutdown")
+	}
+}
+
+func TestListenShards_Inherited(t *testing.T) {
+	parent, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := listenShards(t, parent, 2)
+	defer func() {
+		for _, ln := range shards {
+			ln.Close()
+		}
+	}()
+
+	// The child claims the shards it was handed by key
+	child := &Upgrader{inherited: make(map[string]*os.File), listeners: make(map[string]net.Listener)}
+	for i, key := range parent.order {
+		f, err := listenerFile(shards[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.inherited[key] = f
+	}
+	inherited, err := child.ListenShards("tcp", "127.0.0.1:0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ln := range inherited {
+		defer ln.Close()
+		if ln.Addr().String() != shards[i].Addr().String() {
+			t.Errorf("Expected shard %d to be inherited at %s, got %s", i, shards[i].Addr(), ln.Addr())
+		}
+	}
+	if len(child.inherited) != 0 {
+		t.Errorf("Expected every inherited shard to be claimed, got %v", child.inherited)
+	}
+}
+
+func BenchmarkAccept(b *testing.B) {
+	for _, n := range []int{1, max(runtime.GOMAXPROCS(0), 4)} {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			u, err := NewUpgrader()
+			if err != nil {
+				b.Fatal(err)
+			}
+			shards := listenShards(b, u, n)
+			for _, ln := range shards {
+				defer ln.Close()
+				go func() {
+					for {
+						conn, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+			}
+
+			addr := shards[0].Addr().String()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					conn.Read(make([]byte, 1))
+					conn.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// ringReplicas is the number of points each server has on the hash ring.
+	ringReplicas = 100
+
+	// defaultHashLoadFactor bounds the in-flight requests of any server to
+	// 1.25 times the average.
+	defaultHashLoadFactor = 1.25
+)
+
+// ringPoint is a position on the hash ring owned by a candidate.
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+// consistentHash is consistent hashing with bounded loads: a request goes to
+// the first server clockwise from its key's position on the ring whose
+// in-flight count is below loadFactor times the average, so a hot key spills
+// over to the following servers instead of overloading one of them while
+// other keys keep their server. Weights are not taken into account.
+type consistentHash struct {
+	name       string
+	extract    KeyExtractor
+	loadFactor float64
+
+	// The ring is rebuilt whenever the candidate set changes.
+	members string
+	ring    []ringPoint
+
+	overflows atomic.Uint64
+}
+
+// ConsistentHashStrategy returns a bounded-load consistent hash strategy
+// named name over the key extract derives from each request. A loadFactor
+// below 1 selects the default of 1.25.
+func ConsistentHashStrategy(name string, extract KeyExtractor, loadFactor float64) Strategy {
+	if loadFactor < 1 {
+		loadFactor = defaultHashLoadFactor
+	}
+
+	return &consistentHash{name: name, extract: extract, loadFactor: loadFactor}
+}
+
+func (s *consistentHash) Name() string {
+	return s.name
+}
+
+// Overflows returns how many requests were rerouted away from their ring
+// position because the server there was at the load bound.
+func (s *consistentHash) Overflows() uint64 {
+	return s.overflows.Load()
+}
+
+func (s *consistentHash) Select(req *http.Request, candidates []Candidate) (Server, error) {
+	if req == nil {
+		return nil, ErrStrategyPass
+	}
+	key, ok := s.extract(req)
+	if !ok {
+		return nil, ErrStrategyPass
+	}
+	s.rebuild(candidates)
+
+	var total int64
+	for _, c := range candidates {
+		total += c.InFlight
+	}
+	bound := int64(math.Ceil(s.loadFactor * float64(total+1) / float64(len(candidates))))
+
+	h := hashKey(key)
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	checked := make(map[int]bool, len(candidates))
+	for i := 0; len(checked) < len(candidates); i++ {
+		p := s.ring[(start+i)%len(s.ring)]
+		if checked[p.index] {
+			continue
+		}
+		checked[p.index] = true
+		if candidates[p.index].InFlight < bound {
+			if len(checked) > 1 {
+				s.overflows.Add(1)
+			}
+			return candidates[p.index].Server, nil
+		}
+	}
+
+	// Unreachable: the loads cannot all be at the bound, which exceeds the
+	// average.
+	return candidates[0].Server, nil
+}
+
+func (s *consistentHash) affinityKey(req *http.Request) (string, bool) {
+	return s.extract(req)
+}
+
+// rebuild recomputes the ring if candidates differ from the last call.
+func (s *consistentHash) rebuild(candidates []Candidate) {
+	addrs := make([]string, len(candidates))
+	for i, c := range candidates {
+		addrs[i] = serverName(c.Server)
+	}
+	members := strings.Join(addrs, "\n")
+	if members == s.members {
+		return
+	}
+
+	s.members = members
+	s.ring = s.ring[:0]
+	for i, addr := range addrs {
+		for r := 0; r < ringReplicas; r++ {
+			s.ring = append(s.ring, ringPoint{hash: hashKey(fmt.Sprintf("%s#%d", addr, r)), index: i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+}
+
+// hashKey hashes key onto the ring. FNV alone clusters keys that differ
+// only in their last bytes, such as replica suffixes, so the result is
+// passed through the MurmurHash3 finalizer.
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
+
+// overflowReporter is implemented by strategies that reroute requests when
+// their preferred server is overloaded.
+type overflowReporter interface {
+	Overflows() uint64
+}
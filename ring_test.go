@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConsistentHash_BoundedLoads(t *testing.T) {
+	cfg := &Config{
+		Port: "8000",
+		Servers: []ServerConfig{
+			{Address: "http://server1.com"}, {Address: "http://server2.com"},
+			{Address: "http://server3.com"}, {Address: "http://server4.com"},
+		},
+		Strategy:       "consistent-hash:header:X-Tenant",
+		HashLoadFactor: 1.5,
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skewed traffic: most requests belong to one hot tenant, and none of
+	// them finish, so in-flight counts only grow
+	for i := 0; i < 200; i++ {
+		tenant := "hot"
+		if i%5 == 0 {
+			tenant = fmt.Sprintf("tenant-%d", i)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		if _, err := lb.selectServer(req); err != nil {
+			t.Fatal(err)
+		}
+
+		var total, max int64
+		stats := lb.Stats()
+		for _, s := range stats {
+			total += s.InFlight
+			if s.InFlight > max {
+				max = s.InFlight
+			}
+		}
+		bound := int64(math.Ceil(1.5 * float64(total) / float64(len(stats))))
+		if max > bound {
+			t.Fatalf("Expected at most %d in flight per server after %d requests, got %d", bound, total, max)
+		}
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	prefix := `lb_strategy_overflows_total{route="",strategy="consistent-hash"} `
+	if !strings.Contains(metrics.Body.String(), prefix) || strings.Contains(metrics.Body.String(), prefix+"0\n") {
+		t.Errorf("Expected overflows to be counted, got:\n%s", metrics.Body.String())
+	}
+}
+
+func TestConsistentHash_StableKeys(t *testing.T) {
+	strategy, err := newStrategy("consistent-hash:header:X-Tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []Candidate{
+		{Server: &MockServer{addr: "http://server1.com"}},
+		{Server: &MockServer{addr: "http://server2.com"}},
+		{Server: &MockServer{addr: "http://server3.com"}},
+		{Server: &MockServer{addr: "http://server4.com"}},
+	}
+	selectFor := func(tenant string, candidates []Candidate) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		server, err := strategy.Select(req, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server.Address()
+	}
+
+	idle := map[string]string{}
+	for i := 0; i < 100; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		idle[tenant] = selectFor(tenant, candidates)
+	}
+
+	// Loading one server moves only the keys it owns
+	hot := idle["tenant-0"]
+	loaded := make([]Candidate, len(candidates))
+	copy(loaded, candidates)
+	for i := range loaded {
+		if loaded[i].Server.Address() == hot {
+			loaded[i].InFlight = 10
+		}
+	}
+	for tenant, want := range idle {
+		got := selectFor(tenant, loaded)
+		if want != hot && got != want {
+			t.Errorf("Expected %s to stay on %s while %s is loaded, got %s", tenant, want, hot, got)
+		}
+		if want == hot && got == hot {
+			t.Errorf("Expected %s to move off the loaded %s", tenant, hot)
+		}
+	}
+
+	// Removing a server moves only the keys it owned
+	var remaining []Candidate
+	for _, c := range candidates {
+		if c.Server.Address() != hot {
+			remaining = append(remaining, c)
+		}
+	}
+	for tenant, want := range idle {
+		if got := selectFor(tenant, remaining); want != hot && got != want {
+			t.Errorf("Expected %s to stay on %s after removing %s, got %s", tenant, want, hot, got)
+		}
+	}
+
+	if _, err := newStrategy("consistent-hash:bogus"); err == nil {
+		t.Errorf("Expected an unknown key to be rejected")
+	}
+	if _, err := newStrategy("consistent-hash:header"); err == nil {
+		t.Errorf("Expected a header key without a name to be rejected")
+	}
+}
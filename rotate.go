@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotateConfig controls when a log-style file is rotated. A zero field
+// disables that trigger.
+type RotateConfig struct {
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// rotatingFile is an append-only file that is renamed aside with a timestamp
+// suffix and reopened once it exceeds its size or age limit.
+type rotatingFile struct {
+	path string
+	cfg  RotateConfig
+	now  func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openRotatingFile opens path for appending, creating it if needed.
+func openRotatingFile(path string, cfg RotateConfig) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, cfg: cfg, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size, r.opened = f, info.Size(), r.now()
+
+	return nil
+}
+
+// Write appends p, rotating first when p would push the file past its size
+// limit or the file has reached its maximum age.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	tooBig := r.cfg.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.cfg.MaxSize
+	tooOld := r.cfg.MaxAge > 0 && r.now().Sub(r.opened) >= r.cfg.MaxAge
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// rotate renames the current file aside and opens a fresh one. r.mu must be
+// held.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	rotated := fmt.Sprintf("%s.%s", r.path, r.now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("rotate %s: %w", r.path, err)
+	}
+
+	return r.open()
+}
+
+// Close closes the underlying file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile_RotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.jsonl")
+	f, err := openRotatingFile(path, RotateConfig{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Each write fits on its own but not together
+	for _, line := range []string{"first-1\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("Expected 2 rotated files, got %v", rotated)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "third\n" {
+		t.Errorf("Expected current file to hold the last write, got %q", data)
+	}
+}
+
+func TestRotatingFile_RotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	f := &rotatingFile{path: path, cfg: RotateConfig{MaxAge: 24 * time.Hour}, now: func() time.Time { return now }}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("day one\n"))
+	now = now.Add(24 * time.Hour)
+	f.Write([]byte("day two\n"))
+
+	old, err := os.ReadFile(path + ".20240102T120000.000000000")
+	if err != nil {
+		t.Fatalf("Expected a rotated file named by rotation time: %v", err)
+	}
+	if string(old) != "day one\n" {
+		t.Errorf("Expected rotated file to hold day one, got %q", old)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "day two\n" {
+		t.Errorf("Expected current file to hold day two, got %q", data)
+	}
+}
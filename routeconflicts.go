@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ConflictKind classifies a conflict between routes.
+type ConflictKind string
+
+const (
+	// ConflictUnreachable is a route that no request can reach, because
+	// earlier routes match every request it matches or its own matchers
+	// contradict each other.
+	ConflictUnreachable ConflictKind = "unreachable"
+
+	// ConflictDuplicate is a route matching exactly the requests an
+	// earlier route matches.
+	ConflictDuplicate ConflictKind = "duplicate"
+
+	// ConflictOverlap is a route sharing some requests with an earlier
+	// route without either containing the other, so that reordering them
+	// changes where those requests go.
+	ConflictOverlap ConflictKind = "overlap"
+)
+
+// RouteConflict is a problem found by analyzing routes in order. Route and
+// Other name routes as configuration paths, e.g. "routes[api]".
+type RouteConflict struct {
+	Kind   ConflictKind `json:"kind"`
+	Route  string       `json:"route"`
+	Other  string       `json:"other,omitempty"`
+	Detail string       `json:"detail"`
+}
+
+func (c RouteConflict) Error() string {
+	return fmt.Sprintf("%s: %s", c.Kind, c.Detail)
+}
+
+// routePath names the route at index i, as configuration errors do.
+func routePath(i int, name string) string {
+	if name != "" {
+		return fmt.Sprintf("routes[%s]", name)
+	}
+
+	return fmt.Sprintf("routes[%d]", i)
+}
+
+// routeMatch is the set of requests a route matches: paths starting with
+// prefix, all of those starting with covers unless pattern is set, from
+// clients in countries, or from anywhere when countries is nil. Paths are
+// compared ignoring case when fold is set. A route whose path prefix and
+// gRPC service exclude each other matches no request at all.
+type routeMatch struct {
+	prefix    string
+	covers    string
+	pattern   *pathPattern
+	source    string
+	tolerant  bool
+	fold      bool
+	countries []string
+	none      bool
+}
+
+// matchOf returns the requests r matches as matchRoute decides. Method
+// policies do not take part: a route answers the methods it does not allow
+// with 405 rather than passing them on to later routes. It fails for
+// patterns that do not compile.
+func matchOf(r Route) (routeMatch, error) {
+	m := routeMatch{prefix: r.PathPrefix, covers: r.PathPrefix, tolerant: r.tolerant(), fold: r.CaseInsensitive}
+	if m.tolerant && len(m.prefix) > 1 {
+		m.prefix = strings.TrimSuffix(m.prefix, "/")
+	}
+	if r.PathPattern != "" {
+		p := r.path
+		if p == nil {
+			var err error
+			if p, err = parsePathPattern(r.PathPattern); err != nil {
+				return routeMatch{}, err
+			}
+		}
+		m.pattern, m.source, m.prefix = p, r.PathPattern, p.prefix
+		if m.tolerant && !p.rest && len(p.names) == 0 && len(m.prefix) > 1 {
+			m.prefix = strings.TrimSuffix(m.prefix, "/")
+		}
+	}
+	if len(r.Countries) > 0 {
+		m.countries = r.Countries
+	}
+	if s := r.GRPCService; s != "" {
+		service := "/" + s + "/"
+		switch {
+		case strings.HasPrefix(service, m.prefix):
+			m.prefix = service
+			if strings.HasPrefix(service, m.covers) {
+				m.covers = service
+			}
+		case !strings.HasPrefix(m.prefix, service):
+			m.none = true
+		}
+	}
+
+	return m, nil
+}
+
+// contains reports whether m matches every request o matches.
+func (m routeMatch) contains(o routeMatch) bool {
+	if o.fold && !m.fold {
+		return false
+	}
+	switch {
+	case m.pattern == nil:
+		if !hasPathPrefix(o.prefix, m.covers, m.fold) {
+			return false
+		}
+	case o.pattern == nil || o.tolerant && !m.tolerant:
+		return false
+	case m.fold && !strings.EqualFold(canonicalPattern(m.pattern), canonicalPattern(o.pattern)):
+		return false
+	case !m.fold && canonicalPattern(m.pattern) != canonicalPattern(o.pattern):
+		return false
+	}
+	if m.countries == nil {
+		return true
+	}
+	if o.countries == nil {
+		return false
+	}
+	for _, country := range o.countries {
+		if !slices.Contains(m.countries, country) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// intersect returns the requests both m and o may match, and whether there
+// may be any. Paths matching patterns are approximated by the prefix of
+// the pattern.
+func (m routeMatch) intersect(o routeMatch) (routeMatch, bool) {
+	fold := m.fold || o.fold
+	both := routeMatch{pattern: m.pattern, source: m.source}
+	if both.pattern == nil {
+		both.pattern, both.source = o.pattern, o.source
+	}
+	switch {
+	case hasPathPrefix(o.prefix, m.prefix, fold):
+		both.prefix = o.prefix
+	case hasPathPrefix(m.prefix, o.prefix, fold):
+		both.prefix = m.prefix
+	default:
+		return routeMatch{}, false
+	}
+	if m.pattern != nil && o.pattern != nil && !patternsIntersect(m.pattern, o.pattern, fold, m.tolerant || o.tolerant) {
+		return routeMatch{}, false
+	}
+	switch {
+	case m.countries == nil:
+		both.countries = o.countries
+	case o.countries == nil:
+		both.countries = m.countries
+	default:
+		for _, country := range o.countries {
+			if slices.Contains(m.countries, country) {
+				both.countries = append(both.countries, country)
+			}
+		}
+		if both.countries == nil {
+			return routeMatch{}, false
+		}
+	}
+
+	return both, true
+}
+
+// canonicalPattern returns p with its parameters unnamed, so that patterns
+// matching the same paths compare equal.
+func canonicalPattern(p *pathPattern) string {
+	var b strings.Builder
+	for _, s := range p.segments {
+		b.WriteByte('/')
+		switch {
+		case s.rest:
+			b.WriteString("{...}")
+		case s.param != "":
+			b.WriteString("{}")
+		default:
+			b.WriteString(s.literal)
+		}
+	}
+
+	return b.String()
+}
+
+// patternsIntersect reports whether some path may match both a and b.
+func patternsIntersect(a, b *pathPattern, fold, tolerant bool) bool {
+	as, bs := a.segments, b.segments
+	if tolerant {
+		as, bs = a.bare, b.bare
+	}
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		if x.rest || y.rest {
+			return true
+		}
+		if x.param != "" || y.param != "" {
+			continue
+		}
+		if x.literal != y.literal && !(fold && strings.EqualFold(x.literal, y.literal)) {
+			return false
+		}
+	}
+
+	return len(as) == len(bs) ||
+		len(as) == len(bs)+1 && as[len(bs)].rest ||
+		len(bs) == len(as)+1 && bs[len(as)].rest
+}
+
+func (m routeMatch) String() string {
+	paths := fmt.Sprintf("paths starting with %q", m.prefix)
+	if m.pattern != nil {
+		paths = fmt.Sprintf("paths matching %q", m.source)
+	}
+	if m.countries == nil {
+		return paths
+	}
+
+	return fmt.Sprintf("%s from %s", paths, strings.Join(m.countries, ", "))
+}
+
+// analyzeRoutes reports the routes that can never match and the routes
+// whose outcome depends on their order relative to an earlier route. A
+// route shadowed by an earlier one is reported once, for the first route
+// shadowing it.
+func analyzeRoutes(routes []Route) []RouteConflict {
+	matches := make([]routeMatch, len(routes))
+	invalid := make([]bool, len(routes))
+	for i, r := range routes {
+		var err error
+		matches[i], err = matchOf(r)
+		// Invalid patterns are reported by compile
+		invalid[i] = err != nil
+	}
+
+	var conflicts []RouteConflict
+	for j, r := range routes {
+		path := routePath(j, r.Name)
+		if invalid[j] {
+			continue
+		}
+		if matches[j].none {
+			conflicts = append(conflicts, RouteConflict{
+				Kind:   ConflictUnreachable,
+				Route:  path,
+				Detail: fmt.Sprintf("path prefix %q excludes grpc service %q", r.PathPrefix, r.GRPCService),
+			})
+			continue
+		}
+		for i := range j {
+			if matches[i].none || invalid[i] {
+				continue
+			}
+			other := routePath(i, routes[i].Name)
+			if matches[i].contains(matches[j]) {
+				c := RouteConflict{Kind: ConflictUnreachable, Route: path, Other: other,
+					Detail: fmt.Sprintf("shadowed by %s, which matches every request it matches", other)}
+				if matches[j].contains(matches[i]) {
+					c.Kind, c.Detail = ConflictDuplicate, fmt.Sprintf("matches the same requests as %s", other)
+				}
+				conflicts = append(conflicts, c)
+				break
+			}
+			if both, ok := matches[i].intersect(matches[j]); ok && !matches[j].contains(matches[i]) {
+				conflicts = append(conflicts, RouteConflict{
+					Kind:   ConflictOverlap,
+					Route:  path,
+					Other:  other,
+					Detail: fmt.Sprintf("overlaps %s on %s, which go to %s first", other, both, other),
+				})
+			}
+		}
+	}
+
+	return conflicts
+}
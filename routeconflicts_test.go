@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conflictList renders conflicts as "kind route other" lines.
+func conflictList(conflicts []RouteConflict) []string {
+	var got []string
+	for _, c := range conflicts {
+		got = append(got, strings.TrimSpace(string(c.Kind)+" "+c.Route+" "+c.Other))
+	}
+	return got
+}
+
+func TestAnalyzeRoutes_ShadowedPrefixes(t *testing.T) {
+	got := conflictList(analyzeRoutes([]Route{
+		{Name: "v2", PathPrefix: "/api/v2"},
+		{Name: "api", PathPrefix: "/api"},             // broader, after the specific route: fine
+		{Name: "v2-beta", PathPrefix: "/api/v2/beta"}, // shadowed by v2 first
+		{Name: "api-again", PathPrefix: "/api"},
+		{Name: "apix", PathPrefix: "/apix"}, // "/api" is a prefix of "/apix" too
+		{Name: "other", PathPrefix: "/other"},
+	}))
+	want := []string{
+		"unreachable routes[v2-beta] routes[v2]",
+		"duplicate routes[api-again] routes[api]",
+		"unreachable routes[apix] routes[api]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	if got := analyzeRoutes([]Route{{PathPrefix: "/"}, {Name: "api", PathPrefix: "/api"}}); len(got) != 1 ||
+		got[0].Route != "routes[api]" || got[0].Other != "routes[0]" {
+		t.Errorf("Expected a catch-all to shadow later routes, got %+v", got)
+	}
+}
+
+func TestAnalyzeRoutes_WildcardAndExactCountries(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		routes []Route
+		want   []string
+	}{
+		{
+			"exact before wildcard",
+			[]Route{{Name: "us", PathPrefix: "/api", Countries: []string{"US"}}, {Name: "all", PathPrefix: "/api"}},
+			nil,
+		},
+		{
+			"wildcard before exact",
+			[]Route{{Name: "all", PathPrefix: "/api"}, {Name: "us", PathPrefix: "/api", Countries: []string{"US"}}},
+			[]string{"unreachable routes[us] routes[all]"},
+		},
+		{
+			"exact subset",
+			[]Route{{Name: "na", PathPrefix: "/", Countries: []string{"US", "CA"}}, {Name: "ca", PathPrefix: "/api", Countries: []string{"CA"}}},
+			[]string{"unreachable routes[ca] routes[na]"},
+		},
+		{
+			"partial overlap",
+			[]Route{{Name: "na", PathPrefix: "/api", Countries: []string{"US", "CA"}}, {Name: "v2", PathPrefix: "/api/v2", Countries: []string{"CA", "DE"}}},
+			[]string{"overlap routes[v2] routes[na]"},
+		},
+		{
+			"wildcard prefix, exact countries",
+			[]Route{{Name: "us", PathPrefix: "/", Countries: []string{"US"}}, {Name: "api", PathPrefix: "/api"}},
+			[]string{"overlap routes[api] routes[us]"},
+		},
+		{
+			"disjoint countries",
+			[]Route{{Name: "us", PathPrefix: "/", Countries: []string{"US"}}, {Name: "de", PathPrefix: "/api", Countries: []string{"DE"}}},
+			nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := conflictList(analyzeRoutes(tt.routes)); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAnalyzeRoutes_GRPCService(t *testing.T) {
+	got := analyzeRoutes([]Route{
+		{Name: "greeter", GRPCService: "helloworld.Greeter"},
+		{Name: "greeter-v2", GRPCService: "helloworld.GreeterV2"}, // not shadowed by the service name prefix
+		{Name: "mismatch", PathPrefix: "/api", GRPCService: "helloworld.Greeter"},
+		{Name: "say", PathPrefix: "/helloworld.Greeter/SayHello"},
+	})
+	want := []string{"unreachable routes[mismatch]", "unreachable routes[say] routes[greeter]"}
+	if strings.Join(conflictList(got), "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected %q, got %q", want, conflictList(got))
+	}
+	if !strings.Contains(got[0].Detail, "excludes grpc service") {
+		t.Errorf("Expected the contradiction to be explained, got %q", got[0].Detail)
+	}
+}
+
+func TestRouteConflicts_CheckAndDump(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	write := func(strict bool) {
+		data := `{
+			"port": "8000",
+			"servers": [{"address": "http://server1.com"}],
+			"routes": [
+				{"name": "all", "path_prefix": "/"},
+				{"name": "api", "path_prefix": "/api"}
+			],
+			"strict_routes": ` + map[bool]string{false: "false", true: "true"}[strict] + `
+		}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(false)
+	var out strings.Builder
+	if code := runCheck([]string{path}, &out); code != 0 {
+		t.Fatalf("Expected conflicts to only warn, got %d: %s", code, out.String())
+	}
+	if want := "warning: routes[api]: unreachable: shadowed by routes[all]"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/config", nil))
+	if want := `"route_conflicts":[{"kind":"unreachable","route":"routes[api]","other":"routes[all]"`; !strings.Contains(rw.Body.String(), want) {
+		t.Errorf("Expected the config dump to contain %s, got %s", want, rw.Body.String())
+	}
+
+	write(true)
+	out.Reset()
+	if code := runCheck([]string{path}, &out); code != 1 {
+		t.Errorf("Expected strict routes to fail the check, got %d", code)
+	}
+	if want := "error: routes[api]: unreachable: shadowed by routes[all]"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TrailingSlash is the policy of a route for paths that differ from its
+// path prefix or pattern only by a trailing slash.
+type TrailingSlash string
+
+const (
+	// TrailingSlashStrict matches paths as the route writes them. It is
+	// the default.
+	TrailingSlashStrict TrailingSlash = "strict"
+
+	// TrailingSlashIgnore matches paths with or without a trailing slash
+	// and forwards them as received.
+	TrailingSlashIgnore TrailingSlash = "ignore"
+
+	// TrailingSlashStrip matches paths with or without a trailing slash
+	// and forwards them without.
+	TrailingSlashStrip TrailingSlash = "strip"
+
+	// TrailingSlashRedirect matches paths with or without a trailing slash
+	// and redirects those not written as the route writes them with 308.
+	TrailingSlashRedirect TrailingSlash = "redirect"
+)
+
+// pathPattern is a compiled Route.PathPattern.
+type pathPattern struct {
+	// segments are the segments after the leading slash. A pattern with a
+	// trailing slash ends with an empty literal segment.
+	segments []patternSegment
+
+	// bare are the segments matched when trailing slashes are tolerated.
+	bare []patternSegment
+
+	// prefix is the literal start of every path matched.
+	prefix string
+
+	// lead is the number of literal segments in prefix.
+	lead int
+
+	names []string
+	slash bool
+	rest  bool
+}
+
+// patternSegment is a literal segment or, if param is set, a parameter.
+type patternSegment struct {
+	literal string
+	param   string
+	rest    bool
+}
+
+// parsePathPattern compiles a pattern such as "/users/{id}/avatar", in
+// which {id} matches a non-empty segment and a final {rest...} the
+// remainder of the path, possibly empty.
+func parsePathPattern(pattern string) (*pathPattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("path pattern %q must start with /", pattern)
+	}
+	p := &pathPattern{}
+	parts := strings.Split(pattern[1:], "/")
+	literal := true
+	for i, part := range parts {
+		name, isParam := strings.CutPrefix(part, "{")
+		if isParam {
+			var ok bool
+			if name, ok = strings.CutSuffix(name, "}"); !ok {
+				return nil, fmt.Errorf("path pattern %q: parameter %q must span a whole segment", pattern, part)
+			}
+		}
+		if !isParam {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("path pattern %q: parameter in %q must span a whole segment", pattern, part)
+			}
+			p.segments = append(p.segments, patternSegment{literal: part})
+			if literal {
+				p.prefix += "/" + part
+				p.lead++
+			}
+			continue
+		}
+
+		seg := patternSegment{}
+		seg.param, seg.rest = strings.CutSuffix(name, "...")
+		if seg.rest && i < len(parts)-1 {
+			return nil, fmt.Errorf("path pattern %q: %q must be the last segment", pattern, part)
+		}
+		if !validParamName(seg.param) {
+			return nil, fmt.Errorf("path pattern %q: invalid parameter name %q", pattern, seg.param)
+		}
+		if slices.Contains(p.names, seg.param) {
+			return nil, fmt.Errorf("path pattern %q: parameter %q appears twice", pattern, seg.param)
+		}
+		p.names = append(p.names, seg.param)
+		p.segments = append(p.segments, seg)
+		if literal {
+			p.prefix += "/"
+			literal = false
+		}
+	}
+	p.rest = p.segments[len(p.segments)-1].rest
+	p.slash = len(p.segments) > 1 && p.segments[len(p.segments)-1] == patternSegment{}
+	p.bare = p.segments
+	if p.slash {
+		p.bare = p.segments[:len(p.segments)-1]
+	}
+
+	return p, nil
+}
+
+// validParamName reports whether name is a parameter name: letters,
+// digits and underscores, not starting with a digit.
+func validParamName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// match reports whether path matches p, calling capture, if not nil, with
+// the value of every parameter. Literal segments are compared ignoring
+// case if fold is set, and trailing slashes are ignored if tolerant is.
+func (p *pathPattern) match(path string, fold, tolerant bool, capture func(name, value string)) bool {
+	// Parameters follow prefix, which trailing slashes never change
+	if !strings.HasPrefix(path, "/") || len(p.names) > 0 && !hasPathPrefix(path, p.prefix, fold) {
+		return false
+	}
+	rest, segments := path[1:], p.segments
+	if tolerant && !p.rest && len(path) > 1 {
+		rest, segments = strings.TrimSuffix(rest, "/"), p.bare
+	}
+	if len(p.names) > 0 {
+		if len(rest) < len(p.prefix)-1 {
+			return false // the trailing slash of the prefix was trimmed
+		}
+		rest, segments = rest[len(p.prefix)-1:], segments[p.lead:]
+	}
+	for i, s := range segments {
+		if s.rest {
+			if capture != nil {
+				capture(s.param, rest)
+			}
+			return true
+		}
+		seg, tail, more := rest, "", false
+		if j := strings.IndexByte(rest, '/'); j >= 0 {
+			seg, tail, more = rest[:j], rest[j+1:], true
+		}
+		if more != (i < len(segments)-1) {
+			return false
+		}
+		switch {
+		case s.param != "":
+			if seg == "" {
+				return false
+			}
+			if capture != nil {
+				capture(s.param, seg)
+			}
+		case seg != s.literal && !(fold && strings.EqualFold(seg, s.literal)):
+			return false
+		}
+		rest = tail
+	}
+
+	return true
+}
+
+// tolerant reports whether r matches paths with or without a trailing
+// slash.
+func (r *Route) tolerant() bool {
+	return r.TrailingSlash != "" && r.TrailingSlash != TrailingSlashStrict
+}
+
+// matchesPath reports whether the path prefix or pattern of r matches
+// path.
+func (r *Route) matchesPath(path string) bool {
+	if r.path != nil {
+		return r.path.match(path, r.CaseInsensitive, r.tolerant(), nil)
+	}
+	prefix := r.PathPrefix
+	if hasPathPrefix(path, prefix, r.CaseInsensitive) {
+		return true
+	}
+
+	// "/api" matches "/api/" when tolerant
+	return r.tolerant() && len(prefix) > 1 && strings.HasSuffix(prefix, "/") &&
+		len(path) == len(prefix)-1 && hasPathPrefix(path, prefix[:len(prefix)-1], r.CaseInsensitive)
+}
+
+// hasPathPrefix reports whether path starts with prefix, ignoring case if
+// fold is set.
+func hasPathPrefix(path, prefix string, fold bool) bool {
+	if !fold {
+		return strings.HasPrefix(path, prefix)
+	}
+
+	return len(path) >= len(prefix) && strings.EqualFold(path[:len(prefix)], prefix)
+}
+
+// compile checks the path matching settings of r and compiles its pattern.
+// Routes are compiled when the configuration is loaded, so that matching
+// requests never parses patterns.
+func (r *Route) compile() error {
+	switch r.TrailingSlash {
+	case "", TrailingSlashStrict, TrailingSlashIgnore, TrailingSlashStrip, TrailingSlashRedirect:
+	default:
+		return fmt.Errorf("unknown trailing_slash %q", r.TrailingSlash)
+	}
+	if r.PathPattern != "" {
+		if r.PathPrefix != "" {
+			return fmt.Errorf("path_prefix and path_pattern are mutually exclusive")
+		}
+		if r.path == nil {
+			p, err := parsePathPattern(r.PathPattern)
+			if err != nil {
+				return err
+			}
+			r.path = p
+		}
+	}
+	for name, value := range r.SetHeaders {
+		if _, err := expandPathParams(value, r.paramNames(), nil); err != nil {
+			return fmt.Errorf("set_headers: %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// compileRoutes returns a copy of routes compiled.
+func compileRoutes(routes []Route) ([]Route, error) {
+	compiled := slices.Clone(routes)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", routePath(i, compiled[i].Name), err)
+		}
+	}
+
+	return compiled, nil
+}
+
+// paramNames returns the names of the path parameters of r.
+func (r *Route) paramNames() []string {
+	if r.path == nil {
+		return nil
+	}
+
+	return r.path.names
+}
+
+// PathParam returns the value of the named parameter the pattern of the
+// request's route captured from its path, e.g. for a key extractor
+// registered with RegisterKeyExtractor.
+func PathParam(req *http.Request, name string) (string, bool) {
+	return requestInfo(req).PathParam(name)
+}
+
+// expandPathParams replaces the {path.<name>} placeholders of value with
+// the parameters in params. Placeholders must name one of names.
+func expandPathParams(value string, names []string, params map[string]string) (string, error) {
+	if !strings.ContainsAny(value, "{}") {
+		return value, nil
+	}
+	var b strings.Builder
+	rest := value
+	for rest != "" {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if rest[start] == '}' || end < 0 {
+			return "", fmt.Errorf("unbalanced braces in %q", value)
+		}
+		name, ok := strings.CutPrefix(rest[start+1:start+end], "path.")
+		if !ok || !slices.Contains(names, name) {
+			return "", fmt.Errorf("unknown placeholder %q, want {path.<name>} with a parameter of path_pattern", rest[start:start+end+1])
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(params[name])
+		rest = rest[start+end+1:]
+	}
+
+	return b.String(), nil
+}
+
+// applyRoutePath applies the path settings of the route of req: it
+// redirects or strips trailing slashes as its policy asks, captures the
+// parameters of its pattern into the request's info and sets its headers.
+// It reports whether req was answered with a redirect.
+func (lb *LoadBalancer) applyRoutePath(rw http.ResponseWriter, req *http.Request) bool {
+	route := lb.matchRoute(req)
+	if route == nil {
+		return false
+	}
+	path := req.URL.Path
+	if route.TrailingSlash == TrailingSlashRedirect {
+		if want := route.canonicalPath(path); want != path {
+			u := *req.URL
+			u.Path, u.RawPath = want, ""
+			http.Redirect(rw, req, u.RequestURI(), http.StatusPermanentRedirect)
+			return true
+		}
+	}
+	if route.TrailingSlash == TrailingSlashStrip && len(path) > 1 && strings.HasSuffix(path, "/") {
+		req.URL.Path = strings.TrimSuffix(path, "/")
+		req.URL.RawPath = strings.TrimSuffix(req.URL.RawPath, "/")
+	}
+
+	var params map[string]string
+	if route.path != nil && len(route.path.names) > 0 {
+		params = make(map[string]string, len(route.path.names))
+		route.path.match(req.URL.Path, route.CaseInsensitive, route.tolerant(), func(name, value string) {
+			params[name] = value
+		})
+		if info := requestInfo(req); info != nil {
+			info.pathParams = params
+		}
+	}
+	for name, value := range route.SetHeaders {
+		expanded, _ := expandPathParams(value, route.paramNames(), params)
+		req.Header.Set(name, expanded)
+	}
+
+	return false
+}
+
+// canonicalPath returns path with or without a trailing slash as r writes
+// its pattern or prefix. Paths below a prefix are canonical either way.
+func (r *Route) canonicalPath(path string) string {
+	if len(path) <= 1 {
+		return path
+	}
+	slashed := strings.HasSuffix(path, "/")
+	switch {
+	case r.path != nil && r.path.rest:
+		return path
+	case r.path != nil && r.path.slash && !slashed:
+		return path + "/"
+	case r.path != nil && !r.path.slash && slashed:
+		return strings.TrimSuffix(path, "/")
+	case r.path == nil && len(path) == len(r.PathPrefix)-1:
+		return path + "/"
+	}
+
+	return path
+}
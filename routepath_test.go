@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPathBackend returns a server labelled role=name that echoes the path
+// and X-User header it received.
+func newPathBackend(t *testing.T, name string) Server {
+	return newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Backend", name)
+		rw.Header().Set("X-Path", req.URL.Path)
+		rw.Header().Set("X-User", req.Header.Get("X-User"))
+	}, WithLabels(map[string]string{"role": name}))
+}
+
+// roleSelector selects the servers labelled role=name.
+func roleSelector(name string) Selector {
+	return Selector{{Key: "role", Operator: OpEquals, Values: []string{name}}}
+}
+
+func TestPathPattern_Parse(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		valid   bool
+		prefix  string
+	}{
+		{"/users/{id}/avatar", true, "/users/"},
+		{"/files/{path...}", true, "/files/"},
+		{"/docs/", true, "/docs/"},
+		{"/{tenant}/v1", true, "/"},
+		{"users/{id}", false, ""},
+		{"/users/{id", false, ""},
+		{"/files/{name}.txt", false, ""},
+		{"/users/{1st}", false, ""},
+		{"/users/{}", false, ""},
+		{"/a/{id}/b/{id}", false, ""},
+		{"/files/{path...}/raw", false, ""},
+	} {
+		p, err := parsePathPattern(tt.pattern)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid %t, got %v", tt.pattern, tt.valid, err)
+			continue
+		}
+		if tt.valid && p.prefix != tt.prefix {
+			t.Errorf("%q: expected prefix %q, got %q", tt.pattern, tt.prefix, p.prefix)
+		}
+	}
+}
+
+func TestPathPattern_Match(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		path     string
+		fold     bool
+		tolerant bool
+		want     string // captures, or "-" for no match
+	}{
+		{"/users/{id}/avatar", "/users/42/avatar", false, false, "id=42"},
+		{"/users/{id}/avatar", "/users//avatar", false, false, "-"},
+		{"/users/{id}/avatar", "/users/42/avatar/x", false, false, "-"},
+		{"/users/{id}/avatar", "/users/42", false, false, "-"},
+		{"/users/{id}/avatar", "/Users/42/AVATAR", false, false, "-"},
+		{"/users/{id}/avatar", "/Users/42/AVATAR", true, false, "id=42"},
+		{"/users/{id}/avatar", "/users/42/avatar/", false, false, "-"},
+		{"/users/{id}/avatar", "/users/42/avatar/", false, true, "id=42"},
+		{"/users/{id}", "/users/", false, true, "-"},
+		{"/users/{id}", "/USERS/7/", true, true, "id=7"},
+		{"/docs/", "/docs", false, false, "-"},
+		{"/docs/", "/docs", false, true, ""},
+		{"/files/{path...}", "/files/a/b.txt", false, false, "path=a/b.txt"},
+		{"/files/{path...}", "/files/", false, false, "path="},
+		{"/files/{path...}", "/files", false, true, "-"},
+		{"/", "/", false, true, ""},
+		{"/", "/x", false, true, "-"},
+	} {
+		p, err := parsePathPattern(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var captures []string
+		got := "-"
+		if p.match(tt.path, tt.fold, tt.tolerant, func(name, value string) {
+			captures = append(captures, name+"="+value)
+		}) {
+			got = strings.Join(captures, ",")
+		}
+		if got != tt.want {
+			t.Errorf("%q on %q (fold %t, tolerant %t): expected %q, got %q", tt.pattern, tt.path, tt.fold, tt.tolerant, tt.want, got)
+		}
+	}
+}
+
+func TestRoute_CaseInsensitive(t *testing.T) {
+	api, web := newPathBackend(t, "api"), newPathBackend(t, "web")
+	lb := newTestLoadBalancer(t, []Server{api, web}, WithRoutes(
+		Route{Name: "api", PathPrefix: "/api/", CaseInsensitive: true, Selector: roleSelector("api")},
+		Route{Name: "admin", PathPrefix: "/admin/", Selector: roleSelector("api")},
+		Route{Name: "web", PathPrefix: "/", Selector: roleSelector("web")},
+	))
+
+	for path, want := range map[string]string{
+		"/api/users": "api",
+		"/API/users": "api",
+		"/Api/users": "api",
+		"/admin/x":   "api",
+		"/ADMIN/x":   "web",
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		if got := rw.Header().Get("X-Backend"); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+		if got := rw.Header().Get("X-Path"); got != path {
+			t.Errorf("%s: expected the path forwarded as received, got %s", path, got)
+		}
+	}
+}
+
+func TestRoute_PathParamsFeedAffinity(t *testing.T) {
+	var servers []Server
+	for i := range 4 {
+		servers = append(servers, newPathBackend(t, fmt.Sprintf("s%d", i)))
+	}
+	strategies, err := newStrategyChain([]string{"consistent-hash:path-param:id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, servers, WithRoutes(Route{
+		Name:        "avatars",
+		PathPattern: "/users/{id}/avatar",
+		Strategies:  strategies,
+		SetHeaders:  map[string]string{"X-User": "user-{path.id}"},
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	used := map[string]bool{}
+	for id := range 32 {
+		path := fmt.Sprintf("/users/%d/avatar", id)
+		first := serve(path)
+		if got := first.Header().Get("X-User"); got != fmt.Sprintf("user-%d", id) {
+			t.Fatalf("Expected the header placeholder expanded, got %q", got)
+		}
+		for range 3 {
+			if got := serve(path).Header().Get("X-Backend"); got != first.Header().Get("X-Backend") {
+				t.Fatalf("Expected user %d to stick to %s, got %s", id, first.Header().Get("X-Backend"), got)
+			}
+		}
+		used[first.Header().Get("X-Backend")] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Expected users to be spread over the servers, got %v", used)
+	}
+
+	// Paths the pattern does not match take the default chain
+	if rw := serve("/users/1/profile"); rw.Header().Get("X-User") != "" {
+		t.Errorf("Expected no header outside the route, got %q", rw.Header().Get("X-User"))
+	}
+}
+
+func TestRoute_TrailingSlash(t *testing.T) {
+	for _, tt := range []struct {
+		policy   TrailingSlash
+		path     string
+		backend  string // "" for the fallback route
+		location string
+		forward  string
+	}{
+		{TrailingSlashStrict, "/users/7", "users", "", "/users/7"},
+		{TrailingSlashStrict, "/users/7/", "", "", "/users/7/"},
+		{TrailingSlashStrict, "/docs", "", "", "/docs"},
+		{TrailingSlashIgnore, "/users/7/", "users", "", "/users/7/"},
+		{TrailingSlashIgnore, "/docs", "docs", "", "/docs"},
+		{TrailingSlashStrip, "/users/7/", "users", "", "/users/7"},
+		{TrailingSlashStrip, "/docs/guide/", "docs", "", "/docs/guide"},
+		{TrailingSlashRedirect, "/users/7/?size=2", "", "/users/7?size=2", ""},
+		{TrailingSlashRedirect, "/docs", "", "/docs/", ""},
+		{TrailingSlashRedirect, "/docs/guide/", "docs", "", "/docs/guide/"},
+	} {
+		t.Run(string(tt.policy)+" "+tt.path, func(t *testing.T) {
+			users, docs, other := newPathBackend(t, "users"), newPathBackend(t, "docs"), newPathBackend(t, "other")
+			lb := newTestLoadBalancer(t, []Server{users, docs, other}, WithRoutes(
+				Route{Name: "users", PathPattern: "/users/{id}", TrailingSlash: tt.policy, Selector: roleSelector("users")},
+				Route{Name: "docs", PathPrefix: "/docs/", TrailingSlash: tt.policy, Selector: roleSelector("docs")},
+				Route{Name: "other", PathPrefix: "/", Selector: roleSelector("other")},
+			))
+
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, httptest.NewRequest("GET", tt.path, nil))
+			if tt.location != "" {
+				if rw.Code != http.StatusPermanentRedirect || rw.Header().Get("Location") != tt.location {
+					t.Errorf("Expected a redirect to %s, got %d %q", tt.location, rw.Code, rw.Header().Get("Location"))
+				}
+				return
+			}
+			backend := tt.backend
+			if backend == "" {
+				backend = "other"
+			}
+			if got := rw.Header().Get("X-Backend"); got != backend {
+				t.Errorf("Expected %s, got %s", backend, got)
+			}
+			if got := rw.Header().Get("X-Path"); got != tt.forward {
+				t.Errorf("Expected %s forwarded, got %s", tt.forward, got)
+			}
+		})
+	}
+}
+
+func TestRoute_CompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		route Route
+		err   string
+	}{
+		{Route{PathPrefix: "/a", PathPattern: "/a/{id}"}, "mutually exclusive"},
+		{Route{PathPattern: "/a/{id"}, "must span a whole segment"},
+		{Route{PathPrefix: "/a", TrailingSlash: "sometimes"}, "unknown trailing_slash"},
+		{Route{PathPattern: "/a/{id}", SetHeaders: map[string]string{"X-Id": "{path.name}"}}, "unknown placeholder"},
+		{Route{PathPrefix: "/a", SetHeaders: map[string]string{"X-Id": "{path.id}"}}, "unknown placeholder"},
+		{Route{PathPattern: "/a/{id}", SetHeaders: map[string]string{"X-Id": "{path.id"}}, "unbalanced braces"},
+	} {
+		_, err := NewLoadBalancer("0", []Server{newBackendServer(t, okHandler)}, WithRoutes(tt.route))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: expected an error containing %q, got %v", tt.route, tt.err, err)
+		}
+	}
+
+	cfg := &Config{
+		Port:    "0",
+		Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		Routes:  []RouteConfig{{Name: "users", PathPattern: "/users/{id}/{id}"}},
+	}
+	if _, err := cfg.Build(); err == nil || !strings.Contains(err.Error(), "routes[users]: path pattern") {
+		t.Errorf("Expected the pattern rejected at config load, got %v", err)
+	}
+}
+
+func TestAnalyzeRoutes_Patterns(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		routes []Route
+		want   []string
+	}{
+		{
+			"prefix shadows pattern",
+			[]Route{{Name: "users", PathPrefix: "/users/"}, {Name: "avatar", PathPattern: "/users/{id}/avatar"}},
+			[]string{"unreachable routes[avatar] routes[users]"},
+		},
+		{
+			"same pattern",
+			[]Route{{Name: "a", PathPattern: "/users/{id}"}, {Name: "b", PathPattern: "/users/{uid}"}},
+			[]string{"duplicate routes[b] routes[a]"},
+		},
+		{
+			"disjoint patterns",
+			[]Route{{Name: "avatar", PathPattern: "/users/{id}/avatar"}, {Name: "posts", PathPattern: "/users/{id}/posts"}},
+			nil,
+		},
+		{
+			"pattern before broader prefix",
+			[]Route{{Name: "avatar", PathPattern: "/users/{id}/avatar"}, {Name: "users", PathPrefix: "/users/"}},
+			nil,
+		},
+		{
+			"pattern overlaps prefix",
+			[]Route{{Name: "user", PathPattern: "/users/{id}"}, {Name: "admin", PathPrefix: "/users/admin"}},
+			[]string{"overlap routes[admin] routes[user]"},
+		},
+		{
+			"case-sensitive does not shadow case-insensitive",
+			[]Route{{Name: "api", PathPrefix: "/api"}, {Name: "API", PathPrefix: "/api/v1", CaseInsensitive: true}},
+			[]string{"overlap routes[API] routes[api]"},
+		},
+		{
+			"case-insensitive shadows",
+			[]Route{{Name: "API", PathPrefix: "/API", CaseInsensitive: true}, {Name: "v1", PathPrefix: "/api/v1"}},
+			[]string{"unreachable routes[v1] routes[API]"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := conflictList(analyzeRoutes(tt.routes))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkMatchRoute(b *testing.B) {
+	var routes []Route
+	for i := range 20 {
+		routes = append(routes,
+			Route{Name: fmt.Sprintf("prefix%d", i), PathPrefix: fmt.Sprintf("/service%d/", i), CaseInsensitive: i%2 == 0},
+			Route{Name: fmt.Sprintf("pattern%d", i), PathPattern: fmt.Sprintf("/tenants/{tenant}/items%d/{id}", i), TrailingSlash: TrailingSlashIgnore},
+		)
+	}
+	lb, err := NewLoadBalancer("0", nil, WithAllowEmpty(), WithRoutes(routes...))
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/tenants/acme/items19/42/", nil)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if lb.matchRoute(req) == nil {
+			b.Fatal("Expected a route")
+		}
+	}
+}
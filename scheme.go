@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// clientScheme returns the scheme the client of req connected with, which
+// is independent of the scheme of the server the request is sent to.
+func clientScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// UpstreamTLS verifies the certificate of a server reached over https.
+// ServerName overrides the name verified and sent in SNI, RootCAs replaces
+// the system pool and InsecureSkipVerify disables verification.
+type UpstreamTLS struct {
+	ServerName         string
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+}
+
+// WithUpstreamTLS sets how the certificate of the server is verified. It
+// only applies to servers whose address is an https URL.
+func WithUpstreamTLS(t UpstreamTLS) ServerOption {
+	return func(s *simpleServer) {
+		s.transport.TLSClientConfig = &tls.Config{
+			ServerName:         t.ServerName,
+			RootCAs:            t.RootCAs,
+			InsecureSkipVerify: t.InsecureSkipVerify,
+			ClientSessionCache: s.transport.TLSClientConfig.ClientSessionCache,
+		}
+	}
+}
+
+// ExternalScheme adjusts the responses of a server to the scheme its
+// clients connected with, for servers that do not honour
+// X-Forwarded-Proto. With Locations, absolute Location URLs addressing the
+// host the client addressed are given the client's scheme; Locations
+// naming the server itself are left to the redirect policy. With
+// SecureCookies, cookies set in responses to https clients are marked
+// Secure and the Secure attribute is removed from cookies set in responses
+// to http clients, which would otherwise drop them. SameSite, if set, is
+// added to cookies that have no SameSite attribute.
+type ExternalScheme struct {
+	Locations     bool
+	SecureCookies bool
+	SameSite      http.SameSite
+}
+
+// WithExternalScheme adjusts the responses of the server to the scheme of
+// its clients.
+func WithExternalScheme(e ExternalScheme) ServerOption {
+	return func(s *simpleServer) {
+		s.external = &e
+	}
+}
+
+// adjust rewrites the Location and Set-Cookie headers of resp, the
+// response to the proxied request req, for the client's scheme.
+func (e *ExternalScheme) adjust(req *http.Request, resp *http.Response) {
+	scheme := clientScheme(req)
+	if e.Locations {
+		if loc, err := url.Parse(resp.Header.Get("Location")); err == nil && loc.IsAbs() &&
+			strings.EqualFold(loc.Host, req.Host) && loc.Scheme != scheme {
+			loc.Scheme = scheme
+			resp.Header.Set("Location", loc.String())
+		}
+	}
+	if !e.SecureCookies && e.SameSite == 0 {
+		return
+	}
+	cookies := resp.Header["Set-Cookie"]
+	for i, line := range cookies {
+		cookies[i] = e.adjustCookie(line, scheme == "https")
+	}
+}
+
+// adjustCookie returns the Set-Cookie line with its Secure and SameSite
+// attributes adjusted.
+func (e *ExternalScheme) adjustCookie(line string, secure bool) string {
+	parts := strings.Split(line, ";")
+	adjusted := parts[:1]
+	hasSecure, hasSameSite := false, false
+	for _, part := range parts[1:] {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "secure":
+			hasSecure = true
+			if e.SecureCookies && !secure {
+				continue
+			}
+		case "samesite":
+			hasSameSite = true
+		}
+		adjusted = append(adjusted, part)
+	}
+	if e.SecureCookies && secure && !hasSecure {
+		adjusted = append(adjusted, " Secure")
+	}
+	if !hasSameSite {
+		switch e.SameSite {
+		case http.SameSiteLaxMode:
+			adjusted = append(adjusted, " SameSite=Lax")
+		case http.SameSiteStrictMode:
+			adjusted = append(adjusted, " SameSite=Strict")
+		case http.SameSiteNoneMode:
+			adjusted = append(adjusted, " SameSite=None")
+		}
+	}
+
+	return strings.Join(adjusted, ";")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// schemeBackend answers with a redirect to next on the host the client
+// addressed, in the given scheme, setting cookies, and records the scheme
+// it was reached over and the X-Forwarded-Proto it got.
+func schemeBackend(scheme string, cookies []string, seen *[2]string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		seen[0], seen[1] = "http", req.Header.Get("X-Forwarded-Proto")
+		if req.TLS != nil {
+			seen[0] = "https"
+		}
+		for _, c := range cookies {
+			rw.Header().Add("Set-Cookie", c)
+		}
+		rw.Header().Set("Location", scheme+"://"+req.Host+"/next")
+		rw.WriteHeader(http.StatusFound)
+	}
+}
+
+func TestExternalScheme_HTTPSInHTTPUp(t *testing.T) {
+	var seen [2]string
+	backend := httptest.NewServer(schemeBackend("http", []string{"sid=1; Path=/", "pref=2; Secure; SameSite=Strict"}, &seen))
+	defer backend.Close()
+	server, err := newSimpleServer(backend.URL, WithExternalScheme(ExternalScheme{
+		Locations: true, SecureCookies: true, SameSite: http.SameSiteLaxMode,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	req := httptest.NewRequest("GET", "https://shop.example/", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	if seen != [2]string{"http", "https"} {
+		t.Errorf("Expected a plain HTTP request forwarded for https, got %v", seen)
+	}
+	if loc := rw.Header().Get("Location"); loc != "https://shop.example/next" {
+		t.Errorf("Expected the Location in the client's scheme, got %q", loc)
+	}
+	want := []string{"sid=1; Path=/; Secure; SameSite=Lax", "pref=2; Secure; SameSite=Strict"}
+	if got := rw.Header()["Set-Cookie"]; !slices.Equal(got, want) {
+		t.Errorf("Expected cookies %q, got %q", want, got)
+	}
+}
+
+func TestExternalScheme_HTTPInHTTPSUp(t *testing.T) {
+	var seen [2]string
+	backend := httptest.NewTLSServer(schemeBackend("https", []string{"sid=1; Secure; HttpOnly"}, &seen))
+	defer backend.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+
+	for _, tt := range []struct {
+		external *ExternalScheme
+		location string
+		cookie   string
+	}{
+		{nil, "https://legacy.example/next", "sid=1; Secure; HttpOnly"},
+		{&ExternalScheme{Locations: true, SecureCookies: true}, "http://legacy.example/next", "sid=1; HttpOnly"},
+	} {
+		opts := []ServerOption{WithUpstreamTLS(UpstreamTLS{RootCAs: roots})}
+		if tt.external != nil {
+			opts = append(opts, WithExternalScheme(*tt.external))
+		}
+		server, err := newSimpleServer(backend.URL, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb := newTestLoadBalancer(t, []Server{server})
+
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "http://legacy.example/", nil))
+
+		if rw.Code != http.StatusFound || seen != [2]string{"https", "http"} {
+			t.Fatalf("Expected an https request forwarded for http, got %d and %v", rw.Code, seen)
+		}
+		if loc := rw.Header().Get("Location"); loc != tt.location {
+			t.Errorf("Expected Location %q, got %q", tt.location, loc)
+		}
+		if cookie := rw.Header().Get("Set-Cookie"); cookie != tt.cookie {
+			t.Errorf("Expected cookie %q, got %q", tt.cookie, cookie)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operator is the comparison applied by a selector requirement.
+type Operator string
+
+const (
+	OpEquals    Operator = "="
+	OpNotEquals Operator = "!="
+	OpIn        Operator = "in"
+	OpNotIn     Operator = "notin"
+)
+
+// Requirement is a single label constraint, e.g. "version=v2" or
+// "tier in (premium,gold)".
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Matches reports whether labels satisfy the requirement. A missing label
+// never satisfies = or in, and always satisfies != and notin.
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	found := false
+	if ok {
+		for _, v := range r.Values {
+			if v == value {
+				found = true
+				break
+			}
+		}
+	}
+
+	switch r.Operator {
+	case OpEquals, OpIn:
+		return found
+	case OpNotEquals, OpNotIn:
+		return !found
+	default:
+		return false
+	}
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case OpIn, OpNotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	default:
+		return r.Key + string(r.Operator) + r.Values[0]
+	}
+}
+
+// Selector is a conjunction of label requirements. The zero value matches
+// every set of labels.
+type Selector []Requirement
+
+// Matches reports whether labels satisfy every requirement of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = r.String()
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ParseSelector parses a comma separated list of requirements. Supported
+// forms are "key=value", "key==value", "key!=value", "key in (a,b)" and
+// "key notin (a,b)". An empty string yields an empty selector.
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, fmt.Errorf("parse selector %q: %w", s, err)
+		}
+		selector = append(selector, r)
+	}
+
+	return selector, nil
+}
+
+// splitRequirements splits a selector on commas that are not enclosed in a
+// parenthesised value set.
+func splitRequirements(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func parseRequirement(s string) (Requirement, error) {
+	if i := strings.Index(s, "("); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return Requirement{}, fmt.Errorf("unterminated value set in %q", s)
+		}
+		fields := strings.Fields(s[:i])
+		if len(fields) != 2 {
+			return Requirement{}, fmt.Errorf("malformed set requirement %q", s)
+		}
+		op := Operator(fields[1])
+		if op != OpIn && op != OpNotIn {
+			return Requirement{}, fmt.Errorf("unknown set operator %q", fields[1])
+		}
+		var values []string
+		for _, v := range strings.Split(s[i+1:len(s)-1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return Requirement{}, fmt.Errorf("empty value set in %q", s)
+		}
+		sort.Strings(values)
+
+		return Requirement{Key: fields[0], Operator: op, Values: values}, nil
+	}
+
+	op, sep := OpEquals, "="
+	switch {
+	case strings.Contains(s, "!="):
+		op, sep = OpNotEquals, "!="
+	case strings.Contains(s, "=="):
+		sep = "=="
+	}
+	key, value, ok := strings.Cut(s, sep)
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || key == "" || value == "" {
+		return Requirement{}, fmt.Errorf("malformed requirement %q", s)
+	}
+
+	return Requirement{Key: key, Operator: op, Values: []string{value}}, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		labels   map[string]string
+		want     bool
+	}{
+		{"", map[string]string{"version": "v1"}, true},
+		{"version=v2", map[string]string{"version": "v2"}, true},
+		{"version==v2", map[string]string{"version": "v1"}, false},
+		{"version!=v2", map[string]string{"version": "v1"}, true},
+		{"version!=v2", nil, true},
+		{"tier in (premium, gold)", map[string]string{"tier": "gold"}, true},
+		{"tier in (premium,gold)", map[string]string{"tier": "free"}, false},
+		{"tier notin (free)", map[string]string{"tier": "premium"}, true},
+		{"version=v2,tier in (premium,gold)", map[string]string{"version": "v2", "tier": "premium"}, true},
+		{"version=v2,tier in (premium,gold)", map[string]string{"version": "v1", "tier": "premium"}, false},
+	}
+
+	for _, tt := range tests {
+		selector, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Errorf("ParseSelector(%q) returned error: %v", tt.selector, err)
+			continue
+		}
+		if got := selector.Matches(tt.labels); got != tt.want {
+			t.Errorf("Selector %q matching %v: expected %v, got %v", tt.selector, tt.labels, tt.want, got)
+		}
+	}
+
+	for _, bad := range []string{"version", "=v2", "tier in premium)", "tier in ()", "tier has (a)"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Errorf("Expected ParseSelector(%q) to fail", bad)
+		}
+	}
+}
+
+func TestLoadBalancer_RouteSelector(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true, labels: map[string]string{"version": "v1"}}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true, labels: map[string]string{"version": "v2"}}
+	server3 := &MockServer{addr: "http://server3.com", isAlive: true, labels: map[string]string{"version": "v2", "tier": "premium"}}
+
+	selector, _ := ParseSelector("version=v2")
+	lb := newTestLoadBalancer(t, []Server{server1, server2, server3}, WithRoutes(Route{
+		Name:            "v2",
+		PathPrefix:      "/v2",
+		Selector:        selector,
+		HeaderSelectors: map[string]string{"X-Tier": "tier"},
+	}))
+
+	// Requests on the v2 route rotate between the v2 servers only
+	for i := 0; i < 4; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/items", nil))
+	}
+	if server1.callCount != 0 || server2.callCount != 2 || server3.callCount != 2 {
+		t.Errorf("Expected calls 0/2/2, got %d/%d/%d", server1.callCount, server2.callCount, server3.callCount)
+	}
+
+	// The tier header further narrows selection to the premium server
+	req := httptest.NewRequest("GET", "/v2/items", nil)
+	req.Header.Set("X-Tier", "premium")
+	lb.serveProxy(httptest.NewRecorder(), req)
+	lb.serveProxy(httptest.NewRecorder(), req)
+	if server3.callCount != 4 {
+		t.Errorf("Expected server3 to be called 4 times, got %d", server3.callCount)
+	}
+
+	// Requests outside the route use every server
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if server1.callCount != 1 {
+		t.Errorf("Expected server1 to be called once, got %d", server1.callCount)
+	}
+}
+
+func TestLoadBalancer_EmptySubsetFallback(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true, labels: map[string]string{"version": "v1"}}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: false, labels: map[string]string{"version": "v2"}}
+	selector, _ := ParseSelector("version=v2")
+
+	failing := newTestLoadBalancer(t, []Server{server1, server2}, WithRoutes(Route{
+		PathPrefix: "/", Selector: selector, Fallback: FallbackFail,
+	}))
+	_, err := failing.selectServer(httptest.NewRequest("GET", "/", nil))
+	if !errors.Is(err, ErrNoMatchingServers) {
+		t.Errorf("Expected ErrNoMatchingServers, got %v", err)
+	}
+	rw := httptest.NewRecorder()
+	failing.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", rw.Code)
+	}
+
+	ignoring := newTestLoadBalancer(t, []Server{server1, server2}, WithRoutes(Route{
+		PathPrefix: "/", Selector: selector, Fallback: FallbackIgnore,
+	}))
+	ignoring.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if server1.callCount != 1 {
+		t.Errorf("Expected fallback to server1, got %d calls", server1.callCount)
+	}
+}
+
+func TestAdmin_RuntimeLabelUpdate(t *testing.T) {
+	server1, _ := newSimpleServer("http://server1.com", WithLabels(map[string]string{"version": "v1"}))
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	selector, _ := ParseSelector("version=v2")
+	lb := newTestLoadBalancer(t, []Server{server1, server2}, WithRoutes(Route{
+		PathPrefix: "/", Selector: selector,
+	}))
+	admin := lb.AdminHandler()
+
+	if _, err := lb.selectServer(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNoMatchingServers) {
+		t.Fatalf("Expected ErrNoMatchingServers before update, got %v", err)
+	}
+
+	body := `{"address": "http://server1.com", "labels": {"version": "v2"}}`
+	rw := httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/servers/labels", strings.NewReader(body)))
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	server, err := lb.selectServer(httptest.NewRequest("GET", "/", nil))
+	if err != nil || server.Address() != "http://server1.com" {
+		t.Errorf("Expected server1 after label update, got %v, %v", server, err)
+	}
+
+	// Unknown servers and servers without label support are rejected
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/servers/labels", strings.NewReader(`{"address": "http://unknown.com"}`)))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/servers/labels", strings.NewReader(`{"address": "http://server2.com"}`)))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rw.Code)
+	}
+
+	// Labels are visible in status and metrics
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	var status struct {
+		Servers []ServerStats `json:"servers"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Servers[0].Labels["version"] != "v2" {
+		t.Errorf("Expected status to report version=v2, got %v", status.Servers[0].Labels)
+	}
+
+	rw = httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	want := `lb_server_requests_total{server="http://server1.com",label_version="v2"} 1`
+	if !strings.Contains(rw.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %q, got:\n%s", want, rw.Body.String())
+	}
+}
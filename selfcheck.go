@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// livenessTimeout bounds how long /healthz waits for the load balancer's
+// lock before reporting the process as wedged.
+const livenessTimeout = time.Second
+
+// Readiness configures the /readyz endpoint. MinHealthy is the number of
+// alive, warmed up servers outside maintenance the pool needs for the load
+// balancer to be ready. Probe requests are left out of the access log unless
+// LogProbes is set. MaxProbeAge is how old the newest probe may be for the
+// admin endpoint /lb/pools/{name}/health to succeed, three health intervals
+// of the most often probed server by default.
+type Readiness struct {
+	MinHealthy  int
+	LogProbes   bool
+	MaxProbeAge time.Duration
+}
+
+// defaultReadiness requires one healthy server.
+var defaultReadiness = Readiness{MinHealthy: 1}
+
+// WithReadiness configures the /readyz endpoint.
+func WithReadiness(r Readiness) Option {
+	return func(lb *LoadBalancer) {
+		lb.readiness = r
+	}
+}
+
+// Handler returns the handler of the proxy listeners. It answers /healthz and
+// /readyz itself and proxies everything else, unless the connection is shed
+// for lack of file descriptors.
+func (lb *LoadBalancer) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if lb.shedConn(rw, req) {
+			return
+		}
+		lb.advertiseHTTP3(rw, req)
+		var probe http.HandlerFunc
+		switch req.URL.Path {
+		case "/healthz":
+			probe = lb.handleHealthz
+		case "/readyz":
+			probe = lb.handleReadyz
+		default:
+			lb.serveProxy(rw, req)
+			return
+		}
+
+		if !lb.readiness.LogProbes {
+			probe(rw, req)
+			return
+		}
+		start := time.Now()
+		cw := newCountingResponseWriter(rw)
+		probe(cw, req)
+		lb.logAccess(req, cw, start, accessEntry{})
+	})
+}
+
+// MarkListening records that the proxy listeners are bound and serving, the
+// last step before the load balancer can become ready, and closes Started.
+func (lb *LoadBalancer) MarkListening() {
+	if lb.listening.CompareAndSwap(false, true) {
+		close(lb.started)
+	}
+}
+
+// BeginShutdown makes /readyz fail so that upstream load balancers stop
+// sending traffic before the listeners close.
+func (lb *LoadBalancer) BeginShutdown() {
+	lb.draining.Store(true)
+}
+
+// handleHealthz reports liveness. The process is considered alive as long as
+// the load balancer's lock can be acquired, which every request needs.
+func (lb *LoadBalancer) handleHealthz(rw http.ResponseWriter, req *http.Request) {
+	acquired := make(chan struct{})
+	go func() {
+		lb.mu.Lock()
+		lb.mu.Unlock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		writeJSON(rw, http.StatusOK, map[string]string{"status": "ok"})
+	case <-time.After(livenessTimeout):
+		writeJSON(rw, http.StatusServiceUnavailable, map[string]string{
+			"status": "unhealthy",
+			"reason": fmt.Sprintf("load balancer lock not acquired within %s", livenessTimeout),
+		})
+	}
+}
+
+// readinessReport is the body of /readyz.
+type readinessReport struct {
+	Status         string   `json:"status"`
+	Reasons        []string `json:"reasons,omitempty"`
+	HealthyServers int      `json:"healthy_servers"`
+	MinHealthy     int      `json:"min_healthy_servers"`
+	ConfigSHA256   string   `json:"config_sha256,omitempty"`
+}
+
+// readinessReport evaluates the readiness conditions.
+func (lb *LoadBalancer) readinessReport() readinessReport {
+	lb.mu.Lock()
+	healthy := 0
+	now := lb.now()
+	for _, s := range lb.servers {
+		if _, ok := maintenanceUntil(s, now); ok {
+			continue
+		}
+		if lb.aliveLocked(s, now) && lb.warming[serverName(s)] == nil {
+			healthy++
+		}
+	}
+	lb.mu.Unlock()
+
+	report := readinessReport{
+		Status:         "ready",
+		HealthyServers: healthy,
+		MinHealthy:     lb.readiness.MinHealthy,
+		ConfigSHA256:   lb.configHash,
+	}
+	if !lb.listening.Load() {
+		report.Reasons = append(report.Reasons, "listeners are not bound yet")
+	}
+	if lb.draining.Load() {
+		report.Reasons = append(report.Reasons, "shutting down")
+	}
+	if healthy < lb.readiness.MinHealthy {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("pool default: %d healthy servers, need %d", healthy, lb.readiness.MinHealthy))
+	}
+	if len(report.Reasons) > 0 {
+		report.Status = "not ready"
+	}
+
+	return report
+}
+
+// handleReadyz reports readiness, explaining failures in the body.
+func (lb *LoadBalancer) handleReadyz(rw http.ResponseWriter, req *http.Request) {
+	report := lb.readinessReport()
+	status := http.StatusOK
+	if len(report.Reasons) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, status, report)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// probe requests path through the proxy handler and decodes the JSON body.
+func probe(t *testing.T, lb *LoadBalancer, path string) (int, map[string]any) {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+	var body map[string]any
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid %s body %q: %v", path, rw.Body.String(), err)
+	}
+	return rw.Code, body
+}
+
+func TestReadyz_Transitions(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1, server2}, WithReadiness(Readiness{MinHealthy: 2}))
+
+	// Not ready until the listeners are bound
+	status, body := probe(t, lb, "/readyz")
+	if status != http.StatusServiceUnavailable || !strings.Contains(body["reasons"].([]any)[0].(string), "listeners") {
+		t.Errorf("Expected not ready before listening, got %d %v", status, body)
+	}
+	lb.MarkListening()
+	if status, body := probe(t, lb, "/readyz"); status != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("Expected ready after listening, got %d %v", status, body)
+	}
+
+	// Losing a backend drops below the minimum
+	server2.isAlive = false
+	status, body = probe(t, lb, "/readyz")
+	if status != http.StatusServiceUnavailable || body["healthy_servers"].(float64) != 1 {
+		t.Errorf("Expected not ready with one healthy server, got %d %v", status, body)
+	}
+	server2.isAlive = true
+	if status, _ := probe(t, lb, "/readyz"); status != http.StatusOK {
+		t.Errorf("Expected ready after the backend recovered, got %d", status)
+	}
+
+	// Shutdown fails readiness while liveness still passes
+	lb.BeginShutdown()
+	status, body = probe(t, lb, "/readyz")
+	if status != http.StatusServiceUnavailable || body["reasons"].([]any)[0] != "shutting down" {
+		t.Errorf("Expected not ready during shutdown, got %d %v", status, body)
+	}
+	if status, body := probe(t, lb, "/healthz"); status != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("Expected live during shutdown, got %d %v", status, body)
+	}
+}
+
+func TestProbes_NotProxiedOrLogged(t *testing.T) {
+	server := &MockServer{addr: "http://server1.com", isAlive: true}
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log))
+
+	probe(t, lb, "/healthz")
+	probe(t, lb, "/readyz")
+	if server.callCount != 0 {
+		t.Errorf("Expected probes not to be proxied, got %d calls", server.callCount)
+	}
+	if log.String() != "" {
+		t.Errorf("Expected probes not to be logged, got %s", log.String())
+	}
+
+	// Probe logging can be enabled
+	WithReadiness(Readiness{MinHealthy: 1, LogProbes: true})(lb)
+	probe(t, lb, "/readyz")
+	if entries := accessLogEntries(t, log); len(entries) != 1 || entries[0]["path"] != "/readyz" || entries[0]["status"].(float64) != 503 {
+		t.Errorf("Expected one logged readiness probe, got %v", entries)
+	}
+}
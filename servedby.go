@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// defaultServedByHeader is the response header naming the instance that
+// served a request.
+const defaultServedByHeader = "X-Served-By"
+
+// BackendIdentity controls how the server that handled a request is
+// identified in the served-by header and the access log's backend_id.
+type BackendIdentity string
+
+const (
+	// BackendIdentityNone leaves the server out.
+	BackendIdentityNone BackendIdentity = ""
+
+	// BackendIdentityOpaque identifies the server by a hash of its address,
+	// which is stable across instances without revealing the address.
+	BackendIdentityOpaque BackendIdentity = "opaque"
+
+	// BackendIdentityAddress identifies the server by its address. It exposes
+	// internal addresses to clients and must be chosen explicitly.
+	BackendIdentityAddress BackendIdentity = "address"
+)
+
+// ServedBy configures the served-by response header, whose value is the
+// instance ID optionally followed by the server, as in
+// "X-Served-By: lb-2; backend=9f86d081884c".
+type ServedBy struct {
+	// Header defaults to X-Served-By.
+	Header  string
+	Backend BackendIdentity
+}
+
+// WithServedBy adds the served-by header to proxied responses. It is off by
+// default.
+func WithServedBy(s ServedBy) Option {
+	return func(lb *LoadBalancer) {
+		if s.Header == "" {
+			s.Header = defaultServedByHeader
+		}
+		lb.servedBy = &s
+	}
+}
+
+// WithInstanceID sets the ID that distinguishes this load balancer from
+// others serving the same traffic. It defaults to the hostname.
+func WithInstanceID(id string) Option {
+	return func(lb *LoadBalancer) {
+		lb.instanceID = id
+	}
+}
+
+// defaultInstanceID returns the hostname, or "unknown" if it is not
+// available.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+
+	return host
+}
+
+// backendID identifies server as configured by the served-by header, or
+// returns "" when servers are not identified.
+func (lb *LoadBalancer) backendID(server Server) string {
+	if lb.servedBy == nil || server == nil {
+		return ""
+	}
+
+	switch lb.servedBy.Backend {
+	case BackendIdentityOpaque:
+		return opaqueServerID(server)
+	case BackendIdentityAddress:
+		return server.Address()
+	}
+
+	return ""
+}
+
+// opaqueServerID identifies server by a hash of its name, which is stable
+// across instances and address changes without revealing the address.
+func opaqueServerID(server Server) string {
+	sum := sha256.Sum256([]byte(normalizeAddress(serverName(server))))
+	return hex.EncodeToString(sum[:6])
+}
+
+// setServedBy sets the served-by header on rw for a response from server,
+// which is nil when the load balancer answers itself.
+func (lb *LoadBalancer) setServedBy(rw http.ResponseWriter, server Server) {
+	if lb.servedBy == nil {
+		return
+	}
+
+	value := lb.instanceID
+	if id := lb.backendID(server); id != "" {
+		value = fmt.Sprintf("%s; backend=%s", value, id)
+	}
+	rw.Header().Set(lb.servedBy.Header, value)
+}
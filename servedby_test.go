@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestServedBy_Opaque(t *testing.T) {
+	log := &syncBuffer{}
+	server := &MockServer{addr: "http://10.0.0.4:8080", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log), WithInstanceID("lb-2"),
+		WithServedBy(ServedBy{Backend: BackendIdentityOpaque}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	value := rw.Header().Get("X-Served-By")
+	if !regexp.MustCompile(`^lb-2; backend=[0-9a-f]{12}$`).MatchString(value) {
+		t.Errorf("Expected the instance and an opaque backend ID, got %q", value)
+	}
+	if strings.Contains(value, "10.0.0.4") {
+		t.Errorf("Expected the backend address not to be exposed, got %q", value)
+	}
+
+	// The ID is the same for equivalent addresses
+	if id := lb.backendID(&MockServer{addr: "HTTP://10.0.0.4:8080/"}); !strings.HasSuffix(value, id) {
+		t.Errorf("Expected backend ID %q to be stable, got %q", id, value)
+	}
+
+	entry := accessLogEntries(t, log)[0]
+	if entry["instance"] != "lb-2" || !strings.HasSuffix(value, "="+entry["backend_id"].(string)) {
+		t.Errorf("Expected the access log to carry the same fields, got %v", entry)
+	}
+}
+
+func TestServedBy_Address(t *testing.T) {
+	server := &MockServer{addr: "http://10.0.0.4:8080", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server}, WithInstanceID("lb-2"),
+		WithServedBy(ServedBy{Header: "X-Instance", Backend: BackendIdentityAddress}))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if got := rw.Header().Get("X-Instance"); got != "lb-2; backend=http://10.0.0.4:8080" {
+		t.Errorf("Expected the instance and backend address, got %q", got)
+	}
+	if got := rw.Header().Get("X-Served-By"); got != "" {
+		t.Errorf("Expected only the configured header, got X-Served-By %q", got)
+	}
+
+	// Responses the load balancer makes itself name only the instance
+	lb = newTestLoadBalancer(t, nil, WithAllowEmpty(), WithInstanceID("lb-2"),
+		WithServedBy(ServedBy{Backend: BackendIdentityAddress}))
+	rw = httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("X-Served-By") != "lb-2" {
+		t.Errorf("Expected a 503 served by lb-2, got %d %q", rw.Code, rw.Header().Get("X-Served-By"))
+	}
+}
+
+func TestServedBy_Disabled(t *testing.T) {
+	log := &syncBuffer{}
+	server := &MockServer{addr: "http://10.0.0.4:8080", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log), WithInstanceID("lb-2"))
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if got := rw.Header().Get("X-Served-By"); got != "" {
+		t.Errorf("Expected no served-by header, got %q", got)
+	}
+
+	// The instance is still logged and exported
+	entry := accessLogEntries(t, log)[0]
+	if entry["instance"] != "lb-2" || entry["backend_id"] != "" {
+		t.Errorf("Expected the instance without a backend ID, got %v", entry)
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `lb_instance_info{instance="lb-2"} 1`) {
+		t.Errorf("Expected the instance info metric, got:\n%s", metrics.Body.String())
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a backend requests are proxied to. The load balancer detects
+// optional capabilities by type assertion, so custom implementations can
+// take part in as much of its behaviour as they need:
+//
+//   - Named: a name identifying the server apart from its address; the
+//     address by default.
+//   - Labeled: labels for subset selection; none by default.
+//   - Weighted: relative capacity; weight 1 by default.
+//   - ConcurrencyLimited: a concurrency limit; unlimited by default.
+//   - HealthSettable: liveness set from outside, e.g. by Docker health
+//     checks or restored state; left to IsAlive by default.
+//   - Warmable: custom warm-up before the server is selected; only the
+//     configured warm-up requests by default.
+//   - io.Closer: closed when the server is removed and on shutdown; nothing
+//     to release by default.
+type Server interface {
+	Address() string
+	IsAlive() bool
+	Serve(rw http.ResponseWriter, req *http.Request)
+}
+
+// Named is implemented by servers with a name of their own. The name is
+// the server's identity: it keys metrics, sticky sessions, saved state,
+// log fields and admin API references, so that these survive the server
+// moving to another address. Servers without a name are known by their
+// address.
+type Named interface {
+	Name() string
+}
+
+// serverName returns the name of server, defaulting to its address.
+func serverName(server Server) string {
+	if n, ok := server.(Named); ok {
+		if name := n.Name(); name != "" {
+			return name
+		}
+	}
+
+	return server.Address()
+}
+
+// defaultServerName returns the name of a server at addr without one: the
+// address with its scheme and host in lower case and no trailing slash.
+func defaultServerName(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.Path, "/")
+}
+
+// Labeled is implemented by servers that carry metadata labels used for
+// subset selection. Servers that do not implement it have no labels.
+type Labeled interface {
+	Labels() map[string]string
+}
+
+// serverLabels returns the labels of server, or nil when it carries none.
+func serverLabels(server Server) map[string]string {
+	if l, ok := server.(Labeled); ok {
+		return l.Labels()
+	}
+
+	return nil
+}
+
+// LoadReport is the load a server reported and when. It is stale once the
+// server stopped reporting for longer than its health check, or feedback,
+// allows.
+type LoadReport struct {
+	Load  float64   `json:"load"`
+	Time  time.Time `json:"time"`
+	Stale bool      `json:"stale"`
+
+	// ttl is how long the report stays fresh.
+	ttl time.Duration
+}
+
+// LoadReporter is implemented by servers that report their own load, such
+// as in health check responses. ReportedLoad returns nil until a load was
+// reported.
+type LoadReporter interface {
+	ReportedLoad(now time.Time) *LoadReport
+}
+
+// Weighted is implemented by servers with a relative capacity. Servers that
+// do not implement it have weight 1.
+type Weighted interface {
+	Weight() int
+}
+
+// serverWeight returns the weight of server, defaulting to 1.
+func serverWeight(server Server) int {
+	if w, ok := server.(Weighted); ok {
+		return w.Weight()
+	}
+
+	return 1
+}
+
+// Prioritized is implemented by servers belonging to a failover priority
+// group. Servers without it have priority 0.
+type Prioritized interface {
+	Priority() int
+}
+
+// serverPriority returns the priority of server, defaulting to 0.
+func serverPriority(server Server) int {
+	if p, ok := server.(Prioritized); ok {
+		return p.Priority()
+	}
+
+	return 0
+}
+
+// HealthSettable is implemented by servers whose liveness can be set from
+// outside. Servers that do not implement it keep reporting IsAlive.
+type HealthSettable interface {
+	SetAlive(alive bool)
+}
+
+// Warmable is implemented by servers with their own warm-up, such as
+// priming a cache. Warmup runs before the configured warm-up requests when a
+// server is added at runtime, and the server is not selected until both
+// succeed.
+type Warmable interface {
+	Warmup(ctx context.Context) error
+}
+
+// closeServer closes server if it implements io.Closer. Requests already in
+// flight to it may still be completing, so Close should release resources
+// such as idle connections rather than abort requests.
+func closeServer(server Server) {
+	c, ok := server.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		fmt.Printf("error: close %s: %v\n", server.Address(), err)
+	}
+}
+
+// ConcurrencyLimited is implemented by servers that accept a bounded number
+// of concurrent requests. A limit of 0 means unlimited.
+type ConcurrencyLimited interface {
+	MaxConcurrent() int
+}
+
+// serverMaxConcurrent returns the concurrency limit of server, or 0.
+func serverMaxConcurrent(server Server) int {
+	if l, ok := server.(ConcurrencyLimited); ok {
+		return l.MaxConcurrent()
+	}
+
+	return 0
+}
+
+// configured is implemented by servers built from a ServerConfig.
+type configured interface {
+	Config() *ServerConfig
+}
+
+type simpleServer struct {
+	name  string
+	proxy *httputil.ReverseProxy
+
+	transport *http.Transport
+	conns     transportCounters
+
+	limit     int
+	firstByte time.Duration
+	required  bool
+	encoding  *UpstreamEncoding
+	alive     atomic.Bool
+
+	health       *HealthCheck
+	healthClient *http.Client
+	prewarm      *Prewarm
+	lastProbe    atomic.Pointer[ProbeResult]
+	load         atomic.Pointer[LoadReport]
+
+	// clock stamps probes, on the clock of the load balancer serving the
+	// server so that their ages are measured on one clock.
+	clock atomic.Pointer[func() time.Time]
+
+	mu       sync.RWMutex
+	addr     string
+	url      *url.URL
+	direct   func(*http.Request)
+	labels   map[string]string
+	weight   int
+	priority int
+
+	// config is the configuration the server was built from, with defaults
+	// applied.
+	config *ServerConfig
+
+	maintenance []MaintenanceWindow
+
+	signer Signer
+
+	// external, if set, adjusts responses to the scheme of the client.
+	external *ExternalScheme
+}
+
+// ServerOption configures optional settings of a simpleServer.
+type ServerOption func(*simpleServer)
+
+// WithLabels attaches metadata labels such as version=v2 or tier=premium to
+// the server.
+func WithLabels(labels map[string]string) ServerOption {
+	return func(s *simpleServer) {
+		s.labels = maps.Clone(labels)
+	}
+}
+
+// WithName names the server, which is its identity as its address changes.
+// By default it is named after its address.
+func WithName(name string) ServerOption {
+	return func(s *simpleServer) {
+		if name != "" {
+			s.name = name
+		}
+	}
+}
+
+// withServerConfig records the configuration the server is built from.
+func withServerConfig(sc ServerConfig) ServerOption {
+	return func(s *simpleServer) {
+		s.config = &sc
+	}
+}
+
+// WithWeight sets the relative capacity of the server used by weighted
+// strategies. A weight of 0 means the server is only used when no weighted
+// server is available.
+func WithWeight(weight int) ServerOption {
+	return func(s *simpleServer) {
+		s.weight = weight
+	}
+}
+
+// WithPriority puts the server in a failover priority group. Only servers
+// of the lowest priority with any available server are selected, so that
+// higher priorities take requests once every server of the lower ones is
+// down, draining or at capacity.
+func WithPriority(priority int) ServerOption {
+	return func(s *simpleServer) {
+		s.priority = priority
+	}
+}
+
+// WithMaxConcurrent limits the number of requests forwarded to the server at
+// the same time. Requests beyond the limit wait in the admission queue if one
+// is configured.
+func WithMaxConcurrent(limit int) ServerOption {
+	return func(s *simpleServer) {
+		s.limit = limit
+	}
+}
+
+// WithResponseHeaderTimeout limits how long the server may take to send
+// response headers after the request has been written. Exceeding it is
+// classified as ClassResponseHeaderTimeout.
+func WithResponseHeaderTimeout(d time.Duration) ServerOption {
+	return func(s *simpleServer) {
+		s.transport.ResponseHeaderTimeout = d
+	}
+}
+
+// WithTLSSessionCache sets the number of TLS sessions kept for resumption
+// with the server, 64 by default. A negative size disables resumption.
+func WithTLSSessionCache(size int) ServerOption {
+	return func(s *simpleServer) {
+		if size < 0 {
+			s.transport.TLSClientConfig.ClientSessionCache = nil
+			return
+		}
+		s.transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	}
+}
+
+// WithH2C forwards requests to the server over cleartext HTTP/2, as gRPC
+// servers without TLS expect. Servers reached over TLS negotiate HTTP/2
+// without it.
+func WithH2C() ServerOption {
+	return func(s *simpleServer) {
+		s.transport.Protocols = new(http.Protocols)
+		s.transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+// WithHealthCheck enables active health checking of the server.
+func WithHealthCheck(hc HealthCheck) ServerOption {
+	return func(s *simpleServer) {
+		s.health = &hc
+		s.healthClient = hc.newClient()
+	}
+}
+
+func (s *simpleServer) Address() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.addr
+}
+
+// Name returns the name of the server.
+func (s *simpleServer) Name() string {
+	return s.name
+}
+
+// target returns the URL the server forwards to.
+func (s *simpleServer) target() *url.URL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.url
+}
+
+// SetAddress moves the server to addr at runtime. Requests in flight to the
+// old address complete; its idle connections are closed, so that the pool
+// only holds connections to addr from now on.
+func (s *simpleServer) SetAddress(addr string) error {
+	u, err := parseServerAddress(addr)
+	if err != nil {
+		return err
+	}
+	direct := httputil.NewSingleHostReverseProxy(u).Director
+
+	s.mu.Lock()
+	s.addr, s.url, s.direct = addr, u, direct
+	s.mu.Unlock()
+	s.transport.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *simpleServer) IsAlive() bool {
+	return s.alive.Load()
+}
+
+// SetAlive overrides the liveness of the server until the next probe.
+func (s *simpleServer) SetAlive(alive bool) {
+	s.alive.Store(alive)
+}
+
+func (s *simpleServer) healthInterval() time.Duration {
+	if s.health == nil {
+		return 0
+	}
+
+	return s.health.interval()
+}
+
+// Probe runs a single health check and updates the server's liveness. Servers
+// without a health check are always considered alive.
+func (s *simpleServer) Probe(ctx context.Context) error {
+	if s.health == nil {
+		return nil
+	}
+
+	var load *float64
+	var err error
+	if s.health.GRPC {
+		err = s.health.probeGRPC(ctx, s.healthClient, s.health.probeURL(s.target()))
+	} else {
+		load, err = s.health.probe(ctx, s.healthClient, s.health.probeURL(s.target()))
+	}
+	s.setProbe(&ProbeResult{Time: s.now(), Err: err, Load: load})
+
+	return err
+}
+
+// now returns the time on the clock of the server's load balancer.
+func (s *simpleServer) now() time.Time {
+	if clock := s.clock.Load(); clock != nil {
+		return (*clock)()
+	}
+
+	return time.Now()
+}
+
+// adoptClock makes server stamp its probes with the clock of lb.
+func (lb *LoadBalancer) adoptClock(server Server) {
+	if s, ok := server.(*simpleServer); ok {
+		clock := func() time.Time { return lb.now() }
+		s.clock.Store(&clock)
+	}
+}
+
+// setProbe records result as the latest probe and updates the liveness.
+func (s *simpleServer) setProbe(result *ProbeResult) {
+	s.lastProbe.Store(result)
+	s.alive.Store(result.Err == nil)
+	if result.Load != nil {
+		s.load.Store(&LoadReport{Load: *result.Load, Time: result.Time, ttl: s.health.staleAfter()})
+	}
+}
+
+// ReportedLoad returns the load the server last reported in a probe
+// response or feedback, or nil if it never did.
+func (s *simpleServer) ReportedLoad(now time.Time) *LoadReport {
+	report := s.load.Load()
+	if report == nil {
+		return nil
+	}
+	r := *report
+	r.Stale = now.Sub(r.Time) > r.ttl
+
+	return &r
+}
+
+func (s *simpleServer) healthCheck() *HealthCheck {
+	return s.health
+}
+
+// LastProbe returns the result of the most recent probe, or nil if the
+// server has not been probed yet.
+func (s *simpleServer) LastProbe() *ProbeResult {
+	return s.lastProbe.Load()
+}
+
+// MaintenanceWindows returns the scheduled maintenance windows of the server.
+func (s *simpleServer) MaintenanceWindows() []MaintenanceWindow {
+	return s.maintenance
+}
+
+// Config returns the effective configuration of a server built from one.
+func (s *simpleServer) Config() *ServerConfig {
+	return s.config
+}
+
+func (s *simpleServer) Weight() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.weight
+}
+
+// SetWeight changes the weight of the server at runtime.
+func (s *simpleServer) SetWeight(weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.weight = weight
+}
+
+func (s *simpleServer) Priority() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.priority
+}
+
+// SetPriority moves the server to another priority group at runtime.
+func (s *simpleServer) SetPriority(priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.priority = priority
+}
+
+func (s *simpleServer) MaxConcurrent() int {
+	return s.limit
+}
+
+func (s *simpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	trace := newRequestTrace(&s.conns)
+	s.proxy.ServeHTTP(rw, req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace())))
+	trace.finish(req.Context(), s.name)
+}
+
+// Close closes the idle connections to the server.
+func (s *simpleServer) Close() error {
+	s.CloseIdleConnections()
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections to the server.
+func (s *simpleServer) CloseIdleConnections() {
+	s.transport.CloseIdleConnections()
+}
+
+// TransportStats reports the connections to the server.
+func (s *simpleServer) TransportStats() TransportStats {
+	return s.conns.stats()
+}
+
+// Labels returns a copy of the server's labels.
+func (s *simpleServer) Labels() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return maps.Clone(s.labels)
+}
+
+// SetLabels replaces the server's labels at runtime.
+func (s *simpleServer) SetLabels(labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.labels = maps.Clone(labels)
+}
+
+// newSimpleServer returns a simple server that proxies incoming requests to the
+// specified target address. Addresses that are not absolute URLs with a scheme
+// and host are rejected with ErrInvalidAddress.
+func newSimpleServer(addr string, opts ...ServerOption) (*simpleServer, error) {
+	serverUrl, err := parseServerAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &simpleServer{
+		name:   defaultServerName(addr),
+		addr:   addr,
+		url:    serverUrl,
+		weight: 1,
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	// The upstream scheme is the one of addr, however the client connected;
+	// X-Forwarded-Proto tells the server the latter. The address may change
+	// at runtime, so the director is looked up for every request.
+	server.direct = proxy.Director
+	proxy.Director = func(req *http.Request) {
+		server.mu.RLock()
+		direct := server.direct
+		server.mu.RUnlock()
+		direct(req)
+		req.Header.Set("X-Forwarded-Proto", clientScheme(req))
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(context.Cause(req.Context()), ErrFirstByteTimeout) && !errors.Is(err, ErrFirstByteTimeout) {
+			err = fmt.Errorf("%w: %v", ErrFirstByteTimeout, err)
+		}
+		upstreamErr := newUpstreamError(server.Address(), err)
+		if a := attemptFromContext(req.Context()); a != nil {
+			a.recordError(upstreamErr)
+		} else {
+			fmt.Printf("error: %v\n", upstreamErr)
+		}
+		writeError(rw, upstreamErr)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		a := attemptFromContext(resp.Request.Context())
+		if a != nil {
+			if err := a.awaitFirstByte(resp); err != nil {
+				return err
+			}
+		}
+		// Upgraded connections need the writable body the transport returns.
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		body := &classifyingBody{ReadCloser: resp.Body, req: resp.Request}
+		resp.Body = body
+		if a != nil && isEventStream(resp.StatusCode, resp.Header) {
+			a.events = body
+		}
+		if server.external != nil {
+			server.external.adjust(resp.Request, resp)
+		}
+		if a != nil && a.validation != nil {
+			return a.validation.check(resp)
+		}
+		return nil
+	}
+
+	server.proxy = proxy
+	server.transport = newTransport(&server.conns)
+	proxy.Transport = encodingTransport{
+		RoundTripper: signingTransport{
+			RoundTripper: staleConnTransport{transport: server.transport, counters: &server.conns},
+			server:       server,
+		},
+		server: server,
+	}
+	server.alive.Store(true)
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server, nil
+}
+
+// parseServerAddress parses the address of a server. Addresses that are not
+// absolute URLs with a scheme and host are rejected with ErrInvalidAddress.
+func parseServerAddress(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidAddress, addr, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%w %q: scheme and host are required", ErrInvalidAddress, addr)
+	}
+
+	return u, nil
+}
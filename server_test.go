@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"load-balancer/discovery/docker"
+)
+
+// plainServer implements nothing beyond Server.
+type plainServer struct {
+	addr  string
+	calls atomic.Int64
+}
+
+func (s *plainServer) Address() string { return s.addr }
+func (s *plainServer) IsAlive() bool   { return true }
+
+func (s *plainServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	s.calls.Add(1)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// capableServer implements every optional capability. Warmup blocks until
+// warm is closed and returns warmErr.
+type capableServer struct {
+	plainServer
+	weight  int
+	alive   atomic.Bool
+	closed  atomic.Int64
+	warm    chan struct{}
+	warmErr error
+}
+
+func newCapableServer(addr string, weight int) *capableServer {
+	s := &capableServer{plainServer: plainServer{addr: addr}, weight: weight, warm: make(chan struct{})}
+	s.alive.Store(true)
+	return s
+}
+
+func (s *capableServer) IsAlive() bool       { return s.alive.Load() }
+func (s *capableServer) SetAlive(alive bool) { s.alive.Store(alive) }
+func (s *capableServer) Weight() int         { return s.weight }
+func (s *capableServer) Close() error        { s.closed.Add(1); return nil }
+func (s *capableServer) Warmup(ctx context.Context) error {
+	select {
+	case <-s.warm:
+		return s.warmErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestCapabilities_Defaults(t *testing.T) {
+	plain := &plainServer{addr: "http://plain.com"}
+	capable := newCapableServer("http://capable.com", 3)
+	lb := newTestLoadBalancer(t, []Server{plain, capable})
+
+	stats := lb.Stats()
+	if stats[0].Weight != 1 || stats[0].Labels != nil {
+		t.Errorf("Expected a plain server to have weight 1 and no labels, got %+v", stats[0])
+	}
+	if stats[1].Weight != 3 {
+		t.Errorf("Expected weight 3, got %d", stats[1].Weight)
+	}
+
+	// Liveness updates skip servers that cannot take them
+	for _, addr := range []string{plain.addr, capable.addr} {
+		lb.applyDockerEvent(docker.Event{Type: docker.HealthChanged, Backend: docker.Backend{Address: addr, Health: docker.HealthUnhealthy}})
+	}
+	if !plain.IsAlive() || capable.IsAlive() {
+		t.Errorf("Expected only the health settable server to be marked down")
+	}
+}
+
+func TestCapabilities_Close(t *testing.T) {
+	removed := newCapableServer("http://removed.com", 1)
+	kept := newCapableServer("http://kept.com", 1)
+	plain := &plainServer{addr: "http://plain.com"}
+	lb := newTestLoadBalancer(t, []Server{removed, kept, plain})
+
+	if err := lb.RemoveServer(removed.addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.RemoveServer(plain.addr); err != nil {
+		t.Errorf("Expected a server without Close to be removed, got %v", err)
+	}
+	if removed.closed.Load() != 1 || kept.closed.Load() != 0 {
+		t.Errorf("Expected only the removed server to be closed")
+	}
+	lb.Close()
+	if removed.closed.Load() != 1 || kept.closed.Load() != 1 {
+		t.Errorf("Expected the remaining server to be closed on shutdown")
+	}
+}
+
+func TestCapabilities_Warmable(t *testing.T) {
+	existing := &plainServer{addr: "http://existing.com"}
+	lb := newTestLoadBalancer(t, []Server{existing})
+
+	// No warm-up is configured, the server's own warm-up still gates it
+	warming := newCapableServer("http://warming.com", 1)
+	if err := lb.AddServer(warming); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if warming.calls.Load() != 0 {
+		t.Errorf("Expected no traffic while warming up, got %d requests", warming.calls.Load())
+	}
+	close(warming.warm)
+	waitFor(t, "warm-up", func() bool { return lb.Stats()[1].Warmup == nil })
+	for i := 0; i < 4; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if warming.calls.Load() == 0 {
+		t.Errorf("Expected traffic after warming up")
+	}
+
+	failing := newCapableServer("http://failing.com", 1)
+	failing.warmErr = errors.New("cache unavailable")
+	close(failing.warm)
+	if err := lb.AddServer(failing); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failed warm-up", func() bool {
+		w := lb.Stats()[2].Warmup
+		return w != nil && w.State == "failed"
+	})
+}
+
+func TestSetServerAddress_KeepsIdentity(t *testing.T) {
+	var oldHits, newHits atomic.Int64
+	var oldClosed atomic.Int64
+	oldBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { oldHits.Add(1) }))
+	oldBackend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			oldClosed.Add(1)
+		}
+	}
+	oldBackend.Start()
+	defer oldBackend.Close()
+	newBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { newHits.Add(1) }))
+	defer newBackend.Close()
+
+	server, err := newSimpleServer(oldBackend.URL, WithName("api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &MockServer{addr: "http://other.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server, other}, WithStickySessions(StickySessions{}))
+
+	pinned := &http.Cookie{Name: defaultStickyCookie, Value: opaqueServerID(server)}
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(pinned)
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		return rw
+	}
+	if rw := get(); rw.Code != http.StatusOK || oldHits.Load() != 1 {
+		t.Fatalf("Expected the pinned request at the old address, got %d", rw.Code)
+	}
+
+	rw := httptest.NewRecorder()
+	body := `{"name": "api", "address": "` + newBackend.URL + `"}`
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("PUT", "/admin/servers/address", strings.NewReader(body)))
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rw.Code, rw.Body)
+	}
+	waitFor(t, "the idle connection to the old address to close", func() bool { return oldClosed.Load() == 1 })
+
+	if rw := get(); rw.Code != http.StatusOK || newHits.Load() != 1 || oldHits.Load() != 1 {
+		t.Errorf("Expected the pinned request at the new address, got %d with %d and %d hits", rw.Code, oldHits.Load(), newHits.Load())
+	}
+	if pinned.Value != opaqueServerID(server) {
+		t.Error("Expected the affinity cookie of the server to survive its move")
+	}
+	for _, s := range lb.Stats() {
+		if s.Name == "api" && (s.Address != newBackend.URL || s.Requests != 2) {
+			t.Errorf("Expected the counters to follow the name to the new address, got %+v", s)
+		}
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `lb_server_requests_total{server="api"} 2`) {
+		t.Error("Expected the metrics to be labeled with the name")
+	}
+
+	if err := lb.SetServerAddress("api", "http://other.com"); !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected ErrServerExists moving onto another server, got %v", err)
+	}
+}
+
+func TestServerNames_Duplicates(t *testing.T) {
+	a, err := newSimpleServer("http://a.example", WithName("api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSimpleServer("http://b.example", WithName("api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLoadBalancer("8080", []Server{a, b}); !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected ErrServerExists for a pool with a name twice, got %v", err)
+	}
+
+	lb := newTestLoadBalancer(t, []Server{a})
+	if err := lb.AddServer(b); !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected ErrServerExists adding a taken name, got %v", err)
+	}
+
+	cfg := &Config{Port: "8080", Servers: []ServerConfig{
+		{Name: "api", Address: "http://a.example"},
+		{Name: "api", Address: "http://b.example"},
+	}}
+	if _, err := cfg.build(true); !errors.Is(err, ErrServerExists) {
+		t.Errorf("Expected ErrServerExists for a config with a name twice, got %v", err)
+	}
+
+	// Unnamed servers are named after their normalized address.
+	c, err := newSimpleServer("HTTP://C.Example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serverName(c); got != "http://c.example" {
+		t.Errorf("Expected the default name http://c.example, got %q", got)
+	}
+}
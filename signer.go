@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Signer adds credentials to a request before it is sent to a server, such
+// as a service token the servers require but clients must not know. It is
+// called once per attempt on a copy of the outbound request, after its URL
+// has been rewritten for the server. Implement it to plug in schemes such as
+// AWS SigV4; signers that hold secrets may also implement
+// Reload() error to pick up rotated secrets in ReloadSecrets.
+type Signer interface {
+	Sign(req *http.Request) error
+}
+
+// reloader is implemented by signers whose secrets can be reloaded.
+type reloader interface {
+	Reload() error
+}
+
+// Secret is a credential read from the environment or a file. Its value is
+// never formatted, so a Secret can be logged safely.
+type Secret struct {
+	source string
+	value  atomic.Pointer[string]
+}
+
+// LoadSecret reads the secret named by source: "env:<name>" for an
+// environment variable or "file:<path>" for a file, whose surrounding
+// whitespace is trimmed.
+func LoadSecret(source string) (*Secret, error) {
+	s := &Secret{source: source}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads the secret again. On failure the previous value is kept.
+func (s *Secret) Reload() error {
+	kind, arg, _ := strings.Cut(s.source, ":")
+	var value string
+	switch kind {
+	case "env":
+		value = os.Getenv(arg)
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.source, err)
+		}
+		value = strings.TrimSpace(string(data))
+	default:
+		return fmt.Errorf("secret %q: source must be env:<name> or file:<path>", s.source)
+	}
+	if value == "" {
+		return fmt.Errorf("secret %s is empty", s.source)
+	}
+	s.value.Store(&value)
+
+	return nil
+}
+
+// Value returns the current value of the secret.
+func (s *Secret) Value() string {
+	return *s.value.Load()
+}
+
+// String describes the secret by its source, never its value.
+func (s *Secret) String() string {
+	return "secret " + s.source
+}
+
+// StaticToken sets Header, Authorization by default, to Token, prefixed by
+// Scheme and a space if Scheme is set.
+type StaticToken struct {
+	Header string
+	Scheme string
+	Token  *Secret
+}
+
+func (t StaticToken) Sign(req *http.Request) error {
+	header := t.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	value := t.Token.Value()
+	if t.Scheme != "" {
+		value = t.Scheme + " " + value
+	}
+	req.Header.Set(header, value)
+
+	return nil
+}
+
+func (t StaticToken) Reload() error {
+	return t.Token.Reload()
+}
+
+// defaultSignedFields are the request fields HMACSigner signs by default.
+var defaultSignedFields = []string{"method", "path", "date"}
+
+// HMACSigner sets Header, X-Signature by default, to the hex encoded
+// HMAC-SHA256 with Key over Fields of the outbound request joined by
+// newlines. Fields are "method", "host", "path", "query", "date" and
+// "header:<name>", and default to method, path and date. When the date is
+// signed, requests without a Date header get one.
+type HMACSigner struct {
+	Header string
+	Fields []string
+	Key    *Secret
+}
+
+func (h HMACSigner) Sign(req *http.Request) error {
+	fields := h.Fields
+	if len(fields) == 0 {
+		fields = defaultSignedFields
+	}
+
+	mac := hmac.New(sha256.New, []byte(h.Key.Value()))
+	for i, field := range fields {
+		if field == "date" && req.Header.Get("Date") == "" {
+			req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		}
+		value, err := signedField(req, field)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(value))
+	}
+
+	header := h.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	req.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+
+	return nil
+}
+
+func (h HMACSigner) Reload() error {
+	return h.Key.Reload()
+}
+
+// signedField returns the value of the named field of req.
+func signedField(req *http.Request, field string) (string, error) {
+	switch field {
+	case "method":
+		return req.Method, nil
+	case "host":
+		return req.Host, nil
+	case "path":
+		return req.URL.EscapedPath(), nil
+	case "query":
+		return req.URL.RawQuery, nil
+	case "date":
+		return req.Header.Get("Date"), nil
+	}
+	if name, ok := strings.CutPrefix(field, "header:"); ok && name != "" {
+		return req.Header.Get(name), nil
+	}
+
+	return "", fmt.Errorf("unknown signed field %q", field)
+}
+
+// checkSignedFields returns an error naming the first unknown field.
+func checkSignedFields(fields []string) error {
+	req := &http.Request{URL: &url.URL{}, Header: http.Header{}}
+	for _, field := range fields {
+		if _, err := signedField(req, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WithSigner signs the requests sent to the server with signer, after the
+// signer of their route if there is one.
+func WithSigner(signer Signer) ServerOption {
+	return func(s *simpleServer) {
+		s.signer = signer
+	}
+}
+
+// routeSignerKey carries the signer of a request's route to the transport.
+type routeSignerKey struct{}
+
+// withRouteSigner returns ctx carrying the signer of the route of req.
+func (lb *LoadBalancer) withRouteSigner(ctx context.Context, req *http.Request) context.Context {
+	if route := lb.matchRoute(req); route != nil && route.Signer != nil {
+		return context.WithValue(ctx, routeSignerKey{}, route.Signer)
+	}
+
+	return ctx
+}
+
+// signingTransport signs requests before handing them to the server's
+// transport. Signing happens here rather than in the Director so that a
+// failing signer fails the attempt instead of sending it unsigned.
+type signingTransport struct {
+	http.RoundTripper
+	server *simpleServer
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var signers []Signer
+	if s, ok := req.Context().Value(routeSignerKey{}).(Signer); ok {
+		signers = append(signers, s)
+	}
+	if t.server.signer != nil {
+		signers = append(signers, t.server.signer)
+	}
+	if len(signers) == 0 {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for _, s := range signers {
+		if err := s.Sign(req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSigning, err)
+		}
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// ReloadSecrets reloads the secrets of the signers of every route and
+// server and the API key file. Secrets that fail to load keep their
+// previous value. A complete reload publishes EventConfigReloaded.
+func (lb *LoadBalancer) ReloadSecrets() error {
+	lb.mu.Lock()
+	var signers []Signer
+	for _, route := range lb.routeList() {
+		if route.Signer != nil {
+			signers = append(signers, route.Signer)
+		}
+	}
+	for _, server := range lb.servers {
+		if s, ok := server.(*simpleServer); ok && s.signer != nil {
+			signers = append(signers, s.signer)
+		}
+	}
+	lb.mu.Unlock()
+
+	errs := []error{lb.ReloadAPIKeys(), lb.ReloadListenerCertificate()}
+	for _, s := range signers {
+		if r, ok := s.(reloader); ok {
+			errs = append(errs, r.Reload())
+		}
+	}
+	err := errors.Join(errs...)
+	if err == nil {
+		lb.events.publish(Event{Type: EventConfigReloaded, Reason: "secrets"})
+	}
+
+	return err
+}
+
+var (
+	customSignersMu sync.RWMutex
+	customSigners   = map[string]Signer{}
+)
+
+// RegisterSigner makes a custom signer available to configuration as the
+// auth type name.
+func RegisterSigner(name string, signer Signer) {
+	customSignersMu.Lock()
+	defer customSignersMu.Unlock()
+
+	customSigners[name] = signer
+}
+
+// registeredSigner returns the signer registered under name.
+func registeredSigner(name string) (Signer, bool) {
+	customSignersMu.RLock()
+	defer customSignersMu.RUnlock()
+
+	signer, ok := customSigners[name]
+	return signer, ok
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// headerRecorder is a backend handler recording the headers it receives.
+type headerRecorder struct {
+	mu      sync.Mutex
+	headers []http.Header
+	paths   []string
+}
+
+func (h *headerRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.headers = append(h.headers, req.Header.Clone())
+	h.paths = append(h.paths, req.URL.Path)
+}
+
+func (h *headerRecorder) last() (http.Header, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.headers[len(h.headers)-1], h.paths[len(h.paths)-1]
+}
+
+func hmacHex(key string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSigner_TokenAndHMAC(t *testing.T) {
+	t.Setenv("LB_TEST_TOKEN", "route-token")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("key-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := LoadSecret("env:LB_TEST_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSecret("file:" + keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &headerRecorder{}
+	server := newBackendServer(t, backend.ServeHTTP, WithSigner(HMACSigner{Key: key}))
+	log := &syncBuffer{}
+	lb := newTestLoadBalancer(t, []Server{server}, WithAccessLog(log), WithRoutes(
+		Route{Name: "internal", PathPrefix: "/internal", Signer: StaticToken{Scheme: "Bearer", Token: token}},
+		Route{Name: "default", PathPrefix: "/"},
+	))
+
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/internal/a", nil))
+	header, path := backend.last()
+	if got := header.Get("Authorization"); got != "Bearer route-token" {
+		t.Errorf("Expected the route token, got %q", got)
+	}
+	if want := hmacHex("key-1", "GET", path, header.Get("Date")); header.Get("X-Signature") != want {
+		t.Errorf("Expected signature %s, got %s", want, header.Get("X-Signature"))
+	}
+
+	// Rotated secrets apply once reloaded
+	os.WriteFile(keyFile, []byte("key-2\n"), 0o600)
+	if err := lb.ReloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/b", nil)
+	req.Header.Set("Authorization", "Bearer client")
+	lb.serveProxy(httptest.NewRecorder(), req)
+	header, path = backend.last()
+	if got := header.Get("Authorization"); got != "Bearer client" {
+		t.Errorf("Expected the client's Authorization outside the route, got %q", got)
+	}
+	if want := hmacHex("key-2", "POST", path, header.Get("Date")); header.Get("X-Signature") != want {
+		t.Errorf("Expected signature with the reloaded key %s, got %s", want, header.Get("X-Signature"))
+	}
+	if req.Header.Get("X-Signature") != "" {
+		t.Error("Expected the client request to stay unsigned")
+	}
+
+	for _, secret := range []string{"route-token", "key-1", "key-2", "X-Signature"} {
+		if strings.Contains(log.String(), secret) {
+			t.Errorf("Expected %q to stay out of the access log", secret)
+		}
+	}
+	if s := token.String(); strings.Contains(s, "route-token") {
+		t.Errorf("Expected the secret to format without its value, got %q", s)
+	}
+}
+
+type failingSigner struct{}
+
+func (failingSigner) Sign(req *http.Request) error { return errors.New("no credentials") }
+
+func TestSigner_FailureFailsAttempt(t *testing.T) {
+	backend := &headerRecorder{}
+	server := newBackendServer(t, backend.ServeHTTP, WithSigner(failingSigner{}))
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway || len(backend.headers) != 0 {
+		t.Errorf("Expected 502 without reaching the backend, got %d after %d requests", rw.Code, len(backend.headers))
+	}
+}
+
+func TestAuthConfig_Build(t *testing.T) {
+	t.Setenv("LB_TEST_TOKEN", "token")
+	RegisterSigner("test-custom", failingSigner{})
+
+	for _, tt := range []struct {
+		config  AuthConfig
+		want    Signer
+		wantErr bool
+	}{
+		{config: AuthConfig{Type: "token", Secret: "env:LB_TEST_TOKEN"}},
+		{config: AuthConfig{Type: "hmac", Secret: "env:LB_TEST_TOKEN", Fields: []string{"method", "header:X-Tenant"}}},
+		{config: AuthConfig{Type: "test-custom"}, want: failingSigner{}},
+		{config: AuthConfig{Type: "hmac", Secret: "env:LB_TEST_TOKEN", Fields: []string{"body"}}, wantErr: true},
+		{config: AuthConfig{Type: "token", Secret: "env:LB_TEST_UNSET"}, wantErr: true},
+		{config: AuthConfig{Type: "token", Secret: "LB_TEST_TOKEN"}, wantErr: true},
+		{config: AuthConfig{Type: "sigv4"}, wantErr: true},
+	} {
+		signer, err := tt.config.build()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: expected error %v, got %v", tt.config, tt.wantErr, err)
+		}
+		if tt.want != nil && signer != tt.want {
+			t.Errorf("%+v: expected %#v, got %#v", tt.config, tt.want, signer)
+		}
+	}
+
+	signer, _ := (&AuthConfig{Type: "token", Secret: "env:LB_TEST_TOKEN"}).build()
+	req := httptest.NewRequest("GET", "/", nil)
+	signer.Sign(req)
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Expected a bearer token by default, got %q", got)
+	}
+}
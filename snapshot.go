@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statsCSVColumns is the documented column order of GET /admin/stats.csv.
+var statsCSVColumns = []string{
+	"name", "address", "alive", "weight", "in_flight", "requests", "errors",
+	"bytes_in", "bytes_out", "latency_p50_ms", "latency_p95_ms", "latency_p99_ms",
+}
+
+// statsSnapshot is one line of the metrics snapshot file.
+type statsSnapshot struct {
+	Time    time.Time     `json:"time"`
+	Servers []ServerStats `json:"servers"`
+}
+
+// RunSnapshots appends a JSON snapshot of Stats to w every interval until ctx
+// is done. It runs off the request path; write errors are logged and the
+// next snapshot is attempted as usual.
+func (lb *LoadBalancer) RunSnapshots(ctx context.Context, w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			markActive(ctx)
+			if err := lb.writeSnapshot(w, now); err != nil {
+				fmt.Printf("error: write metrics snapshot: %v\n", err)
+			}
+		}
+	}
+}
+
+// writeSnapshot writes a single snapshot line taken at now.
+func (lb *LoadBalancer) writeSnapshot(w io.Writer, now time.Time) error {
+	line, err := json.Marshal(statsSnapshot{Time: now, Servers: lb.Stats()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+
+	return err
+}
+
+// writeStatsCSV renders stats as CSV in statsCSVColumns order.
+func writeStatsCSV(w io.Writer, stats []ServerStats) error {
+	cw := csv.NewWriter(w)
+	cw.Write(statsCSVColumns)
+	for _, s := range stats {
+		cw.Write([]string{
+			s.Name,
+			s.Address,
+			strconv.FormatBool(s.Alive),
+			strconv.Itoa(s.Weight),
+			strconv.FormatInt(s.InFlight, 10),
+			strconv.FormatUint(s.Requests, 10),
+			strconv.FormatUint(s.Errors, 10),
+			strconv.FormatUint(s.BytesIn, 10),
+			strconv.FormatUint(s.BytesOut, 10),
+			strconv.FormatFloat(s.LatencyP50, 'f', 3, 64),
+			strconv.FormatFloat(s.LatencyP95, 'f', 3, 64),
+			strconv.FormatFloat(s.LatencyP99, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func (lb *LoadBalancer) handleStatsCSV(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writeStatsCSV(rw, lb.Stats())
+}
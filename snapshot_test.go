@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingWriter fails its first write and forwards the rest to buf.
+type failingWriter struct {
+	failed atomic.Bool
+	buf    syncBuffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.failed.CompareAndSwap(false, true) {
+		return 0, errors.New("disk full")
+	}
+	return w.buf.Write(p)
+}
+
+func TestSnapshot_WritesParseableLines(t *testing.T) {
+	server1 := &MockServer{addr: "http://server1.com", isAlive: true}
+	server2 := &MockServer{addr: "http://server2.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{server1, server2})
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// The first write fails; the snapshotter must keep going
+	out := &failingWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		lb.RunSnapshots(ctx, out, 5*time.Millisecond)
+		close(done)
+	}()
+	waitFor(t, "two snapshots", func() bool { return strings.Count(out.buf.String(), "\n") >= 2 })
+	cancel()
+	<-done
+
+	for _, line := range strings.Split(strings.TrimSpace(out.buf.String()), "\n") {
+		var snap statsSnapshot
+		if err := json.Unmarshal([]byte(line), &snap); err != nil {
+			t.Fatalf("Invalid snapshot line %q: %v", line, err)
+		}
+		if snap.Time.IsZero() {
+			t.Errorf("Expected snapshot time to be set")
+		}
+		if len(snap.Servers) != 2 {
+			t.Fatalf("Expected 2 servers in snapshot, got %d", len(snap.Servers))
+		}
+		if snap.Servers[0].Address != "http://server1.com" || snap.Servers[0].Requests != 1 {
+			t.Errorf("Expected server1 with 1 request, got %+v", snap.Servers[0])
+		}
+	}
+}
+
+func TestStatsCSV_ColumnOrder(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/stats.csv", nil))
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Expected text/csv content type, got %s", ct)
+	}
+
+	records, err := csv.NewReader(rw.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected header and one row, got %d records", len(records))
+	}
+	want := "name,address,alive,weight,in_flight,requests,errors,bytes_in,bytes_out,latency_p50_ms,latency_p95_ms,latency_p99_ms"
+	if got := strings.Join(records[0], ","); got != want {
+		t.Errorf("Expected header %s, got %s", want, got)
+	}
+	row := records[1]
+	if row[0] != "http://server1.com" || row[1] != "http://server1.com" || row[2] != "true" || row[3] != "1" || row[4] != "0" || row[5] != "1" || row[6] != "0" {
+		t.Errorf("Unexpected row %v", row)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSRVInterval = 30 * time.Second
+	defaultSRVGrace    = 5 * time.Minute
+	defaultSRVTimeout  = 5 * time.Second
+)
+
+// SRVResolver looks up SRV records and the addresses of their targets.
+// *net.Resolver implements it.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SRVDiscovery maintains servers from the DNS SRV records of Name, such as
+// "_http._tcp.api.service.consul", resolved every Interval, 30s by default.
+// Each target becomes a server at Scheme, "http" by default, with the
+// record's port, labeled srv_target, taking the record's weight as its
+// weight and its priority as its failover priority. With PerAddress, a
+// target resolving to several addresses becomes a server per address
+// instead. Servers whose records disappear are drained before removal.
+// When lookups fail the last good set is kept for Grace, 5m by default,
+// after which every server is removed. Resolver defaults to the system
+// resolver.
+type SRVDiscovery struct {
+	Name       string
+	Scheme     string
+	Interval   time.Duration
+	PerAddress bool
+	Grace      time.Duration
+	Resolver   SRVResolver
+}
+
+// WithSRVDiscovery discovers servers from DNS SRV records. Discovery runs
+// in RunSRVDiscovery.
+func WithSRVDiscovery(d SRVDiscovery) Option {
+	return func(lb *LoadBalancer) {
+		if d.Scheme == "" {
+			d.Scheme = "http"
+		}
+		if d.Interval <= 0 {
+			d.Interval = defaultSRVInterval
+		}
+		if d.Grace <= 0 {
+			d.Grace = defaultSRVGrace
+		}
+		if d.Resolver == nil {
+			d.Resolver = net.DefaultResolver
+		}
+		lb.srv = &srvDiscoverer{
+			config:   d,
+			servers:  make(map[string]srvServer),
+			removals: make(map[string]chan struct{}),
+			synced:   make(chan struct{}),
+		}
+	}
+}
+
+// srvServer is a server wanted by the SRV records.
+type srvServer struct {
+	target   string
+	weight   int
+	priority int
+}
+
+// srvDiscoverer tracks the servers it added and the last good lookup.
+type srvDiscoverer struct {
+	config SRVDiscovery
+
+	mu       sync.Mutex
+	servers  map[string]srvServer
+	lastGood time.Time
+
+	// removals is closed for servers wanted again while draining.
+	removals map[string]chan struct{}
+
+	// synced is closed once the first lookup completed, successful or not.
+	synced   chan struct{}
+	syncOnce sync.Once
+
+	lookups  atomic.Uint64
+	failures atomic.Uint64
+	stale    atomic.Bool
+}
+
+// RunSRVDiscovery resolves the SRV records and reconciles the pool with
+// them every interval until ctx is done. It returns at once without
+// WithSRVDiscovery.
+func (lb *LoadBalancer) RunSRVDiscovery(ctx context.Context) {
+	if lb.srv == nil {
+		return
+	}
+	ticker := time.NewTicker(lb.srv.config.Interval)
+	defer ticker.Stop()
+	lb.refreshSRV(ctx)
+	lb.srv.syncOnce.Do(func() { close(lb.srv.synced) })
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		markActive(ctx)
+		lb.refreshSRV(ctx)
+	}
+}
+
+// refreshSRV resolves the SRV records once and reconciles the pool with
+// them, keeping the last good set while lookups fail within the grace
+// period.
+func (lb *LoadBalancer) refreshSRV(ctx context.Context) {
+	d := lb.srv
+	wanted, err := d.resolve(ctx)
+	now := lb.now()
+	if err != nil {
+		d.failures.Add(1)
+		d.mu.Lock()
+		lastGood := d.lastGood
+		d.mu.Unlock()
+		if !lastGood.IsZero() && now.Sub(lastGood) < d.config.Grace {
+			d.stale.Store(true)
+			fmt.Printf("warning: srv discovery: %v, keeping the servers of %s ago\n", err, now.Sub(lastGood).Round(time.Second))
+			return
+		}
+		fmt.Printf("error: srv discovery: %v\n", err)
+		if lastGood.IsZero() {
+			return
+		}
+		wanted = nil
+	} else {
+		d.lookups.Add(1)
+		d.mu.Lock()
+		d.lastGood = now
+		d.mu.Unlock()
+	}
+	d.stale.Store(err != nil)
+	lb.reconcileSRV(wanted)
+}
+
+// resolve looks up the servers the SRV records ask for, by address.
+func (d *srvDiscoverer) resolve(ctx context.Context) (map[string]srvServer, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultSRVTimeout)
+	defer cancel()
+
+	_, records, err := d.config.Resolver.LookupSRV(ctx, "", "", d.config.Name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", d.config.Name, err)
+	}
+	wanted := make(map[string]srvServer)
+	for _, r := range records {
+		target := strings.TrimSuffix(r.Target, ".")
+		if target == "" {
+			// "." means the service is decidedly not available.
+			continue
+		}
+		hosts := []string{target}
+		if d.config.PerAddress {
+			if hosts, err = d.config.Resolver.LookupHost(ctx, target); err != nil {
+				return nil, fmt.Errorf("lookup %s: %w", target, err)
+			}
+		}
+		for _, host := range hosts {
+			u := url.URL{Scheme: d.config.Scheme, Host: net.JoinHostPort(host, strconv.Itoa(int(r.Port)))}
+			wanted[u.String()] = srvServer{target: target, weight: int(r.Weight), priority: int(r.Priority)}
+		}
+	}
+
+	return wanted, nil
+}
+
+// reconcileSRV adds the wanted servers missing from the pool, updates the
+// weight and priority of those present and drains the servers no longer
+// wanted, removing them once drained.
+func (lb *LoadBalancer) reconcileSRV(wanted map[string]srvServer) {
+	d := lb.srv
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for addr, w := range wanted {
+		lb.mu.Lock()
+		server := lb.findServerLocked(addr)
+		lb.mu.Unlock()
+		if _, ours := d.servers[addr]; ours && server != nil {
+			if s, ok := server.(*simpleServer); ok {
+				s.SetWeight(w.weight)
+				s.SetPriority(w.priority)
+			}
+			d.servers[addr] = w
+			if cancel, ok := d.removals[addr]; ok {
+				close(cancel)
+				delete(d.removals, addr)
+				lb.Undrain(addr)
+			}
+			continue
+		}
+		opts := append(lb.serverOptions(), WithWeight(w.weight), WithPriority(w.priority),
+			WithLabels(map[string]string{"srv_target": w.target}))
+		s, err := newSimpleServer(addr, opts...)
+		if err == nil {
+			err = lb.AddServer(s)
+		}
+		if err != nil {
+			fmt.Printf("error: srv discovery: target %s: %v\n", w.target, err)
+			continue
+		}
+		d.servers[addr] = w
+		fmt.Printf("srv discovery: added %q for target %s\n", addr, w.target)
+	}
+
+	for addr := range d.servers {
+		if _, ok := wanted[addr]; ok || d.removals[addr] != nil {
+			continue
+		}
+		done, err := lb.Drain(addr)
+		if err != nil {
+			delete(d.servers, addr)
+			continue
+		}
+		fmt.Printf("srv discovery: draining %q\n", addr)
+		cancel := make(chan struct{})
+		d.removals[addr] = cancel
+		go func() {
+			select {
+			case <-cancel:
+				return
+			case <-done:
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.removals[addr] != cancel {
+				return
+			}
+			delete(d.removals, addr)
+			delete(d.servers, addr)
+			if err := lb.RemoveServer(addr); err == nil {
+				fmt.Printf("srv discovery: removed %q\n", addr)
+			}
+		}()
+	}
+}
+
+// writeMetrics renders the servers discovered and the lookups made.
+func (d *srvDiscoverer) writeMetrics(w io.Writer) {
+	d.mu.Lock()
+	servers := len(d.servers)
+	d.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP lb_srv_discovery_servers Servers maintained from SRV records.")
+	fmt.Fprintln(w, "# TYPE lb_srv_discovery_servers gauge")
+	fmt.Fprintf(w, "lb_srv_discovery_servers %d\n", servers)
+	fmt.Fprintln(w, "# HELP lb_srv_discovery_lookups_total SRV lookups, by result.")
+	fmt.Fprintln(w, "# TYPE lb_srv_discovery_lookups_total counter")
+	fmt.Fprintf(w, "lb_srv_discovery_lookups_total{result=\"ok\"} %d\n", d.lookups.Load())
+	fmt.Fprintf(w, "lb_srv_discovery_lookups_total{result=\"failed\"} %d\n", d.failures.Load())
+	fmt.Fprintln(w, "# HELP lb_srv_discovery_stale Whether the servers are kept from an earlier lookup because lookups fail.")
+	fmt.Fprintln(w, "# TYPE lb_srv_discovery_stale gauge")
+	stale := 0
+	if d.stale.Load() {
+		stale = 1
+	}
+	fmt.Fprintf(w, "lb_srv_discovery_stale %d\n", stale)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSRVResolver answers with records and hosts that tests change.
+type fakeSRVResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	hosts   map[string][]string
+	err     error
+}
+
+func (r *fakeSRVResolver) set(records []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records, r.err = records, err
+}
+
+func (r *fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return name, r.records, r.err
+}
+
+func (r *fakeSRVResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.hosts[host], nil
+}
+
+// poolOf returns the weight and priority of the servers of lb by address,
+// waiting for servers being drained to be removed.
+func poolOf(t *testing.T, lb *LoadBalancer, want int) map[string][2]int {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pool := make(map[string][2]int)
+		lb.mu.Lock()
+		for _, s := range lb.servers {
+			pool[s.Address()] = [2]int{serverWeight(s), serverPriority(s)}
+		}
+		lb.mu.Unlock()
+		if len(pool) == want || time.Now().After(deadline) {
+			return pool
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newSRVLoadBalancer(t *testing.T, resolver *fakeSRVResolver, perAddress bool) *LoadBalancer {
+	return newTestLoadBalancer(t, nil, WithAllowEmpty(), WithSRVDiscovery(SRVDiscovery{
+		Name: "_http._tcp.api.example", Resolver: resolver, PerAddress: perAddress, Grace: time.Minute,
+	}))
+}
+
+func TestSRVDiscovery_FollowsRecords(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	lb := newSRVLoadBalancer(t, resolver, false)
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "b.example.", Port: 8081, Priority: 20, Weight: 1},
+	}, nil)
+	lb.refreshSRV(context.Background())
+	want := map[string][2]int{"http://a.example:8080": {5, 10}, "http://b.example:8081": {1, 20}}
+	if got := poolOf(t, lb, 2); !maps.Equal(got, want) {
+		t.Errorf("Expected pool %v, got %v", want, got)
+	}
+
+	resolver.set([]*net.SRV{
+		{Target: "a.example.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "c.example.", Port: 9000, Priority: 10, Weight: 2},
+	}, nil)
+	lb.refreshSRV(context.Background())
+	want = map[string][2]int{"http://a.example:8080": {3, 10}, "http://c.example:9000": {2, 10}}
+	if got := poolOf(t, lb, 2); !maps.Equal(got, want) {
+		t.Errorf("Expected pool %v, got %v", want, got)
+	}
+}
+
+func TestSRVDiscovery_PriorityFailover(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	lb := newSRVLoadBalancer(t, resolver, false)
+	resolver.set([]*net.SRV{
+		{Target: "primary.example.", Port: 80, Priority: 1, Weight: 1},
+		{Target: "backup.example.", Port: 80, Priority: 2, Weight: 1},
+	}, nil)
+	lb.refreshSRV(context.Background())
+
+	for range 4 {
+		server, err := lb.getNextMatchingServer(httptest.NewRequest("GET", "/", nil), nil)
+		if err != nil || server.Address() != "http://primary.example:80" {
+			t.Fatalf("Expected the primary group to take requests, got %v, %v", server, err)
+		}
+	}
+	lb.mu.Lock()
+	lb.findServerLocked("http://primary.example:80").(*simpleServer).SetAlive(false)
+	lb.mu.Unlock()
+	server, err := lb.getNextMatchingServer(httptest.NewRequest("GET", "/", nil), nil)
+	if err != nil || server.Address() != "http://backup.example:80" {
+		t.Errorf("Expected failover to the backup group, got %v, %v", server, err)
+	}
+}
+
+func TestSRVDiscovery_PerAddress(t *testing.T) {
+	resolver := &fakeSRVResolver{hosts: map[string][]string{"a.example": {"10.0.0.1", "10.0.0.2"}}}
+	lb := newSRVLoadBalancer(t, resolver, true)
+	resolver.set([]*net.SRV{{Target: "a.example.", Port: 8080, Priority: 0, Weight: 4}}, nil)
+	lb.refreshSRV(context.Background())
+
+	got := slices.Sorted(maps.Keys(poolOf(t, lb, 2)))
+	if want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}; !slices.Equal(got, want) {
+		t.Errorf("Expected a server per address %v, got %v", want, got)
+	}
+}
+
+func TestSRVDiscovery_KeepsLastGoodSet(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	lb := newSRVLoadBalancer(t, resolver, false)
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	resolver.set([]*net.SRV{{Target: "a.example.", Port: 80, Weight: 1}}, nil)
+	lb.refreshSRV(context.Background())
+
+	resolver.set(nil, errors.New("no such host"))
+	now = now.Add(30 * time.Second)
+	lb.refreshSRV(context.Background())
+	if got := poolOf(t, lb, 1); len(got) != 1 {
+		t.Errorf("Expected the last good set kept within the grace period, got %v", got)
+	}
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rw.Body.String(), "lb_srv_discovery_stale 1") {
+		t.Error("Expected the stale set to be reported")
+	}
+
+	now = now.Add(time.Minute)
+	lb.refreshSRV(context.Background())
+	if got := poolOf(t, lb, 0); len(got) != 0 {
+		t.Errorf("Expected the servers removed after the grace period, got %v", got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultDiscoveryTimeout = 10 * time.Second
+	defaultProbeWaitTimeout = 10 * time.Second
+
+	// probeWaitInterval is how often WaitForProbes looks for servers not
+	// probed yet.
+	probeWaitInterval = 10 * time.Millisecond
+)
+
+// Startup bounds the waits of the startup sequence: for the first sync of
+// discovery, 10s by default, and for the first probe of every health
+// checked server, 10s by default.
+type Startup struct {
+	DiscoveryTimeout time.Duration
+	HealthTimeout    time.Duration
+}
+
+// defaultStartup is used without WithStartup.
+var defaultStartup = Startup{DiscoveryTimeout: defaultDiscoveryTimeout, HealthTimeout: defaultProbeWaitTimeout}
+
+// WithStartup bounds the waits of the startup sequence.
+func WithStartup(s Startup) Option {
+	return func(lb *LoadBalancer) {
+		if s.DiscoveryTimeout == 0 {
+			s.DiscoveryTimeout = defaultDiscoveryTimeout
+		}
+		if s.HealthTimeout == 0 {
+			s.HealthTimeout = defaultProbeWaitTimeout
+		}
+		lb.startup = s
+	}
+}
+
+// StartupPhase is a step of the startup sequence. Run is given a context
+// ending after Timeout, if set: a phase that runs out of time is a bounded
+// wait given up on, and startup moves on to the next phase. Any other
+// error aborts startup.
+type StartupPhase struct {
+	Name    string
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Start runs phases in order, logging how long each took, and then marks
+// the load balancer as listening and closes Started. Traffic listeners
+// belong in the last phase, so that no request arrives before the pool,
+// discovery and health checks are set up. The returned error names the
+// phase that failed.
+func (lb *LoadBalancer) Start(ctx context.Context, phases ...StartupPhase) error {
+	for _, p := range phases {
+		start := time.Now()
+		phaseCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			phaseCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		}
+		err := p.Run(phaseCtx)
+		timedOut := p.Timeout > 0 && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+		switch {
+		case timedOut:
+			fmt.Printf("warning: startup: %s: gave up waiting after %s\n", p.Name, p.Timeout)
+		case err != nil:
+			return fmt.Errorf("startup: %s: %w", p.Name, err)
+		default:
+			fmt.Printf("startup: %s done in %s\n", p.Name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	lb.MarkListening()
+
+	return nil
+}
+
+// Started returns a channel closed once the load balancer is listening,
+// for embedders to wait on.
+func (lb *LoadBalancer) Started() <-chan struct{} {
+	return lb.started
+}
+
+// WaitForDiscovery waits until SRV discovery, if set, made its first
+// lookup, and until every channel in synced is closed, or until ctx is
+// done.
+func (lb *LoadBalancer) WaitForDiscovery(ctx context.Context, synced ...<-chan struct{}) error {
+	if lb.srv != nil {
+		synced = append(synced, lb.srv.synced)
+	}
+	for _, ch := range synced {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// WaitForProbes waits until every health checked server in the pool has
+// been probed once, or until ctx is done. Health checks must be running.
+func (lb *LoadBalancer) WaitForProbes(ctx context.Context) error {
+	ticker := time.NewTicker(probeWaitInterval)
+	defer ticker.Stop()
+	for {
+		if lb.unprobed() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// unprobed returns the number of health checked servers without a probe
+// result.
+func (lb *LoadBalancer) unprobed() int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	n := 0
+	for _, s := range lb.servers {
+		if checked, ok := s.(healthChecked); ok && checked.healthInterval() > 0 && checked.LastProbe() == nil {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// started reports whether the Started channel of lb is closed.
+func started(lb *LoadBalancer) bool {
+	select {
+	case <-lb.Started():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStart_Order(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)})
+	var order []string
+	var ln net.Listener
+	phase := func(name string) StartupPhase {
+		return StartupPhase{Name: name, Run: func(ctx context.Context) error {
+			order = append(order, name)
+			if ln != nil {
+				t.Errorf("Expected no traffic listener before %s", name)
+			}
+			if started(lb) || lb.readinessReport().Status == "ready" {
+				t.Errorf("Expected the load balancer not to be started during %s", name)
+			}
+			return nil
+		}}
+	}
+	listeners := StartupPhase{Name: "traffic listeners", Run: func(ctx context.Context) error {
+		order = append(order, "traffic listeners")
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		return err
+	}}
+
+	err := lb.Start(context.Background(), phase("pools"), phase("discovery"), phase("health checks"), phase("admin listener"), listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	want := []string{"pools", "discovery", "health checks", "admin listener", "traffic listeners"}
+	if !slices.Equal(order, want) {
+		t.Errorf("Expected phases %v, got %v", want, order)
+	}
+	if !started(lb) || lb.readinessReport().Status != "ready" {
+		t.Errorf("Expected the load balancer to be started and ready, got %+v", lb.readinessReport())
+	}
+}
+
+func TestStart_BoundedWait(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)})
+	ran := false
+	begin := time.Now()
+	err := lb.Start(context.Background(), StartupPhase{
+		Name:    "discovery",
+		Timeout: 20 * time.Millisecond,
+		Run: func(ctx context.Context) error {
+			<-ctx.Done() // never syncs
+			return ctx.Err()
+		},
+	}, StartupPhase{
+		Name: "traffic listeners",
+		Run: func(ctx context.Context) error {
+			ran = true
+			return nil
+		},
+	})
+	if err != nil || !ran || !started(lb) {
+		t.Fatalf("Expected startup to move on past the wait, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("Expected the wait to be bounded, took %s", elapsed)
+	}
+}
+
+func TestStart_FailureAborts(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{newBackendServer(t, okHandler)})
+	ran := false
+	err := lb.Start(context.Background(), StartupPhase{
+		Name:    "discovery",
+		Timeout: time.Second,
+		Run: func(ctx context.Context) error {
+			return errors.New("socket not found")
+		},
+	}, StartupPhase{
+		Name: "traffic listeners",
+		Run: func(ctx context.Context) error {
+			ran = true
+			return nil
+		},
+	})
+	if err == nil || err.Error() != "startup: discovery: socket not found" {
+		t.Errorf("Expected the failure with its phase, got %v", err)
+	}
+	if ran || started(lb) {
+		t.Error("Expected the traffic listeners not to be bound after a failure")
+	}
+}
+
+func TestStart_WaitForProbes(t *testing.T) {
+	backend := newBackendServer(t, okHandler)
+	server, err := newSimpleServer(backend.Address(), WithHealthCheck(HealthCheck{Path: "/", Interval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := lb.WaitForProbes(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the wait to time out without health checks running, got %v", err)
+	}
+
+	healthCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go lb.RunHealthChecks(healthCtx)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lb.WaitForProbes(ctx); err != nil {
+		t.Fatalf("Expected the first probe to end the wait, got %v", err)
+	}
+	if server.LastProbe() == nil {
+		t.Error("Expected the server to be probed")
+	}
+}
+
+func TestStart_WaitForDiscovery(t *testing.T) {
+	resolver := &fakeSRVResolver{}
+	resolver.set([]*net.SRV{{Target: "a.example.", Port: 8080}}, nil)
+	lb := newSRVLoadBalancer(t, resolver, false)
+	docker := make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := lb.WaitForDiscovery(ctx, docker); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the wait to time out before discovery runs, got %v", err)
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go lb.RunSRVDiscovery(runCtx)
+	close(docker)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lb.WaitForDiscovery(ctx, docker); err != nil {
+		t.Fatalf("Expected the first sync to end the wait, got %v", err)
+	}
+	if len(lb.Stats()) != 1 {
+		t.Errorf("Expected the discovered server in the pool, got %d", len(lb.Stats()))
+	}
+}
+
+func TestStartupConfig(t *testing.T) {
+	lb, err := (&Config{
+		Port:    "0",
+		Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		Startup: &StartupConfig{DiscoveryTimeout: Duration(time.Second)},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.startup != (Startup{DiscoveryTimeout: time.Second, HealthTimeout: defaultProbeWaitTimeout}) {
+		t.Errorf("Expected the discovery timeout set and the default health timeout, got %+v", lb.startup)
+	}
+
+	_, err = (&Config{
+		Port:    "0",
+		Servers: []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		Startup: &StartupConfig{HealthTimeout: Duration(-time.Second)},
+	}).Build()
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("Expected a negative timeout to be rejected, got %v", err)
+	}
+}
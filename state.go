@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	defaultStateInterval = 30 * time.Second
+	defaultStateMaxAge   = 10 * time.Minute
+)
+
+// savedState is the state file written by SaveState.
+type savedState struct {
+	SavedAt time.Time     `json:"saved_at"`
+	Servers []serverState `json:"servers"`
+}
+
+// serverState is the dynamic state of one server that survives a restart.
+// Alive is only restored for servers with a health check, whose next probe
+// confirms or revises it; others would be stuck in the saved state. Files
+// saved before servers had names only have addresses.
+type serverState struct {
+	Name     string                `json:"name,omitempty"`
+	Address  string                `json:"address"`
+	Alive    bool                  `json:"alive"`
+	Failures map[ErrorClass]uint64 `json:"failures,omitempty"`
+	Latency  *histogramState       `json:"latency,omitempty"`
+
+	// Draining is set for servers taken out of selection with Drain, and
+	// Fade and FadeUntil for those still fading out.
+	Draining  bool          `json:"draining,omitempty"`
+	Fade      time.Duration `json:"fade,omitempty"`
+	FadeUntil *time.Time    `json:"fade_until,omitempty"`
+
+	// WeightFactor is the factor of the server under adaptive weights.
+	WeightFactor *float64 `json:"weight_factor,omitempty"`
+
+	// EjectedUntil and BackoffUntil are set while the server is ejected or
+	// backing off.
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    uint64     `json:"ejections,omitempty"`
+	BackoffUntil *time.Time `json:"backoff_until,omitempty"`
+
+	// HealthHistory and Flapping keep a server held down for flapping
+	// until it has been quiet.
+	HealthHistory []HealthTransition `json:"health_history,omitempty"`
+	Flapping      bool               `json:"flapping,omitempty"`
+	Flaps         uint64             `json:"flaps,omitempty"`
+}
+
+// histogramState is the serialized form of a histogram.
+type histogramState struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+}
+
+func (h *histogram) state() *histogramState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &histogramState{Buckets: h.buckets, Counts: append([]uint64(nil), h.counts...), Count: h.count, Sum: h.sum}
+}
+
+// restore replaces the observations of h with s if both use the same
+// buckets.
+func (h *histogram) restore(s *histogramState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(s.Buckets) != len(h.buckets) || len(s.Counts) != len(h.counts) {
+		return
+	}
+	for i := range h.buckets {
+		if s.Buckets[i] != h.buckets[i] {
+			return
+		}
+	}
+	copy(h.counts, s.Counts)
+	h.count, h.sum = s.Count, s.Sum
+}
+
+// SaveState writes the dynamic state of every server to path. The file is
+// replaced atomically so a crash never leaves a partial state behind.
+func (lb *LoadBalancer) SaveState(path string) error {
+	lb.mu.Lock()
+	now := lb.now()
+	state := savedState{SavedAt: now}
+	for _, server := range lb.servers {
+		name := serverName(server)
+		s := serverState{Name: name, Address: server.Address(), Alive: server.IsAlive()}
+		if c, ok := lb.counters[name]; ok {
+			if len(c.failures) > 0 {
+				s.Failures = make(map[ErrorClass]uint64, len(c.failures))
+				for class, n := range c.failures {
+					s.Failures[class] = n
+				}
+			}
+			s.Latency = c.latency.state()
+			if now.Before(c.ejectedUntil) {
+				s.EjectedUntil = &c.ejectedUntil
+			}
+			s.Ejections = c.ejections
+			if now.Before(c.backoffUntil) {
+				s.BackoffUntil = &c.backoffUntil
+			}
+		}
+		if d := lb.drains[name]; d != nil {
+			s.Draining = true
+			if d.fade > 0 {
+				s.Fade, s.FadeUntil = d.fade, &d.fadeUntil
+			}
+		}
+		if lb.adaptive != nil {
+			if f, ok := lb.adaptive.factors[name]; ok {
+				s.WeightFactor = &f
+			}
+		}
+		if h := lb.health[name]; h != nil {
+			s.HealthHistory = slices.Clone(h.transitions)
+			s.Flapping, s.Flaps = h.flapping, h.flaps
+		}
+		state.Servers = append(state.Servers, s)
+	}
+	lb.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash
+// never leaves a partial file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState applies the state saved in path to the servers whose names still
+// exist, or failing that their addresses. A missing file is not an error. Files saved more than maxAge
+// ago are ignored as stale, and corrupt files are reported without changing
+// anything; callers log the error and start fresh.
+func (lb *LoadBalancer) LoadState(path string, maxAge time.Duration) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("load state: corrupt state file %s: %w", path, err)
+	}
+	if age := lb.now().Sub(state.SavedAt); maxAge > 0 && age > maxAge {
+		fmt.Printf("ignoring state saved %s ago\n", age.Round(time.Second))
+		return nil
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	byName := make(map[string]serverState, len(state.Servers))
+	byAddress := make(map[string]serverState, len(state.Servers))
+	for _, s := range state.Servers {
+		if s.Name != "" {
+			byName[s.Name] = s
+		}
+		byAddress[normalizeAddress(s.Address)] = s
+	}
+	restored := 0
+	for _, server := range lb.servers {
+		s, ok := byName[serverName(server)]
+		if !ok {
+			s, ok = byAddress[normalizeAddress(server.Address())]
+		}
+		if !ok {
+			continue
+		}
+		restored++
+		if checked, ok := server.(healthChecked); ok && checked.healthInterval() > 0 {
+			if setter, ok := server.(HealthSettable); ok {
+				setter.SetAlive(s.Alive)
+			}
+		}
+		c := lb.countersFor(serverName(server))
+		for class, n := range s.Failures {
+			c.failures[class] += n
+		}
+		if s.Latency != nil {
+			c.latency.restore(s.Latency)
+		}
+		lb.restoreServerLocked(server, s)
+	}
+	fmt.Printf("restored the state of %d of %d servers from %s\n", restored, len(lb.servers), path)
+
+	return nil
+}
+
+// restoreServerLocked restores the drain, weight factor, ejection,
+// backoff and flapping of server from s. Periods that ended meanwhile are
+// not restored. lb.mu must be held.
+func (lb *LoadBalancer) restoreServerLocked(server Server, s serverState) {
+	name, now := serverName(server), lb.now()
+	if s.Draining && lb.drains[name] == nil {
+		if s.FadeUntil != nil && s.Fade > 0 && now.Before(*s.FadeUntil) {
+			lb.drainLocked(name, s.Fade, *s.FadeUntil)
+		} else {
+			lb.drainLocked(name, 0, now)
+		}
+	}
+	if s.WeightFactor != nil && lb.adaptive != nil {
+		config := lb.adaptive.config
+		lb.adaptive.factors[name] = math.Max(config.Floor, math.Min(config.Cap, *s.WeightFactor))
+	}
+	c := lb.countersFor(name)
+	if s.EjectedUntil != nil && now.Before(*s.EjectedUntil) {
+		c.ejectedUntil = *s.EjectedUntil
+	}
+	c.ejections += s.Ejections
+	if s.BackoffUntil != nil && now.Before(*s.BackoffUntil) {
+		c.backoffUntil = *s.BackoffUntil
+		lb.startBackoffLocked(name, c)
+	}
+	if len(s.HealthHistory) > 0 {
+		lb.health[name] = &healthHistory{
+			observed:    true,
+			alive:       server.IsAlive(),
+			transitions: s.HealthHistory,
+			flapping:    s.Flapping,
+			flaps:       s.Flaps,
+		}
+	}
+}
+
+// RunStateSaver saves the state to path every interval until ctx is done.
+// Save errors are logged and the next save is attempted as usual.
+func (lb *LoadBalancer) RunStateSaver(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			markActive(ctx)
+			if err := lb.SaveState(path); err != nil {
+				fmt.Printf("error: save state: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestState_RoundTrip(t *testing.T) {
+	var healthy atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			if !healthy.Load() {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+	newServers := func() []Server {
+		checked, err := newSimpleServer(backend.URL, WithHealthCheck(HealthCheck{Path: "/healthz", Interval: time.Hour}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []Server{checked, &MockServer{addr: "http://unchecked.com", isAlive: true}}
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// The checked server fails a request and then its probe
+	lb := newTestLoadBalancer(t, newServers())
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	lb.servers[0].(*simpleServer).Probe(context.Background())
+	if err := lb.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart it stays out of selection until a probe passes
+	restarted := newTestLoadBalancer(t, newServers())
+	if !restarted.servers[0].IsAlive() {
+		t.Fatalf("Expected a new server to start alive")
+	}
+	if err := restarted.LoadState(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.servers[0].IsAlive() {
+		t.Errorf("Expected the server that was down to start down")
+	}
+	if !restarted.servers[1].IsAlive() {
+		t.Errorf("Expected a server without health check to stay alive")
+	}
+	stats := restarted.Stats()[0]
+	if stats.Failures[ClassStatus502] != 1 {
+		t.Errorf("Expected 1 restored status-502 failure, got %v", stats.Failures)
+	}
+	if stats.LatencyP50 == 0 {
+		t.Errorf("Expected the learned latency to be restored")
+	}
+	healthy.Store(true)
+	restarted.servers[0].(*simpleServer).Probe(context.Background())
+	if !restarted.servers[0].IsAlive() {
+		t.Errorf("Expected the server to return after passing a probe")
+	}
+}
+
+func TestState_RoundTripSelectionState(t *testing.T) {
+	newLB := func() *LoadBalancer {
+		return newTestLoadBalancer(t, []Server{
+			&MockServer{addr: "http://drained.com", isAlive: true},
+			&MockServer{addr: "http://fading.com", isAlive: true},
+			&MockServer{addr: "http://ejected.com", isAlive: true},
+			&MockServer{addr: "http://other.com", isAlive: true},
+		}, WithAdaptiveWeights(AdaptiveWeights{}), WithFlapDetection(FlapDetection{Transitions: 1, Window: time.Minute, Quiet: time.Minute}))
+	}
+	start := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	lb := newLB()
+	lb.now = func() time.Time { return start }
+	lb.Drain("http://drained.com")
+	lb.DrainFade("http://fading.com", time.Minute)
+	lb.mu.Lock()
+	lb.adaptive.factors["http://ejected.com"] = 0.5
+	c := lb.countersFor("http://ejected.com")
+	c.ejectedUntil, c.ejections = start.Add(time.Minute), 2
+	c.backoffUntil = start.Add(30 * time.Second)
+	lb.health["http://ejected.com"] = &healthHistory{observed: true, alive: true, flapping: true, flaps: 1, transitions: []HealthTransition{
+		{Time: start.Add(-10 * time.Second), Alive: false},
+		{Time: start.Add(-5 * time.Second), Alive: true},
+	}}
+	lb.mu.Unlock()
+	if err := lb.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	lb.Undrain("http://fading.com")
+
+	restarted := newLB()
+	now := start.Add(15 * time.Second)
+	restarted.now = func() time.Time { return now }
+	if err := restarted.LoadState(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	stats := restarted.Stats()
+	if !stats[0].Draining {
+		t.Errorf("Expected the drained server to stay drained, got %+v", stats[0])
+	}
+	if f := stats[1].Fading; f == nil || !f.Until.Equal(start.Add(time.Minute)) || f.Weight != 0.75 {
+		t.Errorf("Expected the fade to go on until its end, got %+v", f)
+	}
+	ejected := stats[2]
+	if ejected.EjectedUntil == nil || !ejected.EjectedUntil.Equal(start.Add(time.Minute)) || ejected.Ejections != 2 {
+		t.Errorf("Expected the ejection to be restored, got %v and %d ejections", ejected.EjectedUntil, ejected.Ejections)
+	}
+	if ejected.BackoffUntil == nil || !ejected.BackoffUntil.Equal(start.Add(30*time.Second)) {
+		t.Errorf("Expected the backoff to be restored, got %v", ejected.BackoffUntil)
+	}
+	if !ejected.Flapping || ejected.Flaps != 1 || len(ejected.HealthHistory) != 2 {
+		t.Errorf("Expected the server to stay held down for flapping, got %+v", ejected)
+	}
+	if w := ejected.EffectiveWeight; w == nil || *w != float64(ejected.Weight)*0.5 {
+		t.Errorf("Expected the adaptive weight to be restored, got %v", w)
+	}
+	for i := 0; i < 8; i++ {
+		server, err := restarted.getNextAvailableServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Address() == "http://drained.com" || server.Address() == "http://ejected.com" {
+			t.Errorf("Expected %s to stay out of selection", server.Address())
+		}
+		restarted.finishRequest(server, http.StatusOK, "", 0, 0, 0)
+	}
+
+	// Periods that ended while the load balancer was down are over.
+	restarted = newLB()
+	now = start.Add(2 * time.Minute)
+	restarted.now = func() time.Time { return now }
+	if err := restarted.LoadState(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	stats = restarted.Stats()
+	if !stats[1].Draining || stats[1].Fading != nil {
+		t.Errorf("Expected the fade to have ended in a drain, got %+v", stats[1])
+	}
+	if stats[2].EjectedUntil != nil || stats[2].BackoffUntil != nil {
+		t.Errorf("Expected the ejection and backoff to be over, got %+v", stats[2])
+	}
+}
+
+func TestState_StaleAndCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	server, err := newSimpleServer("http://server1.com", WithHealthCheck(HealthCheck{Path: "/healthz"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server})
+	server.SetAlive(false)
+	path := filepath.Join(dir, "state.json")
+	if err := lb.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	server.SetAlive(true)
+
+	lb.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := lb.LoadState(path, time.Minute); err != nil {
+		t.Errorf("Expected stale state to be ignored without error, got %v", err)
+	}
+	if !server.IsAlive() {
+		t.Errorf("Expected stale state not to be applied")
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte(`{"servers": [`), 0o644)
+	if err := lb.LoadState(corrupt, time.Minute); err == nil {
+		t.Errorf("Expected a corrupt state file to be reported")
+	}
+	if !server.IsAlive() {
+		t.Errorf("Expected a corrupt state file not to be applied")
+	}
+
+	if err := lb.LoadState(filepath.Join(dir, "missing.json"), time.Minute); err != nil {
+		t.Errorf("Expected a missing state file to be ignored, got %v", err)
+	}
+}
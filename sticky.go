@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultStickyCookie is the affinity cookie unless StickySessions names
+// another.
+const defaultStickyCookie = "lb_sticky"
+
+// StickyFailure is what a sticky session does when its pinned server is
+// unavailable or fails.
+type StickyFailure string
+
+const (
+	// StickyFail answers with the failure and keeps the affinity, so the
+	// session returns to its server once it recovers.
+	StickyFail StickyFailure = "fail"
+
+	// StickyRepin sends the request to another server and, once it
+	// succeeds there, pins the session to that server.
+	StickyRepin StickyFailure = "re-pin"
+
+	// StickyBestEffort sends the request to another server without changing
+	// the affinity.
+	StickyBestEffort StickyFailure = "best-effort"
+)
+
+// StickySessions pins clients to the server that first answered them with
+// an affinity cookie, Cookie or lb_sticky by default, naming the server by
+// a hash of its address. A pinned server that is down, draining or at its
+// concurrency limit, or whose attempt fails where the retry policy would
+// retry it, is handled as OnFailure decides, StickyFail by default.
+// Cookies naming a server that left the pool start a new session. The
+// outcome is logged and recorded in the access log's sticky field.
+type StickySessions struct {
+	Cookie    string
+	OnFailure StickyFailure
+}
+
+// WithStickySessions enables sticky sessions.
+func WithStickySessions(s StickySessions) Option {
+	return func(lb *LoadBalancer) {
+		lb.sticky = s.withDefaults()
+	}
+}
+
+// withDefaults returns a copy of s with its defaults filled in.
+func (s StickySessions) withDefaults() *StickySessions {
+	if s.Cookie == "" {
+		s.Cookie = defaultStickyCookie
+	}
+	if s.OnFailure == "" {
+		s.OnFailure = StickyFail
+	}
+
+	return &s
+}
+
+// stickyFor returns the sticky sessions of req, preferring the matching
+// route's, or nil.
+func (lb *LoadBalancer) stickyFor(req *http.Request) *StickySessions {
+	if route := lb.matchRoute(req); route != nil && route.Sticky != nil {
+		return route.Sticky
+	}
+
+	return lb.sticky
+}
+
+// Outcomes of sticky sessions, as logged.
+const (
+	stickyNew        = "new"
+	stickyPinned     = "pinned"
+	stickyRepinned   = "re-pinned"
+	stickyBestEffort = "best-effort"
+	stickyFailed     = "failed"
+)
+
+// stickySession is the affinity of one request.
+type stickySession struct {
+	policy *StickySessions
+
+	// pinned is the server named by the request's cookie, or nil.
+	pinned Server
+
+	// outcome is how the session was served, once known.
+	outcome string
+}
+
+// stickySession returns the affinity of req, or nil without sticky
+// sessions.
+func (lb *LoadBalancer) stickySession(req *http.Request) *stickySession {
+	policy := lb.stickyFor(req)
+	if policy == nil {
+		return nil
+	}
+	session := &stickySession{policy: policy}
+	c, err := req.Cookie(policy.Cookie)
+	if err != nil {
+		return session
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, s := range lb.servers {
+		if opaqueServerID(s) == c.Value {
+			session.pinned = s
+			break
+		}
+	}
+	if session.pinned == nil {
+		fmt.Printf("sticky session: cookie %s=%s names no server, starting a new session\n", policy.Cookie, c.Value)
+	}
+
+	return session
+}
+
+// claimPinned selects the pinned server of session if it is available,
+// returning nil otherwise.
+func (lb *LoadBalancer) claimPinned(session *stickySession) Server {
+	if session == nil || session.pinned == nil {
+		return nil
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	server, now := session.pinned, lb.now()
+	addr := serverName(server)
+	if !lb.aliveLocked(server, now) || lb.warming[addr] != nil || lb.drainingLocked(addr) {
+		return nil
+	}
+	if _, ok := maintenanceUntil(server, now); ok {
+		return nil
+	}
+	c := lb.countersFor(addr)
+	if limit := serverMaxConcurrent(server); limit > 0 && c.inFlight >= int64(limit) {
+		return nil
+	}
+	c.requests++
+	c.inFlight++
+
+	return server
+}
+
+// unavailable handles the pinned server of session being unavailable. It
+// returns the error to answer with under StickyFail, and nil when the
+// request may go to another server.
+func (s *stickySession) unavailable() error {
+	if s.policy.OnFailure == StickyFail {
+		s.outcome = stickyFailed
+		fmt.Printf("sticky session: pinned server %q unavailable, failing (%s)\n", serverName(s.pinned), s.policy.OnFailure)
+		return fmt.Errorf("sticky session: pinned server %q: %w", serverName(s.pinned), ErrNoAvailableServers)
+	}
+	fmt.Printf("sticky session: pinned server %q unavailable, selecting another (%s)\n", serverName(s.pinned), s.policy.OnFailure)
+
+	return nil
+}
+
+// retries reports whether a failed attempt on server may be retried on
+// another server.
+func (s *stickySession) retries(server Server) bool {
+	return s == nil || s.pinned != server || s.policy.OnFailure != StickyFail
+}
+
+// failed records a failed attempt on server.
+func (s *stickySession) failed(server Server) {
+	if s == nil || s.pinned != server {
+		return
+	}
+	if s.policy.OnFailure == StickyFail {
+		s.outcome = stickyFailed
+		fmt.Printf("sticky session: pinned server %q failed, failing (%s)\n", serverName(server), s.policy.OnFailure)
+		return
+	}
+	fmt.Printf("sticky session: pinned server %q failed, retrying elsewhere (%s)\n", serverName(server), s.policy.OnFailure)
+}
+
+// commitHook returns the hook setting the affinity cookie on a response of
+// server as the policy requires. Failed responses never change it.
+func (s *stickySession) commitHook(server Server) func(status int, header http.Header) {
+	if s == nil {
+		return nil
+	}
+
+	return func(status int, header http.Header) {
+		switch {
+		case status >= http.StatusInternalServerError:
+			if s.policy.OnFailure == StickyFail {
+				s.failed(server)
+			}
+			return
+		case s.pinned == server:
+			s.outcome = stickyPinned
+			return
+		case s.pinned == nil:
+			s.outcome = stickyNew
+		case s.policy.OnFailure == StickyRepin:
+			s.outcome = stickyRepinned
+			fmt.Printf("sticky session: re-pinned from %q to %q\n", serverName(s.pinned), serverName(server))
+		default:
+			s.outcome = stickyBestEffort
+			return
+		}
+		cookie := &http.Cookie{Name: s.policy.Cookie, Value: opaqueServerID(server), Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+		header.Add("Set-Cookie", cookie.String())
+	}
+}
+
+// result returns the outcome of the session for the access log.
+func (s *stickySession) result() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.outcome
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stickyBackend is a backend counting its requests that answers 503 while
+// down.
+type stickyBackend struct {
+	Server
+	hits atomic.Int64
+	down atomic.Bool
+}
+
+func newStickyBackend(t *testing.T) *stickyBackend {
+	b := &stickyBackend{}
+	b.Server = newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		b.hits.Add(1)
+		if b.down.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	return b
+}
+
+// stickyCookie returns the affinity cookie set by rw, or nil.
+func stickyCookie(rw *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == defaultStickyCookie {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestStickySessions_FailureOfPinnedServer(t *testing.T) {
+	tests := []struct {
+		policy    StickyFailure
+		wantCode  int
+		wantOther int64
+		wantRepin bool
+	}{
+		{StickyFail, http.StatusServiceUnavailable, 0, false},
+		{StickyRepin, http.StatusOK, 1, true},
+		{StickyBestEffort, http.StatusOK, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			backends := []*stickyBackend{newStickyBackend(t), newStickyBackend(t)}
+			lb := newTestLoadBalancer(t, []Server{backends[0].Server, backends[1].Server},
+				WithRetryPolicy(RetryPolicy{Attempts: 2}),
+				WithStickySessions(StickySessions{OnFailure: tt.policy}))
+
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+			cookie := stickyCookie(rw)
+			if cookie == nil {
+				t.Fatal("Expected the first response to set the affinity cookie")
+			}
+			var pinned, other *stickyBackend
+			for i, b := range backends {
+				if cookie.Value == opaqueServerID(b.Server) {
+					pinned, other = b, backends[1-i]
+				}
+			}
+			if pinned == nil || pinned.hits.Load() != 1 {
+				t.Fatalf("Expected the cookie to name the server that answered, got %q", cookie.Value)
+			}
+
+			for range 3 {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.AddCookie(cookie)
+				rw := httptest.NewRecorder()
+				lb.serveProxy(rw, req)
+				if rw.Code != http.StatusOK || stickyCookie(rw) != nil {
+					t.Fatalf("Expected pinned requests to succeed without a new cookie, got %d", rw.Code)
+				}
+			}
+			if pinned.hits.Load() != 4 || other.hits.Load() != 0 {
+				t.Fatalf("Expected every request on the pinned server, got %d and %d", pinned.hits.Load(), other.hits.Load())
+			}
+
+			pinned.down.Store(true)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(cookie)
+			rw = httptest.NewRecorder()
+			lb.serveProxy(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Errorf("Expected %d, got %d", tt.wantCode, rw.Code)
+			}
+			if pinned.hits.Load() != 5 || other.hits.Load() != tt.wantOther {
+				t.Errorf("Expected %d requests on the other server, got %d (pinned %d)", tt.wantOther, other.hits.Load(), pinned.hits.Load())
+			}
+			got := stickyCookie(rw)
+			switch {
+			case tt.wantRepin && (got == nil || got.Value != opaqueServerID(other.Server)):
+				t.Errorf("Expected the cookie to be rewritten to the other server, got %v", got)
+			case !tt.wantRepin && got != nil:
+				t.Errorf("Expected the cookie to be kept, got %v", got)
+			}
+		})
+	}
+}
+
+func TestStickySessions_RepinOnlyOnSuccess(t *testing.T) {
+	backends := []*stickyBackend{newStickyBackend(t), newStickyBackend(t)}
+	lb := newTestLoadBalancer(t, []Server{backends[0].Server, backends[1].Server},
+		WithRetryPolicy(RetryPolicy{Attempts: 2}),
+		WithStickySessions(StickySessions{OnFailure: StickyRepin}))
+
+	// Round robin selects backends[0] for the retry.
+	cookie := &http.Cookie{Name: defaultStickyCookie, Value: opaqueServerID(backends[1].Server)}
+	for _, b := range backends {
+		b.down.Store(true)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the failed retry's status, got %d", rw.Code)
+	}
+	if backends[0].hits.Load() != 1 || backends[1].hits.Load() != 1 {
+		t.Errorf("Expected one attempt on each server, got %d and %d", backends[0].hits.Load(), backends[1].hits.Load())
+	}
+	if got := stickyCookie(rw); got != nil {
+		t.Errorf("Expected a failed retry to keep the cookie, got %v", got)
+	}
+}
+
+func TestStickySessions_UnavailablePinnedServer(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	handler := func(name string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+		}
+	}
+	for _, policy := range []StickyFailure{StickyFail, StickyRepin, StickyBestEffort} {
+		t.Run(string(policy), func(t *testing.T) {
+			clear(hits)
+			pinned := newBackendServer(t, handler("pinned"))
+			lb := newTestLoadBalancer(t, []Server{pinned, newBackendServer(t, handler("other"))},
+				WithStickySessions(StickySessions{OnFailure: policy}))
+			pinned.(HealthSettable).SetAlive(false)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: defaultStickyCookie, Value: opaqueServerID(pinned)})
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, req)
+
+			if policy == StickyFail {
+				if rw.Code != http.StatusServiceUnavailable || hits["other"] != 0 {
+					t.Errorf("Expected the request to fail without another server, got %d, %v", rw.Code, hits)
+				}
+				return
+			}
+			if rw.Code != http.StatusOK || hits["other"] != 1 {
+				t.Errorf("Expected the request on the other server, got %d, %v", rw.Code, hits)
+			}
+			if got := stickyCookie(rw); (got != nil) != (policy == StickyRepin) {
+				t.Errorf("Expected the cookie to be rewritten only when re-pinning, got %v", got)
+			}
+		})
+	}
+}
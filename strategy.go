@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Candidate is an alive server eligible for selection together with the
+// load information strategies base their decision on.
+type Candidate struct {
+	Server   Server
+	Weight   int
+	InFlight int64
+}
+
+// Strategy picks the server a request is forwarded to. Select is called with
+// the load balancer's lock held and a non-empty candidate list, so
+// implementations need no synchronization of their own. req is nil when a
+// server is selected outside of a request.
+//
+// A strategy that cannot decide for req, such as a hash strategy whose key is
+// missing, returns ErrStrategyPass so the next strategy in the chain is
+// consulted.
+type Strategy interface {
+	Name() string
+	Select(req *http.Request, candidates []Candidate) (Server, error)
+}
+
+// WithStrategy sets the selection strategy. The default is round-robin.
+func WithStrategy(strategy Strategy) Option {
+	return WithStrategyChain(strategy)
+}
+
+// WithStrategyChain sets an ordered list of strategies. Each request is
+// offered to the strategies in turn until one of them decides; the last one
+// should always decide.
+func WithStrategyChain(strategies ...Strategy) Option {
+	return func(lb *LoadBalancer) {
+		lb.strategies = strategies
+	}
+}
+
+// defaultCookieName is the affinity cookie hashed by "cookie-hash" when no
+// name is given.
+const defaultCookieName = "lb_session"
+
+// newStrategy returns the strategy registered under name. Hash strategies
+// take their key after a colon, as in "cookie-hash:SESSIONID",
+// "header-hash:X-Tenant", "query-hash:tenant", "path-hash:^/tenants/([^/]+)",
+// "path-param-hash:id" for a parameter of the route's path pattern or
+// "hash:<extractor>" for an extractor added with RegisterKeyExtractor.
+// "consistent-hash:<key>" takes a key as understood by newKeyExtractor, as in
+// "consistent-hash:header:X-Tenant", and so does "weighted-rendezvous:<key>".
+func newStrategy(name string) (Strategy, error) {
+	name, arg, _ := strings.Cut(name, ":")
+	switch name {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "weighted-least-connections":
+		return &weightedLeastConnections{}, nil
+	case "least-reported-load":
+		return &leastReportedLoad{now: time.Now}, nil
+	case "cookie-hash":
+		if arg == "" {
+			arg = defaultCookieName
+		}
+		return HashStrategy(name, CookieKey(arg)), nil
+	case "client-ip-hash":
+		return HashStrategy(name, ClientIPKey()), nil
+	case "header-hash", "query-hash", "path-hash", "path-param-hash":
+		if arg == "" {
+			return nil, fmt.Errorf("strategy %q needs a key, as in %q", name, name+":<key>")
+		}
+		switch name {
+		case "header-hash":
+			return HashStrategy(name, HeaderKey(arg)), nil
+		case "query-hash":
+			return HashStrategy(name, QueryKey(arg)), nil
+		case "path-param-hash":
+			return HashStrategy(name, PathParamKey(arg)), nil
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %q: %w", name, err)
+		}
+		extract, err := PathKey(re)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %q: %w", name, err)
+		}
+		return HashStrategy(name, extract), nil
+	case "hash":
+		extract, ok := registeredKeyExtractor(arg)
+		if !ok {
+			return nil, fmt.Errorf("strategy %q: no key extractor registered as %q", name, arg)
+		}
+		return HashStrategy(name+":"+arg, extract), nil
+	case "consistent-hash":
+		extract, err := newKeyExtractor(arg)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %q: %w", name, err)
+		}
+		return ConsistentHashStrategy(name, extract, defaultHashLoadFactor), nil
+	case "weighted-rendezvous":
+		extract, err := newKeyExtractor(arg)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %q: %w", name, err)
+		}
+		return WeightedRendezvousStrategy(name, extract), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+}
+
+// newStrategyChain returns the strategies registered under names, in order.
+func newStrategyChain(names []string) ([]Strategy, error) {
+	strategies := make([]Strategy, 0, len(names))
+	for _, name := range names {
+		strategy, err := newStrategy(name)
+		if err != nil {
+			return nil, err
+		}
+		strategies = append(strategies, strategy)
+	}
+
+	return strategies, nil
+}
+
+// strategyNames describes a strategy chain, e.g. "cookie-hash -> round-robin".
+func strategyNames(strategies []Strategy) string {
+	names := make([]string, len(strategies))
+	for i, s := range strategies {
+		names[i] = s.Name()
+	}
+
+	return strings.Join(names, " -> ")
+}
+
+// roundRobin cycles through the candidates in order.
+type roundRobin struct {
+	count int
+}
+
+func (s *roundRobin) Name() string {
+	return "round-robin"
+}
+
+func (s *roundRobin) Select(_ *http.Request, candidates []Candidate) (Server, error) {
+	server := candidates[s.count%len(candidates)].Server
+	s.count++
+
+	return server, nil
+}
+
+// weightedLeastConnections picks the candidate with the lowest in-flight to
+// weight ratio, so a weight-4 server carries four times the concurrent
+// requests of a weight-1 server. Servers with weight 0 are only used when no
+// weighted server is available, and equal scores are broken round-robin so
+// selection still rotates when traffic is low.
+type weightedLeastConnections struct {
+	count int
+}
+
+func (s *weightedLeastConnections) Name() string {
+	return "weighted-least-connections"
+}
+
+func (s *weightedLeastConnections) Select(_ *http.Request, candidates []Candidate) (Server, error) {
+	weighted := make([]Candidate, 0, len(candidates))
+	for _, c := range candidates {
+		if c.Weight > 0 {
+			weighted = append(weighted, c)
+		}
+	}
+	if len(weighted) == 0 {
+		weighted = make([]Candidate, len(candidates))
+		for i, c := range candidates {
+			c.Weight = 1
+			weighted[i] = c
+		}
+	}
+
+	// Compare inFlight/weight ratios by cross-multiplying to stay in integers.
+	var best []Candidate
+	for _, c := range weighted {
+		if len(best) == 0 {
+			best = append(best, c)
+			continue
+		}
+		lhs, rhs := c.InFlight*int64(best[0].Weight), best[0].InFlight*int64(c.Weight)
+		switch {
+		case lhs < rhs:
+			best = append(best[:0], c)
+		case lhs == rhs:
+			best = append(best, c)
+		}
+	}
+
+	server := best[s.count%len(best)].Server
+	s.count++
+
+	return server, nil
+}
+
+// leastReportedLoad picks the candidate reporting the lowest load in its
+// health checks, breaking ties round-robin. Loads are only comparable when
+// every candidate reported a fresh one, so it falls back to round-robin
+// while any report is missing or stale.
+type leastReportedLoad struct {
+	count    int
+	fallback roundRobin
+	now      func() time.Time
+}
+
+func (s *leastReportedLoad) Name() string {
+	return "least-reported-load"
+}
+
+func (s *leastReportedLoad) Select(req *http.Request, candidates []Candidate) (Server, error) {
+	now := s.now()
+	var best []Server
+	lowest := 0.0
+	for _, c := range candidates {
+		r, ok := c.Server.(LoadReporter)
+		if !ok {
+			return s.fallback.Select(req, candidates)
+		}
+		report := r.ReportedLoad(now)
+		if report == nil || report.Stale {
+			return s.fallback.Select(req, candidates)
+		}
+		switch {
+		case len(best) == 0 || report.Load < lowest:
+			best, lowest = append(best[:0], c.Server), report.Load
+		case report.Load == lowest:
+			best = append(best, c.Server)
+		}
+	}
+
+	server := best[s.count%len(best)]
+	s.count++
+
+	return server, nil
+}
+
+// hashStrategy maps the key extracted from a request onto a candidate, so
+// requests with the same key keep reaching the same server while the pool is
+// unchanged. It passes when the request has no key.
+type hashStrategy struct {
+	name    string
+	extract KeyExtractor
+}
+
+// HashStrategy returns a strategy named name that hashes the key extract
+// derives from each request.
+func HashStrategy(name string, extract KeyExtractor) Strategy {
+	return &hashStrategy{name: name, extract: extract}
+}
+
+func (s *hashStrategy) Name() string {
+	return s.name
+}
+
+func (s *hashStrategy) Select(req *http.Request, candidates []Candidate) (Server, error) {
+	if req == nil {
+		return nil, ErrStrategyPass
+	}
+	key, ok := s.extract(req)
+	if !ok {
+		return nil, ErrStrategyPass
+	}
+
+	return hashCandidate(key, candidates), nil
+}
+
+func (s *hashStrategy) affinityKey(req *http.Request) (string, bool) {
+	return s.extract(req)
+}
+
+// hashCandidate picks the candidate key hashes to.
+func hashCandidate(key string, candidates []Candidate) Server {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return candidates[h.Sum32()%uint32(len(candidates))].Server
+}
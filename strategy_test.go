@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowMockServer is a weighted mock server whose responses block until
+// release is closed.
+type slowMockServer struct {
+	addr    string
+	weight  int
+	release chan struct{}
+}
+
+func (m *slowMockServer) Address() string { return m.addr }
+func (m *slowMockServer) IsAlive() bool   { return true }
+func (m *slowMockServer) Weight() int     { return m.weight }
+
+func (m *slowMockServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	<-m.release
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestWeightedLeastConnections_SteadyStateRatio(t *testing.T) {
+	release := make(chan struct{})
+	light := &slowMockServer{addr: "http://light.com", weight: 1, release: release}
+	heavy := &slowMockServer{addr: "http://heavy.com", weight: 3, release: release}
+	lb := newTestLoadBalancer(t, []Server{light, heavy}, WithStrategy(&weightedLeastConnections{}))
+
+	// Start slow requests that stay in flight until released
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var stats []ServerStats
+	for time.Now().Before(deadline) {
+		stats = lb.Stats()
+		if stats[0].InFlight+stats[1].InFlight == 40 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if stats[0].InFlight < 9 || stats[0].InFlight > 11 || stats[1].InFlight < 29 || stats[1].InFlight > 31 {
+		t.Errorf("Expected in-flight counts near 10:30, got %d:%d", stats[0].InFlight, stats[1].InFlight)
+	}
+	for _, s := range lb.Stats() {
+		if s.InFlight != 0 {
+			t.Errorf("Expected %s to have no requests in flight after release, got %d", s.Address, s.InFlight)
+		}
+	}
+}
+
+func TestWeightedLeastConnections_TiesRotate(t *testing.T) {
+	strategy := &weightedLeastConnections{}
+	candidates := []Candidate{
+		{Server: &MockServer{addr: "http://server1.com"}, Weight: 2},
+		{Server: &MockServer{addr: "http://server2.com"}, Weight: 2},
+		{Server: &MockServer{addr: "http://server3.com"}, Weight: 2},
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		server, _ := strategy.Select(nil, candidates)
+		seen[server.Address()]++
+	}
+	for _, c := range candidates {
+		if seen[c.Server.Address()] != 2 {
+			t.Errorf("Expected idle ties to rotate evenly, got %v", seen)
+		}
+	}
+}
+
+func TestWeightedLeastConnections_ZeroWeight(t *testing.T) {
+	strategy := &weightedLeastConnections{}
+	standby := Candidate{Server: &MockServer{addr: "http://standby.com"}, Weight: 0}
+	busy := Candidate{Server: &MockServer{addr: "http://busy.com"}, Weight: 1, InFlight: 100}
+
+	if got, _ := strategy.Select(nil, []Candidate{standby, busy}); got.Address() != "http://busy.com" {
+		t.Errorf("Expected weighted server to be preferred over weight 0, got %s", got.Address())
+	}
+	if got, _ := strategy.Select(nil, []Candidate{standby}); got.Address() != "http://standby.com" {
+		t.Errorf("Expected weight 0 server when nothing else is available, got %s", got.Address())
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"", "round-robin", "weighted-least-connections", "least-reported-load", "cookie-hash", "cookie-hash:SESSIONID", "client-ip-hash"} {
+		if _, err := newStrategy(name); err != nil {
+			t.Errorf("Expected strategy %q to exist, got %v", name, err)
+		}
+	}
+	if _, err := newStrategy("random"); err == nil {
+		t.Errorf("Expected unknown strategy to be rejected")
+	}
+}
+
+// chainLoadBalancer returns a load balancer using the chain
+// [cookie-hash, client-ip-hash, round-robin] that logs its strategy decisions
+// to log.
+func chainLoadBalancer(t *testing.T, log *syncBuffer) *LoadBalancer {
+	var servers []Server
+	for _, addr := range []string{"http://server1.com", "http://server2.com", "http://server3.com"} {
+		servers = append(servers, &MockServer{addr: addr, isAlive: true})
+	}
+	chain, _ := newStrategyChain([]string{"cookie-hash:session", "client-ip-hash", "round-robin"})
+	logger := slog.New(slog.NewJSONHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	return newTestLoadBalancer(t, servers, WithStrategyChain(chain...), WithLogger(logger), WithLogLevel(slog.LevelDebug))
+}
+
+// decidingStrategies returns the strategy recorded in each debug log line.
+func decidingStrategies(t *testing.T, log *syncBuffer) []string {
+	var strategies []string
+	for _, entry := range accessLogEntries(t, log) {
+		strategies = append(strategies, entry["strategy"].(string))
+	}
+	return strategies
+}
+
+func TestStrategyChain_FallsThroughWithoutCookie(t *testing.T) {
+	log := &syncBuffer{}
+	lb := chainLoadBalancer(t, log)
+
+	// The same client IP always reaches the same server
+	var first string
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.7:5000"
+		server, err := lb.selectServer(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == "" {
+			first = server.Address()
+		} else if server.Address() != first {
+			t.Errorf("Expected IP hash to stick to %s, got %s", first, server.Address())
+		}
+	}
+
+	for _, strategy := range decidingStrategies(t, log) {
+		if strategy != "client-ip-hash" {
+			t.Errorf("Expected client-ip-hash to decide, got %s", strategy)
+		}
+	}
+
+	// Without a remote address the chain ends at round-robin
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = ""
+	if _, err := lb.selectServer(req); err != nil {
+		t.Fatal(err)
+	}
+	if strategies := decidingStrategies(t, log); strategies[len(strategies)-1] != "round-robin" {
+		t.Errorf("Expected round-robin to decide last, got %v", strategies)
+	}
+}
+
+func TestStrategyChain_CookieShortCircuits(t *testing.T) {
+	log := &syncBuffer{}
+	lb := chainLoadBalancer(t, log)
+
+	// Requests from different IPs with the same cookie stick together
+	var first string
+	for i, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":5000"
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		server, err := lb.selectServer(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = server.Address()
+		} else if server.Address() != first {
+			t.Errorf("Expected cookie hash to stick to %s, got %s", first, server.Address())
+		}
+	}
+
+	for _, strategy := range decidingStrategies(t, log) {
+		if strategy != "cookie-hash" {
+			t.Errorf("Expected cookie-hash to decide, got %s", strategy)
+		}
+	}
+}
+
+func TestStrategyChain_AllPass(t *testing.T) {
+	strategy, _ := newStrategy("client-ip-hash")
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}}, WithStrategy(strategy))
+
+	if _, err := lb.getNextAvailableServer(); !errors.Is(err, ErrNoAvailableServers) {
+		t.Errorf("Expected ErrNoAvailableServers when every strategy passes, got %v", err)
+	}
+}
+
+// loadBackend answers health checks with the load tests set, or without a
+// load once silenced.
+type loadBackend struct {
+	load   atomic.Int64
+	silent atomic.Bool
+	server *simpleServer
+}
+
+func newLoadBackends(t *testing.T, loads ...int64) []*loadBackend {
+	var backends []*loadBackend
+	for _, load := range loads {
+		b := &loadBackend{}
+		b.load.Store(load)
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if b.silent.Load() {
+				rw.Write([]byte(`{"status": "ok"}`))
+				return
+			}
+			fmt.Fprintf(rw, `{"status": "ok", "load": {"queue_depth": %d}}`, b.load.Load())
+		}))
+		t.Cleanup(srv.Close)
+		server, err := newSimpleServer(srv.URL, WithHealthCheck(HealthCheck{
+			Path: "/health", Interval: 20 * time.Millisecond, LoadPath: "load.queue_depth", LoadStaleIntervals: 2,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.server = server
+		backends = append(backends, b)
+	}
+
+	return backends
+}
+
+func probeAll(t *testing.T, backends []*loadBackend) {
+	for _, b := range backends {
+		if err := b.server.Probe(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLeastReportedLoad(t *testing.T) {
+	backends := newLoadBackends(t, 7, 2, 5)
+	strategy, _ := newStrategy("least-reported-load")
+	lb := newTestLoadBalancer(t, []Server{backends[0].server, backends[1].server, backends[2].server}, WithStrategy(strategy))
+	probeAll(t, backends)
+
+	for range 5 {
+		if server, err := lb.getNextAvailableServer(); err != nil || server != backends[1].server {
+			t.Fatalf("Expected the least loaded server, got %v, %v", server, err)
+		}
+	}
+	backends[1].load.Store(9)
+	probeAll(t, backends)
+	if server, _ := lb.getNextAvailableServer(); server != backends[2].server {
+		t.Errorf("Expected selection to follow the reported load, got %v", server)
+	}
+
+	// One server stops reporting: its load goes stale, and selection falls
+	// back to round-robin over every server.
+	backends[2].silent.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	probeAll(t, backends)
+	seen := make(map[Server]bool)
+	for range 3 {
+		server, _ := lb.getNextAvailableServer()
+		seen[server] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected round-robin over every server, got %d distinct servers", len(seen))
+	}
+
+	rw := httptest.NewRecorder()
+	lb.handleMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		fmt.Sprintf(`lb_server_reported_load{server=%q} 9`, backends[1].server.Address()),
+		fmt.Sprintf(`lb_server_reported_load_stale{server=%q} 1`, backends[2].server.Address()),
+		fmt.Sprintf(`lb_server_reported_load_stale{server=%q} 0`, backends[0].server.Address()),
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
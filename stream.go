@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errStreamClosed is returned for writes to a stream the load balancer
+// closed.
+var errStreamClosed = errors.New("stream closed by the load balancer")
+
+// wsGoingAway is the WebSocket close code of an endpoint going away.
+const wsGoingAway = 1001
+
+const (
+	// defaultStreamShutdownGrace is how long streams may go on after
+	// shutdown began without WithStreamShutdown.
+	defaultStreamShutdownGrace = 5 * time.Second
+
+	// defaultShutdownEvent is sent to event streams closed at shutdown
+	// without WithStreamShutdown.
+	defaultShutdownEvent = "event: reconnect\ndata: shutting down\n\n"
+)
+
+// Reasons the load balancer closes a stream, as counted in the metrics.
+const (
+	streamMaxDuration = "max_duration"
+	streamIdle        = "idle"
+	streamDrain       = "drain"
+	streamShutdown    = "shutdown"
+)
+
+// StreamPolicy bounds long-lived connections: upgraded ones such as
+// WebSockets and streamed responses such as server-sent events. A stream is
+// closed once it has been open for MaxDuration, once no bytes have flowed
+// in either direction for IdleTimeout, or DrainGrace after its server
+// started draining; zero values disable each limit. WebSockets get a going
+// away close frame first; other upgraded connections are closed and
+// event streams are cut off.
+type StreamPolicy struct {
+	MaxDuration time.Duration
+	IdleTimeout time.Duration
+	DrainGrace  time.Duration
+}
+
+// WithStreamPolicy sets the stream policy of requests whose route has none.
+func WithStreamPolicy(p StreamPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.streamPolicy = &p
+	}
+}
+
+// StreamShutdown is how streams end when the load balancer shuts down.
+// They go on for Grace, then event streams are sent Event, raw text such as
+// "event: reconnect\ndata: bye\n\n", and closed, and WebSockets get a going
+// away close frame. Streams would otherwise hold the drain of requests on
+// shutdown up to its timeout.
+type StreamShutdown struct {
+	Grace time.Duration
+	Event string
+}
+
+// WithStreamShutdown sets how streams end at shutdown. By default, and
+// for zero fields, they go on for 5s and event streams are sent a reconnect
+// event.
+func WithStreamShutdown(s StreamShutdown) Option {
+	return func(lb *LoadBalancer) {
+		if s.Grace > 0 {
+			lb.streams.grace = s.Grace
+		}
+		if s.Event != "" {
+			// The event must end with the blank line dispatching it.
+			lb.streams.event = strings.TrimRight(s.Event, "\n") + "\n\n"
+		}
+	}
+}
+
+// streamPolicyFor returns the stream policy applying to req, or nil.
+func (lb *LoadBalancer) streamPolicyFor(req *http.Request) *StreamPolicy {
+	if route := lb.matchRoute(req); route != nil && route.Streams != nil {
+		return route.Streams
+	}
+
+	return lb.streamPolicy
+}
+
+// streamTracker holds the open streams, to shorten their deadline when
+// their server drains or the load balancer shuts down.
+type streamTracker struct {
+	mu      sync.Mutex
+	watches map[*streamWatch]struct{}
+
+	// stopped is poked whenever a stream ends.
+	stopped chan struct{}
+
+	// shutdownAt is when shutdown began, after which streams end within
+	// grace, event streams with event.
+	shutdownAt atomic.Int64
+	grace      time.Duration
+	event      string
+
+	closes sync.Map // reason -> *atomic.Uint64
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{
+		watches: make(map[*streamWatch]struct{}),
+		stopped: make(chan struct{}, 1),
+		grace:   defaultStreamShutdownGrace,
+		event:   defaultShutdownEvent,
+	}
+}
+
+// ShutdownStreams ends the streams of the load balancer for shutdown and
+// waits until they are closed or ctx is done. Streams go on for the grace
+// of the stream shutdown, as do those starting meanwhile, then event
+// streams are sent the shutdown event and WebSockets a going away close
+// frame. Upgrades are refused from now on.
+func (lb *LoadBalancer) ShutdownStreams(ctx context.Context) error {
+	lb.BeginShutdown()
+	t := lb.streams
+	t.shutdownAt.CompareAndSwap(0, time.Now().UnixNano())
+	t.mu.Lock()
+	for w := range t.watches {
+		w.poke()
+	}
+	t.mu.Unlock()
+
+	for {
+		t.mu.Lock()
+		open := len(t.watches)
+		t.mu.Unlock()
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-t.stopped:
+		case <-ctx.Done():
+			return fmt.Errorf("%d streams still open after shutdown", open)
+		}
+	}
+}
+
+// draining starts the drain grace of the streams to the server with the
+// given name, or cancels it when draining is false.
+func (t *streamTracker) draining(addr string, draining bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for w := range t.watches {
+		if w.server != addr {
+			continue
+		}
+		if draining {
+			w.drainAt.CompareAndSwap(0, time.Now().UnixNano())
+		} else {
+			w.drainAt.Store(0)
+		}
+		w.poke()
+	}
+}
+
+// closed counts a stream closed for reason.
+func (t *streamTracker) closed(reason string) {
+	n, _ := t.closes.LoadOrStore(reason, &atomic.Uint64{})
+	n.(*atomic.Uint64).Add(1)
+}
+
+// writeMetrics renders the open streams and the streams closed by reason.
+func (t *streamTracker) writeMetrics(w io.Writer) {
+	t.mu.Lock()
+	open := len(t.watches)
+	t.mu.Unlock()
+	fmt.Fprintln(w, "# HELP lb_streams_open Open upgraded connections and event streams.")
+	fmt.Fprintln(w, "# TYPE lb_streams_open gauge")
+	fmt.Fprintf(w, "lb_streams_open %d\n", open)
+	fmt.Fprintln(w, "# HELP lb_stream_closes_total Streams closed by the load balancer by reason.")
+	fmt.Fprintln(w, "# TYPE lb_stream_closes_total counter")
+	for _, reason := range []string{streamMaxDuration, streamIdle, streamDrain, streamShutdown} {
+		var n uint64
+		if v, ok := t.closes.Load(reason); ok {
+			n = v.(*atomic.Uint64).Load()
+		}
+		fmt.Fprintf(w, "lb_stream_closes_total{reason=%q} %d\n", reason, n)
+	}
+}
+
+// streamWatch enforces the stream policy of one request once its response
+// turns out to be a stream.
+type streamWatch struct {
+	lb        *LoadBalancer
+	policy    *StreamPolicy
+	websocket bool
+	cancel    context.CancelFunc
+
+	// server is the address of the server the request was sent to.
+	server string
+
+	// conn is the hijacked client connection of an upgraded stream, nil
+	// for event streams.
+	conn net.Conn
+
+	// client writes the response of the request.
+	client *countingResponseWriter
+
+	// writeMu serializes writes to conn or client so the close frame or
+	// shutdown event does not land inside another write; nothing is
+	// written once cutOff.
+	writeMu sync.Mutex
+	cutOff  bool
+
+	started  bool
+	start    time.Time
+	last     atomic.Int64
+	drainAt  atomic.Int64
+	wake     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// watchStream returns the watch of req, answered through client, under
+// policy, whose cancel cuts off an event stream.
+func (lb *LoadBalancer) watchStream(req *http.Request, client *countingResponseWriter, policy *StreamPolicy, cancel context.CancelFunc) *streamWatch {
+	return &streamWatch{
+		lb:        lb,
+		policy:    policy,
+		websocket: strings.EqualFold(req.Header.Get("Upgrade"), "websocket"),
+		client:    client,
+		cancel:    cancel,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// watchEventStream returns the watch of an event stream from server,
+// answered through client, which cancel cuts off.
+func (lb *LoadBalancer) watchEventStream(client *countingResponseWriter, server Server, cancel context.CancelFunc) *streamWatch {
+	w := &streamWatch{
+		lb:     lb,
+		policy: &StreamPolicy{},
+		client: client,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	w.attach(server)
+
+	return w
+}
+
+// attach records server as the server of the request.
+func (w *streamWatch) attach(server Server) {
+	if w != nil {
+		w.server = serverName(server)
+	}
+}
+
+// begin starts enforcing the policy on the stream, on conn when the
+// connection was upgraded.
+func (w *streamWatch) begin(conn net.Conn) {
+	if w.started {
+		return
+	}
+	w.started, w.conn, w.start = true, conn, time.Now()
+	w.touch()
+
+	t := w.lb.streams
+	t.mu.Lock()
+	t.watches[w] = struct{}{}
+	t.mu.Unlock()
+	w.lb.mu.Lock()
+	if w.lb.drainingLocked(w.server) {
+		w.drainAt.Store(w.start.UnixNano())
+	}
+	w.lb.mu.Unlock()
+
+	go w.run()
+}
+
+// upgraded starts enforcing the policy on the hijacked connection conn,
+// returning it wrapped to track the bytes flowing through it.
+func (w *streamWatch) upgraded(conn net.Conn) net.Conn {
+	w.begin(conn)
+	return &streamConn{Conn: conn, watch: w}
+}
+
+// responding starts enforcing the policy on event streams.
+func (w *streamWatch) responding(status int, header http.Header) {
+	if isEventStream(status, header) {
+		w.begin(nil)
+	}
+}
+
+// isEventStream reports whether a response with status and header is an
+// event stream.
+func isEventStream(status int, header http.Header) bool {
+	if status != http.StatusOK {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return err == nil && t == "text/event-stream"
+}
+
+// touch records bytes flowing through the stream.
+func (w *streamWatch) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// poke makes the watch reconsider its deadline.
+func (w *streamWatch) poke() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the watch once the stream is over.
+func (w *streamWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() {
+		close(w.done)
+		t := w.lb.streams
+		t.mu.Lock()
+		delete(t.watches, w)
+		t.mu.Unlock()
+		select {
+		case t.stopped <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// deadline returns when the stream must be closed and why, or the zero
+// time while no limit applies.
+func (w *streamWatch) deadline() (time.Time, string) {
+	var at time.Time
+	var reason string
+	limit := func(t time.Time, r string) {
+		if at.IsZero() || t.Before(at) {
+			at, reason = t, r
+		}
+	}
+	if p := w.policy; p.MaxDuration > 0 {
+		limit(w.start.Add(p.MaxDuration), streamMaxDuration)
+	}
+	if p := w.policy; p.IdleTimeout > 0 {
+		limit(time.Unix(0, w.last.Load()).Add(p.IdleTimeout), streamIdle)
+	}
+	if d := w.drainAt.Load(); d != 0 && w.policy.DrainGrace > 0 {
+		limit(time.Unix(0, d).Add(w.policy.DrainGrace), streamDrain)
+	}
+	if t := w.lb.streams; t.shutdownAt.Load() != 0 {
+		limit(time.Unix(0, t.shutdownAt.Load()).Add(t.grace), streamShutdown)
+	}
+
+	return at, reason
+}
+
+// run closes the stream once its deadline passes.
+func (w *streamWatch) run() {
+	for {
+		at, reason := w.deadline()
+		wait := time.Duration(1<<63 - 1)
+		if !at.IsZero() {
+			if wait = time.Until(at); wait <= 0 {
+				w.close(reason)
+				return
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.wake:
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// close closes the stream for reason.
+func (w *streamWatch) close(reason string) {
+	w.lb.streams.closed(reason)
+	if w.conn == nil {
+		fmt.Printf("closing event stream to %q: %s\n", w.server, reason)
+		if reason == streamShutdown {
+			w.notify(w.lb.streams.event)
+		}
+		w.cancel()
+		return
+	}
+
+	fmt.Printf("closing upgraded connection to %q: %s\n", w.server, reason)
+	if w.websocket {
+		// A client that stopped reading must not hold the close up.
+		w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		w.writeMu.Lock()
+		w.conn.Write(wsCloseFrame(wsGoingAway, reason))
+		w.writeMu.Unlock()
+	}
+	w.conn.Close()
+}
+
+// notify sends event as the last bytes of the event stream.
+func (w *streamWatch) notify(event string) {
+	rc := http.NewResponseController(w.client.ResponseWriter)
+	// A client that stopped reading must not hold the event up.
+	rc.SetWriteDeadline(time.Now().Add(time.Second))
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.cutOff = true
+	n, _ := io.WriteString(w.client.ResponseWriter, event)
+	w.client.written.Add(int64(n))
+	rc.Flush()
+}
+
+// wsCloseFrame returns an unmasked WebSocket close frame with code and
+// reason.
+func wsCloseFrame(code uint16, reason string) []byte {
+	frame := []byte{0x88, byte(2 + len(reason)), 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], code)
+
+	return append(frame, reason...)
+}
+
+// streamConn is a hijacked client connection under a stream policy. The
+// proxy's copy loops read and write through it, recording activity.
+type streamConn struct {
+	net.Conn
+	watch *streamWatch
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.watch.touch()
+	}
+
+	return n, err
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.watch.writeMu.Lock()
+	n, err := c.Conn.Write(p)
+	c.watch.writeMu.Unlock()
+	if n > 0 {
+		c.watch.touch()
+	}
+
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	c.watch.stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsEcho accepts a WebSocket upgrade and echoes the raw bytes it reads.
+func wsEcho(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Connection", "Upgrade")
+	rw.Header().Set("Upgrade", "websocket")
+	rw.WriteHeader(http.StatusSwitchingProtocols)
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.Copy(conn, brw)
+}
+
+// newStreamingBalancer proxies to a backend running handler under policy.
+func newStreamingBalancer(t *testing.T, handler http.HandlerFunc, policy StreamPolicy) (*LoadBalancer, Server, *httptest.Server) {
+	server := newBackendServer(t, handler)
+	lb := newTestLoadBalancer(t, []Server{server}, WithStreamPolicy(policy))
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	t.Cleanup(front.Close)
+
+	return lb, server, front
+}
+
+// dialWebSocket upgrades a connection to front.
+func dialWebSocket(t *testing.T, front *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %v, %v", resp, err)
+	}
+
+	return conn, br
+}
+
+// echo sends ping and reads it back, returning the close frame's reason
+// instead if the connection is closed.
+func echo(conn net.Conn, br *bufio.Reader) (closed bool, reason string, err error) {
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		return false, "", err
+	}
+	first, err := br.ReadByte()
+	if err != nil {
+		return false, "", err
+	}
+	if first != 0x88 {
+		rest := make([]byte, 3)
+		_, err := io.ReadFull(br, rest)
+		return false, "", err
+	}
+	reason, err = readCloseFrame(br)
+	return true, reason, err
+}
+
+// readCloseFrame reads the rest of a close frame whose first byte was read,
+// checking its going away code, and returns its reason.
+func readCloseFrame(br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return "", err
+	}
+	if code := binary.BigEndian.Uint16(payload); code != wsGoingAway {
+		return "", fmt.Errorf("close code %d", code)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return "", fmt.Errorf("expected the connection to be closed, got %v", err)
+	}
+
+	return string(payload[2:]), nil
+}
+
+// awaitClose reads until the close frame and returns its reason.
+func awaitClose(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	first, err := br.ReadByte()
+	if err != nil || first != 0x88 {
+		t.Fatalf("Expected a close frame, got %#x, %v", first, err)
+	}
+	reason, err := readCloseFrame(br)
+	if err != nil {
+		t.Fatalf("Expected a going away close frame: %v", err)
+	}
+
+	return reason
+}
+
+func TestStreamPolicy_IdleTimeout(t *testing.T) {
+	lb, _, front := newStreamingBalancer(t, wsEcho, StreamPolicy{IdleTimeout: 150 * time.Millisecond})
+	conn, br := dialWebSocket(t, front)
+
+	for range 3 {
+		if closed, _, err := echo(conn, br); closed || err != nil {
+			t.Fatalf("Expected the echo while active, got closed=%v, %v", closed, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	start := time.Now()
+	if reason := awaitClose(t, br); reason != streamIdle {
+		t.Errorf("Expected an idle close, got %q", reason)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the close after the idle timeout, got %v", elapsed)
+	}
+
+	waitFor(t, "the stream to be released", func() bool {
+		return lb.Stats()[0].InFlight == 0
+	})
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`lb_stream_closes_total{reason="idle"} 1`, "lb_streams_open 0"} {
+		if !strings.Contains(metrics.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
+
+func TestStreamPolicy_MaxDuration(t *testing.T) {
+	_, _, front := newStreamingBalancer(t, wsEcho, StreamPolicy{
+		MaxDuration: 300 * time.Millisecond,
+		IdleTimeout: 150 * time.Millisecond,
+	})
+	conn, br := dialWebSocket(t, front)
+
+	start := time.Now()
+	for {
+		closed, reason, err := echo(conn, br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closed {
+			if reason != streamMaxDuration {
+				t.Errorf("Expected a max duration close, got %q", reason)
+			}
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected the connection to live for its max duration, closed after %v", elapsed)
+	}
+}
+
+func TestStreamPolicy_DrainShortensDeadline(t *testing.T) {
+	lb, server, front := newStreamingBalancer(t, wsEcho, StreamPolicy{
+		MaxDuration: time.Hour,
+		DrainGrace:  100 * time.Millisecond,
+	})
+	conn, br := dialWebSocket(t, front)
+	if closed, _, err := echo(conn, br); closed || err != nil {
+		t.Fatalf("Expected the echo, got closed=%v, %v", closed, err)
+	}
+
+	drained, err := lb.Drain(server.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if reason := awaitClose(t, br); reason != streamDrain {
+		t.Errorf("Expected a drain close, got %q", reason)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the drain grace to cut the connection short, took %v", elapsed)
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the drain to complete once the connection closed")
+	}
+}
+
+func TestStreamPolicy_EventStreamIdle(t *testing.T) {
+	lb, _, front := newStreamingBalancer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(rw, "data: hello\n\n")
+		http.NewResponseController(rw).Flush()
+		<-req.Context().Done()
+	}, StreamPolicy{IdleTimeout: 100 * time.Millisecond})
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: hello\n" {
+		t.Fatalf("Expected the first event, got %q, %v", line, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, resp.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle event stream to be cut off")
+	}
+	waitFor(t, "the stream to be released", func() bool {
+		return lb.Stats()[0].InFlight == 0
+	})
+}
+
+func TestStreamShutdown(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "" {
+			wsEcho(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(rw, "data: hello\n\n")
+		http.NewResponseController(rw).Flush()
+		<-req.Context().Done()
+	})
+	lb := newTestLoadBalancer(t, []Server{server},
+		WithStreamShutdown(StreamShutdown{Grace: 200 * time.Millisecond, Event: "event: reconnect\ndata: bye"}))
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	t.Cleanup(front.Close)
+
+	resp, err := http.Get(front.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	if line, err := events.ReadString('\n'); err != nil || line != "data: hello\n" {
+		t.Fatalf("Expected the first event, got %q, %v", line, err)
+	}
+	_, br := dialWebSocket(t, front)
+
+	// Read both streams to their end while shutting down.
+	rest := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(events)
+		rest <- string(b)
+	}()
+	reason := make(chan string, 1)
+	go func() {
+		first, _ := br.ReadByte()
+		r, err := readCloseFrame(br)
+		if first != 0x88 || err != nil {
+			r = fmt.Sprintf("no close frame: %#x, %v", first, err)
+		}
+		reason <- r
+	}()
+
+	// The drain timeout is far longer than the grace of streams.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	streamsErr := make(chan error, 1)
+	go func() { streamsErr <- lb.ShutdownStreams(ctx) }()
+	if err := front.Config.Shutdown(ctx); err != nil {
+		t.Errorf("Expected the drain to complete, got %v", err)
+	}
+	if err := <-streamsErr; err != nil {
+		t.Errorf("Expected the streams to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to take the 200ms grace of streams, took %v", elapsed)
+	}
+
+	if got := <-rest; !strings.Contains(got, "event: reconnect\ndata: bye\n\n") {
+		t.Errorf("Expected the event stream to end with the shutdown event, got %q", got)
+	}
+	if got := <-reason; got != streamShutdown {
+		t.Errorf("Expected a going away close frame for the shutdown, got %q", got)
+	}
+
+	rw := httptest.NewRecorder()
+	upgrade := httptest.NewRequest("GET", "/", nil)
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	lb.serveProxy(rw, upgrade)
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected upgrades to be refused after shutdown began, got %d", rw.Code)
+	}
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `lb_stream_closes_total{reason="shutdown"} 2`; !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected %q in the metrics", want)
+	}
+}
+
+func TestStreamShutdown_WatchesOnlyStreams(t *testing.T) {
+	responding := make(chan struct{})
+	release := make(chan struct{})
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/events" {
+			rw.Header().Set("Content-Type", "text/event-stream")
+		}
+		rw.WriteHeader(http.StatusOK)
+		http.NewResponseController(rw).Flush()
+		responding <- struct{}{}
+		<-release
+	})
+	lb := newTestLoadBalancer(t, []Server{server})
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	t.Cleanup(front.Close)
+
+	open := func() int {
+		lb.streams.mu.Lock()
+		defer lb.streams.mu.Unlock()
+		return len(lb.streams.watches)
+	}
+	for path, want := range map[string]int{"/plain": 0, "/events": 1} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if resp, err := http.Get(front.URL + path); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+		<-responding
+		waitFor(t, fmt.Sprintf("%d watches during %s", want, path), func() bool { return open() == want })
+		release <- struct{}{}
+		<-done
+		waitFor(t, "no watch after "+path, func() bool { return open() == 0 })
+	}
+}
+
+func TestStreamShutdownConfig(t *testing.T) {
+	lb, err := (&Config{
+		Port:           "0",
+		Servers:        []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		StreamShutdown: &StreamShutdownConfig{Event: "event: reconnect\n"},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.streams.grace != defaultStreamShutdownGrace || lb.streams.event != "event: reconnect\n\n" {
+		t.Errorf("Expected the default grace and the event ended by a blank line, got %s and %q", lb.streams.grace, lb.streams.event)
+	}
+
+	_, err = (&Config{
+		Port:           "0",
+		Servers:        []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		StreamShutdown: &StreamShutdownConfig{Grace: Duration(-time.Second)},
+	}).Build()
+	if err == nil || !strings.Contains(err.Error(), "grace must not be negative") {
+		t.Errorf("Expected a negative grace to be rejected, got %v", err)
+	}
+}
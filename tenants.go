@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTenantHeader identifies tenants unless Tenants names another
+// header.
+const defaultTenantHeader = "X-Tenant"
+
+// TenantSource is what identifies the tenant of a request.
+type TenantSource string
+
+const (
+	// TenantByHeader identifies tenants by the value of a request header.
+	TenantByHeader TenantSource = "header"
+
+	// TenantByAPIKey identifies tenants by the ID of the request's API key.
+	// It requires WithAPIKeys.
+	TenantByAPIKey TenantSource = "api_key"
+
+	// TenantByHost identifies tenants by the request's host, without port.
+	TenantByHost TenantSource = "host"
+)
+
+// Tenants isolates the teams sharing the load balancer. The tenant of a
+// request is identified by Source, reading Header, X-Tenant by default, for
+// TenantByHeader. Key, a key as understood by newKeyExtractor such as
+// "path:^/tenants/([^/]+)", identifies them instead of Source if set.
+// Requests of unknown tenants are handled as the tenant named Default, or
+// rejected with 403 without one.
+type Tenants struct {
+	Source  TenantSource
+	Header  string
+	Key     string
+	Tenants []Tenant
+	Default string
+}
+
+// Tenant is a tenant of Tenants. Its requests are recognized by the values
+// in IDs, or by Name without any, and only reach servers matching Selector
+// in addition to the selector of their route. They are limited to
+// RateLimit if set and to MaxConcurrent requests in flight if positive,
+// answering 429 beyond either. Limits and metrics are kept per tenant, so
+// one tenant at its limits does not hold up the others.
+type Tenant struct {
+	Name          string
+	IDs           []string
+	Selector      Selector
+	RateLimit     *RateLimit
+	MaxConcurrent int
+}
+
+// WithTenants enables tenant isolation. NewLoadBalancer fails if the
+// tenants are invalid.
+func WithTenants(t Tenants) Option {
+	return func(lb *LoadBalancer) {
+		if t.Source == "" {
+			t.Source = TenantByHeader
+		}
+		if t.Header == "" {
+			t.Header = defaultTenantHeader
+		}
+		lb.tenants = &tenantRegistry{config: t}
+	}
+}
+
+// tenantRegistry holds the state of each tenant. It is built once, so
+// looking tenants up takes no lock; each tenant guards its own state.
+type tenantRegistry struct {
+	config  Tenants
+	states  []*tenantState
+	byID    map[string]*tenantState
+	unknown atomic.Uint64
+
+	// fallback is the default tenant, if any.
+	fallback *tenantState
+
+	// extract reads the tenant ID of a request as Source says.
+	extract KeyExtractor
+}
+
+// tenantState is the accounting of a tenant.
+type tenantState struct {
+	tenant Tenant
+
+	mu       sync.Mutex
+	limiter  *rateLimiter
+	inFlight int
+	results  map[string]uint64
+	duration *histogram
+}
+
+// Results counted per tenant.
+const (
+	tenantOK        = "ok"
+	tenantError     = "error"
+	tenantLimited   = "limited"
+	tenantSaturated = "saturated"
+)
+
+var tenantResults = []string{tenantOK, tenantError, tenantLimited, tenantSaturated}
+
+// init validates the tenants and builds their state.
+func (r *tenantRegistry) init(apiKeys bool) error {
+	switch source := r.config.Source; {
+	case r.config.Key != "":
+		extract, err := newKeyExtractor(r.config.Key)
+		if err != nil {
+			return fmt.Errorf("tenants: %w", err)
+		}
+		if r.config.Key == "api-key" && !apiKeys {
+			return fmt.Errorf("tenants: key %q requires api keys", r.config.Key)
+		}
+		r.extract = extract
+	case source == TenantByHeader:
+		r.extract = HeaderKey(r.config.Header)
+	case source == TenantByHost:
+		r.extract = HostKey()
+	case source == TenantByAPIKey:
+		if !apiKeys {
+			return fmt.Errorf("tenants: source %q requires api keys", r.config.Source)
+		}
+		r.extract = APIKeyIDKey()
+	default:
+		return fmt.Errorf("tenants: unknown source %q", r.config.Source)
+	}
+
+	r.byID = make(map[string]*tenantState)
+	names := make(map[string]bool)
+	for _, t := range r.config.Tenants {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("tenant %q: names must be set and unique", t.Name)
+		}
+		if l := t.RateLimit; l != nil && (l.PerSecond <= 0 || l.Burst < 0) {
+			return fmt.Errorf("tenant %q: rate limit must be positive", t.Name)
+		}
+		var limiter *rateLimiter
+		if t.RateLimit != nil {
+			var err error
+			if limiter, err = newRateLimiter(*t.RateLimit); err != nil {
+				return fmt.Errorf("tenant %q: rate limit: %w", t.Name, err)
+			}
+		}
+		if t.MaxConcurrent < 0 {
+			return fmt.Errorf("tenant %q: max concurrent must not be negative", t.Name)
+		}
+		names[t.Name] = true
+
+		state := &tenantState{
+			tenant:   t,
+			limiter:  limiter,
+			results:  make(map[string]uint64),
+			duration: newHistogram(defaultLatencyBuckets),
+		}
+		r.states = append(r.states, state)
+		ids := t.IDs
+		if len(ids) == 0 {
+			ids = []string{t.Name}
+		}
+		for _, id := range ids {
+			if r.byID[id] != nil {
+				return fmt.Errorf("tenant %q: id %q already belongs to tenant %q", t.Name, id, r.byID[id].tenant.Name)
+			}
+			r.byID[id] = state
+		}
+	}
+	if r.config.Default != "" {
+		for _, state := range r.states {
+			if state.tenant.Name == r.config.Default {
+				r.fallback = state
+			}
+		}
+		if r.fallback == nil {
+			return fmt.Errorf("tenants: default %q is not a tenant", r.config.Default)
+		}
+	}
+
+	return nil
+}
+
+// identify returns the tenant of req, falling back to the default tenant,
+// or nil for unknown tenants without one.
+func (r *tenantRegistry) identify(req *http.Request) *tenantState {
+	id, _ := r.extract(req)
+	if state := r.byID[id]; state != nil {
+		return state
+	}
+	r.unknown.Add(1)
+
+	return r.fallback
+}
+
+// acquire admits req, a request of the tenant, at now. It returns
+// ErrRateLimited with the time until a request is allowed again, or
+// ErrTenantSaturated. With shared set, the rate limit is taken from the
+// shared store rather than the local bucket.
+func (s *tenantState) acquire(req *http.Request, shared *sharedRateLimiter, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit := s.tenant.MaxConcurrent; limit > 0 && s.inFlight >= limit {
+		s.results[tenantSaturated]++
+		return 0, fmt.Errorf("tenant %q: %w", s.tenant.Name, ErrTenantSaturated)
+	}
+	if s.limiter != nil {
+		var wait time.Duration
+		bucket := s.limiter.bucket(req)
+		if shared != nil {
+			// The request holds its slot while the store, which is not to
+			// be waited on with the tenant locked, decides.
+			s.inFlight++
+			s.mu.Unlock()
+			wait = shared.take(req.Context(), "tenant:"+s.tenant.Name+bucket, *s.tenant.RateLimit, now)
+			s.mu.Lock()
+			s.inFlight--
+		} else {
+			wait = s.limiter.take(bucket, now)
+		}
+		if wait > 0 {
+			s.results[tenantLimited]++
+			return wait, fmt.Errorf("tenant %q: %w", s.tenant.Name, ErrRateLimited)
+		}
+	}
+	s.inFlight++
+
+	return 0, nil
+}
+
+// release accounts for the completion of an admitted request.
+func (s *tenantState) release(status int, duration time.Duration) {
+	s.duration.Observe(duration)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight--
+	if status >= http.StatusInternalServerError {
+		s.results[tenantError]++
+	} else {
+		s.results[tenantOK]++
+	}
+}
+
+// admitTenant identifies the tenant of req, records it in the request's
+// info and admits it against the tenant's limits. Admitted requests must be
+// released. Failures are answered on rw.
+func (lb *LoadBalancer) admitTenant(rw http.ResponseWriter, req *http.Request) (*tenantState, error) {
+	if lb.tenants == nil {
+		return nil, nil
+	}
+	state := lb.tenants.identify(req)
+	if state == nil {
+		writeError(rw, ErrUnknownTenant)
+		return nil, ErrUnknownTenant
+	}
+	if info := requestInfo(req); info != nil {
+		info.tenant = state
+	}
+	wait, err := state.acquire(req, lb.sharedLimits, lb.now())
+	if err != nil {
+		if wait > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		writeError(rw, err)
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// requestTenant returns the tenant of req, or nil.
+func requestTenant(req *http.Request) *tenantState {
+	if info := requestInfo(req); info != nil {
+		return info.tenant
+	}
+
+	return nil
+}
+
+// tenantName returns the name of the tenant of req, if any.
+func tenantName(req *http.Request) string {
+	if state := requestTenant(req); state != nil {
+		return state.tenant.Name
+	}
+
+	return ""
+}
+
+// tenantSelector returns the selector of the tenant of req, if any.
+func tenantSelector(req *http.Request) Selector {
+	if req == nil {
+		return nil
+	}
+	if state := requestTenant(req); state != nil {
+		return state.tenant.Selector
+	}
+
+	return nil
+}
+
+// writeMetrics renders the requests, requests in flight and request
+// durations of each tenant. Only configured tenants are labelled; requests
+// of other tenants are counted together.
+func (r *tenantRegistry) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP lb_tenant_requests_total Requests by tenant and result.")
+	fmt.Fprintln(w, "# TYPE lb_tenant_requests_total counter")
+	for _, s := range r.states {
+		s.mu.Lock()
+		for _, result := range tenantResults {
+			fmt.Fprintf(w, "lb_tenant_requests_total{tenant=%q,result=%q} %d\n", s.tenant.Name, result, s.results[result])
+		}
+		s.mu.Unlock()
+	}
+	fmt.Fprintln(w, "# HELP lb_tenant_in_flight Requests of the tenant in flight.")
+	fmt.Fprintln(w, "# TYPE lb_tenant_in_flight gauge")
+	for _, s := range r.states {
+		s.mu.Lock()
+		fmt.Fprintf(w, "lb_tenant_in_flight{tenant=%q} %d\n", s.tenant.Name, s.inFlight)
+		s.mu.Unlock()
+	}
+	fmt.Fprintln(w, "# HELP lb_tenant_request_duration_seconds Time to complete the admitted requests of the tenant.")
+	fmt.Fprintln(w, "# TYPE lb_tenant_request_duration_seconds histogram")
+	for _, s := range r.states {
+		s.duration.writeSeries(w, "lb_tenant_request_duration_seconds", fmt.Sprintf("tenant=%q", s.tenant.Name))
+	}
+	fmt.Fprintln(w, "# HELP lb_tenant_unknown_total Requests of tenants that are not configured.")
+	fmt.Fprintln(w, "# TYPE lb_tenant_unknown_total counter")
+	fmt.Fprintf(w, "lb_tenant_unknown_total %d\n", r.unknown.Load())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTenants_SaturatedTenantDoesNotAffectOthers(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	hits := map[string]int{}
+	handler := func(name string, block bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			if block {
+				<-release
+			}
+		}
+	}
+	lb := newTestLoadBalancer(t, []Server{
+		newBackendServer(t, handler("a", true), WithLabels(map[string]string{"team": "a"})),
+		newBackendServer(t, handler("b", false), WithLabels(map[string]string{"team": "b"})),
+	}, WithTenants(Tenants{Tenants: []Tenant{
+		{Name: "a", Selector: Selector{{Key: "team", Operator: OpEquals, Values: []string{"a"}}}, MaxConcurrent: 2},
+		{Name: "b", Selector: Selector{{Key: "team", Operator: OpEquals, Values: []string{"b"}}}, MaxConcurrent: 2},
+	}}))
+	send := func(tenant string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		return rw.Code
+	}
+	metrics := func() string {
+		rw := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+		return rw.Body.String()
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send("a")
+		}()
+	}
+	waitFor(t, "tenant a at its cap", func() bool {
+		return strings.Contains(metrics(), `lb_tenant_in_flight{tenant="a"} 2`)
+	})
+
+	var slowest time.Duration
+	for range 20 {
+		if code := send("a"); code != http.StatusTooManyRequests {
+			t.Errorf("Expected tenant a to be rejected at its cap, got %d", code)
+		}
+		start := time.Now()
+		if code := send("b"); code != http.StatusOK {
+			t.Errorf("Expected tenant b to be served, got %d", code)
+		}
+		slowest = max(slowest, time.Since(start))
+	}
+	if slowest > time.Second {
+		t.Errorf("Expected tenant b to be served promptly, slowest request took %v", slowest)
+	}
+	close(release)
+	wg.Wait()
+
+	if hits["a"] != 2 || hits["b"] != 20 {
+		t.Errorf("Expected each tenant to reach its own servers, got %v", hits)
+	}
+	body := metrics()
+	for _, line := range []string{
+		`lb_tenant_requests_total{tenant="a",result="ok"} 2`,
+		`lb_tenant_requests_total{tenant="a",result="saturated"} 20`,
+		`lb_tenant_requests_total{tenant="b",result="ok"} 20`,
+		`lb_tenant_requests_total{tenant="b",result="saturated"} 0`,
+		`lb_tenant_in_flight{tenant="a"} 0`,
+		`lb_tenant_request_duration_seconds_count{tenant="b"} 20`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+}
+
+func TestTenants_UnknownTenants(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	tenants := Tenants{Source: TenantByHost, Tenants: []Tenant{
+		{Name: "a", IDs: []string{"a.example.com"}},
+		{Name: "shared"},
+	}}
+
+	lb := newTestLoadBalancer(t, []Server{server}, WithTenants(tenants))
+	for host, want := range map[string]int{
+		"a.example.com:8000": http.StatusOK,
+		"b.example.com":      http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != want {
+			t.Errorf("%s: Expected %d, got %d", host, want, rw.Code)
+		}
+	}
+
+	tenants.Default = "shared"
+	lb = newTestLoadBalancer(t, []Server{server}, WithTenants(tenants))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "b.example.com"
+	lb.serveProxy(httptest.NewRecorder(), req)
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`lb_tenant_requests_total{tenant="shared",result="ok"} 1`,
+		`lb_tenant_unknown_total 1`,
+	} {
+		if !strings.Contains(rw.Body.String(), line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+	if strings.Contains(rw.Body.String(), `tenant="b.example.com"`) {
+		t.Error("Expected unknown tenants not to be labelled")
+	}
+
+	tenants.Default = "missing"
+	if _, err := NewLoadBalancer("8000", []Server{server}, WithTenants(tenants)); err == nil {
+		t.Error("Expected an unknown default tenant to be rejected")
+	}
+}
+
+func TestTenants_ByAPIKey(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	tenants := Tenants{Source: TenantByAPIKey, Tenants: []Tenant{
+		{Name: "partners", IDs: []string{"partner"}},
+	}}
+	lb := newTestLoadBalancer(t, []Server{server}, WithTenants(tenants), WithAPIKeys(APIKeys{
+		Keys: []APIKey{{ID: "partner", SHA256: HashAPIKey("s3cret")}, {ID: "other", SHA256: HashAPIKey("other")}},
+	}))
+
+	if rw := keyedGet(lb, "/", "s3cret"); rw.Code != http.StatusOK {
+		t.Errorf("Expected the key's tenant to be admitted, got %d", rw.Code)
+	}
+	if rw := keyedGet(lb, "/", "other"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected a key of no tenant to be rejected, got %d", rw.Code)
+	}
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `lb_tenant_requests_total{tenant="partners",result="ok"} 1`; !strings.Contains(rw.Body.String(), line) {
+		t.Errorf("Expected %q in the metrics", line)
+	}
+
+	if _, err := NewLoadBalancer("8000", []Server{server}, WithTenants(tenants)); err == nil {
+		t.Error("Expected tenants by API key to require API keys")
+	}
+}
+
+func TestTenants_ByPathKey(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server}, WithTenants(Tenants{Key: "path:^/tenants/([^/]+)/", Tenants: []Tenant{
+		{Name: "acme", RateLimit: &RateLimit{PerSecond: 1, Burst: 1, Key: "query:user"}},
+	}}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	get := func(path string) int {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+
+	if code := get("/tenants/acme/orders?user=a"); code != http.StatusOK {
+		t.Errorf("Expected the tenant in the path to be admitted, got %d", code)
+	}
+	if code := get("/tenants/globex/orders?user=a"); code != http.StatusForbidden {
+		t.Errorf("Expected an unknown tenant in the path to be rejected, got %d", code)
+	}
+	if code := get("/orders"); code != http.StatusForbidden {
+		t.Errorf("Expected a path without tenant to be rejected, got %d", code)
+	}
+
+	// The tenant's limit applies to each user on its own.
+	if code := get("/tenants/acme/orders?user=a"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the user to be limited, got %d", code)
+	}
+	if code := get("/tenants/acme/orders?user=b"); code != http.StatusOK {
+		t.Errorf("Expected another user to be unaffected, got %d", code)
+	}
+	if code := get("/tenants/acme/orders"); code != http.StatusOK {
+		t.Errorf("Expected requests without user to share a limit, got %d", code)
+	}
+	if code := get("/tenants/acme/orders"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected requests without user to be limited together, got %d", code)
+	}
+}
+
+func TestTenants_ByQueryKey(t *testing.T) {
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {})
+	lb := newTestLoadBalancer(t, []Server{server}, WithTenants(Tenants{Key: "query:tenant", Tenants: []Tenant{{Name: "acme"}}}))
+
+	for path, want := range map[string]int{
+		"/?tenant=acme":   http.StatusOK,
+		"/?tenant=globex": http.StatusForbidden,
+		"/":               http.StatusForbidden,
+	} {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rw.Code)
+		}
+	}
+
+	for _, tenants := range []Tenants{
+		{Key: "query", Tenants: []Tenant{{Name: "acme"}}},
+		{Key: "api-key", Tenants: []Tenant{{Name: "acme"}}},
+		{Tenants: []Tenant{{Name: "acme", RateLimit: &RateLimit{PerSecond: 1, Key: "path:("}}}},
+	} {
+		if _, err := NewLoadBalancer("8000", []Server{server}, WithTenants(tenants)); err == nil {
+			t.Errorf("Expected key %q or rate limit key to be rejected", tenants.Key)
+		}
+	}
+	if _, err := (&TenantsConfig{Source: TenantByHost, Key: "query:tenant"}).build(); err == nil {
+		t.Error("Expected a key with a source to be rejected")
+	}
+}
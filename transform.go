@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultTransformMaxBody = 1 << 20
+
+// RequestTransformer rewrites the bodies of requests it matches. Transform
+// receives the whole body and returns the body to forward, which must not
+// exceed limit bytes; it may adjust the headers of req to describe the new
+// body. Content-Length is set by the load balancer.
+type RequestTransformer interface {
+	Match(req *http.Request) bool
+	Transform(req *http.Request, body []byte, limit int64) ([]byte, error)
+}
+
+// BodyTransform applies Transformers in order to the request bodies of a
+// route. Bodies matched by a transformer are read whole, up to MaxBody, 1MiB
+// by default; larger bodies, before or after a transformation, are rejected
+// with 413. A failing transformation is answered with FailureStatus, 400 or
+// 502, 400 by default, and nothing is sent to a server. Requests matched by
+// no transformer are streamed through untouched.
+type BodyTransform struct {
+	Transformers  []RequestTransformer
+	MaxBody       int64
+	FailureStatus int
+}
+
+// transformBody applies the body transformation of the route of req, if
+// any. Failures are answered on rw.
+func (lb *LoadBalancer) transformBody(rw http.ResponseWriter, req *http.Request) error {
+	route := lb.matchRoute(req)
+	if route == nil || route.Transform == nil || journalDelivery(req) {
+		return nil
+	}
+	t := route.Transform
+	var matched []RequestTransformer
+	for _, transformer := range t.Transformers {
+		if transformer.Match(req) {
+			matched = append(matched, transformer)
+		}
+	}
+	if len(matched) == 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	maxBody := t.MaxBody
+	if maxBody <= 0 {
+		maxBody = defaultTransformMaxBody
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil {
+		err = fmt.Errorf("%w: read body: %v", ErrClientClosed, err)
+		writeError(rw, err)
+		return err
+	}
+	if int64(len(body)) > maxBody {
+		err = fmt.Errorf("%w: exceeds %d bytes to transform", ErrBodyTooLarge, maxBody)
+		writeError(rw, err)
+		return err
+	}
+	// Transformers work on a copy of the request, so a failure midway
+	// leaves nothing half-transformed behind.
+	out := req.Clone(req.Context())
+	for _, transformer := range matched {
+		if body, err = transformer.Transform(out, body, maxBody); err == nil && int64(len(body)) > maxBody {
+			err = fmt.Errorf("%w: transformed body exceeds %d bytes", ErrBodyTooLarge, maxBody)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrBodyTooLarge) {
+				err = fmt.Errorf("%w: %v", ErrTransform, err)
+			}
+			if t.FailureStatus != 0 && errors.Is(err, ErrTransform) {
+				writeStatus(rw, t.FailureStatus)
+			} else {
+				writeError(rw, err)
+			}
+			return err
+		}
+	}
+
+	req.Header = out.Header
+	req.Header.Del("Content-Length")
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return nil
+}
+
+// GzipDecompress decompresses request bodies sent with Content-Encoding
+// gzip, for servers that cannot, and removes the header.
+type GzipDecompress struct{}
+
+// Match reports whether the body of req is gzip encoded.
+func (GzipDecompress) Match(req *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip")
+}
+
+// Transform decompresses body, failing once the result exceeds limit.
+func (GzipDecompress) Transform(req *http.Request, body []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("%w: decompressed body exceeds %d bytes", ErrBodyTooLarge, limit)
+	}
+	req.Header.Del("Content-Encoding")
+
+	return out, nil
+}
+
+// JSONField sets the field at Path, dot separated as in "meta.tenant.id", in
+// JSON object request bodies to an attribute of the request named by From:
+// "header:<name>", "tenant" or "api_key". Objects missing along the path are
+// created. Requests lacking the attribute fail.
+type JSONField struct {
+	Path string
+	From string
+}
+
+// Match reports whether req has a JSON body.
+func (f JSONField) Match(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Transform sets the field in body.
+func (f JSONField) Transform(req *http.Request, body []byte, limit int64) ([]byte, error) {
+	value, err := f.value(req)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil || doc == nil {
+		return nil, fmt.Errorf("json field %s: body is not a JSON object", f.Path)
+	}
+	keys := strings.Split(f.Path, ".")
+	obj := doc
+	for i, key := range keys[:len(keys)-1] {
+		switch next := obj[key].(type) {
+		case map[string]any:
+			obj = next
+		case nil:
+			created := make(map[string]any)
+			obj[key] = created
+			obj = created
+		default:
+			return nil, fmt.Errorf("json field %s: %s is not an object", f.Path, strings.Join(keys[:i+1], "."))
+		}
+	}
+	obj[keys[len(keys)-1]] = value
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("json field %s: %w", f.Path, err)
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// value returns the attribute of req the field is set to.
+func (f JSONField) value(req *http.Request) (string, error) {
+	var value string
+	switch {
+	case strings.HasPrefix(f.From, "header:"):
+		value = req.Header.Get(strings.TrimPrefix(f.From, "header:"))
+	case f.From == "tenant":
+		value = tenantName(req)
+	case f.From == "api_key":
+		value = apiKeyID(req)
+	default:
+		return "", fmt.Errorf("json field %s: unknown source %q", f.Path, f.From)
+	}
+	if value == "" {
+		return "", fmt.Errorf("json field %s: request has no %s", f.Path, f.From)
+	}
+
+	return value, nil
+}
+
+// checkJSONField returns an error if f cannot be applied.
+func checkJSONField(f JSONField) error {
+	if f.Path == "" || strings.HasPrefix(f.Path, ".") || strings.HasSuffix(f.Path, ".") || strings.Contains(f.Path, "..") {
+		return fmt.Errorf("invalid json field path %q", f.Path)
+	}
+	switch {
+	case f.From == "tenant", f.From == "api_key":
+	case strings.HasPrefix(f.From, "header:") && len(f.From) > len("header:"):
+	default:
+		return fmt.Errorf("json field %s: unknown source %q, want header:<name>, tenant or api_key", f.Path, f.From)
+	}
+
+	return nil
+}
+
+// checkTransformStatus returns an error unless status may answer failed
+// transformations.
+func checkTransformStatus(status int) error {
+	switch status {
+	case 0, http.StatusBadRequest, http.StatusBadGateway:
+		return nil
+	}
+
+	return fmt.Errorf("failure status must be 400 or 502, got %d", status)
+}
+
+var (
+	customTransformersMu sync.RWMutex
+	customTransformers   = map[string]RequestTransformer{}
+)
+
+// RegisterTransformer makes a custom transformer available to configuration
+// as the transform type name.
+func RegisterTransformer(name string, transformer RequestTransformer) {
+	customTransformersMu.Lock()
+	defer customTransformersMu.Unlock()
+
+	customTransformers[name] = transformer
+}
+
+// registeredTransformer returns the transformer registered under name.
+func registeredTransformer(name string) (RequestTransformer, bool) {
+	customTransformersMu.RLock()
+	defer customTransformersMu.RUnlock()
+
+	transformer, ok := customTransformers[name]
+	return transformer, ok
+}
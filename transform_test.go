@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transformBackend records the last request it received.
+type transformBackend struct {
+	mu       sync.Mutex
+	requests int
+	header   http.Header
+	length   int64
+	body     string
+}
+
+func newTransformLoadBalancer(t *testing.T, transform BodyTransform) (*LoadBalancer, *transformBackend) {
+	b := &transformBackend{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.requests++
+		b.header, b.length, b.body = req.Header, req.ContentLength, string(body)
+	}))
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{Name: "legacy", PathPrefix: "/legacy/", Transform: &transform}))
+
+	return lb, b
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+func TestBodyTransform_GzipDecompress(t *testing.T) {
+	lb, backend := newTransformLoadBalancer(t, BodyTransform{Transformers: []RequestTransformer{GzipDecompress{}}})
+	payload := strings.Repeat("legacy payload ", 100)
+
+	req := httptest.NewRequest("POST", "/legacy/upload", bytes.NewReader(gzipped(t, payload)))
+	req.Header.Set("Content-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	if backend.body != payload {
+		t.Errorf("Expected the decompressed payload, got %q", backend.body)
+	}
+	if backend.length != int64(len(payload)) || backend.header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected Content-Length %d without Content-Encoding, got %d and %q",
+			len(payload), backend.length, backend.header.Get("Content-Encoding"))
+	}
+}
+
+func TestBodyTransform_JSONFieldNested(t *testing.T) {
+	lb, backend := newTransformLoadBalancer(t, BodyTransform{Transformers: []RequestTransformer{
+		JSONField{Path: "meta.tenant.id", From: "header:X-Tenant"},
+	}})
+
+	req := httptest.NewRequest("POST", "/legacy/orders", strings.NewReader(`{"amount":12.50,"meta":{"source":"<web>"}}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Tenant", "acme")
+	lb.serveProxy(httptest.NewRecorder(), req)
+
+	want := `{"amount":12.50,"meta":{"source":"<web>","tenant":{"id":"acme"}}}`
+	if backend.body != want {
+		t.Errorf("Expected body %s, got %s", want, backend.body)
+	}
+	if backend.length != int64(len(want)) {
+		t.Errorf("Expected Content-Length %d, got %d", len(want), backend.length)
+	}
+}
+
+func TestBodyTransform_Failures(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"default", 0, http.StatusBadRequest},
+		{"configured", http.StatusBadGateway, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, backend := newTransformLoadBalancer(t, BodyTransform{
+				Transformers:  []RequestTransformer{GzipDecompress{}, JSONField{Path: "tenant", From: "header:X-Tenant"}},
+				FailureStatus: tc.status,
+			})
+
+			// The body decompresses, but has no tenant to inject.
+			req := httptest.NewRequest("POST", "/legacy/orders", bytes.NewReader(gzipped(t, `{"amount":1}`)))
+			req.Header.Set("Content-Encoding", "gzip")
+			req.Header.Set("Content-Type", "application/json")
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, req)
+
+			if rw.Code != tc.want || backend.requests != 0 {
+				t.Errorf("Expected %d without contacting the server, got %d after %d requests", tc.want, rw.Code, backend.requests)
+			}
+		})
+	}
+}
+
+func TestBodyTransform_SizeCap(t *testing.T) {
+	lb, backend := newTransformLoadBalancer(t, BodyTransform{
+		Transformers: []RequestTransformer{GzipDecompress{}, JSONField{Path: "tenant", From: "header:X-Tenant"}},
+		MaxBody:      1024,
+	})
+
+	for name, req := range map[string]*http.Request{
+		"body":         httptest.NewRequest("POST", "/legacy/a", strings.NewReader(`{"pad":"`+strings.Repeat("x", 2048)+`"}`)),
+		"decompressed": httptest.NewRequest("POST", "/legacy/b", bytes.NewReader(gzipped(t, strings.Repeat("x", 4096)))),
+	} {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant", "acme")
+		if name == "decompressed" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, req)
+		if rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected the %s above the cap rejected with 413, got %d", name, rw.Code)
+		}
+	}
+	if backend.requests != 0 {
+		t.Errorf("Expected no request forwarded, got %d", backend.requests)
+	}
+}
+
+func TestBodyTransform_PassThrough(t *testing.T) {
+	lb, backend := newTransformLoadBalancer(t, BodyTransform{Transformers: []RequestTransformer{
+		GzipDecompress{}, JSONField{Path: "tenant", From: "header:X-Tenant"},
+	}})
+
+	for _, path := range []string{"/legacy/form", "/other"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader("a=1&b=2"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		lb.serveProxy(httptest.NewRecorder(), req)
+		if backend.body != "a=1&b=2" || backend.length != 7 {
+			t.Errorf("Expected %s forwarded untouched, got %q of length %d", path, backend.body, backend.length)
+		}
+	}
+}
+
+func TestTransformConfig(t *testing.T) {
+	RegisterTransformer("test-noop", GzipDecompress{})
+	cfg := &Config{
+		Servers: []ServerConfig{{Address: "http://localhost:9001"}},
+		Routes: []RouteConfig{{Name: "legacy", PathPrefix: "/legacy/", Transform: &TransformConfig{
+			Steps: []TransformStepConfig{
+				{Type: "gzip_decompress"},
+				{Type: "json_field", Path: "meta.tenant", From: "tenant"},
+				{Type: "test-noop"},
+			},
+			FailureStatus: http.StatusBadGateway,
+		}}},
+	}
+	if _, err := cfg.Build(); err != nil {
+		t.Fatalf("Expected the transform to build, got %v", err)
+	}
+
+	for _, bad := range []TransformConfig{
+		{},
+		{Steps: []TransformStepConfig{{Type: "rot13"}}},
+		{Steps: []TransformStepConfig{{Type: "json_field", Path: "a..b", From: "tenant"}}},
+		{Steps: []TransformStepConfig{{Type: "json_field", Path: "a", From: "cookie:x"}}},
+		{Steps: []TransformStepConfig{{Type: "gzip_decompress"}}, FailureStatus: http.StatusInternalServerError},
+	} {
+		cfg.Routes[0].Transform = &bad
+		if _, err := cfg.Build(); err == nil {
+			t.Errorf("Expected transform %+v to be rejected", bad)
+		}
+	}
+}
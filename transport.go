@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTLSSessionCacheSize is the number of TLS sessions each server's
+// transport keeps for resumption.
+const defaultTLSSessionCacheSize = 64
+
+// TransportStats describes the connections of a server's transport.
+// IdleConnections is estimated as the open connections not serving a
+// request, which is exact for HTTP/1.
+type TransportStats struct {
+	ConnectionsOpened     uint64  `json:"connections_opened"`
+	ConnectionsReused     uint64  `json:"connections_reused"`
+	TLSHandshakes         uint64  `json:"tls_handshakes"`
+	TLSResumed            uint64  `json:"tls_resumed"`
+	OpenConnections       int64   `json:"open_connections"`
+	IdleConnections       int64   `json:"idle_connections"`
+	RequestsPerConnection float64 `json:"requests_per_connection"`
+	PrewarmProbes         uint64  `json:"prewarm_probes,omitempty"`
+	PrewarmedConnections  uint64  `json:"prewarmed_connections,omitempty"`
+	StaleRetries          uint64  `json:"stale_retries,omitempty"`
+	RetiredConnections    uint64  `json:"retired_connections,omitempty"`
+}
+
+// transportReporter is implemented by servers that instrument their
+// transport.
+type transportReporter interface {
+	TransportStats() TransportStats
+}
+
+// transportCounters are updated by the dialer and the per-request traces of
+// a server's transport.
+type transportCounters struct {
+	opened     atomic.Uint64
+	reused     atomic.Uint64
+	handshakes atomic.Uint64
+	resumed    atomic.Uint64
+	requests   atomic.Uint64
+	open       atomic.Int64
+	active     atomic.Int64
+
+	// prewarmProbes and prewarmed count the probes of Prewarm and the
+	// connections they opened.
+	prewarmProbes atomic.Uint64
+	prewarmed     atomic.Uint64
+
+	// staleRetries counts requests resent after failing on a stale
+	// connection, and retired the idle connections closed at maxAge.
+	staleRetries atomic.Uint64
+	retired      atomic.Uint64
+	maxAge       time.Duration
+}
+
+func (c *transportCounters) stats() TransportStats {
+	s := TransportStats{
+		ConnectionsOpened:    c.opened.Load(),
+		ConnectionsReused:    c.reused.Load(),
+		TLSHandshakes:        c.handshakes.Load(),
+		TLSResumed:           c.resumed.Load(),
+		OpenConnections:      c.open.Load(),
+		PrewarmProbes:        c.prewarmProbes.Load(),
+		PrewarmedConnections: c.prewarmed.Load(),
+		StaleRetries:         c.staleRetries.Load(),
+		RetiredConnections:   c.retired.Load(),
+	}
+	s.IdleConnections = max(s.OpenConnections-c.active.Load(), 0)
+	if s.ConnectionsOpened > 0 {
+		s.RequestsPerConnection = float64(c.requests.Load()) / float64(s.ConnectionsOpened)
+	}
+
+	return s
+}
+
+// newTransport returns a transport like http.DefaultTransport that resumes
+// TLS sessions and counts the connections it opens in counters.
+func newTransport(counters *transportCounters) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(defaultTLSSessionCacheSize),
+	}
+
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		counters.opened.Add(1)
+		counters.open.Add(1)
+		return &countedConn{Conn: conn, counters: counters, opened: time.Now()}, nil
+	}
+
+	return transport
+}
+
+// countedConn keeps the open connection count of a transport and retires
+// the connection once it is idle and older than the transport's maxAge.
+type countedConn struct {
+	net.Conn
+	counters *transportCounters
+	once     sync.Once
+	opened   time.Time
+
+	// retire is pending while the connection is idle; retired is set once
+	// it closed the connection.
+	mu      sync.Mutex
+	retire  *time.Timer
+	retired bool
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.counters.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+type loggerKey struct{}
+
+// withLogger attaches the operational logger to ctx for code that has no
+// access to the load balancer, such as servers.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the logger attached to ctx, or nil.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	logger, _ := ctx.Value(loggerKey{}).(*slog.Logger)
+	return logger
+}
+
+// requestTrace follows one upstream request through the transport, feeding
+// the connection counters and recording the timing of each phase. Hooks may
+// run on the transport's dialing goroutines, hence the lock.
+type requestTrace struct {
+	counters *transportCounters
+	start    time.Time
+
+	mu                                    sync.Mutex
+	dnsStart, connectStart, tlsStart      time.Time
+	dns, connect, tlsHandshake, firstByte time.Duration
+	gotConn, reused                       bool
+}
+
+func newRequestTrace(counters *transportCounters) *requestTrace {
+	return &requestTrace{counters: counters, start: time.Now()}
+}
+
+// clientTrace returns the hooks to install on the request.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			t.tlsHandshake = time.Since(t.tlsStart)
+			t.mu.Unlock()
+			if err == nil {
+				t.counters.handshakes.Add(1)
+				if state.DidResume {
+					t.counters.resumed.Add(1)
+				}
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.gotConn {
+				return
+			}
+			t.gotConn, t.reused = true, info.Reused
+			t.counters.requests.Add(1)
+			t.counters.active.Add(1)
+			if info.Reused {
+				t.counters.reused.Add(1)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Since(t.start)
+		},
+	}
+}
+
+// finish records the end of the request and logs its timing at debug level.
+func (t *requestTrace) finish(ctx context.Context, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.gotConn {
+		t.counters.active.Add(-1)
+	}
+	logger := loggerFromContext(ctx)
+	if logger == nil || !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "upstream timing",
+		slog.String("server", addr),
+		slog.Bool("reused", t.reused),
+		slog.Float64("dns_ms", float64(t.dns.Microseconds())/1000),
+		slog.Float64("connect_ms", float64(t.connect.Microseconds())/1000),
+		slog.Float64("tls_ms", float64(t.tlsHandshake.Microseconds())/1000),
+		slog.Float64("ttfb_ms", float64(t.firstByte.Microseconds())/1000),
+		slog.Float64("total_ms", float64(time.Since(t.start).Microseconds())/1000),
+	)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTrustedTLSServer returns a server for an HTTPS backend that trusts its test
+// certificate.
+func newTrustedTLSServer(t *testing.T, opts ...ServerOption) (*httptest.Server, *simpleServer) {
+	t.Helper()
+	backend := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	t.Cleanup(backend.Close)
+	server, err := newSimpleServer(backend.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.transport.TLSClientConfig.RootCAs = backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return backend, server
+}
+
+func TestTransport_ConnectionReuse(t *testing.T) {
+	log := &syncBuffer{}
+	_, server := newTrustedTLSServer(t)
+	lb := newTestLoadBalancer(t, []Server{server}, WithLogLevel(slog.LevelDebug),
+		WithLogger(slog.New(slog.NewJSONHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rw.Code)
+		}
+	}
+
+	stats := lb.Stats()[0].Transport
+	if stats.ConnectionsOpened != 1 || stats.ConnectionsReused != 2 || stats.TLSHandshakes != 1 {
+		t.Errorf("Expected one connection reused twice, got %+v", stats)
+	}
+	if stats.OpenConnections != 1 || stats.IdleConnections != 1 || stats.RequestsPerConnection != 3 {
+		t.Errorf("Expected one idle connection carrying 3 requests, got %+v", stats)
+	}
+
+	var timings []map[string]any
+	for _, entry := range accessLogEntries(t, log) {
+		if entry["msg"] == "upstream timing" {
+			timings = append(timings, entry)
+		}
+	}
+	if len(timings) != 3 || timings[0]["reused"] != false || timings[1]["reused"] != true || timings[0]["tls_ms"].(float64) <= 0 {
+		t.Errorf("Expected a debug timing line per request, got %v", timings)
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	want := `lb_server_connections_reused_total{server="` + server.Address() + `"} 2`
+	if !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s, got:\n%s", want, metrics.Body.String())
+	}
+}
+
+func TestTransport_SessionResumption(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    []ServerOption
+		resumed uint64
+	}{
+		{"default", nil, 1},
+		{"disabled", []ServerOption{WithTLSSessionCache(-1)}, 0},
+	} {
+		backend, server := newTrustedTLSServer(t, tt.opts...)
+		backend.Config.SetKeepAlivesEnabled(false)
+		lb := newTestLoadBalancer(t, []Server{server})
+
+		for i := 0; i < 2; i++ {
+			rw := httptest.NewRecorder()
+			lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+			if rw.Code != http.StatusOK {
+				t.Fatalf("%s: Expected status 200, got %d", tt.name, rw.Code)
+			}
+		}
+
+		stats := lb.Stats()[0].Transport
+		if stats.TLSHandshakes != 2 || stats.TLSResumed != tt.resumed {
+			t.Errorf("%s: Expected 2 handshakes with %d resumed, got %+v", tt.name, tt.resumed, stats)
+		}
+	}
+}
+
+func TestTransport_SessionCacheConfig(t *testing.T) {
+	server, err := newServerFromConfig(ServerConfig{Address: "https://server1.com", TLSSessionCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache := server.(*simpleServer).transport.TLSClientConfig.ClientSessionCache; cache != nil {
+		t.Errorf("Expected resumption to be disabled")
+	}
+	server, _ = newServerFromConfig(ServerConfig{Address: "https://server1.com"})
+	if _, ok := server.(*simpleServer).transport.TLSClientConfig.ClientSessionCache.(tls.ClientSessionCache); !ok {
+		t.Errorf("Expected a session cache by default")
+	}
+}
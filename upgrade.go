@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// envInheritedListeners lists the listeners handed to a child process as
+	// semicolon separated "network:address" keys, in ExtraFiles order.
+	envInheritedListeners = "LB_INHERITED_LISTENERS"
+
+	// envReadyFD holds the descriptor the child writes to once it serves.
+	envReadyFD = "LB_READY_FD"
+)
+
+// Upgrader hands listening sockets over to a freshly started copy of the
+// binary so it can be replaced without refusing a single connection. The
+// child inherits the listener descriptors, signals readiness over a pipe and
+// only then does the parent stop accepting and drain.
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners map[string]net.Listener
+	packets   map[string]net.PacketConn
+	order     []string
+	readyFile *os.File
+	upgraded  bool
+
+	// exe, args and env describe the child process. They default to the
+	// running binary and its arguments.
+	exe  string
+	args []string
+	env  []string
+}
+
+// NewUpgrader returns an Upgrader, picking up any listeners and the readiness
+// pipe inherited from a parent process.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]net.Listener),
+		packets:   make(map[string]net.PacketConn),
+		args:      os.Args[1:],
+		env:       os.Environ(),
+	}
+
+	if keys := os.Getenv(envInheritedListeners); keys != "" {
+		for i, key := range strings.Split(keys, ";") {
+			u.inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+	if fd := os.Getenv(envReadyFD); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", envReadyFD, err)
+		}
+		u.readyFile = os.NewFile(uintptr(n), "ready")
+	}
+
+	return u, nil
+}
+
+// Listen returns a listener for network and address, reusing the descriptor
+// inherited from the parent when one matches.
+func (u *Upgrader) Listen(network, address string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.listenLocked(network+":"+address, func() (net.Listener, error) {
+		return net.Listen(network, address)
+	})
+}
+
+// ListenPacket returns a packet connection for network and address, such
+// as the UDP socket of the HTTP/3 listener, reusing the descriptor
+// inherited from the parent when one matches. Both processes read the
+// socket until the parent has drained, so QUIC connections of the parent
+// may be lost on upgrade.
+func (u *Upgrader) ListenPacket(network, address string) (net.PacketConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := network + ":" + address
+	if conn, ok := u.packets[key]; ok {
+		return conn, nil
+	}
+
+	var conn net.PacketConn
+	var err error
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket(network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", key, err)
+	}
+
+	u.packets[key] = conn
+	u.order = append(u.order, key)
+
+	return conn, nil
+}
+
+// ListenShards returns n listeners sharing the TCP address with
+// SO_REUSEPORT, so that the kernel spreads accepted connections across
+// them. Each shard is handed off on upgrade like any other listener. A zero
+// port is resolved by the first shard and shared by the others.
+func (u *Upgrader) ListenShards(network, address string, n int) ([]net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var shards []net.Listener
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%s:%s#%d", network, address, i)
+		bind := address
+		if i > 0 {
+			bind = shards[0].Addr().String()
+		}
+		ln, err := u.listenLocked(key, func() (net.Listener, error) {
+			return listenReusePort(network, bind)
+		})
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, ln)
+	}
+
+	return shards, nil
+}
+
+// listenLocked returns the listener registered under key, creating it from
+// the inherited descriptor or with listen. u.mu must be held.
+func (u *Upgrader) listenLocked(key string, listen func() (net.Listener, error)) (net.Listener, error) {
+	if ln, ok := u.listeners[key]; ok {
+		return ln, nil
+	}
+
+	var ln net.Listener
+	var err error
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = listen()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", key, err)
+	}
+
+	u.listeners[key] = ln
+	u.order = append(u.order, key)
+
+	return ln, nil
+}
+
+// Ready closes inherited listeners that were not claimed and tells the parent
+// process, if any, that this process is serving.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, key)
+	}
+	if u.readyFile == nil {
+		return nil
+	}
+
+	_, err := u.readyFile.Write([]byte{1})
+	u.readyFile.Close()
+	u.readyFile = nil
+
+	return err
+}
+
+// Upgrade starts a new copy of the binary, passes it every listener and waits
+// until it reports readiness or ctx is done. On failure the child is killed
+// and the caller keeps serving. On success the caller should stop accepting
+// and drain; unix socket files are left in place for the child.
+func (u *Upgrader) Upgrade(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.upgraded {
+		return errors.New("upgrade already completed")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range u.order {
+		var f *os.File
+		var err error
+		if conn, ok := u.packets[key]; ok {
+			f, err = packetConnFile(conn)
+		} else {
+			f, err = listenerFile(u.listeners[key])
+		}
+		if err != nil {
+			return fmt.Errorf("upgrade: %s: %w", key, err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	defer readyR.Close()
+
+	exe := u.exe
+	if exe == "" {
+		if exe, err = os.Executable(); err != nil {
+			readyW.Close()
+			return fmt.Errorf("upgrade: %w", err)
+		}
+	}
+
+	cmd := exec.Command(exe, u.args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(withoutUpgradeEnv(u.env),
+		envInheritedListeners+"="+strings.Join(u.order, ";"),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: start child: %w", err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgrade: child %d not ready: %w", cmd.Process.Pid, err)
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	for _, ln := range u.listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	u.upgraded = true
+	fmt.Printf("upgrade: child %d is ready, draining\n", pid)
+
+	return nil
+}
+
+// listenerFile returns a duplicate of the listener's descriptor.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	default:
+		return nil, fmt.Errorf("listener type %T cannot be handed off", ln)
+	}
+}
+
+// packetConnFile returns a duplicate of the packet connection's
+// descriptor.
+func packetConnFile(conn net.PacketConn) (*os.File, error) {
+	if c, ok := conn.(*net.UDPConn); ok {
+		return c.File()
+	}
+
+	return nil, fmt.Errorf("packet connection type %T cannot be handed off", conn)
+}
+
+// withoutUpgradeEnv strips handoff variables inherited from a previous
+// upgrade so they do not leak into the next child.
+func withoutUpgradeEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, envInheritedListeners+"=") || strings.HasPrefix(kv, envReadyFD+"=") {
+			continue
+		}
+		out = append(out, kv)
+	}
+
+	return out
+}
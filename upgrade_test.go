@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestUpgradeHelperChild is not a real test: it is the child process started
+// by the upgrade tests. It serves "child" on the inherited listeners.
+func TestUpgradeHelperChild(t *testing.T) {
+	mode := os.Getenv("LB_UPGRADE_HELPER")
+	if mode == "" {
+		t.Skip("helper process for upgrade tests")
+	}
+	if mode == "fail" {
+		os.Exit(3)
+	}
+
+	u, err := NewUpgrader()
+	if err != nil {
+		os.Exit(1)
+	}
+	exit := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "child")
+	})
+	mux.HandleFunc("/exit", func(rw http.ResponseWriter, req *http.Request) {
+		close(exit)
+	})
+	for _, l := range [][2]string{{"tcp", os.Getenv("LB_HELPER_TCP")}, {"unix", os.Getenv("LB_HELPER_UNIX")}} {
+		ln, err := u.Listen(l[0], l[1])
+		if err != nil {
+			os.Exit(1)
+		}
+		go http.Serve(ln, mux)
+	}
+	if err := u.Ready(); err != nil {
+		os.Exit(1)
+	}
+
+	select {
+	case <-exit:
+	case <-time.After(30 * time.Second):
+	}
+	os.Exit(0)
+}
+
+// newTestUpgrader returns an upgrader whose child is the helper test above
+// running in the given mode.
+func newTestUpgrader(t *testing.T, mode, tcpAddr, unixPath string) *Upgrader {
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.exe = os.Args[0]
+	u.args = []string{"-test.run=^TestUpgradeHelperChild$"}
+	u.env = append(os.Environ(),
+		"LB_UPGRADE_HELPER="+mode,
+		"LB_HELPER_TCP="+tcpAddr,
+		"LB_HELPER_UNIX="+unixPath,
+	)
+
+	return u
+}
+
+// get performs a request over a fresh connection produced by dial.
+func get(t *testing.T, dial func() (net.Conn, error), path string) string {
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial()
+		},
+	}}
+	resp, err := client.Get("http://lb" + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	return string(body)
+}
+
+func TestUpgrader_Handoff(t *testing.T) {
+	tcpAddr := "127.0.0.1:0"
+	unixPath := filepath.Join(t.TempDir(), "lb.sock")
+	u := newTestUpgrader(t, "serve", tcpAddr, unixPath)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "parent")
+	})
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(rw, "parent")
+	})
+
+	tln, err := u.Listen("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uln, err := u.Listen("unix", unixPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, 2)
+	servers := []*http.Server{{Handler: mux}, {Handler: mux}}
+	for _, srv := range servers {
+		srv.RegisterOnShutdown(func() { closed <- struct{}{} })
+	}
+	go servers[0].Serve(tln)
+	go servers[1].Serve(uln)
+
+	dialTCP := func() (net.Conn, error) { return net.Dial("tcp", tln.Addr().String()) }
+	dialUnix := func() (net.Conn, error) { return net.Dial("unix", unixPath) }
+
+	// Start a slow request on the parent before upgrading
+	slowBody := make(chan string)
+	go func() { slowBody <- get(t, dialTCP, "/slow") }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := u.Upgrade(ctx); err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(servers, 10*time.Second)
+		close(done)
+	}()
+	<-closed
+	<-closed
+
+	// New connections land on the child while the parent drains
+	if body := get(t, dialTCP, "/"); body != "child" {
+		t.Errorf("Expected new TCP connection to reach the child, got %q", body)
+	}
+	if body := get(t, dialUnix, "/"); body != "child" {
+		t.Errorf("Expected new unix connection to reach the child, got %q", body)
+	}
+
+	// The in-flight request still completes on the parent
+	close(release)
+	if body := <-slowBody; body != "parent" {
+		t.Errorf("Expected in-flight request to complete on the parent, got %q", body)
+	}
+	<-done
+
+	get(t, dialTCP, "/exit")
+}
+
+func TestUpgrader_ChildFailureKeepsServing(t *testing.T) {
+	u := newTestUpgrader(t, "fail", "127.0.0.1:0", filepath.Join(t.TempDir(), "lb.sock"))
+	ln, err := u.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "parent")
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := u.Upgrade(ctx); err == nil {
+		t.Fatal("Expected upgrade to fail when the child exits before ready")
+	}
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) }
+	if body := get(t, dial, "/"); body != "parent" {
+		t.Errorf("Expected parent to keep serving, got %q", body)
+	}
+}
+
+func TestUpgrader_ListenPacketInherited(t *testing.T) {
+	parent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	f, err := packetConnFile(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := parent.LocalAddr().String()
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.inherited["udp:"+addr] = f
+
+	conn, err := u.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("Expected the inherited socket to be reused, got %v", err)
+	}
+	defer conn.Close()
+	if again, _ := u.ListenPacket("udp", addr); again != conn {
+		t.Error("Expected the same packet connection for the same address")
+	}
+
+	sender, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Expected to read from the inherited socket, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRecentErrors is the number of upstream errors kept without
+// WithRecentErrors.
+const defaultRecentErrors = 100
+
+// RecentError is an upstream failure as operators see it at
+// /admin/errors: the full error, naming addresses clients never see, of
+// Attempt to Backend, which failed after Duration.
+type RecentError struct {
+	Time       time.Time  `json:"time"`
+	Backend    string     `json:"backend"`
+	Attempt    int        `json:"attempt"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	RequestID  string     `json:"request_id,omitempty"`
+	Phase      Phase      `json:"phase"`
+	Class      ErrorClass `json:"class"`
+	DurationMS float64    `json:"duration_ms"`
+	Error      string     `json:"error"`
+}
+
+// WithRecentErrors keeps the last n upstream errors for /admin/errors, 100
+// by default.
+func WithRecentErrors(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.recentErrors = newErrorRing(n)
+	}
+}
+
+// errorRing holds the last upstream errors, overwriting the oldest.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int
+	full    bool
+}
+
+func newErrorRing(n int) *errorRing {
+	return &errorRing{entries: make([]RecentError, max(n, 1))}
+}
+
+func (r *errorRing) add(e RecentError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	r.full = r.full || r.next == 0
+}
+
+// list returns the errors held, newest first.
+func (r *errorRing) list() []RecentError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	list := make([]RecentError, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+
+	return list
+}
+
+// recordUpstreamError logs the upstream error of an attempt of req in full
+// and keeps it for /admin/errors.
+func (lb *LoadBalancer) recordUpstreamError(req *http.Request, attempt int, record attemptRecord, err *UpstreamError) {
+	fmt.Printf("error: %s %s: attempt %d to %s failed after %s: %v\n",
+		req.Method, req.URL.Path, attempt, serverName(record.server), record.duration.Round(time.Millisecond), err)
+	lb.recentErrors.add(RecentError{
+		Time:       lb.now(),
+		Backend:    serverName(record.server),
+		Attempt:    attempt,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		RequestID:  requestID(req),
+		Phase:      err.Phase,
+		Class:      err.Class,
+		DurationMS: float64(record.duration) / float64(time.Millisecond),
+		Error:      err.Error(),
+	})
+}
+
+func (lb *LoadBalancer) handleErrors(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]any{"errors": lb.recentErrors.list()})
+}
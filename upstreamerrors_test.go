@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recentErrors returns the errors listed at /admin/errors.
+func recentErrors(t *testing.T, lb *LoadBalancer) []RecentError {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/errors", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from /admin/errors, got %d", rw.Code)
+	}
+	var body struct {
+		Errors []RecentError `json:"errors"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Errors
+}
+
+func TestRecentErrors_DialFailure(t *testing.T) {
+	dead := newRefusingServer(t)
+	lb := newTestLoadBalancer(t, []Server{dead}, WithRetryPolicy(RetryPolicy{Attempts: 2}))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	lb.serveProxy(rw, req)
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502, got %d", rw.Code)
+	}
+	host := strings.TrimPrefix(dead.Address(), "http://")
+	if body := rw.Body.String(); strings.Contains(body, host) || strings.Contains(body, "refused") {
+		t.Errorf("Expected no upstream detail in the client body, got %q", body)
+	}
+
+	errs := recentErrors(t, lb)
+	if len(errs) != 2 {
+		t.Fatalf("Expected both attempts listed, got %+v", errs)
+	}
+	for i, e := range errs {
+		if want := 2 - i; e.Attempt != want {
+			t.Errorf("Expected attempt %d listed at %d, newest first, got %d", want, i, e.Attempt)
+		}
+		if e.Backend != dead.Address() || e.Class != ClassConnectRefused || e.Phase != PhaseDial {
+			t.Errorf("Expected a refused dial to %s, got %+v", dead.Address(), e)
+		}
+		if !strings.Contains(e.Error, host) || !strings.Contains(e.Error, "connection refused") {
+			t.Errorf("Expected the full error, got %q", e.Error)
+		}
+		if e.Method != "GET" || e.Path != "/orders" || e.RequestID != "req-1" || e.Time.IsZero() {
+			t.Errorf("Expected the request and time recorded, got %+v", e)
+		}
+	}
+}
+
+func TestRecentErrors_DebugExplain(t *testing.T) {
+	dead := newRefusingServer(t)
+	lb := newTestLoadBalancer(t, []Server{dead}, WithDebugExplain(DebugExplain{Secret: "s3cret"}))
+
+	e := explain(t, lb, debugRequest("/", "s3cret"))
+	if e == nil || !strings.Contains(e.Error, "connection refused") {
+		t.Fatalf("Expected the upstream error explained with the secret, got %+v", e)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+	if got := rw.Header().Get(debugHeader); got != "" {
+		t.Errorf("Expected no explanation without the secret, got %q", got)
+	}
+}
+
+func TestRecentErrors_Bounded(t *testing.T) {
+	r := newErrorRing(3)
+	if got := r.list(); len(got) != 0 {
+		t.Fatalf("Expected no errors, got %+v", got)
+	}
+	for i := 1; i <= 5; i++ {
+		r.add(RecentError{Attempt: i})
+	}
+	got := r.list()
+	if len(got) != 3 || got[0].Attempt != 5 || got[1].Attempt != 4 || got[2].Attempt != 3 {
+		t.Errorf("Expected the last three, newest first, got %+v", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				r.add(RecentError{Error: fmt.Sprint(i, j)})
+				r.list()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := r.list(); len(got) != 3 {
+		t.Errorf("Expected the ring to stay bounded, got %d", len(got))
+	}
+}
+
+func TestRecentErrorsConfig(t *testing.T) {
+	lb, err := (&Config{
+		Port:         "0",
+		Servers:      []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		RecentErrors: 5,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lb.recentErrors.entries); n != 5 {
+		t.Errorf("Expected 5 errors kept, got %d", n)
+	}
+
+	_, err = (&Config{
+		Port:         "0",
+		Servers:      []ServerConfig{{Address: "http://127.0.0.1:9"}},
+		RecentErrors: -1,
+	}).Build()
+	if err == nil || !strings.Contains(err.Error(), "recent_errors must not be negative") {
+		t.Errorf("Expected a negative size to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxJSONBytes = 1 << 20
+	defaultEjectFor     = 30 * time.Second
+)
+
+// ResponseValidation rejects successful responses of servers that are unfit
+// to serve: bodies shorter than MinBodyBytes, media types other than
+// ContentTypes, responses missing one of RequiredHeaders, and, with JSON,
+// bodies that do not parse as JSON. Only 2xx responses are validated, and
+// body rules are skipped for HEAD requests and 204 responses.
+//
+// Rejected responses fail their attempt with ClassInvalidResponse, which is
+// retried on another server if the retry policy lists it. Only as much of
+// the body is read ahead as the rules need: MinBodyBytes, or MaxJSONBytes,
+// 1MiB by default, with JSON. Longer bodies are not checked for JSON, so
+// large responses still stream.
+//
+// A server answering EjectAfter consecutive validated requests with invalid
+// responses is ejected from selection for EjectFor, 30s by default. Zero
+// never ejects.
+type ResponseValidation struct {
+	MinBodyBytes    int64
+	ContentTypes    []string
+	RequiredHeaders []string
+	JSON            bool
+	MaxJSONBytes    int64
+	EjectAfter      int
+	EjectFor        time.Duration
+}
+
+// readsBody reports whether v inspects response bodies.
+func (v *ResponseValidation) readsBody() bool {
+	return v != nil && (v.MinBodyBytes > 0 || v.JSON)
+}
+
+// validationFor returns the response validation of the route of req, if
+// any, with its defaults applied.
+func (lb *LoadBalancer) validationFor(req *http.Request) *ResponseValidation {
+	route := lb.matchRoute(req)
+	if route == nil || route.Validate == nil {
+		return nil
+	}
+	v := *route.Validate
+	if v.MaxJSONBytes <= 0 {
+		v.MaxJSONBytes = defaultMaxJSONBytes
+	}
+	if v.EjectFor <= 0 {
+		v.EjectFor = defaultEjectFor
+	}
+
+	return &v
+}
+
+// check validates resp, reading ahead as much of its body as the rules need
+// and leaving the body to be read in full. It returns an error wrapping
+// ErrInvalidResponse for invalid responses.
+func (v *ResponseValidation) check(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+	if len(v.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if !slices.ContainsFunc(v.ContentTypes, func(t string) bool { return strings.EqualFold(t, mediaType) }) {
+			return fmt.Errorf("%w: content type %q", ErrInvalidResponse, resp.Header.Get("Content-Type"))
+		}
+	}
+	for _, h := range v.RequiredHeaders {
+		if resp.Header.Get(h) == "" {
+			return fmt.Errorf("%w: missing header %s", ErrInvalidResponse, h)
+		}
+	}
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	need := v.MinBodyBytes
+	checkJSON := v.JSON && (resp.ContentLength < 0 || resp.ContentLength <= v.MaxJSONBytes)
+	if checkJSON {
+		need = max(need, v.MaxJSONBytes+1)
+	}
+	if need <= 0 {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, need))
+	resp.Body = &readAheadBody{Reader: io.MultiReader(bytes.NewReader(head), resp.Body), Closer: resp.Body}
+	if err != nil {
+		return err
+	}
+	if int64(len(head)) < v.MinBodyBytes {
+		return fmt.Errorf("%w: body of %d bytes, want at least %d", ErrInvalidResponse, len(head), v.MinBodyBytes)
+	}
+	if checkJSON && int64(len(head)) <= v.MaxJSONBytes && !json.Valid(head) {
+		return fmt.Errorf("%w: body is not JSON", ErrInvalidResponse)
+	}
+
+	return nil
+}
+
+// readAheadBody is a response body part of which was read ahead.
+type readAheadBody struct {
+	io.Reader
+	io.Closer
+}
+
+// observeValidation counts the outcome of a validated attempt on server,
+// ejecting the server once it answered too many requests in a row with
+// invalid responses. Other failures neither count nor break the streak.
+func (lb *LoadBalancer) observeValidation(server Server, v *ResponseValidation, class ErrorClass) {
+	if v == nil || v.EjectAfter <= 0 || class != "" && class != ClassInvalidResponse {
+		return
+	}
+	addr := serverName(server)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	c := lb.countersFor(addr)
+	if class == "" {
+		c.invalidStreak = 0
+		return
+	}
+	c.invalidStreak++
+	if c.invalidStreak < v.EjectAfter {
+		return
+	}
+	c.invalidStreak = 0
+	c.ejectedUntil = lb.now().Add(v.EjectFor)
+	c.ejections++
+	fmt.Printf("server %s answered %d requests in a row with invalid responses, ejecting it for %s\n", addr, v.EjectAfter, v.EjectFor)
+	lb.events.publish(Event{Type: EventBreakerOpened, Backend: addr, Reason: "invalid_responses"})
+}
+
+// ejectedLocked reports whether the server with the given name is
+// ejected, for invalid responses or failed passthrough dials, at now. lb.mu must be held.
+func (lb *LoadBalancer) ejectedLocked(addr string, now time.Time) bool {
+	c := lb.counters[addr]
+	return c != nil && now.Before(c.ejectedUntil)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newValidatingServers returns a server answering with valid JSON and one
+// answering 200 with an empty body, counting the requests of the latter.
+func newValidatingServers(t *testing.T) (good, bad Server, badCalls *atomic.Int64) {
+	badCalls = new(atomic.Int64)
+	good = newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"ok":true}`))
+	})
+	bad = newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		badCalls.Add(1)
+		rw.Header().Set("Content-Type", "application/json")
+	})
+
+	return good, bad, badCalls
+}
+
+func TestResponseValidation_Check(t *testing.T) {
+	v := &ResponseValidation{
+		MinBodyBytes:    2,
+		ContentTypes:    []string{"application/json"},
+		RequiredHeaders: []string{"X-Version"},
+		JSON:            true,
+		MaxJSONBytes:    64,
+	}
+	for _, tt := range []struct {
+		name        string
+		status      int
+		contentType string
+		version     string
+		body        string
+		valid       bool
+	}{
+		{"valid", 200, "application/json; charset=utf-8", "1", `{"a":1}`, true},
+		{"error status", 500, "text/plain", "", "", true},
+		{"content type", 200, "text/html", "1", `{"a":1}`, false},
+		{"missing header", 200, "application/json", "", `{"a":1}`, false},
+		{"short body", 200, "application/json", "1", `1`, false},
+		{"not JSON", 200, "application/json", "1", `{"a":`, false},
+		{"too long to parse", 200, "application/json", "1", `"` + strings.Repeat("x", 100), true},
+	} {
+		resp := &http.Response{
+			StatusCode:    tt.status,
+			Header:        http.Header{"Content-Type": {tt.contentType}},
+			Body:          io.NopCloser(strings.NewReader(tt.body)),
+			ContentLength: -1,
+			Request:       httptest.NewRequest("GET", "/", nil),
+		}
+		if tt.version != "" {
+			resp.Header.Set("X-Version", tt.version)
+		}
+		err := v.check(resp)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %t, got %v", tt.name, tt.valid, err)
+		}
+		if body, _ := io.ReadAll(resp.Body); tt.valid && string(body) != tt.body {
+			t.Errorf("%s: expected the body to be left intact, got %q", tt.name, body)
+		}
+	}
+}
+
+func TestResponseValidation_RetriesInvalid(t *testing.T) {
+	good, bad, badCalls := newValidatingServers(t)
+	lb := newTestLoadBalancer(t, []Server{bad, good}, WithRoutes(Route{
+		PathPrefix: "/",
+		Validate:   &ResponseValidation{MinBodyBytes: 1, JSON: true},
+		Retry:      &RetryPolicy{Attempts: 2, On: []ErrorClass{ClassInvalidResponse}},
+	}))
+
+	for range 4 {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code != http.StatusOK || rw.Body.String() != `{"ok":true}` {
+			t.Errorf("Expected the valid response, got %d %q", rw.Code, rw.Body.String())
+		}
+	}
+	if badCalls.Load() == 0 {
+		t.Fatal("Expected the invalid server to be tried")
+	}
+
+	metrics := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `class="invalid-response"} `) {
+		t.Error("Expected invalid responses to count as failures of the server")
+	}
+}
+
+func TestResponseValidation_EjectsInvalidServer(t *testing.T) {
+	good, bad, badCalls := newValidatingServers(t)
+	lb := newTestLoadBalancer(t, []Server{bad, good}, WithRoutes(Route{
+		PathPrefix: "/",
+		Validate:   &ResponseValidation{MinBodyBytes: 1, EjectAfter: 3, EjectFor: time.Minute},
+	}))
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+
+	invalid := 0
+	for range 10 {
+		rw := httptest.NewRecorder()
+		lb.serveProxy(rw, httptest.NewRequest("GET", "/", nil))
+		if rw.Code == http.StatusBadGateway {
+			invalid++
+		}
+	}
+	if invalid != 3 || badCalls.Load() != 3 {
+		t.Errorf("Expected the server to be ejected after 3 invalid responses, got %d of %d requests", invalid, badCalls.Load())
+	}
+	stats := lb.Stats()
+	if stats[0].EjectedUntil == nil || stats[0].Ejections != 1 {
+		t.Errorf("Expected the server to be reported as ejected, got %+v", stats[0])
+	}
+
+	now = now.Add(time.Minute)
+	for range 2 {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if badCalls.Load() != 4 {
+		t.Errorf("Expected the server to be selected again once the ejection ended, got %d requests", badCalls.Load())
+	}
+}
+
+func TestResponseValidation_StreamsLargeBodies(t *testing.T) {
+	chunk := strings.Repeat("x", 64<<10)
+	release := make(chan struct{})
+	server := newBackendServer(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(chunk))
+		rw.(http.Flusher).Flush()
+		<-release
+		for range 32 {
+			rw.Write([]byte(chunk))
+		}
+	})
+	lb := newTestLoadBalancer(t, []Server{server}, WithRoutes(Route{
+		PathPrefix: "/",
+		Validate:   &ResponseValidation{MinBodyBytes: 1024},
+	}))
+	front := httptest.NewServer(http.HandlerFunc(lb.serveProxy))
+	defer front.Close()
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(5*time.Second, func() {
+		timedOut.Store(true)
+		close(release)
+	})
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len(chunk))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	if !timer.Stop() || timedOut.Load() {
+		t.Fatal("Expected the first chunk before the rest was sent")
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(first) + len(rest); n != 33*len(chunk) {
+		t.Errorf("Expected the whole body, got %d bytes", n)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WarmupRequest describes synthetic requests sent to a new server before it
+// receives real traffic. Count requests are sent with up to Concurrency in
+// flight at once.
+type WarmupRequest struct {
+	Method      string
+	Path        string
+	Header      http.Header
+	Count       int
+	Concurrency int
+}
+
+// Warmup configures warm-up of servers added at runtime. The requests are
+// sent in order and every response must have a 2xx or 3xx status. When a
+// request fails or Timeout elapses first, FailOpen decides whether the server
+// becomes selectable anyway. With SlowStart, the share of selections a
+// server is offered once selectable ramps up from none to its full weight
+// over SlowStart, as after a maintenance window.
+type Warmup struct {
+	Requests  []WarmupRequest
+	Timeout   time.Duration
+	FailOpen  bool
+	SlowStart time.Duration
+}
+
+// defaultWarmupTimeout bounds warm-up when no timeout is configured.
+const defaultWarmupTimeout = 30 * time.Second
+
+// WithWarmup warms up servers registered through AddServer before they are
+// selected. Servers implementing Warmable are warmed up even without it,
+// failing closed within the default timeout.
+func WithWarmup(w Warmup) Option {
+	return func(lb *LoadBalancer) {
+		lb.warmup = &w
+	}
+}
+
+// warmupState tracks the progress of a server being warmed up.
+type warmupState struct {
+	total     int
+	completed atomic.Int64
+	failed    atomic.Bool
+}
+
+// WarmupStatus reports warm-up progress in ServerStats. State is "warming"
+// while requests are outstanding and "failed" when a fail-closed warm-up did
+// not succeed.
+type WarmupStatus struct {
+	State     string `json:"state"`
+	Completed int64  `json:"completed"`
+	Total     int    `json:"total"`
+}
+
+func (s *warmupState) status() *WarmupStatus {
+	state := "warming"
+	if s.failed.Load() {
+		state = "failed"
+	}
+
+	return &WarmupStatus{State: state, Completed: s.completed.Load(), Total: s.total}
+}
+
+// startWarmupLocked marks server as warming and warms it up in the
+// background. lb.mu must be held.
+func (lb *LoadBalancer) startWarmupLocked(server Server) {
+	var w Warmup
+	if lb.warmup != nil {
+		w = *lb.warmup
+	}
+	state := &warmupState{}
+	for _, r := range w.Requests {
+		state.total += r.Count
+	}
+	lb.warming[serverName(server)] = state
+
+	go func() {
+		err := warmUp(server, w, state)
+		if err != nil {
+			fmt.Printf("error: warm-up of %s: %v\n", serverName(server), err)
+		}
+
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.warming[serverName(server)] != state {
+			return // removed while warming up
+		}
+		if err != nil && !w.FailOpen {
+			state.failed.Store(true)
+			return
+		}
+		delete(lb.warming, serverName(server))
+		if w.SlowStart > 0 {
+			lb.slowStarts[serverName(server)] = lb.now()
+		}
+	}()
+}
+
+// slowStartLocked returns the slow start server is in at now after its
+// warm-up or a maintenance window, the least advanced if it is in both.
+// lb.mu must be held.
+func (lb *LoadBalancer) slowStartLocked(server Server, now time.Time) *DrainFade {
+	ramp, _ := maintenanceRamp(server, now)
+	name := serverName(server)
+	since, ok := lb.slowStarts[name]
+	if !ok {
+		return ramp
+	}
+	length := lb.warmup.SlowStart
+	if elapsed := now.Sub(since); elapsed < length {
+		if weight := float64(max(elapsed, 0)) / float64(length); ramp == nil || weight < ramp.Weight {
+			ramp = &DrainFade{Until: since.Add(length), Weight: weight}
+		}
+	} else {
+		delete(lb.slowStarts, name)
+	}
+
+	return ramp
+}
+
+// warmUp runs the server's own warm-up, if it has one, and then sends the
+// warm-up requests of w to it.
+func warmUp(server Server, w Warmup, state *warmupState) error {
+	timeout := w.Timeout
+	if timeout == 0 {
+		timeout = defaultWarmupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if warmable, ok := server.(Warmable); ok {
+		if err := warmable.Warmup(ctx); err != nil {
+			return err
+		}
+	}
+	for _, r := range w.Requests {
+		if err := sendWarmupRequests(ctx, server, r, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendWarmupRequests sends r.Count copies of r with up to r.Concurrency in
+// flight, stopping at the first failure.
+func sendWarmupRequests(ctx context.Context, server Server, r WarmupRequest, state *warmupState) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	sem := make(chan struct{}, max(r.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < r.Count; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := sendWarmupRequest(ctx, server, r); err != nil {
+				cancel(err)
+				return
+			}
+			state.completed.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
+
+func sendWarmupRequest(ctx context.Context, server Server, r WarmupRequest) error {
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = r.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	rw := &warmupResponseWriter{header: http.Header{}}
+	server.Serve(rw, req)
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.status >= 400 {
+		return fmt.Errorf("%s %s: status %d", method, r.Path, rw.status)
+	}
+
+	return nil
+}
+
+// warmupResponseWriter discards a warm-up response, keeping its status.
+type warmupResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *warmupResponseWriter) Header() http.Header { return w.header }
+
+func (w *warmupResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *warmupResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
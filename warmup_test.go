@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// warmupMockServer records every request it serves. Requests to /warm block
+// until release is closed and respond with status.
+type warmupMockServer struct {
+	addr    string
+	status  int
+	release chan struct{}
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (m *warmupMockServer) Address() string { return m.addr }
+func (m *warmupMockServer) IsAlive() bool   { return true }
+
+func (m *warmupMockServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	m.calls = append(m.calls, req.Method+" "+req.URL.Path+" "+req.Header.Get("X-Warmup"))
+	m.mu.Unlock()
+	if req.URL.Path == "/warm" {
+		select {
+		case <-m.release:
+		case <-req.Context().Done():
+		}
+	}
+	rw.WriteHeader(m.status)
+}
+
+func (m *warmupMockServer) Calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+func TestWarmup_NoTrafficUntilWarm(t *testing.T) {
+	existing := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{existing}, WithWarmup(Warmup{
+		Requests: []WarmupRequest{{Method: "POST", Path: "/warm", Header: http.Header{"X-Warmup": {"1"}}, Count: 4, Concurrency: 2}},
+		Timeout:  5 * time.Second,
+	}))
+
+	fresh := &warmupMockServer{addr: "http://server2.com", status: http.StatusOK, release: make(chan struct{})}
+	if err := lb.AddServer(fresh); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "warm-up requests in flight", func() bool { return len(fresh.Calls()) == 2 })
+
+	// Status reports the warm-up in progress
+	status := lb.Stats()[1].Warmup
+	if status == nil || status.State != "warming" || status.Total != 4 {
+		t.Fatalf("Expected warm-up status warming with 4 requests, got %+v", status)
+	}
+
+	// Real traffic only reaches the existing server while warming up
+	for i := 0; i < 4; i++ {
+		lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if existing.callCount != 4 {
+		t.Errorf("Expected all 4 requests on server1 during warm-up, got %d", existing.callCount)
+	}
+
+	close(fresh.release)
+	waitFor(t, "warm-up to finish", func() bool { return lb.Stats()[1].Warmup == nil })
+	calls := fresh.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("Expected 4 warm-up calls, got %v", calls)
+	}
+	for _, call := range calls {
+		if call != "POST /warm 1" {
+			t.Errorf("Expected warm-up call POST /warm with header, got %q", call)
+		}
+	}
+	if requests := lb.Stats()[1].Requests; requests != 0 {
+		t.Errorf("Expected warm-up requests not to count as traffic, got %d", requests)
+	}
+
+	// Once warm, the server takes its share of traffic
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	lb.serveProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if calls := fresh.Calls(); len(calls) != 5 || calls[4] != "GET / " {
+		t.Errorf("Expected a real request after warm-up, got %v", calls)
+	}
+}
+
+func TestWarmup_FailClosedAndOpen(t *testing.T) {
+	// A failing warm-up keeps the server out of rotation when failing closed
+	lb := newTestLoadBalancer(t, nil, WithAllowEmpty(), WithWarmup(Warmup{
+		Requests: []WarmupRequest{{Path: "/", Count: 1}},
+	}))
+	broken := &warmupMockServer{addr: "http://broken.com", status: http.StatusInternalServerError}
+	lb.AddServer(broken)
+	waitFor(t, "warm-up to fail", func() bool {
+		s := lb.Stats()[0].Warmup
+		return s != nil && s.State == "failed"
+	})
+	if _, err := lb.getNextAvailableServer(); err != ErrNoAvailableServers {
+		t.Errorf("Expected ErrNoAvailableServers, got %v", err)
+	}
+
+	// A timed out warm-up still admits the server when failing open
+	lb = newTestLoadBalancer(t, nil, WithAllowEmpty(), WithWarmup(Warmup{
+		Requests: []WarmupRequest{{Path: "/warm", Count: 1}},
+		Timeout:  20 * time.Millisecond,
+		FailOpen: true,
+	}))
+	slow := &warmupMockServer{addr: "http://slow.com", status: http.StatusOK, release: make(chan struct{})}
+	lb.AddServer(slow)
+	waitFor(t, "warm-up to time out", func() bool { return lb.Stats()[0].Warmup == nil })
+	if server, err := lb.getNextAvailableServer(); err != nil || server.Address() != "http://slow.com" {
+		t.Errorf("Expected slow.com to be selectable after failing open, got %v", err)
+	}
+}
+
+func TestWarmup_SlowStart(t *testing.T) {
+	existing := &MockServer{addr: "http://server1.com", isAlive: true}
+	lb := newTestLoadBalancer(t, []Server{existing}, WithWarmup(Warmup{
+		Requests:  []WarmupRequest{{Path: "/", Count: 1}},
+		SlowStart: 10 * time.Second,
+	}))
+	start := time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC)
+	now := start
+	lb.now = func() time.Time { return now }
+
+	fresh := &warmupMockServer{addr: "http://server2.com", status: http.StatusOK}
+	if err := lb.AddServer(fresh); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "warm-up to finish", func() bool { return lb.Stats()[1].Warmup == nil })
+	shareOfFresh := func() float64 {
+		picked := 0
+		for i := 0; i < 300; i++ {
+			server, err := lb.getNextAvailableServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server == Server(fresh) {
+				picked++
+			}
+			lb.finishRequest(server, http.StatusOK, "", 0, 0, 0)
+		}
+		return float64(picked) / 300
+	}
+
+	if share := shareOfFresh(); share != 0 {
+		t.Errorf("Expected no selections right after warm-up, got %.2f", share)
+	}
+	now = start.Add(5 * time.Second)
+	if slow := lb.Stats()[1].SlowStart; slow == nil || slow.Weight != 0.5 || !slow.Until.Equal(start.Add(10*time.Second)) {
+		t.Errorf("Expected the slow start halfway, got %+v", slow)
+	}
+	if share := shareOfFresh(); share < 1.0/3-0.02 || share > 1.0/3+0.02 {
+		t.Errorf("Expected a third of the selections halfway through the slow start, got %.2f", share)
+	}
+	now = start.Add(10 * time.Second)
+	if share := shareOfFresh(); share != 0.5 {
+		t.Errorf("Expected an even share after the slow start, got %.2f", share)
+	}
+	if slow := lb.Stats()[1].SlowStart; slow != nil {
+		t.Errorf("Expected the slow start to be over, got %+v", slow)
+	}
+}
+
+func TestWarmup_SlowStartWithMaintenance(t *testing.T) {
+	server := &simpleServer{addr: "http://server1.com", maintenance: []MaintenanceWindow{
+		{Start: 3 * time.Hour, Duration: 30 * time.Minute, SlowStart: 10 * time.Minute},
+	}}
+	server.alive.Store(true)
+	lb := newTestLoadBalancer(t, []Server{server}, WithWarmup(Warmup{SlowStart: 20 * time.Minute}))
+	lb.slowStarts["http://server1.com"] = time.Date(2026, 3, 9, 3, 25, 0, 0, time.UTC)
+
+	// Both slow starts apply at once; the least advanced counts.
+	for _, tt := range []struct {
+		at     time.Time
+		weight float64
+		until  time.Time
+	}{
+		{time.Date(2026, 3, 9, 3, 30, 0, 0, time.UTC), 0, time.Date(2026, 3, 9, 3, 40, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 9, 3, 39, 0, 0, time.UTC), 0.7, time.Date(2026, 3, 9, 3, 45, 0, 0, time.UTC)},
+	} {
+		lb.now = func() time.Time { return tt.at }
+		slow := lb.Stats()[0].SlowStart
+		if slow == nil || math.Abs(slow.Weight-tt.weight) > 1e-9 || !slow.Until.Equal(tt.until) {
+			t.Errorf("%s: Expected weight %.1f until %s, got %+v", tt.at, tt.weight, tt.until, slow)
+		}
+	}
+}
+
+func TestAdmin_AddServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	lb := newTestLoadBalancer(t, nil, WithAllowEmpty())
+	handler := lb.AdminHandler()
+
+	body := `{"address": "` + backend.URL + `", "labels": {"zone": "a"}}`
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/servers", strings.NewReader(body)))
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if stats := lb.Stats(); len(stats) != 1 || stats[0].Labels["zone"] != "a" {
+		t.Errorf("Expected the new server in the pool, got %+v", stats)
+	}
+
+	// Adding it twice conflicts
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/servers", strings.NewReader(body)))
+	if rw.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", rw.Code)
+	}
+}
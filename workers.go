@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minWorkerBackoff is the delay before a worker that panicked is
+	// restarted the first time; it doubles with every restart up to
+	// maxWorkerBackoff.
+	minWorkerBackoff = 100 * time.Millisecond
+	maxWorkerBackoff = 30 * time.Second
+)
+
+// WorkerState is the state of a background worker.
+type WorkerState string
+
+const (
+	WorkerRunning    WorkerState = "running"
+	WorkerRestarting WorkerState = "restarting"
+	WorkerStopping   WorkerState = "stopping"
+)
+
+// WorkerStatus is a background worker as shown in the status: its state,
+// how often it was restarted after a panic and when it last did work.
+type WorkerStatus struct {
+	Name         string      `json:"name"`
+	State        WorkerState `json:"state"`
+	Started      time.Time   `json:"started"`
+	LastActivity time.Time   `json:"last_activity"`
+	Restarts     int         `json:"restarts"`
+	LastPanic    string      `json:"last_panic,omitempty"`
+}
+
+// supervisor runs the background workers of a load balancer, restarting
+// those that panic, until they return or it is shut down. Workers that
+// returned are forgotten.
+type supervisor struct {
+	mu      sync.Mutex
+	workers []*worker
+	wg      sync.WaitGroup
+
+	// ctx ends at shutdown, stopping every worker.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// backoff is the delay before the first restart; tests shorten it.
+	backoff time.Duration
+}
+
+// worker is a running worker; its status is guarded by the supervisor.
+type worker struct {
+	sup    *supervisor
+	status WorkerStatus
+}
+
+type workerKey struct{}
+
+func newSupervisor() *supervisor {
+	ctx, stop := context.WithCancel(context.Background())
+	return &supervisor{ctx: ctx, stop: stop, backoff: minWorkerBackoff}
+}
+
+// Go runs the background worker run under name until it returns, ctx is
+// done or the load balancer shuts down. A worker that panics is restarted
+// after a backoff doubling from 100ms to 30s. Workers started after
+// Shutdown do not run.
+func (lb *LoadBalancer) Go(ctx context.Context, name string, run func(ctx context.Context)) {
+	lb.workers.start(ctx, name, run)
+}
+
+// Workers returns the running background workers in the order they were
+// started.
+func (lb *LoadBalancer) Workers() []WorkerStatus {
+	return lb.workers.list()
+}
+
+// Shutdown stops the background workers and waits until they returned or
+// ctx is done. The error names the workers still running at the deadline.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	return lb.workers.shutdown(ctx)
+}
+
+func (s *supervisor) start(ctx context.Context, name string, run func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopOnShutdown := context.AfterFunc(s.ctx, cancel)
+	now := time.Now()
+	w := &worker{sup: s, status: WorkerStatus{Name: name, State: WorkerRunning, Started: now, LastActivity: now}}
+	s.workers = append(s.workers, w)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.remove(w)
+		defer stopOnShutdown()
+		defer cancel()
+
+		ctx := context.WithValue(ctx, workerKey{}, w)
+		for delay := s.backoff; w.run(ctx, run); delay = min(2*delay, maxWorkerBackoff) {
+			if ctx.Err() != nil {
+				return
+			}
+			s.set(w, func(st *WorkerStatus) { st.State = WorkerRestarting; st.Restarts++ })
+			fmt.Printf("restarting worker %s in %s\n", name, delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			s.set(w, func(st *WorkerStatus) { st.State = WorkerRunning; st.LastActivity = time.Now() })
+		}
+	}()
+}
+
+// run runs the worker once, reporting whether it panicked.
+func (w *worker) run(ctx context.Context, run func(ctx context.Context)) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicked = true
+			fmt.Printf("error: worker %s panicked: %v\n%s", w.status.Name, v, debug.Stack())
+			w.sup.set(w, func(st *WorkerStatus) { st.LastPanic = fmt.Sprint(v) })
+		}
+	}()
+	run(ctx)
+
+	return false
+}
+
+// set updates the status of w.
+func (s *supervisor) set(w *worker, update func(st *WorkerStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&w.status)
+}
+
+func (s *supervisor) remove(w *worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = slices.DeleteFunc(s.workers, func(other *worker) bool { return other == w })
+}
+
+// markActive records that the worker running in ctx did work, for its
+// last activity in the status. It does nothing outside of a worker.
+func markActive(ctx context.Context) {
+	if w, ok := ctx.Value(workerKey{}).(*worker); ok {
+		w.sup.set(w, func(st *WorkerStatus) { st.LastActivity = time.Now() })
+	}
+}
+
+func (s *supervisor) list() []WorkerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]WorkerStatus, len(s.workers))
+	for i, w := range s.workers {
+		list[i] = w.status
+	}
+
+	return list
+}
+
+func (s *supervisor) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.stop()
+	for _, w := range s.workers {
+		w.status.State = WorkerStopping
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	var names []string
+	for _, st := range s.list() {
+		names = append(names, st.Name)
+	}
+
+	return fmt.Errorf("workers still running after shutdown: %s", strings.Join(names, ", "))
+}
+
+// writeMetrics renders the number of workers by state and the restarts and
+// last activity of each.
+func (s *supervisor) writeMetrics(w io.Writer) {
+	list := s.list()
+	states := map[WorkerState]int{WorkerRunning: 0, WorkerRestarting: 0, WorkerStopping: 0}
+	for _, st := range list {
+		states[st.State]++
+	}
+	fmt.Fprintln(w, "# HELP lb_workers Background workers by state.")
+	fmt.Fprintln(w, "# TYPE lb_workers gauge")
+	for _, state := range []WorkerState{WorkerRunning, WorkerRestarting, WorkerStopping} {
+		fmt.Fprintf(w, "lb_workers{state=%q} %d\n", state, states[state])
+	}
+	fmt.Fprintln(w, "# HELP lb_worker_restarts_total Restarts of background workers after a panic.")
+	fmt.Fprintln(w, "# TYPE lb_worker_restarts_total counter")
+	for _, st := range list {
+		fmt.Fprintf(w, "lb_worker_restarts_total{worker=%q} %d\n", st.Name, st.Restarts)
+	}
+	fmt.Fprintln(w, "# HELP lb_worker_last_activity_timestamp_seconds When background workers last did work.")
+	fmt.Fprintln(w, "# TYPE lb_worker_last_activity_timestamp_seconds gauge")
+	for _, st := range list {
+		fmt.Fprintf(w, "lb_worker_last_activity_timestamp_seconds{worker=%q} %d\n", st.Name, st.LastActivity.Unix())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// workerStatus returns the status of the running worker with the given name.
+func workerStatus(lb *LoadBalancer, name string) (WorkerStatus, bool) {
+	for _, st := range lb.Workers() {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return WorkerStatus{}, false
+}
+
+func TestWorkers_RestartAfterPanic(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+	lb.workers.backoff = 20 * time.Millisecond
+
+	var runs atomic.Int32
+	var starts []time.Time
+	startsCh := make(chan time.Time, 3)
+	lb.Go(context.Background(), "flaky", func(ctx context.Context) {
+		startsCh <- time.Now()
+		if runs.Add(1) < 3 {
+			panic("boom")
+		}
+		<-ctx.Done()
+	})
+	for range 3 {
+		select {
+		case s := <-startsCh:
+			starts = append(starts, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the worker to be restarted, ran %d times", runs.Load())
+		}
+	}
+
+	// Backoff doubles: 20ms, then 40ms
+	if gap := starts[1].Sub(starts[0]); gap < 20*time.Millisecond {
+		t.Errorf("Expected the first restart after 20ms, got %s", gap)
+	}
+	if gap := starts[2].Sub(starts[1]); gap < 40*time.Millisecond {
+		t.Errorf("Expected the second restart after 40ms, got %s", gap)
+	}
+	waitFor(t, "the restarted worker to run", func() bool {
+		st, _ := workerStatus(lb, "flaky")
+		return st.State == WorkerRunning
+	})
+	st, ok := workerStatus(lb, "flaky")
+	if !ok || st.Restarts != 2 || st.LastPanic != "boom" {
+		t.Errorf("Expected 2 restarts after panics, got %+v", st)
+	}
+}
+
+func TestWorkers_ShutdownReportsStuckWorker(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+	release := make(chan struct{})
+	lb.Go(context.Background(), "stubborn", func(ctx context.Context) {
+		<-release // ignores ctx
+	})
+	lb.Go(context.Background(), "polite", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := lb.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), "stubborn") || strings.Contains(err.Error(), "polite") {
+		t.Errorf("Expected shutdown to report only the stuck worker, got %v", err)
+	}
+	if st, _ := workerStatus(lb, "stubborn"); st.State != WorkerStopping {
+		t.Errorf("Expected the stuck worker to be stopping, got %+v", st)
+	}
+
+	close(release)
+	waitFor(t, "the stuck worker to return", func() bool { return len(lb.Workers()) == 0 })
+	ran := false
+	lb.Go(context.Background(), "late", func(ctx context.Context) { ran = true })
+	if len(lb.Workers()) != 0 || ran {
+		t.Error("Expected no worker to start after shutdown")
+	}
+}
+
+func TestWorkers_Activity(t *testing.T) {
+	lb := newTestLoadBalancer(t, []Server{&MockServer{addr: "http://server1.com", isAlive: true}})
+	tick := make(chan struct{})
+	lb.Go(context.Background(), "ticker", func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				markActive(ctx)
+			}
+		}
+	})
+	before, _ := workerStatus(lb, "ticker")
+	time.Sleep(5 * time.Millisecond)
+	tick <- struct{}{}
+	waitFor(t, "the activity to be recorded", func() bool {
+		st, _ := workerStatus(lb, "ticker")
+		return st.LastActivity.After(before.LastActivity)
+	})
+
+	rw := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`lb_workers{state="running"} 1`, `lb_worker_restarts_total{worker="ticker"} 0`, `lb_worker_last_activity_timestamp_seconds{worker="ticker"}`} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected %q in the metrics", want)
+		}
+	}
+	rw = httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/admin/status", nil))
+	if !strings.Contains(rw.Body.String(), `"name":"ticker"`) {
+		t.Errorf("Expected the worker in the status, got %s", rw.Body.String())
+	}
+}
+
+func TestWorkers_HealthChecks(t *testing.T) {
+	backend := newBackendServer(t, okHandler)
+	server, err := newSimpleServer(backend.Address(), WithHealthCheck(HealthCheck{Path: "/", Interval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, []Server{server})
+	lb.Go(context.Background(), "health checks", lb.RunHealthChecks)
+	waitFor(t, "the probe worker to start", func() bool {
+		_, ok := workerStatus(lb, "health check of "+serverName(server))
+		return ok
+	})
+
+	if err := lb.RemoveServer(server.Address()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the probe worker to stop", func() bool {
+		_, ok := workerStatus(lb, "health check of "+serverName(server))
+		return !ok
+	})
+}